@@ -0,0 +1,69 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/bazelbuild/bazel-toolchains/pkg/rbeconfigsgen"
+)
+
+// runDiff implements the "diff" subcommand which reports the differences between two sets of
+// generated configs given the manifests and/or tarballs produced by rbe_configs_gen.
+func runDiff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	oldManifest := fs.String("old_manifest", "", "(Optional) Path to the JSON manifest of the old configs.")
+	newManifest := fs.String("new_manifest", "", "(Optional) Path to the JSON manifest of the new configs. Required if --old_manifest is specified.")
+	oldTarball := fs.String("old_tarball", "", "(Optional) Path to the old configs tarball.")
+	newTarball := fs.String("new_tarball", "", "(Optional) Path to the new configs tarball. Required if --old_tarball is specified.")
+	format := fs.String("format", "text", "(Optional) Format (text|json) of the reported differences. Defaults to text.")
+	fs.Parse(args)
+
+	if (len(*oldManifest) == 0) != (len(*newManifest) == 0) {
+		usageFatalf("both or neither of --old_manifest & --new_manifest must be specified")
+	}
+	if (len(*oldTarball) == 0) != (len(*newTarball) == 0) {
+		usageFatalf("both or neither of --old_tarball & --new_tarball must be specified")
+	}
+	if len(*oldManifest) == 0 && len(*oldTarball) == 0 {
+		usageFatalf("at least one of --old_manifest/--new_manifest or --old_tarball/--new_tarball must be specified")
+	}
+	if *format != "text" && *format != "json" {
+		usageFatalf("invalid --format %q, want text or json", *format)
+	}
+
+	o, err := rbeconfigsgen.LoadConfigSet(*oldManifest, *oldTarball)
+	if err != nil {
+		return fmt.Errorf("unable to load the old configs: %w", err)
+	}
+	n, err := rbeconfigsgen.LoadConfigSet(*newManifest, *newTarball)
+	if err != nil {
+		return fmt.Errorf("unable to load the new configs: %w", err)
+	}
+	d := rbeconfigsgen.Diff(o, n)
+	if *format == "text" {
+		fmt.Print(d.String())
+		return nil
+	}
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", " ")
+	if err := e.Encode(d); err != nil {
+		return fmt.Errorf("unable to convert the differences into JSON: %w", err)
+	}
+	return nil
+}
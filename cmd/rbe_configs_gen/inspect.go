@@ -0,0 +1,54 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/bazelbuild/bazel-toolchains/pkg/rbeconfigsgen"
+)
+
+// runInspect implements the "inspect" subcommand which prints the manifest embedded in a configs
+// tarball produced with --embed_manifest or the files at the root of the tarball if it has none.
+func runInspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	tarball := fs.String("tarball", "", "Path to the configs tarball to inspect. May be compressed with gzip or zstd.")
+	format := fs.String("format", "text", "(Optional) Format (text|json) of the printed manifest or files. Defaults to text.")
+	fs.Parse(args)
+
+	if len(*tarball) == 0 {
+		usageFatalf("--tarball must be specified")
+	}
+	if *format != "text" && *format != "json" {
+		usageFatalf("invalid --format %q, want text or json", *format)
+	}
+	c, err := rbeconfigsgen.InspectTarball(*tarball)
+	if err != nil {
+		return err
+	}
+	if *format == "text" {
+		fmt.Print(c.String())
+		return nil
+	}
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", " ")
+	if err := e.Encode(c); err != nil {
+		return fmt.Errorf("unable to convert the contents of the configs tarball into JSON: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/bazelbuild/bazel-toolchains/pkg/rbeconfigsgen"
+)
+
+// runManifest implements the "manifest" subcommand which packages an existing directory of
+// generated configs into a tarball & writes a manifest for it without running the toolchain
+// container.
+func runManifest(args []string) error {
+	fs := flag.NewFlagSet("manifest", flag.ExitOnError)
+	configsDir := fs.String("configs_dir", "", "Path to the directory containing the generated configs, i.e., the directory with the cc, java & config sub-directories.")
+	bazelVersion := fs.String("bazel_version", "", "The version of Bazel the configs were generated for.")
+	imageDigest := fs.String("image_digest", "", "The sha256 digest of the toolchain image the configs were generated for, with or without the sha256: prefix.")
+	execOS := fs.String("exec_os", "", "The OS (linux|windows) of the toolchain image.")
+	outputTarball := fs.String("output_tarball", "", "Path where the configs tarball will be written.")
+	tarballPrefix := fs.String("tarball_prefix", "", "(Optional) Directory inside the --output_tarball the configs are written under. Defaults to the root of the tarball.")
+	tarballFormat := fs.String("tarball_format", rbeconfigsgen.TarballFormatTar, "(Optional) Compression of the --output_tarball, one of tar, tar.gz or tar.zst. Defaults to tar.")
+	outputManifest := fs.String("output_manifest", "", "Path where the JSON manifest will be written.")
+	toolchainContainer := fs.String("toolchain_container", "", "(Optional) Repository path of the toolchain image the configs were generated for to be recorded in the manifest.")
+	repoName := fs.String("repo_name", rbeconfigsgen.DefaultRepoName, "(Optional) Name of the Bazel external repository the configs are expected to be imported as.")
+	platformName := fs.String("platform_name", rbeconfigsgen.DefaultPlatformName, "(Optional) Name of the platform target in the config package of the configs.")
+	javaVersion := fs.String("java_version", "", "(Optional) Version of the JDK in the toolchain image to be recorded in the manifest.")
+	fs.Parse(args)
+
+	if _, err := rbeconfigsgen.GenerateManifest(&rbeconfigsgen.ManifestOptions{
+		ConfigsDir:         *configsDir,
+		BazelVersion:       *bazelVersion,
+		ToolchainContainer: *toolchainContainer,
+		ImageDigest:        *imageDigest,
+		ExecOS:             *execOS,
+		RepoName:           *repoName,
+		PlatformName:       *platformName,
+		JavaVersion:        *javaVersion,
+		OutputTarball:      *outputTarball,
+		TarballPrefix:      *tarballPrefix,
+		TarballFormat:      *tarballFormat,
+		OutputManifest:     *outputManifest,
+	}); err != nil {
+		return fmt.Errorf("unable to generate a manifest: %w", err)
+	}
+	return nil
+}
@@ -13,47 +13,158 @@
 // limitations under the License.
 //
 // Binary rbe_configs_gen provides the ability to generate toolchain targets along with a default
-// platform target to configure Bazel to run actions remotely.
+// platform target to configure Bazel to run actions remotely. "rbe_configs_gen diff" compares two
+// sets of previously generated configs. "rbe_configs_gen manifest" produces the manifest & tarball
+// for a directory of previously generated configs without running the toolchain container.
+// "rbe_configs_gen verify" verifies a configs tarball against its manifest.
+// "rbe_configs_gen probe" is run inside toolchain containers without a shell if --no_shell is
+// specified.
 package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/bazelbuild/bazel-toolchains/pkg/logging"
 	"github.com/bazelbuild/bazel-toolchains/pkg/monitoring"
 	"github.com/bazelbuild/bazel-toolchains/pkg/rbeconfigsgen"
 )
 
 var (
 	// Mandatory input arguments.
-	toolchainContainer = flag.String("toolchain_container", "", "Repository path to toolchain image to generate configs for. E.g., l.gcr.io/google/rbe-ubuntu16-04:latest")
+	toolchainContainer = flag.String("toolchain_container", "", "Repository path to toolchain image to generate configs for. E.g., l.gcr.io/google/rbe-ubuntu16-04:latest. Only one of --toolchain_container, --image_tarball, --existing_container, --dockerfile or --apptainer_image must be specified.")
+	imageTarball       = flag.String("image_tarball", "", "Path to a tarball of the toolchain image (docker save or OCI layout format) to load into docker instead of pulling --toolchain_container from a registry.")
+	existingContainer  = flag.String("existing_container", "", "Name or ID of an already running container of the toolchain image to generate configs in instead of creating a new container, e.g., a container whose entrypoint set up the toolchain. The container isn't removed once configs are generated.")
+	dockerfile         = flag.String("dockerfile", "", "Path to a Dockerfile to build the toolchain image from locally with docker build instead of pulling --toolchain_container from a registry. The image is tagged with a unique tag in the rbe_configs_gen_build repository that's removed on cleanup & its image ID is recorded in the manifest.")
+	apptainerImage     = flag.String("apptainer_image", "", "Path to a local Apptainer (Singularity) SIF image to generate configs for with apptainer exec instead of a docker image. The path, sha256 digest & labels of the image are recorded in the manifest. Only supported for --exec_os=linux & requires --platform_image_override because remote execution backends can't pull the local image.")
+	requireDigest      = flag.Bool("require_digest", false, "(Optional) Fail unless --toolchain_container is referenced by digest, e.g., gcr.io/foo/bar@sha256:<digest>, instead of only by tag, e.g., to enforce reproducible image references in CI. The digest the image resolves to is recorded in the manifest either way. Can't be used with --image_tarball, --existing_container or --dockerfile. Defaults to false.")
+	buildContext       = flag.String("build_context", "", "(Optional) Directory to use as the build context when building --dockerfile. Defaults to the directory containing --dockerfile.")
 	execOS             = flag.String("exec_os", "", "The OS (linux|windows) of the toolchain container image a.k.a, the execution platform in Bazel.")
 	targetOS           = flag.String("target_os", "", "The OS (linux|windows) artifacts built will target a.k.a, the target platform in Bazel.")
+	execCPU            = flag.String("exec_cpu", "", "(Optional) The CPU architecture (x86_64|aarch64) of the toolchain container image a.k.a, the execution platform in Bazel. Defaults to x86_64.")
+	targetCPU          = flag.String("target_cpu", "", "(Optional) The CPU architecture (x86_64|aarch64) artifacts built will target. If it differs from --exec_cpu, C++ configs are generated for the GCC cross compiler for the target, e.g., aarch64-linux-gnu-gcc, which must be installed in the toolchain container. Only supported for --exec_os=linux & --target_os=linux when cross-compiling. Defaults to --exec_cpu.")
+	targetSysroot      = flag.String("target_sysroot", "", "(Optional) Sysroot of the generated C++ toolchain when cross-compiling to --target_cpu. Defaults to what the cross compiler reports with -print-sysroot.")
+	allowEmulation     = flag.Bool("allow_emulation", false, "(Optional) Generate configs for a toolchain image whose CPU architecture differs from the docker host, i.e., detect the toolchains under emulation, e.g., QEMU, which is slow & may detect the wrong toolchain details. Otherwise, config generation fails for such images. Defaults to false.")
 	dockerPlatform     = flag.String("docker_platform", "", "(Optional) Set platform when creating container, if given the Docker server is multi-platform capable.")
+	reuseContainer     = flag.Bool("reuse_container", true, "(Optional) Run all detection steps, e.g., detecting the C++ toolchain, the JDK & the OS, in a single toolchain container. Set to false to run each step in its own container if a step changes the container in a way that breaks another, at the cost of starting a container per step. Can't be false with --existing_container. Defaults to true.")
+	runEntrypoint      = flag.Bool("run_entrypoint", false, "(Optional) Run the ENTRYPOINT of the toolchain image with env as its arguments in the toolchain container before detection & run every detection command with the environment variables it set, e.g., for images configuring the toolchain in their entrypoint. The entrypoint must exec its arguments. Only supported for --exec_os=linux. Defaults to false.")
+	initCommand        = flag.String("init_command", "", "(Optional) Shell command run in the toolchain container before detection instead of the entrypoint like --run_entrypoint, e.g., '. /opt/toolchain/setup.sh'. Every detection command runs with the environment variables it exported. Only supported for --exec_os=linux.")
+
+	containerTmpfsSize = flag.String("container_tmpfs_size", "", "(Optional) Size of a tmpfs mounted at /tmp in the detection containers, e.g., 2g, for docker hosts whose container storage is too small for the scratch files written by detection. Whether the tmpfs counts against the memory of the container depends on the container runtime. Only supported for --exec_os=linux & can't be used with --existing_container.")
+	scratchMount       = flag.String("scratch_mount", "", "(Optional) Absolute path of a local directory bind mounted at /tmp in the detection containers instead of a tmpfs. Files written to it by detection are left behind. Only supported for --exec_os=linux & can't be used with --existing_container or --container_tmpfs_size.")
+	containerRunFlags  = stringList("container_run_flag", "(Optional, repeatable) Raw flag appended to the docker create command of the detection containers after the flags of this tool, e.g., --container_run_flag=--security-opt=seccomp=unconfined or --container_run_flag=--network=host. Pass each flag as a single argument in the --name=value form, e.g., --container_run_flag=--env=FOO=bar rather than -e FOO=bar, & give boolean flags an explicit value, e.g., --privileged=true. Values that may contain secrets, e.g., of --env, are redacted in logs. Can't be used with --existing_container.")
+	detectResources    = flag.Bool("detect_resources", false, "(Optional) Detect the CPUs & memory available to the toolchain container from /proc & its cgroup limits, log them as a starting point to size the remote workers & record them as recommended_cpu & recommended_memory in the --output_manifest. The values describe the docker host running detection, not the remote workers, so they're only advisory. Only supported for --exec_os=linux. Defaults to false.")
+
+	// Optional input arguments that affect the generated platform.
+	platformImageOverride = flag.String("platform_image_override", "", "(Optional) Image referenced by digest, e.g., docker://<mirror>/<image>@sha256:<digest>, used as the container-image of the generated platform instead of the probed toolchain image. The toolchains are still detected in the probed image.")
+	dockerNetwork         = flag.String("docker_network", "", "(Optional) Network access of remote actions running on the generated platform set as the dockerNetwork exec property, one of standard or off. The exec property isn't set if unspecified.")
+	dockerRunAsRoot       = flag.Bool("docker_run_as_root", false, "(Optional) Set the dockerRunAsRoot exec property of the generated platform to run remote actions as root. Defaults to false.")
+	dockerPrivileged      = flag.Bool("docker_privileged", false, "(Optional) Set the dockerPrivileged exec property of the generated platform to run remote actions in a privileged container. Defaults to false.")
+	supportsWorkers       = flag.Bool("supports_workers", false, "(Optional) Set the supportsWorkers exec property of the generated platform for remote execution backends implementing remote persistent workers. Defaults to false.")
+	workerKeyMnemonics    = flag.String("worker_key_mnemonics", "", "(Optional) Comma separated mnemonics of the actions to run in remote persistent workers, e.g., Javac,Scalac, set as the workerKeyMnemonics exec property of the generated platform. Requires --supports_workers.")
+	platformConstraints   = stringList("platform_constraint", "(Optional, repeatable) Label of an existing constraint value, e.g., @mycorp//constraints:toolchain_flavor, to add to the constraint_values of the generated platform. The constraint isn't defined by the generated configs.")
+
+	// Optional input arguments that affect pulling the toolchain image & downloads.
+	registryCACert   = flag.String("registry_ca_cert", "", "(Optional) Path to a file with PEM encoded CA certificates to trust in addition to the system trust store when pulling --toolchain_container & downloading Bazelisk, e.g., for a registry using a private CA. The certificates are installed into the certificate directory of the local docker daemon for the registry while the image is pulled.")
+	httpUserAgent    = flag.String("http_user_agent", "", "(Optional) User-Agent of outbound HTTP requests, i.e., looking up Bazel releases & downloading Bazelisk, e.g., for proxies allowlisting clients by User-Agent. Defaults to rbe_configs_gen/<version>.")
+	bazeliskSHA256   = flag.String("bazelisk_sha256", "", "(Optional) Expected sha256 digest of the Bazelisk executable downloaded into the toolchain container for --exec_os & --exec_cpu. Config generation fails if the downloaded executable doesn't match. Defaults to the digest known for the downloaded Bazelisk release. Required if no digest is known for it, in which case Bazelisk isn't downloaded without it.")
+	insecureRegistry = flag.Bool("insecure_registry", false, "(Optional) Skip TLS certificate verification for downloads. Only use this with development registries. The registry must also be listed in the insecure-registries of the docker daemon configuration to pull from it. Defaults to false.")
+
+	// Optional input arguments for toolchain images without a shell.
+	noShell     = flag.Bool("no_shell", false, "(Optional) Run commands in the toolchain container directly without relying on a shell or shell utilities like mkdir, find & tar, e.g., for distroless images. The --probe_helper is copied into the toolchain container to perform these operations instead. Only supported for --exec_os=linux. Defaults to false.")
+	probeHelper = flag.String("probe_helper", "", "(Optional) Path to a statically linked Linux build of rbe_configs_gen, e.g., built with CGO_ENABLED=0, copied into the toolchain container if --no_shell is specified. Defaults to this binary.")
 
 	// Optional input arguments.
-	bazelVersion = flag.String("bazel_version", "", "(Optional) Bazel release version to generate configs for. E.g., 4.0.0. If unspecified, the latest available Bazel release is picked.")
-	bazelPath    = flag.String("bazel_path", "", "(Optional) Path to preinstalled Bazel within the container. If unspecified, Bazelisk will be downloaded and installed.")
+	bazelVersion     = flag.String("bazel_version", "", "(Optional) Bazel release version to generate configs for. E.g., 4.0.0. If unspecified, the latest available Bazel release is picked.")
+	skipVersionCheck = flag.Bool("skip_version_check", false, "(Optional) Skip verifying that --bazel_version is a published Bazel release on GitHub before generating configs, e.g., for unreleased custom builds of Bazel. Defaults to false.")
+	minBazelVersion  = flag.String("min_bazel_version", "", "(Optional) Minimum Bazel version (inclusive) the generated configs are recorded as compatible with in the --output_manifest. Defaults to the last known Bazel version at or before --bazel_version where the rules used by the configs changed, if any.")
+	maxBazelVersion  = flag.String("max_bazel_version", "", "(Optional) First Bazel version the generated configs are recorded as incompatible with in the --output_manifest, i.e., the maximum is exclusive. Defaults to the first known Bazel version after --bazel_version where the rules used by the configs change, if any.")
+	bazelPath        = flag.String("bazel_path", "", "(Optional) Path to preinstalled Bazel within the container. If unspecified, Bazelisk will be downloaded and installed.")
 
 	// Arguments affecting output generation not specific to either C++ or Java Configs.
-	outputTarball    = flag.String("output_tarball", "", "(Optional) Path where a tarball with the generated configs will be created.")
+	outputTarball    = flag.String("output_tarball", "", "(Optional) Path where a tarball with the generated configs will be created. Use '-' to stream the tarball to stdout in which case all logs are written to stderr.")
+	tarballPrefix    = flag.String("tarball_prefix", "", "(Optional) Directory inside the --output_tarball the generated configs are written under, e.g., rbe_default. Specify the same directory as the strip_prefix of the http_archive importing the tarball. Defaults to the root of the tarball.")
+	tarballFormat    = flag.String("tarball_format", rbeconfigsgen.TarballFormatTar, "(Optional) Compression of the --output_tarball, one of tar, tar.gz or tar.zst. Import a compressed tarball with an http_archive whose type matches the format, e.g., type = \"tar.zst\". Defaults to tar.")
 	outputSrcRoot    = flag.String("output_src_root", "", "(Optional) Path to root directory of Bazel repository where generated configs should be copied to. Configs aren't copied if this is blank. Use '.' to specify the current directory.")
 	outputConfigPath = flag.String("output_config_path", "", "(Optional) Path relative to what was specified to --output_src_root where configs will be extracted. Defaults to root if unspecified. --output_src_root is mandatory if this argument is specified.")
+	noTarball        = flag.Bool("no_tarball", false, "(Optional) Only copy the generated configs to --output_src_root without creating a configs tarball, e.g., for configs imported with new_local_repository. The manifest records the configs_dir_digest of the copied configs instead of the configs_tarball_digest. Can't be used with --output_tarball. Defaults to false.")
 	outputManifest   = flag.String("output_manifest", "", "(Optional) Generate a JSON file with details about the generated configs.")
+	embedManifest    = flag.Bool("embed_manifest", false, "(Optional) Also write the JSON manifest into the --output_tarball as config/manifest.json under the --tarball_prefix. The embedded manifest doesn't include the configs_tarball_digest because it can't contain the digest of the tarball it's part of. Defaults to false.")
+	repoName         = flag.String("repo_name", rbeconfigsgen.DefaultRepoName, "(Optional) Name of the Bazel external repository the generated configs will be imported as. Used in the labels of the summary & recorded in the manifest. Defaults to rbe_default.")
+	platformName     = flag.String("platform_name", rbeconfigsgen.DefaultPlatformName, "(Optional) Name of the generated platform target in the config package, e.g., to tell the platforms of several config sets imported into one repository apart. Used in the labels of the summary, the aliases & the --bazelrc_output & recorded in the manifest. Defaults to platform.")
+	outputSummary    = flag.String("output_summary", "", "(Optional) Generate a JSON file listing the Bazel labels of the generated toolchain & platform targets.")
+	postHook         = flag.String("post_hook", "", "(Optional) Path to an executable run after the configs were generated with the directory containing the generated configs & the --output_manifest path as arguments. Config generation fails if it exits with a non-zero exit code.")
+	simulateRBE      = flag.Bool("simulate_rbe", false, "(Optional) Build hello world C++ & Java targets with the generated configs using Bazel with local execution inside a fresh toolchain container as a cheap check of the configs without a remote execution service. Config generation fails if the build fails. Only supported for --exec_os=linux. Defaults to false.")
+	dumpFacts        = flag.String("dump_detection_facts", "", "(Optional) Path where the facts detected in the toolchain container, e.g., the C++ compiler, its builtin include directories, the JDK & the C library, are written to as JSON instead of generating configs. The facts are detected exactly like they are to generate configs. Can't be used with the flags specifying where configs are written.")
+	validateOnly     = flag.String("validate_only", "", "(Optional) Path to a directory with previously generated configs, e.g., committed at --output_config_path in a source repository. The configs are generated into a temporary directory instead & compared file by file with the ones in this directory by digest. Exits with a non-zero exit code listing the files that differ if they don't match. Specify the --output_src_root & --output_config_path the configs were committed with so the labels in the generated configs match, nothing is written to them. Can't be used with the other flags specifying where configs are written.")
+	warningsAsErrors = flag.Bool("warnings_as_errors", false, "(Optional) Fail with the exit code of detection failures instead of generating configs if any warnings were reported while detecting the toolchains, e.g., a C++ compiler that didn't report its version or builtin include directories listed more than once. Warnings are logged with a code identifying their kind & listed in the --output_summary either way. Defaults to false.")
+	formatBuildFiles = flag.Bool("format_build_files", false, "(Optional) Format the generated BUILD & .bzl files, including the C++ configs generated by Bazel, with buildifier so they match a buildifier formatted source tree. Defaults to false.")
+	buildifierPath   = flag.String("buildifier_path", "", "(Optional) Path to the buildifier binary used by --format_build_files. Defaults to buildifier on the PATH.")
+	printSummary     = flag.Bool("print_summary", false, "(Optional) Print the JSON summary of the Bazel labels of the generated toolchain & platform targets to stdout.")
+	printExecProps   = flag.Bool("print_exec_properties", false, "(Optional) Print the JSON map of the exec_properties of the platform that would be generated with the other flags to stdout & exit without generating configs. A --toolchain_container referenced by tag is printed as is instead of the digest it resolves to once pulled.")
+
+	// Optional arguments for the generated bazelrc.
+	bazelrcOutput       = flag.String("bazelrc_output", "", "(Optional) Path where a bazelrc fragment configuring Bazel to run remote builds using the generated configs with --config=remote will be written to.")
+	bazelrcConfigsURL   = flag.String("bazelrc_configs_url", "", "(Optional) URL the configs tarball will be uploaded to, recorded in a comment in the --bazelrc_output.")
+	remoteExecutor      = flag.String("remote_executor", "", "(Optional) grpc:// or grpcs:// endpoint of the remote execution service set as --remote_executor in the --bazelrc_output.")
+	remoteInstance      = flag.String("remote_instance_name", "", "(Optional) Remote instance name set as --remote_instance_name in the --bazelrc_output.")
+	googleCredentials   = flag.Bool("google_default_credentials", false, "(Optional) Authenticate to the remote execution service with Google application default credentials in the --bazelrc_output. Defaults to false.")
+	bazelrcBazelVersion = flag.String("bazelrc_bazel_version", "", "(Optional) Bazel version the --bazelrc_output is generated for if it differs from --bazel_version, e.g., to select the Java runtime of configs generated with --java_compat=both for another Bazel version. Defaults to --bazel_version.")
+
+	// Optional arguments for generating configs for several toolchain images in one run.
+	batchFile   = flag.String("batch_file", "", "(Optional) Path to a JSON list of objects with the toolchain_container, the exec_cpu (optional), the output_tarball & the output_manifest (optional) of each toolchain image to generate configs for, instead of --toolchain_container, --output_tarball & --output_manifest. All other flags apply to every image.")
+	maxParallel = flag.Int("max_parallel", 0, "(Optional) Maximum number of toolchain images in the --batch_file probed concurrently. Defaults to the number of CPUs.")
+	failFast    = flag.Bool("fail_fast", false, "(Optional) Stop generating configs for the remaining toolchain images in the --batch_file once an image failed. Otherwise, the failures of all images are reported at the end. Defaults to false.")
 
 	// Optional input arguments that affect config generation for either C++ or Java configs.
-	genCppConfigs       = flag.Bool("generate_cpp_configs", true, "(Optional) Generate C++ configs. Defaults to true.")
-	cppEnvJSON          = flag.String("cpp_env_json", "", "(Optional) JSON file containing a str -> str dict of environment variables to be set when generating C++ configs inside the toolchain container. This replaces any exec OS specific defaults that would usually be applied.")
-	cppToolchainTarget  = flag.String("cpp_toolchain_target", "", "(Optional) Set the CPP toolchain target. When exec_os is linux, the default is cc-compiler-k8. When exec_os is windows, the default is cc-compiler-x64_windows.")
-	genJavaConfigs      = flag.Bool("generate_java_configs", true, "(Optional) Generate Java configs. Defaults to true.")
-	javaUseLocalRuntime = flag.Bool("java_use_local_runtime", false, "(Optional) Make the generated java toolchain use the new local_java_runtime rule instead of java_runtime. Otherwise, the Bazel version will be used to infer which rule to use.")
+	genCppConfigs                = flag.Bool("generate_cpp_configs", true, "(Optional) Generate C++ configs. Defaults to true.")
+	cppEnvJSON                   = flag.String("cpp_env_json", "", "(Optional) JSON file containing a str -> str dict of environment variables to be set when generating C++ configs inside the toolchain container. This replaces any exec OS specific defaults that would usually be applied.")
+	cppCompiler                  = flag.String("cpp_compiler", "", "(Optional) Name of the C++ compiler Bazel uses to generate C++ configs, one of gcc, g++, clang or clang++. Overrides CC in the C++ config generation environment. Config generation fails with the list of found compilers if it isn't in the toolchain container. Only supported for --exec_os=linux. Defaults to the compiler specified by CC.")
+	cppStdlib                    = flag.String("cpp_stdlib", "", "(Optional) C++ standard library to generate C++ configs for, one of libc++ or libstdc++. Adds -stdlib to BAZEL_CXXOPTS so the builtin include directories of the selected library are detected & to BAZEL_LINKOPTS for libc++. Requires clang, e.g., with --cpp_compiler=clang, & fails if the detected compiler is GCC. Only supported for --exec_os=linux. Defaults to the standard library of the compiler.")
+	cppToolchainTarget           = flag.String("cpp_toolchain_target", "", "(Optional) Set the CPP toolchain target. When exec_os is linux, the default is cc-compiler-k8. When exec_os is windows, the default is cc-compiler-x64_windows.")
+	cxxBuiltinIncludeDirs        = stringList("cxx_builtin_include_dir", "(Optional, repeatable) Builtin include directory of the C++ toolchain. If specified, replaces the cxx_builtin_include_directories detected by Bazel entirely.")
+	extraCxxBuiltinIncludeDirs   = stringList("extra_cxx_builtin_include_dir", "(Optional, repeatable) Builtin include directory appended to the cxx_builtin_include_directories of the C++ toolchain.")
+	excludeCxxBuiltinIncludeDirs = stringList("exclude_cxx_builtin_include_dir", "(Optional, repeatable) Builtin include directory removed from the cxx_builtin_include_directories detected by Bazel, e.g., a compiler resource directory that doesn't exist on the remote workers. Can't be specified with --cxx_builtin_include_dir. With --verify_cpp, a warning is logged if a standard library header is only inside an excluded directory. Only supported for --exec_os=linux.")
+	linkerFlags                  = stringList("linker_flag", "(Optional, repeatable) Flag appended to the link_flags of the C++ toolchain, e.g., -static. Only supported for --exec_os=linux.")
+	replaceLinkerFlags           = flag.Bool("replace_linker_flags", false, "(Optional) Replace the link_flags of the C++ toolchain detected by Bazel with the --linker_flag values in the given order instead of appending them. Defaults to false.")
+	verifyCpp                    = flag.Bool("verify_cpp", false, "(Optional) Verify the generated C++ configs against the toolchain container, e.g., the builtin include directories must exist in the container & a program must link with the --linker_flag values. Defaults to false.")
+	cppToolchainResolution       = flag.Bool("cc_toolchain_resolution", false, "(Optional) The generated C++ configs will be used with --incompatible_enable_cc_toolchain_resolution, i.e., without --crosstool_top, even if the Bazel version doesn't enable it by default. Otherwise, the Bazel version is used to infer whether it's enabled. Defaults to false.")
+	genJavaConfigs               = flag.Bool("generate_java_configs", true, "(Optional) Generate Java configs. Defaults to true.")
+	only                         = flag.String("only", rbeconfigsgen.OnlyAll, "(Optional) Only write the config files of one kind, one of platform (config/BUILD), cc (the C++ configs), java (java/BUILD) or rust (the Rust configs), running only the detection needed for them. The manifest records the generation as partial. Defaults to all.")
+	javaUseLocalRuntime          = flag.Bool("java_use_local_runtime", false, "(Optional) Make the generated java toolchain use the new local_java_runtime rule instead of java_runtime. Otherwise, the Bazel version will be used to infer which rule to use.")
+	genRust                      = flag.Bool("gen_rust", false, "(Optional) Detect the rustc installed in the toolchain container & generate the rust package with its version & sysroot for rules_rust, e.g., @rbe_default//rust:toolchain.bzl. Only supported for --exec_os=linux. Defaults to false.")
+	javaHome                     = flag.String("java_home", "", "(Optional) Path of the JDK inside the toolchain container to use as the java_home of the generated Java runtime instead of the value of JAVA_HOME in the toolchain image. The path must contain bin/java inside the container.")
+	javaSourceVersion            = flag.String("java_source_version", "", "(Optional) Java source version, e.g., 11, of a Java toolchain generated in java/BUILD with default_java_toolchain in addition to the Java runtime. Bazel resolves it for --java_language_version=<version>. Requires the local_java_runtime rule, i.e., Bazel >= 5.0.0 or --java_use_local_runtime.")
+	javaTargetVersion            = flag.String("java_target_version", "", "(Optional) Java target version of the Java toolchain generated for --java_source_version. Defaults to --java_source_version.")
+	javaCompat                   = flag.String("java_compat", rbeconfigsgen.JavaCompatVersion, "(Optional) Java toolchain rules used in java/BUILD, one of version (the rules used by --bazel_version) or both (the java_runtime used as --javabase by Bazel < 5.0.0 & the local_java_runtime based toolchains used by newer versions) so one set of configs works while migrating across Bazel 5.0.0. The manifest records both & --bazelrc_bazel_version selects the flags of another Bazel version. Can't be used with --java_use_local_runtime or Bazel >= 7.0.0. Defaults to version.")
+	strictJavaVersion            = flag.Bool("strict_java_version", false, "(Optional) Fail instead of only warning when the JDK in the toolchain container is older than the JDK expected by the Java toolchain rules used by the Bazel version. Defaults to false.")
+
+	// Optional arguments that affect the features of the generated C++ toolchain. Features that
+	// aren't specified keep the defaults of the C++ toolchain generated by Bazel.
+	cppSupportsPIC           = optionalBool("cpp_supports_pic", "(Optional) Enable (true) or disable (false) the supports_pic feature of the generated C++ toolchain. Only supported for --exec_os=linux.")
+	cppPerObjectDebugInfo    = optionalBool("cpp_per_object_debug_info", "(Optional) Enable (true) or disable (false) the per_object_debug_info feature of the generated C++ toolchain. Only supported for --exec_os=linux.")
+	cppSupportsDynamicLinker = optionalBool("cpp_supports_dynamic_linker", "(Optional) Enable (true) or disable (false) the supports_dynamic_linker feature of the generated C++ toolchain. Only supported for --exec_os=linux.")
+	extraCppFeatures         = stringList("extra_cpp_feature", "(Optional, repeatable) Feature appended to the features of the generated C++ toolchain. Either the name of a feature enabled without any flags, e.g., asan, or a raw Starlark feature(...) expression used verbatim. Only supported for --exec_os=linux.")
+	cppActions               = flag.String("cpp_actions", "", "(Optional) Comma separated groups of actions the generated C++ toolchain is also configured for with action configs running its compiler, any of objc (objc-compile & objc++-compile) or asm (assemble & preprocess-assemble). Config generation fails unless the compiler in the toolchain container supports the languages of the actions. Only supported for --exec_os=linux.")
 
 	// Other misc arguments.
 	tempWorkDir = flag.String("temp_work_dir", "", "(Optional) Temporary directory to use to store intermediate files. Defaults to a temporary directory automatically allocated by the OS. The temporary working directory is deleted at the end unless --cleanup=false is specified.")
-	cleanup     = flag.Bool("cleanup", true, "(Optional) Stop running container & delete intermediate files. Defaults to true. Set to false for debugging.")
+	logLevel    = flag.String("log_level", "info", "(Optional) Minimum level (debug|info|warn|error) of log messages to print. Defaults to info.")
+	quiet       = flag.Bool("quiet", false, "(Optional) Only print warnings, errors & the location of the output manifest. Overrides --log_level.")
+	cleanup     = flag.Bool("cleanup", true, "(Optional) Stop running container, remove the image built from --dockerfile & delete intermediate files. Defaults to true. Set to false for debugging.")
+	cacheDir    = flag.String("cache_dir", "", "(Optional) Local directory to cache facts detected in the toolchain container keyed by the image digest. Later runs against the same image digest reuse cached facts instead of running the toolchain container, without pulling --toolchain_container if the registry allows resolving its digest anonymously.")
+	noCache     = flag.Bool("no_cache", false, "(Optional) Ignore facts cached in --cache_dir and detect them afresh in the toolchain container. The cache is updated with the new results.")
+	version     = flag.Bool("version", false, "(Optional) Print the version of rbe_configs_gen recorded as generator_version in the manifest & exit.")
 
 	// Google Cloud Monitoring options. Used by internal automation only.
 	enableMonitoring      = flag.Bool("enable_monitoring", false, "(Optional) Enables reporting reporting results to Google Cloud Monitoring. Defaults to false.")
@@ -61,55 +172,383 @@ var (
 	monitoringDockerImage = flag.String("monitoring_docker_image", "", "Name of the toolchain docker image to be reported as a string label to monitoring. Required if --enable_monitoring is true.")
 )
 
+// stringListFlag is a flag.Value accumulating the values of a flag that can be repeated.
+type stringListFlag []string
+
+func (s *stringListFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringListFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// stringList defines a repeatable string flag with the given name & usage.
+func stringList(name, usage string) *stringListFlag {
+	s := &stringListFlag{}
+	flag.Var(s, name, usage)
+	return s
+}
+
+// splitList returns the non-empty comma separated values in the given flag value.
+func splitList(v string) []string {
+	var result []string
+	for _, e := range strings.Split(v, ",") {
+		if e = strings.TrimSpace(e); len(e) != 0 {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// optionalBoolFlag is a flag.Value for a boolean flag that distinguishes being unset from false.
+type optionalBoolFlag struct {
+	v *bool
+}
+
+func (b *optionalBoolFlag) String() string {
+	if b.v == nil {
+		return ""
+	}
+	return strconv.FormatBool(*b.v)
+}
+
+func (b *optionalBoolFlag) Set(v string) error {
+	p, err := strconv.ParseBool(v)
+	if err != nil {
+		return err
+	}
+	b.v = &p
+	return nil
+}
+
+// IsBoolFlag allows specifying the flag without a value to set it to true.
+func (b *optionalBoolFlag) IsBoolFlag() bool {
+	return true
+}
+
+// optionalBool defines a boolean flag with the given name & usage that's unset by default.
+func optionalBool(name, usage string) *optionalBoolFlag {
+	b := &optionalBoolFlag{}
+	flag.Var(b, name, usage)
+	return b
+}
+
+// cppFeatureFlags maps the names of the C++ toolchain features to the flags enabling or disabling
+// them.
+var cppFeatureFlags = []struct {
+	feature string
+	flag    string
+	value   *optionalBoolFlag
+}{
+	{"supports_pic", "cpp_supports_pic", cppSupportsPIC},
+	{"per_object_debug_info", "cpp_per_object_debug_info", cppPerObjectDebugInfo},
+	{"supports_dynamic_linker", "cpp_supports_dynamic_linker", cppSupportsDynamicLinker},
+}
+
+// cppFeatures returns the C++ toolchain features enabled or disabled by the command line flags.
+func cppFeatures() map[string]bool {
+	result := map[string]bool{}
+	for _, f := range cppFeatureFlags {
+		if f.value.v != nil {
+			result[f.feature] = *f.value.v
+		}
+	}
+	return result
+}
+
 // printFlag prints flag values with the intent of allowing easy copy paste of flags to rerun this
 // binary. Printing defaults are skipped as much as possible to avoid cluttering the output.
 func printFlags() {
-	log.Println("rbe_configs_gen.go \\")
-	log.Printf("--toolchain_container=%q \\", *toolchainContainer)
-	log.Printf("--exec_os=%q \\", *execOS)
-	log.Printf("--target_os=%q \\", *targetOS)
-	log.Printf("--bazel_version=%q \\", *bazelVersion)
+	logging.Infof("rbe_configs_gen.go \\")
+	logging.Infof("--toolchain_container=%q \\", *toolchainContainer)
+	if *requireDigest {
+		logging.Infof("--require_digest=%v \\", *requireDigest)
+	}
+	if len(*imageTarball) != 0 {
+		logging.Infof("--image_tarball=%q \\", *imageTarball)
+	}
+	if len(*existingContainer) != 0 {
+		logging.Infof("--existing_container=%q \\", *existingContainer)
+	}
+	if len(*dockerfile) != 0 {
+		logging.Infof("--dockerfile=%q \\", *dockerfile)
+	}
+	if len(*buildContext) != 0 {
+		logging.Infof("--build_context=%q \\", *buildContext)
+	}
+	if len(*apptainerImage) != 0 {
+		logging.Infof("--apptainer_image=%q \\", *apptainerImage)
+	}
+	if len(*registryCACert) != 0 {
+		logging.Infof("--registry_ca_cert=%q \\", *registryCACert)
+	}
+	if *insecureRegistry {
+		logging.Infof("--insecure_registry=%v \\", *insecureRegistry)
+	}
+	if len(*httpUserAgent) != 0 {
+		logging.Infof("--http_user_agent=%q \\", *httpUserAgent)
+	}
+	if len(*bazeliskSHA256) != 0 {
+		logging.Infof("--bazelisk_sha256=%q \\", *bazeliskSHA256)
+	}
+	if len(*platformImageOverride) != 0 {
+		logging.Infof("--platform_image_override=%q \\", *platformImageOverride)
+	}
+	for _, c := range *platformConstraints {
+		logging.Infof("--platform_constraint=%q \\", c)
+	}
+	if len(*dockerNetwork) != 0 {
+		logging.Infof("--docker_network=%q \\", *dockerNetwork)
+	}
+	if *dockerRunAsRoot {
+		logging.Infof("--docker_run_as_root=%v \\", *dockerRunAsRoot)
+	}
+	if *dockerPrivileged {
+		logging.Infof("--docker_privileged=%v \\", *dockerPrivileged)
+	}
+	if *supportsWorkers {
+		logging.Infof("--supports_workers=%v \\", *supportsWorkers)
+	}
+	if len(*workerKeyMnemonics) != 0 {
+		logging.Infof("--worker_key_mnemonics=%q \\", *workerKeyMnemonics)
+	}
+	if *noShell {
+		logging.Infof("--no_shell=%v \\", *noShell)
+	}
+	if len(*probeHelper) != 0 {
+		logging.Infof("--probe_helper=%q \\", *probeHelper)
+	}
+	logging.Infof("--exec_os=%q \\", *execOS)
+	logging.Infof("--target_os=%q \\", *targetOS)
+	if len(*execCPU) != 0 {
+		logging.Infof("--exec_cpu=%q \\", *execCPU)
+	}
+	if len(*targetCPU) != 0 {
+		logging.Infof("--target_cpu=%q \\", *targetCPU)
+	}
+	if len(*targetSysroot) != 0 {
+		logging.Infof("--target_sysroot=%q \\", *targetSysroot)
+	}
+	if *allowEmulation {
+		logging.Infof("--allow_emulation=%v \\", *allowEmulation)
+	}
+	if !*reuseContainer {
+		logging.Infof("--reuse_container=%v \\", *reuseContainer)
+	}
+	if *runEntrypoint {
+		logging.Infof("--run_entrypoint=%v \\", *runEntrypoint)
+	}
+	if len(*initCommand) != 0 {
+		logging.Infof("--init_command=%q \\", *initCommand)
+	}
+	if len(*containerTmpfsSize) != 0 {
+		logging.Infof("--container_tmpfs_size=%q \\", *containerTmpfsSize)
+	}
+	if len(*scratchMount) != 0 {
+		logging.Infof("--scratch_mount=%q \\", *scratchMount)
+	}
+	for _, f := range *containerRunFlags {
+		logging.Infof("--container_run_flag=%q \\", rbeconfigsgen.RedactContainerRunFlag(f))
+	}
+	if *detectResources {
+		logging.Infof("--detect_resources=%v \\", *detectResources)
+	}
+	logging.Infof("--bazel_version=%q \\", *bazelVersion)
+	if *skipVersionCheck {
+		logging.Infof("--skip_version_check=%v \\", *skipVersionCheck)
+	}
+	if len(*minBazelVersion) != 0 {
+		logging.Infof("--min_bazel_version=%q \\", *minBazelVersion)
+	}
+	if len(*maxBazelVersion) != 0 {
+		logging.Infof("--max_bazel_version=%q \\", *maxBazelVersion)
+	}
 	if len(*bazelPath) != 0 {
-		log.Printf("--bazel_path=%q \\", *bazelPath)
+		logging.Infof("--bazel_path=%q \\", *bazelPath)
 	}
 	if len(*outputTarball) != 0 {
-		log.Printf("--output_tarball=%q \\", *outputTarball)
+		logging.Infof("--output_tarball=%q \\", *outputTarball)
+	}
+	if len(*tarballPrefix) != 0 {
+		logging.Infof("--tarball_prefix=%q \\", *tarballPrefix)
+	}
+	if *tarballFormat != rbeconfigsgen.TarballFormatTar {
+		logging.Infof("--tarball_format=%q \\", *tarballFormat)
 	}
 	if len(*outputSrcRoot) != 0 {
-		log.Printf("--output_src_root=%q \\", *outputSrcRoot)
+		logging.Infof("--output_src_root=%q \\", *outputSrcRoot)
 	}
 	if len(*outputConfigPath) != 0 {
-		log.Printf("--output_config_path=%q \\", *outputConfigPath)
+		logging.Infof("--output_config_path=%q \\", *outputConfigPath)
+	}
+	if *noTarball {
+		logging.Infof("--no_tarball=%v \\", *noTarball)
 	}
 	if len(*outputManifest) != 0 {
-		log.Printf("--output_manifest=%q \\", *outputManifest)
+		logging.Infof("--output_manifest=%q \\", *outputManifest)
+	}
+	if *embedManifest {
+		logging.Infof("--embed_manifest=%v \\", *embedManifest)
+	}
+	if len(*bazelrcOutput) != 0 {
+		logging.Infof("--bazelrc_output=%q \\", *bazelrcOutput)
+	}
+	if len(*bazelrcConfigsURL) != 0 {
+		logging.Infof("--bazelrc_configs_url=%q \\", *bazelrcConfigsURL)
+	}
+	if len(*remoteExecutor) != 0 {
+		logging.Infof("--remote_executor=%q \\", *remoteExecutor)
+	}
+	if len(*remoteInstance) != 0 {
+		logging.Infof("--remote_instance_name=%q \\", *remoteInstance)
+	}
+	if *googleCredentials {
+		logging.Infof("--google_default_credentials=%v \\", *googleCredentials)
+	}
+	if len(*bazelrcBazelVersion) != 0 {
+		logging.Infof("--bazelrc_bazel_version=%q \\", *bazelrcBazelVersion)
+	}
+	if len(*batchFile) != 0 {
+		logging.Infof("--batch_file=%q \\", *batchFile)
+	}
+	if *maxParallel != 0 {
+		logging.Infof("--max_parallel=%d \\", *maxParallel)
+	}
+	if *failFast {
+		logging.Infof("--fail_fast=%v \\", *failFast)
+	}
+	if *repoName != rbeconfigsgen.DefaultRepoName {
+		logging.Infof("--repo_name=%q \\", *repoName)
+	}
+	if *platformName != rbeconfigsgen.DefaultPlatformName {
+		logging.Infof("--platform_name=%q \\", *platformName)
+	}
+	if len(*outputSummary) != 0 {
+		logging.Infof("--output_summary=%q \\", *outputSummary)
+	}
+	if len(*postHook) != 0 {
+		logging.Infof("--post_hook=%q \\", *postHook)
+	}
+	if *simulateRBE {
+		logging.Infof("--simulate_rbe=%v \\", *simulateRBE)
+	}
+	if len(*dumpFacts) != 0 {
+		logging.Infof("--dump_detection_facts=%q \\", *dumpFacts)
+	}
+	if len(*validateOnly) != 0 {
+		logging.Infof("--validate_only=%q \\", *validateOnly)
+	}
+	if *warningsAsErrors {
+		logging.Infof("--warnings_as_errors=%v \\", *warningsAsErrors)
+	}
+	if *formatBuildFiles {
+		logging.Infof("--format_build_files=%v \\", *formatBuildFiles)
+	}
+	if len(*buildifierPath) != 0 {
+		logging.Infof("--buildifier_path=%q \\", *buildifierPath)
+	}
+	if *printSummary {
+		logging.Infof("--print_summary=%v \\", *printSummary)
+	}
+	if *printExecProps {
+		logging.Infof("--print_exec_properties=%v \\", *printExecProps)
 	}
 	if !(*genCppConfigs) {
-		log.Printf("--generate_cpp_configs=%v \\", *genCppConfigs)
+		logging.Infof("--generate_cpp_configs=%v \\", *genCppConfigs)
 	}
 	if len(*cppEnvJSON) != 0 {
-		log.Printf("--cpp_env_json=%q \\", *cppEnvJSON)
+		logging.Infof("--cpp_env_json=%q \\", *cppEnvJSON)
+	}
+	if len(*cppCompiler) != 0 {
+		logging.Infof("--cpp_compiler=%q \\", *cppCompiler)
+	}
+	if len(*cppStdlib) != 0 {
+		logging.Infof("--cpp_stdlib=%q \\", *cppStdlib)
+	}
+	for _, d := range *cxxBuiltinIncludeDirs {
+		logging.Infof("--cxx_builtin_include_dir=%q \\", d)
+	}
+	for _, d := range *extraCxxBuiltinIncludeDirs {
+		logging.Infof("--extra_cxx_builtin_include_dir=%q \\", d)
+	}
+	for _, d := range *excludeCxxBuiltinIncludeDirs {
+		logging.Infof("--exclude_cxx_builtin_include_dir=%q \\", d)
+	}
+	for _, f := range *linkerFlags {
+		logging.Infof("--linker_flag=%q \\", f)
+	}
+	if *replaceLinkerFlags {
+		logging.Infof("--replace_linker_flags=%v \\", *replaceLinkerFlags)
+	}
+	for _, f := range cppFeatureFlags {
+		if f.value.v != nil {
+			logging.Infof("--%s=%v \\", f.flag, *f.value.v)
+		}
+	}
+	if len(*cppActions) != 0 {
+		logging.Infof("--cpp_actions=%q \\", *cppActions)
+	}
+	for _, f := range *extraCppFeatures {
+		logging.Infof("--extra_cpp_feature=%q \\", f)
+	}
+	if *verifyCpp {
+		logging.Infof("--verify_cpp=%v \\", *verifyCpp)
+	}
+	if *cppToolchainResolution {
+		logging.Infof("--cc_toolchain_resolution=%v \\", *cppToolchainResolution)
 	}
 	if !(*genJavaConfigs) {
-		log.Printf("--generate_java_configs=%v \\", *genJavaConfigs)
+		logging.Infof("--generate_java_configs=%v \\", *genJavaConfigs)
+	}
+	if *only != rbeconfigsgen.OnlyAll {
+		logging.Infof("--only=%q \\", *only)
 	}
 	if *javaUseLocalRuntime {
-		log.Printf("--java_use_local_runtime=%v \\", *javaUseLocalRuntime)
+		logging.Infof("--java_use_local_runtime=%v \\", *javaUseLocalRuntime)
+	}
+	if *genRust {
+		logging.Infof("--gen_rust=%v \\", *genRust)
+	}
+	if len(*javaHome) != 0 {
+		logging.Infof("--java_home=%q \\", *javaHome)
+	}
+	if len(*javaSourceVersion) != 0 {
+		logging.Infof("--java_source_version=%q \\", *javaSourceVersion)
+	}
+	if len(*javaTargetVersion) != 0 {
+		logging.Infof("--java_target_version=%q \\", *javaTargetVersion)
+	}
+	if *javaCompat != rbeconfigsgen.JavaCompatVersion {
+		logging.Infof("--java_compat=%q \\", *javaCompat)
+	}
+	if *strictJavaVersion {
+		logging.Infof("--strict_java_version=%v \\", *strictJavaVersion)
 	}
 	if len(*tempWorkDir) != 0 {
-		log.Printf("--temp_work_dir=%q \\", *tempWorkDir)
+		logging.Infof("--temp_work_dir=%q \\", *tempWorkDir)
+	}
+	if *logLevel != "info" {
+		logging.Infof("--log_level=%q \\", *logLevel)
 	}
 	if !(*cleanup) {
-		log.Printf("--cleanup=%v \\", *cleanup)
+		logging.Infof("--cleanup=%v \\", *cleanup)
+	}
+	if len(*cacheDir) != 0 {
+		logging.Infof("--cache_dir=%q \\", *cacheDir)
+	}
+	if *noCache {
+		logging.Infof("--no_cache=%v \\", *noCache)
 	}
 	if *enableMonitoring {
-		log.Printf("--enable_monitoring=%v \\", *enableMonitoring)
+		logging.Infof("--enable_monitoring=%v \\", *enableMonitoring)
 	}
 	if len(*monitoringProjectID) != 0 {
-		log.Printf("--monitoring_project_id=%q \\", *monitoringProjectID)
+		logging.Infof("--monitoring_project_id=%q \\", *monitoringProjectID)
 	}
 	if len(*monitoringDockerImage) != 0 {
-		log.Printf("--monitoring_docker_image=%q \\", *monitoringDockerImage)
+		logging.Infof("--monitoring_docker_image=%q \\", *monitoringDockerImage)
 	}
 }
 
@@ -130,23 +569,157 @@ func initMonitoringClient(ctx context.Context) (*monitoring.Client, error) {
 	return c, nil
 }
 
+// cliObserver prints the progress of config generation the way this binary always has, i.e.,
+// messages are printed with the standard log package & stages are only logged when debugging.
+type cliObserver struct{}
+
+func (cliObserver) OnStageStart(stage string) {
+	logging.Debugf("Starting stage %q.", stage)
+}
+
+func (cliObserver) OnStageEnd(stage string, d time.Duration) {
+	logging.Debugf("Stage %q took %v.", stage, d.Round(100*time.Millisecond))
+}
+
+func (cliObserver) OnLog(l logging.Level, msg string) {
+	logging.Print(l, msg)
+}
+
 // genConfigs is just a wrapper for the config generation code so that the caller can report
 // results if monitoring is enabled before exiting.
-func genConfigs(o rbeconfigsgen.Options) error {
+func genConfigs(ctx context.Context, o rbeconfigsgen.Options) error {
+	if err := o.ApplyDefaults(o.ExecOS); err != nil {
+		return fmt.Errorf("failed to apply default options for OS name %q specified to --exec_os: %w", *execOS, err)
+	}
+	if err := o.Validate(); err != nil {
+		return fmt.Errorf("Failed to validate command line arguments: %w", err)
+	}
+	o.Timings = &rbeconfigsgen.StageTimings{}
+	o.Warnings = &rbeconfigsgen.Warnings{}
+	o.Observer = cliObserver{}
+	err := rbeconfigsgen.RunWithContext(ctx, o)
+	logging.Infof("Stage timings: %s", o.Timings)
+	if ws := o.Warnings.All(); len(ws) != 0 {
+		logging.Infof("%d warning(s) were reported while detecting the toolchains.", len(ws))
+	}
+	if err != nil {
+		return fmt.Errorf("Config generation failed: %w", err)
+	}
+	if *printSummary {
+		s, err := rbeconfigsgen.NewSummary(&o)
+		if err != nil {
+			return fmt.Errorf("unable to determine the labels of the generated configs: %v", err)
+		}
+		blob, err := json.MarshalIndent(s, "", " ")
+		if err != nil {
+			return fmt.Errorf("unable to convert the summary into JSON: %v", err)
+		}
+		fmt.Println(string(blob))
+	}
+	return nil
+}
+
+// printExecProperties prints the JSON map of the exec_properties of the platform that would be
+// generated with the given options to stdout.
+func printExecProperties(o rbeconfigsgen.Options) error {
 	if err := o.ApplyDefaults(o.ExecOS); err != nil {
 		return fmt.Errorf("failed to apply default options for OS name %q specified to --exec_os: %w", *execOS, err)
 	}
 	if err := o.Validate(); err != nil {
-		return fmt.Errorf("Failed to validate command line arguments: %v", err)
+		return fmt.Errorf("Failed to validate command line arguments: %w", err)
 	}
-	if err := rbeconfigsgen.Run(o); err != nil {
+	props, err := rbeconfigsgen.PlatformExecProperties(&o)
+	if err != nil {
+		return err
+	}
+	blob, err := json.MarshalIndent(props, "", " ")
+	if err != nil {
+		return fmt.Errorf("unable to convert the exec properties into JSON: %v", err)
+	}
+	fmt.Println(string(blob))
+	return nil
+}
+
+// genBatchConfigs generates configs for every toolchain image in the --batch_file using the given
+// options shared by all images.
+func genBatchConfigs(ctx context.Context, o rbeconfigsgen.Options) error {
+	inputs, err := rbeconfigsgen.LoadBatchInputs(*batchFile)
+	if err != nil {
+		return fmt.Errorf("invalid --batch_file: %v", err)
+	}
+	o.Observer = cliObserver{}
+	results, err := rbeconfigsgen.RunBatch(ctx, o, inputs, rbeconfigsgen.BatchOptions{
+		MaxParallel: *maxParallel,
+		FailFast:    *failFast,
+	})
+	for _, r := range results {
+		logging.Infof("Stage timings for %s: %s", r.Input, r.Timings)
+	}
+	if err != nil {
 		return fmt.Errorf("Config generation failed: %v", err)
 	}
 	return nil
 }
 
+// usageFatalf logs the given message about invalid flags & exits with the exit code of usage
+// errors.
+func usageFatalf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+	os.Exit(rbeconfigsgen.ExitCodeUsage)
+}
+
+// exitWithError logs the given error prefixed with the given message & exits with the exit code
+// of the category of the error.
+func exitWithError(msg string, err error) {
+	log.Printf("%s: %v", msg, err)
+	os.Exit(rbeconfigsgen.ExitCode(err))
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		if err := runDiff(os.Args[2:]); err != nil {
+			exitWithError("Diff failed", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "inspect" {
+		if err := runInspect(os.Args[2:]); err != nil {
+			exitWithError("Inspect failed", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		if err := runVerify(os.Args[2:]); err != nil {
+			exitWithError("Verify failed", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == rbeconfigsgen.ProbeCmd {
+		if err := rbeconfigsgen.RunProbe(os.Args[2:], os.Stdout); err != nil {
+			exitWithError("Probe failed", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "manifest" {
+		if err := runManifest(os.Args[2:]); err != nil {
+			exitWithError("Manifest generation failed", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		if err := runSelftest(os.Args[2:]); err != nil {
+			exitWithError("Self test failed", err)
+		}
+		return
+	}
 	flag.Parse()
+	if *version {
+		fmt.Println(rbeconfigsgen.GeneratorVersion())
+		return
+	}
+	if err := logging.Configure(*logLevel, *quiet); err != nil {
+		usageFatalf("Invalid --log_level: %v", err)
+	}
 	printFlags()
 
 	ctx := context.Background()
@@ -156,31 +729,167 @@ func main() {
 	}
 
 	o := rbeconfigsgen.Options{
-		BazelVersion:           *bazelVersion,
-		BazelPath:              *bazelPath,
-		ToolchainContainer:     *toolchainContainer,
-		DockerPlatform:         *dockerPlatform,
-		ExecOS:                 *execOS,
-		TargetOS:               *targetOS,
-		OutputTarball:          *outputTarball,
-		OutputSourceRoot:       *outputSrcRoot,
-		OutputConfigPath:       *outputConfigPath,
-		OutputManifest:         *outputManifest,
-		GenCPPConfigs:          *genCppConfigs,
-		CppGenEnvJSON:          *cppEnvJSON,
-		CPPToolchainTargetName: *cppToolchainTarget,
-		GenJavaConfigs:         *genJavaConfigs,
-		JavaUseLocalRuntime:    *javaUseLocalRuntime,
-		TempWorkDir:            *tempWorkDir,
-		Cleanup:                *cleanup,
+		BazelVersion:                        *bazelVersion,
+		SkipVersionCheck:                    *skipVersionCheck,
+		MinBazelVersion:                     *minBazelVersion,
+		MaxBazelVersion:                     *maxBazelVersion,
+		BazelPath:                           *bazelPath,
+		ToolchainContainer:                  *toolchainContainer,
+		RequireDigest:                       *requireDigest,
+		ImageTarball:                        *imageTarball,
+		ExistingContainer:                   *existingContainer,
+		Dockerfile:                          *dockerfile,
+		BuildContext:                        *buildContext,
+		ApptainerImage:                      *apptainerImage,
+		RegistryCACert:                      *registryCACert,
+		InsecureRegistry:                    *insecureRegistry,
+		HTTPUserAgent:                       *httpUserAgent,
+		BazeliskSHA256:                      *bazeliskSHA256,
+		PlatformImageOverride:               *platformImageOverride,
+		PlatformConstraints:                 *platformConstraints,
+		DockerNetwork:                       *dockerNetwork,
+		DockerRunAsRoot:                     *dockerRunAsRoot,
+		DockerPrivileged:                    *dockerPrivileged,
+		SupportsWorkers:                     *supportsWorkers,
+		WorkerKeyMnemonics:                  splitList(*workerKeyMnemonics),
+		DockerPlatform:                      *dockerPlatform,
+		IsolateProbes:                       !*reuseContainer,
+		RunEntrypoint:                       *runEntrypoint,
+		InitCommand:                         *initCommand,
+		ContainerTmpfsSize:                  *containerTmpfsSize,
+		ScratchMount:                        *scratchMount,
+		ContainerRunFlags:                   *containerRunFlags,
+		DetectResources:                     *detectResources,
+		AllowEmulation:                      *allowEmulation,
+		NoShell:                             *noShell,
+		ProbeHelper:                         *probeHelper,
+		ExecOS:                              *execOS,
+		TargetOS:                            *targetOS,
+		ExecCPU:                             *execCPU,
+		TargetCPU:                           *targetCPU,
+		TargetSysroot:                       *targetSysroot,
+		OutputTarball:                       *outputTarball,
+		TarballPrefix:                       *tarballPrefix,
+		TarballFormat:                       *tarballFormat,
+		OutputSourceRoot:                    *outputSrcRoot,
+		OutputConfigPath:                    *outputConfigPath,
+		NoTarball:                           *noTarball,
+		OutputManifest:                      *outputManifest,
+		EmbedManifest:                       *embedManifest,
+		BazelrcOutput:                       *bazelrcOutput,
+		RepoName:                            *repoName,
+		PlatformName:                        *platformName,
+		OutputSummary:                       *outputSummary,
+		PostHook:                            *postHook,
+		SimulateRBE:                         *simulateRBE,
+		DumpDetectionFacts:                  *dumpFacts,
+		ValidateOnly:                        *validateOnly,
+		WarningsAsErrors:                    *warningsAsErrors,
+		FormatBuildFiles:                    *formatBuildFiles,
+		BuildifierPath:                      *buildifierPath,
+		GenCPPConfigs:                       *genCppConfigs,
+		CppGenEnvJSON:                       *cppEnvJSON,
+		CppCompiler:                         *cppCompiler,
+		CppStdlib:                           *cppStdlib,
+		CPPToolchainTargetName:              *cppToolchainTarget,
+		CxxBuiltinIncludeDirectories:        *cxxBuiltinIncludeDirs,
+		ExtraCxxBuiltinIncludeDirectories:   *extraCxxBuiltinIncludeDirs,
+		ExcludeCxxBuiltinIncludeDirectories: *excludeCxxBuiltinIncludeDirs,
+		LinkerFlags:                         *linkerFlags,
+		ReplaceLinkerFlags:                  *replaceLinkerFlags,
+		CppFeatures:                         cppFeatures(),
+		ExtraCppFeatures:                    *extraCppFeatures,
+		CppActions:                          splitList(*cppActions),
+		VerifyCPP:                           *verifyCpp,
+		CppToolchainResolution:              *cppToolchainResolution,
+		GenJavaConfigs:                      *genJavaConfigs,
+		Only:                                *only,
+		JavaUseLocalRuntime:                 *javaUseLocalRuntime,
+		JavaCompat:                          *javaCompat,
+		StrictJavaVersion:                   *strictJavaVersion,
+		JavaHome:                            *javaHome,
+		JavaSourceVersion:                   *javaSourceVersion,
+		JavaTargetVersion:                   *javaTargetVersion,
+		GenRustConfigs:                      *genRust,
+		TempWorkDir:                         *tempWorkDir,
+		Cleanup:                             *cleanup,
+		CacheDir:                            *cacheDir,
+		NoCache:                             *noCache,
+	}
+	o.Bazelrc = rbeconfigsgen.BazelrcOptions{
+		ConfigsURL:        *bazelrcConfigsURL,
+		RemoteExecutor:    *remoteExecutor,
+		RemoteInstance:    *remoteInstance,
+		GoogleCredentials: *googleCredentials,
+		BazelVersion:      *bazelrcBazelVersion,
+	}
+	if *outputTarball == "-" {
+		// Stdout must only contain the tarball. Logs are always written to stderr.
+		if *printSummary {
+			usageFatalf("--print_summary can't be used with --output_tarball=- because the tarball is written to stdout. Use --output_summary instead.")
+		}
+		o.OutputTarball = ""
+		o.TarballWriter = os.Stdout
+	}
+	if o.NoShell && len(o.ProbeHelper) == 0 {
+		// This binary implements the probe helper commands but can only be copied into the
+		// toolchain container if it was built for Linux.
+		if runtime.GOOS != "linux" {
+			usageFatalf("--probe_helper must be specified with --no_shell because this binary was built for %q instead of Linux.", runtime.GOOS)
+		}
+		p, err := os.Executable()
+		if err != nil {
+			log.Fatalf("Unable to determine the path of this binary to use as the --probe_helper: %v", err)
+		}
+		o.ProbeHelper = p
 	}
 
+	if len(*batchFile) == 0 && (*maxParallel != 0 || *failFast) {
+		usageFatalf("--max_parallel & --fail_fast can only be used with --batch_file.")
+	}
+	if *maxParallel < 0 {
+		usageFatalf("--max_parallel must not be negative, got %d.", *maxParallel)
+	}
+	if len(*batchFile) != 0 && *printSummary {
+		usageFatalf("--print_summary can't be used with --batch_file.")
+	}
+	if len(*batchFile) != 0 && *printExecProps {
+		usageFatalf("--print_exec_properties can't be used with --batch_file.")
+	}
+	if len(*dumpFacts) != 0 && (len(*batchFile) != 0 || *printSummary) {
+		usageFatalf("--dump_detection_facts can't be used with --batch_file or --print_summary.")
+	}
+	if len(*validateOnly) != 0 && (len(*batchFile) != 0 || *printSummary) {
+		usageFatalf("--validate_only can't be used with --batch_file or --print_summary.")
+	}
+	if *printExecProps {
+		if err := printExecProperties(o); err != nil {
+			exitWithError("Unable to determine the exec properties", err)
+		}
+		return
+	}
+
+	// Interrupting this tool cancels config generation which removes the toolchain container
+	// instead of leaving it running.
+	genCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	gen := genConfigs
+	if len(*batchFile) != 0 {
+		gen = genBatchConfigs
+	}
 	result := true
-	if err := genConfigs(o); err != nil {
+	// The exit code distinguishes transient failures, e.g., pulling the toolchain image, from
+	// deterministic ones so callers can decide whether to retry.
+	exitCode := 0
+	if err := gen(genCtx, o); err != nil {
 		result = false
+		exitCode = rbeconfigsgen.ExitCode(err)
 		log.Printf("Config generation failed: %v", err)
 	} else {
-		log.Printf("Config generation was successful.")
+		logging.Infof("Config generation was successful.")
+		if len(*outputManifest) != 0 {
+			log.Printf("Wrote JSON manifest to %q.", *outputManifest)
+		}
 	}
 	// Monitoring is optional and used for internal alerting by the owners of this repo only.
 	if mc != nil {
@@ -189,6 +898,6 @@ func main() {
 		}
 	}
 	if !result {
-		os.Exit(1)
+		os.Exit(exitCode)
 	}
 }
@@ -0,0 +1,49 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/bazelbuild/bazel-toolchains/pkg/logging"
+	"github.com/bazelbuild/bazel-toolchains/pkg/rbeconfigsgen"
+)
+
+// runSelftest implements the "selftest" subcommand which generates configs for a known good public
+// toolchain image locally & checks the expected files & labels were produced.
+func runSelftest(args []string) error {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	toolchainContainer := fs.String("toolchain_container", rbeconfigsgen.SelfTestImage, "(Optional) Repository path to the Linux toolchain image to generate configs for.")
+	bazelVersion := fs.String("bazel_version", rbeconfigsgen.SelfTestBazelVersion, "(Optional) The version of Bazel to generate configs for.")
+	outputDir := fs.String("output_dir", "", "(Optional) Directory to keep the generated configs tarball & manifest in for inspection. Defaults to a temporary directory that's deleted afterwards.")
+	logLevel := fs.String("log_level", "info", "(Optional) Minimum level (debug|info|warn|error) of log messages to print. Defaults to info.")
+	fs.Parse(args)
+
+	if err := logging.Configure(*logLevel, false); err != nil {
+		usageFatalf("invalid --log_level: %v", err)
+	}
+	// Interrupting the self test removes the toolchain container instead of leaving it running.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return rbeconfigsgen.SelfTest(ctx, rbeconfigsgen.SelfTestOptions{
+		ToolchainContainer: *toolchainContainer,
+		BazelVersion:       *bazelVersion,
+		OutputDir:          *outputDir,
+	})
+}
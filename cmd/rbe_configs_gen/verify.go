@@ -0,0 +1,58 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/bazelbuild/bazel-toolchains/pkg/rbeconfigsgen"
+)
+
+// runVerify implements the "verify" subcommand which verifies a configs tarball against the
+// manifest produced with it & prints the report. An error is returned if the verification failed.
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	manifest := fs.String("manifest", "", "Path to the JSON manifest of the configs.")
+	tarball := fs.String("tarball", "", "Path to the configs tarball to verify. May be compressed with gzip or zstd.")
+	format := fs.String("format", "text", "(Optional) Format (text|json) of the printed verification report. Defaults to text.")
+	fs.Parse(args)
+
+	if len(*manifest) == 0 || len(*tarball) == 0 {
+		usageFatalf("--manifest & --tarball must be specified")
+	}
+	if *format != "text" && *format != "json" {
+		usageFatalf("invalid --format %q, want text or json", *format)
+	}
+	r, err := rbeconfigsgen.VerifyTarball(*manifest, *tarball)
+	if err != nil {
+		return err
+	}
+	if *format == "text" {
+		fmt.Print(r.String())
+	} else {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", " ")
+		if err := e.Encode(r); err != nil {
+			return fmt.Errorf("unable to convert the verification report into JSON: %w", err)
+		}
+	}
+	if !r.Passed {
+		return fmt.Errorf("configs tarball %q doesn't match manifest %q", *tarball, *manifest)
+	}
+	return nil
+}
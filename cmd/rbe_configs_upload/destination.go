@@ -0,0 +1,193 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// defaultDestination is the destination the configs are uploaded to unless --destination is
+// specified.
+const defaultDestination = "gs://rbe-toolchain/bazel-configs"
+
+// destination is a remote location the configs are uploaded to, e.g., a directory in a GCS bucket
+// or on an HTTP server.
+type destination interface {
+	// uploadOnce uploads the contents of the given reader as the file at the given path relative
+	// to the root of the destination with the given content type in a single attempt.
+	uploadOnce(ctx context.Context, r io.ReadSeeker, name, contentType string) error
+	// verifyDigest verifies the sha256 digest of the file at the given path relative to the root of
+	// the destination matches the given hex encoded digest.
+	verifyDigest(ctx context.Context, name, want string) error
+	// url returns the URL of the file at the given path relative to the root of the destination.
+	url(name string) string
+	// publicURL returns the URL the file at the given path relative to the root of the
+	// destination can be downloaded from over HTTP(S), e.g., by Bazel's http_archive.
+	publicURL(name string) string
+	// withCacheControl returns a copy of the destination uploading files with the given
+	// Cache-Control instead.
+	withCacheControl(cacheControl string) destination
+}
+
+// stringListFlag is a flag that may be repeated to specify several values.
+type stringListFlag []string
+
+func (s *stringListFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringListFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// parseDestination splits the given destination URL into its scheme, i.e., "gs", "http" or
+// "https", its host, i.e., the GCS bucket for "gs", & the path of its root directory without
+// leading or trailing slashes. Other object stores, e.g., S3, aren't supported.
+func parseDestination(d string) (scheme, host, dir string, err error) {
+	u, err := url.Parse(d)
+	if err != nil {
+		return "", "", "", fmt.Errorf("unable to parse destination %q: %w", d, err)
+	}
+	switch u.Scheme {
+	case "gs", "http", "https":
+	default:
+		return "", "", "", fmt.Errorf("unsupported destination %q, want gs://<bucket>[/<path>] or http(s)://<host>[/<path>] (S3 & other object stores aren't supported)", d)
+	}
+	if len(u.Host) == 0 {
+		return "", "", "", fmt.Errorf("destination %q doesn't specify a bucket or host", d)
+	}
+	if len(u.RawQuery) != 0 || len(u.Fragment) != 0 {
+		return "", "", "", fmt.Errorf("destination %q must not have a query or fragment", d)
+	}
+	return u.Scheme, u.Host, strings.Trim(u.Path, "/"), nil
+}
+
+// upload uploads the bytes represented by the given reader as the file at the given path relative
+// to the root of the given destination with the given content type. If an attempt fails, the
+// upload is restarted from the beginning of the reader until the given number of attempts is
+// reached.
+func upload(ctx context.Context, d destination, attempts int, r io.ReadSeeker, name, contentType string) error {
+	var err error
+	for a := 1; a <= attempts; a++ {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("unable to rewind the contents to upload to %s: %w", d.url(name), err)
+		}
+		if err = d.uploadOnce(ctx, r, name, contentType); err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		log.Printf("Attempt %d of %d to upload %s failed: %v", a, attempts, d.url(name), err)
+	}
+	return err
+}
+
+// httpDestination is a directory on an HTTP server accepting PUT requests to upload files, e.g.,
+// an internal mirror.
+type httpDestination struct {
+	client *http.Client
+	// baseURL is the URL of the root directory of the destination without a trailing slash.
+	baseURL string
+	// cacheControl is the Cache-Control header of the upload requests.
+	cacheControl string
+}
+
+func newHTTPDestination(scheme, host, dir, cacheControl string) *httpDestination {
+	u := fmt.Sprintf("%s://%s", scheme, host)
+	if len(dir) != 0 {
+		u = fmt.Sprintf("%s/%s", u, dir)
+	}
+	return &httpDestination{
+		client:       http.DefaultClient,
+		baseURL:      u,
+		cacheControl: cacheControl,
+	}
+}
+
+func (h *httpDestination) url(name string) string {
+	return fmt.Sprintf("%s/%s", h.baseURL, name)
+}
+
+func (h *httpDestination) publicURL(name string) string {
+	return h.url(name)
+}
+
+func (h *httpDestination) withCacheControl(cacheControl string) destination {
+	c := *h
+	c.cacheControl = cacheControl
+	return &c
+}
+
+func (h *httpDestination) uploadOnce(ctx context.Context, r io.ReadSeeker, name, contentType string) error {
+	u := h.url(name)
+	// Servers may reject PUT requests with chunked bodies so the length of the contents is sent.
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("unable to determine the size of the contents to upload to %s: %w", u, err)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("unable to rewind the contents to upload to %s: %w", u, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, io.NopCloser(r))
+	if err != nil {
+		return fmt.Errorf("unable to create the request to upload to %s: %w", u, err)
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Cache-Control", h.cacheControl)
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error while uploading to %s: %w", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("uploading to %s failed with HTTP status %s", u, resp.Status)
+	}
+	return nil
+}
+
+func (h *httpDestination) verifyDigest(ctx context.Context, name, want string) error {
+	u := h.url(name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return fmt.Errorf("unable to create the request to read back %s: %w", u, err)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to read back %s: %w", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("reading back %s failed with HTTP status %s", u, resp.Status)
+	}
+	s := sha256.New()
+	if _, err := io.Copy(s, resp.Body); err != nil {
+		return fmt.Errorf("error while hashing the contents of %s: %w", u, err)
+	}
+	if got := hex.EncodeToString(s.Sum(nil)); got != want {
+		return fmt.Errorf("sha256 digest of %s was %q, want %q from the manifest", u, got, want)
+	}
+	return nil
+}
@@ -0,0 +1,420 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseDestination(t *testing.T) {
+	tests := []struct {
+		name       string
+		dest       string
+		wantScheme string
+		wantHost   string
+		wantDir    string
+		wantErr    string
+	}{
+		{
+			name:       "GCS bucket",
+			dest:       "gs://rbe-toolchain",
+			wantScheme: "gs",
+			wantHost:   "rbe-toolchain",
+		},
+		{
+			name:       "GCS directory",
+			dest:       "gs://rbe-toolchain/bazel-configs/",
+			wantScheme: "gs",
+			wantHost:   "rbe-toolchain",
+			wantDir:    "bazel-configs",
+		},
+		{
+			name:       "HTTPS mirror",
+			dest:       "https://mirror.example.com:8443/a/b",
+			wantScheme: "https",
+			wantHost:   "mirror.example.com:8443",
+			wantDir:    "a/b",
+		},
+		{
+			name:       "HTTP mirror",
+			dest:       "http://mirror",
+			wantScheme: "http",
+			wantHost:   "mirror",
+		},
+		{
+			name:    "S3",
+			dest:    "s3://bucket/configs",
+			wantErr: "S3 & other object stores aren't supported",
+		},
+		{
+			name:    "No scheme",
+			dest:    "rbe-toolchain/bazel-configs",
+			wantErr: "unsupported destination",
+		},
+		{
+			name:    "No bucket",
+			dest:    "gs:///bazel-configs",
+			wantErr: "doesn't specify a bucket or host",
+		},
+		{
+			name:    "Query",
+			dest:    "https://mirror/configs?token=secret",
+			wantErr: "must not have a query or fragment",
+		},
+		{
+			name:    "Fragment",
+			dest:    "https://mirror/configs#latest",
+			wantErr: "must not have a query or fragment",
+		},
+		{
+			name:    "Unparsable",
+			dest:    "https://mirror/%zz",
+			wantErr: "unable to parse destination",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			scheme, host, dir, err := parseDestination(tc.dest)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("parseDestination(%q) = %v, want error containing %q", tc.dest, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseDestination(%q) failed: %v", tc.dest, err)
+			}
+			if scheme != tc.wantScheme || host != tc.wantHost || dir != tc.wantDir {
+				t.Errorf("parseDestination(%q) = (%q, %q, %q), want (%q, %q, %q)", tc.dest, scheme, host, dir, tc.wantScheme, tc.wantHost, tc.wantDir)
+			}
+		})
+	}
+}
+
+// fakeDestination is a destination failing the first given number of upload attempts after reading
+// part of the contents.
+type fakeDestination struct {
+	failures int
+	attempts int
+	uploaded []byte
+}
+
+func (f *fakeDestination) uploadOnce(ctx context.Context, r io.ReadSeeker, name, contentType string) error {
+	f.attempts++
+	if f.attempts <= f.failures {
+		// Consume part of the contents so that a retry without rewinding would upload a prefix.
+		r.Read(make([]byte, 2))
+		return errors.New("connection reset")
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	f.uploaded = b
+	return nil
+}
+
+func (f *fakeDestination) verifyDigest(ctx context.Context, name, want string) error {
+	return nil
+}
+
+func (f *fakeDestination) url(name string) string {
+	return "fake://" + name
+}
+
+func (f *fakeDestination) publicURL(name string) string {
+	return f.url(name)
+}
+
+func (f *fakeDestination) withCacheControl(cacheControl string) destination {
+	return f
+}
+
+func TestUploadRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		attempts     int
+		wantErr      bool
+		wantAttempts int
+	}{
+		{
+			name:         "First attempt succeeds",
+			attempts:     3,
+			wantAttempts: 1,
+		},
+		{
+			name:         "Retried after failures",
+			failures:     2,
+			attempts:     3,
+			wantAttempts: 3,
+		},
+		{
+			name:         "Out of attempts",
+			failures:     3,
+			attempts:     3,
+			wantErr:      true,
+			wantAttempts: 3,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &fakeDestination{failures: tc.failures}
+			err := upload(context.Background(), d, tc.attempts, bytes.NewReader([]byte("contents")), "manifest.json", "application/json")
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("upload() = %v, want error %v", err, tc.wantErr)
+			}
+			if d.attempts != tc.wantAttempts {
+				t.Errorf("upload() made %d attempts, want %d", d.attempts, tc.wantAttempts)
+			}
+			if !tc.wantErr && string(d.uploaded) != "contents" {
+				t.Errorf("upload() uploaded %q, want the contents from the start", d.uploaded)
+			}
+		})
+	}
+}
+
+func TestUploadCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d := &fakeDestination{failures: 3}
+	if err := upload(ctx, d, 3, bytes.NewReader([]byte("contents")), "manifest.json", "application/json"); err == nil {
+		t.Fatalf("upload() with a cancelled context succeeded, want error")
+	}
+	if d.attempts != 1 {
+		t.Errorf("upload() with a cancelled context made %d attempts, want 1", d.attempts)
+	}
+}
+
+// fakeHTTPServer is an HTTP server storing the files uploaded with PUT requests & serving them
+// with GET requests.
+type fakeHTTPServer struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	// headers are the headers of the last PUT request of each path.
+	headers map[string]http.Header
+}
+
+func newFakeHTTPServer(t *testing.T) (*fakeHTTPServer, *httptest.Server) {
+	f := &fakeHTTPServer{files: map[string][]byte{}, headers: map[string]http.Header{}}
+	s := httptest.NewServer(f)
+	t.Cleanup(s.Close)
+	return f, s
+}
+
+func (f *fakeHTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		if r.ContentLength < 0 {
+			http.Error(w, "length required", http.StatusLengthRequired)
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.files[r.URL.Path] = b
+		f.headers[r.URL.Path] = r.Header.Clone()
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet:
+		b, ok := f.files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(b)
+	default:
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestHTTPDestination(t *testing.T) {
+	f, s := newFakeHTTPServer(t)
+	scheme, host, dir, err := parseDestination(s.URL + "/configs/")
+	if err != nil {
+		t.Fatalf("parseDestination(%q) failed: %v", s.URL, err)
+	}
+	d := newHTTPDestination(scheme, host, dir, "no-cache")
+	if got, want := d.url("latest/manifest.json"), s.URL+"/configs/latest/manifest.json"; got != want {
+		t.Errorf("url() = %q, want %q", got, want)
+	}
+
+	ctx := context.Background()
+	contents := []byte("configs tarball")
+	if err := upload(ctx, d, 1, bytes.NewReader(contents), "latest/rbe_default.tar", "application/x-tar"); err != nil {
+		t.Fatalf("upload() failed: %v", err)
+	}
+	if got := f.files["/configs/latest/rbe_default.tar"]; !bytes.Equal(got, contents) {
+		t.Errorf("Server received %q, want %q", got, contents)
+	}
+	h := f.headers["/configs/latest/rbe_default.tar"]
+	if got := h.Get("Content-Type"); got != "application/x-tar" {
+		t.Errorf("Upload had Content-Type %q, want %q", got, "application/x-tar")
+	}
+	if got := h.Get("Cache-Control"); got != "no-cache" {
+		t.Errorf("Upload had Cache-Control %q, want %q", got, "no-cache")
+	}
+
+	digest := sha256.Sum256(contents)
+	if err := d.verifyDigest(ctx, "latest/rbe_default.tar", hex.EncodeToString(digest[:])); err != nil {
+		t.Errorf("verifyDigest() of the uploaded file failed: %v", err)
+	}
+	if err := d.verifyDigest(ctx, "latest/rbe_default.tar", strings.Repeat("0", 64)); err == nil {
+		t.Errorf("verifyDigest() with the wrong digest succeeded, want error")
+	}
+	if err := d.verifyDigest(ctx, "latest/missing.tar", hex.EncodeToString(digest[:])); err == nil {
+		t.Errorf("verifyDigest() of a missing file succeeded, want error")
+	}
+}
+
+func TestHTTPDestinationUploadFailure(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "denied", http.StatusForbidden)
+	}))
+	defer s.Close()
+	scheme, host, dir, err := parseDestination(s.URL)
+	if err != nil {
+		t.Fatalf("parseDestination(%q) failed: %v", s.URL, err)
+	}
+	d := newHTTPDestination(scheme, host, dir, defaultCacheControl)
+	err = upload(context.Background(), d, 2, bytes.NewReader([]byte("x")), "manifest.json", "application/json")
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("upload() = %v, want error with the HTTP status", err)
+	}
+}
+
+// setFlag sets the given flag variable to the given value until the test finishes.
+func setFlag(t *testing.T, f *bool, v bool) {
+	old := *f
+	*f = v
+	t.Cleanup(func() { *f = old })
+}
+
+func TestUploadConfigsFailFast(t *testing.T) {
+	dir := t.TempDir()
+	tarball := filepath.Join(dir, "rbe_default.tar")
+	contents := []byte("configs tarball")
+	if err := ioutil.WriteFile(tarball, contents, 0644); err != nil {
+		t.Fatalf("Unable to write the configs tarball: %v", err)
+	}
+	digest := sha256.Sum256(contents)
+	manifestPath := filepath.Join(dir, "manifest.json")
+	if err := ioutil.WriteFile(manifestPath, []byte(fmt.Sprintf(`{"bazel_version": "7.0.0", "configs_tarball_digest": %q}`, hex.EncodeToString(digest[:]))), 0644); err != nil {
+		t.Fatalf("Unable to write the manifest: %v", err)
+	}
+
+	// The failing destination rejects every upload while the slow destination only responds once
+	// the upload is cancelled or after a timeout.
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "denied", http.StatusForbidden)
+	}))
+	defer failing.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices the client closing the connection once the body was read.
+		ioutil.ReadAll(r.Body)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+		http.Error(w, "timed out", http.StatusGatewayTimeout)
+	}))
+	defer slow.Close()
+
+	oldTarball, oldManifest, oldDests, oldAttempts := *configsTarball, *configsManifest, destinations, *uploadAttempts
+	defer func() {
+		*configsTarball, *configsManifest, destinations, *uploadAttempts = oldTarball, oldManifest, oldDests, oldAttempts
+	}()
+	*configsTarball, *configsManifest, *uploadAttempts = tarball, manifestPath, 1
+	destinations = stringListFlag{failing.URL, slow.URL}
+	setFlag(t, failFast, true)
+
+	start := time.Now()
+	err := uploadConfigs(context.Background(), "toolchain")
+	if err == nil {
+		t.Fatalf("uploadConfigs() succeeded, want error")
+	}
+	if !strings.Contains(err.Error(), "2 of 2 destinations") {
+		t.Errorf("uploadConfigs() = %v, want both destinations to fail", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("uploadConfigs() took %v, want the upload to the slow destination to be cancelled", d)
+	}
+}
+
+func TestUploadConfigsContentAddressed(t *testing.T) {
+	dir := t.TempDir()
+	tarball := filepath.Join(dir, "rbe_default.tar")
+	contents := []byte("configs tarball")
+	if err := ioutil.WriteFile(tarball, contents, 0644); err != nil {
+		t.Fatalf("Unable to write the configs tarball: %v", err)
+	}
+	sum := sha256.Sum256(contents)
+	digest := hex.EncodeToString(sum[:])
+	manifestPath := filepath.Join(dir, "manifest.json")
+	if err := ioutil.WriteFile(manifestPath, []byte(fmt.Sprintf(`{"bazel_version": "7.0.0", "configs_tarball_digest": %q}`, digest)), 0644); err != nil {
+		t.Fatalf("Unable to write the manifest: %v", err)
+	}
+	f, s := newFakeHTTPServer(t)
+
+	oldTarball, oldManifest, oldDests := *configsTarball, *configsManifest, destinations
+	defer func() {
+		*configsTarball, *configsManifest, destinations = oldTarball, oldManifest, oldDests
+	}()
+	*configsTarball, *configsManifest = tarball, manifestPath
+	destinations = stringListFlag{s.URL + "/configs"}
+	// --set_tarball_url isn't specified because --content_addressed_path implies it.
+	setFlag(t, contentAddressed, true)
+	setFlag(t, setTarballURL, false)
+
+	if err := uploadConfigs(context.Background(), "toolchain"); err != nil {
+		t.Fatalf("uploadConfigs() failed: %v", err)
+	}
+	caPath := "/configs/sha256/" + digest + ".tar"
+	if got := f.files[caPath]; !bytes.Equal(got, contents) {
+		t.Errorf("Server received %q at %s, want the configs tarball", got, caPath)
+	}
+	if got := f.headers[caPath].Get("Cache-Control"); got != immutableCacheControl {
+		t.Errorf("Content addressed tarball was uploaded with Cache-Control %q, want %q", got, immutableCacheControl)
+	}
+	for _, p := range []string{"/configs/toolchain/latest/manifest.json", "/configs/bazel_7.0.0/toolchain/latest/manifest.json"} {
+		if got := f.headers[p].Get("Cache-Control"); got != defaultCacheControl {
+			t.Errorf("Manifest %s was uploaded with Cache-Control %q, want %q", p, got, defaultCacheControl)
+		}
+		if want := fmt.Sprintf(`"configs_tarball_url": %q`, s.URL+caPath); !strings.Contains(string(f.files[p]), want) {
+			t.Errorf("Manifest %s was uploaded as:\n%s\nwant it to contain %s", p, f.files[p], want)
+		}
+		if _, ok := f.files[path.Join(path.Dir(p), "rbe_default.tar")]; ok {
+			t.Errorf("Configs tarball was uploaded next to manifest %s, want it only at its content addressed path", p)
+		}
+	}
+}
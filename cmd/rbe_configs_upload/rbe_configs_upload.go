@@ -14,13 +14,23 @@
 //
 // Binary rbe_configs_upload uploads the artifacts generated by rbe_configs_gen to GCS. This tool
 // is meant for internal use by the owners of this repository only.
-// This tool will upload the given configs tarball & manifest to the following paths on GCS:
-// - gs://rbe-bazel-toolchains/configs/latest
-// - - rbe_default.tar (The configs tarball)
+// This tool will upload the given configs tarball & manifest to the following paths under each
+// --destination, gs://rbe-toolchain/bazel-configs by default:
+// - <toolchain container>/latest
+// - - rbe_default.tar (The configs tarball, .tar.gz or .tar.zst if compressed)
 // - - manifest.json (The JSON manifest)
-// - gs://rbe-bazel-toolchains/configs/bazel_<version>/latest
-// - - rbe_default.tar (The configs tarball)
+// - bazel_<version>/<toolchain container>/latest
+// - - rbe_default.tar (The configs tarball, .tar.gz or .tar.zst if compressed)
 // - - manifest.json (The JSON manifest)
+// Destinations may also be HTTP servers accepting PUT requests, e.g., an internal mirror. Several
+// destinations are uploaded to concurrently.
+// With --content_addressed_path, the configs tarball is uploaded once per destination to
+// sha256/<digest>.tar (.tar.gz or .tar.zst if compressed) instead, which is never overwritten with
+// different contents & may be cached indefinitely, & only the manifests pointing to it are uploaded
+// to the above directories.
+// With --emit_checksums, a SHA256SUMS file listing the sha256 digests of the configs tarball &
+// manifest in the format of sha256sum is uploaded to both directories as well so that downloads
+// can be verified with "sha256sum -c SHA256SUMS".
 // This tool will upload the above files even if the config tarball hasn't changed. This can happen
 // if there's been no new Bazel release or toolchain container release since the last time this tool
 // was run. Thus, the above GCS artifacts are unstable in the sense that their contents can change
@@ -32,6 +42,8 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -39,21 +51,58 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 
+	"cloud.google.com/go/compute/metadata"
 	"cloud.google.com/go/storage"
 	"github.com/bazelbuild/bazel-toolchains/pkg/monitoring"
 	"github.com/bazelbuild/bazel-toolchains/pkg/rbeconfigsgen"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+)
+
+const (
+	// defaultCacheControl is the Cache-Control metadata of the uploaded objects unless overridden.
+	// The "latest" objects are replaced by every upload so caches may only serve them for a few
+	// minutes.
+	defaultCacheControl = "public, max-age=300"
+	// immutableCacheControl is the Cache-Control metadata of the configs tarball uploaded to its
+	// content addressed path. Its contents never change so caches may serve it for a year.
+	immutableCacheControl = "public, max-age=31536000, immutable"
 )
 
 var (
-	configsTarball        = flag.String("configs_tarball", "", "Path to the configs tarball generated by rbe_configs_gen to be uploaded to GCS.")
+	configsTarball        = flag.String("configs_tarball", "", "Path to the configs tarball generated by rbe_configs_gen to be uploaded.")
 	configsManifest       = flag.String("configs_manifest", "", "Path to the JSON manifest generated by rbe_configs_gen.")
 	enableMonitoring      = flag.Bool("enable_monitoring", false, "(Optional) Enables reporting reporting results to Google Cloud Monitoring. Defaults to false.")
 	monitoringProjectID   = flag.String("monitoring_project_id", "", "GCP Project ID where monitoring results will be reported. Required if --enable_monitoring is true.")
 	monitoringDockerImage = flag.String("monitoring_docker_image", "", "Name of the toolchain docker image to be reported as a string label to monitoring. Required if --enable_monitoring is true.")
+	chunkSizeMB           = flag.Int("chunk_size_mb", 16, "(Optional) Size in MiB of each chunk of the resumable uploads to GCS. Transient failures are retried per chunk without restarting the upload. 0 disables chunking & uploads each file in a single request. Defaults to 16.")
+	uploadAttempts        = flag.Int("upload_attempts", 3, "(Optional) Number of times an upload is attempted from the start if the resumable upload session fails. Defaults to 3.")
+	googleCredentials     = flag.String("google_credentials", "", "(Optional) Path to the JSON key of the service account to upload to GCS as, like Bazel's --google_credentials, or to an external account configuration for workload identity federation. Defaults to Application Default Credentials.")
+	cacheControl          = flag.String("cache_control", defaultCacheControl, "(Optional) Cache-Control metadata of the uploaded configs tarball & manifest. The objects are overwritten by every upload so they must not be cached for long. Defaults to "+defaultCacheControl+".")
+	emitChecksums         = flag.Bool("emit_checksums", false, "(Optional) Upload a SHA256SUMS file listing the sha256 digests of the configs tarball & manifest next to them so that downloads can be verified with sha256sum -c. Defaults to false.")
+	setTarballURL         = flag.Bool("set_tarball_url", false, "(Optional) Set the configs_tarball_url of each uploaded manifest to the public URL of the uploaded configs tarball, next to it or at its --content_addressed_path, so that consumers can find the tarball from the manifest alone. Nothing else in the manifest is changed. Implied by --content_addressed_path. Defaults to false.")
+	contentAddressed      = flag.Bool("content_addressed_path", false, "(Optional) Upload the configs tarball to sha256/<digest>.<format> under each --destination instead of next to the manifests so that the bytes at its URL never change, e.g., to avoid stale CDN copies failing Bazel's sha256 check. A tarball already uploaded with the same digest isn't uploaded again. The tarball is uploaded with Cache-Control \""+immutableCacheControl+"\" regardless of --cache_control. Implies --set_tarball_url so consumers find it from the manifests. Defaults to false.")
+	failFast              = flag.Bool("fail_fast", false, "(Optional) Cancel the uploads to the remaining --destination URLs once the upload to one of them failed. Otherwise, the failures of all destinations are reported at the end. Defaults to false.")
+	gcsProject            = flag.String("gcs_project", "", "(Optional) ID of the GCP project billed for the GCS requests, e.g., if the bucket is requester pays or the credentials belong to a different project. Defaults to the project of the bucket.")
 )
 
+// impersonatedAccountRegexp extracts the email of the service account impersonated by external
+// account credentials from their service_account_impersonation_url.
+var impersonatedAccountRegexp = regexp.MustCompile(`/serviceAccounts/([^/:]+):generateAccessToken$`)
+
+// destinations are the URLs of the directories the configs are uploaded to.
+var destinations stringListFlag
+
+func init() {
+	flag.Var(&destinations, "destination", "(Optional) URL of the directory the configs are uploaded to, gs://<bucket>[/<path>] for a GCS bucket or http(s)://<host>[/<path>] for an HTTP server accepting PUT requests, e.g., an internal mirror. Other schemes, e.g., s3://, aren't supported. May be repeated to upload to several destinations concurrently. Defaults to "+defaultDestination+".")
+}
+
 // manifest is the metadata about the configs that'll be uploaded to GCS.
 type manifest struct {
 	// Wrap around the manifest produced by rbe_configs_gen.
@@ -81,52 +130,288 @@ func manifestFromFile(filePath string) (*manifest, error) {
 	return m, nil
 }
 
-// storageClient represents the GCS client.
+// manifestJSON returns the given manifest as JSON to upload with its ConfigsTarballURL set to the
+// given URL. The ConfigsTarballURL is left as is if the URL is blank.
+func manifestJSON(m *manifest, tarballURL string) ([]byte, error) {
+	c := *m
+	if len(tarballURL) != 0 {
+		c.ConfigsTarballURL = tarballURL
+	}
+	b, err := json.MarshalIndent(&c, "", " ")
+	if err != nil {
+		return nil, fmt.Errorf("error converting manifest into JSON: %v", err)
+	}
+	return b, nil
+}
+
+// loadGoogleCredentials returns the credentials to access GCS from the JSON credentials file at the
+// given path, e.g., a service account key or an external account configuration for workload
+// identity federation, or the Application Default Credentials if the path is blank.
+func loadGoogleCredentials(ctx context.Context, credsPath string) (*google.Credentials, error) {
+	if len(credsPath) == 0 {
+		c, err := google.FindDefaultCredentials(ctx, storage.ScopeFullControl)
+		if err != nil {
+			return nil, fmt.Errorf("unable to find Application Default Credentials: %w", err)
+		}
+		return c, nil
+	}
+	blob, err := ioutil.ReadFile(credsPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the credentials file: %w", err)
+	}
+	c, err := google.CredentialsFromJSON(ctx, blob, storage.ScopeFullControl)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the credentials in %q: %w", credsPath, err)
+	}
+	return c, nil
+}
+
+// credentialsPrincipal returns the email of the principal the given credentials authenticate as,
+// e.g., the service account of a JSON key, impersonated by external account credentials or of the
+// GCE metadata server, or a description of the credentials if their email can't be determined.
+func credentialsPrincipal(c *google.Credentials) string {
+	if len(c.JSON) == 0 {
+		// The credentials are provided by the environment, i.e., the GCE metadata server.
+		if !metadata.OnGCE() {
+			return "unknown principal"
+		}
+		e, err := metadata.Email("default")
+		if err != nil {
+			return fmt.Sprintf("default service account of the GCE metadata server (%v)", err)
+		}
+		return e
+	}
+	var f struct {
+		Type                           string `json:"type"`
+		ClientEmail                    string `json:"client_email"`
+		ClientID                       string `json:"client_id"`
+		Audience                       string `json:"audience"`
+		ServiceAccountImpersonationURL string `json:"service_account_impersonation_url"`
+	}
+	if err := json.Unmarshal(c.JSON, &f); err != nil {
+		return "unknown principal"
+	}
+	if len(f.ClientEmail) != 0 {
+		return f.ClientEmail
+	}
+	switch f.Type {
+	case "authorized_user":
+		return fmt.Sprintf("user credentials of OAuth client %s", f.ClientID)
+	case "external_account":
+		// The URL is like .../serviceAccounts/<email>:generateAccessToken.
+		if m := impersonatedAccountRegexp.FindStringSubmatch(f.ServiceAccountImpersonationURL); m != nil {
+			return m[1]
+		}
+		return fmt.Sprintf("external account of workload identity pool provider %s", f.Audience)
+	}
+	return fmt.Sprintf("unknown principal of %q credentials", f.Type)
+}
+
+// storageClient represents a directory in a GCS bucket the configs are uploaded to.
 type storageClient struct {
 	client *storage.Client
 	// bucketName is the GCS bucket all artifacts will be uploaded to.
 	bucketName string
+	// dir is the directory in the bucket all artifacts will be uploaded to. Blank for the root of
+	// the bucket.
+	dir string
+	// principal describes who the uploads are authenticated as.
+	principal string
+	// userProject is the GCP project billed for the GCS requests. Defaults to the project of the
+	// bucket if blank.
+	userProject string
+	// chunkSize is the size in bytes of each request of a resumable upload.
+	chunkSize int
+	// cacheControl is the Cache-Control metadata of the uploaded objects.
+	cacheControl string
 }
 
-func newStorage(ctx context.Context) (*storageClient, error) {
-	c, err := storage.NewClient(ctx)
+func newStorage(ctx context.Context, creds *google.Credentials, principal, bucketName, dir, userProject string, chunkSize int, cacheControl string) (*storageClient, error) {
+	c, err := storage.NewClient(ctx, option.WithCredentials(creds))
 	if err != nil {
 		return nil, err
 	}
 	return &storageClient{
-		client:     c,
-		bucketName: "rbe-toolchain",
+		client:       c,
+		bucketName:   bucketName,
+		dir:          dir,
+		principal:    principal,
+		userProject:  userProject,
+		chunkSize:    chunkSize,
+		cacheControl: cacheControl,
 	}, nil
 }
 
-// upload uploads the bytes represented by the given reader as the given GCS object name.
-func (s *storageClient) upload(ctx context.Context, r io.Reader, objectName string) error {
-	w := s.client.Bucket(s.bucketName).Object(objectName).NewWriter(ctx)
+// bucket returns the handle of the GCS bucket all artifacts will be uploaded to.
+func (s *storageClient) bucket() *storage.BucketHandle {
+	b := s.client.Bucket(s.bucketName)
+	if len(s.userProject) != 0 {
+		b = b.UserProject(s.userProject)
+	}
+	return b
+}
+
+// objectName returns the name of the GCS object of the file at the given path relative to the
+// directory all artifacts are uploaded to.
+func (s *storageClient) objectName(name string) string {
+	return path.Join(s.dir, name)
+}
+
+func (s *storageClient) url(name string) string {
+	return fmt.Sprintf("gs://%s/%s", s.bucketName, s.objectName(name))
+}
+
+func (s *storageClient) publicURL(name string) string {
+	return fmt.Sprintf("https://storage.googleapis.com/%s/%s", s.bucketName, s.objectName(name))
+}
+
+func (s *storageClient) withCacheControl(cacheControl string) destination {
+	c := *s
+	c.cacheControl = cacheControl
+	return &c
+}
+
+// uploadOnce uploads the bytes represented by the given reader as the GCS object of the given
+// path with the given content type & the configured Cache-Control in a single resumable upload
+// session. Failed chunks are retried by the resumable upload session.
+func (s *storageClient) uploadOnce(ctx context.Context, r io.ReadSeeker, name, contentType string) error {
+	objectName := s.objectName(name)
+	// Cancelling the context aborts the upload session if copying the contents fails.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := s.bucket().Object(objectName).NewWriter(ctx)
+	w.ChunkSize = s.chunkSize
+	w.ContentType = contentType
+	w.CacheControl = s.cacheControl
+	w.ProgressFunc = func(n int64) {
+		log.Printf("Uploaded %d bytes to GCS object %q.", n, objectName)
+	}
 	if _, err := io.Copy(w, r); err != nil {
-		return fmt.Errorf("error while uploading to GCS object %q: %w", objectName, err)
+		return fmt.Errorf("error while uploading to GCS object %q as %s: %w", objectName, s.principal, err)
 	}
 	// The actual upload might happen after Close is called so we need to capture any errors.
 	if err := w.Close(); err != nil {
-		return fmt.Errorf("error finishing upload to GCS object %q: %w", objectName, err)
+		return fmt.Errorf("error finishing upload to GCS object %q as %s: %w", objectName, s.principal, err)
 	}
 	return nil
 }
 
-// uploadArtifacts uploads the given blob of bytes representing a JSON manifest and the configs
-// tarball at the given path to the given GCS directory.
-func (s *storageClient) uploadArtifacts(ctx context.Context, manifest []byte, tarballPath, remoteDir string) error {
+// verifyDigest verifies the sha256 digest of the contents of the GCS object of the given path
+// matches the given hex encoded digest.
+func (s *storageClient) verifyDigest(ctx context.Context, name, want string) error {
+	objectName := s.objectName(name)
+	r, err := s.bucket().Object(objectName).NewReader(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to read back GCS object %q: %w", objectName, err)
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return fmt.Errorf("error while hashing the contents of GCS object %q: %w", objectName, err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return fmt.Errorf("sha256 digest of GCS object %q was %q, want %q from the manifest", objectName, got, want)
+	}
+	return nil
+}
+
+// sha256Sums returns the contents of a SHA256SUMS file in the format produced by sha256sum, i.e.,
+// one "<hex digest>  <file name>" line per file, listing the given file names & hex encoded sha256
+// digests in order.
+func sha256Sums(files ...[2]string) []byte {
+	b := bytes.NewBuffer(nil)
+	for _, f := range files {
+		fmt.Fprintf(b, "%s  %s\n", f[1], f[0])
+	}
+	return b.Bytes()
+}
+
+// tarballName returns the name of the uploaded configs tarball in the given format, e.g.,
+// "tar.zst".
+func tarballName(tarballFormat string) string {
+	if len(tarballFormat) == 0 {
+		tarballFormat = rbeconfigsgen.TarballFormatTar
+	}
+	return fmt.Sprintf("rbe_default.%s", tarballFormat)
+}
+
+// contentAddressedTarballName returns the path of the configs tarball with the given hex encoded
+// sha256 digest in the given format, e.g., "tar.zst", relative to the root of a destination with
+// --content_addressed_path.
+func contentAddressedTarballName(tarballDigest, tarballFormat string) string {
+	if len(tarballFormat) == 0 {
+		tarballFormat = rbeconfigsgen.TarballFormatTar
+	}
+	return path.Join("sha256", fmt.Sprintf("%s.%s", tarballDigest, tarballFormat))
+}
+
+// uploadTarball uploads the configs tarball in the given format at the given local path as the
+// file at the given path relative to the root of the given destination, attempting the upload at
+// most the given number of times. The uploaded configs tarball is verified to match the given hex
+// encoded sha256 digest.
+func uploadTarball(ctx context.Context, d destination, attempts int, tarballPath, tarballFormat, tarballDigest, name string) error {
 	f, err := os.Open(tarballPath)
 	if err != nil {
 		return fmt.Errorf("unable to open configs tarball file %q: %w", tarballPath, err)
 	}
 	defer f.Close()
+	if err := upload(ctx, d, attempts, f, name, rbeconfigsgen.TarballContentType(tarballFormat)); err != nil {
+		return fmt.Errorf("error uploading configs tarball: %w", err)
+	}
+	if err := d.verifyDigest(ctx, name, tarballDigest); err != nil {
+		return fmt.Errorf("uploaded configs tarball failed verification: %w", err)
+	}
+	return nil
+}
 
-	if err := s.upload(ctx, bytes.NewBuffer(manifest), fmt.Sprintf("%s/manifest.json", remoteDir)); err != nil {
-		return fmt.Errorf("error uploading manifest to GCS: %w", err)
+// uploadContentAddressedTarball uploads the configs tarball like uploadTarball to its content
+// addressed path with immutableCacheControl unless the destination already has a tarball with the
+// given digest there. Returns the path the tarball was uploaded to relative to the root of the
+// destination.
+func uploadContentAddressedTarball(ctx context.Context, d destination, attempts int, tarballPath, tarballFormat, tarballDigest string) (string, error) {
+	name := contentAddressedTarballName(tarballDigest, tarballFormat)
+	if err := d.verifyDigest(ctx, name, tarballDigest); err == nil {
+		log.Printf("Configs tarball %s was already uploaded, not uploading it again.", d.url(name))
+		return name, nil
+	}
+	if err := uploadTarball(ctx, d.withCacheControl(immutableCacheControl), attempts, tarballPath, tarballFormat, tarballDigest, name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// uploadArtifacts uploads the given blob of bytes representing a JSON manifest and the configs
+// tarball in the given format, e.g., "tar.zst", at the given path to the given directory of the
+// given destination, attempting each upload at most the given number of times. The uploaded
+// configs tarball is verified to match the given hex encoded sha256 digest. The configs tarball
+// isn't uploaded if its path is blank, e.g., because it was uploaded to its content addressed path
+// instead. If checksums is true, a SHA256SUMS file listing the digests of the uploaded files is
+// uploaded once they were uploaded.
+func uploadArtifacts(ctx context.Context, d destination, attempts int, manifest []byte, tarballPath, tarballFormat, tarballDigest, remoteDir string, checksums bool) error {
+	if err := upload(ctx, d, attempts, bytes.NewReader(manifest), path.Join(remoteDir, "manifest.json"), "application/json"); err != nil {
+		return fmt.Errorf("error uploading manifest: %w", err)
+	}
+
+	if len(tarballPath) != 0 {
+		if err := uploadTarball(ctx, d, attempts, tarballPath, tarballFormat, tarballDigest, path.Join(remoteDir, tarballName(tarballFormat))); err != nil {
+			return err
+		}
 	}
 
-	if err := s.upload(ctx, f, fmt.Sprintf("%s/rbe_default.tar", remoteDir)); err != nil {
-		return fmt.Errorf("error uploading configs tarball to GCS: %w", err)
+	if !checksums {
+		return nil
+	}
+	// The manifest is hashed as uploaded, i.e., including the upload time.
+	manifestDigest := sha256.Sum256(manifest)
+	var files [][2]string
+	if len(tarballPath) != 0 {
+		files = append(files, [2]string{tarballName(tarballFormat), tarballDigest})
+	}
+	files = append(files, [2]string{"manifest.json", hex.EncodeToString(manifestDigest[:])})
+	sums := sha256Sums(files...)
+	if err := upload(ctx, d, attempts, bytes.NewReader(sums), path.Join(remoteDir, "SHA256SUMS"), "text/plain"); err != nil {
+		return fmt.Errorf("error uploading SHA256SUMS: %w", err)
 	}
 	return nil
 }
@@ -139,37 +424,167 @@ func printFlags() {
 	log.Printf("--configs_manifest=%q \\", *configsManifest)
 	log.Printf("--enable_monitoring=%v \\", *enableMonitoring)
 	log.Printf("--monitoring_project_id=%q \\", *monitoringProjectID)
-	log.Printf("--monitoring_docker_image=%q", *monitoringDockerImage)
+	log.Printf("--monitoring_docker_image=%q \\", *monitoringDockerImage)
+	for _, d := range destinations {
+		log.Printf("--destination=%q \\", d)
+	}
+	if *failFast {
+		log.Printf("--fail_fast=%v \\", *failFast)
+	}
+	if *setTarballURL {
+		log.Printf("--set_tarball_url=%v \\", *setTarballURL)
+	}
+	if *contentAddressed {
+		log.Printf("--content_addressed_path=%v \\", *contentAddressed)
+	}
+	log.Printf("--chunk_size_mb=%v \\", *chunkSizeMB)
+	if len(*googleCredentials) != 0 {
+		log.Printf("--google_credentials=%q \\", *googleCredentials)
+	}
+	if len(*gcsProject) != 0 {
+		log.Printf("--gcs_project=%q \\", *gcsProject)
+	}
+	if *cacheControl != defaultCacheControl {
+		log.Printf("--cache_control=%q \\", *cacheControl)
+	}
+	if *emitChecksums {
+		log.Printf("--emit_checksums=%v \\", *emitChecksums)
+	}
+	log.Printf("--upload_attempts=%v", *uploadAttempts)
+}
+
+// newDestinations returns the destinations of the given URLs. The credentials for GCS are only
+// loaded if any of the destinations is a GCS bucket.
+func newDestinations(ctx context.Context, urls []string) ([]destination, error) {
+	var creds *google.Credentials
+	var principal string
+	var result []destination
+	for _, u := range urls {
+		scheme, host, dir, err := parseDestination(u)
+		if err != nil {
+			return nil, err
+		}
+		if scheme != "gs" {
+			result = append(result, newHTTPDestination(scheme, host, dir, *cacheControl))
+			continue
+		}
+		if creds == nil {
+			if creds, err = loadGoogleCredentials(ctx, *googleCredentials); err != nil {
+				return nil, fmt.Errorf("failed to load the credentials for GCS: %v", err)
+			}
+			principal = credentialsPrincipal(creds)
+			if len(*googleCredentials) != 0 {
+				log.Printf("Uploading to GCS as %s using the credentials in %s.", principal, *googleCredentials)
+			} else {
+				log.Printf("Uploading to GCS as %s using Application Default Credentials.", principal)
+			}
+		}
+		sc, err := newStorage(ctx, creds, principal, host, dir, *gcsProject, *chunkSizeMB*1024*1024, *cacheControl)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize the GCS client for %s: %v", u, err)
+		}
+		result = append(result, sc)
+	}
+	return result, nil
 }
 
 // uploadConfigs is the core config upload logic allowing the caller a convenient wrapper to
 // report results to monitoring before triggering a fatal exit.
 // containerImage is the name of the toolchain container that will be used to name the directory
-// on GCS configs are uploaded to.
+// configs are uploaded to under each destination. The destinations are uploaded to concurrently.
+// A failed destination doesn't stop the uploads to the other destinations unless --fail_fast is
+// specified.
 func uploadConfigs(ctx context.Context, containerImage string) error {
-	sc, err := newStorage(ctx)
+	urls := []string(destinations)
+	if len(urls) == 0 {
+		urls = []string{defaultDestination}
+	}
+	dests, err := newDestinations(ctx, urls)
 	if err != nil {
-		return fmt.Errorf("failed to initialize the GCS client: %v", err)
+		return err
 	}
 
 	m, err := manifestFromFile(*configsManifest)
 	if err != nil {
 		return fmt.Errorf("error reading config manifest: %v", err)
 	}
-	manifestBlob, err := json.MarshalIndent(m, "", " ")
-	if err != nil {
-		return fmt.Errorf("error converting manifest into JSON: %v", err)
+	if len(m.ConfigsTarballDigest) == 0 {
+		return fmt.Errorf("manifest %q did not specify the configs tarball digest needed to verify the upload", *configsManifest)
 	}
 
 	uploadDirs := []string{
-		fmt.Sprintf("bazel-configs/%s/latest", containerImage),
-		fmt.Sprintf("bazel-configs/bazel_%s/%s/latest", m.BazelVersion, containerImage),
+		fmt.Sprintf("%s/latest", containerImage),
+		fmt.Sprintf("bazel_%s/%s/latest", m.BazelVersion, containerImage),
+	}
+	t := &rbeconfigsgen.StageTimings{}
+	defer func() { log.Printf("Stage timings: %s", t) }()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make([]error, len(dests))
+	var wg sync.WaitGroup
+	for i, d := range dests {
+		wg.Add(1)
+		go func(i int, d destination) {
+			defer wg.Done()
+			fail := func(err error) {
+				errs[i] = err
+				log.Printf("Uploading configs to destination %s failed: %v", urls[i], err)
+				if *failFast {
+					cancel()
+				}
+			}
+			// The tarball is uploaded next to each manifest unless it's uploaded once to its
+			// content addressed path.
+			tarballPath := *configsTarball
+			caTarball := ""
+			if *contentAddressed {
+				if err := t.Time(rbeconfigsgen.StageUpload, func() error {
+					var err error
+					caTarball, err = uploadContentAddressedTarball(ctx, d, *uploadAttempts, *configsTarball, m.TarballFormat, m.ConfigsTarballDigest)
+					return err
+				}); err != nil {
+					fail(fmt.Errorf("error uploading the configs tarball to %s: %w", d.url(contentAddressedTarballName(m.ConfigsTarballDigest, m.TarballFormat)), err))
+					return
+				}
+				tarballPath = ""
+			}
+			for _, u := range uploadDirs {
+				tarball := path.Join(u, tarballName(m.TarballFormat))
+				if len(caTarball) != 0 {
+					tarball = caTarball
+				}
+				tarballURL := ""
+				// Consumers can't find the content addressed tarball without its URL.
+				if *setTarballURL || *contentAddressed {
+					tarballURL = d.publicURL(tarball)
+				}
+				if err := t.Time(rbeconfigsgen.StageUpload, func() error {
+					manifestBlob, err := manifestJSON(m, tarballURL)
+					if err != nil {
+						return err
+					}
+					return uploadArtifacts(ctx, d, *uploadAttempts, manifestBlob, tarballPath, m.TarballFormat, m.ConfigsTarballDigest, u, *emitChecksums)
+				}); err != nil {
+					fail(fmt.Errorf("error uploading configs to %s: %w", d.url(u), err))
+					return
+				}
+				log.Printf("Configs published to %s & %s.", d.url(tarball), d.url(path.Join(u, "manifest.json")))
+			}
+		}(i, d)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", urls[i], err))
+		}
 	}
-	for _, u := range uploadDirs {
-		if err := sc.uploadArtifacts(ctx, manifestBlob, *configsTarball, u); err != nil {
-			return fmt.Errorf("error uploading configs to GCS bucket %s, directory %s: %v", sc.bucketName, u, err)
+	if len(failed) != 0 {
+		return &rbeconfigsgen.StageError{
+			Stage: rbeconfigsgen.StageUpload,
+			Err:   fmt.Errorf("configs upload failed for %d of %d destinations:\n%s", len(failed), len(dests), strings.Join(failed, "\n")),
 		}
-		log.Printf("Configs published to GCS bucket %s, directory %s.", sc.bucketName, u)
 	}
 	return nil
 }
@@ -191,15 +606,33 @@ func initMonitoringClient(ctx context.Context) (*monitoring.Client, error) {
 	return c, nil
 }
 
+// usageFatalf logs the given message about invalid flags & exits with the exit code of usage
+// errors.
+func usageFatalf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+	os.Exit(rbeconfigsgen.ExitCodeUsage)
+}
+
 func main() {
 	flag.Parse()
 	printFlags()
 
 	if len(*configsTarball) == 0 {
-		log.Fatalf("--configs_tarball was not specified.")
+		usageFatalf("--configs_tarball was not specified.")
 	}
 	if len(*configsManifest) == 0 {
-		log.Fatalf("--configs_manifest was not specified.")
+		usageFatalf("--configs_manifest was not specified.")
+	}
+	if *chunkSizeMB < 0 {
+		usageFatalf("--chunk_size_mb must not be negative, got %d.", *chunkSizeMB)
+	}
+	if *uploadAttempts < 1 {
+		usageFatalf("--upload_attempts must be at least 1, got %d.", *uploadAttempts)
+	}
+	for _, d := range destinations {
+		if _, _, _, err := parseDestination(d); err != nil {
+			usageFatalf("Invalid --destination: %v.", err)
+		}
 	}
 
 	ctx := context.Background()
@@ -209,9 +642,11 @@ func main() {
 	}
 
 	result := true
+	exitCode := 0
 	if err := uploadConfigs(ctx, *monitoringDockerImage); err != nil {
 		log.Printf("Configs upload failed: %v", err)
 		result = false
+		exitCode = rbeconfigsgen.ExitCode(err)
 	} else {
 		log.Printf("Configs uploaded successfully.")
 	}
@@ -223,6 +658,6 @@ func main() {
 		}
 	}
 	if !result {
-		os.Exit(1)
+		os.Exit(exitCode)
 	}
 }
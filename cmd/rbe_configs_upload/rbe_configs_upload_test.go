@@ -0,0 +1,96 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/oauth2/google"
+)
+
+func TestCredentialsPrincipal(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want string
+	}{
+		{
+			name: "Service account key",
+			json: `{"type": "service_account", "client_email": "uploader@project.iam.gserviceaccount.com", "client_id": "123"}`,
+			want: "uploader@project.iam.gserviceaccount.com",
+		},
+		{
+			name: "User credentials",
+			json: `{"type": "authorized_user", "client_id": "123.apps.googleusercontent.com"}`,
+			want: "user credentials of OAuth client 123.apps.googleusercontent.com",
+		},
+		{
+			name: "External account impersonating a service account",
+			json: `{"type": "external_account", "audience": "//iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/pool/providers/github", "service_account_impersonation_url": "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/uploader@project.iam.gserviceaccount.com:generateAccessToken"}`,
+			want: "uploader@project.iam.gserviceaccount.com",
+		},
+		{
+			name: "External account without impersonation",
+			json: `{"type": "external_account", "audience": "//iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/pool/providers/github"}`,
+			want: "external account of workload identity pool provider //iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/pool/providers/github",
+		},
+		{
+			name: "Unknown type",
+			json: `{"type": "impersonated_service_account"}`,
+			want: `unknown principal of "impersonated_service_account" credentials`,
+		},
+		{
+			name: "Invalid JSON",
+			json: `{`,
+			want: "unknown principal",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if got := credentialsPrincipal(&google.Credentials{JSON: []byte(tc.json)}); got != tc.want {
+				t.Errorf("credentialsPrincipal(%s)=%q, want %q", tc.json, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoadGoogleCredentialsExternalAccount(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "credentials.json")
+	// The subject token is only read once a token is requested.
+	json := `{
+  "type": "external_account",
+  "audience": "//iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/pool/providers/github",
+  "subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+  "token_url": "https://sts.googleapis.com/v1/token",
+  "service_account_impersonation_url": "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/uploader@project.iam.gserviceaccount.com:generateAccessToken",
+  "credential_source": {"file": "` + filepath.Join(dir, "token") + `"}
+}`
+	if err := ioutil.WriteFile(path, []byte(json), 0644); err != nil {
+		t.Fatalf("Unable to write the credentials file: %v", err)
+	}
+	c, err := loadGoogleCredentials(context.Background(), path)
+	if err != nil {
+		t.Fatalf("loadGoogleCredentials() failed for external account credentials: %v", err)
+	}
+	if got, want := credentialsPrincipal(c), "uploader@project.iam.gserviceaccount.com"; got != want {
+		t.Errorf("credentialsPrincipal() of the loaded external account credentials=%q, want %q", got, want)
+	}
+}
@@ -3,12 +3,18 @@ module github.com/bazelbuild/bazel-toolchains
 go 1.16
 
 require (
-	cloud.google.com/go v0.57.0
-	cloud.google.com/go/storage v1.6.0
-	github.com/bazelbuild/bazelisk v1.7.4
+	cloud.google.com/go v0.65.0
+	cloud.google.com/go/storage v1.10.0
 	github.com/coreos/go-semver v0.3.0
-	github.com/golang/protobuf v1.4.1
-	github.com/google/go-containerregistry v0.4.0
+	github.com/golang/protobuf v1.4.2
+	github.com/google/go-cmp v0.5.2 // indirect
 	github.com/googleapis/gax-go/v2 v2.0.5
-	google.golang.org/genproto v0.0.0-20200527145253-8367513e4ece
+	github.com/klauspost/compress v1.14.4
+	golang.org/x/net v0.0.0-20201110031124-69a78807bb2b // indirect
+	golang.org/x/oauth2 v0.0.0-20210514164344-f6687ab2804c
+	golang.org/x/text v0.3.4 // indirect
+	golang.org/x/tools v0.0.0-20200916195026-c9a70fc28ce3 // indirect
+	google.golang.org/api v0.30.0
+	google.golang.org/genproto v0.0.0-20200825200019-8632dd797987
+	gopkg.in/yaml.v2 v2.3.0 // indirect
 )
@@ -0,0 +1,179 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Package logging provides leveled logging on top of the standard log package. Messages below the
+// configured level are dropped. Messages logged directly with the standard log package are always
+// printed. Messages logged with a Logger created with a Handler go to the Handler instead of the
+// standard log package.
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Level is the severity of a log message.
+type Level int32
+
+const (
+	// Debug is for detailed messages only useful when debugging, e.g., every command that's run.
+	Debug Level = iota
+	// Info is for messages describing the progress of the tool. This is the default level.
+	Info
+	// Warning is for unexpected conditions that don't cause a failure.
+	Warning
+	// Error is for failures.
+	Error
+)
+
+var (
+	// levelNames maps the names of levels accepted by ParseLevel to levels.
+	levelNames = map[string]Level{
+		"debug": Debug,
+		"info":  Info,
+		"warn":  Warning,
+		"error": Error,
+	}
+
+	// level is the minimum level of messages that are printed.
+	level = int32(Info)
+)
+
+// Handler receives the messages logged at enabled levels, formatted but without the "Warning: " or
+// "Error: " prefix of warnings & errors. It must be safe for concurrent use.
+type Handler func(l Level, msg string)
+
+// Logger logs messages at enabled levels to its Handler. Each Logger has its own Handler so
+// concurrent users, e.g., concurrent config generation runs,
+// don't receive each other's messages. A nil Logger prints messages with the standard log package.
+type Logger struct {
+	handler Handler
+}
+
+// NewLogger returns a Logger passing messages to the given handler. A nil handler prints messages
+// with the standard log package.
+func NewLogger(h Handler) *Logger {
+	return &Logger{handler: h}
+}
+
+// Print prints the given message at the given level with the standard log package the way
+// messages are printed without a handler, regardless of the configured level.
+func Print(l Level, msg string) {
+	switch l {
+	case Warning:
+		log.Print("Warning: " + msg)
+	case Error:
+		log.Print("Error: " + msg)
+	default:
+		log.Print(msg)
+	}
+}
+
+// logf passes the message at the given level to the given handler or prints it if the level is
+// enabled.
+func logf(h Handler, l Level, format string, v ...interface{}) {
+	if !Enabled(l) {
+		return
+	}
+	msg := fmt.Sprintf(format, v...)
+	if h != nil {
+		h(l, msg)
+		return
+	}
+	Print(l, msg)
+}
+
+// logf logs the message at the given level to the handler of the logger.
+func (lg *Logger) logf(l Level, format string, v ...interface{}) {
+	var h Handler
+	if lg != nil {
+		h = lg.handler
+	}
+	logf(h, l, format, v...)
+}
+
+// Debugf logs a message at level Debug with arguments handled in the manner of fmt.Printf.
+func (lg *Logger) Debugf(format string, v ...interface{}) {
+	lg.logf(Debug, format, v...)
+}
+
+// Infof logs a message at level Info with arguments handled in the manner of fmt.Printf.
+func (lg *Logger) Infof(format string, v ...interface{}) {
+	lg.logf(Info, format, v...)
+}
+
+// Warningf logs a message at level Warning with arguments handled in the manner of fmt.Printf.
+func (lg *Logger) Warningf(format string, v ...interface{}) {
+	lg.logf(Warning, format, v...)
+}
+
+// Errorf logs a message at level Error with arguments handled in the manner of fmt.Printf.
+func (lg *Logger) Errorf(format string, v ...interface{}) {
+	lg.logf(Error, format, v...)
+}
+
+// ParseLevel returns the level with the given name (debug|info|warn|error).
+func ParseLevel(name string) (Level, error) {
+	l, ok := levelNames[strings.ToLower(name)]
+	if !ok {
+		return Info, fmt.Errorf("invalid log level %q, want one of debug, info, warn or error", name)
+	}
+	return l, nil
+}
+
+// SetLevel sets the minimum level of messages that are printed.
+func SetLevel(l Level) {
+	atomic.StoreInt32(&level, int32(l))
+}
+
+// Enabled returns whether messages at the given level are printed.
+func Enabled(l Level) bool {
+	return int32(l) >= atomic.LoadInt32(&level)
+}
+
+// Debugf logs a message at level Debug with arguments handled in the manner of fmt.Printf.
+func Debugf(format string, v ...interface{}) {
+	logf(nil, Debug, format, v...)
+}
+
+// Infof logs a message at level Info with arguments handled in the manner of fmt.Printf.
+func Infof(format string, v ...interface{}) {
+	logf(nil, Info, format, v...)
+}
+
+// Warningf logs a message at level Warning with arguments handled in the manner of fmt.Printf.
+func Warningf(format string, v ...interface{}) {
+	logf(nil, Warning, format, v...)
+}
+
+// Errorf logs a message at level Error with arguments handled in the manner of fmt.Printf.
+func Errorf(format string, v ...interface{}) {
+	logf(nil, Error, format, v...)
+}
+
+// Configure sets the minimum level of printed messages to the level with the given name. If quiet
+// is true, only warnings & errors are printed regardless of the given level name.
+func Configure(name string, quiet bool) error {
+	l, err := ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	if quiet && l < Warning {
+		l = Warning
+	}
+	SetLevel(l)
+	return nil
+}
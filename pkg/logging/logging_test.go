@@ -0,0 +1,107 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package logging
+
+import (
+	"testing"
+)
+
+func TestConfigure(t *testing.T) {
+	testCases := []struct {
+		name      string
+		levelName string
+		quiet     bool
+		wantLevel Level
+		wantErr   bool
+	}{
+		{
+			name:      "Debug",
+			levelName: "debug",
+			wantLevel: Debug,
+		},
+		{
+			name:      "CaseInsensitive",
+			levelName: "WARN",
+			wantLevel: Warning,
+		},
+		{
+			name:      "QuietOverridesInfo",
+			levelName: "info",
+			quiet:     true,
+			wantLevel: Warning,
+		},
+		{
+			name:      "QuietKeepsError",
+			levelName: "error",
+			quiet:     true,
+			wantLevel: Error,
+		},
+		{
+			name:      "InvalidLevel",
+			levelName: "verbose",
+			wantErr:   true,
+		},
+	}
+	defer SetLevel(Info)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			SetLevel(Info)
+			err := Configure(tc.levelName, tc.quiet)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("Configure(%q, %v) succeeded, want error", tc.levelName, tc.quiet)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Configure(%q, %v) failed: %v", tc.levelName, tc.quiet, err)
+			}
+			if !Enabled(tc.wantLevel) || (tc.wantLevel > Debug && Enabled(tc.wantLevel-1)) {
+				t.Errorf("Configure(%q, %v) enabled the wrong levels, want minimum level %v", tc.levelName, tc.quiet, tc.wantLevel)
+			}
+		})
+	}
+}
+
+func TestLogger(t *testing.T) {
+	type message struct {
+		level Level
+		msg   string
+	}
+	var got1, got2 []message
+	defer SetLevel(Info)
+	SetLevel(Info)
+	l1 := NewLogger(func(l Level, msg string) {
+		got1 = append(got1, message{l, msg})
+	})
+	l2 := NewLogger(func(l Level, msg string) {
+		got2 = append(got2, message{l, msg})
+	})
+	l1.Debugf("dropped %d", 1)
+	l1.Infof("info %d", 2)
+	l2.Warningf("warning %q", "w")
+	Infof("printed")
+	var nilLogger *Logger
+	nilLogger.Errorf("printed by a nil logger")
+
+	want1 := []message{{Info, "info 2"}}
+	if len(got1) != len(want1) || got1[0] != want1[0] {
+		t.Errorf("Handler of the first logger received %v, want %v", got1, want1)
+	}
+	want2 := []message{{Warning, `warning "w"`}}
+	if len(got2) != len(want2) || got2[0] != want2[0] {
+		t.Errorf("Handler of the second logger received %v, want %v", got2, want2)
+	}
+}
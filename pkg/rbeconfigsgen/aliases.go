@@ -0,0 +1,94 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+)
+
+// aliasBuildFile is the name of the top-level BUILD file of the generated configs with the alias
+// targets pointing at the canonical targets.
+const aliasBuildFile = "BUILD"
+
+// aliasBuildTemplate is the template for the top-level BUILD file with the alias targets. The
+// LICENSE is exported too because the BUILD file makes the top-level directory a package.
+var aliasBuildTemplate = template.Must(template.New("aliasBuild").Parse(buildHeader + `
+package(default_visibility = ["//visibility:public"])
+
+exports_files(["LICENSE"])
+{{ range . }}
+alias(
+    name = "{{ .Name }}",
+    actual = "{{ .Actual }}",
+)
+{{ end }}`))
+
+// configAlias is an alias target in the top-level BUILD file of the generated configs.
+type configAlias struct {
+	// Name is the name of the alias target, e.g., "platform".
+	Name string
+	// Actual is the label of the canonical target relative to the repository containing the
+	// configs, e.g., "//config:platform".
+	Actual string
+	// field is the JSON name of the field of the Summary with the label of the canonical target,
+	// e.g., "platform".
+	field string
+}
+
+// writesAliases returns whether the top-level BUILD file with the alias targets is written
+// according to the given options. It isn't written if only some kind of configs is written
+// because it'd replace the aliases of the other configs or if the configs are copied to the root
+// of the source repository which has a top-level BUILD file of its own.
+func writesAliases(o *Options) bool {
+	if len(o.Only) != 0 && o.Only != OnlyAll {
+		return false
+	}
+	return len(o.OutputSourceRoot) == 0 || len(o.OutputConfigPath) != 0
+}
+
+// configAliases returns the alias targets for the configs generated according to the given
+// options or nothing if the aliases aren't written.
+func configAliases(o *Options) []configAlias {
+	if !writesAliases(o) {
+		return nil
+	}
+	aliases := []configAlias{{Name: "platform", Actual: repoLabel(o, "config", platformName(o)), field: "platform"}}
+	if o.GenCPPConfigs {
+		aliases = append(aliases, configAlias{Name: "toolchain", Actual: repoLabel(o, "config", "cc-toolchain"), field: "cc_toolchain"})
+	}
+	if o.GenJavaConfigs {
+		aliases = append(aliases, configAlias{Name: "jdk", Actual: repoLabel(o, "java", "jdk"), field: "java_runtime"})
+	}
+	return aliases
+}
+
+// genAliasBuild generates the top-level BUILD file with the alias targets for the configs
+// generated according to the given options. The name is blank if the aliases aren't written.
+func genAliasBuild(o *Options) (generatedFile, error) {
+	aliases := configAliases(o)
+	if len(aliases) == 0 {
+		return generatedFile{}, nil
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := aliasBuildTemplate.Execute(buf, aliases); err != nil {
+		return generatedFile{}, fmt.Errorf("failed to generate the BUILD file with the alias targets: %w", err)
+	}
+	return generatedFile{
+		name:     aliasBuildFile,
+		contents: buf.Bytes(),
+	}, nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenAliasBuild(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  *Options
+		// want are the alias targets expected in the BUILD file. Nothing if it isn't written.
+		want []string
+	}{
+		{
+			name: "Tarball output, C++ and Java",
+			opt:  &Options{GenCPPConfigs: true, GenJavaConfigs: true},
+			want: []string{
+				"alias(\n    name = \"platform\",\n    actual = \"//config:platform\",\n)",
+				"alias(\n    name = \"toolchain\",\n    actual = \"//config:cc-toolchain\",\n)",
+				"alias(\n    name = \"jdk\",\n    actual = \"//java:jdk\",\n)",
+			},
+		},
+		{
+			name: "Source root output with config path",
+			opt:  &Options{OutputSourceRoot: "/src", OutputConfigPath: "configs/rbe", GenCPPConfigs: true},
+			want: []string{
+				"alias(\n    name = \"platform\",\n    actual = \"//configs/rbe/config:platform\",\n)",
+				"alias(\n    name = \"toolchain\",\n    actual = \"//configs/rbe/config:cc-toolchain\",\n)",
+			},
+		},
+		{
+			name: "Source root output at root",
+			opt:  &Options{OutputSourceRoot: "/src", GenCPPConfigs: true},
+		},
+		{
+			name: "Only Java configs",
+			opt:  &Options{GenJavaConfigs: true, Only: OnlyJava},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			g, err := genAliasBuild(tc.opt)
+			if err != nil {
+				t.Fatalf("genAliasBuild() failed: %v", err)
+			}
+			if len(tc.want) == 0 {
+				if len(g.name) != 0 {
+					t.Fatalf("genAliasBuild() generated %s, want nothing", g.name)
+				}
+				return
+			}
+			if g.name != aliasBuildFile {
+				t.Fatalf("genAliasBuild() generated %q, want %q", g.name, aliasBuildFile)
+			}
+			got := string(g.contents)
+			if n := strings.Count(got, "alias("); n != len(tc.want) {
+				t.Errorf("genAliasBuild() generated %d aliases, want %d:\n%s", n, len(tc.want), got)
+			}
+			for _, w := range append(tc.want, `exports_files(["LICENSE"])`) {
+				if !strings.Contains(got, w) {
+					t.Errorf("genAliasBuild() generated:\n%s\nwant it to contain:\n%s", got, w)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bazelbuild/bazel-toolchains/pkg/logging"
+)
+
+const (
+	// apptainerBindPath is the directory in Apptainer toolchain containers the local directory of
+	// the container is bound at. Apptainer images are read-only so the working directory is created
+	// in it & files are copied into & out of the container through the local directory.
+	apptainerBindPath = "/rbe_configs_gen"
+	// apptainerHomePath is the home directory of Apptainer toolchain containers. It's backed by a
+	// local directory of the container so files written to it, e.g., the Bazel output base, can be
+	// copied out of the container too.
+	apptainerHomePath = "/home/rbe_configs_gen"
+)
+
+// apptainerClient returns the Apptainer client on the PATH falling back to the Singularity client
+// it was renamed from, along with the prefix of the host environment variables the client sets in
+// the container.
+func apptainerClient() (string, string) {
+	if _, err := exec.LookPath("apptainer"); err != nil {
+		if _, err := exec.LookPath("singularity"); err == nil {
+			return "singularity", "SINGULARITYENV_"
+		}
+	}
+	return "apptainer", "APPTAINERENV_"
+}
+
+// validateApptainerOptions verifies the given options specifying an ApptainerImage don't specify
+// another toolchain image or options only supported for docker containers.
+func validateApptainerOptions(o *Options) error {
+	if o.ToolchainContainer != "" || o.ImageTarball != "" || o.ExistingContainer != "" || o.Dockerfile != "" {
+		return fmt.Errorf("ApptainerImage=%q can't be specified with ToolchainContainer, ImageTarball, ExistingContainer or Dockerfile", o.ApptainerImage)
+	}
+	if o.ExecOS != OSLinux {
+		return fmt.Errorf("ApptainerImage is only supported for ExecOS %q, got %q", OSLinux, o.ExecOS)
+	}
+	if o.PlatformImageOverride == "" {
+		return fmt.Errorf("PlatformImageOverride must be specified with ApptainerImage because remote execution backends can't pull a local Apptainer image referenced by its path")
+	}
+	if s, err := os.Stat(o.ApptainerImage); err != nil {
+		return fmt.Errorf("unable to access ApptainerImage %q: %w", o.ApptainerImage, err)
+	} else if !s.Mode().IsRegular() {
+		return fmt.Errorf("ApptainerImage %q is not a regular file", o.ApptainerImage)
+	}
+	dockerOnly := []struct {
+		name string
+		set  bool
+	}{
+		{"DockerPlatform", o.DockerPlatform != ""},
+		{"ContainerTmpfsSize", o.ContainerTmpfsSize != ""},
+		{"ScratchMount", o.ScratchMount != ""},
+		{"ContainerRunFlags", len(o.ContainerRunFlags) != 0},
+		{"RunEntrypoint", o.RunEntrypoint},
+		{"NoShell", o.NoShell},
+	}
+	for _, f := range dockerOnly {
+		if f.set {
+			return fmt.Errorf("%s can't be specified with ApptainerImage because it only applies to docker containers", f.name)
+		}
+	}
+	return nil
+}
+
+// newApptainerRunner returns a runner for the local Apptainer (Singularity) SIF image at the given
+// path. Commands are run in the image with "apptainer exec" instead of in a docker container so
+// there's nothing to pull or remove. The image is resolved to its absolute path with the sha256
+// digest of the SIF file appended. The containers of the image are local directories created in
+// the given directory which are removed by the cleanup function if stopContainer is true. Apptainer
+// commands are killed once the given context is done.
+func newApptainerRunner(ctx context.Context, log *logging.Logger, image, containersDir string, stopContainer bool) (*dockerRunner, error) {
+	abs, err := filepath.Abs(image)
+	if err != nil {
+		return nil, fmt.Errorf("unable to determine the absolute path of Apptainer image %q: %w", image, err)
+	}
+	digest, err := digestFile(abs)
+	if err != nil {
+		return nil, fmt.Errorf("unable to compute the digest of Apptainer image %q: %w", image, err)
+	}
+	client, envPrefix := apptainerClient()
+	d := &dockerRunner{
+		containerImage:     abs,
+		stopContainer:      stopContainer,
+		execOS:             OSLinux,
+		dockerPath:         client,
+		apptainerDir:       containersDir,
+		apptainerEnvPrefix: envPrefix,
+		resolvedImage:      fmt.Sprintf("%s@sha256:%s", abs, digest),
+		ctx:                ctx,
+		log:                log,
+	}
+	if d.imageLabels, err = d.apptainerLabels(); err != nil {
+		return nil, err
+	}
+	d.log.Infof("Resolved Apptainer image %q to %q with %d labels.", image, d.resolvedImage, len(d.imageLabels))
+	return d, nil
+}
+
+// apptainerLabels returns the labels embedded in the metadata of the Apptainer image of the runner.
+func (d *dockerRunner) apptainerLabels() (map[string]string, error) {
+	out, err := runCmd(d.ctx, d.log, d.dockerPath, "inspect", "--labels", "--json", d.containerImage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect the labels of Apptainer image %q: %w", d.containerImage, err)
+	}
+	var i struct {
+		Data struct {
+			Attributes struct {
+				Labels map[string]string `json:"labels"`
+			} `json:"attributes"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(out), &i); err != nil {
+		return nil, fmt.Errorf("unable to parse the labels of Apptainer image %q from %q: %w", d.containerImage, out, err)
+	}
+	return i.Data.Attributes.Labels, nil
+}
+
+// startApptainerContainer creates the local directory of a new container of the Apptainer image of
+// the runner. It holds the home directory, /tmp & the directory bound at apptainerBindPath of the
+// container so they persist between the commands run in it.
+func (d *dockerRunner) startApptainerContainer() error {
+	dir, err := ioutil.TempDir(d.apptainerDir, "apptainer_container_")
+	if err != nil {
+		return fmt.Errorf("unable to create the local directory of the Apptainer container: %w", err)
+	}
+	for _, sub := range []string{"home", "tmp", "bind"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0755); err != nil {
+			return fmt.Errorf("unable to create the local directory of the Apptainer container: %w", err)
+		}
+	}
+	d.containerID = dir
+	d.log.Infof("Created local directory %q for a container of Apptainer image %v.", d.containerID, d.resolvedImage)
+	return nil
+}
+
+// execApptainer runs the given command in a container of the Apptainer image of the runner with
+// the local directory of the container bound into it & returns the output with whitespace trimmed
+// from the edges. The environment of the host isn't passed into the container. The command runs in
+// its own PID namespace so processes it leaves behind, e.g., the Bazel server, are killed once it
+// exits instead of outliving the container.
+func (d *dockerRunner) execApptainer(args ...string) (string, error) {
+	a := []string{"exec", "--cleanenv", "--contain", "--pid",
+		"--home", fmt.Sprintf("%s:%s", filepath.Join(d.containerID, "home"), apptainerHomePath),
+		"--workdir", filepath.Join(d.containerID, "tmp"),
+		"--bind", fmt.Sprintf("%s:%s", filepath.Join(d.containerID, "bind"), apptainerBindPath),
+	}
+	if d.workdir != "" {
+		a = append(a, "--pwd", d.workdir)
+	}
+	a = append(a, d.containerImage)
+	a = append(a, args...)
+	// The --env flag of apptainer exec splits values at commas so the environment is passed with
+	// prefixed environment variables of the client instead.
+	var env []string
+	for _, e := range append(append([]string(nil), d.initEnv...), d.env...) {
+		env = append(env, d.apptainerEnvPrefix+e)
+	}
+	o, err := runCmdEnv(d.ctx, d.log, env, d.dockerPath, a...)
+	return strings.TrimSpace(o), err
+}
+
+// getApptainerEnv gets the environment variables set by the Apptainer image of the runner.
+func (d *dockerRunner) getApptainerEnv() (map[string]string, error) {
+	o, err := runCmd(d.ctx, d.log, d.dockerPath, "exec", "--cleanenv", "--contain", d.containerImage, "env")
+	if err != nil {
+		return nil, fmt.Errorf("failed to run env in Apptainer image %q to get environment variables: %w", d.containerImage, err)
+	}
+	return parseEnv(o), nil
+}
+
+// apptainerLocalPath returns the local path of the given path inside the current container of the
+// Apptainer image of the runner which must be in apptainerBindPath or apptainerHomePath.
+func (d *dockerRunner) apptainerLocalPath(p string) (string, error) {
+	p = path.Clean(p)
+	for dir, local := range map[string]string{apptainerBindPath: "bind", apptainerHomePath: "home"} {
+		if p == dir || strings.HasPrefix(p, dir+"/") {
+			return filepath.Join(d.containerID, local, filepath.FromSlash(strings.TrimPrefix(p, dir))), nil
+		}
+	}
+	return "", fmt.Errorf("path %q in the Apptainer container isn't in %s or %s, the only directories files can be copied into or out of", p, apptainerBindPath, apptainerHomePath)
+}
+
+// copyLocalTree copies the file, symlink or directory at 'src' to 'dst' recursively keeping the
+// permissions of the copied files.
+func copyLocalTree(dst, src string) error {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		t := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(t, info.Mode().Perm()|0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			l, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(l, t)
+		}
+		if err := copyLocalFile(t, p); err != nil {
+			return err
+		}
+		return os.Chmod(t, info.Mode().Perm())
+	})
+}
+
+// cleanupApptainer removes the local directory of the current container of the Apptainer image of
+// the runner if stopContainer was true when the runner was created.
+func (d *dockerRunner) cleanupApptainer() {
+	if d.containerID == "" {
+		return
+	}
+	if !d.stopContainer {
+		d.log.Infof("Not removing local directory %q of the container of Apptainer image %v because the Cleanup option was set to false.", d.containerID, d.resolvedImage)
+		return
+	}
+	if err := os.RemoveAll(d.containerID); err != nil {
+		d.log.Warningf("Failed to remove local directory %q of the container of Apptainer image %v but it's ok to ignore this error if config generation & extraction succeeded: %v", d.containerID, d.resolvedImage, err)
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestApptainerRunner(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake apptainer client is a shell script")
+	}
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "apptainer.log")
+	// The fake apptainer client records its arguments, reports the labels of the image & prints
+	// the environment variable it was asked to set in the container.
+	script := fmt.Sprintf(`#!/bin/sh
+echo "$@" >> %q
+case "$1" in
+inspect) echo '{"data":{"attributes":{"labels":{"org.opencontainers.image.title":"toolchain"}}},"type":"container"}' ;;
+exec) echo "FOO=$APPTAINERENV_FOO" ;;
+esac
+`, logPath)
+	if err := ioutil.WriteFile(filepath.Join(dir, "apptainer"), []byte(script), 0755); err != nil {
+		t.Fatalf("Unable to write fake apptainer client: %v", err)
+	}
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(filepath.ListSeparator)+oldPath)
+	defer os.Setenv("PATH", oldPath)
+
+	image := filepath.Join(dir, "toolchain.sif")
+	if err := ioutil.WriteFile(image, []byte("sif"), 0644); err != nil {
+		t.Fatalf("Unable to write fake Apptainer image: %v", err)
+	}
+	digest, err := digestFile(image)
+	if err != nil {
+		t.Fatalf("Unable to compute the digest of the fake Apptainer image: %v", err)
+	}
+	containersDir := filepath.Join(dir, "containers")
+	if err := os.Mkdir(containersDir, 0755); err != nil {
+		t.Fatalf("Unable to create the containers directory: %v", err)
+	}
+	d, err := newApptainerRunner(context.Background(), nil, image, containersDir, true)
+	if err != nil {
+		t.Fatalf("newApptainerRunner failed: %v", err)
+	}
+	if want := image + "@sha256:" + digest; d.resolvedImage != want {
+		t.Errorf("newApptainerRunner resolved the image to %q, want %q", d.resolvedImage, want)
+	}
+	if want := map[string]string{"org.opencontainers.image.title": "toolchain"}; !reflect.DeepEqual(d.imageLabels, want) {
+		t.Errorf("newApptainerRunner returned image labels %v, want %v", d.imageLabels, want)
+	}
+	if err := d.startContainer(); err != nil {
+		t.Fatalf("startContainer failed: %v", err)
+	}
+	containerDir := d.containerID
+	// The fake apptainer client doesn't run commands so the working directory is created locally.
+	if err := os.Mkdir(filepath.Join(containerDir, "bind", "workdir"), 0755); err != nil {
+		t.Fatalf("Unable to create the working directory of the container: %v", err)
+	}
+
+	src := filepath.Join(dir, "probe.cc")
+	if err := ioutil.WriteFile(src, []byte("int main() {}"), 0644); err != nil {
+		t.Fatalf("Unable to write the file to copy: %v", err)
+	}
+	if err := d.copyToContainer(src, "/rbe_configs_gen/workdir/probe.cc"); err != nil {
+		t.Fatalf("copyToContainer failed: %v", err)
+	}
+	if err := d.copyToContainer(src, "/workdir/probe.cc"); err == nil {
+		t.Errorf("copyToContainer outside %s & %s succeeded, want error", apptainerBindPath, apptainerHomePath)
+	}
+	// Files in the home directory, e.g., the Bazel output base, can be copied out of the container.
+	if err := d.copyToContainer(src, "/home/rbe_configs_gen/probe.cc"); err != nil {
+		t.Fatalf("copyToContainer into %s failed: %v", apptainerHomePath, err)
+	}
+	if _, err := os.Stat(filepath.Join(containerDir, "home", "probe.cc")); err != nil {
+		t.Errorf("copyToContainer into %s didn't copy the file into the local home directory of the container: %v", apptainerHomePath, err)
+	}
+	dst := filepath.Join(dir, "copied.cc")
+	if err := d.copyFromContainer("/rbe_configs_gen/workdir/probe.cc", dst); err != nil {
+		t.Fatalf("copyFromContainer failed: %v", err)
+	}
+	if blob, err := ioutil.ReadFile(dst); err != nil || string(blob) != "int main() {}" {
+		t.Errorf("copyFromContainer copied %q, %v, want the contents of the file copied into the container", blob, err)
+	}
+
+	d.workdir = "/rbe_configs_gen/workdir"
+	d.env = []string{"FOO=a,b"}
+	out, err := d.execCmd("true")
+	if err != nil {
+		t.Fatalf("execCmd failed: %v", err)
+	}
+	if out != "FOO=a,b" {
+		t.Errorf("execCmd passed the environment %q into the container, want %q", out, "FOO=a,b")
+	}
+	d.cleanup()
+	if _, err := os.Stat(containerDir); !os.IsNotExist(err) {
+		t.Errorf("cleanup didn't remove the local directory %q of the container: %v", containerDir, err)
+	}
+
+	blob, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("Unable to read the fake apptainer client log: %v", err)
+	}
+	want := fmt.Sprintf("exec --cleanenv --contain --pid --home %s/home:/home/rbe_configs_gen --workdir %s/tmp --bind %s/bind:/rbe_configs_gen --pwd /rbe_configs_gen/workdir %s true", containerDir, containerDir, containerDir, image)
+	if !strings.Contains(string(blob), want) {
+		t.Errorf("execCmd didn't run %q, apptainer was invoked with:\n%s", want, blob)
+	}
+}
+
+func TestValidateApptainerOptions(t *testing.T) {
+	image := filepath.Join(t.TempDir(), "toolchain.sif")
+	if err := ioutil.WriteFile(image, []byte("sif"), 0644); err != nil {
+		t.Fatalf("Unable to write fake Apptainer image: %v", err)
+	}
+	override := "docker://gcr.io/foo/bar@sha256:" + strings.Repeat("a", 64)
+	tests := []struct {
+		name    string
+		o       *Options
+		wantErr string
+	}{
+		{
+			name: "Valid",
+			o:    &Options{ApptainerImage: image, ExecOS: OSLinux, PlatformImageOverride: override},
+		},
+		{
+			name:    "No platform image override",
+			o:       &Options{ApptainerImage: image, ExecOS: OSLinux},
+			wantErr: "PlatformImageOverride must be specified",
+		},
+		{
+			name:    "Docker image",
+			o:       &Options{ApptainerImage: image, ToolchainContainer: "gcr.io/foo/bar:latest", ExecOS: OSLinux},
+			wantErr: "can't be specified with ToolchainContainer",
+		},
+		{
+			name:    "Windows",
+			o:       &Options{ApptainerImage: image, ExecOS: OSWindows},
+			wantErr: "only supported for ExecOS",
+		},
+		{
+			name:    "Missing image",
+			o:       &Options{ApptainerImage: image + ".missing", ExecOS: OSLinux, PlatformImageOverride: override},
+			wantErr: "unable to access ApptainerImage",
+		},
+		{
+			name:    "Docker only option",
+			o:       &Options{ApptainerImage: image, ExecOS: OSLinux, PlatformImageOverride: override, ContainerRunFlags: []string{"--network=host"}},
+			wantErr: "ContainerRunFlags can't be specified with ApptainerImage",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateApptainerOptions(tc.o)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateApptainerOptions() failed: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("validateApptainerOptions() = %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/bazelbuild/bazel-toolchains/pkg/logging"
+)
+
+// BatchInput is a toolchain image & CPU to generate configs for along with other images in a
+// single batch.
+type BatchInput struct {
+	// ToolchainContainer is the docker image to generate configs for. Required.
+	ToolchainContainer string `json:"toolchain_container"`
+	// ExecCPU is the CPU architecture of the image, e.g., CPUAarch64. Defaults to the ExecCPU of
+	// the options shared by the batch.
+	ExecCPU string `json:"exec_cpu,omitempty"`
+	// OutputTarball is the path the configs tarball for the image is written to. Required.
+	OutputTarball string `json:"output_tarball"`
+	// OutputManifest is the path the JSON manifest for the image is written to. Optional.
+	OutputManifest string `json:"output_manifest,omitempty"`
+}
+
+// String returns a description of the given input for log & error messages.
+func (in BatchInput) String() string {
+	if len(in.ExecCPU) == 0 {
+		return in.ToolchainContainer
+	}
+	return fmt.Sprintf("%s (%s)", in.ToolchainContainer, in.ExecCPU)
+}
+
+// BatchOptions control how the configs for the images in a batch are generated.
+type BatchOptions struct {
+	// MaxParallel is the maximum number of images probed concurrently. Defaults to the number of
+	// CPUs if not positive.
+	MaxParallel int
+	// FailFast cancels generating configs for the remaining images once generating configs for an
+	// image failed.
+	FailFast bool
+}
+
+// BatchResult is the outcome of generating configs for an image in a batch.
+type BatchResult struct {
+	// Input is the image the configs were generated for.
+	Input BatchInput
+	// Err is why generating configs for the image failed or was skipped. Nil on success.
+	Err error
+	// Timings are how long each stage of generating configs for the image took.
+	Timings *StageTimings
+	// Warnings are the warnings reported while generating configs for the image.
+	Warnings *Warnings
+}
+
+// LoadBatchInputs reads a JSON list of BatchInput from the file at the given path.
+func LoadBatchInputs(path string) ([]BatchInput, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the batch file: %w", err)
+	}
+	var inputs []BatchInput
+	if err := json.Unmarshal(blob, &inputs); err != nil {
+		return nil, fmt.Errorf("unable to parse the batch file %q as a JSON list of images: %w", path, err)
+	}
+	return inputs, nil
+}
+
+// validateBatch verifies the given inputs can be generated together using the given shared
+// options. Every input must have its own outputs because the configs for all inputs are generated
+// using the same shared options.
+func validateBatch(base *Options, inputs []BatchInput) error {
+	if len(inputs) == 0 {
+		return fmt.Errorf("no images were specified")
+	}
+	perImage := []struct {
+		name string
+		set  bool
+	}{
+		{"ToolchainContainer", len(base.ToolchainContainer) != 0},
+		{"ImageTarball", len(base.ImageTarball) != 0},
+		{"ExistingContainer", len(base.ExistingContainer) != 0},
+		{"Dockerfile", len(base.Dockerfile) != 0},
+		{"ApptainerImage", len(base.ApptainerImage) != 0},
+		{"OutputTarball", len(base.OutputTarball) != 0},
+		{"TarballWriter", base.TarballWriter != nil},
+		{"OutputManifest", len(base.OutputManifest) != 0},
+		{"OutputSourceRoot", len(base.OutputSourceRoot) != 0},
+		{"OutputSummary", len(base.OutputSummary) != 0},
+		{"BazelrcOutput", len(base.BazelrcOutput) != 0},
+	}
+	for _, p := range perImage {
+		if p.set {
+			return fmt.Errorf("%s can't be shared by the images of a batch", p.name)
+		}
+	}
+	outputs := make(map[string]int)
+	for i, in := range inputs {
+		if len(in.ToolchainContainer) == 0 {
+			return fmt.Errorf("image %d didn't specify toolchain_container", i)
+		}
+		if len(in.OutputTarball) == 0 {
+			return fmt.Errorf("image %s didn't specify output_tarball", in)
+		}
+		for _, p := range []string{in.OutputTarball, in.OutputManifest} {
+			if len(p) == 0 {
+				continue
+			}
+			a, err := filepath.Abs(p)
+			if err != nil {
+				return fmt.Errorf("unable to determine the absolute path of %q: %w", p, err)
+			}
+			if j, ok := outputs[a]; ok {
+				return fmt.Errorf("images %s & %s are both written to %q", inputs[j], in, p)
+			}
+			outputs[a] = i
+		}
+	}
+	return nil
+}
+
+// batchInputOptions returns the options to generate configs for the given input of a batch with
+// the given shared options & index of the input. Every input gets its own sub-directory of a
+// shared TempWorkDir so intermediate files of concurrent runs don't collide.
+func batchInputOptions(base Options, in BatchInput, i int) (Options, error) {
+	o := base
+	o.ToolchainContainer = in.ToolchainContainer
+	if len(in.ExecCPU) != 0 {
+		o.ExecCPU = in.ExecCPU
+	}
+	o.OutputTarball = in.OutputTarball
+	o.OutputManifest = in.OutputManifest
+	if len(base.TempWorkDir) != 0 {
+		o.TempWorkDir = filepath.Join(base.TempWorkDir, fmt.Sprintf("image_%d", i))
+		if err := os.MkdirAll(o.TempWorkDir, os.ModePerm); err != nil {
+			return Options{}, fmt.Errorf("unable to create the temporary working directory for image %s: %w", in, err)
+		}
+	}
+	if err := o.ApplyDefaults(o.ExecOS); err != nil {
+		return Options{}, fmt.Errorf("failed to apply default options for image %s: %w", in, err)
+	}
+	if err := o.Validate(); err != nil {
+		return Options{}, fmt.Errorf("invalid options for image %s: %w", in, err)
+	}
+	o.Timings = &StageTimings{}
+	o.Warnings = &Warnings{}
+	return o, nil
+}
+
+// RunBatch generates configs for each of the given images using the given shared options with at
+// most MaxParallel images probed concurrently. Options that aren't specific to an image, e.g., the
+// BazelVersion, ExecOS or the C++ & Java settings, are shared by all images while every image
+// specifies its own outputs. The options of every image are validated before any toolchain
+// container is started.
+// A failed image doesn't stop the configs for the other images from being generated unless
+// FailFast is set. Returns the result of every image in the order they were given along with an
+// error listing the images whose configs weren't generated.
+func RunBatch(ctx context.Context, base Options, inputs []BatchInput, bo BatchOptions) ([]BatchResult, error) {
+	return runBatch(ctx, base, inputs, bo, RunWithContext)
+}
+
+// runBatch implements RunBatch generating the configs for every image using the given function.
+func runBatch(ctx context.Context, base Options, inputs []BatchInput, bo BatchOptions, run func(context.Context, Options) error) ([]BatchResult, error) {
+	if err := validateBatch(&base, inputs); err != nil {
+		return nil, fmt.Errorf("invalid batch: %w", err)
+	}
+	opts := make([]Options, len(inputs))
+	for i, in := range inputs {
+		o, err := batchInputOptions(base, in, i)
+		if err != nil {
+			return nil, err
+		}
+		opts[i] = o
+		// The Bazel version resolved & validated for the first image applies to all images.
+		base.BazelVersion = o.BazelVersion
+		base.SkipVersionCheck = true
+	}
+
+	p := bo.MaxParallel
+	if p <= 0 {
+		p = runtime.NumCPU()
+	}
+	if p > len(inputs) {
+		p = len(inputs)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make([]BatchResult, len(inputs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < p; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = BatchResult{Input: inputs[i], Timings: opts[i].Timings, Warnings: opts[i].Warnings}
+				if err := ctx.Err(); err != nil {
+					results[i].Err = fmt.Errorf("skipped: %w", err)
+					continue
+				}
+				logging.Infof("Generating configs for image %s.", inputs[i])
+				if err := run(ctx, opts[i]); err != nil {
+					results[i].Err = err
+					logging.Errorf("Generating configs for image %s failed: %v", inputs[i], err)
+					if bo.FailFast {
+						cancel()
+					}
+					continue
+				}
+				logging.Infof("Generated configs for image %s.", inputs[i])
+			}
+		}()
+	}
+	for i := range inputs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	var failed []string
+	for _, r := range results {
+		if r.Err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", r.Input, r.Err))
+		}
+	}
+	if len(failed) != 0 {
+		return results, fmt.Errorf("configs generation failed for %d of %d images:\n%s", len(failed), len(inputs), strings.Join(failed, "\n"))
+	}
+	return results, nil
+}
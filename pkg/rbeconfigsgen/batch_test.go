@@ -0,0 +1,166 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// batchTestInputs returns n inputs for the images "image0", "image1", etc.
+func batchTestInputs(n int) []BatchInput {
+	var inputs []BatchInput
+	for i := 0; i < n; i++ {
+		inputs = append(inputs, BatchInput{
+			ToolchainContainer: fmt.Sprintf("image%d", i),
+			OutputTarball:      fmt.Sprintf("/tmp/configs%d.tar", i),
+		})
+	}
+	return inputs
+}
+
+// batchTestOptions returns shared options of a batch that validate without network access.
+func batchTestOptions() Options {
+	return Options{
+		BazelVersion:     "6.4.0",
+		SkipVersionCheck: true,
+		ExecOS:           OSLinux,
+		TargetOS:         OSLinux,
+		GenCPPConfigs:    true,
+	}
+}
+
+func TestRunBatchMaxParallel(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	var images []string
+	run := func(_ context.Context, o Options) error {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		images = append(images, o.ToolchainContainer)
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		if o.ToolchainContainer == "image1" {
+			return errors.New("pull failed")
+		}
+		return nil
+	}
+	results, err := runBatch(context.Background(), batchTestOptions(), batchTestInputs(5), BatchOptions{MaxParallel: 2}, run)
+	if err == nil || !strings.Contains(err.Error(), "1 of 5 images") || !strings.Contains(err.Error(), "image1: pull failed") {
+		t.Errorf("runBatch() returned error %v, want the failure of image1 only", err)
+	}
+	if maxRunning > 2 {
+		t.Errorf("runBatch() ran %d images concurrently, want at most 2", maxRunning)
+	}
+	if len(images) != 5 {
+		t.Errorf("runBatch() generated configs for %v, want all 5 images despite the failure", images)
+	}
+	for i, r := range results {
+		if want := fmt.Sprintf("image%d", i); r.Input.ToolchainContainer != want {
+			t.Errorf("results[%d] was for %q, want %q", i, r.Input.ToolchainContainer, want)
+		}
+		if gotErr := r.Err != nil; gotErr != (i == 1) {
+			t.Errorf("results[%d].Err=%v, want error=%v", i, r.Err, i == 1)
+		}
+	}
+}
+
+func TestRunBatchFailFast(t *testing.T) {
+	run := func(_ context.Context, o Options) error {
+		if o.ToolchainContainer == "image0" {
+			return errors.New("pull failed")
+		}
+		return nil
+	}
+	results, err := runBatch(context.Background(), batchTestOptions(), batchTestInputs(3), BatchOptions{MaxParallel: 1, FailFast: true}, run)
+	if err == nil || !strings.Contains(err.Error(), "3 of 3 images") {
+		t.Errorf("runBatch() returned error %v, want all images to fail or be skipped", err)
+	}
+	for _, r := range results[1:] {
+		if r.Err == nil || !strings.Contains(r.Err.Error(), "skipped") {
+			t.Errorf("Image %s had error %v, want it to be skipped", r.Input, r.Err)
+		}
+	}
+}
+
+func TestValidateBatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(o *Options, inputs []BatchInput) []BatchInput
+		wantErr string
+	}{
+		{
+			name:   "Valid",
+			modify: func(o *Options, inputs []BatchInput) []BatchInput { return inputs },
+		},
+		{
+			name:    "No images",
+			modify:  func(o *Options, inputs []BatchInput) []BatchInput { return nil },
+			wantErr: "no images",
+		},
+		{
+			name: "Shared output tarball",
+			modify: func(o *Options, inputs []BatchInput) []BatchInput {
+				o.OutputTarball = "/tmp/configs.tar"
+				return inputs
+			},
+			wantErr: "OutputTarball can't be shared",
+		},
+		{
+			name: "Missing output tarball",
+			modify: func(o *Options, inputs []BatchInput) []BatchInput {
+				inputs[1].OutputTarball = ""
+				return inputs
+			},
+			wantErr: "didn't specify output_tarball",
+		},
+		{
+			name: "Duplicate output",
+			modify: func(o *Options, inputs []BatchInput) []BatchInput {
+				inputs[1].OutputManifest = inputs[0].OutputTarball
+				return inputs
+			},
+			wantErr: "are both written to",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			o := batchTestOptions()
+			err := validateBatch(&o, tc.modify(&o, batchTestInputs(2)))
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateBatch() failed: %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("validateBatch() returned error %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// BazelrcOptions are the options other than the manifest of the configs for generating a bazelrc
+// fragment configuring Bazel to run remote builds using the configs.
+type BazelrcOptions struct {
+	// ConfigsURL is the URL the configs tarball was uploaded to. Only recorded in the comment at the
+	// top of the bazelrc if specified.
+	ConfigsURL string
+	// RemoteExecutor is the grpc:// or grpcs:// endpoint of the remote execution service.
+	// --remote_executor isn't set if blank.
+	RemoteExecutor string
+	// RemoteInstance is the remote instance name. --remote_instance_name isn't set if blank.
+	RemoteInstance string
+	// RepoName is the name of the external repository the configs are imported as if it differs
+	// from the repository name recorded in the manifest. Defaults to the repository name of the
+	// manifest or DefaultRepoName.
+	RepoName string
+	// GoogleCredentials authenticates to the remote execution service using Google application
+	// default credentials.
+	GoogleCredentials bool
+	// SkipCpp omits the C++ toolchain flags, e.g., because C++ configs weren't generated.
+	SkipCpp bool
+	// SkipJava omits the Java toolchain flags, e.g., because Java configs weren't generated.
+	SkipJava bool
+	// BazelVersion is the Bazel version the bazelrc is generated for if it differs from the Bazel
+	// version of the manifest, e.g., to generate a bazelrc for each Bazel version using configs
+	// generated with JavaCompatBoth. Defaults to the Bazel version of the manifest.
+	BazelVersion string
+}
+
+// GenerateBazelrc returns a bazelrc fragment whose "remote" config runs remote builds using the
+// configs described by the given manifest with the given options. The Bazel version, the Java
+// toolchain rules & the digests of the configs are taken from the manifest, so the fragment can be
+// regenerated from the manifest of configs that were uploaded earlier.
+func GenerateBazelrc(m *Manifest, p BazelrcOptions) (string, error) {
+	bv := m.BazelVersion
+	if len(p.BazelVersion) != 0 {
+		bv = p.BazelVersion
+	}
+	image := "sha256:" + m.ImageDigest
+	if len(m.ImageDigest) == 0 && len(m.ImageID) != 0 {
+		image = "image ID sha256:" + m.ImageID
+	}
+	b := bytes.NewBuffer(nil)
+	fmt.Fprintf(b, `
+# .bazelrc generated for:
+#   Bazel %s
+#   Toolchain Container %s (%s)
+`, bv, m.ToolchainContainer, image)
+	if len(p.ConfigsURL) != 0 {
+		fmt.Fprintf(b, "#   Configs Tarball URL %s (sha256:%s)\n", p.ConfigsURL, m.ConfigsTarballDigest)
+	} else if len(m.ConfigsTarballDigest) != 0 {
+		fmt.Fprintf(b, "#   Configs Tarball (sha256:%s)\n", m.ConfigsTarballDigest)
+	}
+	fmt.Fprintln(b)
+	if len(p.RemoteInstance) != 0 {
+		fmt.Fprintf(b, "build:remote --remote_instance_name=%s\n", p.RemoteInstance)
+	}
+	if len(p.RemoteExecutor) != 0 {
+		fmt.Fprintf(b, "build:remote --remote_executor=%s\n", p.RemoteExecutor)
+	}
+	fmt.Fprint(b, `
+build:remote --jobs=6
+build:remote --define=EXECUTOR=remote
+
+# Enforce stricter environment rules, which eliminates some non-hermetic
+# behavior and therefore improves both the remote cache hit rate and the
+# correctness and repeatability of the build.
+build:remote --incompatible_strict_action_env=true
+
+build:remote --remote_timeout=3600
+`)
+	if p.GoogleCredentials {
+		fmt.Fprint(b, `
+# Enable authentication. This will pick up application default credentials by
+# default. You can use --google_credentials=some_file.json to use a service
+# account credential instead.
+build:remote --google_default_credentials=true
+`)
+	}
+	r := p.RepoName
+	if len(r) == 0 {
+		r = m.RepoName
+	}
+	if len(r) == 0 {
+		r = DefaultRepoName
+	}
+	if p.SkipCpp {
+		fmt.Fprint(b, `
+# Default platform configuration.
+`)
+	} else {
+		// Bazel versions that resolve the C++ toolchain using platforms by default don't need the
+		// legacy --crosstool_top.
+		ccr, err := UsesCcToolchainResolution(bv)
+		if err != nil {
+			return "", fmt.Errorf("unable to determine whether Bazel %q uses C++ toolchain resolution: %w", bv, err)
+		}
+		fmt.Fprint(b, `
+# C++ toolchain & default platform configuration.
+`)
+		switch {
+		case !m.CppToolchainResolution && !ccr:
+			fmt.Fprintf(b, "build:remote --crosstool_top=@%s//cc:toolchain\n", r)
+		case !ccr:
+			fmt.Fprintln(b, "build:remote --incompatible_enable_cc_toolchain_resolution")
+		}
+		fmt.Fprintf(b, `build:remote --action_env=BAZEL_DO_NOT_DETECT_CPP_TOOLCHAIN=1
+build:remote --extra_toolchains=@%s//config:cc-toolchain
+`, r)
+	}
+	pn := m.PlatformName
+	if len(pn) == 0 {
+		pn = DefaultPlatformName
+	}
+	fmt.Fprintf(b, `build:remote --extra_execution_platforms=@%[1]s//config:%[2]s
+build:remote --host_platform=@%[1]s//config:%[2]s
+build:remote --platforms=@%[1]s//config:%[2]s
+`, r, pn)
+	if p.SkipJava {
+		return b.String(), nil
+	}
+	// The Java toolchain rules used by Bazel are expected to change in a certain Bazel version
+	// that affects the bazelrc file.
+	u, err := UsesLocalJavaRuntime(bv)
+	if err != nil {
+		return "", fmt.Errorf("unable to determine type of Java toolchain rules used by Bazel %q: %w", bv, err)
+	}
+	if m.JavaCompat == JavaCompatBoth {
+		// The Java flags below start with a newline.
+		fmt.Fprintf(b, `
+# The configs define Java runtimes for Bazel versions on either side of 5.0.0. The flags below
+# select the one used by Bazel %s.`, bv)
+	} else if bv != m.BazelVersion {
+		mu, err := UsesLocalJavaRuntime(m.BazelVersion)
+		if err != nil {
+			return "", fmt.Errorf("unable to determine type of Java toolchain rules used by Bazel %q: %w", m.BazelVersion, err)
+		}
+		if mu != u {
+			return "", fmt.Errorf("the Java configs generated for Bazel %q don't define the Java runtime used by Bazel %q, generate them with JavaCompat %q to use them with both", m.BazelVersion, bv, JavaCompatBoth)
+		}
+	}
+	if u {
+		fmt.Fprintf(b, `
+build:remote --java_runtime_version=rbe_jdk
+build:remote --tool_java_runtime_version=rbe_jdk
+build:remote --extra_toolchains=@%s//java:all
+`, r)
+	} else {
+		fmt.Fprintf(b, `
+build:remote --host_javabase=@%[1]s//java:jdk
+build:remote --javabase=@%[1]s//java:jdk
+build:remote --host_java_toolchain=@bazel_tools//tools/jdk:toolchain_hostjdk8
+build:remote --java_toolchain=@bazel_tools//tools/jdk:toolchain_hostjdk8
+`, r)
+	}
+	return b.String(), nil
+}
+
+// createBazelrc writes the bazelrc fragment for the generated configs described by the given
+// manifest if the given options specified a bazelrc output file. tarballDigest is the sha256
+// digest of the output tarball, if one was generated.
+func createBazelrc(o *Options, m *Manifest, tarballDigest string) error {
+	if len(o.BazelrcOutput) == 0 {
+		return nil
+	}
+	withDigest := *m
+	withDigest.ConfigsTarballDigest = tarballDigest
+	p := o.Bazelrc
+	p.SkipCpp = !o.GenCPPConfigs
+	p.SkipJava = !o.GenJavaConfigs
+	bazelrc, err := GenerateBazelrc(&withDigest, p)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(o.BazelrcOutput, []byte(bazelrc), os.ModePerm); err != nil {
+		return fmt.Errorf("unable to write the bazelrc to %q: %w", o.BazelrcOutput, err)
+	}
+	o.log.Infof("Wrote bazelrc to %q.", o.BazelrcOutput)
+	return nil
+}
@@ -0,0 +1,175 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerateBazelrc(t *testing.T) {
+	m := &Manifest{
+		BazelVersion:         "6.4.0",
+		ToolchainContainer:   "gcr.io/foo/bar",
+		ImageDigest:          "abcd",
+		ConfigsTarballDigest: "1234",
+	}
+	got, err := GenerateBazelrc(m, BazelrcOptions{
+		ConfigsURL:        "https://example.com/configs.tar",
+		RemoteExecutor:    "grpcs://remotebuildexecution.googleapis.com",
+		RemoteInstance:    "projects/p/instances/default_instance",
+		GoogleCredentials: true,
+	})
+	if err != nil {
+		t.Fatalf("GenerateBazelrc() failed: %v", err)
+	}
+	want := `
+# .bazelrc generated for:
+#   Bazel 6.4.0
+#   Toolchain Container gcr.io/foo/bar (sha256:abcd)
+#   Configs Tarball URL https://example.com/configs.tar (sha256:1234)
+
+build:remote --remote_instance_name=projects/p/instances/default_instance
+build:remote --remote_executor=grpcs://remotebuildexecution.googleapis.com
+
+build:remote --jobs=6
+build:remote --define=EXECUTOR=remote
+
+# Enforce stricter environment rules, which eliminates some non-hermetic
+# behavior and therefore improves both the remote cache hit rate and the
+# correctness and repeatability of the build.
+build:remote --incompatible_strict_action_env=true
+
+build:remote --remote_timeout=3600
+
+# Enable authentication. This will pick up application default credentials by
+# default. You can use --google_credentials=some_file.json to use a service
+# account credential instead.
+build:remote --google_default_credentials=true
+
+# C++ toolchain & default platform configuration.
+build:remote --crosstool_top=@rbe_default//cc:toolchain
+build:remote --action_env=BAZEL_DO_NOT_DETECT_CPP_TOOLCHAIN=1
+build:remote --extra_toolchains=@rbe_default//config:cc-toolchain
+build:remote --extra_execution_platforms=@rbe_default//config:platform
+build:remote --host_platform=@rbe_default//config:platform
+build:remote --platforms=@rbe_default//config:platform
+
+build:remote --java_runtime_version=rbe_jdk
+build:remote --tool_java_runtime_version=rbe_jdk
+build:remote --extra_toolchains=@rbe_default//java:all
+`
+	if got != want {
+		t.Errorf("GenerateBazelrc() returned:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestGenerateBazelrcOptions(t *testing.T) {
+	tests := []struct {
+		name        string
+		manifest    *Manifest
+		opts        BazelrcOptions
+		wantLines   []string
+		unwantLines []string
+	}{
+		{
+			name:        "Bazel 7 uses C++ toolchain resolution",
+			manifest:    &Manifest{BazelVersion: "7.0.0", RepoName: "my_configs"},
+			wantLines:   []string{"build:remote --extra_toolchains=@my_configs//config:cc-toolchain"},
+			unwantLines: []string{"--crosstool_top", "--incompatible_enable_cc_toolchain_resolution", "--remote_executor", "--google_default_credentials"},
+		},
+		{
+			name:      "Opted into C++ toolchain resolution",
+			manifest:  &Manifest{BazelVersion: "6.4.0", CppToolchainResolution: true},
+			wantLines: []string{"build:remote --incompatible_enable_cc_toolchain_resolution"},
+		},
+		{
+			name:        "No C++ or Java",
+			manifest:    &Manifest{BazelVersion: "6.4.0"},
+			opts:        BazelrcOptions{SkipCpp: true, SkipJava: true},
+			wantLines:   []string{"build:remote --platforms=@rbe_default//config:platform"},
+			unwantLines: []string{"cc-toolchain", "--crosstool_top", "java"},
+		},
+		{
+			name:        "Custom platform name",
+			manifest:    &Manifest{BazelVersion: "7.0.0", RepoName: "rbe_ubuntu", PlatformName: "ubuntu_platform"},
+			opts:        BazelrcOptions{SkipJava: true},
+			wantLines:   []string{"build:remote --extra_execution_platforms=@rbe_ubuntu//config:ubuntu_platform", "build:remote --host_platform=@rbe_ubuntu//config:ubuntu_platform", "build:remote --platforms=@rbe_ubuntu//config:ubuntu_platform"},
+			unwantLines: []string{"config:platform"},
+		},
+		{
+			name:        "Repo name override",
+			manifest:    &Manifest{BazelVersion: "7.0.0", RepoName: "rbe_ubuntu"},
+			opts:        BazelrcOptions{RepoName: "rbe_mirror"},
+			wantLines:   []string{"build:remote --extra_toolchains=@rbe_mirror//config:cc-toolchain", "build:remote --platforms=@rbe_mirror//config:platform", "build:remote --extra_toolchains=@rbe_mirror//java:all"},
+			unwantLines: []string{"rbe_ubuntu"},
+		},
+		{
+			name:      "Image ID without a registry digest",
+			manifest:  &Manifest{BazelVersion: "6.4.0", ToolchainContainer: "rbe_configs_gen_build", ImageID: "1234"},
+			wantLines: []string{"#   Toolchain Container rbe_configs_gen_build (image ID sha256:1234)"},
+		},
+		{
+			name:        "Digest without URL",
+			manifest:    &Manifest{BazelVersion: "6.4.0", ConfigsTarballDigest: "1234"},
+			wantLines:   []string{"#   Configs Tarball (sha256:1234)"},
+			unwantLines: []string{"Configs Tarball URL"},
+		},
+		{
+			name:        "Both Java runtimes for an older Bazel",
+			manifest:    &Manifest{BazelVersion: "5.4.0", JavaCompat: JavaCompatBoth},
+			opts:        BazelrcOptions{BazelVersion: "4.2.2"},
+			wantLines:   []string{"#   Bazel 4.2.2", "build:remote --javabase=@rbe_default//java:jdk"},
+			unwantLines: []string{"--java_runtime_version"},
+		},
+		{
+			name:        "Both Java runtimes for a newer Bazel",
+			manifest:    &Manifest{BazelVersion: "4.2.2", JavaCompat: JavaCompatBoth},
+			opts:        BazelrcOptions{BazelVersion: "6.4.0"},
+			wantLines:   []string{"build:remote --java_runtime_version=rbe_jdk", "build:remote --extra_toolchains=@rbe_default//java:all"},
+			unwantLines: []string{"--javabase"},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := GenerateBazelrc(tc.manifest, tc.opts)
+			if err != nil {
+				t.Fatalf("GenerateBazelrc() failed: %v", err)
+			}
+			for _, l := range tc.wantLines {
+				if !strings.Contains(got, l+"\n") {
+					t.Errorf("GenerateBazelrc() returned:\n%s\nwant it to contain %q", got, l)
+				}
+			}
+			for _, l := range tc.unwantLines {
+				if strings.Contains(got, l) {
+					t.Errorf("GenerateBazelrc() returned:\n%s\nwant it to not contain %q", got, l)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateBazelrcJavaMismatch(t *testing.T) {
+	m := &Manifest{BazelVersion: "6.4.0"}
+	if _, err := GenerateBazelrc(m, BazelrcOptions{BazelVersion: "4.2.2"}); err == nil {
+		t.Errorf("GenerateBazelrc() for Bazel 4.2.2 with Java configs generated for Bazel 6.4.0 succeeded, want error")
+	}
+	if _, err := GenerateBazelrc(m, BazelrcOptions{BazelVersion: "5.0.0"}); err != nil {
+		t.Errorf("GenerateBazelrc() for Bazel 5.0.0 with Java configs generated for Bazel 6.4.0 failed: %v", err)
+	}
+}
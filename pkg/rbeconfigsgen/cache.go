@@ -0,0 +1,191 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	// cachedFactsFile is the name of the file with the JSON encoded detection facts in a cache
+	// entry. It's written last so a cache entry is only considered valid if this file exists.
+	cachedFactsFile = "facts.json"
+	// cachedCppConfigsTarball is the name of the C++ configs tarball in a cache entry.
+	cachedCppConfigsTarball = "cpp_configs.tar"
+)
+
+// factsCache stores facts detected in a toolchain container in a local directory so that later
+// runs against the same toolchain image can skip running the container entirely.
+type factsCache struct {
+	// dir is the directory containing the cache entry for a specific toolchain image digest and
+	// the options affecting detection.
+	dir string
+}
+
+// detectionKey returns a digest of the options that affect what's detected in the toolchain
+// container. Cache entries for the same image are separated by this key because, e.g., the C++
+// configs generated by Bazel depend on the Bazel version & environment variables & the container
+// run flags can change the environment or user detection runs with.
+func detectionKey(o *Options) (string, error) {
+	env, err := appendCppEnv(nil, o)
+	if err != nil {
+		return "", fmt.Errorf("unable to determine the C++ config generation environment: %w", err)
+	}
+	sort.Strings(env)
+	blob, err := json.Marshal(struct {
+		BazelVersion      string
+		BazelPath         string
+		ExecOS            string
+		ExecCPU           string
+		TargetCPU         string
+		TargetSysroot     string
+		DockerPlatform    string
+		GenCPPConfigs     bool
+		CPPConfigTargets  []string
+		CPPConfigRepo     string
+		CppBazelCmd       string
+		CppGenEnv         []string
+		CppCompiler       string
+		CppStdlib         string
+		CppActions        []string
+		GenJavaConfigs    bool
+		JavaHome          string
+		GenRustConfigs    bool
+		RunEntrypoint     bool
+		InitCommand       string
+		ContainerRunFlags []string
+	}{
+		BazelVersion:      o.BazelVersion,
+		BazelPath:         o.BazelPath,
+		ExecOS:            o.ExecOS,
+		ExecCPU:           o.ExecCPU,
+		TargetCPU:         o.TargetCPU,
+		TargetSysroot:     o.TargetSysroot,
+		DockerPlatform:    o.DockerPlatform,
+		GenCPPConfigs:     o.GenCPPConfigs,
+		CPPConfigTargets:  o.CPPConfigTargets,
+		CPPConfigRepo:     o.CPPConfigRepo,
+		CppBazelCmd:       o.CppBazelCmd,
+		CppGenEnv:         env,
+		CppCompiler:       o.CppCompiler,
+		CppStdlib:         o.CppStdlib,
+		CppActions:        o.CppActions,
+		GenJavaConfigs:    o.GenJavaConfigs,
+		JavaHome:          o.JavaHome,
+		GenRustConfigs:    o.GenRustConfigs,
+		RunEntrypoint:     o.RunEntrypoint,
+		InitCommand:       o.InitCommand,
+		ContainerRunFlags: o.ContainerRunFlags,
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to encode options as JSON: %w", err)
+	}
+	h := sha256.Sum256(blob)
+	return hex.EncodeToString(h[:]), nil
+}
+
+// newFactsCache returns the cache for the given toolchain image referenced by digest or nil if
+// the given options didn't specify a cache directory.
+func newFactsCache(o *Options, resolvedImage string) (*factsCache, error) {
+	if len(o.CacheDir) == 0 {
+		return nil, nil
+	}
+	s := imageDigestRegexp.FindStringSubmatch(resolvedImage)
+	if len(s) != 2 {
+		return nil, fmt.Errorf("failed to extract sha256 digest using regex from image name %q, got %d substrings, want 2", resolvedImage, len(s))
+	}
+	k, err := detectionKey(o)
+	if err != nil {
+		return nil, fmt.Errorf("unable to compute the cache key: %w", err)
+	}
+	return &factsCache{dir: filepath.Join(o.CacheDir, s[1], k)}, nil
+}
+
+// load returns the cached facts or false if the cache didn't have a complete entry.
+func (c *factsCache) load(o *Options) (*detectionFacts, bool) {
+	blob, err := ioutil.ReadFile(filepath.Join(c.dir, cachedFactsFile))
+	if err != nil {
+		return nil, false
+	}
+	f := &detectionFacts{}
+	if err := json.Unmarshal(blob, f); err != nil {
+		return nil, false
+	}
+	// Entries written before the OS distribution was detected are incomplete.
+	if len(f.OSID) == 0 {
+		return nil, false
+	}
+	// Resources are only detected with DetectResources.
+	if o.DetectResources && len(f.ResourceCPUs) == 0 {
+		return nil, false
+	}
+	if o.GenCPPConfigs {
+		f.CppConfigsTarball = filepath.Join(c.dir, cachedCppConfigsTarball)
+		if _, err := os.Stat(f.CppConfigsTarball); err != nil {
+			return nil, false
+		}
+	}
+	return f, true
+}
+
+// store writes the given facts to the cache replacing any existing entry.
+func (c *factsCache) store(o *Options, f *detectionFacts) error {
+	if err := os.MkdirAll(c.dir, os.ModePerm); err != nil {
+		return fmt.Errorf("unable to create cache directory %q: %w", c.dir, err)
+	}
+	// Invalidate the existing entry before overwriting its files.
+	if err := os.Remove(filepath.Join(c.dir, cachedFactsFile)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to remove the existing cache entry in %q: %w", c.dir, err)
+	}
+	if o.GenCPPConfigs {
+		if err := copyLocalFile(filepath.Join(c.dir, cachedCppConfigsTarball), f.CppConfigsTarball); err != nil {
+			return fmt.Errorf("unable to cache the C++ configs tarball: %w", err)
+		}
+	}
+	blob, err := json.MarshalIndent(f, "", " ")
+	if err != nil {
+		return fmt.Errorf("unable to encode detection facts as JSON: %w", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(c.dir, cachedFactsFile), blob, os.ModePerm); err != nil {
+		return fmt.Errorf("unable to write detection facts: %w", err)
+	}
+	return nil
+}
+
+// copyLocalFile copies the regular file at 'src' to 'dst'.
+func copyLocalFile(dst, src string) error {
+	i, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %q for reading: %w", src, err)
+	}
+	defer i.Close()
+	o, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("failed to open %q for writing: %w", dst, err)
+	}
+	if _, err := io.Copy(o, i); err != nil {
+		o.Close()
+		return fmt.Errorf("error while copying the contents of %q to %q: %w", src, dst, err)
+	}
+	return o.Close()
+}
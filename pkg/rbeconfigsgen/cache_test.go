@@ -0,0 +1,212 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+const testResolvedImage = "gcr.io/foo/bar@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestFactsCacheRoundTrip(t *testing.T) {
+	tmp := t.TempDir()
+	o := &Options{
+		BazelVersion:   "6.0.0",
+		ExecOS:         OSLinux,
+		GenCPPConfigs:  true,
+		GenJavaConfigs: true,
+		CacheDir:       filepath.Join(tmp, "cache"),
+	}
+	c, err := newFactsCache(o, testResolvedImage)
+	if err != nil {
+		t.Fatalf("newFactsCache failed: %v", err)
+	}
+	if _, ok := c.load(o); ok {
+		t.Fatalf("load on an empty cache returned a cache hit, wanted a miss")
+	}
+
+	tarball := filepath.Join(tmp, "cpp_configs.tar")
+	if err := ioutil.WriteFile(tarball, []byte("configs"), 0644); err != nil {
+		t.Fatalf("Failed to write fake C++ configs tarball: %v", err)
+	}
+	want := &detectionFacts{
+		CppConfigsTarball: tarball,
+		JavaHome:          "/usr/lib/jvm/java",
+		JavaVersion:       "11.0.2",
+		OSID:              "ubuntu",
+		OSVersionID:       "20.04",
+	}
+	if err := c.store(o, want); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	got, ok := c.load(o)
+	if !ok {
+		t.Fatalf("load after store returned a cache miss, wanted a hit")
+	}
+	if got.JavaHome != want.JavaHome || got.JavaVersion != want.JavaVersion {
+		t.Errorf("load returned Java facts (%q, %q), wanted (%q, %q)", got.JavaHome, got.JavaVersion, want.JavaHome, want.JavaVersion)
+	}
+	if got.OSID != want.OSID || got.OSVersionID != want.OSVersionID {
+		t.Errorf("load returned OS facts (%q, %q), wanted (%q, %q)", got.OSID, got.OSVersionID, want.OSID, want.OSVersionID)
+	}
+	blob, err := ioutil.ReadFile(got.CppConfigsTarball)
+	if err != nil {
+		t.Fatalf("Failed to read cached C++ configs tarball: %v", err)
+	}
+	if string(blob) != "configs" {
+		t.Errorf("Cached C++ configs tarball had contents %q, wanted %q", blob, "configs")
+	}
+
+	// A different Bazel version must not share the cache entry.
+	o.BazelVersion = "7.0.0"
+	c2, err := newFactsCache(o, testResolvedImage)
+	if err != nil {
+		t.Fatalf("newFactsCache failed: %v", err)
+	}
+	if _, ok := c2.load(o); ok {
+		t.Errorf("load for a different Bazel version returned a cache hit, wanted a miss")
+	}
+}
+
+func TestDetectionKeyContainerRunFlags(t *testing.T) {
+	keys := make(map[string][]string)
+	for _, flags := range [][]string{
+		nil,
+		{"--env=JAVA_HOME=/opt/jdk17"},
+		{"--env=JAVA_HOME=/opt/jdk21"},
+		{"--user=1000"},
+	} {
+		k, err := detectionKey(&Options{BazelVersion: "6.0.0", ExecOS: OSLinux, ContainerRunFlags: flags})
+		if err != nil {
+			t.Fatalf("detectionKey(ContainerRunFlags=%q) failed: %v", flags, err)
+		}
+		if other, ok := keys[k]; ok {
+			t.Errorf("detectionKey(ContainerRunFlags=%q) = detectionKey(ContainerRunFlags=%q), want different keys", flags, other)
+		}
+		keys[k] = flags
+	}
+}
+
+func TestNewFactsCacheDisabled(t *testing.T) {
+	c, err := newFactsCache(&Options{}, testResolvedImage)
+	if err != nil {
+		t.Fatalf("newFactsCache failed: %v", err)
+	}
+	if c != nil {
+		t.Errorf("newFactsCache returned %v when CacheDir was unset, wanted nil", c)
+	}
+}
+
+func TestDetectFactsCachedUnpulledImage(t *testing.T) {
+	o := &Options{
+		BazelVersion: "6.0.0",
+		ExecOS:       OSLinux,
+		ExecCPU:      CPUX8664,
+		CacheDir:     filepath.Join(t.TempDir(), "cache"),
+	}
+	c, err := newFactsCache(o, testResolvedImage)
+	if err != nil {
+		t.Fatalf("newFactsCache failed: %v", err)
+	}
+	if err := c.store(o, &detectionFacts{OSID: "ubuntu", ImageArch: "arm64"}); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	// The image wasn't pulled so detection must not run docker at all.
+	d := &dockerRunner{
+		dockerPath:    filepath.Join(t.TempDir(), "missing_docker"),
+		resolvedImage: testResolvedImage,
+		unpulled:      true,
+		warnings:      &Warnings{},
+	}
+	f, err := detectFacts(d, o)
+	if err != nil {
+		t.Fatalf("detectFacts failed: %v", err)
+	}
+	if f.OSID != "ubuntu" {
+		t.Errorf("detectFacts returned OS %q, want the cached %q", f.OSID, "ubuntu")
+	}
+	if !d.unpulled {
+		t.Errorf("detectFacts pulled the toolchain image despite cached facts")
+	}
+	if d.arch != "arm64" {
+		t.Errorf("detectFacts set the image architecture to %q, want the cached %q", d.arch, "arm64")
+	}
+	if ws := d.warnings.All(); len(ws) != 1 || ws[0].Code != WarningImageArchMismatch {
+		t.Errorf("detectFacts reported warnings %v, want the %s warning for the cached architecture", ws, WarningImageArchMismatch)
+	}
+}
+
+func TestDetectFactsUnpulledImageRunFlagsChanged(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake docker client is a shell script")
+	}
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "docker.log")
+	// The fake docker client records its arguments, pulls & inspects an amd64 image but fails to
+	// create containers so detection stops right after it started.
+	script := fmt.Sprintf(`#!/bin/sh
+echo "$@" >> %q
+case "$1" in
+pull) ;;
+inspect|version) echo amd64 ;;
+*) exit 1 ;;
+esac
+`, logPath)
+	dockerPath := filepath.Join(dir, "docker")
+	if err := ioutil.WriteFile(dockerPath, []byte(script), 0755); err != nil {
+		t.Fatalf("Unable to write fake docker client: %v", err)
+	}
+	o := &Options{
+		BazelVersion:      "6.0.0",
+		ExecOS:            OSLinux,
+		ExecCPU:           CPUX8664,
+		CacheDir:          filepath.Join(dir, "cache"),
+		ContainerRunFlags: []string{"--env=JAVA_HOME=/opt/jdk17"},
+		TempWorkDir:       dir,
+	}
+	c, err := newFactsCache(o, testResolvedImage)
+	if err != nil {
+		t.Fatalf("newFactsCache failed: %v", err)
+	}
+	if err := c.store(o, &detectionFacts{OSID: "ubuntu", ImageArch: "amd64"}); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+
+	// Facts cached with other run flags don't apply so the image must be pulled & run.
+	o.ContainerRunFlags = []string{"--env=JAVA_HOME=/opt/jdk21"}
+	d := newUnpulledDockerRunner(context.Background(), nil, "gcr.io/foo/bar:1.0", testResolvedImage[strings.Index(testResolvedImage, "@")+1:], "", OSLinux, true, nil)
+	d.dockerPath = dockerPath
+	d.warnings = &Warnings{}
+	if _, err := detectFacts(d, o); err == nil {
+		t.Fatalf("detectFacts succeeded although the fake docker client can't create containers, want error")
+	}
+	if d.unpulled {
+		t.Errorf("detectFacts didn't pull the toolchain image for run flags without cached facts")
+	}
+	blob, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("Unable to read the fake docker client log: %v", err)
+	}
+	log := string(blob)
+	if !strings.Contains(log, "pull "+testResolvedImage) || !strings.Contains(log, "create") {
+		t.Errorf("detectFacts didn't pull %q & create a container to detect facts afresh, docker was invoked with:\n%s", testResolvedImage, log)
+	}
+}
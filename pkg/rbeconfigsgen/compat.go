@@ -0,0 +1,111 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"fmt"
+)
+
+// bazelVersionBoundary is a Bazel version at which the configs generated for older Bazel versions
+// stop working, e.g., because Bazel switched the rules used by the configs.
+type bazelVersionBoundary struct {
+	// version is the first Bazel version on the new side of the boundary.
+	version string
+	// applies returns whether the configs generated according to the given options depend on the
+	// boundary.
+	applies func(o *Options) bool
+}
+
+// bazelVersionBoundaries are the known Bazel versions where generated configs stop being
+// compatible, sorted by version. They match the versions UsesLocalJavaRuntime &
+// UsesCcToolchainResolution switch at.
+var bazelVersionBoundaries = []bazelVersionBoundary{
+	{
+		// Java configs switch from java_runtime to local_java_runtime unless the rule was forced or
+		// both rules are used.
+		version: "5.0.0",
+		applies: func(o *Options) bool {
+			return o.GenJavaConfigs && o.ForceLocalJavaRuntime == nil && !o.JavaUseLocalRuntime && o.JavaCompat != JavaCompatBoth
+		},
+	},
+	{
+		// C++ configs are resolved using platforms instead of --crosstool_top unless C++ toolchain
+		// resolution was requested explicitly.
+		version: "7.0.0",
+		applies: func(o *Options) bool {
+			return o.GenCPPConfigs && !o.CppToolchainResolution
+		},
+	},
+}
+
+// bazelVersionRange returns the range of Bazel versions the configs generated according to the
+// given options are expected to be compatible with, i.e., the minimum version (inclusive) & the
+// maximum version (exclusive). The range spans the known boundaries around BazelVersion & either
+// end is blank if it's unbounded. MinBazelVersion & MaxBazelVersion override the computed ends &
+// an error is returned if the resulting minimum isn't less than the maximum.
+func bazelVersionRange(o *Options) (string, string, error) {
+	bv, err := bazelCoreVersion(o.BazelVersion)
+	if err != nil {
+		return "", "", fmt.Errorf("unable to determine the Bazel versions compatible with the configs: %w", err)
+	}
+	var min, max string
+	for _, b := range bazelVersionBoundaries {
+		if !b.applies(o) {
+			continue
+		}
+		v, err := bazelCoreVersion(b.version)
+		if err != nil {
+			return "", "", err
+		}
+		if bv.LessThan(*v) {
+			max = b.version
+			break
+		}
+		min = b.version
+	}
+	if len(o.MinBazelVersion) != 0 {
+		min = o.MinBazelVersion
+	}
+	if len(o.MaxBazelVersion) != 0 {
+		max = o.MaxBazelVersion
+	}
+	// Overriding only one end may put it past the computed other end.
+	if err := validateBazelVersionRange(min, max); err != nil {
+		return "", "", fmt.Errorf("invalid range of Bazel versions compatible with the configs for Bazel version %q: %w", o.BazelVersion, err)
+	}
+	return min, max, nil
+}
+
+// validateBazelVersionRange verifies the given minimum & maximum Bazel versions, either of which
+// may be blank, are Bazel versions & the maximum is greater than the minimum.
+func validateBazelVersionRange(min, max string) error {
+	for _, v := range []string{min, max} {
+		if len(v) == 0 {
+			continue
+		}
+		if _, err := bazelCoreVersion(v); err != nil {
+			return err
+		}
+	}
+	if len(min) == 0 || len(max) == 0 {
+		return nil
+	}
+	minV, _ := bazelCoreVersion(min)
+	maxV, _ := bazelCoreVersion(max)
+	if !minV.LessThan(*maxV) {
+		return fmt.Errorf("maximum Bazel version %q must be greater than the minimum Bazel version %q", max, min)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"testing"
+)
+
+func TestBazelVersionRange(t *testing.T) {
+	forceLocal := true
+	tests := []struct {
+		name    string
+		o       Options
+		wantMin string
+		wantMax string
+		wantErr bool
+	}{
+		{
+			name:    "Java & C++ before 5.0.0",
+			o:       Options{BazelVersion: "4.2.1", GenJavaConfigs: true, GenCPPConfigs: true},
+			wantMax: "5.0.0",
+		},
+		{
+			name:    "Java & C++ between 5.0.0 & 7.0.0",
+			o:       Options{BazelVersion: "6.4.0", GenJavaConfigs: true, GenCPPConfigs: true},
+			wantMin: "5.0.0",
+			wantMax: "7.0.0",
+		},
+		{
+			name:    "Java & C++ release candidate at 7.0.0",
+			o:       Options{BazelVersion: "7.0.0rc2", GenJavaConfigs: true, GenCPPConfigs: true},
+			wantMin: "7.0.0",
+		},
+		{
+			name:    "Only C++ before 7.0.0",
+			o:       Options{BazelVersion: "4.2.1", GenCPPConfigs: true},
+			wantMax: "7.0.0",
+		},
+		{
+			name: "Only Java after 5.0.0",
+			o:    Options{BazelVersion: "6.4.0", GenJavaConfigs: true},
+			// The C++ boundary doesn't apply without C++ configs.
+			wantMin: "5.0.0",
+		},
+		{
+			name:    "Forced Java rule & C++ toolchain resolution",
+			o:       Options{BazelVersion: "4.2.1", GenJavaConfigs: true, ForceLocalJavaRuntime: &forceLocal, GenCPPConfigs: true, CppToolchainResolution: true},
+			wantMin: "",
+			wantMax: "",
+		},
+		{
+			name:    "Overrides",
+			o:       Options{BazelVersion: "6.4.0", GenJavaConfigs: true, GenCPPConfigs: true, MinBazelVersion: "6.0.0", MaxBazelVersion: "6.5.0"},
+			wantMin: "6.0.0",
+			wantMax: "6.5.0",
+		},
+		{
+			name:    "Minimum override past the computed maximum",
+			o:       Options{BazelVersion: "6.4.0", GenJavaConfigs: true, GenCPPConfigs: true, MinBazelVersion: "7.1.0"},
+			wantErr: true,
+		},
+		{
+			name:    "Maximum override before the computed minimum",
+			o:       Options{BazelVersion: "6.4.0", GenJavaConfigs: true, GenCPPConfigs: true, MaxBazelVersion: "4.2.1"},
+			wantErr: true,
+		},
+		{
+			name:    "Maximum override at the computed minimum",
+			o:       Options{BazelVersion: "6.4.0", GenJavaConfigs: true, GenCPPConfigs: true, MaxBazelVersion: "5.0.0"},
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			min, max, err := bazelVersionRange(&tc.o)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("bazelVersionRange()=(%q, %q), want error", min, max)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("bazelVersionRange() failed: %v", err)
+			}
+			if min != tc.wantMin || max != tc.wantMax {
+				t.Errorf("bazelVersionRange()=(%q, %q), want (%q, %q)", min, max, tc.wantMin, tc.wantMax)
+			}
+		})
+	}
+}
+
+func TestValidateBazelVersionRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		min     string
+		max     string
+		wantErr bool
+	}{
+		{name: "Unbounded"},
+		{name: "Only minimum", min: "5.0.0"},
+		{name: "Only maximum", max: "7.0.0"},
+		{name: "Both", min: "5.0.0", max: "7.0.0"},
+		{name: "Maximum not greater than minimum", min: "7.0.0", max: "7.0.0", wantErr: true},
+		{name: "Malformed version", min: "five", wantErr: true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if err := validateBazelVersionRange(tc.min, tc.max); (err != nil) != tc.wantErr {
+				t.Errorf("validateBazelVersionRange(%q, %q) returned error %v, want error: %v", tc.min, tc.max, err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// C++ standard libraries the C++ configs can be generated for with the CppStdlib option.
+const (
+	// CppStdlibLibcxx is LLVM's C++ standard library, e.g., for sanitizer builds.
+	CppStdlibLibcxx = "libc++"
+	// CppStdlibLibstdcxx is GCC's C++ standard library.
+	CppStdlibLibstdcxx = "libstdc++"
+)
+
+var (
+	// cppStdlibNames are the valid values of the CppStdlib option.
+	cppStdlibNames = []string{CppStdlibLibcxx, CppStdlibLibstdcxx}
+	// cppCompilerNames are the names of the C/C++ compiler drivers probed for in Linux toolchain
+	// containers. Any of these can be selected with the CppCompiler option.
+	cppCompilerNames = []string{"gcc", "g++", "clang", "clang++"}
+	// cppCompilerDirs are directories compilers are commonly installed in that may not be on the
+	// PATH of the toolchain container. Shell globs are expanded.
+	cppCompilerDirs = []string{
+		"/usr/local/bin",
+		"/usr/bin",
+		"/opt/llvm/bin",
+		"/usr/local/llvm/bin",
+		"/usr/lib/llvm-*/bin",
+		"/opt/rh/devtoolset-*/root/usr/bin",
+	}
+	// compilerVersionRegexp extracts the version from the first line printed by
+	// '<compiler> --version', e.g., "9.4.0" from "gcc (Ubuntu 9.4.0-1ubuntu1~20.04.1) 9.4.0".
+	compilerVersionRegexp = regexp.MustCompile(`\b(\d+\.\d+(\.\d+)?)`)
+)
+
+// cppCompiler is a C/C++ compiler found in the toolchain container.
+type cppCompiler struct {
+	// name is the name of the compiler driver, e.g., "clang".
+	name string
+	// path is the absolute path of the compiler driver in the toolchain container.
+	path string
+	// version is the version of the compiler or osUnknown if it couldn't be determined.
+	version string
+}
+
+// String returns a description of the compiler for log & error messages, e.g.,
+// "clang 10.0.0 (/usr/local/bin/clang)".
+func (c cppCompiler) String() string {
+	return fmt.Sprintf("%s %s (%s)", c.name, c.version, c.path)
+}
+
+// findCppCompilersScript returns a shell script printing the name & path of every compiler with
+// the given names found on the PATH or in cppCompilerDirs, one "<name> <path>" per line. The first
+// match for each compiler wins.
+func findCppCompilersScript(names []string) string {
+	return fmt.Sprintf(`for c in %s; do
+  p=$(command -v "$c" 2>/dev/null)
+  if [ -z "$p" ]; then
+    for d in %s; do
+      if [ -x "$d/$c" ]; then p="$d/$c"; break; fi
+    done
+  fi
+  if [ -n "$p" ]; then echo "$c $p"; fi
+done`, strings.Join(names, " "), strings.Join(cppCompilerDirs, " "))
+}
+
+// parseCppCompilers parses the output of the script returned by findCppCompilersScript for the
+// given compiler names.
+func parseCppCompilers(out string, names []string) []cppCompiler {
+	var result []cppCompiler
+	for _, l := range strings.Split(out, "\n") {
+		s := strings.Fields(l)
+		if len(s) != 2 || !strListContains(names, s[0]) || !path.IsAbs(s[1]) {
+			continue
+		}
+		result = append(result, cppCompiler{name: s[0], path: s[1], version: osUnknown})
+	}
+	return result
+}
+
+// parseCompilerVersion returns the version in the output of '<compiler> --version' or osUnknown
+// if the output didn't have a version.
+func parseCompilerVersion(out string) string {
+	first := strings.SplitN(strings.TrimSpace(out), "\n", 2)[0]
+	m := compilerVersionRegexp.FindStringSubmatch(first)
+	if len(m) < 2 {
+		return osUnknown
+	}
+	return m[1]
+}
+
+// parseLinkerVersion returns the version in the output of '<linker> --version' or "" if the output
+// didn't have a version. The last version on the first line is the version of the linker, e.g.,
+// "2.34" from "GNU ld (GNU Binutils for Ubuntu) 2.34" or "1.16" from
+// "GNU gold (GNU Binutils for Ubuntu 2.34) 1.16".
+func parseLinkerVersion(out string) string {
+	first := strings.SplitN(strings.TrimSpace(out), "\n", 2)[0]
+	m := compilerVersionRegexp.FindAllStringSubmatch(first, -1)
+	if len(m) == 0 {
+		return ""
+	}
+	return m[len(m)-1][1]
+}
+
+// detectLinker records the version of the linker used by the detected C++ compiler in the running
+// toolchain container in the given facts. The version is left blank if it couldn't be determined.
+func detectLinker(d *dockerRunner, f *detectionFacts) {
+	if len(f.CppCompilerPath) == 0 {
+		return
+	}
+	ld, err := d.execCmd(f.CppCompilerPath, "-print-prog-name=ld")
+	if err != nil {
+		d.warnf(WarningUnknownLinkerVersion, "Unable to determine the linker used by C++ compiler %q, its version will not be recorded in the manifest: %v", f.CppCompilerPath, err)
+		return
+	}
+	ld = strings.TrimSpace(ld)
+	out, err := d.execCmd(ld, "--version")
+	if err != nil {
+		d.warnf(WarningUnknownLinkerVersion, "Unable to determine the version of linker %q, it will not be recorded in the manifest: %v", ld, err)
+		return
+	}
+	if f.LinkerVersion = parseLinkerVersion(out); len(f.LinkerVersion) == 0 {
+		d.warnf(WarningUnknownLinkerVersion, "Linker %q didn't report a version, it will not be recorded in the manifest.", ld)
+		return
+	}
+	d.log.Infof("Linker: %s %s.", ld, f.LinkerVersion)
+}
+
+// findCppCompilers returns the compilers with the given names found in the running Linux
+// toolchain container.
+func findCppCompilers(d *dockerRunner, names []string) ([]cppCompiler, error) {
+	out, err := d.execUtil([]string{"sh", "-c", findCppCompilersScript(names)}, append([]string{"find-compilers"}, names...)...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to search for C++ compilers in the toolchain container: %w", err)
+	}
+	found := parseCppCompilers(out, names)
+	for i, c := range found {
+		v, err := d.execCmd(c.path, "--version")
+		if err != nil {
+			d.warnf(WarningUnknownCompilerVersion, "Unable to determine the version of C++ compiler %q, it will be recorded as %q: %v", c.path, osUnknown, err)
+			continue
+		}
+		found[i].version = parseCompilerVersion(v)
+	}
+	return found, nil
+}
+
+// selectCppCompiler returns the compiler with the given name among the given found compilers.
+// The error lists the found compilers if there's no match.
+func selectCppCompiler(found []cppCompiler, name string) (cppCompiler, error) {
+	var names []string
+	for _, c := range found {
+		if c.name == name {
+			return c, nil
+		}
+		names = append(names, c.String())
+	}
+	if len(names) == 0 {
+		return cppCompiler{}, fmt.Errorf("C++ compiler %q was not found in the toolchain container, no compilers were found", name)
+	}
+	return cppCompiler{}, fmt.Errorf("C++ compiler %q was not found in the toolchain container, found: %s", name, strings.Join(names, ", "))
+}
+
+// envValue returns the value of the last assignment to the given key in the given environment of
+// "key=value" strings or "" if the key isn't set.
+func envValue(env []string, key string) string {
+	var v string
+	for _, e := range env {
+		if strings.HasPrefix(e, key+"=") {
+			v = strings.TrimPrefix(e, key+"=")
+		}
+	}
+	return v
+}
+
+// detectCppCompiler determines the compiler Bazel will use to generate C++ configs in the running
+// toolchain container and records it in the given facts. This is the compiler selected with the
+// CppCompiler option which must be present in the container or otherwise the compiler specified
+// by CC in the C++ config generation environment if it was found. Compilers are only detected in
+// Linux containers. The cross compiler for the TargetCPU is detected instead when cross-compiling.
+func detectCppCompiler(d *dockerRunner, o *Options, f *detectionFacts) error {
+	if o.ExecOS != OSLinux {
+		return nil
+	}
+	if isCrossCompiling(o) {
+		return detectCrossCompiler(d, o, f)
+	}
+	found, err := findCppCompilers(d, cppCompilerNames)
+	if err != nil {
+		if len(o.CppCompiler) != 0 {
+			return err
+		}
+		d.warnf(WarningUnknownCompiler, "The C++ compiler will not be recorded in the manifest: %v", err)
+		return nil
+	}
+	for _, c := range found {
+		d.log.Debugf("Found C++ compiler %s.", c)
+	}
+	var c cppCompiler
+	if len(o.CppCompiler) != 0 {
+		if c, err = selectCppCompiler(found, o.CppCompiler); err != nil {
+			return err
+		}
+	} else {
+		env, err := appendCppEnv(nil, o)
+		if err != nil {
+			return fmt.Errorf("unable to determine the C++ config generation environment: %w", err)
+		}
+		cc := envValue(env, "CC")
+		for _, fc := range found {
+			if fc.name == cc || fc.path == cc {
+				c = fc
+				break
+			}
+		}
+		if len(c.name) == 0 {
+			d.warnf(WarningUnknownCompiler, "C++ compiler CC=%q wasn't among the detected C++ compilers, it will not be recorded in the manifest.", cc)
+			return nil
+		}
+	}
+	f.CppCompiler, f.CppCompilerPath, f.CppCompilerVersion = c.name, c.path, c.version
+	d.log.Infof("C++ compiler: %s.", c)
+	return checkCppStdlibCompiler(o, f.CppCompiler)
+}
+
+// checkCppStdlibCompiler returns an error if the CppStdlib in the given options was specified but
+// the detected C++ compiler with the given name is GCC, which doesn't support -stdlib. Validate
+// only rejects GCC selected with CppCompiler, not GCC from CC in the C++ config generation
+// environment, e.g., the default environment.
+func checkCppStdlibCompiler(o *Options, compiler string) error {
+	if len(o.CppStdlib) == 0 || (compiler != "gcc" && compiler != "g++") {
+		return nil
+	}
+	return fmt.Errorf("CppStdlib %q requires clang but the C++ compiler from CC in the C++ config generation environment is %q, specify CppCompiler to select clang", o.CppStdlib, compiler)
+}
+
+// appendEnvOpts returns the given environment of "key=value" strings with the given options
+// appended to the colon separated list of options set for the given key, e.g., BAZEL_CXXOPTS.
+// Options for which the given drop function returns true are removed from the existing list.
+func appendEnvOpts(env []string, key string, drop func(string) bool, opts ...string) []string {
+	var result []string
+	if v := envValue(env, key); len(v) != 0 {
+		for _, opt := range strings.Split(v, ":") {
+			if drop == nil || !drop(opt) {
+				result = append(result, opt)
+			}
+		}
+	}
+	return setEnv(env, key, strings.Join(append(result, opts...), ":"))
+}
+
+// applyCppStdlibEnv adds -stdlib for the CppStdlib in the given options to BAZEL_CXXOPTS in the
+// given C++ config generation environment. Bazel passes BAZEL_CXXOPTS to the compiler when it
+// detects the builtin include directories so the headers of the selected standard library are
+// detected. For libc++, -stdlib also replaces -lstdc++ in BAZEL_LINKOPTS, which defaults to
+// "-lstdc++:-lm".
+func applyCppStdlibEnv(o *Options, env []string) []string {
+	if len(o.CppStdlib) == 0 {
+		return env
+	}
+	flag := "-stdlib=" + o.CppStdlib
+	env = appendEnvOpts(env, "BAZEL_CXXOPTS", nil, flag)
+	if o.CppStdlib != CppStdlibLibcxx {
+		return env
+	}
+	if !envContains(env, "BAZEL_LINKOPTS") {
+		env = setEnv(env, "BAZEL_LINKOPTS", "-lstdc++:-lm")
+	}
+	return appendEnvOpts(env, "BAZEL_LINKOPTS", func(opt string) bool { return opt == "-lstdc++" }, flag)
+}
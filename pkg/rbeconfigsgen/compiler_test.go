@@ -0,0 +1,241 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParseCppCompilers(t *testing.T) {
+	out := strings.Join([]string{
+		"gcc /usr/bin/gcc",
+		"clang /usr/lib/llvm-10/bin/clang",
+		"cc /usr/bin/cc",
+		"clang++ relative/clang++",
+		"",
+	}, "\n")
+	want := []cppCompiler{
+		{name: "gcc", path: "/usr/bin/gcc", version: osUnknown},
+		{name: "clang", path: "/usr/lib/llvm-10/bin/clang", version: osUnknown},
+	}
+	got := parseCppCompilers(out, cppCompilerNames)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseCppCompilers(%q)=%v, want %v", out, got, want)
+	}
+}
+
+func TestParseCompilerVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want string
+	}{
+		{
+			name: "GCC",
+			out:  "gcc (Ubuntu 9.4.0-1ubuntu1~20.04.1) 9.4.0\nCopyright (C) 2019 Free Software Foundation, Inc.",
+			want: "9.4.0",
+		},
+		{
+			name: "Clang",
+			out:  "clang version 10.0.0-4ubuntu1\nTarget: x86_64-pc-linux-gnu\nThread model: posix",
+			want: "10.0.0",
+		},
+		{
+			name: "Major & minor only",
+			out:  "Ubuntu clang version 14.0",
+			want: "14.0",
+		},
+		{
+			name: "No version",
+			out:  "some compiler",
+			want: osUnknown,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if got := parseCompilerVersion(tc.out); got != tc.want {
+				t.Errorf("parseCompilerVersion(%q)=%q, want %q", tc.out, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseLinkerVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want string
+	}{
+		{
+			name: "GNU ld",
+			out:  "GNU ld (GNU Binutils for Ubuntu) 2.34\nCopyright (C) 2020 Free Software Foundation, Inc.",
+			want: "2.34",
+		},
+		{
+			name: "GNU ld on CentOS",
+			out:  "GNU ld version 2.27-44.base.el7",
+			want: "2.27",
+		},
+		{
+			name: "Gold",
+			out:  "GNU gold (GNU Binutils for Ubuntu 2.34) 1.16",
+			want: "1.16",
+		},
+		{
+			name: "LLD",
+			out:  "LLD 10.0.0 (compatible with GNU linkers)",
+			want: "10.0.0",
+		},
+		{
+			name: "No version",
+			out:  "some linker",
+			want: "",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if got := parseLinkerVersion(tc.out); got != tc.want {
+				t.Errorf("parseLinkerVersion(%q)=%q, want %q", tc.out, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSelectCppCompiler(t *testing.T) {
+	found := []cppCompiler{
+		{name: "gcc", path: "/usr/bin/gcc", version: "9.4.0"},
+		{name: "clang", path: "/usr/local/bin/clang", version: "10.0.0"},
+	}
+	tests := []struct {
+		name       string
+		found      []cppCompiler
+		compiler   string
+		wantPath   string
+		wantErrMsg string
+	}{
+		{
+			name:     "Found",
+			found:    found,
+			compiler: "clang",
+			wantPath: "/usr/local/bin/clang",
+		},
+		{
+			name:       "Missing",
+			found:      found,
+			compiler:   "clang++",
+			wantErrMsg: "found: gcc 9.4.0 (/usr/bin/gcc), clang 10.0.0 (/usr/local/bin/clang)",
+		},
+		{
+			name:       "No compilers",
+			compiler:   "gcc",
+			wantErrMsg: "no compilers were found",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			c, err := selectCppCompiler(tc.found, tc.compiler)
+			if len(tc.wantErrMsg) != 0 {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErrMsg) {
+					t.Fatalf("selectCppCompiler(%q)=%v, want error containing %q", tc.compiler, err, tc.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("selectCppCompiler(%q) failed: %v", tc.compiler, err)
+			}
+			if c.path != tc.wantPath {
+				t.Errorf("selectCppCompiler(%q) returned path %q, want %q", tc.compiler, c.path, tc.wantPath)
+			}
+		})
+	}
+}
+
+func TestCheckCppStdlibCompiler(t *testing.T) {
+	tests := []struct {
+		name     string
+		stdlib   string
+		compiler string
+		wantErr  bool
+	}{
+		{name: "No stdlib", compiler: "gcc"},
+		{name: "Clang", stdlib: CppStdlibLibcxx, compiler: "clang"},
+		{name: "Unknown compiler", stdlib: CppStdlibLibcxx},
+		{name: "Default gcc", stdlib: CppStdlibLibcxx, compiler: "gcc", wantErr: true},
+		{name: "Default g++", stdlib: CppStdlibLibstdcxx, compiler: "g++", wantErr: true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			err := checkCppStdlibCompiler(&Options{CppStdlib: tc.stdlib}, tc.compiler)
+			if got := err != nil; got != tc.wantErr {
+				t.Errorf("checkCppStdlibCompiler(%q, %q)=%v, want error=%v", tc.stdlib, tc.compiler, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestApplyCppStdlibEnv(t *testing.T) {
+	tests := []struct {
+		name   string
+		stdlib string
+		env    []string
+		want   []string
+	}{
+		{
+			name: "Unset",
+			env:  []string{"CC=clang"},
+			want: []string{"CC=clang"},
+		},
+		{
+			name:   "Libcxx",
+			stdlib: CppStdlibLibcxx,
+			env:    []string{"CC=clang"},
+			want:   []string{"BAZEL_CXXOPTS=-stdlib=libc++", "BAZEL_LINKOPTS=-lm:-stdlib=libc++", "CC=clang"},
+		},
+		{
+			name:   "Libcxx with existing options",
+			stdlib: CppStdlibLibcxx,
+			env:    []string{"CC=clang", "BAZEL_CXXOPTS=-std=c++17", "BAZEL_LINKOPTS=-lstdc++:-lm:-fuse-ld=lld"},
+			want:   []string{"BAZEL_CXXOPTS=-std=c++17:-stdlib=libc++", "BAZEL_LINKOPTS=-lm:-fuse-ld=lld:-stdlib=libc++", "CC=clang"},
+		},
+		{
+			name:   "Libstdcxx",
+			stdlib: CppStdlibLibstdcxx,
+			env:    []string{"CC=clang"},
+			want:   []string{"BAZEL_CXXOPTS=-stdlib=libstdc++", "CC=clang"},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got := applyCppStdlibEnv(&Options{CppStdlib: tc.stdlib}, tc.env)
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("applyCppStdlibEnv()=%v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// TarballFormatTar is an uncompressed configs tarball.
+	TarballFormatTar = "tar"
+	// TarballFormatTarGz is a gzip compressed configs tarball.
+	TarballFormatTarGz = "tar.gz"
+	// TarballFormatTarZst is a zstd compressed configs tarball.
+	TarballFormatTarZst = "tar.zst"
+)
+
+var (
+	// validTarballFormats are the accepted values of TarballFormat.
+	validTarballFormats = []string{TarballFormatTar, TarballFormatTarGz, TarballFormatTarZst}
+
+	// tarballContentTypes maps the tarball formats to their MIME types.
+	tarballContentTypes = map[string]string{
+		TarballFormatTar:    "application/x-tar",
+		TarballFormatTarGz:  "application/gzip",
+		TarballFormatTarZst: "application/zstd",
+	}
+
+	// gzipMagic & zstdMagic are the leading bytes of gzip & zstd compressed streams respectively.
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// validateTarballFormat returns an error if the given tarball format isn't one of
+// validTarballFormats.
+func validateTarballFormat(format string) error {
+	if !strListContains(validTarballFormats, format) {
+		return fmt.Errorf("got unknown tarball format %q, want one of %s", format, strings.Join(validTarballFormats, ", "))
+	}
+	return nil
+}
+
+// TarballContentType returns the MIME type to upload a configs tarball in the given format with,
+// e.g., "application/zstd" for TarballFormatTarZst. A blank format is treated as TarballFormatTar
+// like in manifests written before the format was recorded.
+func TarballContentType(format string) string {
+	if len(format) == 0 {
+		format = TarballFormatTar
+	}
+	return tarballContentTypes[format]
+}
+
+// nopWriteCloser is an io.WriteCloser whose Close does nothing.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// newTarballCompressor returns a writer compressing everything written to it in the given tarball
+// format into the given writer. The returned writer must be closed to flush the compressed stream
+// but closing it doesn't close the given writer.
+func newTarballCompressor(format string, w io.Writer) (io.WriteCloser, error) {
+	switch format {
+	case TarballFormatTar, "":
+		return nopWriteCloser{w}, nil
+	case TarballFormatTarGz:
+		return gzip.NewWriter(w), nil
+	case TarballFormatTarZst:
+		z, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, fmt.Errorf("unable to initialize the zstd compressor: %w", err)
+		}
+		return z, nil
+	}
+	return nil, validateTarballFormat(format)
+}
+
+// newTarballDecompressor returns a reader of the uncompressed contents of the configs tarball read
+// from the given reader. The compression is detected from the leading bytes of the tarball so that
+// uncompressed, gzip & zstd compressed tarballs can be read.
+func newTarballDecompressor(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	// Short tarballs are caught when reading the tar headers.
+	magic, _ := br.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		g, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the gzip compressed tarball: %w", err)
+		}
+		return g, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		z, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the zstd compressed tarball: %w", err)
+		}
+		return z.IOReadCloser(), nil
+	}
+	return ioutil.NopCloser(br), nil
+}
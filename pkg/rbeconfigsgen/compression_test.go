@@ -0,0 +1,93 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestAssembleConfigTarballFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tarball_format_test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	oc := outputConfigs{
+		license:     generatedFile{name: "LICENSE", contents: []byte("license")},
+		configBuild: generatedFile{name: "config/BUILD", contents: []byte("platform")},
+	}
+	tests := []struct {
+		format string
+		magic  []byte
+	}{
+		{format: TarballFormatTar},
+		{format: TarballFormatTarGz, magic: gzipMagic},
+		{format: TarballFormatTarZst, magic: zstdMagic},
+	}
+	for _, tc := range tests {
+		t.Run(tc.format, func(t *testing.T) {
+			o := &Options{OutputTarball: filepath.Join(dir, "configs."+tc.format), TarballFormat: tc.format}
+			if _, err := assembleConfigTarball(o, oc); err != nil {
+				t.Fatalf("assembleConfigTarball(TarballFormat=%q) failed: %v", tc.format, err)
+			}
+			blob, err := ioutil.ReadFile(o.OutputTarball)
+			if err != nil {
+				t.Fatalf("Failed to read the output tarball: %v", err)
+			}
+			if len(tc.magic) != 0 && !bytes.HasPrefix(blob, tc.magic) {
+				t.Errorf("assembleConfigTarball(TarballFormat=%q) wrote a tarball starting with %x, want %x", tc.format, blob[:len(tc.magic)], tc.magic)
+			}
+
+			// The configs tarball is read back regardless of how it was compressed.
+			files, err := tarballFileDigests(o.OutputTarball, "")
+			if err != nil {
+				t.Fatalf("tarballFileDigests(%q) failed: %v", o.OutputTarball, err)
+			}
+			var got []string
+			for f := range files {
+				got = append(got, f)
+			}
+			sort.Strings(got)
+			if len(got) != 2 || got[0] != "LICENSE" || got[1] != "config/BUILD" {
+				t.Errorf("tarballFileDigests(%q) returned files %v, want [LICENSE config/BUILD]", o.OutputTarball, got)
+			}
+		})
+	}
+}
+
+func TestTarballContentType(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{format: "", want: "application/x-tar"},
+		{format: TarballFormatTar, want: "application/x-tar"},
+		{format: TarballFormatTarGz, want: "application/gzip"},
+		{format: TarballFormatTarZst, want: "application/zstd"},
+	}
+	for _, tc := range tests {
+		if got := TarballContentType(tc.format); got != tc.want {
+			t.Errorf("TarballContentType(%q)=%q, want %q", tc.format, got, tc.want)
+		}
+	}
+	if err := validateTarballFormat("tar.xz"); err == nil {
+		t.Errorf("validateTarballFormat(%q) succeeded, want error", "tar.xz")
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Groups of actions the generated C++ toolchain can be configured for with the CppActions option
+// in addition to the C & C++ actions configured by Bazel.
+const (
+	// CppActionsObjC configures the objc-compile & objc++-compile actions for Objective-C &
+	// Objective-C++ sources.
+	CppActionsObjC = "objc"
+	// CppActionsAsm configures the assemble & preprocess-assemble actions for .s & .S sources.
+	CppActionsAsm = "asm"
+)
+
+// cppActionProbe is a source file compiled with the compiler of the generated C++ toolchain to
+// verify it supports the language of a Bazel action before the action is configured.
+type cppActionProbe struct {
+	// action is the name of the Bazel action, e.g., "objc-compile".
+	action string
+	// lang is the language of the source file passed to the compiler with -x.
+	lang string
+	// file is the name of the source file.
+	file string
+	// source is the contents of the source file.
+	source string
+	// implies are the features implied by the action config Bazel defines for the action of
+	// toolchains configured with tool_paths, which is replaced by the action config of the action.
+	// Bazel's action configs don't have flag sets of their own, the flags of the action come from
+	// the implied features.
+	implies []string
+}
+
+var (
+	// cppActionGroups are the valid values of the CppActions option.
+	cppActionGroups = []string{CppActionsObjC, CppActionsAsm}
+	// cppActionProbes are the probes of the actions configured for each group of CppActions.
+	cppActionProbes = map[string][]cppActionProbe{
+		CppActionsObjC: {
+			{action: "objc-compile", lang: "objective-c", file: "action_probe.m", source: "int main(void) { return 0; }\n", implies: legacyCompileActionImplies},
+			{action: "objc++-compile", lang: "objective-c++", file: "action_probe.mm", source: "int main() { return 0; }\n", implies: legacyCompileActionImplies},
+		},
+		CppActionsAsm: {
+			{action: "assemble", lang: "assembler", file: "action_probe.s", source: "\t.text\n", implies: legacyCompileActionImplies[1:]},
+			{action: "preprocess-assemble", lang: "assembler-with-cpp", file: "action_probe.S", source: "#define PROBE 1\n\t.text\n", implies: legacyCompileActionImplies},
+		},
+	}
+	// legacyCompileActionImplies are the features implied by the action configs of the compile
+	// actions Bazel defines for toolchains configured with tool_paths, see getLegacyActionConfigs
+	// in CppActionConfigs.java. The assemble action doesn't imply legacy_compile_flags.
+	legacyCompileActionImplies = []string{
+		"legacy_compile_flags",
+		"user_compile_flags",
+		"sysroot",
+		"unfiltered_compile_flags",
+		"compiler_input_flags",
+		"compiler_output_flags",
+	}
+	// loadRegexp matches the load statements of a Starlark file.
+	loadRegexp = regexp.MustCompile(`(?m)^load\(`)
+	// configInfoActionConfigsRegexp matches the action configs passed to
+	// create_cc_toolchain_config_info in the cc_toolchain_config rule implementation generated by
+	// Bazel versions that define action configs.
+	configInfoActionConfigsRegexp = regexp.MustCompile(`\baction_configs\s*=\s*(\w+)\s*,`)
+	// configInfoCtxRegexp matches the start of the call to create_cc_toolchain_config_info in the
+	// cc_toolchain_config rule implementation generated by Bazel.
+	configInfoCtxRegexp = regexp.MustCompile(`create_cc_toolchain_config_info\(\s*ctx\s*=\s*ctx\s*,`)
+)
+
+// cppActionConfigsLoad loads the rules to define action configs under names that don't clash with
+// the symbols already loaded by the cc_toolchain_config rule generated by Bazel.
+const cppActionConfigsLoad = `load("@bazel_tools//tools/cpp:cc_toolchain_config_lib.bzl", rbe_action_config = "action_config", rbe_tool = "tool")` + "\n"
+
+// cppActionConfigs returns the Starlark expressions of the action configs for the CppActions in
+// the given options. The actions run the compiler in the tool_paths of the generated C++ toolchain
+// & imply the same features as the action configs Bazel defines for the actions of toolchains
+// configured with tool_paths. Action configs are disabled unless enabled explicitly.
+func cppActionConfigs(o *Options) []string {
+	var result []string
+	for _, g := range o.CppActions {
+		for _, p := range cppActionProbes[g] {
+			var implies []string
+			for _, f := range p.implies {
+				implies = append(implies, fmt.Sprintf("%q", f))
+			}
+			result = append(result, fmt.Sprintf(`rbe_action_config(action_name = %q, enabled = True, tools = [rbe_tool(path = ctx.attr.tool_paths["gcc"])], implies = [%s])`, p.action, strings.Join(implies, ", ")))
+		}
+	}
+	return result
+}
+
+// addCppActionConfigs adds the action configs for the CppActions in the given options to the
+// given contents of the Starlark file with the cc_toolchain_config rule generated by Bazel. They're
+// appended to the action configs of the toolchain if Bazel defines any.
+func addCppActionConfigs(o *Options, bzl []byte) ([]byte, error) {
+	if len(o.CppActions) == 0 {
+		return bzl, nil
+	}
+	configs := strings.Join(cppActionConfigs(o), ",\n            ")
+	switch n := len(configInfoActionConfigsRegexp.FindAllIndex(bzl, -1)); {
+	case n == 1:
+		bzl = configInfoActionConfigsRegexp.ReplaceAll(bzl, []byte("action_configs = ${1} + [\n            "+configs+",\n        ],"))
+	case n == 0 && len(configInfoCtxRegexp.FindAllIndex(bzl, -1)) == 1:
+		bzl = configInfoCtxRegexp.ReplaceAllLiteral(bzl, []byte("create_cc_toolchain_config_info(\n        ctx = ctx,\n        action_configs = [\n            "+configs+",\n        ],"))
+	default:
+		return nil, fmt.Errorf("unable to find where the generated C++ toolchain config passes its action configs to create_cc_toolchain_config_info, found %d candidates", n)
+	}
+	// Load statements must precede all other statements.
+	at := 0
+	if i := loadRegexp.FindIndex(bzl); i != nil {
+		at = i[0]
+	}
+	return append(append(append([]byte{}, bzl[:at]...), cppActionConfigsLoad...), bzl[at:]...), nil
+}
+
+// verifyCppActions verifies the compiler of the generated C++ toolchain in the C++ configs
+// tarball at the given path supports the languages of the CppActions in the given options by
+// compiling a probe source file for each action inside the running toolchain container.
+func verifyCppActions(d *dockerRunner, o *Options, tarPath string) error {
+	if len(o.CppActions) == 0 {
+		return nil
+	}
+	build, err := readCppBuild(tarPath)
+	if err != nil {
+		return err
+	}
+	m := compilerToolPathRegexp.FindSubmatch(build)
+	if m == nil {
+		return fmt.Errorf("unable to determine the compiler of the generated C++ toolchain from its tool_paths")
+	}
+	compiler := string(m[1])
+	for _, g := range o.CppActions {
+		for _, p := range cppActionProbes[g] {
+			src := path.Join(o.TempWorkDir, p.file)
+			if err := ioutil.WriteFile(src, []byte(p.source), 0644); err != nil {
+				return fmt.Errorf("unable to write the probe source file for the %s action: %w", p.action, err)
+			}
+			containerSrc := path.Join(d.workdir, p.file)
+			if err := d.copyToContainer(src, containerSrc); err != nil {
+				return fmt.Errorf("failed to copy the probe source file for the %s action into the toolchain container: %w", p.action, err)
+			}
+			if _, err := d.execCmd(compiler, "-x", p.lang, "-c", "-o", containerSrc+".o", containerSrc); err != nil {
+				return fmt.Errorf("compiler %q of the generated C++ toolchain doesn't support %s sources needed for the %s action of CppActions %q: %w", compiler, p.lang, p.action, g, err)
+			}
+		}
+	}
+	return nil
+}
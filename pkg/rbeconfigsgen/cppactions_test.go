@@ -0,0 +1,160 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestAddCppActionConfigs(t *testing.T) {
+	const withoutActionConfigs = `load("@bazel_tools//tools/cpp:cc_toolchain_config_lib.bzl", "feature")
+
+def _impl(ctx):
+    return cc_common.create_cc_toolchain_config_info(
+        ctx = ctx,
+        features = features,
+    )
+`
+	tests := []struct {
+		name       string
+		opt        *Options
+		bzl        string
+		want       []string
+		wantErrMsg string
+	}{
+		{
+			name: "Appended to the action configs of Bazel",
+			opt:  &Options{CppActions: []string{CppActionsAsm}},
+			bzl:  testCppToolchainConfig,
+			want: []string{
+				cppActionConfigsLoad + "def _impl(ctx):",
+				"action_configs = action_configs + [\n            rbe_action_config(action_name = \"assemble\", enabled = True, tools = [rbe_tool(path = ctx.attr.tool_paths[\"gcc\"])], implies = [\"user_compile_flags\", \"sysroot\", \"unfiltered_compile_flags\", \"compiler_input_flags\", \"compiler_output_flags\"]),\n            rbe_action_config(action_name = \"preprocess-assemble\", enabled = True, tools = [rbe_tool(path = ctx.attr.tool_paths[\"gcc\"])], implies = [\"legacy_compile_flags\", \"user_compile_flags\",",
+			},
+		},
+		{
+			name: "No action configs defined by Bazel",
+			opt:  &Options{CppActions: []string{CppActionsObjC, CppActionsAsm}},
+			bzl:  withoutActionConfigs,
+			want: []string{
+				cppActionConfigsLoad + `load("@bazel_tools//tools/cpp:cc_toolchain_config_lib.bzl", "feature")`,
+				"ctx = ctx,\n        action_configs = [\n            rbe_action_config(action_name = \"objc-compile\",",
+				`rbe_action_config(action_name = "objc++-compile",`,
+				`rbe_action_config(action_name = "preprocess-assemble",`,
+			},
+		},
+		{
+			name: "With extra features",
+			opt:  &Options{CppActions: []string{CppActionsObjC}, ExtraCppFeatures: []string{"asan"}},
+			bzl:  testCppToolchainConfig,
+			want: []string{
+				"features = features + [\n            feature(name = \"asan\", enabled = True),\n        ],",
+				"action_configs = action_configs + [\n            rbe_action_config(action_name = \"objc-compile\",",
+			},
+		},
+		{
+			name:       "No call to create_cc_toolchain_config_info",
+			opt:        &Options{CppActions: []string{CppActionsAsm}},
+			bzl:        "def _impl(ctx):\n    return []\n",
+			wantErrMsg: "action configs",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			out, err := editCppToolchainConfig(tc.opt, []byte(tc.bzl))
+			if len(tc.wantErrMsg) != 0 {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErrMsg) {
+					t.Fatalf("editCppToolchainConfig()=%v, want error containing %q", err, tc.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("editCppToolchainConfig() failed: %v", err)
+			}
+			for _, w := range tc.want {
+				if !strings.Contains(string(out), w) {
+					t.Errorf("editCppToolchainConfig() output didn't contain %q:\n%s", w, out)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyCppActions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake docker client is a shell script")
+	}
+	tests := []struct {
+		name string
+		// failLang is the language the fake compiler fails to compile.
+		failLang string
+		wantErr  bool
+	}{
+		{name: "Supported"},
+		{name: "No Objective-C++ frontend", failLang: "objective-c++", wantErr: true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			dir := t.TempDir()
+			logPath := filepath.Join(dir, "docker.log")
+			dockerPath := filepath.Join(dir, "docker")
+			// The fake docker client records its arguments & fails to compile failLang sources.
+			script := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %q\nif [ \"$1\" = exec ] && [ \"$7\" = %q ]; then exit 1; fi\n", logPath, tc.failLang)
+			if err := ioutil.WriteFile(dockerPath, []byte(script), 0755); err != nil {
+				t.Fatalf("Unable to write fake docker client: %v", err)
+			}
+			d := &dockerRunner{
+				dockerPath:  dockerPath,
+				containerID: "cid123",
+				workdir:     "/workdir",
+				ctx:         context.Background(),
+			}
+			o := &Options{CppActions: []string{CppActionsObjC, CppActionsAsm}, TempWorkDir: dir}
+			tarPath := writeTestTarball(t, map[string]string{cppBuildFile: testCppLinkBuild})
+			err := verifyCppActions(d, o, tarPath)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("verifyCppActions() = %v, want error %v", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			blob, err := ioutil.ReadFile(logPath)
+			if err != nil {
+				t.Fatalf("Unable to read the fake docker client log: %v", err)
+			}
+			log := string(blob)
+			for _, want := range []string{
+				"cp " + filepath.Join(dir, "action_probe.m") + " cid123:/workdir/action_probe.m\n",
+				"exec -w /workdir cid123 /usr/bin/clang -x objective-c -c -o /workdir/action_probe.m.o /workdir/action_probe.m\n",
+				"exec -w /workdir cid123 /usr/bin/clang -x objective-c++ -c -o /workdir/action_probe.mm.o /workdir/action_probe.mm\n",
+				"exec -w /workdir cid123 /usr/bin/clang -x assembler -c -o /workdir/action_probe.s.o /workdir/action_probe.s\n",
+				"exec -w /workdir cid123 /usr/bin/clang -x assembler-with-cpp -c -o /workdir/action_probe.S.o /workdir/action_probe.S\n",
+			} {
+				if !strings.Contains(log, want) {
+					t.Errorf("verifyCppActions() didn't run %q, docker was invoked with:\n%s", want, log)
+				}
+			}
+		})
+	}
+}
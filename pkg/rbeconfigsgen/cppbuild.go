@@ -0,0 +1,489 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// cxxBuiltinIncludeDirsRegexp matches the cxx_builtin_include_directories attribute of the
+	// cc_toolchain_config rules in the C++ configs BUILD file generated by Bazel.
+	cxxBuiltinIncludeDirsRegexp = regexp.MustCompile(`(?s)cxx_builtin_include_directories\s*=\s*\[(.*?)\]`)
+	// linkFlagsRegexp matches the link_flags attribute of the cc_toolchain_config rules in the C++
+	// configs BUILD file generated by Bazel but not, e.g., opt_link_flags.
+	linkFlagsRegexp = regexp.MustCompile(`(?s)\blink_flags\s*=\s*\[(.*?)\]`)
+	// linkLibsRegexp matches the link_libs attribute of the cc_toolchain_config rules in the C++
+	// configs BUILD file generated by Bazel.
+	linkLibsRegexp = regexp.MustCompile(`(?s)\blink_libs\s*=\s*\[(.*?)\]`)
+	// compilerToolPathRegexp matches the path of the compiler in the tool_paths attribute of the
+	// cc_toolchain_config rules in the C++ configs BUILD file generated by Bazel.
+	compilerToolPathRegexp = regexp.MustCompile(`"gcc"\s*:\s*"([^"]*)"`)
+	// cxxFlagsRegexp matches the cxx_flags attribute of the cc_toolchain_config rules in the C++
+	// configs BUILD file generated by Bazel.
+	cxxFlagsRegexp = regexp.MustCompile(`(?s)\bcxx_flags\s*=\s*\[(.*?)\]`)
+	// quotedStrRegexp matches a double quoted Starlark string literal.
+	quotedStrRegexp = regexp.MustCompile(`"([^"]*)"`)
+	// configInfoFeaturesRegexp matches the features passed to create_cc_toolchain_config_info in
+	// the cc_toolchain_config rule implementation generated by Bazel.
+	configInfoFeaturesRegexp = regexp.MustCompile(`\bfeatures\s*=\s*features\s*,`)
+	// cppFeatureNameRegexp matches the names of C++ toolchain features.
+	cppFeatureNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_+.-]*$`)
+	// knownCppFeatures are the features defined by the cc_toolchain_config rule generated by Bazel
+	// that can be enabled or disabled with the CppFeatures option.
+	knownCppFeatures = []string{"supports_pic", "per_object_debug_info", "supports_dynamic_linker"}
+)
+
+const (
+	// cppBuildFile is the name of the BUILD file with the C++ toolchain definitions in the C++
+	// configs tarball generated by Bazel.
+	cppBuildFile = "BUILD"
+	// cppToolchainConfigFile is the name of the Starlark file with the cc_toolchain_config rule in
+	// the C++ configs tarball generated by Bazel.
+	cppToolchainConfigFile = "cc_toolchain_config.bzl"
+)
+
+// starlarkList formats the given strings as a multi-line Starlark list.
+func starlarkList(l []string) string {
+	if len(l) == 0 {
+		return "[]"
+	}
+	var b strings.Builder
+	b.WriteString("[\n")
+	for _, s := range l {
+		fmt.Fprintf(&b, "        %q,\n", s)
+	}
+	b.WriteString("    ]")
+	return b.String()
+}
+
+// resolveCxxBuiltinIncludeDirs applies the include directory options to the given include
+// directories detected by Bazel.
+func resolveCxxBuiltinIncludeDirs(o *Options, detected []string) []string {
+	result := detected
+	if len(o.CxxBuiltinIncludeDirectories) != 0 {
+		result = o.CxxBuiltinIncludeDirectories
+	} else if len(o.ExcludeCxxBuiltinIncludeDirectories) != 0 {
+		result = nil
+		for _, dir := range detected {
+			if !excludesCxxBuiltinIncludeDir(o, dir) {
+				result = append(result, dir)
+			}
+		}
+	}
+	return append(append([]string{}, result...), o.ExtraCxxBuiltinIncludeDirectories...)
+}
+
+// excludesCxxBuiltinIncludeDir returns whether the given detected builtin include directory is
+// one of the ExcludeCxxBuiltinIncludeDirectories of the given options.
+func excludesCxxBuiltinIncludeDir(o *Options, dir string) bool {
+	for _, e := range o.ExcludeCxxBuiltinIncludeDirectories {
+		if path.Clean(e) == path.Clean(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// underDir returns whether the given path is the given directory or inside it.
+func underDir(p, dir string) bool {
+	p, dir = path.Clean(p), path.Clean(dir)
+	return p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// rewriteCxxBuiltinIncludeDirs rewrites every cxx_builtin_include_directories attribute in the
+// given contents of a C++ configs BUILD file according to the given options. Returns the rewritten
+// contents along with the resolved include directories of every rewritten attribute.
+func rewriteCxxBuiltinIncludeDirs(o *Options, build []byte) ([]byte, []string) {
+	var resolved []string
+	out := cxxBuiltinIncludeDirsRegexp.ReplaceAllFunc(build, func(m []byte) []byte {
+		dirs := resolveCxxBuiltinIncludeDirs(o, quotedStrs(cxxBuiltinIncludeDirsRegexp, m))
+		resolved = append(resolved, dirs...)
+		return []byte("cxx_builtin_include_directories = " + starlarkList(dirs))
+	})
+	return out, resolved
+}
+
+// quotedStrs returns the double quoted Starlark strings in the given list attribute matched by
+// the given regexp.
+func quotedStrs(r *regexp.Regexp, attr []byte) []string {
+	var l []string
+	for _, s := range quotedStrRegexp.FindAllSubmatch(r.FindSubmatch(attr)[1], -1) {
+		l = append(l, string(s[1]))
+	}
+	return l
+}
+
+// resolveLinkFlags applies the linker flag options to the given link flags detected by Bazel.
+func resolveLinkFlags(o *Options, detected []string) []string {
+	if o.ReplaceLinkerFlags {
+		return append([]string{}, o.LinkerFlags...)
+	}
+	return append(append([]string{}, detected...), o.LinkerFlags...)
+}
+
+// rewriteLinkFlags rewrites every link_flags attribute in the given contents of a C++ configs
+// BUILD file according to the given options. Returns the rewritten contents along with the
+// resolved flags of the last rewritten attribute.
+func rewriteLinkFlags(o *Options, build []byte) ([]byte, []string, error) {
+	if !linkFlagsRegexp.Match(build) {
+		return nil, nil, fmt.Errorf("the C++ configs %s file doesn't set link_flags", cppBuildFile)
+	}
+	var resolved []string
+	out := linkFlagsRegexp.ReplaceAllFunc(build, func(m []byte) []byte {
+		resolved = resolveLinkFlags(o, quotedStrs(linkFlagsRegexp, m))
+		return []byte("link_flags = " + starlarkList(resolved))
+	})
+	return out, resolved, nil
+}
+
+// hasCppBuildOverrides returns whether the given options require modifying the C++ configs BUILD
+// file generated by Bazel.
+func hasCppBuildOverrides(o *Options) bool {
+	return len(o.CxxBuiltinIncludeDirectories) != 0 || len(o.ExtraCxxBuiltinIncludeDirectories) != 0 || len(o.ExcludeCxxBuiltinIncludeDirectories) != 0 || hasCppFeatureOverrides(o) || len(o.TargetSysroot) != 0 || len(o.LinkerFlags) != 0
+}
+
+// hasCppFeatureOverrides returns whether the given options require modifying the features or the
+// action configs of the cc_toolchain_config rule generated by Bazel.
+func hasCppFeatureOverrides(o *Options) bool {
+	return len(o.CppFeatures) != 0 || len(o.ExtraCppFeatures) != 0 || len(o.CppActions) != 0
+}
+
+// extraCppFeature returns the Starlark expression for the given extra C++ feature which is either
+// the name of a feature enabled by default or a raw feature(...) expression used verbatim.
+func extraCppFeature(f string) string {
+	if strings.HasPrefix(strings.TrimSpace(f), "feature(") {
+		return strings.TrimSpace(f)
+	}
+	return fmt.Sprintf("feature(name = %q, enabled = True)", f)
+}
+
+// editCppToolchainConfig applies the C++ feature & action options to the given contents of the
+// Starlark file with the cc_toolchain_config rule generated by Bazel. Known features are enabled or
+// disabled in place, extra features are appended to the features of the toolchain & action
+// configs are added for CppActions.
+func editCppToolchainConfig(o *Options, bzl []byte) ([]byte, error) {
+	var names []string
+	for n := range o.CppFeatures {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		// Bazel defines features with the name as the first argument, optionally followed by
+		// whether the feature is enabled by default.
+		r := regexp.MustCompile(`feature\(\s*name\s*=\s*"` + regexp.QuoteMeta(n) + `"\s*,(\s*enabled\s*=\s*(True|False)\s*,)?`)
+		if !r.Match(bzl) {
+			return nil, fmt.Errorf("feature %q isn't defined by the generated C++ toolchain config", n)
+		}
+		enabled := "False"
+		if o.CppFeatures[n] {
+			enabled = "True"
+		}
+		bzl = r.ReplaceAllLiteral(bzl, []byte(fmt.Sprintf("feature(\n        name = %q,\n        enabled = %s,", n, enabled)))
+	}
+	if len(o.ExtraCppFeatures) == 0 {
+		return addCppActionConfigs(o, bzl)
+	}
+	if n := len(configInfoFeaturesRegexp.FindAllIndex(bzl, -1)); n != 1 {
+		return nil, fmt.Errorf("unable to find where the generated C++ toolchain config passes its features to create_cc_toolchain_config_info, found %d candidates, want 1", n)
+	}
+	var extra []string
+	for _, f := range o.ExtraCppFeatures {
+		extra = append(extra, extraCppFeature(f))
+	}
+	bzl = configInfoFeaturesRegexp.ReplaceAllLiteral(bzl, []byte("features = features + [\n            "+strings.Join(extra, ",\n            ")+",\n        ],"))
+	return addCppActionConfigs(o, bzl)
+}
+
+// editCppBuild applies the C++ options overriding what was detected by Bazel to the given contents
+// of the C++ configs BUILD file.
+func editCppBuild(o *Options, build []byte) []byte {
+	if len(o.ExcludeCxxBuiltinIncludeDirectories) != 0 && cxxBuiltinIncludeDirsRegexp.Match(build) {
+		detected := quotedStrs(cxxBuiltinIncludeDirsRegexp, build)
+		for _, e := range o.ExcludeCxxBuiltinIncludeDirectories {
+			found := false
+			for _, dir := range detected {
+				found = found || path.Clean(e) == path.Clean(dir)
+			}
+			if !found {
+				o.log.Warningf("Excluded builtin include directory %q isn't one of the cxx_builtin_include_directories detected by Bazel: %s.", e, strings.Join(detected, ", "))
+			}
+		}
+	}
+	out, _ := rewriteCxxBuiltinIncludeDirs(o, build)
+	return out
+}
+
+// readCppBuild returns the contents of the C++ configs BUILD file in the given C++ configs tarball.
+func readCppBuild(tarPath string) ([]byte, error) {
+	in, err := os.Open(tarPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open input tarball %q for reading: %w", tarPath, err)
+	}
+	defer in.Close()
+	inTar := tar.NewReader(in)
+	for {
+		h, err := inTar.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error while reading input tarball %q: %w", tarPath, err)
+		}
+		if h.Typeflag == tar.TypeReg && path.Clean(h.Name) == cppBuildFile {
+			return ioutil.ReadAll(inTar)
+		}
+	}
+	return nil, fmt.Errorf("C++ configs tarball %q didn't have a %s file", tarPath, cppBuildFile)
+}
+
+// applyCppBuildOverrides writes a copy of the C++ configs tarball at 'inTarPath' to 'outTarPath'
+// with the C++ configs BUILD file modified according to the given options.
+func applyCppBuildOverrides(o *Options, inTarPath, outTarPath string) error {
+	in, err := os.Open(inTarPath)
+	if err != nil {
+		return fmt.Errorf("unable to open input tarball %q for reading: %w", inTarPath, err)
+	}
+	defer in.Close()
+	out, err := os.Create(outTarPath)
+	if err != nil {
+		return fmt.Errorf("unable to open output tarball %q for writing: %w", outTarPath, err)
+	}
+	defer out.Close()
+	inTar := tar.NewReader(in)
+	outTar := tar.NewWriter(out)
+	editedFeatures := false
+	for {
+		h, err := inTar.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error while reading input tarball %q: %w", inTarPath, err)
+		}
+		var r io.Reader = inTar
+		if h.Typeflag == tar.TypeReg && path.Clean(h.Name) == cppBuildFile {
+			blob, err := ioutil.ReadAll(inTar)
+			if err != nil {
+				return fmt.Errorf("error while reading %q from input tarball %q: %w", h.Name, inTarPath, err)
+			}
+			blob = editCppBuild(o, blob)
+			if len(o.TargetSysroot) != 0 {
+				if blob, err = rewriteBuiltinSysroot(blob, o.TargetSysroot); err != nil {
+					return fmt.Errorf("unable to set the sysroot of the C++ cross compiler in %q: %w", h.Name, err)
+				}
+			}
+			if len(o.LinkerFlags) != 0 {
+				if blob, _, err = rewriteLinkFlags(o, blob); err != nil {
+					return fmt.Errorf("unable to apply LinkerFlags to %q: %w", h.Name, err)
+				}
+			}
+			h.Size = int64(len(blob))
+			r = bytes.NewReader(blob)
+		}
+		if h.Typeflag == tar.TypeReg && path.Clean(h.Name) == cppToolchainConfigFile && hasCppFeatureOverrides(o) {
+			blob, err := ioutil.ReadAll(inTar)
+			if err != nil {
+				return fmt.Errorf("error while reading %q from input tarball %q: %w", h.Name, inTarPath, err)
+			}
+			if blob, err = editCppToolchainConfig(o, blob); err != nil {
+				return fmt.Errorf("unable to apply the C++ feature options to %q: %w", h.Name, err)
+			}
+			editedFeatures = true
+			h.Size = int64(len(blob))
+			r = bytes.NewReader(blob)
+		}
+		if err := outTar.WriteHeader(h); err != nil {
+			return fmt.Errorf("error while adding tar header for %q to output tarball %q: %w", h.Name, outTarPath, err)
+		}
+		if _, err := io.Copy(outTar, r); err != nil {
+			return fmt.Errorf("failed to copy the contents of %q to the output tarball %q: %w", h.Name, outTarPath, err)
+		}
+	}
+	if hasCppFeatureOverrides(o) && !editedFeatures {
+		return fmt.Errorf("C++ configs tarball %q didn't have a %s file to apply the C++ feature options to", inTarPath, cppToolchainConfigFile)
+	}
+	if err := outTar.Close(); err != nil {
+		return fmt.Errorf("error trying to finish writing the output tarball %q: %w", outTarPath, err)
+	}
+	return nil
+}
+
+// verifyCxxBuiltinIncludeDirs verifies every resolved builtin include directory for the C++
+// configs tarball at the given path exists inside the running toolchain container.
+func verifyCxxBuiltinIncludeDirs(d *dockerRunner, o *Options, tarPath string) error {
+	build, err := readCppBuild(tarPath)
+	if err != nil {
+		return err
+	}
+	_, dirs := rewriteCxxBuiltinIncludeDirs(o, build)
+	var missing []string
+	for _, dir := range dirs {
+		if !d.pathExists(dir) {
+			missing = append(missing, dir)
+		}
+	}
+	if len(missing) != 0 {
+		return fmt.Errorf("the following cxx_builtin_include_directories don't exist in the toolchain container: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// includeProbeSource is the C++ program preprocessed to list the headers of the C++ standard
+// library & the C library it includes.
+const includeProbeSource = `#include <cstdio>
+#include <cstdlib>
+#include <iostream>
+#include <string>
+#include <vector>
+
+int main() { return 0; }
+`
+
+// includedHeaders returns the headers in the given make rule printed by the -M option of the
+// compiler for a single source file, e.g., "probe.o: probe.cc /usr/include/stdio.h \\".
+func includedHeaders(rule string) []string {
+	i := strings.Index(rule, ":")
+	if i < 0 {
+		return nil
+	}
+	var headers []string
+	// The first prerequisite is the source file itself.
+	for j, f := range strings.Fields(strings.ReplaceAll(rule[i+1:], "\\\n", " ")) {
+		if j == 0 || f == "\\" {
+			continue
+		}
+		headers = append(headers, path.Clean(f))
+	}
+	return headers
+}
+
+// verifyExcludedCxxBuiltinIncludeDirs warns if excluding the ExcludeCxxBuiltinIncludeDirectories
+// from the builtin include directories for the C++ configs tarball at the given path breaks
+// compiling C++ programs with Bazel, i.e., if a header of the C++ standard library or the C
+// library included by a probe program is only inside an excluded directory, which Bazel reports
+// as an undeclared inclusion. The headers are listed by preprocessing the probe program with the
+// compiler of the generated C++ toolchain inside the running toolchain container. Nothing is
+// verified unless the given options specified ExcludeCxxBuiltinIncludeDirectories.
+func verifyExcludedCxxBuiltinIncludeDirs(d *dockerRunner, o *Options, tarPath string) error {
+	if len(o.ExcludeCxxBuiltinIncludeDirectories) == 0 {
+		return nil
+	}
+	build, err := readCppBuild(tarPath)
+	if err != nil {
+		return err
+	}
+	build, dirs := rewriteCxxBuiltinIncludeDirs(o, build)
+	m := compilerToolPathRegexp.FindSubmatch(build)
+	if m == nil {
+		return fmt.Errorf("unable to determine the compiler of the generated C++ toolchain from its tool_paths")
+	}
+	var flags []string
+	if cxxFlagsRegexp.Match(build) {
+		flags = quotedStrs(cxxFlagsRegexp, build)
+	}
+	src := path.Join(o.TempWorkDir, "include_probe.cc")
+	if err := ioutil.WriteFile(src, []byte(includeProbeSource), 0644); err != nil {
+		return fmt.Errorf("unable to write the include probe program: %w", err)
+	}
+	containerSrc := path.Join(d.workdir, "include_probe.cc")
+	if err := d.copyToContainer(src, containerSrc); err != nil {
+		return fmt.Errorf("failed to copy the include probe program into the toolchain container: %w", err)
+	}
+	cmd := append([]string{string(m[1]), "-M"}, flags...)
+	rule, err := d.execCmd(append(cmd, containerSrc)...)
+	if err != nil {
+		o.log.Warningf("Unable to verify that excluding %s from the cxx_builtin_include_directories doesn't break compilation because listing the headers included by a C++ program failed: %v", strings.Join(o.ExcludeCxxBuiltinIncludeDirectories, ", "), err)
+		return nil
+	}
+	var undeclared []string
+	for _, h := range includedHeaders(rule) {
+		declared := false
+		for _, dir := range dirs {
+			declared = declared || underDir(h, dir)
+		}
+		if declared {
+			continue
+		}
+		for _, e := range o.ExcludeCxxBuiltinIncludeDirectories {
+			if underDir(h, e) {
+				undeclared = append(undeclared, h)
+				break
+			}
+		}
+	}
+	if len(undeclared) != 0 {
+		o.log.Warningf("Excluding %s from the cxx_builtin_include_directories breaks compiling C++ programs with the generated C++ toolchain. Bazel will report the following headers as undeclared inclusions: %s", strings.Join(o.ExcludeCxxBuiltinIncludeDirectories, ", "), strings.Join(undeclared, ", "))
+	}
+	return nil
+}
+
+// linkProbeSource is the C++ program linked with the resolved link flags to verify them.
+const linkProbeSource = "int main() { return 0; }\n"
+
+// verifyLinkFlags verifies the resolved link flags for the C++ configs tarball at the given path
+// by linking a probe program with the compiler of the generated C++ toolchain inside the running
+// toolchain container. The probe program is also run unless cross-compiling. Nothing is verified
+// unless the given options specified LinkerFlags.
+func verifyLinkFlags(d *dockerRunner, o *Options, tarPath string) error {
+	if len(o.LinkerFlags) == 0 {
+		return nil
+	}
+	build, err := readCppBuild(tarPath)
+	if err != nil {
+		return err
+	}
+	build, flags, err := rewriteLinkFlags(o, build)
+	if err != nil {
+		return err
+	}
+	m := compilerToolPathRegexp.FindSubmatch(build)
+	if m == nil {
+		return fmt.Errorf("unable to determine the compiler of the generated C++ toolchain from its tool_paths")
+	}
+	var libs []string
+	if linkLibsRegexp.Match(build) {
+		libs = quotedStrs(linkLibsRegexp, build)
+	}
+	src := path.Join(o.TempWorkDir, "link_probe.cc")
+	if err := ioutil.WriteFile(src, []byte(linkProbeSource), 0644); err != nil {
+		return fmt.Errorf("unable to write the link probe program: %w", err)
+	}
+	containerSrc := path.Join(d.workdir, "link_probe.cc")
+	if err := d.copyToContainer(src, containerSrc); err != nil {
+		return fmt.Errorf("failed to copy the link probe program into the toolchain container: %w", err)
+	}
+	bin := path.Join(d.workdir, "link_probe")
+	cmd := append([]string{string(m[1]), "-o", bin, containerSrc}, flags...)
+	if _, err := d.execCmd(append(cmd, libs...)...); err != nil {
+		return fmt.Errorf("unable to link a program with link_flags %q: %w", strings.Join(flags, " "), err)
+	}
+	if isCrossCompiling(o) {
+		return nil
+	}
+	if _, err := d.execCmd(bin); err != nil {
+		return fmt.Errorf("program linked with link_flags %q failed to run: %w", strings.Join(flags, " "), err)
+	}
+	return nil
+}
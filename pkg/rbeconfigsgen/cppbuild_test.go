@@ -0,0 +1,333 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/bazel-toolchains/pkg/logging"
+)
+
+const testCppBuild = `cc_toolchain_config(
+    name = "local",
+    cpu = "k8",
+    cxx_builtin_include_directories = ["/usr/lib/gcc/x86_64-linux-gnu/9/include",
+    "/usr/local/include",
+    "/usr/include"],
+    tool_paths = {"gcc": "/usr/bin/clang"},
+)
+`
+
+func TestRewriteCxxBuiltinIncludeDirs(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  *Options
+		want []string
+	}{
+		{
+			name: "No overrides keeps detected",
+			opt:  &Options{},
+			want: []string{"/usr/lib/gcc/x86_64-linux-gnu/9/include", "/usr/local/include", "/usr/include"},
+		},
+		{
+			name: "Replace detected",
+			opt: &Options{
+				CxxBuiltinIncludeDirectories: []string{"/usr/include"},
+			},
+			want: []string{"/usr/include"},
+		},
+		{
+			name: "Append to detected",
+			opt: &Options{
+				ExtraCxxBuiltinIncludeDirectories: []string{"/opt/include"},
+			},
+			want: []string{"/usr/lib/gcc/x86_64-linux-gnu/9/include", "/usr/local/include", "/usr/include", "/opt/include"},
+		},
+		{
+			name: "Exclude detected",
+			opt: &Options{
+				ExcludeCxxBuiltinIncludeDirectories: []string{"/usr/lib/gcc/x86_64-linux-gnu/9/include/", "/opt/missing"},
+				ExtraCxxBuiltinIncludeDirectories:   []string{"/opt/include"},
+			},
+			want: []string{"/usr/local/include", "/usr/include", "/opt/include"},
+		},
+		{
+			name: "Replace and append",
+			opt: &Options{
+				CxxBuiltinIncludeDirectories:      []string{"/usr/include"},
+				ExtraCxxBuiltinIncludeDirectories: []string{"/opt/include"},
+			},
+			want: []string{"/usr/include", "/opt/include"},
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			out, got := rewriteCxxBuiltinIncludeDirs(tc.opt, []byte(testCppBuild))
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("rewriteCxxBuiltinIncludeDirs returned include dirs %v, wanted %v", got, tc.want)
+			}
+			// Rewriting the output again without overrides must preserve the resolved list.
+			if _, again := rewriteCxxBuiltinIncludeDirs(&Options{}, out); !reflect.DeepEqual(again, tc.want) {
+				t.Fatalf("rewritten BUILD file had include dirs %v, wanted %v", again, tc.want)
+			}
+		})
+	}
+}
+
+const testCppToolchainConfig = `def _impl(ctx):
+    supports_pic_feature = feature(
+        name = "supports_pic",
+        enabled = True,
+    )
+    per_object_debug_info_feature = feature(
+        name = "per_object_debug_info",
+        flag_sets = [],
+    )
+    features = [supports_pic_feature, per_object_debug_info_feature]
+    return cc_common.create_cc_toolchain_config_info(
+        ctx = ctx,
+        features = features,
+        action_configs = action_configs,
+    )
+`
+
+func TestEditCppToolchainConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		opt        *Options
+		want       []string
+		wantErrMsg string
+	}{
+		{
+			name: "Disable enabled feature",
+			opt:  &Options{CppFeatures: map[string]bool{"supports_pic": false}},
+			want: []string{"name = \"supports_pic\",\n        enabled = False,\n    )"},
+		},
+		{
+			name: "Enable feature without enabled attribute",
+			opt:  &Options{CppFeatures: map[string]bool{"per_object_debug_info": true}},
+			want: []string{"name = \"per_object_debug_info\",\n        enabled = True,\n        flag_sets = [],"},
+		},
+		{
+			name: "Extra features",
+			opt: &Options{ExtraCppFeatures: []string{
+				"asan",
+				`feature(name = "tsan", flag_sets = [])`,
+			}},
+			want: []string{"features = features + [\n            feature(name = \"asan\", enabled = True),\n            feature(name = \"tsan\", flag_sets = []),\n        ],"},
+		},
+		{
+			name:       "Undefined feature",
+			opt:        &Options{CppFeatures: map[string]bool{"supports_dynamic_linker": true}},
+			wantErrMsg: "isn't defined",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			out, err := editCppToolchainConfig(tc.opt, []byte(testCppToolchainConfig))
+			if len(tc.wantErrMsg) != 0 {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErrMsg) {
+					t.Fatalf("editCppToolchainConfig()=%v, want error containing %q", err, tc.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("editCppToolchainConfig() failed: %v", err)
+			}
+			for _, w := range tc.want {
+				if !strings.Contains(string(out), w) {
+					t.Errorf("editCppToolchainConfig() output didn't contain %q:\n%s", w, out)
+				}
+			}
+		})
+	}
+}
+
+const testCppLinkBuild = `cc_toolchain_config(
+    name = "local",
+    tool_paths = {"ar": "/usr/bin/ar",
+        "gcc": "/usr/bin/clang"},
+    link_flags = ["-fuse-ld=gold",
+    "-Wl,-no-as-needed"],
+    link_libs = ["-lstdc++",
+    "-lm"],
+    opt_link_flags = ["-Wl,--gc-sections"],
+)
+`
+
+func TestRewriteLinkFlags(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  *Options
+		want []string
+	}{
+		{
+			name: "Append to detected",
+			opt:  &Options{LinkerFlags: []string{"-static"}},
+			want: []string{"-fuse-ld=gold", "-Wl,-no-as-needed", "-static"},
+		},
+		{
+			name: "Replace detected",
+			opt:  &Options{LinkerFlags: []string{"-static", "-static-libgcc"}, ReplaceLinkerFlags: true},
+			want: []string{"-static", "-static-libgcc"},
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			out, got, err := rewriteLinkFlags(tc.opt, []byte(testCppLinkBuild))
+			if err != nil {
+				t.Fatalf("rewriteLinkFlags() failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("rewriteLinkFlags returned link flags %v, wanted %v", got, tc.want)
+			}
+			if want := `opt_link_flags = ["-Wl,--gc-sections"]`; !strings.Contains(string(out), want) {
+				t.Errorf("rewriteLinkFlags() modified opt_link_flags, got:\n%s", out)
+			}
+			if _, again, _ := rewriteLinkFlags(&Options{}, out); !reflect.DeepEqual(again, tc.want) {
+				t.Fatalf("rewritten BUILD file had link flags %v, wanted %v", again, tc.want)
+			}
+		})
+	}
+	if _, _, err := rewriteLinkFlags(&Options{LinkerFlags: []string{"-static"}}, []byte(testCppBuild)); err == nil {
+		t.Errorf("rewriteLinkFlags() succeeded for a BUILD file without link_flags, want error")
+	}
+}
+
+func TestIncludedHeaders(t *testing.T) {
+	rule := "include_probe.o: /workdir/include_probe.cc /usr/include/stdio.h \\\n /usr/lib/gcc/x86_64-linux-gnu/9/../../../../include/c++/9/iostream \\\n /usr/lib/gcc/x86_64-linux-gnu/9/include/stddef.h\n"
+	want := []string{"/usr/include/stdio.h", "/usr/include/c++/9/iostream", "/usr/lib/gcc/x86_64-linux-gnu/9/include/stddef.h"}
+	if got := includedHeaders(rule); !reflect.DeepEqual(got, want) {
+		t.Errorf("includedHeaders()=%q, want %q", got, want)
+	}
+}
+
+func TestVerifyExcludedCxxBuiltinIncludeDirs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake docker client is a shell script")
+	}
+	tests := []struct {
+		name    string
+		exclude []string
+		// wantWarning is whether a warning about undeclared inclusions is expected.
+		wantWarning bool
+	}{
+		{name: "Unused directory", exclude: []string{"/usr/local/include"}},
+		{name: "Needed directory", exclude: []string{"/usr/lib/gcc/x86_64-linux-gnu/9/include"}, wantWarning: true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			logPath := filepath.Join(dir, "docker.log")
+			dockerPath := filepath.Join(dir, "docker")
+			// The fake docker client records its arguments & prints the headers included by the
+			// probe program when it's preprocessed with -M.
+			script := fmt.Sprintf(`#!/bin/sh
+echo "$@" >> %q
+case "$*" in
+*-M*) printf 'include_probe.o: /workdir/include_probe.cc /usr/include/stdio.h \\\n /usr/lib/gcc/x86_64-linux-gnu/9/include/stddef.h\n' ;;
+esac
+`, logPath)
+			if err := ioutil.WriteFile(dockerPath, []byte(script), 0755); err != nil {
+				t.Fatalf("Unable to write fake docker client: %v", err)
+			}
+			var warnings []string
+			log := logging.NewLogger(func(l logging.Level, msg string) {
+				if l == logging.Warning {
+					warnings = append(warnings, msg)
+				}
+			})
+			d := &dockerRunner{
+				dockerPath:  dockerPath,
+				containerID: "cid123",
+				workdir:     "/workdir",
+				ctx:         context.Background(),
+				log:         log,
+			}
+			o := &Options{ExcludeCxxBuiltinIncludeDirectories: tc.exclude, TempWorkDir: dir, log: log}
+			tarPath := writeTestTarball(t, map[string]string{cppBuildFile: testCppBuild})
+			if err := verifyExcludedCxxBuiltinIncludeDirs(d, o, tarPath); err != nil {
+				t.Fatalf("verifyExcludedCxxBuiltinIncludeDirs() failed: %v", err)
+			}
+			blob, err := ioutil.ReadFile(logPath)
+			if err != nil {
+				t.Fatalf("Unable to read the fake docker client log: %v", err)
+			}
+			if want := "exec -w /workdir cid123 /usr/bin/clang -M /workdir/include_probe.cc\n"; !strings.Contains(string(blob), want) {
+				t.Errorf("verifyExcludedCxxBuiltinIncludeDirs() didn't run %q, docker was invoked with:\n%s", want, blob)
+			}
+			gotWarning := len(warnings) != 0 && strings.Contains(warnings[0], "/usr/lib/gcc/x86_64-linux-gnu/9/include/stddef.h")
+			if gotWarning != tc.wantWarning || len(warnings) > 1 {
+				t.Errorf("verifyExcludedCxxBuiltinIncludeDirs() logged warnings %q, want a warning about undeclared inclusions: %v", warnings, tc.wantWarning)
+			}
+		})
+	}
+}
+
+func TestVerifyLinkFlags(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake docker client is a shell script")
+	}
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "docker.log")
+	dockerPath := filepath.Join(dir, "docker")
+	// The fake docker client records its arguments.
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %q\n", logPath)
+	if err := ioutil.WriteFile(dockerPath, []byte(script), 0755); err != nil {
+		t.Fatalf("Unable to write fake docker client: %v", err)
+	}
+	d := &dockerRunner{
+		dockerPath:  dockerPath,
+		containerID: "cid123",
+		workdir:     "/workdir",
+		ctx:         context.Background(),
+	}
+	o := &Options{LinkerFlags: []string{"-static"}, ReplaceLinkerFlags: true, TempWorkDir: dir}
+	tarPath := writeTestTarball(t, map[string]string{cppBuildFile: testCppLinkBuild})
+	if err := verifyLinkFlags(d, o, tarPath); err != nil {
+		t.Fatalf("verifyLinkFlags() failed: %v", err)
+	}
+	blob, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("Unable to read the fake docker client log: %v", err)
+	}
+	log := string(blob)
+	for _, want := range []string{
+		"cp " + filepath.Join(dir, "link_probe.cc") + " cid123:/workdir/link_probe.cc\n",
+		"exec -w /workdir cid123 /usr/bin/clang -o /workdir/link_probe /workdir/link_probe.cc -static -lstdc++ -lm\n",
+		"exec -w /workdir cid123 /workdir/link_probe\n",
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("verifyLinkFlags() didn't run %q, docker was invoked with:\n%s", want, log)
+		}
+	}
+}
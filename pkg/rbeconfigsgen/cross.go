@@ -0,0 +1,182 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// CPUX8664 represents x86_64 CPUs when selecting platforms.
+	CPUX8664 = "x86_64"
+	// CPUAarch64 represents 64-bit ARM CPUs when selecting platforms.
+	CPUAarch64 = "aarch64"
+
+	// cpuConstraintPrefix & osConstraintPrefix are the packages of the CPU & OS constraint values
+	// in the generated toolchain & platform.
+	cpuConstraintPrefix = "@platforms//cpu:"
+	osConstraintPrefix  = "@platforms//os:"
+)
+
+// crossTarget describes how to generate C++ configs for a Linux target CPU.
+type crossTarget struct {
+	// triple is the GNU target triple prefixing the names of the cross compiler drivers, e.g.,
+	// "aarch64-linux-gnu" for "aarch64-linux-gnu-gcc".
+	triple string
+	// bazelCPU is the value of BAZEL_TARGET_CPU, i.e., the --cpu Bazel uses for the target.
+	bazelCPU string
+	// system is the value of BAZEL_TARGET_SYSTEM.
+	system string
+}
+
+var (
+	// validCPUs are the CPU architectures accepted for ExecCPU & TargetCPU.
+	validCPUs = []string{CPUX8664, CPUAarch64}
+
+	// crossTargets maps the target CPU architectures to how C++ configs are generated for them
+	// when cross-compiling.
+	crossTargets = map[string]crossTarget{
+		CPUX8664: {
+			triple:   "x86_64-linux-gnu",
+			bazelCPU: "k8",
+			system:   "x86_64-unknown-linux-gnu",
+		},
+		CPUAarch64: {
+			triple:   "aarch64-linux-gnu",
+			bazelCPU: "aarch64",
+			system:   "aarch64-unknown-linux-gnu",
+		},
+	}
+
+	// builtinSysrootRegexp matches the builtin_sysroot attribute of the cc_toolchain_config rule in
+	// the C++ configs BUILD file generated by Bazel.
+	builtinSysrootRegexp = regexp.MustCompile(`builtin_sysroot\s*=\s*"[^"]*"`)
+)
+
+// isCrossCompiling returns whether the given options generate configs for a target CPU different
+// from the CPU of the toolchain container.
+func isCrossCompiling(o *Options) bool {
+	return o.TargetCPU != o.ExecCPU
+}
+
+// replaceConstraints returns a copy of the given constraints with every constraint value in the
+// constraint setting with the given prefix, e.g., "@platforms//cpu:", replaced by the value with
+// the given name.
+func replaceConstraints(constraints []string, prefix, name string) []string {
+	var result []string
+	for _, c := range constraints {
+		if strings.HasPrefix(c, prefix) {
+			c = prefix + name
+		}
+		result = append(result, c)
+	}
+	return result
+}
+
+// applyPlatformCPUs sets the OS & CPU constraints of the given platform params to the exec &
+// target platforms in the given options. The exec constraints, which are also used for the
+// generated platform, get the ExecCPU while the target constraints of the C++ toolchain get the
+// TargetOS & TargetCPU.
+func applyPlatformCPUs(o *Options) {
+	p := o.PlatformParams
+	p.ExecConstraints = replaceConstraints(p.ExecConstraints, cpuConstraintPrefix, o.ExecCPU)
+	p.TargetConstraints = replaceConstraints(p.TargetConstraints, cpuConstraintPrefix, o.TargetCPU)
+	p.TargetConstraints = replaceConstraints(p.TargetConstraints, osConstraintPrefix, o.TargetOS)
+}
+
+// crossCppEnv returns the C++ config generation environment variables overridden to make Bazel
+// generate a C++ toolchain for the TargetCPU in the given options.
+func crossCppEnv(o *Options) map[string]string {
+	t := crossTargets[o.TargetCPU]
+	return map[string]string{
+		"ABI_VERSION":         "gcc",
+		"BAZEL_COMPILER":      "gcc",
+		"BAZEL_TARGET_CPU":    t.bazelCPU,
+		"BAZEL_TARGET_SYSTEM": t.system,
+	}
+}
+
+// setEnv returns the given environment of "key=value" strings with every assignment to the given
+// key replaced by a single assignment of the given value.
+func setEnv(env []string, key, value string) []string {
+	var result []string
+	for _, e := range env {
+		if !strings.HasPrefix(e, key+"=") {
+			result = append(result, e)
+		}
+	}
+	return append(result, key+"="+value)
+}
+
+// applyCrossCppEnv overrides the variables returned by crossCppEnv in the given C++ config
+// generation environment if the given options cross-compile.
+func applyCrossCppEnv(o *Options, env []string) []string {
+	if !isCrossCompiling(o) {
+		return env
+	}
+	overrides := crossCppEnv(o)
+	var keys []string
+	for k := range overrides {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		env = setEnv(env, k, overrides[k])
+	}
+	return env
+}
+
+// detectCrossCompiler locates the GCC cross compiler for the TargetCPU in the given options in the
+// running toolchain container, e.g., "aarch64-linux-gnu-gcc", & records it along with its sysroot
+// in the given facts. The sysroot is the TargetSysroot in the given options or otherwise what the
+// cross compiler reports with -print-sysroot.
+func detectCrossCompiler(d *dockerRunner, o *Options, f *detectionFacts) error {
+	name := crossTargets[o.TargetCPU].triple + "-gcc"
+	found, err := findCppCompilers(d, []string{name})
+	if err != nil {
+		return err
+	}
+	c, err := selectCppCompiler(found, name)
+	if err != nil {
+		return fmt.Errorf("unable to find the cross compiler for TargetCPU %q: %w", o.TargetCPU, err)
+	}
+	f.CppCompiler, f.CppCompilerPath, f.CppCompilerVersion = c.name, c.path, c.version
+	o.log.Infof("C++ cross compiler for %s: %s.", o.TargetCPU, c)
+	f.CppSysroot = o.TargetSysroot
+	if len(f.CppSysroot) == 0 {
+		out, err := d.execCmd(c.path, "-print-sysroot")
+		if err != nil {
+			d.warnf(WarningUnknownSysroot, "Unable to determine the sysroot of C++ cross compiler %q, Bazel's default will be used: %v", c.path, err)
+			return nil
+		}
+		f.CppSysroot = strings.TrimSpace(out)
+	}
+	if len(f.CppSysroot) != 0 {
+		o.log.Infof("C++ cross compiler sysroot: %q.", f.CppSysroot)
+	}
+	return nil
+}
+
+// rewriteBuiltinSysroot sets the builtin_sysroot attribute of the cc_toolchain_config rules in the
+// given contents of a C++ configs BUILD file to the given sysroot.
+func rewriteBuiltinSysroot(build []byte, sysroot string) ([]byte, error) {
+	if !builtinSysrootRegexp.Match(build) {
+		return nil, fmt.Errorf("the C++ configs %s file doesn't set builtin_sysroot", cppBuildFile)
+	}
+	return builtinSysrootRegexp.ReplaceAllLiteral(build, []byte(fmt.Sprintf("builtin_sysroot = %q", sysroot))), nil
+}
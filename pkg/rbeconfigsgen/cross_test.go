@@ -0,0 +1,116 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestApplyPlatformCPUs(t *testing.T) {
+	tests := []struct {
+		name       string
+		execCPU    string
+		targetCPU  string
+		wantExec   []string
+		wantTarget []string
+	}{
+		{
+			name:       "Same CPU",
+			execCPU:    CPUX8664,
+			targetCPU:  CPUX8664,
+			wantExec:   []string{"@platforms//os:linux", "@platforms//cpu:x86_64", "@bazel_tools//tools/cpp:clang"},
+			wantTarget: []string{"@platforms//os:linux", "@platforms//cpu:x86_64"},
+		},
+		{
+			name:       "Cross-compile to aarch64",
+			execCPU:    CPUX8664,
+			targetCPU:  CPUAarch64,
+			wantExec:   []string{"@platforms//os:linux", "@platforms//cpu:x86_64", "@bazel_tools//tools/cpp:clang"},
+			wantTarget: []string{"@platforms//os:linux", "@platforms//cpu:aarch64"},
+		},
+		{
+			name:       "aarch64 exec",
+			execCPU:    CPUAarch64,
+			targetCPU:  CPUAarch64,
+			wantExec:   []string{"@platforms//os:linux", "@platforms//cpu:aarch64", "@bazel_tools//tools/cpp:clang"},
+			wantTarget: []string{"@platforms//os:linux", "@platforms//cpu:aarch64"},
+		},
+	}
+	// The parallel subtests only finish once the group they're run in returns.
+	t.Run("group", func(t *testing.T) {
+		for _, tc := range tests {
+			tc := tc
+			t.Run(tc.name, func(t *testing.T) {
+				t.Parallel()
+				o := &Options{ExecCPU: tc.execCPU, TargetCPU: tc.targetCPU, TargetOS: OSLinux}
+				if err := o.ApplyDefaults(OSLinux); err != nil {
+					t.Fatalf("ApplyDefaults(%q) failed: %v", OSLinux, err)
+				}
+				applyPlatformCPUs(o)
+				if !reflect.DeepEqual(o.PlatformParams.ExecConstraints, tc.wantExec) {
+					t.Errorf("applyPlatformCPUs() set exec constraints %v, want %v", o.PlatformParams.ExecConstraints, tc.wantExec)
+				}
+				if !reflect.DeepEqual(o.PlatformParams.TargetConstraints, tc.wantTarget) {
+					t.Errorf("applyPlatformCPUs() set target constraints %v, want %v", o.PlatformParams.TargetConstraints, tc.wantTarget)
+				}
+			})
+		}
+	})
+	// The defaults shared by all options must not be modified.
+	p := DefaultExecOptions[OSLinux].PlatformParams
+	if got := p.ExecConstraints; got[1] != "@platforms//cpu:x86_64" {
+		t.Errorf("applyPlatformCPUs() modified the default exec constraints to %v", got)
+	}
+	if got := p.TargetConstraints; got[1] != "@platforms//cpu:x86_64" {
+		t.Errorf("applyPlatformCPUs() modified the default target constraints to %v", got)
+	}
+}
+
+func TestApplyCrossCppEnv(t *testing.T) {
+	env := []string{"CC=clang", "BAZEL_TARGET_CPU=k8", "BAZEL_TARGET_SYSTEM=x86_64-unknown-linux-gnu", "FOO=bar"}
+	if got := applyCrossCppEnv(&Options{ExecCPU: CPUX8664, TargetCPU: CPUX8664}, env); !reflect.DeepEqual(got, env) {
+		t.Errorf("applyCrossCppEnv() without cross-compiling=%v, want %v", got, env)
+	}
+	got := applyCrossCppEnv(&Options{ExecCPU: CPUX8664, TargetCPU: CPUAarch64}, env)
+	sort.Strings(got)
+	want := []string{
+		"ABI_VERSION=gcc",
+		"BAZEL_COMPILER=gcc",
+		"BAZEL_TARGET_CPU=aarch64",
+		"BAZEL_TARGET_SYSTEM=aarch64-unknown-linux-gnu",
+		"CC=clang",
+		"FOO=bar",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("applyCrossCppEnv()=%v, want %v", got, want)
+	}
+}
+
+func TestRewriteBuiltinSysroot(t *testing.T) {
+	build := "cc_toolchain_config(\n    name = \"local\",\n    builtin_sysroot = \"\",\n)\n"
+	got, err := rewriteBuiltinSysroot([]byte(build), "/usr/aarch64-linux-gnu")
+	if err != nil {
+		t.Fatalf("rewriteBuiltinSysroot() failed: %v", err)
+	}
+	if want := `builtin_sysroot = "/usr/aarch64-linux-gnu"`; !strings.Contains(string(got), want) {
+		t.Errorf("rewriteBuiltinSysroot() returned:\n%s\nwant it to contain %s", got, want)
+	}
+	if _, err := rewriteBuiltinSysroot([]byte(testCppBuild), "/sysroot"); err == nil {
+		t.Errorf("rewriteBuiltinSysroot() succeeded for a BUILD file without builtin_sysroot, want error")
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ConfigSet is a set of generated configs to be compared by Diff. Either the manifest or the files
+// may be unset in which case they're not compared.
+type ConfigSet struct {
+	// Manifest is the manifest generated along with the configs.
+	Manifest *Manifest
+	// Files maps the path of every file in the configs tarball to the hex encoded sha256 digest of
+	// its contents.
+	Files map[string]string
+}
+
+// LoadConfigSet loads the config set represented by the manifest & configs tarball at the given
+// paths. Either path may be blank to skip loading it.
+func LoadConfigSet(manifestPath, tarballPath string) (*ConfigSet, error) {
+	var m *Manifest
+	if len(manifestPath) != 0 {
+		var err error
+		if m, err = ManifestFromJSONFile(manifestPath); err != nil {
+			return nil, err
+		}
+	}
+	return NewConfigSet(m, tarballPath)
+}
+
+// NewConfigSet returns the config set represented by the given manifest, e.g., one downloaded from
+// where the configs were published, & the configs tarball at the given path. The manifest may be
+// nil & the path may be blank to skip loading the tarball.
+func NewConfigSet(m *Manifest, tarballPath string) (*ConfigSet, error) {
+	c := &ConfigSet{Manifest: m}
+	if len(tarballPath) != 0 {
+		prefix := ""
+		if c.Manifest != nil {
+			prefix = c.Manifest.TarballPrefix
+		}
+		f, err := tarballFileDigests(tarballPath, prefix)
+		if err != nil {
+			return nil, err
+		}
+		c.Files = f
+	}
+	return c, nil
+}
+
+// tarballFileDigests returns a map from the path of every regular file in the tarball at the given
+// path relative to the given prefix directory to the hex encoded sha256 digest of its contents.
+// The prefix is the tarball prefix recorded in the manifest so that configs packed under different
+// prefixes can be compared.
+func tarballFileDigests(tarPath, prefix string) (map[string]string, error) {
+	result := make(map[string]string)
+	if err := walkTarball(tarPath, prefix, func(name string, r io.Reader) error {
+		d := sha256.New()
+		if _, err := io.Copy(d, r); err != nil {
+			return fmt.Errorf("error while hashing %q in configs tarball %q: %w", name, tarPath, err)
+		}
+		result[name] = hex.EncodeToString(d.Sum(nil))
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// dirFileDigests returns a map from the path of every regular file under the given directory
+// relative to the directory to the hex encoded sha256 digest of its contents, i.e., the same
+// paths as tarballFileDigests for configs copied to a directory instead of packed in a tarball.
+func dirFileDigests(dir string) (map[string]string, error) {
+	result := make(map[string]string)
+	if err := filepath.WalkDir(dir, func(p string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !e.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		d, err := digestFile(p)
+		if err != nil {
+			return err
+		}
+		result[filepath.ToSlash(rel)] = d
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("unable to hash the configs in directory %q: %w", dir, err)
+	}
+	return result, nil
+}
+
+// walkTarball calls the given function with the path relative to the given prefix directory &
+// the contents of every regular file in the tarball at the given path.
+func walkTarball(tarPath, prefix string, f func(name string, r io.Reader) error) error {
+	in, err := os.Open(tarPath)
+	if err != nil {
+		return fmt.Errorf("unable to open configs tarball %q for reading: %w", tarPath, err)
+	}
+	defer in.Close()
+	r, err := newTarballDecompressor(in)
+	if err != nil {
+		return fmt.Errorf("unable to read configs tarball %q: %w", tarPath, err)
+	}
+	defer r.Close()
+	t := tar.NewReader(r)
+	for {
+		h, err := t.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error while reading configs tarball %q: %w", tarPath, err)
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(h.Name)
+		if len(prefix) != 0 {
+			name = strings.TrimPrefix(name, prefix+"/")
+		}
+		if err := f(name, t); err != nil {
+			return err
+		}
+	}
+}
+
+// FieldChange is a manifest field whose value differs between two config sets.
+type FieldChange struct {
+	Name string `json:"name"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+// ConfigsDiff are the differences between two config sets.
+type ConfigsDiff struct {
+	// ChangedFields are the manifest fields whose values changed, e.g., the Bazel version, the
+	// toolchain image digest or the JDK version.
+	ChangedFields []FieldChange `json:"changed_fields,omitempty"`
+	// AddedFiles are the files only in the new configs.
+	AddedFiles []string `json:"added_files,omitempty"`
+	// RemovedFiles are the files only in the old configs.
+	RemovedFiles []string `json:"removed_files,omitempty"`
+	// ModifiedFiles are the files in both configs whose contents changed.
+	ModifiedFiles []string `json:"modified_files,omitempty"`
+}
+
+// manifestFields are the names & accessors of the manifest fields compared by Diff.
+var manifestFields = []struct {
+	name string
+	get  func(m *Manifest) string
+}{
+	{"bazel_version", func(m *Manifest) string { return m.BazelVersion }},
+	{"min_bazel_version", func(m *Manifest) string { return m.MinBazelVersion }},
+	{"max_bazel_version", func(m *Manifest) string { return m.MaxBazelVersion }},
+	{"toolchain_container", func(m *Manifest) string { return m.ToolchainContainer }},
+	{"image_digest", func(m *Manifest) string { return m.ImageDigest }},
+	{"image_id", func(m *Manifest) string { return m.ImageID }},
+	{"apptainer_image", func(m *Manifest) string { return m.ApptainerImage }},
+	{"platform_image", func(m *Manifest) string { return m.PlatformImage }},
+	{"exec_os", func(m *Manifest) string { return m.ExecOS }},
+	{"exec_cpu", func(m *Manifest) string { return m.ExecCPU }},
+	{"image_arch", func(m *Manifest) string { return m.ImageArch }},
+	{"rustc_version", func(m *Manifest) string { return m.RustcVersion }},
+	{"rust_host_triple", func(m *Manifest) string { return m.RustHostTriple }},
+	{"rust_sysroot", func(m *Manifest) string { return m.RustSysroot }},
+	{"cargo_version", func(m *Manifest) string { return m.CargoVersion }},
+	{"only", func(m *Manifest) string { return m.Only }},
+	{"generator_version", func(m *Manifest) string { return m.GeneratorVersion }},
+	{"recommended_cpu", func(m *Manifest) string { return m.RecommendedCPU }},
+	{"recommended_memory", func(m *Manifest) string { return m.RecommendedMemory }},
+	{"target_os", func(m *Manifest) string { return m.TargetOS }},
+	{"target_cpu", func(m *Manifest) string { return m.TargetCPU }},
+	{"repo_name", func(m *Manifest) string { return m.RepoName }},
+	{"platform_name", func(m *Manifest) string { return m.PlatformName }},
+	{"java_version", func(m *Manifest) string { return m.JavaVersion }},
+	{"java_compat", func(m *Manifest) string { return m.JavaCompat }},
+	{"tarball_prefix", func(m *Manifest) string { return m.TarballPrefix }},
+	{"tarball_format", func(m *Manifest) string { return m.TarballFormat }},
+	{"os_id", func(m *Manifest) string { return m.OSID }},
+	{"os_version_id", func(m *Manifest) string { return m.OSVersionID }},
+	{"cpp_compiler", func(m *Manifest) string { return m.CppCompiler }},
+	{"cpp_compiler_version", func(m *Manifest) string { return m.CppCompilerVersion }},
+	{"linker_version", func(m *Manifest) string { return m.LinkerVersion }},
+	{"cpp_stdlib", func(m *Manifest) string { return m.CppStdlib }},
+	{"cpp_sysroot", func(m *Manifest) string { return m.CppSysroot }},
+	{"configs_tarball_digest", func(m *Manifest) string { return m.ConfigsTarballDigest }},
+	{"configs_dir_digest", func(m *Manifest) string { return m.ConfigsDirDigest }},
+}
+
+// Diff returns the differences between the given old & new config sets. Manifests are only
+// compared if both config sets have one & likewise for the files in the configs tarballs.
+func Diff(o, n *ConfigSet) *ConfigsDiff {
+	d := &ConfigsDiff{}
+	if o.Manifest != nil && n.Manifest != nil {
+		for _, f := range manifestFields {
+			if ov, nv := f.get(o.Manifest), f.get(n.Manifest); ov != nv {
+				d.ChangedFields = append(d.ChangedFields, FieldChange{Name: f.name, Old: ov, New: nv})
+			}
+		}
+	}
+	if o.Files != nil && n.Files != nil {
+		for f, od := range o.Files {
+			nd, ok := n.Files[f]
+			switch {
+			case !ok:
+				d.RemovedFiles = append(d.RemovedFiles, f)
+			case od != nd:
+				d.ModifiedFiles = append(d.ModifiedFiles, f)
+			}
+		}
+		for f := range n.Files {
+			if _, ok := o.Files[f]; !ok {
+				d.AddedFiles = append(d.AddedFiles, f)
+			}
+		}
+		sort.Strings(d.AddedFiles)
+		sort.Strings(d.RemovedFiles)
+		sort.Strings(d.ModifiedFiles)
+	}
+	return d
+}
+
+// Empty returns whether no differences were found.
+func (d *ConfigsDiff) Empty() bool {
+	return len(d.ChangedFields) == 0 && len(d.AddedFiles) == 0 && len(d.RemovedFiles) == 0 && len(d.ModifiedFiles) == 0
+}
+
+// String returns a human readable report of the differences.
+func (d *ConfigsDiff) String() string {
+	if d.Empty() {
+		return "No differences found.\n"
+	}
+	var b strings.Builder
+	for _, f := range d.ChangedFields {
+		fmt.Fprintf(&b, "~ %s: %q -> %q\n", f.Name, f.Old, f.New)
+	}
+	for _, f := range d.AddedFiles {
+		fmt.Fprintf(&b, "+ %s\n", f)
+	}
+	for _, f := range d.RemovedFiles {
+		fmt.Fprintf(&b, "- %s\n", f)
+	}
+	for _, f := range d.ModifiedFiles {
+		fmt.Fprintf(&b, "M %s\n", f)
+	}
+	return b.String()
+}
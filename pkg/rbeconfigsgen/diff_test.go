@@ -0,0 +1,254 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"archive/tar"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeTestTarball writes a tarball with the given files to a temporary directory & returns its
+// path.
+func writeTestTarball(t *testing.T, files map[string]string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "configs.tar")
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatalf("Unable to create tarball: %v", err)
+	}
+	defer f.Close()
+	w := tar.NewWriter(f)
+	for name, contents := range files {
+		if err := w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatalf("Unable to write tar header for %q: %v", name, err)
+		}
+		if _, err := w.Write([]byte(contents)); err != nil {
+			t.Fatalf("Unable to write %q to tarball: %v", name, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Unable to finish writing tarball: %v", err)
+	}
+	return p
+}
+
+func TestDiff(t *testing.T) {
+	oldTar := writeTestTarball(t, map[string]string{
+		"LICENSE":    "license",
+		"cc/BUILD":   "old cc",
+		"java/BUILD": "java",
+		"cc/removed": "removed",
+	})
+	newTar := writeTestTarball(t, map[string]string{
+		"LICENSE":    "license",
+		"cc/BUILD":   "new cc",
+		"java/BUILD": "java",
+		"cc/added":   "added",
+	})
+	o, err := LoadConfigSet("", oldTar)
+	if err != nil {
+		t.Fatalf("LoadConfigSet(%q) failed: %v", oldTar, err)
+	}
+	n, err := LoadConfigSet("", newTar)
+	if err != nil {
+		t.Fatalf("LoadConfigSet(%q) failed: %v", newTar, err)
+	}
+	o.Manifest = &Manifest{BazelVersion: "6.4.0", ImageDigest: "aaaa", JavaVersion: "11.0.2"}
+	n.Manifest = &Manifest{BazelVersion: "7.0.0", ImageDigest: "aaaa", JavaVersion: "17.0.1"}
+
+	got := Diff(o, n)
+	want := &ConfigsDiff{
+		ChangedFields: []FieldChange{
+			{Name: "bazel_version", Old: "6.4.0", New: "7.0.0"},
+			{Name: "java_version", Old: "11.0.2", New: "17.0.1"},
+		},
+		AddedFiles:    []string{"cc/added"},
+		RemovedFiles:  []string{"cc/removed"},
+		ModifiedFiles: []string{"cc/BUILD"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Diff() = %+v, want %+v", got, want)
+	}
+	if d := Diff(o, o); !d.Empty() {
+		t.Errorf("Diff() of a config set with itself = %+v, want no differences", d)
+	}
+}
+
+func TestNewConfigSet(t *testing.T) {
+	tarball := writeTestTarball(t, map[string]string{
+		"configs/LICENSE":  "license",
+		"configs/cc/BUILD": "cc",
+	})
+	m := &Manifest{BazelVersion: "6.4.0", TarballPrefix: "configs"}
+	got, err := NewConfigSet(m, tarball)
+	if err != nil {
+		t.Fatalf("NewConfigSet(%q) failed: %v", tarball, err)
+	}
+	if got.Manifest != m {
+		t.Errorf("NewConfigSet() returned manifest %+v, want %+v", got.Manifest, m)
+	}
+	var files []string
+	for f := range got.Files {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	if want := []string{"LICENSE", "cc/BUILD"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("NewConfigSet() returned files %v, want %v relative to the tarball prefix", files, want)
+	}
+}
+
+// writeTestDir writes the given files to a temporary directory & returns its path.
+func writeTestDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, contents := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+			t.Fatalf("Unable to create directory for %q: %v", name, err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatalf("Unable to write %q: %v", name, err)
+		}
+	}
+	return dir
+}
+
+func TestValidateConfigsDir(t *testing.T) {
+	generated := map[string]string{
+		"LICENSE":    "license",
+		"cc/BUILD":   "cc",
+		"java/BUILD": "java",
+	}
+	tests := []struct {
+		name      string
+		committed map[string]string
+		// wantLines are the lines listing the differing files expected in the error. The configs
+		// are expected to match if empty.
+		wantLines []string
+	}{
+		{
+			name:      "Match",
+			committed: generated,
+		},
+		{
+			name: "Differing files",
+			committed: map[string]string{
+				"LICENSE":        "license",
+				"cc/BUILD":       "stale",
+				"cc/removed.bzl": "removed",
+			},
+			wantLines: []string{"+ java/BUILD", "- cc/removed.bzl", "M cc/BUILD"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			o := &Options{
+				ValidateOnly:     writeTestDir(t, tc.committed),
+				OutputSourceRoot: writeTestDir(t, generated),
+			}
+			err := validateConfigsDir(o)
+			if len(tc.wantLines) == 0 {
+				if err != nil {
+					t.Fatalf("validateConfigsDir() failed: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrConfigsMismatch) {
+				t.Fatalf("validateConfigsDir() returned error %v, want one matching ErrConfigsMismatch", err)
+			}
+			for _, l := range tc.wantLines {
+				if !strings.Contains(err.Error(), "\n"+l) {
+					t.Errorf("validateConfigsDir() returned error %q, want it to list %q", err, l)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateCommittedConfigs(t *testing.T) {
+	srcRoot := t.TempDir()
+	const configPath = "configs/rbe"
+	f := &detectionFacts{
+		CppConfigsTarball: writeTestTarball(t, map[string]string{"BUILD": "cc"}),
+		JavaHome:          "/usr/lib/jvm/java-17",
+		JavaVersion:       "17.0.2",
+	}
+	newOptions := func(outputSourceRoot, outputConfigPath, validateOnly string) *Options {
+		o := &Options{
+			BazelVersion:     "7.0.0",
+			ExecOS:           OSLinux,
+			GenCPPConfigs:    true,
+			GenJavaConfigs:   true,
+			OutputSourceRoot: outputSourceRoot,
+			OutputConfigPath: outputConfigPath,
+			ValidateOnly:     validateOnly,
+			TempWorkDir:      t.TempDir(),
+		}
+		if err := o.ApplyDefaults(o.ExecOS); err != nil {
+			t.Fatalf("ApplyDefaults() failed: %v", err)
+		}
+		return o
+	}
+	// generate generates the configs like config generation does once the facts were detected.
+	generate := func(o *Options) *Options {
+		oc, err := genOutputConfigs(o, o, f)
+		if err != nil {
+			t.Fatalf("genOutputConfigs() failed: %v", err)
+		}
+		ao := assembleOptions(o)
+		if _, err := assembleConfigs(ao, oc); err != nil {
+			t.Fatalf("assembleConfigs() failed: %v", err)
+		}
+		return ao
+	}
+
+	// Commit the configs to the source repository at the config path.
+	generate(newOptions(srcRoot, configPath, ""))
+	committed := filepath.Join(srcRoot, configPath)
+	blob, err := ioutil.ReadFile(filepath.Join(committed, "config", "BUILD"))
+	if err != nil {
+		t.Fatalf("Unable to read the committed configs: %v", err)
+	}
+	if want := "//" + configPath + "/cc:"; !strings.Contains(string(blob), want) {
+		t.Fatalf("Committed configs don't reference the C++ configs with %q:\n%s", want, blob)
+	}
+	before, err := dirFileDigests(srcRoot)
+	if err != nil {
+		t.Fatalf("dirFileDigests() failed: %v", err)
+	}
+
+	if err := validateConfigsDir(generate(newOptions(srcRoot, configPath, committed))); err != nil {
+		t.Errorf("validateConfigsDir() of the committed configs failed: %v", err)
+	}
+	after, err := dirFileDigests(srcRoot)
+	if err != nil {
+		t.Fatalf("dirFileDigests() failed: %v", err)
+	}
+	if d := Diff(&ConfigSet{Files: before}, &ConfigSet{Files: after}); !d.Empty() {
+		t.Errorf("Validating the committed configs modified the source repository:\n%s", d)
+	}
+
+	// The labels in the configs generated without the config path don't match.
+	if err := validateConfigsDir(generate(newOptions("", "", committed))); !errors.Is(err, ErrConfigsMismatch) {
+		t.Errorf("validateConfigsDir() without the config path returned %v, want an error matching ErrConfigsMismatch", err)
+	}
+}
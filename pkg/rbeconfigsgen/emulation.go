@@ -0,0 +1,107 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bazelbuild/bazel-toolchains/pkg/logging"
+)
+
+// dockerArchCPUs maps the architectures docker reports for images & the docker server to the CPU
+// architectures used when selecting platforms.
+var dockerArchCPUs = map[string]string{
+	"amd64": CPUX8664,
+	"arm64": CPUAarch64,
+}
+
+// cpuDockerArch returns the architecture docker reports for images of the given CPU architecture
+// used when selecting platforms, e.g., "arm64" for CPUAarch64.
+func cpuDockerArch(cpu string) (string, error) {
+	for arch, c := range dockerArchCPUs {
+		if c == cpu {
+			return arch, nil
+		}
+	}
+	return "", fmt.Errorf("unknown CPU architecture %q", cpu)
+}
+
+// imageArch returns the CPU architecture of the resolved toolchain image as reported by docker,
+// e.g., "amd64" or "arm64".
+func (d *dockerRunner) imageArch() (string, error) {
+	o, err := runCmd(d.ctx, d.log, d.dockerPath, "inspect", "--type=image", "--format={{.Architecture}}", d.resolvedImage)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect the architecture of toolchain image %q: %w", d.resolvedImage, err)
+	}
+	return strings.TrimSpace(o), nil
+}
+
+// serverArch returns the CPU architecture of the host the docker server runs containers on as
+// reported by docker, e.g., "amd64" or "arm64".
+func (d *dockerRunner) serverArch() (string, error) {
+	o, err := runCmd(d.ctx, d.log, d.dockerPath, "version", "--format={{.Server.Arch}}")
+	if err != nil {
+		return "", fmt.Errorf("failed to determine the architecture of the docker server: %w", err)
+	}
+	return strings.TrimSpace(o), nil
+}
+
+// checkEmulation returns an error if the toolchain image with the given architecture would run
+// under emulation on a docker server with the given architecture unless allowEmulation is true in
+// which case a warning is logged instead. Detection under emulation, e.g., QEMU, is slow & can
+// detect the wrong toolchain details.
+func checkEmulation(log *logging.Logger, imageArch, serverArch string, allowEmulation bool) error {
+	if len(imageArch) == 0 || len(serverArch) == 0 || imageArch == serverArch {
+		return nil
+	}
+	if !allowEmulation {
+		return fmt.Errorf("toolchain image for %s would run under emulation on this %s docker host which is slow & can detect the wrong toolchain details, run rbe_configs_gen on a %s host or specify AllowEmulation to generate configs under emulation anyway", imageArch, serverArch, imageArch)
+	}
+	log.Warningf("Toolchain image for %s is running under emulation on this %s docker host. Detection will be slow & may detect the wrong toolchain details, verify the generated configs carefully.", imageArch, serverArch)
+	return nil
+}
+
+// verifyImageArch determines the architecture of the resolved toolchain image of the given runner
+// & verifies it doesn't run under emulation unless the given options allow it. Also warns if the
+// image architecture doesn't match ExecCPU. Returns the architecture of the image.
+func verifyImageArch(d *dockerRunner, o *Options) (string, error) {
+	if d.apptainerDir != "" {
+		// Apptainer runs images natively on the local host without a docker server.
+		return "", nil
+	}
+	arch, err := d.imageArch()
+	if err != nil {
+		return "", err
+	}
+	server, err := d.serverArch()
+	if err != nil {
+		return "", err
+	}
+	o.log.Debugf("Toolchain image %q has architecture %q & the docker server has architecture %q.", d.resolvedImage, arch, server)
+	if err := checkEmulation(o.log, arch, server, o.AllowEmulation); err != nil {
+		return "", err
+	}
+	warnImageArchMismatch(d, o, arch)
+	return arch, nil
+}
+
+// warnImageArchMismatch warns if the given architecture of the toolchain image of the given runner
+// doesn't match ExecCPU in the given options.
+func warnImageArchMismatch(d *dockerRunner, o *Options, arch string) {
+	if cpu, ok := dockerArchCPUs[arch]; ok && cpu != o.ExecCPU {
+		d.warnf(WarningImageArchMismatch, "Toolchain image %q is built for %s but configs are generated for ExecCPU %q.", d.resolvedImage, cpu, o.ExecCPU)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestCheckEmulation(t *testing.T) {
+	tests := []struct {
+		name           string
+		imageArch      string
+		serverArch     string
+		allowEmulation bool
+		wantErr        bool
+	}{
+		{name: "Same architecture", imageArch: "amd64", serverArch: "amd64"},
+		{name: "Emulated", imageArch: "amd64", serverArch: "arm64", wantErr: true},
+		{name: "Emulation allowed", imageArch: "amd64", serverArch: "arm64", allowEmulation: true},
+		{name: "Unknown image architecture", serverArch: "arm64"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if err := checkEmulation(nil, tc.imageArch, tc.serverArch, tc.allowEmulation); (err != nil) != tc.wantErr {
+				t.Errorf("checkEmulation(%q, %q, %v) returned error %v, want error: %v", tc.imageArch, tc.serverArch, tc.allowEmulation, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyImageArch(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake docker client is a shell script")
+	}
+	dockerPath := filepath.Join(t.TempDir(), "docker")
+	// The fake docker client reports an arm64 image on an amd64 docker server.
+	script := "#!/bin/sh\nif [ \"$1\" = version ]; then echo amd64; else echo arm64; fi\n"
+	if err := ioutil.WriteFile(dockerPath, []byte(script), 0755); err != nil {
+		t.Fatalf("Unable to write fake docker client: %v", err)
+	}
+	d := &dockerRunner{dockerPath: dockerPath, resolvedImage: "gcr.io/foo/bar@sha256:aaaa", ctx: context.Background()}
+	if _, err := verifyImageArch(d, &Options{ExecCPU: CPUAarch64}); err == nil {
+		t.Errorf("verifyImageArch() succeeded for an emulated image, want error")
+	}
+	arch, err := verifyImageArch(d, &Options{ExecCPU: CPUAarch64, AllowEmulation: true})
+	if err != nil {
+		t.Fatalf("verifyImageArch() failed with AllowEmulation: %v", err)
+	}
+	if arch != "arm64" {
+		t.Errorf("verifyImageArch()=%q, want %q", arch, "arm64")
+	}
+}
+
+func TestCPUDockerArch(t *testing.T) {
+	for cpu, want := range map[string]string{CPUX8664: "amd64", CPUAarch64: "arm64"} {
+		if got, err := cpuDockerArch(cpu); err != nil || got != want {
+			t.Errorf("cpuDockerArch(%q) = (%q, %v), want %q", cpu, got, err, want)
+		}
+	}
+	if _, err := cpuDockerArch("riscv64"); err == nil {
+		t.Errorf("cpuDockerArch(%q) succeeded, want error", "riscv64")
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// shellEnv are the environment variables maintained by the shell itself which aren't forwarded
+// from the environment initialized by the entrypoint or InitCommand.
+var shellEnv = map[string]bool{
+	"_":      true,
+	"OLDPWD": true,
+	"PWD":    true,
+	"SHLVL":  true,
+}
+
+// imageEntrypoint returns the ENTRYPOINT declared by the toolchain image represented by the given
+// docker runner or nothing if it declares none.
+func imageEntrypoint(d *dockerRunner) ([]string, error) {
+	out, err := runCmd(d.ctx, d.log, d.dockerPath, "inspect", "--type=image", "--format={{json .Config.Entrypoint}}", d.resolvedImage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect the entrypoint of toolchain image %q: %w", d.resolvedImage, err)
+	}
+	var ep []string
+	if err := json.Unmarshal([]byte(strings.TrimSpace(out)), &ep); err != nil {
+		return nil, fmt.Errorf("unable to parse the entrypoint of toolchain image %q from %q: %w", d.resolvedImage, out, err)
+	}
+	return ep, nil
+}
+
+// initEnvCmd returns the command printing the environment initialized according to the given
+// options inside the toolchain container, i.e., InitCommand followed by env in the same shell or
+// the entrypoint of the image with env as its arguments. The entrypoint is expected to exec its
+// arguments once it's done like entrypoints that prepare the environment usually do.
+func initEnvCmd(d *dockerRunner, o *Options) ([]string, error) {
+	if len(o.InitCommand) != 0 {
+		return []string{"sh", "-c", o.InitCommand + " && env"}, nil
+	}
+	ep, err := imageEntrypoint(d)
+	if err != nil {
+		return nil, err
+	}
+	if len(ep) == 0 {
+		return nil, fmt.Errorf("RunEntrypoint was specified but toolchain image %q declares no ENTRYPOINT", d.resolvedImage)
+	}
+	return append(ep, "env"), nil
+}
+
+// parseEnv returns the KEY=VALUE lines in the given output of env.
+func parseEnv(out string) map[string]string {
+	env := make(map[string]string)
+	for _, l := range strings.Split(out, "\n") {
+		kv := strings.SplitN(strings.TrimRight(l, "\r"), "=", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 {
+			continue
+		}
+		env[kv[0]] = kv[1]
+	}
+	return env
+}
+
+// changedEnv returns the variables of the given initialized environment that aren't set to the
+// same value in the given base environment as KEY=VALUE sorted by key. Variables maintained by
+// the shell are ignored.
+func changedEnv(base, initialized map[string]string) []string {
+	var env []string
+	for k, v := range initialized {
+		if shellEnv[k] {
+			continue
+		}
+		if b, ok := base[k]; ok && b == v {
+			continue
+		}
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// initContainerEnv runs the entrypoint of the toolchain image or InitCommand inside the running
+// toolchain container if the given options specified either & records the environment variables
+// they set or changed so every following command in the container runs in the initialized
+// environment.
+func initContainerEnv(d *dockerRunner, o *Options) error {
+	if !o.RunEntrypoint && len(o.InitCommand) == 0 {
+		return nil
+	}
+	cmd, err := initEnvCmd(d, o)
+	if err != nil {
+		return err
+	}
+	base, err := d.execCmd("env")
+	if err != nil {
+		return fmt.Errorf("unable to determine the environment of the toolchain container: %w", err)
+	}
+	out, err := d.execCmd(cmd...)
+	if err != nil {
+		return fmt.Errorf("failed to initialize the environment of the toolchain container with %q: %w", strings.Join(cmd, " "), err)
+	}
+	d.initEnv = changedEnv(parseEnv(base), parseEnv(out))
+	by := "the entrypoint of the image"
+	if len(o.InitCommand) != 0 {
+		by = fmt.Sprintf("InitCommand %q", o.InitCommand)
+	}
+	o.log.Infof("Running commands in the toolchain container with %d environment variables initialized by %s: %s", len(d.initEnv), by, strings.Join(d.initEnv, " "))
+	return nil
+}
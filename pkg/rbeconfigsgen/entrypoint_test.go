@@ -0,0 +1,111 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestChangedEnv(t *testing.T) {
+	base := parseEnv("PATH=/usr/bin\nHOME=/root\nPWD=/\nSHLVL=1\n")
+	initialized := parseEnv("PATH=/opt/gcc/bin:/usr/bin\nHOME=/root\nPWD=/workdir\nSHLVL=2\nCPATH=/opt/gcc/include\nFLAGS=a=b\n_=/usr/bin/env\n")
+	want := []string{"CPATH=/opt/gcc/include", "FLAGS=a=b", "PATH=/opt/gcc/bin:/usr/bin"}
+	if got := changedEnv(base, initialized); !reflect.DeepEqual(got, want) {
+		t.Errorf("changedEnv()=%q, want %q", got, want)
+	}
+}
+
+func TestInitContainerEnv(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake docker client is a shell script")
+	}
+	tests := []struct {
+		name string
+		o    *Options
+		// wantCmd is the command expected to print the initialized environment.
+		wantCmd string
+	}{
+		{
+			name:    "Entrypoint",
+			o:       &Options{RunEntrypoint: true},
+			wantCmd: "exec cid123 /entrypoint.sh env",
+		},
+		{
+			name:    "Init command",
+			o:       &Options{InitCommand: ". /opt/setup.sh"},
+			wantCmd: "exec cid123 sh -c . /opt/setup.sh && env",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			dir := t.TempDir()
+			logPath := filepath.Join(dir, "docker.log")
+			dockerPath := filepath.Join(dir, "docker")
+			// The fake docker client records its arguments, reports the entrypoint of the image &
+			// prints an environment with CPATH set unless env is run directly.
+			script := fmt.Sprintf(`#!/bin/sh
+echo "$@" >> %q
+case "$1" in
+inspect) echo '["/entrypoint.sh"]' ;;
+exec)
+  if [ "$3" = env ]; then
+    echo "PATH=/usr/bin"
+  else
+    echo "PATH=/usr/bin"
+    echo "CPATH=/opt/gcc/include"
+  fi ;;
+esac
+`, logPath)
+			if err := ioutil.WriteFile(dockerPath, []byte(script), 0755); err != nil {
+				t.Fatalf("Unable to write fake docker client: %v", err)
+			}
+			d := &dockerRunner{
+				dockerPath:    dockerPath,
+				containerID:   "cid123",
+				resolvedImage: "sha256:imageid",
+				ctx:           context.Background(),
+			}
+			if err := initContainerEnv(d, tc.o); err != nil {
+				t.Fatalf("initContainerEnv() failed: %v", err)
+			}
+			if want := []string{"CPATH=/opt/gcc/include"}; !reflect.DeepEqual(d.initEnv, want) {
+				t.Errorf("initContainerEnv() initialized environment %q, want %q", d.initEnv, want)
+			}
+			if _, err := d.execCmd("gcc", "--version"); err != nil {
+				t.Fatalf("execCmd() failed: %v", err)
+			}
+			blob, err := ioutil.ReadFile(logPath)
+			if err != nil {
+				t.Fatalf("Unable to read the fake docker client log: %v", err)
+			}
+			log := string(blob)
+			if !strings.Contains(log, tc.wantCmd+"\n") {
+				t.Errorf("initContainerEnv() didn't run %q, docker was invoked with:\n%s", tc.wantCmd, log)
+			}
+			if want := "exec -e CPATH=/opt/gcc/include cid123 gcc --version\n"; !strings.Contains(log, want) {
+				t.Errorf("execCmd() didn't run in the initialized environment, docker was invoked with:\n%s\nwant %q", log, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Errors matching the failures of the config generation stages with errors.Is, e.g.,
+// errors.Is(err, ErrImagePull) is true if RunWithContext failed to pull the toolchain image.
+var (
+	// ErrImagePull matches failures of StagePull.
+	ErrImagePull = errors.New("unable to pull, load or build the toolchain image")
+	// ErrContainerStart matches failures of StageStart.
+	ErrContainerStart = errors.New("unable to start the toolchain container")
+	// ErrCppDetect matches failures of StageDetectCpp.
+	ErrCppDetect = errors.New("unable to detect the C++ toolchain")
+	// ErrJavaDetect matches failures of StageDetectJava.
+	ErrJavaDetect = errors.New("unable to detect the JDK")
+	// ErrRustDetect matches failures of StageDetectRust.
+	ErrRustDetect = errors.New("unable to detect the Rust toolchain")
+	// ErrTarball matches failures of StageTar.
+	ErrTarball = errors.New("unable to assemble the configs")
+	// ErrSimulate matches failures of StageSimulate.
+	ErrSimulate = errors.New("unable to build with the configs in the toolchain container")
+	// ErrPostHook matches failures of StagePostHook.
+	ErrPostHook = errors.New("post generation hook failed")
+	// ErrUpload matches failures of StageUpload.
+	ErrUpload = errors.New("unable to upload the configs")
+
+	// ErrConfigsMismatch matches failures because the generated configs differ from the ones in
+	// the ValidateOnly directory.
+	ErrConfigsMismatch = errors.New("the generated configs don't match the configs to validate")
+
+	// ErrWarnings matches failures because warnings were reported with WarningsAsErrors.
+	ErrWarnings = errors.New("warnings were reported while detecting the toolchains")
+
+	// ErrInvalidOptions matches errors returned by Options.Validate because of invalid options.
+	ErrInvalidOptions = errors.New("invalid options")
+	// ErrNetwork matches transient network failures outside of the stages, e.g., looking up the
+	// Bazel release when validating options.
+	ErrNetwork = errors.New("network failure")
+
+	// ErrImageNotFound matches failures of StagePull because the toolchain image doesn't exist.
+	ErrImageNotFound = errors.New("the toolchain image doesn't exist")
+	// ErrImageAccessDenied matches failures of StagePull because the registry denied access to the
+	// toolchain image, e.g., because docker isn't logged into it.
+	ErrImageAccessDenied = errors.New("access to the toolchain image was denied")
+)
+
+var (
+	// imageNotFoundRegexp matches the output of docker failing to pull an image that doesn't exist.
+	// Docker Hub reports missing repositories as "pull access denied" so this is checked first.
+	imageNotFoundRegexp = regexp.MustCompile(`(?i)(manifest unknown|name unknown|not found|no such image|repository does not exist)`)
+	// imageAccessDeniedRegexp matches the output of docker failing to pull an image because the
+	// registry denied access to it.
+	imageAccessDeniedRegexp = regexp.MustCompile(`(?i)(unauthorized|denied|authentication required|forbidden)`)
+	// invalidRunFlagsRegexp matches the output of docker rejecting the flags of a docker command.
+	invalidRunFlagsRegexp = regexp.MustCompile(`(unknown (shorthand )?flag|flag needs an argument|invalid argument|bad flag syntax)`)
+)
+
+// Exit codes of the rbe_configs_* binaries by category of failure so that callers can decide
+// whether to retry.
+const (
+	// ExitCodeFailure is the exit code of failures that don't belong to another category.
+	ExitCodeFailure = 1
+	// ExitCodeUsage is the exit code of invalid flags or options, including a toolchain image that
+	// doesn't exist or ContainerRunFlags rejected by docker. Retrying won't help.
+	ExitCodeUsage = 2
+	// ExitCodeTransient is the exit code of failures that may succeed if retried, e.g., network
+	// failures pulling the toolchain image or downloading Bazelisk. Failures pulling an image that
+	// doesn't exist or that the registry denied access to aren't transient.
+	ExitCodeTransient = 3
+	// ExitCodeDetection is the exit code of failures detecting the toolchains in the toolchain
+	// container, e.g., the C++ compiler, the JDK or rustc, including warnings reported with
+	// WarningsAsErrors.
+	ExitCodeDetection = 4
+	// ExitCodeUpload is the exit code of failures uploading the configs.
+	ExitCodeUpload = 5
+)
+
+// stageErrors maps the stages to the errors matching their failures.
+var stageErrors = map[string]error{
+	StagePull:       ErrImagePull,
+	StageStart:      ErrContainerStart,
+	StageDetectCpp:  ErrCppDetect,
+	StageDetectJava: ErrJavaDetect,
+	StageDetectRust: ErrRustDetect,
+	StageTar:        ErrTarball,
+	StageSimulate:   ErrSimulate,
+	StagePostHook:   ErrPostHook,
+	StageUpload:     ErrUpload,
+}
+
+// stageExitCodes are the exit codes of the rbe_configs_* binaries when a stage fails. Failures of
+// other stages exit with ExitCodeFailure. Deterministic failures matching ErrImageNotFound,
+// ErrImageAccessDenied or ErrInvalidOptions take precedence over the exit code of the stage.
+var stageExitCodes = map[string]int{
+	// Pulling the image & installing Bazelisk into the started container need network access.
+	StagePull:       ExitCodeTransient,
+	StageStart:      ExitCodeTransient,
+	StageDetectCpp:  ExitCodeDetection,
+	StageDetectJava: ExitCodeDetection,
+	StageDetectRust: ExitCodeDetection,
+	StageUpload:     ExitCodeUpload,
+}
+
+// StageError is the error returned when a stage of config generation fails, e.g., StagePull.
+// Use errors.As to determine the stage or errors.Is with the error of the stage, e.g.,
+// ErrImagePull. The message is that of the underlying error.
+type StageError struct {
+	// Stage is the stage that failed.
+	Stage string
+	// Err is the error the stage failed with.
+	Err error
+}
+
+func (e *StageError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the error the stage failed with.
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// Is returns whether the given error is the error matching failures of the stage.
+func (e *StageError) Is(target error) bool {
+	s, ok := stageErrors[e.Stage]
+	return ok && s == target
+}
+
+// taggedError is an error that also matches the given sentinel error with errors.Is without
+// changing the message of the underlying error.
+type taggedError struct {
+	tag error
+	err error
+}
+
+func (e *taggedError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *taggedError) Unwrap() error {
+	return e.err
+}
+
+// Is returns whether the given error is the sentinel error of this error.
+func (e *taggedError) Is(target error) bool {
+	return e.tag == target
+}
+
+// tagged returns the given error such that it also matches the given sentinel error.
+func tagged(tag, err error) error {
+	return &taggedError{tag: tag, err: err}
+}
+
+// cmdError is the error returned when a command run by runCmd fails. It keeps the combined output
+// of the command so the failure can be classified without changing the message of the error.
+type cmdError struct {
+	err    error
+	output string
+}
+
+func (e *cmdError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the error the command failed with.
+func (e *cmdError) Unwrap() error {
+	return e.err
+}
+
+// cmdOutput returns the combined output of the failed command the given error wraps if any.
+func cmdOutput(err error) string {
+	var ce *cmdError
+	if errors.As(err, &ce) {
+		return ce.output
+	}
+	return ""
+}
+
+// classifyPullError tags the given error of docker failing to pull or look up a toolchain image
+// with ErrImageNotFound or ErrImageAccessDenied if its output shows retrying won't help.
+func classifyPullError(err error) error {
+	out := cmdOutput(err)
+	switch {
+	case imageNotFoundRegexp.MatchString(out):
+		return tagged(ErrImageNotFound, err)
+	case imageAccessDeniedRegexp.MatchString(out):
+		return tagged(ErrImageAccessDenied, err)
+	}
+	return err
+}
+
+// classifyRunFlagsError tags the given error of docker failing to create a container with the
+// given ContainerRunFlags with ErrInvalidOptions if docker rejected the flags.
+func classifyRunFlagsError(err error, runFlags []string) error {
+	if len(runFlags) != 0 && invalidRunFlagsRegexp.MatchString(cmdOutput(err)) {
+		return tagged(ErrInvalidOptions, fmt.Errorf("docker rejected ContainerRunFlags: %w", err))
+	}
+	return classifyPullError(err)
+}
+
+// ExitCode returns the exit code the rbe_configs_* binaries exit with for the given error, e.g.,
+// ExitCodeTransient if the toolchain image couldn't be pulled because of a network failure,
+// ExitCodeUsage if it doesn't exist or ExitCodeDetection if a StageError for StageDetectCpp.
+func ExitCode(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidOptions), errors.Is(err, ErrImageNotFound):
+		return ExitCodeUsage
+	case errors.Is(err, ErrImageAccessDenied):
+		return ExitCodeFailure
+	}
+	var se *StageError
+	if errors.As(err, &se) {
+		if c, ok := stageExitCodes[se.Stage]; ok {
+			return c
+		}
+		return ExitCodeFailure
+	}
+	switch {
+	case errors.Is(err, ErrNetwork):
+		return ExitCodeTransient
+	case errors.Is(err, ErrWarnings):
+		return ExitCodeDetection
+	}
+	return ExitCodeFailure
+}
+
+// stepsError is the error returned when concurrent detection steps fail. It unwraps to the error
+// of the first step that failed so the stage of the step can be determined.
+type stepsError struct {
+	// total is the number of steps that were run.
+	total int
+	// names are the names of the failed steps in the order they failed.
+	names []string
+	// errs are the errors of the failed steps in the order they failed.
+	errs []error
+}
+
+func (e *stepsError) Error() string {
+	var msgs []string
+	for i, err := range e.errs {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", e.names[i], err))
+	}
+	return fmt.Sprintf("%d of %d detection steps failed: %s", len(e.errs), e.total, strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the error of the first step that failed.
+func (e *stepsError) Unwrap() error {
+	return e.errs[0]
+}
@@ -0,0 +1,202 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestStageError(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		want         error
+		wantExitCode int
+	}{
+		{
+			name:         "Pull",
+			err:          fmt.Errorf("failed to initialize a docker container: %w", &StageError{Stage: StagePull, Err: errors.New("not found")}),
+			want:         ErrImagePull,
+			wantExitCode: ExitCodeTransient,
+		},
+		{
+			name:         "Pull nonexistent image",
+			err:          &StageError{Stage: StagePull, Err: tagged(ErrImageNotFound, errors.New("manifest unknown"))},
+			want:         ErrImagePull,
+			wantExitCode: ExitCodeUsage,
+		},
+		{
+			name:         "Pull denied",
+			err:          &StageError{Stage: StagePull, Err: tagged(ErrImageAccessDenied, errors.New("unauthorized"))},
+			want:         ErrImagePull,
+			wantExitCode: ExitCodeFailure,
+		},
+		{
+			name:         "Invalid container run flags",
+			err:          &StageError{Stage: StageStart, Err: tagged(ErrInvalidOptions, errors.New("unknown flag: --foo"))},
+			want:         ErrContainerStart,
+			wantExitCode: ExitCodeUsage,
+		},
+		{
+			name: "Concurrent detection steps",
+			err: &stepsError{
+				total: 3,
+				names: []string{"Java", "C++"},
+				errs:  []error{&StageError{Stage: StageDetectJava, Err: errors.New("no JAVA_HOME")}, &StageError{Stage: StageDetectCpp, Err: errors.New("no compiler")}},
+			},
+			want:         ErrJavaDetect,
+			wantExitCode: ExitCodeDetection,
+		},
+		{
+			name:         "Upload",
+			err:          &StageError{Stage: StageUpload, Err: errors.New("permission denied")},
+			want:         ErrUpload,
+			wantExitCode: ExitCodeUpload,
+		},
+		{
+			name:         "Post hook",
+			err:          &StageError{Stage: StagePostHook, Err: errors.New("exit status 1")},
+			want:         ErrPostHook,
+			wantExitCode: ExitCodeFailure,
+		},
+		{
+			name:         "Invalid options",
+			err:          fmt.Errorf("Failed to validate command line arguments: %w", tagged(ErrInvalidOptions, errors.New("bad"))),
+			wantExitCode: ExitCodeUsage,
+		},
+		{
+			name:         "Network failure",
+			err:          tagged(ErrNetwork, errors.New("connection refused")),
+			wantExitCode: ExitCodeTransient,
+		},
+		{
+			name:         "Warnings as errors",
+			err:          warningsError(&Options{WarningsAsErrors: true}, []Warning{{Code: WarningUnknownOS, Message: "no /etc/os-release"}}),
+			want:         ErrWarnings,
+			wantExitCode: ExitCodeDetection,
+		},
+		{
+			name:         "Unknown failure",
+			err:          errors.New("boom"),
+			wantExitCode: ExitCodeFailure,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			for _, e := range stageErrors {
+				if got, want := errors.Is(tc.err, e), e == tc.want; got != want {
+					t.Errorf("errors.Is(%v, %v)=%v, want %v", tc.err, e, got, want)
+				}
+			}
+			if got := ExitCode(tc.err); got != tc.wantExitCode {
+				t.Errorf("ExitCode(%v)=%d, want %d", tc.err, got, tc.wantExitCode)
+			}
+		})
+	}
+}
+
+func TestClassifyDockerErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		runFlags []string
+		want     error
+	}{
+		{
+			name:   "Manifest unknown",
+			output: "Error response from daemon: manifest for gcr.io/foo/bar:latest not found: manifest unknown",
+			want:   ErrImageNotFound,
+		},
+		{
+			name:   "Docker Hub repository doesn't exist",
+			output: "Error response from daemon: pull access denied for foo/bar, repository does not exist or may require 'docker login'",
+			want:   ErrImageNotFound,
+		},
+		{
+			name:   "Unauthorized",
+			output: "Error response from daemon: Head \"https://gcr.io/v2/foo/bar/manifests/latest\": unauthorized: authentication failed",
+			want:   ErrImageAccessDenied,
+		},
+		{
+			name:   "Network failure",
+			output: "Error response from daemon: Get \"https://gcr.io/v2/\": net/http: TLS handshake timeout",
+		},
+		{
+			name:     "Unknown run flag",
+			output:   "unknown flag: --foo",
+			runFlags: []string{"--foo"},
+			want:     ErrInvalidOptions,
+		},
+		{
+			name:     "Invalid run flag value",
+			output:   `invalid argument "lots" for "-m, --memory" flag: invalid size: 'lots'`,
+			runFlags: []string{"--memory=lots"},
+			want:     ErrInvalidOptions,
+		},
+		{
+			name:   "Unknown flag without run flags",
+			output: "unknown flag: --platform",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			cmdErr := &cmdError{err: errors.New("exit status 1"), output: tc.output}
+			err := classifyRunFlagsError(cmdErr, tc.runFlags)
+			for _, e := range []error{ErrImageNotFound, ErrImageAccessDenied, ErrInvalidOptions} {
+				if got, want := errors.Is(err, e), e == tc.want; got != want {
+					t.Errorf("errors.Is(classifyRunFlagsError(%q), %v)=%v, want %v", tc.output, e, got, want)
+				}
+			}
+			if got, want := ExitCode(&StageError{Stage: StageStart, Err: err}) == ExitCodeTransient, tc.want == nil; got != want {
+				t.Errorf("ExitCode() of a failure with output %q is transient=%v, want %v", tc.output, got, want)
+			}
+		})
+	}
+}
+
+func TestStepsErrorMessage(t *testing.T) {
+	err := &stepsError{
+		total: 3,
+		names: []string{"Java", "C++"},
+		errs:  []error{errors.New("no JAVA_HOME"), errors.New("no compiler")},
+	}
+	if want := "2 of 3 detection steps failed: Java: no JAVA_HOME; C++: no compiler"; err.Error() != want {
+		t.Errorf("Error()=%q, want %q", err.Error(), want)
+	}
+	if !strings.Contains((&StageError{Stage: StagePull, Err: err}).Error(), err.Error()) {
+		t.Errorf("StageError didn't have the message of the underlying error")
+	}
+}
+
+func TestValidateInvalidOptions(t *testing.T) {
+	o := batchTestOptions()
+	if err := o.ApplyDefaults(o.ExecOS); err != nil {
+		t.Fatalf("ApplyDefaults() failed: %v", err)
+	}
+	err := o.Validate()
+	if !errors.Is(err, ErrInvalidOptions) || errors.Is(err, ErrNetwork) {
+		t.Errorf("Validate() without a toolchain image returned error %v, want an error matching ErrInvalidOptions", err)
+	}
+	if err := (&Options{}).ApplyDefaults("plan9"); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("ApplyDefaults() for an unknown OS returned error %v, want an error matching ErrInvalidOptions", err)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// factsDump is the JSON blob written to DumpDetectionFacts with the facts detected in the
+// toolchain container along with the platform they were detected for.
+type factsDump struct {
+	// ToolchainContainer is the toolchain image referenced by digest the facts were detected in.
+	ToolchainContainer string `json:"toolchain_container"`
+	// ExecOS & ExecCPU are the OS & CPU architecture of the toolchain container.
+	ExecOS  string `json:"exec_os"`
+	ExecCPU string `json:"exec_cpu"`
+	// TargetCPU is the CPU architecture the C++ configs were detected for.
+	TargetCPU string `json:"target_cpu"`
+	*detectionFacts
+	// CxxBuiltinIncludeDirectories are the builtin include directories of the C++ compiler
+	// detected by Bazel before any include directory options are applied.
+	CxxBuiltinIncludeDirectories []string `json:"cxx_builtin_include_directories,omitempty"`
+}
+
+// detectedCxxBuiltinIncludeDirs returns the distinct cxx_builtin_include_directories of the
+// cc_toolchain_config rules in the C++ configs tarball at the given path in the order they appear.
+func detectedCxxBuiltinIncludeDirs(tarPath string) ([]string, error) {
+	build, err := readCppBuild(tarPath)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	seen := make(map[string]bool)
+	for _, m := range cxxBuiltinIncludeDirsRegexp.FindAll(build, -1) {
+		for _, dir := range quotedStrs(cxxBuiltinIncludeDirsRegexp, m) {
+			if !seen[dir] {
+				seen[dir] = true
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	return dirs, nil
+}
+
+// newFactsDump returns the dump of the given facts detected according to the given options in the
+// toolchain image represented by the given docker runner.
+func newFactsDump(o *Options, d *dockerRunner, f *detectionFacts) (*factsDump, error) {
+	fd := &factsDump{
+		ToolchainContainer: d.resolvedImage,
+		ExecOS:             o.ExecOS,
+		ExecCPU:            o.ExecCPU,
+		TargetCPU:          o.TargetCPU,
+		detectionFacts:     f,
+	}
+	if o.GenCPPConfigs && len(f.CppConfigsTarball) != 0 {
+		dirs, err := detectedCxxBuiltinIncludeDirs(f.CppConfigsTarball)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the builtin include directories of the C++ configs generated by Bazel: %w", err)
+		}
+		fd.CxxBuiltinIncludeDirectories = dirs
+	}
+	return fd, nil
+}
+
+// dumpDetectionFacts writes the given facts detected according to the given options in the
+// toolchain image represented by the given docker runner as JSON to DumpDetectionFacts.
+func dumpDetectionFacts(o *Options, d *dockerRunner, f *detectionFacts) error {
+	fd, err := newFactsDump(o, d, f)
+	if err != nil {
+		return err
+	}
+	blob, err := json.MarshalIndent(fd, "", " ")
+	if err != nil {
+		return fmt.Errorf("unable to encode the detected facts as JSON: %w", err)
+	}
+	if err := ioutil.WriteFile(o.DumpDetectionFacts, blob, os.ModePerm); err != nil {
+		return fmt.Errorf("unable to write the detected facts to %q: %w", o.DumpDetectionFacts, err)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDumpDetectionFacts(t *testing.T) {
+	cppTar := writeTestTarball(t, map[string]string{
+		"BUILD": `cc_toolchain_config(
+    name = "local",
+    cxx_builtin_include_directories = ["/usr/local/include",
+    "/usr/include"],
+)
+
+cc_toolchain_config(
+    name = "stub_armeabi-v7a",
+    cxx_builtin_include_directories = ["/usr/include"],
+)
+`,
+	})
+	tests := []struct {
+		name string
+		opt  *Options
+		f    *detectionFacts
+		want map[string]interface{}
+	}{
+		{
+			name: "C++ & Java",
+			opt:  &Options{ExecOS: OSLinux, ExecCPU: CPUX8664, TargetCPU: CPUX8664, GenCPPConfigs: true, GenJavaConfigs: true},
+			f: &detectionFacts{
+				CppConfigsTarball:  cppTar,
+				JavaHome:           "/usr/lib/jvm/java-11",
+				JavaVersion:        "11.0.11",
+				OSID:               "ubuntu",
+				OSVersionID:        "20.04",
+				Libc:               "glibc_2.31",
+				CppCompiler:        "clang",
+				CppCompilerPath:    "/usr/local/bin/clang",
+				CppCompilerVersion: "10.0.0",
+			},
+			want: map[string]interface{}{
+				"toolchain_container":             "gcr.io/foo/bar@sha256:1234",
+				"exec_os":                         "linux",
+				"exec_cpu":                        "x86_64",
+				"target_cpu":                      "x86_64",
+				"java_home":                       "/usr/lib/jvm/java-11",
+				"java_version":                    "11.0.11",
+				"os_id":                           "ubuntu",
+				"os_version_id":                   "20.04",
+				"libc":                            "glibc_2.31",
+				"cpp_compiler":                    "clang",
+				"cpp_compiler_path":               "/usr/local/bin/clang",
+				"cpp_compiler_version":            "10.0.0",
+				"cxx_builtin_include_directories": []interface{}{"/usr/local/include", "/usr/include"},
+			},
+		}, {
+			name: "Java only",
+			opt:  &Options{ExecOS: OSLinux, ExecCPU: CPUX8664, TargetCPU: CPUX8664, GenJavaConfigs: true},
+			f: &detectionFacts{
+				JavaHome:    "/usr/lib/jvm/java-11",
+				JavaVersion: "11.0.11",
+				OSID:        "debian",
+				OSVersionID: "unknown",
+			},
+			want: map[string]interface{}{
+				"toolchain_container": "gcr.io/foo/bar@sha256:1234",
+				"exec_os":             "linux",
+				"exec_cpu":            "x86_64",
+				"target_cpu":          "x86_64",
+				"java_home":           "/usr/lib/jvm/java-11",
+				"java_version":        "11.0.11",
+				"os_id":               "debian",
+				"os_version_id":       "unknown",
+			},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			tc.opt.DumpDetectionFacts = filepath.Join(t.TempDir(), "facts.json")
+			d := &dockerRunner{resolvedImage: "gcr.io/foo/bar@sha256:1234"}
+			if err := dumpDetectionFacts(tc.opt, d, tc.f); err != nil {
+				t.Fatalf("dumpDetectionFacts() failed: %v", err)
+			}
+			blob, err := ioutil.ReadFile(tc.opt.DumpDetectionFacts)
+			if err != nil {
+				t.Fatalf("Unable to read the dumped facts: %v", err)
+			}
+			got := make(map[string]interface{})
+			if err := json.Unmarshal(blob, &got); err != nil {
+				t.Fatalf("Unable to parse the dumped facts %s: %v", blob, err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("dumpDetectionFacts() wrote %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// DefaultBuildifierPath is the buildifier binary looked up on the PATH to format the generated
+// Starlark files if FormatBuildFiles is specified without a BuildifierPath.
+const DefaultBuildifierPath = "buildifier"
+
+// buildifierType returns the --type of buildifier to format the Starlark file with the given name
+// as, i.e., "build" for BUILD files & "bzl" for .bzl files, or blank if the file isn't Starlark.
+func buildifierType(name string) string {
+	switch b := path.Base(name); {
+	case b == "BUILD" || b == "BUILD.bazel":
+		return "build"
+	case strings.HasSuffix(b, ".bzl"):
+		return "bzl"
+	}
+	return ""
+}
+
+// formatStarlark returns the given contents of the Starlark file with the given name formatted by
+// the buildifier binary at the given path. The contents of files that aren't Starlark are
+// returned unchanged.
+func formatStarlark(ctx context.Context, buildifier, name string, contents []byte) ([]byte, error) {
+	t := buildifierType(name)
+	if len(t) == 0 {
+		return contents, nil
+	}
+	// buildifier formats its stdin to stdout if no files are given.
+	c := exec.CommandContext(ctx, buildifier, "--type="+t)
+	c.Stdin = bytes.NewReader(contents)
+	var stdout, stderr bytes.Buffer
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	if err := c.Run(); err != nil {
+		return nil, fmt.Errorf("buildifier failed to format %s: %w, stderr: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// formatCppConfigsTarball writes a copy of the C++ configs tarball at 'inTarPath' to 'outTarPath'
+// with the Starlark files formatted by the buildifier binary at the given path.
+func formatCppConfigsTarball(ctx context.Context, buildifier, inTarPath, outTarPath string) error {
+	in, err := os.Open(inTarPath)
+	if err != nil {
+		return fmt.Errorf("unable to open input tarball %q for reading: %w", inTarPath, err)
+	}
+	defer in.Close()
+	out, err := os.Create(outTarPath)
+	if err != nil {
+		return fmt.Errorf("unable to open output tarball %q for writing: %w", outTarPath, err)
+	}
+	defer out.Close()
+	inTar := tar.NewReader(in)
+	outTar := tar.NewWriter(out)
+	for {
+		h, err := inTar.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error while reading input tarball %q: %w", inTarPath, err)
+		}
+		var r io.Reader = inTar
+		if h.Typeflag == tar.TypeReg && len(buildifierType(h.Name)) != 0 {
+			blob, err := ioutil.ReadAll(inTar)
+			if err != nil {
+				return fmt.Errorf("error while reading %q from input tarball %q: %w", h.Name, inTarPath, err)
+			}
+			if blob, err = formatStarlark(ctx, buildifier, h.Name, blob); err != nil {
+				return err
+			}
+			h.Size = int64(len(blob))
+			r = bytes.NewReader(blob)
+		}
+		if err := outTar.WriteHeader(h); err != nil {
+			return fmt.Errorf("error while adding tar header for %q to output tarball %q: %w", h.Name, outTarPath, err)
+		}
+		if _, err := io.Copy(outTar, r); err != nil {
+			return fmt.Errorf("failed to copy the contents of %q to the output tarball %q: %w", h.Name, outTarPath, err)
+		}
+	}
+	if err := outTar.Close(); err != nil {
+		return fmt.Errorf("error trying to finish writing the output tarball %q: %w", outTarPath, err)
+	}
+	return nil
+}
+
+// formatOutputConfigs formats the Starlark files of the given configs with buildifier if the given
+// options specified FormatBuildFiles. The C++ configs tarball is replaced by a formatted copy in
+// the temporary working directory.
+func formatOutputConfigs(ctx context.Context, o *Options, oc *outputConfigs) error {
+	if !o.FormatBuildFiles {
+		return nil
+	}
+	files := []*generatedFile{&oc.configBuild, &oc.aliasBuild, &oc.javaBuild}
+	for i := range oc.rustConfigs {
+		files = append(files, &oc.rustConfigs[i])
+	}
+	for _, g := range files {
+		if len(g.name) == 0 {
+			continue
+		}
+		blob, err := formatStarlark(ctx, o.BuildifierPath, g.name, g.contents)
+		if err != nil {
+			return err
+		}
+		g.contents = blob
+	}
+	if len(oc.cppConfigsTarball) != 0 {
+		p := path.Join(o.TempWorkDir, "cpp_configs_formatted.tar")
+		if err := formatCppConfigsTarball(ctx, o.BuildifierPath, oc.cppConfigsTarball, p); err != nil {
+			return fmt.Errorf("unable to format the C++ configs: %w", err)
+		}
+		oc.cppConfigsTarball = p
+	}
+	o.log.Infof("Formatted the generated BUILD & .bzl files with %s.", o.BuildifierPath)
+	return nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestBuildifierType(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "cc/BUILD", want: "build"},
+		{name: "BUILD.bazel", want: "build"},
+		{name: "rust/toolchain.bzl", want: "bzl"},
+		{name: "WORKSPACE", want: ""},
+		{name: "LICENSE", want: ""},
+		{name: "cc/armeabi_cc_toolchain_config.bzl", want: "bzl"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if got := buildifierType(tc.name); got != tc.want {
+				t.Errorf("buildifierType(%q)=%q, want %q", tc.name, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFormatOutputConfigs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake buildifier is a shell script")
+	}
+	dir := t.TempDir()
+	buildifier := filepath.Join(dir, "buildifier")
+	// The fake buildifier prefixes its stdin with the type it was asked to format it as.
+	script := "#!/bin/sh\necho \"# $1\"\ncat\n"
+	if err := ioutil.WriteFile(buildifier, []byte(script), 0755); err != nil {
+		t.Fatalf("Unable to write fake buildifier: %v", err)
+	}
+	cppTarball := filepath.Join(dir, "cpp_configs.tar")
+	f, err := os.Create(cppTarball)
+	if err != nil {
+		t.Fatalf("Unable to create C++ configs tarball: %v", err)
+	}
+	tw := tar.NewWriter(f)
+	for name, contents := range map[string]string{"BUILD": "cc_toolchain_suite()", "WORKSPACE": "workspace()"} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))}); err != nil {
+			t.Fatalf("Unable to write tar header for %q: %v", name, err)
+		}
+		if _, err := tw.Write([]byte(contents)); err != nil {
+			t.Fatalf("Unable to write %q to the tarball: %v", name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Unable to finish writing the C++ configs tarball: %v", err)
+	}
+	f.Close()
+
+	o := &Options{FormatBuildFiles: true, BuildifierPath: buildifier, TempWorkDir: dir}
+	oc := outputConfigs{
+		license:           generatedFile{name: "LICENSE", contents: []byte("license")},
+		cppConfigsTarball: cppTarball,
+		configBuild:       generatedFile{name: "config/BUILD", contents: []byte("platform()\n")},
+		rustConfigs:       []generatedFile{{name: "rust/toolchain.bzl", contents: []byte("RUSTC_VERSION = \"1.75.0\"\n")}},
+	}
+	if err := formatOutputConfigs(context.Background(), o, &oc); err != nil {
+		t.Fatalf("formatOutputConfigs() failed: %v", err)
+	}
+	for _, tc := range []struct {
+		g    generatedFile
+		want string
+	}{
+		{oc.license, "license"},
+		{oc.configBuild, "# --type=build\nplatform()\n"},
+		{oc.rustConfigs[0], "# --type=bzl\nRUSTC_VERSION = \"1.75.0\"\n"},
+	} {
+		if got := string(tc.g.contents); got != tc.want {
+			t.Errorf("formatOutputConfigs() changed %s to %q, want %q", tc.g.name, got, tc.want)
+		}
+	}
+
+	if oc.cppConfigsTarball == cppTarball {
+		t.Fatalf("formatOutputConfigs() didn't replace the C++ configs tarball")
+	}
+	got := make(map[string]string)
+	if err := walkTarball(oc.cppConfigsTarball, "", func(name string, r io.Reader) error {
+		blob, err := ioutil.ReadAll(r)
+		got[name] = string(blob)
+		return err
+	}); err != nil {
+		t.Fatalf("Unable to read the formatted C++ configs tarball: %v", err)
+	}
+	want := map[string]string{"BUILD": "# --type=build\ncc_toolchain_suite()", "WORKSPACE": "workspace()"}
+	for name, w := range want {
+		if got[name] != w {
+			t.Errorf("Formatted C++ configs tarball has %s with contents %q, want %q", name, got[name], w)
+		}
+	}
+}
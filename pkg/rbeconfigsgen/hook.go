@@ -0,0 +1,74 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+)
+
+// postHookConfigsDir returns the directory with the generated configs to be validated by the post
+// generation hook. If the configs weren't copied to a source directory, they're extracted to the
+// temporary working directory.
+func postHookConfigsDir(o *Options, oc outputConfigs) (string, error) {
+	if len(o.OutputSourceRoot) != 0 {
+		return path.Join(o.OutputSourceRoot, o.OutputConfigPath), nil
+	}
+	ho := *o
+	ho.OutputSourceRoot = path.Join(o.TempWorkDir, "post_hook_configs")
+	ho.OutputConfigPath = ""
+	if err := copyConfigsToOutputDir(&ho, oc); err != nil {
+		return "", err
+	}
+	return ho.OutputSourceRoot, nil
+}
+
+// runPostHook runs the post generation hook specified in the given options, if any, on the given
+// generated configs. The hook is passed the directory with the generated configs & the path to
+// the manifest as arguments. These & the other outputs are also available to the hook as
+// environment variables. The output of the hook is forwarded to the output of this tool and the
+// hook is considered to have failed if it exits with a non-zero exit code.
+func runPostHook(ctx context.Context, o *Options, oc outputConfigs) error {
+	if len(o.PostHook) == 0 {
+		return nil
+	}
+	dir, err := postHookConfigsDir(o, oc)
+	if err != nil {
+		return fmt.Errorf("unable to prepare the generated configs for the post generation hook: %w", err)
+	}
+	c := exec.CommandContext(ctx, o.PostHook, dir, o.OutputManifest)
+	c.Env = append(os.Environ(),
+		"RBE_CONFIGS_DIR="+dir,
+		"RBE_CONFIGS_MANIFEST="+o.OutputManifest,
+		"RBE_CONFIGS_TARBALL="+o.OutputTarball,
+		"RBE_CONFIGS_SUMMARY="+o.OutputSummary,
+		"RBE_CONFIGS_BAZEL_VERSION="+o.BazelVersion,
+		"RBE_CONFIGS_EXEC_OS="+o.ExecOS,
+	)
+	c.Stdout = os.Stdout
+	if o.TarballWriter != nil {
+		// The tarball may be streamed to stdout so keep the output of the hook out of it.
+		c.Stdout = os.Stderr
+	}
+	c.Stderr = os.Stderr
+	o.log.Infof("Running post generation hook %q on the configs in %q.", o.PostHook, dir)
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("post generation hook %q failed: %w", o.PostHook, err)
+	}
+	return nil
+}
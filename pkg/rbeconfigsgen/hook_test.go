@@ -0,0 +1,75 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestRunPostHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test hooks are shell scripts")
+	}
+	oc := outputConfigs{
+		license:     generatedFile{name: "LICENSE", contents: []byte("license")},
+		configBuild: generatedFile{name: "config/BUILD", contents: []byte("platform")},
+	}
+	tests := []struct {
+		name     string
+		exitCode int
+		wantErr  bool
+	}{
+		{name: "Hook succeeds", exitCode: 0},
+		{name: "Hook fails", exitCode: 3, wantErr: true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			dir := t.TempDir()
+			logPath := filepath.Join(dir, "hook.log")
+			hook := filepath.Join(dir, "hook.sh")
+			// The hook records the contents of the LICENSE in the configs directory it's given
+			// along with the manifest path.
+			script := fmt.Sprintf("#!/bin/sh\ncat \"$1/LICENSE\" > %q\necho \" $2 $RBE_CONFIGS_MANIFEST\" >> %q\nexit %d\n", logPath, logPath, tc.exitCode)
+			if err := ioutil.WriteFile(hook, []byte(script), 0755); err != nil {
+				t.Fatalf("Unable to write the test hook: %v", err)
+			}
+			o := &Options{
+				PostHook:       hook,
+				TempWorkDir:    dir,
+				OutputTarball:  filepath.Join(dir, "configs.tar"),
+				OutputManifest: "manifest.json",
+			}
+			err := runPostHook(context.Background(), o, oc)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("runPostHook() returned error %v, want error: %v", err, tc.wantErr)
+			}
+			blob, err := ioutil.ReadFile(logPath)
+			if err != nil {
+				t.Fatalf("Unable to read the log of the test hook: %v", err)
+			}
+			if got, want := strings.TrimSpace(string(blob)), "license manifest.json manifest.json"; got != want {
+				t.Errorf("Test hook logged %q, want %q", got, want)
+			}
+		})
+	}
+}
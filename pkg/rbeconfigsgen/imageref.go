@@ -0,0 +1,66 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"fmt"
+	"strings"
+)
+
+// imageRef is a docker image reference split into the repository, tag & digest, e.g.,
+// "gcr.io/foo/bar:1.0@sha256:<hex>". Either or both of the tag & digest may be blank.
+type imageRef struct {
+	// repo is the repository of the image including the registry host, e.g., "gcr.io/foo/bar".
+	repo string
+	// tag is the tag of the image without the leading ':', e.g., "1.0".
+	tag string
+	// digest is the digest of the image including the algorithm, e.g., "sha256:<hex>".
+	digest string
+}
+
+// parseImageRef splits the given docker image reference into its repository, tag & digest. The
+// port of a registry host like "localhost:5000" isn't mistaken for a tag.
+func parseImageRef(ref string) imageRef {
+	var r imageRef
+	if i := strings.LastIndex(ref, "@"); i >= 0 {
+		ref, r.digest = ref[:i], ref[i+1:]
+	}
+	// A tag can only follow the last path component of the repository.
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		ref, r.tag = ref[:i], ref[i+1:]
+	}
+	r.repo = ref
+	return r
+}
+
+// name returns the reference without the digest, i.e., the repository & the tag if any. This is
+// the name recorded as the toolchain container in the manifest.
+func (r imageRef) name() string {
+	if len(r.tag) == 0 {
+		return r.repo
+	}
+	return r.repo + ":" + r.tag
+}
+
+// validate verifies the digest of the image reference, if any, is a sha256 digest.
+func (r imageRef) validate() error {
+	if len(r.repo) == 0 {
+		return fmt.Errorf("image reference doesn't specify a repository")
+	}
+	if len(r.digest) != 0 && !imageDigestRegexp.MatchString(r.digest) {
+		return fmt.Errorf("invalid digest %q, want sha256:<64 lowercase hex characters>", r.digest)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseImageRef(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	tests := []struct {
+		name     string
+		ref      string
+		want     imageRef
+		wantName string
+		wantErr  bool
+	}{
+		{
+			name:     "Tag only",
+			ref:      "gcr.io/foo/bar:latest",
+			want:     imageRef{repo: "gcr.io/foo/bar", tag: "latest"},
+			wantName: "gcr.io/foo/bar:latest",
+		},
+		{
+			name:     "Digest only",
+			ref:      "gcr.io/foo/bar@" + digest,
+			want:     imageRef{repo: "gcr.io/foo/bar", digest: digest},
+			wantName: "gcr.io/foo/bar",
+		},
+		{
+			name:     "Tag & digest",
+			ref:      "gcr.io/foo/bar:1.0@" + digest,
+			want:     imageRef{repo: "gcr.io/foo/bar", tag: "1.0", digest: digest},
+			wantName: "gcr.io/foo/bar:1.0",
+		},
+		{
+			name:     "Registry port & digest",
+			ref:      "localhost:5000/bar@" + digest,
+			want:     imageRef{repo: "localhost:5000/bar", digest: digest},
+			wantName: "localhost:5000/bar",
+		},
+		{
+			name:     "Neither tag nor digest",
+			ref:      "ubuntu",
+			want:     imageRef{repo: "ubuntu"},
+			wantName: "ubuntu",
+		},
+		{
+			name:    "Invalid digest",
+			ref:     "gcr.io/foo/bar@sha256:abcd",
+			want:    imageRef{repo: "gcr.io/foo/bar", digest: "sha256:abcd"},
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got := parseImageRef(tc.ref)
+			if got != tc.want {
+				t.Errorf("parseImageRef(%q)=%+v, want %+v", tc.ref, got, tc.want)
+			}
+			if err := got.validate(); (err != nil) != tc.wantErr {
+				t.Errorf("parseImageRef(%q).validate() returned error %v, want error: %v", tc.ref, err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			if n := got.name(); n != tc.wantName {
+				t.Errorf("parseImageRef(%q).name()=%q, want %q", tc.ref, n, tc.wantName)
+			}
+		})
+	}
+}
+
+func TestValidateRequireDigest(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	tests := []struct {
+		name    string
+		modify  func(o *Options)
+		wantErr string
+	}{
+		{
+			name:   "Digest",
+			modify: func(o *Options) { o.ToolchainContainer = "gcr.io/foo/bar@" + digest },
+		},
+		{
+			name:   "Tag & digest",
+			modify: func(o *Options) { o.ToolchainContainer = "gcr.io/foo/bar:1.0@" + digest },
+		},
+		{
+			name:    "Tag",
+			modify:  func(o *Options) { o.ToolchainContainer = "gcr.io/foo/bar:1.0" },
+			wantErr: "gcr.io/foo/bar@sha256:<digest>",
+		},
+		{
+			name:    "Image tarball",
+			modify:  func(o *Options) { o.ImageTarball = "image.tar" },
+			wantErr: "isn't pulled from ToolchainContainer",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			o := batchTestOptions()
+			o.OutputTarball = filepath.Join(t.TempDir(), "configs.tar")
+			o.RequireDigest = true
+			tc.modify(&o)
+			if err := o.ApplyDefaults(o.ExecOS); err != nil {
+				t.Fatalf("ApplyDefaults() failed: %v", err)
+			}
+			err := o.Validate()
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate() failed: %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Validate() returned error %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
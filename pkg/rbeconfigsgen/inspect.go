@@ -0,0 +1,92 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// TarballContents describes a configs tarball without extracting it.
+type TarballContents struct {
+	// Manifest is the manifest embedded in the configs tarball. Nil if the tarball wasn't generated
+	// with EmbedManifest.
+	Manifest *Manifest `json:"manifest,omitempty"`
+	// TopLevelFiles are the files & directories, suffixed with "/", at the root of the configs
+	// tarball sorted by name. Only set if the tarball has no embedded manifest.
+	TopLevelFiles []string `json:"top_level_files,omitempty"`
+}
+
+// InspectTarball returns the embedded manifest of the configs tarball at the given path, which may
+// be compressed in any of the supported tarball formats. The embedded manifest is found under any
+// TarballPrefix. The files at the root of the tarball are returned instead if it has no embedded
+// manifest.
+func InspectTarball(tarPath string) (*TarballContents, error) {
+	c := &TarballContents{}
+	top := make(map[string]bool)
+	if err := walkTarball(tarPath, "", func(name string, r io.Reader) error {
+		if i := strings.Index(name, "/"); i >= 0 {
+			top[name[:i+1]] = true
+		} else {
+			top[name] = true
+		}
+		if c.Manifest != nil || (name != EmbeddedManifestFile && !strings.HasSuffix(name, "/"+EmbeddedManifestFile)) {
+			return nil
+		}
+		blob, err := ioutil.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("unable to read the embedded manifest %q: %w", name, err)
+		}
+		m := &Manifest{}
+		if err := json.Unmarshal(blob, m); err != nil {
+			return fmt.Errorf("unable to parse the contents of the embedded manifest %q as a JSON manifest: %w", name, err)
+		}
+		c.Manifest = m
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if c.Manifest != nil {
+		return c, nil
+	}
+	for f := range top {
+		c.TopLevelFiles = append(c.TopLevelFiles, f)
+	}
+	sort.Strings(c.TopLevelFiles)
+	return c, nil
+}
+
+// String returns the non-blank fields of the embedded manifest one per line or the top level files
+// if the tarball has no embedded manifest.
+func (c *TarballContents) String() string {
+	var b strings.Builder
+	if c.Manifest == nil {
+		b.WriteString("No embedded manifest found. Top level files:\n")
+		for _, f := range c.TopLevelFiles {
+			fmt.Fprintf(&b, "  %s\n", f)
+		}
+		return b.String()
+	}
+	for _, f := range manifestFields {
+		if v := f.get(c.Manifest); len(v) != 0 {
+			fmt.Fprintf(&b, "%s: %s\n", f.name, v)
+		}
+	}
+	return b.String()
+}
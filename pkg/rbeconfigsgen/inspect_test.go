@@ -0,0 +1,89 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// gzipTestTarball returns the path of a gzip compressed copy of the tarball at the given path.
+func gzipTestTarball(t *testing.T, p string) string {
+	t.Helper()
+	blob, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatalf("Unable to read tarball: %v", err)
+	}
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(blob); err != nil {
+		t.Fatalf("Unable to compress tarball: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Unable to finish compressing tarball: %v", err)
+	}
+	gz := p + ".gz"
+	if err := ioutil.WriteFile(gz, b.Bytes(), 0644); err != nil {
+		t.Fatalf("Unable to write compressed tarball: %v", err)
+	}
+	return gz
+}
+
+func TestInspectTarball(t *testing.T) {
+	manifest := `{"bazel_version": "6.4.0", "image_digest": "aaaa", "tarball_prefix": "rbe_default"}`
+	tests := []struct {
+		name  string
+		files map[string]string
+		gzip  bool
+		want  *TarballContents
+	}{
+		{
+			name:  "Embedded manifest",
+			files: map[string]string{"cc/BUILD": "cc", "config/manifest.json": manifest},
+			want:  &TarballContents{Manifest: &Manifest{BazelVersion: "6.4.0", ImageDigest: "aaaa", TarballPrefix: "rbe_default"}},
+		},
+		{
+			name:  "Embedded manifest under prefix in gzip tarball",
+			files: map[string]string{"rbe_default/cc/BUILD": "cc", "rbe_default/config/manifest.json": manifest},
+			gzip:  true,
+			want:  &TarballContents{Manifest: &Manifest{BazelVersion: "6.4.0", ImageDigest: "aaaa", TarballPrefix: "rbe_default"}},
+		},
+		{
+			name:  "No embedded manifest",
+			files: map[string]string{"LICENSE": "license", "cc/BUILD": "cc", "cc/cc_toolchain_config.bzl": "cc", "config/BUILD": "config"},
+			want:  &TarballContents{TopLevelFiles: []string{"LICENSE", "cc/", "config/"}},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			p := writeTestTarball(t, tc.files)
+			if tc.gzip {
+				p = gzipTestTarball(t, p)
+			}
+			got, err := InspectTarball(p)
+			if err != nil {
+				t.Fatalf("InspectTarball() failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("InspectTarball()=%+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
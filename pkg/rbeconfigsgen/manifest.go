@@ -0,0 +1,371 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bazelbuild/bazel-toolchains/pkg/logging"
+)
+
+// ManifestSchemaVersion is the schema version of the manifests written & understood by this
+// package. See Manifest.SchemaVersion.
+const ManifestSchemaVersion = 1
+
+// SchemaVersionError is returned by ParseManifestStrict if the manifest has a newer schema version
+// than ManifestSchemaVersion.
+type SchemaVersionError struct {
+	// Version is the schema version of the manifest.
+	Version int
+}
+
+func (e *SchemaVersionError) Error() string {
+	return fmt.Sprintf("manifest has schema version %d but only schema versions up to %d are supported, upgrade to a newer release of bazel-toolchains", e.Version, ManifestSchemaVersion)
+}
+
+// ManifestDecodeError is returned by ParseManifest if the manifest isn't valid JSON.
+type ManifestDecodeError struct {
+	// Err is the error returned by the JSON decoder.
+	Err error
+}
+
+func (e *ManifestDecodeError) Error() string {
+	return fmt.Sprintf("unable to parse the manifest as JSON: %v", e.Err)
+}
+
+// Unwrap returns the error returned by the JSON decoder.
+func (e *ManifestDecodeError) Unwrap() error {
+	return e.Err
+}
+
+// MissingFieldError is returned by ParseManifest if the manifest didn't specify a required field.
+type MissingFieldError struct {
+	// Field is the JSON name of the missing field, e.g., "bazel_version".
+	Field string
+}
+
+func (e *MissingFieldError) Error() string {
+	return fmt.Sprintf("manifest did not specify required field %q", e.Field)
+}
+
+// ParseManifest decodes a JSON manifest in the format produced by rbe_configs_gen from the given
+// reader & verifies it specifies the Bazel version & configs tarball digest. Fields unknown to
+// this package, e.g., those added by rbe_configs_upload, are ignored. A warning is logged if the
+// manifest has a newer schema version than ManifestSchemaVersion. The returned error is a
+// *ManifestDecodeError if the JSON was malformed or a *MissingFieldError if a required field was
+// missing.
+func ParseManifest(r io.Reader) (*Manifest, error) {
+	return parseManifest(r, false)
+}
+
+// ParseManifestStrict is like ParseManifest but returns a *SchemaVersionError instead of logging a
+// warning if the manifest has a newer schema version than ManifestSchemaVersion.
+func ParseManifestStrict(r io.Reader) (*Manifest, error) {
+	return parseManifest(r, true)
+}
+
+// parseManifest implements ParseManifest & ParseManifestStrict.
+func parseManifest(r io.Reader, strict bool) (*Manifest, error) {
+	m := &Manifest{}
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, &ManifestDecodeError{Err: err}
+	}
+	if err := checkSchemaVersion(m, strict); err != nil {
+		return nil, err
+	}
+	if len(m.BazelVersion) == 0 {
+		return nil, &MissingFieldError{Field: "bazel_version"}
+	}
+	if len(m.ConfigsTarballDigest) == 0 {
+		return nil, &MissingFieldError{Field: "configs_tarball_digest"}
+	}
+	return m, nil
+}
+
+// checkSchemaVersion returns a *SchemaVersionError if strict is true & the given manifest has a
+// newer schema version than ManifestSchemaVersion. Otherwise, a warning is logged for such
+// manifests because fields may have changed in ways this package doesn't know about.
+func checkSchemaVersion(m *Manifest, strict bool) error {
+	if m.SchemaVersion <= ManifestSchemaVersion {
+		return nil
+	}
+	err := &SchemaVersionError{Version: m.SchemaVersion}
+	if strict {
+		return err
+	}
+	logging.Warningf("%v. Fields of the manifest may be misinterpreted.", err)
+	return nil
+}
+
+// ManifestOptions are the options to produce a manifest & configs tarball for configs that were
+// previously generated into a directory without re-running the toolchain container.
+type ManifestOptions struct {
+	// ConfigsDir is the directory containing the previously generated configs, i.e., the
+	// directory with the "cc", "java" & "config" sub-directories. Required.
+	ConfigsDir string
+	// BazelVersion is the version of Bazel the configs were generated for. Required.
+	BazelVersion string
+	// ToolchainContainer is the toolchain image the configs were generated for. Optional.
+	ToolchainContainer string
+	// ImageDigest is the sha256 digest of the toolchain image the configs were generated for,
+	// with or without the "sha256:" prefix. Required.
+	ImageDigest string
+	// ExecOS is the OS (linux|windows) of the toolchain image. Required.
+	ExecOS string
+	// RepoName is the name of the Bazel external repository the configs are expected to be
+	// imported as. Defaults to DefaultRepoName if unset when Validate() is called.
+	RepoName string
+	// PlatformName is the name of the platform target in the config package of the configs.
+	// Defaults to DefaultPlatformName if unset when Validate() is called.
+	PlatformName string
+	// JavaVersion is the version of the JDK in the toolchain image. Optional.
+	JavaVersion string
+	// OutputTarball is the path the configs tarball will be written to. Required.
+	OutputTarball string
+	// TarballPrefix is the directory inside OutputTarball the configs are written under. The
+	// configs are written to the root of the tarball if unset.
+	TarballPrefix string
+	// TarballFormat is how OutputTarball is compressed, one of TarballFormatTar, TarballFormatTarGz
+	// or TarballFormatTarZst. Defaults to TarballFormatTar if unset when Validate() is called.
+	TarballFormat string
+	// OutputManifest is the path the JSON manifest will be written to. Required.
+	OutputManifest string
+}
+
+// Validate verifies that mandatory arguments were provided and have valid values.
+func (o *ManifestOptions) Validate() error {
+	if o.ConfigsDir == "" {
+		return fmt.Errorf("ConfigsDir was not specified")
+	}
+	if s, err := os.Stat(o.ConfigsDir); err != nil {
+		return fmt.Errorf("unable to access ConfigsDir %q: %w", o.ConfigsDir, err)
+	} else if !s.IsDir() {
+		return fmt.Errorf("ConfigsDir %q is not a directory", o.ConfigsDir)
+	}
+	if o.BazelVersion == "" {
+		return fmt.Errorf("BazelVersion was not specified")
+	}
+	if o.ImageDigest == "" {
+		return fmt.Errorf("ImageDigest was not specified")
+	}
+	o.ImageDigest = strings.TrimPrefix(o.ImageDigest, "sha256:")
+	if !imageDigestRegexp.MatchString("sha256:" + o.ImageDigest) {
+		return fmt.Errorf("invalid ImageDigest %q, want a sha256 digest of 64 lowercase hex characters", o.ImageDigest)
+	}
+	if o.ExecOS == "" {
+		return fmt.Errorf("ExecOS was not specified")
+	}
+	if !strListContains(validOS, o.ExecOS) {
+		return fmt.Errorf("invalid ExecOS, got %q, want one of %s", o.ExecOS, strings.Join(validOS, ", "))
+	}
+	if o.RepoName == "" {
+		o.RepoName = DefaultRepoName
+	}
+	if !repoNameRegexp.MatchString(o.RepoName) {
+		return fmt.Errorf("invalid RepoName %q, must start with a letter & only contain letters, digits, '_', '-' or '.'", o.RepoName)
+	}
+	if err := validatePlatformName(&o.PlatformName); err != nil {
+		return err
+	}
+	if o.OutputTarball == "" {
+		return fmt.Errorf("OutputTarball was not specified")
+	}
+	p, err := cleanTarballPrefix(o.TarballPrefix)
+	if err != nil {
+		return fmt.Errorf("invalid TarballPrefix: %w", err)
+	}
+	o.TarballPrefix = p
+	if o.TarballFormat == "" {
+		o.TarballFormat = TarballFormatTar
+	}
+	if err := validateTarballFormat(o.TarballFormat); err != nil {
+		return fmt.Errorf("invalid TarballFormat: %w", err)
+	}
+	if o.OutputManifest == "" {
+		return fmt.Errorf("OutputManifest was not specified")
+	}
+	logging.Debugf("rbeconfigsgen.ManifestOptions:")
+	logging.Debugf("ConfigsDir=%q", o.ConfigsDir)
+	logging.Debugf("BazelVersion=%q", o.BazelVersion)
+	logging.Debugf("ToolchainContainer=%q", o.ToolchainContainer)
+	logging.Debugf("ImageDigest=%q", o.ImageDigest)
+	logging.Debugf("ExecOS=%q", o.ExecOS)
+	logging.Debugf("RepoName=%q", o.RepoName)
+	logging.Debugf("PlatformName=%q", o.PlatformName)
+	logging.Debugf("JavaVersion=%q", o.JavaVersion)
+	logging.Debugf("OutputTarball=%q", o.OutputTarball)
+	logging.Debugf("TarballPrefix=%q", o.TarballPrefix)
+	logging.Debugf("TarballFormat=%q", o.TarballFormat)
+	logging.Debugf("OutputManifest=%q", o.OutputManifest)
+	return nil
+}
+
+// TarOptions are the options to write a configs tarball from a directory with TarballDir.
+type TarOptions struct {
+	// Prefix is the directory inside the tarball the files are written under, i.e., the
+	// strip_prefix of the http_archive importing the tarball. Files are written at the root of the
+	// tarball if blank.
+	Prefix string
+	// Format is how the tarball is compressed, one of TarballFormatTar, TarballFormatTarGz or
+	// TarballFormatTarZst. Defaults to TarballFormatTar if blank like Options.TarballFormat.
+	Format string
+	// Exclude are the paths of files in the directory that aren't written to the tarball, e.g.,
+	// outputs from a previous run written into the directory.
+	Exclude []string
+}
+
+// TarballDir writes the regular files in the given directory to a configs tarball written to the
+// given writer according to the given options & returns the hex encoded sha256 digest of the
+// tarball. Files are added in lexical order with their mod times set to epoch so that the output
+// is deterministic & byte compatible with the tarballs rbe_configs_gen writes for the same files.
+func TarballDir(srcDir string, w io.Writer, opts TarOptions) (string, error) {
+	skip := make(map[string]bool)
+	for _, e := range opts.Exclude {
+		a, err := filepath.Abs(e)
+		if err != nil {
+			return "", fmt.Errorf("unable to determine the absolute path of %q: %w", e, err)
+		}
+		skip[a] = true
+	}
+	var files []string
+	if err := filepath.Walk(srcDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		a, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && !skip[a] {
+			files = append(files, p)
+		}
+		return nil
+	}); err != nil {
+		return "", fmt.Errorf("unable to list the files in %q: %w", srcDir, err)
+	}
+	sort.Strings(files)
+
+	h := sha256.New()
+	c, err := newTarballCompressor(opts.Format, io.MultiWriter(w, h))
+	if err != nil {
+		return "", err
+	}
+	outTar := tar.NewWriter(c)
+	for _, p := range files {
+		rel, err := filepath.Rel(srcDir, p)
+		if err != nil {
+			return "", fmt.Errorf("unable to determine the path of %q relative to %q: %w", p, srcDir, err)
+		}
+		if err := copyFileToTarball(p, path.Join(opts.Prefix, filepath.ToSlash(rel)), outTar); err != nil {
+			return "", err
+		}
+	}
+	if err := outTar.Close(); err != nil {
+		return "", fmt.Errorf("error trying to finish writing the tarball: %w", err)
+	}
+	if err := c.Close(); err != nil {
+		return "", fmt.Errorf("error trying to finish compressing the tarball: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// dirToTarball writes the regular files in the given directory under the directory 'prefix' in a
+// tarball in the given format at the given path excluding the given files using TarballDir.
+// Returns the sha256 digest of the tarball.
+func dirToTarball(dir, tarballPath, prefix, format string, exclude ...string) (string, error) {
+	out, err := os.Create(tarballPath)
+	if err != nil {
+		return "", fmt.Errorf("unable to open output tarball %q for writing: %w", tarballPath, err)
+	}
+	defer out.Close()
+	d, err := TarballDir(dir, out, TarOptions{
+		Prefix:  prefix,
+		Format:  format,
+		Exclude: append(exclude, tarballPath),
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to write output tarball %q: %w", tarballPath, err)
+	}
+	return d, out.Close()
+}
+
+// copyFileToTarball writes the local file at the given path to the given output tarball with the
+// given name.
+func copyFileToTarball(filePath, name string, outTar *tar.Writer) error {
+	in, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("unable to open %q for reading: %w", filePath, err)
+	}
+	defer in.Close()
+	s, err := in.Stat()
+	if err != nil {
+		return fmt.Errorf("unable to stat %q: %w", filePath, err)
+	}
+	if err := outTar.WriteHeader(&tar.Header{
+		Name:    name,
+		Size:    s.Size(),
+		Mode:    int64(os.ModePerm),
+		ModTime: time.Unix(0, 0),
+	}); err != nil {
+		return fmt.Errorf("failed to write tar header for %q: %w", name, err)
+	}
+	if _, err := io.Copy(outTar, in); err != nil {
+		return fmt.Errorf("failed to copy the contents of %q to the output tarball: %w", filePath, err)
+	}
+	return nil
+}
+
+// GenerateManifest packages the configs in the directory specified in the given options into a
+// tarball & writes a manifest for them without running the toolchain container. This is useful
+// to publish configs that were generated directly into a source repository or edited by hand.
+func GenerateManifest(o *ManifestOptions) (*Manifest, error) {
+	if err := o.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid options: %w", err)
+	}
+	d, err := dirToTarball(o.ConfigsDir, o.OutputTarball, o.TarballPrefix, o.TarballFormat, o.OutputManifest)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create a configs tarball from %q: %w", o.ConfigsDir, err)
+	}
+	m := &Manifest{
+		SchemaVersion:        ManifestSchemaVersion,
+		GeneratorVersion:     GeneratorVersion(),
+		BazelVersion:         o.BazelVersion,
+		ToolchainContainer:   o.ToolchainContainer,
+		ImageDigest:          o.ImageDigest,
+		ExecOS:               DefaultExecOptions[o.ExecOS].PlatformParams.OSFamily,
+		ConfigsTarballDigest: d,
+		RepoName:             o.RepoName,
+		PlatformName:         o.PlatformName,
+		JavaVersion:          o.JavaVersion,
+		TarballPrefix:        o.TarballPrefix,
+		TarballFormat:        o.TarballFormat,
+	}
+	if err := m.ToJSONFile(o.OutputManifest); err != nil {
+		return nil, fmt.Errorf("unable to write the manifest: %w", err)
+	}
+	logging.Infof("Wrote manifest %q for configs tarball %q.", o.OutputManifest, o.OutputTarball)
+	return m, nil
+}
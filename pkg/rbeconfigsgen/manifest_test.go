@@ -0,0 +1,406 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testImageDigest = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestGenerateManifest(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"LICENSE":         "license",
+		"cc/BUILD":        "cc",
+		"config/BUILD":    "platform",
+		"java/BUILD":      "java",
+		"manifest.json":   "stale manifest",
+		"configs.tar":     "stale tarball",
+		"cc/sub/file.txt": "nested",
+	}
+	for name, contents := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+			t.Fatalf("Unable to create directory for %q: %v", name, err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatalf("Unable to write %q: %v", name, err)
+		}
+	}
+	o := &ManifestOptions{
+		ConfigsDir:     dir,
+		BazelVersion:   "6.4.0",
+		ImageDigest:    "sha256:" + testImageDigest,
+		ExecOS:         OSLinux,
+		OutputTarball:  filepath.Join(dir, "configs.tar"),
+		TarballPrefix:  "rbe_default/",
+		OutputManifest: filepath.Join(dir, "manifest.json"),
+	}
+	m, err := GenerateManifest(o)
+	if err != nil {
+		t.Fatalf("GenerateManifest failed: %v", err)
+	}
+	if m.ImageDigest != testImageDigest || m.ExecOS != "Linux" || m.RepoName != DefaultRepoName || m.TarballPrefix != "rbe_default" {
+		t.Errorf("GenerateManifest returned manifest with (ImageDigest, ExecOS, RepoName, TarballPrefix) = (%q, %q, %q, %q), want (%q, %q, %q, %q)", m.ImageDigest, m.ExecOS, m.RepoName, m.TarballPrefix, testImageDigest, "Linux", DefaultRepoName, "rbe_default")
+	}
+	raw, err := tarballFileDigests(o.OutputTarball, "")
+	if err != nil {
+		t.Fatalf("tarballFileDigests failed: %v", err)
+	}
+	if _, ok := raw["rbe_default/cc/BUILD"]; !ok {
+		t.Errorf("Configs tarball didn't contain the configs under the tarball prefix, got %v", raw)
+	}
+
+	c, err := LoadConfigSet(o.OutputManifest, o.OutputTarball)
+	if err != nil {
+		t.Fatalf("LoadConfigSet failed: %v", err)
+	}
+	if !reflect.DeepEqual(c.Manifest, m) {
+		t.Errorf("Manifest written to %q = %+v, want %+v", o.OutputManifest, c.Manifest, m)
+	}
+	var got []string
+	for name := range c.Files {
+		got = append(got, name)
+	}
+	want := []string{"LICENSE", "cc/BUILD", "cc/sub/file.txt", "config/BUILD", "java/BUILD"}
+	if len(got) != len(want) {
+		t.Fatalf("Configs tarball contained files %v, want %v", got, want)
+	}
+	for _, w := range want {
+		if _, ok := c.Files[w]; !ok {
+			t.Errorf("Configs tarball didn't contain %q, got %v", w, got)
+		}
+	}
+}
+
+func TestTarballDir(t *testing.T) {
+	dir := t.TempDir()
+	for name, contents := range map[string]string{
+		"LICENSE":       "license",
+		"cc/BUILD":      "cc",
+		"config/BUILD":  "platform",
+		"manifest.json": "stale manifest",
+	} {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+			t.Fatalf("Unable to create directory for %q: %v", name, err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatalf("Unable to write %q: %v", name, err)
+		}
+	}
+	tests := []struct {
+		name string
+		opts TarOptions
+		want []string
+	}{
+		{
+			name: "Defaults",
+			want: []string{"LICENSE", "cc/BUILD", "config/BUILD", "manifest.json"},
+		},
+		{
+			name: "Prefix & exclude",
+			opts: TarOptions{Prefix: "rbe_default", Exclude: []string{filepath.Join(dir, "manifest.json")}},
+			want: []string{"rbe_default/LICENSE", "rbe_default/cc/BUILD", "rbe_default/config/BUILD"},
+		},
+		{
+			name: "Gzip",
+			opts: TarOptions{Format: TarballFormatTarGz},
+			want: []string{"LICENSE", "cc/BUILD", "config/BUILD", "manifest.json"},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			var first, second bytes.Buffer
+			d, err := TarballDir(dir, &first, tc.opts)
+			if err != nil {
+				t.Fatalf("TarballDir() failed: %v", err)
+			}
+			if want := fmt.Sprintf("%x", sha256.Sum256(first.Bytes())); d != want {
+				t.Errorf("TarballDir() returned digest %q, want the digest of the bytes written %q", d, want)
+			}
+			if _, err := TarballDir(dir, &second, tc.opts); err != nil {
+				t.Fatalf("TarballDir() failed: %v", err)
+			}
+			if !bytes.Equal(first.Bytes(), second.Bytes()) {
+				t.Errorf("TarballDir() wrote different tarballs for the same directory")
+			}
+
+			p := filepath.Join(t.TempDir(), "configs.tar")
+			if err := ioutil.WriteFile(p, first.Bytes(), 0644); err != nil {
+				t.Fatalf("Unable to write %q: %v", p, err)
+			}
+			var got []string
+			if err := walkTarball(p, "", func(name string, _ io.Reader) error {
+				got = append(got, name)
+				return nil
+			}); err != nil {
+				t.Fatalf("walkTarball() failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("TarballDir() wrote files %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAssembleConfigTarballMatchesTarballDir(t *testing.T) {
+	oc := outputConfigs{
+		license: generatedFile{name: "LICENSE", contents: []byte("license")},
+		// The WORKSPACE file Bazel generated for the C++ configs repository isn't part of the configs.
+		cppConfigsTarball: writeTestTarball(t, map[string]string{"BUILD": "cc", "WORKSPACE": "workspace", "cc_toolchain_config.bzl": "config"}),
+		configBuild:       generatedFile{name: "config/BUILD", contents: []byte("platform")},
+		javaBuild:         generatedFile{name: "java/BUILD", contents: []byte("java")},
+	}
+	o := &Options{OutputTarball: filepath.Join(t.TempDir(), "configs.tar.gz"), TarballPrefix: "rbe_default", TarballFormat: TarballFormatTarGz}
+	want, err := assembleConfigTarball(o, oc)
+	if err != nil {
+		t.Fatalf("assembleConfigTarball() failed: %v", err)
+	}
+
+	// Extract the tarball & archive the extracted configs again with TarballDir.
+	dir := t.TempDir()
+	if err := walkTarball(o.OutputTarball, o.TarballPrefix, func(name string, r io.Reader) error {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+			return err
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(p, b, 0644)
+	}); err != nil {
+		t.Fatalf("Unable to extract the configs tarball: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cc", "WORKSPACE")); !os.IsNotExist(err) {
+		t.Errorf("assembleConfigTarball() wrote the WORKSPACE file of the C++ configs: %v", err)
+	}
+	got, err := TarballDir(dir, ioutil.Discard, TarOptions{Prefix: o.TarballPrefix, Format: o.TarballFormat})
+	if err != nil {
+		t.Fatalf("TarballDir() failed: %v", err)
+	}
+	if got != want {
+		t.Errorf("TarballDir() of the extracted configs returned digest %q, want the digest %q of the tarball written by assembleConfigTarball()", got, want)
+	}
+}
+
+func TestCleanTarballPrefix(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		want    string
+		wantErr bool
+	}{
+		{prefix: "", want: ""},
+		{prefix: ".", want: ""},
+		{prefix: "rbe_default", want: "rbe_default"},
+		{prefix: "rbe_default/", want: "rbe_default"},
+		{prefix: "a/./b", want: "a/b"},
+		{prefix: "/rbe_default", wantErr: true},
+		{prefix: "../rbe_default", wantErr: true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.prefix, func(t *testing.T) {
+			t.Parallel()
+			got, err := cleanTarballPrefix(tc.prefix)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("cleanTarballPrefix(%q) returned error %v, want error: %v", tc.prefix, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("cleanTarballPrefix(%q) = %q, want %q", tc.prefix, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestManifestOptionsValidate(t *testing.T) {
+	dir := t.TempDir()
+	valid := func() *ManifestOptions {
+		return &ManifestOptions{
+			ConfigsDir:     dir,
+			BazelVersion:   "6.4.0",
+			ImageDigest:    testImageDigest,
+			ExecOS:         OSLinux,
+			OutputTarball:  "configs.tar",
+			OutputManifest: "manifest.json",
+		}
+	}
+	tests := []struct {
+		name    string
+		modify  func(o *ManifestOptions)
+		wantErr string
+	}{
+		{
+			name:   "Valid",
+			modify: func(o *ManifestOptions) {},
+		}, {
+			name:    "Missing configs dir",
+			modify:  func(o *ManifestOptions) { o.ConfigsDir = filepath.Join(dir, "missing") },
+			wantErr: "unable to access ConfigsDir",
+		}, {
+			name:    "Missing Bazel version",
+			modify:  func(o *ManifestOptions) { o.BazelVersion = "" },
+			wantErr: "BazelVersion",
+		}, {
+			name:    "Short image digest",
+			modify:  func(o *ManifestOptions) { o.ImageDigest = "sha256:abcd" },
+			wantErr: "invalid ImageDigest",
+		}, {
+			name:    "Invalid exec OS",
+			modify:  func(o *ManifestOptions) { o.ExecOS = "darwin" },
+			wantErr: "invalid ExecOS",
+		}, {
+			name:    "Invalid repo name",
+			modify:  func(o *ManifestOptions) { o.RepoName = "1rbe" },
+			wantErr: "invalid RepoName",
+		}, {
+			name:    "Missing output manifest",
+			modify:  func(o *ManifestOptions) { o.OutputManifest = "" },
+			wantErr: "OutputManifest",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			o := valid()
+			tc.modify(o)
+			err := o.Validate()
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate() failed: %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Validate() returned error %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseManifestSchemaVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		strict   bool
+		wantErr  bool
+	}{
+		{
+			name:     "Unversioned",
+			manifest: `{"bazel_version": "6.4.0", "configs_tarball_digest": "abcd"}`,
+			strict:   true,
+		}, {
+			name:     "Current",
+			manifest: fmt.Sprintf(`{"schema_version": %d, "bazel_version": "6.4.0", "configs_tarball_digest": "abcd"}`, ManifestSchemaVersion),
+			strict:   true,
+		}, {
+			name:     "Newer",
+			manifest: fmt.Sprintf(`{"schema_version": %d, "bazel_version": "6.4.0", "configs_tarball_digest": "abcd", "new_field": true}`, ManifestSchemaVersion+1),
+		}, {
+			name:     "Newer strict",
+			manifest: fmt.Sprintf(`{"schema_version": %d, "bazel_version": "6.4.0", "configs_tarball_digest": "abcd"}`, ManifestSchemaVersion+1),
+			strict:   true,
+			wantErr:  true,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			parse := ParseManifest
+			if tc.strict {
+				parse = ParseManifestStrict
+			}
+			_, err := parse(strings.NewReader(tc.manifest))
+			var sv *SchemaVersionError
+			if tc.wantErr {
+				if !errors.As(err, &sv) || sv.Version != ManifestSchemaVersion+1 {
+					t.Errorf("parsing returned error %v, want a SchemaVersionError for version %d", err, ManifestSchemaVersion+1)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("parsing failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	tests := []struct {
+		name        string
+		manifest    string
+		wantMissing string
+		wantDecode  bool
+	}{
+		{
+			name:     "Valid with unknown fields",
+			manifest: `{"bazel_version": "6.4.0", "configs_tarball_digest": "abcd", "upload_time": "now"}`,
+		}, {
+			name:        "Missing Bazel version",
+			manifest:    `{"configs_tarball_digest": "abcd"}`,
+			wantMissing: "bazel_version",
+		}, {
+			name:        "Missing configs tarball digest",
+			manifest:    `{"bazel_version": "6.4.0"}`,
+			wantMissing: "configs_tarball_digest",
+		}, {
+			name:       "Malformed JSON",
+			manifest:   `{"bazel_version": `,
+			wantDecode: true,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			m, err := ParseManifest(strings.NewReader(tc.manifest))
+			var missing *MissingFieldError
+			var decode *ManifestDecodeError
+			switch {
+			case tc.wantMissing != "":
+				if !errors.As(err, &missing) || missing.Field != tc.wantMissing {
+					t.Errorf("ParseManifest() returned error %v, want a MissingFieldError for %q", err, tc.wantMissing)
+				}
+			case tc.wantDecode:
+				if !errors.As(err, &decode) {
+					t.Errorf("ParseManifest() returned error %v, want a ManifestDecodeError", err)
+				}
+			default:
+				if err != nil {
+					t.Fatalf("ParseManifest() failed: %v", err)
+				}
+				if m.BazelVersion != "6.4.0" || m.ConfigsTarballDigest != "abcd" {
+					t.Errorf("ParseManifest() = %+v, want BazelVersion 6.4.0 & ConfigsTarballDigest abcd", m)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"time"
+
+	"github.com/bazelbuild/bazel-toolchains/pkg/logging"
+)
+
+// Observer receives progress events during config generation, e.g., to render the progress in a
+// UI embedding this package without parsing the logs. The detection stages run concurrently so
+// implementations must be safe for concurrent use.
+type Observer interface {
+	// OnStageStart is called when the given stage, e.g., StagePull, starts.
+	OnStageStart(stage string)
+	// OnStageEnd is called with how long the given stage took once it ends, regardless of whether
+	// it failed.
+	OnStageEnd(stage string, d time.Duration)
+	// OnLog is called with the messages logged at enabled levels while RunWithContext runs instead
+	// of printing them with the standard log package. Messages are formatted but don't have the
+	// "Warning: " or "Error: " prefix.
+	OnLog(l logging.Level, msg string)
+}
+
+// StageProgress is the progress of a long running stage, e.g., the number of layers of the
+// toolchain image pulled so far during StagePull.
+type StageProgress struct {
+	// Done is the number of units of work completed so far.
+	Done int
+	// Total is the number of units of work known so far. It may grow while the stage runs, e.g.,
+	// as docker discovers the layers of the image.
+	Total int
+	// Elapsed is how long the stage has been running.
+	Elapsed time.Duration
+}
+
+// ProgressObserver is an Observer that's also periodically notified of the progress of long
+// running stages. Observers that don't implement it only receive the progress as log messages.
+type ProgressObserver interface {
+	Observer
+	// OnStageProgress is called periodically with the progress of the given stage while it runs.
+	OnStageProgress(stage string, p StageProgress)
+}
+
+// progress notifies the Observer of the given options of the given progress of the given stage if
+// it's a ProgressObserver.
+func (o *Options) progress(stage string, p StageProgress) {
+	if po, ok := o.Observer.(ProgressObserver); ok {
+		po.OnStageProgress(stage, p)
+	}
+}
+
+// stage runs the given function as the given stage of config generation, notifying the Observer
+// & recording the duration in the Timings of the given options if they were specified. Errors are
+// returned as a StageError for the given stage.
+func (o *Options) stage(name string, f func() error) error {
+	if o.Observer != nil {
+		o.Observer.OnStageStart(name)
+	}
+	start := time.Now()
+	err := f()
+	d := time.Since(start)
+	o.Timings.Record(name, d)
+	if o.Observer != nil {
+		o.Observer.OnStageEnd(name, d)
+	}
+	if err != nil {
+		return &StageError{Stage: name, Err: err}
+	}
+	return nil
+}
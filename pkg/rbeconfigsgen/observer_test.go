@@ -0,0 +1,79 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bazelbuild/bazel-toolchains/pkg/logging"
+)
+
+// recordingObserver records the events it receives as strings.
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *recordingObserver) record(e string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+func (r *recordingObserver) OnStageStart(stage string) {
+	r.record("start " + stage)
+}
+
+func (r *recordingObserver) OnStageEnd(stage string, _ time.Duration) {
+	r.record("end " + stage)
+}
+
+func (r *recordingObserver) OnLog(_ logging.Level, msg string) {
+	r.record("log " + msg)
+}
+
+func TestOptionsStage(t *testing.T) {
+	r := &recordingObserver{}
+	o := &Options{Observer: r, Timings: &StageTimings{}}
+	if err := o.stage(StagePull, func() error { return nil }); err != nil {
+		t.Errorf("stage(%q) failed: %v", StagePull, err)
+	}
+	wantErr := errors.New("failed")
+	err := o.stage(StageTar, func() error { return wantErr })
+	var se *StageError
+	if !errors.As(err, &se) || se.Stage != StageTar || !errors.Is(err, wantErr) || !errors.Is(err, ErrTarball) {
+		t.Errorf("stage(%q) returned error %v, want a StageError for %q wrapping %v", StageTar, err, StageTar, wantErr)
+	}
+
+	want := []string{"start pull", "end pull", "start tar", "end tar"}
+	if !reflect.DeepEqual(r.events, want) {
+		t.Errorf("Observer received %v, want %v", r.events, want)
+	}
+	if got := o.Timings.Stages(); len(got) != 2 || got[0].Stage != StagePull || got[1].Stage != StageTar {
+		t.Errorf("Timings recorded %v, want pull followed by tar", got)
+	}
+}
+
+func TestOptionsStageWithoutObserver(t *testing.T) {
+	o := &Options{}
+	ran := false
+	if err := o.stage(StagePull, func() error { ran = true; return nil }); err != nil || !ran {
+		t.Errorf("stage(%q) without an observer or timings ran=%v, err=%v, want ran=true & no error", StagePull, ran, err)
+	}
+}
@@ -17,13 +17,20 @@
 package rbeconfigsgen
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
 	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 
-	"github.com/bazelbuild/bazelisk/core"
-	"github.com/bazelbuild/bazelisk/repositories"
+	"github.com/bazelbuild/bazel-toolchains/pkg/logging"
+	"github.com/coreos/go-semver/semver"
 )
 
 // Options are the options to tweak Bazel C++/Java Toolchain config generation.
@@ -31,31 +38,241 @@ type Options struct {
 	// BazelVersion is the version of Bazel to generate configs for. If unset, the latest Bazel
 	// version is automatically populated into this field when Validate() is called.
 	BazelVersion string
+	// SkipVersionCheck skips verifying that the specified BazelVersion is a published Bazel release
+	// when Validate() is called, e.g., for unreleased custom builds of Bazel.
+	SkipVersionCheck bool
+	// MinBazelVersion overrides the minimum Bazel version (inclusive) the generated configs are
+	// recorded as compatible with in the manifest. Otherwise, it's computed from the known Bazel
+	// versions where the rules used by the configs changed.
+	MinBazelVersion string
+	// MaxBazelVersion overrides the maximum Bazel version (exclusive) the generated configs are
+	// recorded as compatible with in the manifest. Otherwise, it's computed like MinBazelVersion.
+	MaxBazelVersion string
 	// BazelPath is the path within the container where Bazel is preinstalled. If unspecified,
 	// Bazelisk will be downloaded and installed.
 	BazelPath string
 	// ToolchainContainer is the docker image of the toolchain container to generate configs for.
+	// It may be referenced by tag, by digest, e.g., "gcr.io/foo/bar@sha256:<hex>", or both. The
+	// manifest records the reference without the digest. Only one of ToolchainContainer or
+	// ImageTarball can be specified.
 	ToolchainContainer string
+	// RequireDigest fails config generation unless ToolchainContainer is referenced by digest, e.g.,
+	// to enforce reproducible references to toolchain images in CI. The digest the toolchain image
+	// resolves to is recorded in the manifest either way.
+	RequireDigest bool
+	// ImageTarball is the path to a tarball of the toolchain container image as produced by
+	// "docker save" or an OCI image layout tarball. The image is loaded into docker instead of being
+	// pulled from a registry. Only one of ToolchainContainer or ImageTarball can be specified.
+	ImageTarball string
+	// ExistingContainer is the name or ID of an already running container to detect toolchains in
+	// instead of creating a new container, e.g., a container whose entrypoint set up the toolchain.
+	// The image the container is based on is recorded in the manifest. The container is never
+	// stopped or removed. Only one of ToolchainContainer, ImageTarball, ExistingContainer or
+	// Dockerfile can be specified.
+	ExistingContainer string
+	// Dockerfile is the path to a Dockerfile the toolchain container image is built from locally
+	// with "docker build" & tagged in BuildImageRepository instead of being pulled from a registry. The
+	// digest of the built image is recorded in the manifest. Only one of ToolchainContainer,
+	// ImageTarball, ExistingContainer or Dockerfile can be specified.
+	Dockerfile string
+	// BuildContext is the directory used as the build context when building Dockerfile. Defaults to
+	// the directory containing Dockerfile.
+	BuildContext string
+	// ApptainerImage is the path to a local Apptainer (Singularity) SIF image to detect toolchains
+	// in with "apptainer exec" instead of a docker image, e.g., for workers running Apptainer
+	// images. The path, the sha256 digest & the labels of the image are recorded in the manifest.
+	// Only supported for ExecOS "linux" & can't be specified with the other toolchain images or the
+	// options configuring docker containers. PlatformImageOverride must be specified because remote
+	// execution backends can't pull the local image.
+	ApptainerImage string
+	// PlatformImageOverride is the docker image referenced by digest, optionally prefixed with
+	// "docker://", used by the generated platform instead of the probed toolchain image, e.g., the
+	// same image in a registry mirror. The probed image is still used for toolchain detection.
+	PlatformImageOverride string
+	// RegistryCACert is a file with PEM encoded CA certificates trusted in addition to the system
+	// trust store when pulling ToolchainContainer & downloading Bazelisk, e.g., for a registry using
+	// a private CA. The certificates are installed into the certificate directory of the local
+	// docker daemon for the registry of ToolchainContainer while it's pulled, after which the
+	// certificate previously installed there, if any, is restored.
+	RegistryCACert string
+	// InsecureRegistry disables TLS certificate verification for downloads. The docker daemon
+	// doesn't allow disabling verification per pull so the registry must also be listed in the
+	// "insecure-registries" of the daemon configuration to pull from it.
+	InsecureRegistry bool
+	// HTTPUserAgent is the User-Agent of outbound HTTP requests, i.e., looking up Bazel releases &
+	// downloading Bazelisk. Defaults to DefaultUserAgent if blank.
+	HTTPUserAgent string
+	// BazeliskSHA256 is the hex encoded sha256 digest the Bazelisk executable downloaded into the
+	// toolchain container must have. Defaults to the digest known for the downloaded Bazelisk
+	// release. Bazelisk isn't downloaded if neither is available.
+	BazeliskSHA256 string
+	// PlatformConstraints are labels of existing constraint values, e.g.,
+	// "@mycorp//constraints:toolchain_flavor", appended to the constraint_values of the generated
+	// platform. The constraints themselves aren't defined in the generated configs.
+	PlatformConstraints []string
+	// DockerNetwork is the network access of remote actions running on the generated platform, set
+	// as the "dockerNetwork" exec property, one of "standard" or "off". The exec property isn't set
+	// if this is blank.
+	DockerNetwork string
+	// DockerRunAsRoot sets the "dockerRunAsRoot" exec property of the generated platform to run
+	// remote actions as root in the toolchain container.
+	DockerRunAsRoot bool
+	// DockerPrivileged sets the "dockerPrivileged" exec property of the generated platform to run
+	// remote actions in a privileged toolchain container.
+	DockerPrivileged bool
+	// SupportsWorkers sets the "supportsWorkers" exec property of the generated platform so
+	// backends implementing remote persistent workers keep worker processes alive across actions.
+	SupportsWorkers bool
+	// WorkerKeyMnemonics are the mnemonics of the actions, e.g., "Javac", run in remote persistent
+	// workers, set as the comma separated "workerKeyMnemonics" exec property of the generated
+	// platform. Requires SupportsWorkers.
+	WorkerKeyMnemonics []string
+	// IsolateProbes runs every detection step, e.g., detecting the C++ toolchain or the JDK, in its
+	// own toolchain container instead of running all of them in a single container, e.g., if a
+	// step changes the state of the container in a way that breaks another. Each extra container
+	// adds its startup time. Can't be used with ExistingContainer.
+	IsolateProbes bool
+	// RunEntrypoint runs the ENTRYPOINT of the toolchain image with env as its arguments inside the
+	// toolchain container before detection & sets the environment variables it set or changed for
+	// every command run in the container, e.g., for images configuring the toolchain in their
+	// entrypoint. The entrypoint must exec its arguments. Only supported for ExecOS OSLinux.
+	RunEntrypoint bool
+	// InitCommand is a shell command run like RunEntrypoint instead of the entrypoint, e.g.,
+	// ". /opt/toolchain/setup.sh". The variables it exports are set for every command run in the
+	// container. Only one of RunEntrypoint or InitCommand can be specified.
+	InitCommand string
+	// ContainerTmpfsSize is the size of a tmpfs mounted at /tmp in the detection containers, e.g.,
+	// "2g", for hosts whose default container storage is too small for the scratch files written
+	// by detection. Whether the tmpfs counts against the memory limit of the container depends on
+	// the container runtime. Only supported for ExecOS OSLinux & can't be used with
+	// ExistingContainer.
+	ContainerTmpfsSize string
+	// ScratchMount is a local directory bind mounted at /tmp in the detection containers instead of
+	// a tmpfs, e.g., a directory on a large disk. Files written to it by detection are left behind.
+	// Only one of ContainerTmpfsSize or ScratchMount can be specified.
+	ScratchMount string
+	// ContainerRunFlags are raw flags appended to the docker create command of the detection
+	// containers after the flags of this tool, e.g., "--security-opt=seccomp=unconfined" or
+	// "--network=host", for container runtimes that need options this tool doesn't know about.
+	// Every flag must be a single argument in the --name=value form, e.g., "--env=FOO=bar" rather
+	// than "-e FOO=bar" or "-eFOO=bar", & boolean flags need an explicit value, e.g.,
+	// "--privileged=true". Flags set by this tool like --name, --rm, --entrypoint & --platform
+	// can't be overridden. Values that may contain secrets are redacted in logs with
+	// RedactContainerRunFlag. Can't be used with ExistingContainer.
+	ContainerRunFlags []string
+	// DetectResources detects the CPUs & memory available to the toolchain container from
+	// /proc/cpuinfo, /proc/meminfo & its cgroup limits, logs them as a starting point to size the
+	// remote workers & records them as RecommendedCPU & RecommendedMemory in the manifest. The
+	// values describe the docker host running detection, not the remote workers, so they're only
+	// advisory. Only supported for ExecOS OSLinux.
+	DetectResources bool
 	// Specify --platform when executing docker create.
 	DockerPlatform string
+	// AllowEmulation allows generating configs for a toolchain image whose architecture differs
+	// from the docker host, i.e., running the toolchain container under emulation, with a warning.
+	// Otherwise, config generation fails for such images.
+	AllowEmulation bool
+	// NoShell runs commands in the toolchain container directly without relying on a shell or
+	// shell utilities like mkdir, find & tar which minimal images, e.g., distroless images, don't
+	// have. ProbeHelper is copied into the toolchain container to perform these operations
+	// instead. Only supported for Linux toolchain containers.
+	NoShell bool
+	// ProbeHelper is the local path to a statically linked Linux executable copied into the
+	// toolchain container if NoShell is set. It must call RunProbe with the remaining arguments
+	// when its first argument is ProbeCmd, e.g., rbe_configs_gen built with CGO_ENABLED=0.
+	ProbeHelper string
 	// ExecOS is the OS of the toolchain container image or the OS in which the build actions will
 	// execute.
 	ExecOS string
 	// TargetOS is the OS to be used as the target platform in the generated platform rule. This
 	// is the OS that artifacts built by Bazel will be executed on.
 	TargetOS string
+	// ExecCPU is the CPU architecture of the toolchain container, i.e., of the execution platform,
+	// e.g., CPUX8664. Defaults to CPUX8664 if unset when Validate() is called.
+	ExecCPU string
+	// TargetCPU is the CPU architecture artifacts built by Bazel will be executed on. Defaults to
+	// ExecCPU if unset when Validate() is called. If it differs from ExecCPU, the C++ configs are
+	// generated for the GCC cross compiler for the target, e.g., aarch64-linux-gnu-gcc, which
+	// must be installed in the Linux toolchain container.
+	TargetCPU string
+	// TargetSysroot is the sysroot of the generated C++ toolchain when cross-compiling. Detected
+	// with -print-sysroot of the cross compiler if unset.
+	TargetSysroot string
 	// OutputTarball is the path at with a tarball will be generated containing the C++/Java
 	// configs.
 	OutputTarball string
+	// TarballWriter is where the tarball containing the C++/Java configs is written to instead of
+	// a file at OutputTarball, e.g., os.Stdout to stream the tarball to the next stage of a
+	// pipeline. Can't be combined with OutputTarball.
+	TarballWriter io.Writer
+	// TarballPrefix is the directory inside OutputTarball the generated configs are written
+	// under, e.g., "rbe_default" so that the tarball unpacks into a single top-level directory.
+	// The configs are written to the root of the tarball if unset.
+	TarballPrefix string
+	// TarballFormat is how the output tarball is compressed, one of TarballFormatTar,
+	// TarballFormatTarGz or TarballFormatTarZst. Defaults to TarballFormatTar if unset when
+	// Validate() is called.
+	TarballFormat string
 	// OutputSourceRoot is the path where the root of the source repository where generated configs
 	// should be copied to. This directory is expected to have a Bazel WORKSPACE file.
 	OutputSourceRoot string
 	// OutputConfigPath is the path relative to OutputSourceRoot where the generated configs will
 	// be copied to.
 	OutputConfigPath string
+	// NoTarball only copies the generated configs to OutputSourceRoot without assembling & hashing
+	// a configs tarball, e.g., for configs imported with new_local_repository. The manifest records
+	// the ConfigsDirDigest of the copied configs instead of the digest of a tarball. Conflicts
+	// with OutputTarball, TarballWriter, TarballPrefix & EmbedManifest.
+	NoTarball bool
 	// OutputManifest is a path where a text file containing details about the generated configs.
 	// The manifest aims to be easily parseable by shell utilities like grep/sed.
 	OutputManifest string
+	// EmbedManifest writes the JSON manifest into the output tarball as EmbeddedManifestFile so
+	// that it's available once the tarball is extracted. The embedded manifest can't contain the
+	// digest of the tarball it's part of so its ConfigsTarballDigest is always blank. Requires
+	// OutputTarball or TarballWriter.
+	EmbedManifest bool
+	// BazelrcOutput is a path where a bazelrc fragment configuring Bazel to run remote builds
+	// using the generated configs with --config=remote will be written to.
+	BazelrcOutput string
+	// Bazelrc are the options of the bazelrc fragment written to BazelrcOutput. SkipCpp &
+	// SkipJava are determined by GenCPPConfigs & GenJavaConfigs.
+	Bazelrc BazelrcOptions
+	// RepoName is the name of the Bazel external repository the generated configs are expected to
+	// be imported as. Used to generate the labels in the summary & recorded in the manifest.
+	// Defaults to DefaultRepoName if unset when Validate() is called.
+	RepoName string
+	// PlatformName is the name of the generated platform target in the config package, e.g., to
+	// tell the platforms of several config sets imported into one repository apart. Used in the
+	// labels of the summary, the aliases & the bazelrc & recorded in the manifest. Defaults to
+	// DefaultPlatformName if unset when Validate() is called.
+	PlatformName string
+	// OutputSummary is a path where a JSON file listing the Bazel labels of the generated
+	// toolchain & platform targets will be written to.
+	OutputSummary string
+	// PostHook is the path to an executable run after the configs were generated to validate them.
+	// It receives the directory with the generated configs & the manifest path as arguments and
+	// config generation fails if it exits with a non-zero exit code.
+	PostHook string
+	// SimulateRBE builds hello world targets with the generated C++ & Java toolchains using Bazel
+	// with local execution inside a fresh container of the toolchain image once the configs were
+	// assembled. Config generation fails if the build fails. Only supported for Linux toolchain
+	// containers.
+	SimulateRBE bool
+	// DumpDetectionFacts is a path where the facts detected in the toolchain container, e.g., the
+	// C++ compiler, its builtin include directories, the JDK & the C library, are written to as a
+	// single JSON blob instead of generating configs. The facts are detected exactly like they are
+	// to generate configs, including the use of CacheDir. Can't be combined with the options
+	// specifying where configs & the files describing them are written.
+	DumpDetectionFacts string
+	// ValidateOnly is the path to a directory with previously generated configs, e.g., committed
+	// to a source repository at OutputConfigPath. The configs are generated into a temporary
+	// directory instead & config generation fails with ErrConfigsMismatch listing the files that
+	// differ if the digest of any file doesn't match. OutputSourceRoot & OutputConfigPath only
+	// determine the labels in the generated configs, e.g., to validate configs committed to a
+	// source repository, & nothing is written to them. Can't be combined with the other options
+	// specifying where configs & the files describing them are written.
+	ValidateOnly string
 	// PlatformParams specify platform specific constraints used to generate a BUILD file with the
 	// toolchain & platform targets in the generated configs. This is set to default values and not
 	// directly configurable.
@@ -85,8 +302,61 @@ type Options struct {
 	// command to generate C++ configs inside the toolchain container. Only one of CppGenEnv or
 	// CppGenEnvJSON can be specified.
 	CppGenEnvJSON string
+	// CppCompiler is the name of the compiler, one of gcc, g++, clang or clang++, Bazel uses to
+	// generate C++ configs. It must be present in the toolchain container & overrides CC in the
+	// C++ config generation environment. Only supported for Linux toolchain containers.
+	CppCompiler string
+	// CppStdlib is the C++ standard library, one of libc++ or libstdc++, the C++ configs are
+	// generated for by passing -stdlib to clang when compiling, linking & detecting the builtin
+	// include directories. Config generation fails if the detected C++ compiler is GCC, e.g., the
+	// default CC, so select clang with CppCompiler. Only supported for Linux toolchain containers.
+	CppStdlib string
 	// CPPToolchainTarget is the toolchain to be used by the cpp configs.
 	CPPToolchainTargetName string
+	// CxxBuiltinIncludeDirectories replaces the builtin include directories detected by Bazel in
+	// the cxx_builtin_include_directories attribute of the generated C++ toolchain if specified.
+	CxxBuiltinIncludeDirectories []string
+	// ExtraCxxBuiltinIncludeDirectories are appended to the cxx_builtin_include_directories
+	// attribute of the generated C++ toolchain after CxxBuiltinIncludeDirectories is applied.
+	ExtraCxxBuiltinIncludeDirectories []string
+	// ExcludeCxxBuiltinIncludeDirectories are removed from the builtin include directories
+	// detected by Bazel, e.g., a version pinned compiler resource directory that doesn't exist on
+	// the remote workers. Can't be specified with CxxBuiltinIncludeDirectories. Only supported for
+	// Linux toolchain containers.
+	ExcludeCxxBuiltinIncludeDirectories []string
+	// LinkerFlags are appended to the link_flags attribute of the generated C++ toolchain, e.g.,
+	// "-static" to produce fully static binaries. Only supported for Linux toolchain containers.
+	LinkerFlags []string
+	// ReplaceLinkerFlags replaces the link_flags detected by Bazel with LinkerFlags in the given
+	// order instead of appending to them.
+	ReplaceLinkerFlags bool
+	// CppFeatures enables (true) or disables (false) features of the generated C++ toolchain that
+	// Bazel defines, e.g., "supports_pic". Features that aren't set keep Bazel's default. Only
+	// supported for Linux toolchain containers.
+	CppFeatures map[string]bool
+	// ExtraCppFeatures are appended to the features of the generated C++ toolchain. Each is either
+	// the name of a feature that's enabled without any flags, e.g., "asan" to let targets detect
+	// the feature, or a raw Starlark "feature(...)" expression used verbatim. Only supported for
+	// Linux toolchain containers.
+	ExtraCppFeatures []string
+	// CppActions are groups of actions, CppActionsObjC or CppActionsAsm, the generated C++
+	// toolchain is configured for with action configs running its compiler in addition to the C &
+	// C++ actions configured by Bazel. Config generation fails unless the compiler supports the
+	// languages of the actions in the toolchain container. Only supported for Linux toolchain
+	// containers.
+	CppActions []string
+	// VerifyCPP verifies the generated C++ configs against the running toolchain container, e.g.,
+	// every resolved builtin include directory must exist in the container & a program must link
+	// with the link flags resolved for LinkerFlags. A warning is logged if a standard library
+	// header is only inside one of the ExcludeCxxBuiltinIncludeDirectories. This always runs the
+	// toolchain container even if facts were cached.
+	VerifyCPP bool
+	// CppToolchainResolution indicates the generated C++ configs will be used with platform based
+	// C++ toolchain resolution, i.e., --incompatible_enable_cc_toolchain_resolution, even if the
+	// Bazel version doesn't enable it by default. Otherwise, the Bazel version is used to infer
+	// whether it's enabled. This determines whether the C++ toolchain suite for --crosstool_top is
+	// reported in the summary.
+	CppToolchainResolution bool
 
 	// Java config generation options.
 	// GenJavaConfigs determines whether Java configs are generated.
@@ -95,12 +365,77 @@ type Options struct {
 	// rule instead of java_runtime. Otherwise, the Bazel version will be used to infer which rule
 	// to use. Older Bazel versions use java_runtime.
 	JavaUseLocalRuntime bool
+	// ForceLocalJavaRuntime, if set, overrides whether the generated java toolchain uses the
+	// local_java_runtime rule instead of java_runtime, bypassing both JavaUseLocalRuntime & the
+	// Bazel version heuristic.
+	ForceLocalJavaRuntime *bool
+	// JavaCompat selects which Java toolchain rules java/BUILD uses, one of JavaCompatVersion or
+	// JavaCompatBoth. JavaCompatBoth defines both the java_runtime based --javabase target used by
+	// Bazel < 5.0.0 & the local_java_runtime based Java toolchains used by newer versions so one
+	// set of configs works during a migration across that version. Defaults to JavaCompatVersion.
+	JavaCompat string
+	// JavaHome is the path of the JDK inside the toolchain container used as the java_home of the
+	// generated Java runtime instead of the value of JAVA_HOME in the toolchain image, e.g., when
+	// JAVA_HOME points to a JRE. The path must contain bin/java inside the container.
+	JavaHome string
+	// JavaSourceVersion is the Java source version, e.g., "11", of a Java toolchain generated in
+	// addition to the Java runtime with default_java_toolchain. Bazel resolves it for
+	// --java_language_version=<JavaSourceVersion>. Requires the local_java_runtime rule.
+	JavaSourceVersion string
+	// JavaTargetVersion is the Java target version of the Java toolchain generated for
+	// JavaSourceVersion. Defaults to JavaSourceVersion.
+	JavaTargetVersion string
+	// StrictJavaVersion fails instead of logging a warning when the JDK in the toolchain
+	// container is older than the JDK expected by the Java toolchain rules used by the Bazel
+	// version.
+	StrictJavaVersion bool
+	// GenRustConfigs determines whether the rust package exposing the version & sysroot of the
+	// rustc installed in the toolchain container is generated, e.g., for rules_rust macros. Only
+	// supported for ExecOS OSLinux.
+	GenRustConfigs bool
+	// FormatBuildFiles formats the generated BUILD & .bzl files, including the C++ configs
+	// generated by Bazel, with buildifier on the local machine so they match buildifier formatted
+	// source trees.
+	FormatBuildFiles bool
+	// BuildifierPath is the path to the buildifier binary used with FormatBuildFiles. Defaults to
+	// DefaultBuildifierPath found on the PATH.
+	BuildifierPath string
+	// Only limits the config files that are written to a single kind, one of OnlyPlatform,
+	// OnlyCC, OnlyJava or OnlyRust, e.g., to iterate on one kind without redoing everything else. Only the
+	// detection needed for that kind is run & the manifest records the generation as partial. All
+	// config files are written if blank or OnlyAll.
+	Only string
 	// TempWorkDir is a temporary directory that will be used by this tool to store intermediate
 	// files. If unspecified, a temporary directory will be requested from the OS.
 	TempWorkDir string
-	// Cleanup determines whether the running container & intermediate files will be deleted once
-	// config generation is done. Setting it to false is useful for debugging intermediate state.
+	// Cleanup determines whether the running container, the image built from Dockerfile &
+	// intermediate files will be deleted once config generation is done. Setting it to false is
+	// useful for debugging intermediate state.
 	Cleanup bool
+	// CacheDir is a local directory where facts detected in the toolchain container are cached
+	// keyed by the digest of the resolved toolchain image. If the cache has facts for the image, the
+	// toolchain container isn't run. ToolchainContainer is then resolved to its digest in the
+	// registry without pulling it unless the registry requires credentials, in which case it's
+	// pulled like without a cache. Caching is disabled if unspecified.
+	CacheDir string
+	// NoCache forces detection to run in the toolchain container even if CacheDir has cached facts
+	// for the toolchain image. The cache is still updated with the freshly detected facts.
+	NoCache bool
+	// Timings, if set, records how long each stage of config generation took.
+	Timings *StageTimings
+	// Warnings, if set, records the warnings about anomalies detected in the toolchain image, e.g.,
+	// a C++ compiler that didn't report its version.
+	Warnings *Warnings
+	// WarningsAsErrors fails config generation once the toolchains were detected if any warnings
+	// were reported instead of generating configs anyway.
+	WarningsAsErrors bool
+	// Observer, if set, is notified when each stage of config generation starts & ends and
+	// receives the messages logged by RunWithContext instead of the standard log package.
+	Observer Observer
+
+	// log is the logger of the run the options were passed to. It passes messages to the Observer
+	// of the run if set.
+	log *logging.Logger
 }
 
 // DefaultOptions are some option values that are populated as default values for certain fields
@@ -115,18 +450,81 @@ type DefaultOptions struct {
 }
 
 const (
+	// DefaultRepoName is the default name of the Bazel external repository the generated configs
+	// are expected to be imported as.
+	DefaultRepoName = "rbe_default"
+	// DefaultPlatformName is the default name of the generated platform target.
+	DefaultPlatformName = "platform"
+	// EmbeddedManifestFile is the path of the manifest inside the configs tarball relative to the
+	// TarballPrefix if EmbedManifest was specified.
+	EmbeddedManifestFile = "config/manifest.json"
+	// BuildImageRepository is the local repository of the toolchain image built from Dockerfile.
+	// Each run tags the image it built with a unique tag in this repository that's removed again
+	// on cleanup so concurrent runs don't replace each other's images.
+	BuildImageRepository = "rbe_configs_gen_build"
 	// OSLinux represents Linux when selecting platforms.
 	OSLinux = "linux"
 	// OSWindows represents Windows when selecting platforms.
 	OSWindows = "windows"
+
+	// OnlyAll writes all config files.
+	OnlyAll = "all"
+	// OnlyPlatform only writes the BUILD file with the platform & the C++ toolchain target, i.e.,
+	// config/BUILD.
+	OnlyPlatform = "platform"
+	// OnlyCC only writes the C++ configs generated by Bazel, i.e., the cc directory.
+	OnlyCC = "cc"
+	// OnlyJava only writes the BUILD file with the Java toolchain, i.e., java/BUILD.
+	OnlyJava = "java"
+	// OnlyRust only writes the Rust configs, i.e., the rust directory.
+	OnlyRust = "rust"
+
+	// JavaCompatVersion uses the Java toolchain rules picked by the Bazel version, see
+	// UsesLocalJavaRuntime.
+	JavaCompatVersion = "version"
+	// JavaCompatBoth uses both the java_runtime & the local_java_runtime rules.
+	JavaCompatBoth = "both"
 )
 
 var (
+	// repoNameRegexp matches valid Bazel external repository names.
+	repoNameRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]*$`)
+	// absLabelRegexp matches absolute Bazel labels optionally in an external repository, e.g.,
+	// "@mycorp//constraints:toolchain_flavor" or "//constraints:flavor".
+	absLabelRegexp = regexp.MustCompile(`^(@[A-Za-z0-9_.-]*)?//[^\s":]*(:[^\s":]+)?$`)
+
+	// containerRunFlagRegexp matches the --name=value form ContainerRunFlags must be in.
+	containerRunFlagRegexp = regexp.MustCompile(`^--[A-Za-z0-9][A-Za-z0-9-]*=`)
+	// reservedContainerRunFlags are the flags of docker create set by this tool which can't be
+	// specified in ContainerRunFlags.
+	reservedContainerRunFlags = []string{"--name", "--rm", "--entrypoint", "--platform"}
+
 	validOS = []string{
 		OSLinux,
 		OSWindows,
 	}
 
+	// onlyKinds are the valid values of Only.
+	onlyKinds = []string{OnlyAll, OnlyPlatform, OnlyCC, OnlyJava, OnlyRust}
+
+	// javaCompatModes are the valid values of JavaCompat.
+	javaCompatModes = []string{JavaCompatVersion, JavaCompatBoth}
+
+	// dockerNetworks are the valid values of the dockerNetwork exec property.
+	dockerNetworks = []string{"standard", "off"}
+
+	// javaLanguageVersionRegexp matches Java releases as accepted by javac --release, e.g., "11".
+	javaLanguageVersionRegexp = regexp.MustCompile(`^[1-9][0-9]*$`)
+
+	// targetNameRegexp matches the names of targets the generated configs may define.
+	targetNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.+-]*$`)
+
+	// tmpfsSizeRegexp matches the sizes of tmpfs mounts accepted by docker, e.g., "512m" or "2g".
+	tmpfsSizeRegexp = regexp.MustCompile(`^[1-9][0-9]*[kmg]?$`)
+
+	// mnemonicRegexp matches Bazel action mnemonics, e.g., "Javac" or "CppCompile".
+	mnemonicRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
 	// DefaultExecOptions is a map from the ExecOS to default values for certain fields in Options
 	// that vary based on the execution environment.
 	DefaultExecOptions = map[string]DefaultOptions{
@@ -179,6 +577,26 @@ var (
 	}
 )
 
+// cleanTarballPrefix returns the given directory inside a configs tarball in a canonical form
+// with leading & trailing slashes removed or an error if it's not a relative path inside the
+// tarball.
+func cleanTarballPrefix(prefix string) (string, error) {
+	if prefix == "" {
+		return "", nil
+	}
+	if path.IsAbs(prefix) {
+		return "", fmt.Errorf("tarball prefix %q should be a relative path", prefix)
+	}
+	c := path.Clean(prefix)
+	if c == "." {
+		return "", nil
+	}
+	if c == ".." || strings.HasPrefix(c, "../") {
+		return "", fmt.Errorf("tarball prefix %q must not point outside the tarball", prefix)
+	}
+	return c, nil
+}
+
 func strListContains(l []string, s string) bool {
 	for _, i := range l {
 		if i == s {
@@ -189,11 +607,11 @@ func strListContains(l []string, s string) bool {
 }
 
 // ApplyDefaults applies platform specific default values to the given options for the given
-// OS.
+// OS. An unknown OS is an error matching ErrInvalidOptions.
 func (o *Options) ApplyDefaults(os string) error {
 	dopts, ok := DefaultExecOptions[os]
 	if !ok {
-		return fmt.Errorf("got unknown OS %q, want one of %s", os, strings.Join(validOS, ", "))
+		return tagged(ErrInvalidOptions, fmt.Errorf("got unknown OS %q, want one of %s", os, strings.Join(validOS, ", ")))
 	}
 	o.PlatformParams = new(PlatformToolchainsTemplateParams)
 	*o.PlatformParams = dopts.PlatformParams
@@ -211,28 +629,208 @@ func (o *Options) ApplyDefaults(os string) error {
 	return nil
 }
 
-// latestBazelVersion uses Bazelisk to determine the latest available Bazel version.
-func latestBazelVersion() (string, error) {
-	r := core.CreateRepositories(&repositories.GCSRepo{}, nil, nil, nil, false)
-	v, _, err := r.ResolveVersion("", "", "latest")
+// latestBazelVersion determines the latest available Bazel release from the tag GitHub redirects
+// the latest release of Bazel to using the given HTTP client.
+func latestBazelVersion(c *http.Client) (string, error) {
+	u := bazelReleasesURL + "/latest"
+	resp, err := c.Head(u)
 	if err != nil {
-		return "", fmt.Errorf("unable to determine the latest available Bazel release using Bazelisk: %w", err)
+		return "", tagged(ErrNetwork, fmt.Errorf("unable to look up the latest Bazel release at %s: %w", u, err))
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", tagged(ErrNetwork, fmt.Errorf("unable to look up the latest Bazel release at %s: got HTTP status %q", u, resp.Status))
+	}
+	dir, v := path.Split(resp.Request.URL.Path)
+	if !strings.HasSuffix(dir, "/tag/") {
+		return "", fmt.Errorf("the latest Bazel release at %s redirected to %s, want the page of a release tag", u, resp.Request.URL)
+	}
+	if _, err := bazelCoreVersion(v); err != nil {
+		return "", fmt.Errorf("the latest Bazel release at %s has an invalid version: %w", u, err)
 	}
 	return v, nil
 }
 
 // Validate verifies that mandatory arguments were provided and argument values don't conflict in
-// certain cases.
+// certain cases. Errors match ErrInvalidOptions unless they're network failures looking up the
+// Bazel release, which match ErrNetwork instead.
 func (o *Options) Validate() error {
-	if o.BazelVersion == "" {
-		v, err := latestBazelVersion()
+	if err := o.validate(); err != nil {
+		if errors.Is(err, ErrNetwork) {
+			return err
+		}
+		return tagged(ErrInvalidOptions, err)
+	}
+	return nil
+}
+
+// validate implements Validate.
+func (o *Options) validate() error {
+	if o.BazelVersion == "" || !o.SkipVersionCheck {
+		c, err := newHTTPClient(o.log, o.RegistryCACert, o.InsecureRegistry, o.HTTPUserAgent)
 		if err != nil {
-			return fmt.Errorf("BazelVersion wasn't specified and was unable to determine the latest available Bazel version: %w", err)
+			return fmt.Errorf("failed to initialize the HTTP client to look up the Bazel release: %w", err)
+		}
+		if o.BazelVersion == "" {
+			v, err := latestBazelVersion(c)
+			if err != nil {
+				return fmt.Errorf("BazelVersion wasn't specified and was unable to determine the latest available Bazel version: %w", err)
+			}
+			o.BazelVersion = v
+		} else if err := ValidateBazelVersion(c, o.BazelVersion); err != nil {
+			return fmt.Errorf("invalid BazelVersion, specify SkipVersionCheck for unreleased Bazel versions: %w", err)
+		}
+	}
+	if err := validateBazelVersionRange(o.MinBazelVersion, o.MaxBazelVersion); err != nil {
+		return fmt.Errorf("invalid MinBazelVersion or MaxBazelVersion: %w", err)
+	}
+	if len(o.BazeliskSHA256) != 0 && !sha256Regexp.MatchString(o.BazeliskSHA256) {
+		return fmt.Errorf("invalid BazeliskSHA256 %q, want 64 lowercase hex characters", o.BazeliskSHA256)
+	}
+	if _, _, err := bazelVersionRange(o); err != nil {
+		return fmt.Errorf("invalid MinBazelVersion or MaxBazelVersion: %w", err)
+	}
+	if o.ToolchainContainer == "" && o.ImageTarball == "" && o.ExistingContainer == "" && o.Dockerfile == "" && o.ApptainerImage == "" {
+		return fmt.Errorf("one of ToolchainContainer, ImageTarball, ExistingContainer, Dockerfile or ApptainerImage must be specified")
+	}
+	if o.ToolchainContainer != "" && o.ImageTarball != "" {
+		return fmt.Errorf("only one of ToolchainContainer=%q or ImageTarball=%q must be specified", o.ToolchainContainer, o.ImageTarball)
+	}
+	if o.ExistingContainer != "" && (o.ToolchainContainer != "" || o.ImageTarball != "") {
+		return fmt.Errorf("ExistingContainer=%q can't be specified with ToolchainContainer or ImageTarball", o.ExistingContainer)
+	}
+	if o.Dockerfile != "" && (o.ToolchainContainer != "" || o.ImageTarball != "" || o.ExistingContainer != "") {
+		return fmt.Errorf("Dockerfile=%q can't be specified with ToolchainContainer, ImageTarball or ExistingContainer", o.Dockerfile)
+	}
+	if o.ApptainerImage != "" {
+		if err := validateApptainerOptions(o); err != nil {
+			return err
+		}
+	}
+	if o.BuildContext != "" && o.Dockerfile == "" {
+		return fmt.Errorf("BuildContext=%q was specified without a Dockerfile to build", o.BuildContext)
+	}
+	if o.Dockerfile != "" {
+		if s, err := os.Stat(o.Dockerfile); err != nil {
+			return fmt.Errorf("unable to access Dockerfile %q: %w", o.Dockerfile, err)
+		} else if !s.Mode().IsRegular() {
+			return fmt.Errorf("Dockerfile %q is not a regular file", o.Dockerfile)
+		}
+		if o.BuildContext == "" {
+			o.BuildContext = filepath.Dir(o.Dockerfile)
+		}
+		if s, err := os.Stat(o.BuildContext); err != nil {
+			return fmt.Errorf("unable to access BuildContext %q: %w", o.BuildContext, err)
+		} else if !s.IsDir() {
+			return fmt.Errorf("BuildContext %q is not a directory", o.BuildContext)
+		}
+	}
+	if o.ToolchainContainer != "" {
+		if err := parseImageRef(o.ToolchainContainer).validate(); err != nil {
+			return fmt.Errorf("invalid ToolchainContainer %q: %w", o.ToolchainContainer, err)
+		}
+	}
+	if o.RequireDigest {
+		if o.ToolchainContainer == "" {
+			return fmt.Errorf("RequireDigest was specified but the toolchain image isn't pulled from ToolchainContainer")
+		}
+		if r := parseImageRef(o.ToolchainContainer); len(r.digest) == 0 {
+			return fmt.Errorf("ToolchainContainer %q must be referenced by digest, e.g., %s@sha256:<digest>, because RequireDigest was specified", o.ToolchainContainer, r.repo)
 		}
-		o.BazelVersion = v
 	}
-	if o.ToolchainContainer == "" {
-		return fmt.Errorf("ToolchainContainer was not specified")
+	for _, c := range o.PlatformConstraints {
+		if !absLabelRegexp.MatchString(c) {
+			return fmt.Errorf("invalid PlatformConstraints label %q, want an absolute label like @repo//package:name", c)
+		}
+	}
+	if o.DockerNetwork != "" && !strListContains(dockerNetworks, o.DockerNetwork) {
+		return fmt.Errorf("invalid DockerNetwork, got %q, want one of %s", o.DockerNetwork, strings.Join(dockerNetworks, ", "))
+	}
+	if len(o.WorkerKeyMnemonics) != 0 && !o.SupportsWorkers {
+		return fmt.Errorf("WorkerKeyMnemonics were specified but SupportsWorkers was false")
+	}
+	seenMnemonics := make(map[string]bool)
+	for _, m := range o.WorkerKeyMnemonics {
+		if !mnemonicRegexp.MatchString(m) {
+			return fmt.Errorf("invalid WorkerKeyMnemonics mnemonic %q, want a Bazel action mnemonic like Javac", m)
+		}
+		if seenMnemonics[m] {
+			return fmt.Errorf("WorkerKeyMnemonics has duplicate mnemonic %q", m)
+		}
+		seenMnemonics[m] = true
+	}
+	if o.BuildifierPath != "" && !o.FormatBuildFiles {
+		return fmt.Errorf("BuildifierPath was specified but FormatBuildFiles was false")
+	}
+	if o.FormatBuildFiles {
+		if o.BuildifierPath == "" {
+			o.BuildifierPath = DefaultBuildifierPath
+		}
+		if _, err := exec.LookPath(o.BuildifierPath); err != nil {
+			return fmt.Errorf("unable to find buildifier to format the generated configs, install it or specify BuildifierPath: %w", err)
+		}
+	}
+	if o.RunEntrypoint && o.InitCommand != "" {
+		return fmt.Errorf("only one of RunEntrypoint or InitCommand=%q must be specified", o.InitCommand)
+	}
+	if o.RunEntrypoint || o.InitCommand != "" {
+		if o.ExecOS != OSLinux {
+			return fmt.Errorf("RunEntrypoint & InitCommand are only supported for ExecOS %q, got %q", OSLinux, o.ExecOS)
+		}
+		if o.NoShell {
+			return fmt.Errorf("RunEntrypoint & InitCommand can't be specified with NoShell because the initialized environment is printed with env")
+		}
+	}
+	if o.ExistingContainer != "" && o.IsolateProbes {
+		return fmt.Errorf("IsolateProbes can't be specified with ExistingContainer because no other container is started")
+	}
+	if o.ContainerTmpfsSize != "" && o.ScratchMount != "" {
+		return fmt.Errorf("only one of ContainerTmpfsSize=%q or ScratchMount=%q must be specified", o.ContainerTmpfsSize, o.ScratchMount)
+	}
+	if o.ContainerTmpfsSize != "" || o.ScratchMount != "" {
+		if o.ExecOS != OSLinux {
+			return fmt.Errorf("ContainerTmpfsSize & ScratchMount are only supported for ExecOS %q, got %q", OSLinux, o.ExecOS)
+		}
+		if o.ExistingContainer != "" {
+			return fmt.Errorf("ContainerTmpfsSize & ScratchMount can't be specified with ExistingContainer because the container is already running")
+		}
+	}
+	if o.ContainerTmpfsSize != "" && !tmpfsSizeRegexp.MatchString(o.ContainerTmpfsSize) {
+		return fmt.Errorf("invalid ContainerTmpfsSize %q, want a size in bytes optionally followed by k, m or g, e.g., 2g", o.ContainerTmpfsSize)
+	}
+	if o.ScratchMount != "" {
+		if !filepath.IsAbs(o.ScratchMount) {
+			return fmt.Errorf("ScratchMount %q must be an absolute path", o.ScratchMount)
+		}
+		if s, err := os.Stat(o.ScratchMount); err != nil {
+			return fmt.Errorf("unable to access ScratchMount %q: %w", o.ScratchMount, err)
+		} else if !s.IsDir() {
+			return fmt.Errorf("ScratchMount %q is not a directory", o.ScratchMount)
+		}
+	}
+	if o.DetectResources && o.ExecOS != OSLinux {
+		return fmt.Errorf("DetectResources is only supported for ExecOS %q, got %q", OSLinux, o.ExecOS)
+	}
+	if len(o.ContainerRunFlags) != 0 && o.ExistingContainer != "" {
+		return fmt.Errorf("ContainerRunFlags can't be specified with ExistingContainer because the container is already running")
+	}
+	if err := validateContainerRunFlags(o.ContainerRunFlags); err != nil {
+		return err
+	}
+	if o.ExistingContainer != "" && o.DockerPlatform != "" {
+		return fmt.Errorf("DockerPlatform can't be specified with ExistingContainer because the container is already running")
+	}
+	if o.RepoName == "" {
+		o.RepoName = DefaultRepoName
+	}
+	if !repoNameRegexp.MatchString(o.RepoName) {
+		return fmt.Errorf("invalid RepoName %q, must start with a letter & only contain letters, digits, '_', '-' or '.'", o.RepoName)
+	}
+	if err := validatePlatformName(&o.PlatformName); err != nil {
+		return err
+	}
+	if o.PlatformImageOverride != "" && !imageDigestRegexp.MatchString(o.PlatformImageOverride) {
+		return fmt.Errorf("PlatformImageOverride %q must reference an image by its sha256 digest, e.g., docker://<image>@sha256:<digest>", o.PlatformImageOverride)
 	}
 	if o.ExecOS == "" {
 		return fmt.Errorf("ExecOS was not specified")
@@ -246,8 +844,72 @@ func (o *Options) Validate() error {
 	if !strListContains(validOS, o.TargetOS) {
 		return fmt.Errorf("invalid TargetOS, got %q, want one of %s", o.TargetOS, strings.Join(validOS, ", "))
 	}
-	if o.OutputTarball == "" && o.OutputSourceRoot == "" {
-		return fmt.Errorf("atleast one of OutputTarball or OutputSourceRoot must be specified or this tool won't generate any output")
+	if o.ExecCPU == "" {
+		o.ExecCPU = CPUX8664
+	}
+	if !strListContains(validCPUs, o.ExecCPU) {
+		return fmt.Errorf("invalid ExecCPU, got %q, want one of %s", o.ExecCPU, strings.Join(validCPUs, ", "))
+	}
+	if o.TargetCPU == "" {
+		o.TargetCPU = o.ExecCPU
+	}
+	if !strListContains(validCPUs, o.TargetCPU) {
+		return fmt.Errorf("invalid TargetCPU, got %q, want one of %s", o.TargetCPU, strings.Join(validCPUs, ", "))
+	}
+	if isCrossCompiling(o) && (o.ExecOS != OSLinux || o.TargetOS != OSLinux) {
+		return fmt.Errorf("cross-compiling from ExecCPU %q to TargetCPU %q is only supported for ExecOS & TargetOS %q, got %q & %q", o.ExecCPU, o.TargetCPU, OSLinux, o.ExecOS, o.TargetOS)
+	}
+	if o.TargetSysroot != "" && !isCrossCompiling(o) {
+		return fmt.Errorf("TargetSysroot was specified but TargetCPU %q doesn't differ from ExecCPU", o.TargetCPU)
+	}
+	if o.OutputTarball != "" && o.TarballWriter != nil {
+		return fmt.Errorf("only one of OutputTarball or TarballWriter can be specified")
+	}
+	if o.NoTarball && o.genTarball() {
+		return fmt.Errorf("OutputTarball & TarballWriter can't be specified because NoTarball was specified")
+	}
+	if o.NoTarball && o.OutputSourceRoot == "" {
+		return fmt.Errorf("OutputSourceRoot is required because NoTarball was specified")
+	}
+	if o.DumpDetectionFacts != "" {
+		if o.genTarball() || o.OutputSourceRoot != "" || o.OutputManifest != "" || o.BazelrcOutput != "" || o.OutputSummary != "" || o.PostHook != "" || o.SimulateRBE || o.ValidateOnly != "" {
+			return fmt.Errorf("DumpDetectionFacts can't be combined with OutputTarball, TarballWriter, OutputSourceRoot, OutputManifest, BazelrcOutput, OutputSummary, PostHook, SimulateRBE or ValidateOnly because no configs are generated")
+		}
+	} else if o.ValidateOnly != "" {
+		if o.genTarball() || o.OutputManifest != "" || o.BazelrcOutput != "" || o.OutputSummary != "" || o.PostHook != "" {
+			return fmt.Errorf("ValidateOnly can't be combined with OutputTarball, TarballWriter, OutputManifest, BazelrcOutput, OutputSummary or PostHook because the configs are only compared with the ones in %q", o.ValidateOnly)
+		}
+		if s, err := os.Stat(o.ValidateOnly); err != nil || !s.IsDir() {
+			return fmt.Errorf("ValidateOnly %q must be an existing directory with the configs to compare with", o.ValidateOnly)
+		}
+	} else if !o.genTarball() && o.OutputSourceRoot == "" {
+		return fmt.Errorf("at least one of OutputTarball, TarballWriter or OutputSourceRoot must be specified or this tool won't generate any output")
+	}
+	if o.TarballPrefix != "" && !o.genTarball() {
+		return fmt.Errorf("OutputTarball or TarballWriter is required because TarballPrefix was specified")
+	}
+	p, err := cleanTarballPrefix(o.TarballPrefix)
+	if err != nil {
+		return fmt.Errorf("invalid TarballPrefix: %w", err)
+	}
+	o.TarballPrefix = p
+	if o.TarballFormat != "" && o.TarballFormat != TarballFormatTar && !o.genTarball() {
+		return fmt.Errorf("OutputTarball or TarballWriter is required because TarballFormat %q was specified", o.TarballFormat)
+	}
+	if o.TarballFormat == "" {
+		o.TarballFormat = TarballFormatTar
+	}
+	if err := validateTarballFormat(o.TarballFormat); err != nil {
+		return fmt.Errorf("invalid TarballFormat: %w", err)
+	}
+	if o.EmbedManifest && !o.genTarball() {
+		return fmt.Errorf("OutputTarball or TarballWriter is required because EmbedManifest was specified")
+	}
+	if o.BazelrcOutput == "" && (o.Bazelrc.ConfigsURL != "" || o.Bazelrc.RemoteExecutor != "" || o.Bazelrc.RemoteInstance != "" || o.Bazelrc.GoogleCredentials) {
+		return fmt.Errorf("BazelrcOutput is required because Bazelrc options were specified")
+	}
+	if e := o.Bazelrc.RemoteExecutor; e != "" && !strings.HasPrefix(e, "grpc://") && !strings.HasPrefix(e, "grpcs://") {
+		return fmt.Errorf("Bazelrc.RemoteExecutor %q must start with grpc:// or grpcs://", e)
 	}
 	if o.OutputSourceRoot == "" && o.OutputConfigPath != "" {
 		return fmt.Errorf("OutputSourceRoot is required because OutputConfigPath was specified")
@@ -258,38 +920,362 @@ func (o *Options) Validate() error {
 	if o.PlatformParams == nil {
 		return fmt.Errorf("PlatformParams was not initialized")
 	}
+	applyPlatformCPUs(o)
 	if !o.GenCPPConfigs && !o.GenJavaConfigs {
 		return fmt.Errorf("both GenCPPConfigs & GenJavaConfigs were set to false which means there's no configs to generate")
 	}
+	if len(o.Only) != 0 && !strListContains(onlyKinds, o.Only) {
+		return fmt.Errorf("invalid Only, got %q, want one of %s", o.Only, strings.Join(onlyKinds, ", "))
+	}
+	if o.Only == OnlyCC && !o.GenCPPConfigs {
+		return fmt.Errorf("Only was %q but GenCPPConfigs was false", o.Only)
+	}
+	if o.Only == OnlyJava && !o.GenJavaConfigs {
+		return fmt.Errorf("Only was %q but GenJavaConfigs was false", o.Only)
+	}
+	if o.Only == OnlyRust && !o.GenRustConfigs {
+		return fmt.Errorf("Only was %q but GenRustConfigs was false", o.Only)
+	}
+	if o.GenRustConfigs && o.ExecOS != OSLinux {
+		return fmt.Errorf("GenRustConfigs is only supported for ExecOS %q, got %q", OSLinux, o.ExecOS)
+	}
 	if o.GenCPPConfigs && len(o.CPPConfigTargets) == 0 {
 		return fmt.Errorf("GenCPPConfigs was true but CppConfigTargets was not specified")
 	}
 	if o.GenCPPConfigs && len(o.CppBazelCmd) == 0 {
 		return fmt.Errorf("GenCPPConfigs was true but CppBazelCmd was not specified")
 	}
+	if o.NoShell {
+		if o.ExecOS != OSLinux {
+			return fmt.Errorf("NoShell is only supported for ExecOS %q, got %q", OSLinux, o.ExecOS)
+		}
+		if o.ProbeHelper == "" {
+			return fmt.Errorf("ProbeHelper is required because NoShell was specified")
+		}
+		if s, err := os.Stat(o.ProbeHelper); err != nil {
+			return fmt.Errorf("unable to access ProbeHelper %q: %w", o.ProbeHelper, err)
+		} else if !s.Mode().IsRegular() {
+			return fmt.Errorf("ProbeHelper %q is not a regular file", o.ProbeHelper)
+		}
+	}
+	if o.SimulateRBE {
+		if o.ExecOS != OSLinux {
+			return fmt.Errorf("SimulateRBE is only supported for ExecOS %q, got %q", OSLinux, o.ExecOS)
+		}
+		if !o.GenCPPConfigs && !o.GenJavaConfigs {
+			return fmt.Errorf("SimulateRBE was specified but neither GenCPPConfigs nor GenJavaConfigs was true")
+		}
+		if o.NoShell {
+			return fmt.Errorf("SimulateRBE can't be specified with NoShell because Bazel needs a shell in the toolchain container")
+		}
+		if len(o.Only) != 0 && o.Only != OnlyAll {
+			return fmt.Errorf("SimulateRBE needs all the configs but Only=%q was specified", o.Only)
+		}
+		if isCrossCompiling(o) {
+			return fmt.Errorf("SimulateRBE can't be specified when cross-compiling to TargetCPU %q because the built binaries don't run on the platform of the toolchain container", o.TargetCPU)
+		}
+	}
+	if len(o.JavaCompat) != 0 && !strListContains(javaCompatModes, o.JavaCompat) {
+		return fmt.Errorf("invalid JavaCompat, got %q, want one of %s", o.JavaCompat, strings.Join(javaCompatModes, ", "))
+	}
+	if o.JavaCompat == JavaCompatBoth {
+		if !o.GenJavaConfigs {
+			return fmt.Errorf("JavaCompat was %q but GenJavaConfigs was false", o.JavaCompat)
+		}
+		if o.JavaUseLocalRuntime || o.ForceLocalJavaRuntime != nil {
+			return fmt.Errorf("JavaCompat %q can't be specified with JavaUseLocalRuntime or ForceLocalJavaRuntime because it uses both Java toolchain rules", o.JavaCompat)
+		}
+		// Bazel 7.0.0 removed --javabase so there's nothing to be compatible with.
+		bv, err := bazelCoreVersion(o.BazelVersion)
+		if err != nil {
+			return fmt.Errorf("unable to determine whether Bazel %q supports --javabase: %w", o.BazelVersion, err)
+		}
+		if !bv.LessThan(*semver.New("7.0.0")) {
+			return fmt.Errorf("JavaCompat %q is only supported for Bazel versions < 7.0.0 which still support --javabase, got %q", o.JavaCompat, o.BazelVersion)
+		}
+	}
+	if len(o.JavaHome) != 0 {
+		if !o.GenJavaConfigs {
+			return fmt.Errorf("JavaHome was specified but GenJavaConfigs was false")
+		}
+		if o.ExecOS == OSLinux && !path.IsAbs(o.JavaHome) {
+			return fmt.Errorf("JavaHome must be an absolute path inside the toolchain container, got %q", o.JavaHome)
+		}
+	}
+	if len(o.JavaTargetVersion) != 0 && len(o.JavaSourceVersion) == 0 {
+		return fmt.Errorf("JavaTargetVersion=%q was specified without a JavaSourceVersion", o.JavaTargetVersion)
+	}
+	if len(o.JavaSourceVersion) != 0 {
+		if !o.GenJavaConfigs {
+			return fmt.Errorf("JavaSourceVersion was specified but GenJavaConfigs was false")
+		}
+		if len(o.JavaTargetVersion) == 0 {
+			o.JavaTargetVersion = o.JavaSourceVersion
+		}
+		for _, v := range []string{o.JavaSourceVersion, o.JavaTargetVersion} {
+			if !javaLanguageVersionRegexp.MatchString(v) {
+				return fmt.Errorf("invalid JavaSourceVersion or JavaTargetVersion %q, want a Java release like 11", v)
+			}
+		}
+		// Both versions are numbers after matching javaLanguageVersionRegexp.
+		s, _ := strconv.Atoi(o.JavaSourceVersion)
+		t, _ := strconv.Atoi(o.JavaTargetVersion)
+		if t < s {
+			return fmt.Errorf("JavaTargetVersion=%q must not be older than JavaSourceVersion=%q", o.JavaTargetVersion, o.JavaSourceVersion)
+		}
+		u, err := usesLocalJavaRuntime(o)
+		if err != nil {
+			return err
+		}
+		if !u && o.JavaCompat != JavaCompatBoth {
+			return fmt.Errorf("JavaSourceVersion requires the local_java_runtime rule which Bazel %q doesn't use, specify JavaUseLocalRuntime to use it anyway", o.BazelVersion)
+		}
+	}
 	if len(o.CppGenEnv) != 0 && len(o.CppGenEnvJSON) != 0 {
 		return fmt.Errorf("only one of CppGenEnv=%v or CppGenEnvJSON=%q must be specified", o.CppGenEnv, o.CppGenEnvJSON)
 	}
-	log.Printf("rbeconfigsgen.Options:")
-	log.Printf("BazelVersion=%q", o.BazelVersion)
-	log.Printf("ToolchainContainer=%q", o.ToolchainContainer)
-	log.Printf("ExecOS=%q", o.ExecOS)
-	log.Printf("TargetOS=%q", o.TargetOS)
-	log.Printf("DockerPlatform=%q", o.DockerPlatform)
-	log.Printf("OutputTarball=%q", o.OutputTarball)
-	log.Printf("OutputSourceRoot=%q", o.OutputSourceRoot)
-	log.Printf("OutputConfigPath=%q", o.OutputConfigPath)
-	log.Printf("OutputManifest=%q", o.OutputManifest)
-	log.Printf("PlatformParams=%v", *o.PlatformParams)
-	log.Printf("GenCPPConfigs=%v", o.GenCPPConfigs)
-	log.Printf("CPPConfigTargets=%v", o.CPPConfigTargets)
-	log.Printf("CPPConfigRepo=%q", o.CPPConfigRepo)
-	log.Printf("CppBazelCmd=%q", o.CppBazelCmd)
-	log.Printf("CppGenEnv=%v", o.CppGenEnv)
-	log.Printf("CppGenEnvJSON=%q", o.CppGenEnvJSON)
-	log.Printf("GenJavaConfigs=%v", o.GenJavaConfigs)
-	log.Printf("JavaUseLocalRuntime=%v", o.JavaUseLocalRuntime)
-	log.Printf("TempWorkDir=%q", o.TempWorkDir)
-	log.Printf("Cleanup=%v", o.Cleanup)
+	if len(o.CppCompiler) != 0 {
+		if !o.GenCPPConfigs {
+			return fmt.Errorf("CppCompiler was specified but GenCPPConfigs was false")
+		}
+		if o.ExecOS != OSLinux {
+			return fmt.Errorf("CppCompiler is only supported for ExecOS %q, got %q", OSLinux, o.ExecOS)
+		}
+		if !strListContains(cppCompilerNames, o.CppCompiler) {
+			return fmt.Errorf("invalid CppCompiler, got %q, want one of %s", o.CppCompiler, strings.Join(cppCompilerNames, ", "))
+		}
+		if isCrossCompiling(o) {
+			return fmt.Errorf("CppCompiler can't be specified when cross-compiling to TargetCPU %q because the cross compiler for the target is used", o.TargetCPU)
+		}
+	}
+	if len(o.CppStdlib) != 0 {
+		if !o.GenCPPConfigs {
+			return fmt.Errorf("CppStdlib was specified but GenCPPConfigs was false")
+		}
+		if o.ExecOS != OSLinux {
+			return fmt.Errorf("CppStdlib is only supported for ExecOS %q, got %q", OSLinux, o.ExecOS)
+		}
+		if !strListContains(cppStdlibNames, o.CppStdlib) {
+			return fmt.Errorf("invalid CppStdlib, got %q, want one of %s", o.CppStdlib, strings.Join(cppStdlibNames, ", "))
+		}
+		// GCC doesn't support -stdlib.
+		if o.CppCompiler == "gcc" || o.CppCompiler == "g++" {
+			return fmt.Errorf("CppStdlib requires clang but CppCompiler was %q", o.CppCompiler)
+		}
+		if isCrossCompiling(o) {
+			return fmt.Errorf("CppStdlib can't be specified when cross-compiling to TargetCPU %q because the GCC cross compiler for the target doesn't support -stdlib", o.TargetCPU)
+		}
+	}
+	if len(o.CppFeatures) != 0 || len(o.ExtraCppFeatures) != 0 {
+		if !o.GenCPPConfigs {
+			return fmt.Errorf("CppFeatures or ExtraCppFeatures were specified but GenCPPConfigs was false")
+		}
+		if o.ExecOS != OSLinux {
+			return fmt.Errorf("CppFeatures & ExtraCppFeatures are only supported for ExecOS %q, got %q", OSLinux, o.ExecOS)
+		}
+	}
+	if len(o.CppActions) != 0 {
+		if !o.GenCPPConfigs {
+			return fmt.Errorf("CppActions were specified but GenCPPConfigs was false")
+		}
+		if o.ExecOS != OSLinux {
+			return fmt.Errorf("CppActions are only supported for ExecOS %q, got %q", OSLinux, o.ExecOS)
+		}
+		seen := make(map[string]bool)
+		for _, a := range o.CppActions {
+			if !strListContains(cppActionGroups, a) {
+				return fmt.Errorf("invalid CppActions, got %q, want any of %s", a, strings.Join(cppActionGroups, ", "))
+			}
+			if seen[a] {
+				return fmt.Errorf("CppActions %q was specified more than once", a)
+			}
+			seen[a] = true
+		}
+	}
+	if len(o.LinkerFlags) != 0 {
+		if !o.GenCPPConfigs {
+			return fmt.Errorf("LinkerFlags were specified but GenCPPConfigs was false")
+		}
+		if o.ExecOS != OSLinux {
+			return fmt.Errorf("LinkerFlags are only supported for ExecOS %q, got %q", OSLinux, o.ExecOS)
+		}
+	}
+	if len(o.ExcludeCxxBuiltinIncludeDirectories) != 0 {
+		if !o.GenCPPConfigs {
+			return fmt.Errorf("ExcludeCxxBuiltinIncludeDirectories were specified but GenCPPConfigs was false")
+		}
+		if o.ExecOS != OSLinux {
+			return fmt.Errorf("ExcludeCxxBuiltinIncludeDirectories are only supported for ExecOS %q, got %q", OSLinux, o.ExecOS)
+		}
+		if len(o.CxxBuiltinIncludeDirectories) != 0 {
+			return fmt.Errorf("ExcludeCxxBuiltinIncludeDirectories can't be specified with CxxBuiltinIncludeDirectories which replaces the detected builtin include directories entirely")
+		}
+	}
+	if o.ReplaceLinkerFlags && len(o.LinkerFlags) == 0 {
+		return fmt.Errorf("ReplaceLinkerFlags was specified without any LinkerFlags to replace the detected link flags with")
+	}
+	for f := range o.CppFeatures {
+		if !strListContains(knownCppFeatures, f) {
+			return fmt.Errorf("invalid CppFeatures, got feature %q, want one of %s", f, strings.Join(knownCppFeatures, ", "))
+		}
+	}
+	for _, f := range o.ExtraCppFeatures {
+		if !strings.HasPrefix(strings.TrimSpace(f), "feature(") && !cppFeatureNameRegexp.MatchString(f) {
+			return fmt.Errorf("invalid ExtraCppFeatures, got %q, want a feature name or a Starlark feature(...) expression", f)
+		}
+	}
+	o.log.Debugf("rbeconfigsgen.Options:")
+	o.log.Debugf("BazelVersion=%q", o.BazelVersion)
+	o.log.Debugf("SkipVersionCheck=%v", o.SkipVersionCheck)
+	o.log.Debugf("MinBazelVersion=%q", o.MinBazelVersion)
+	o.log.Debugf("MaxBazelVersion=%q", o.MaxBazelVersion)
+	o.log.Debugf("ToolchainContainer=%q", o.ToolchainContainer)
+	o.log.Debugf("RequireDigest=%v", o.RequireDigest)
+	o.log.Debugf("PlatformImageOverride=%q", o.PlatformImageOverride)
+	o.log.Debugf("PlatformConstraints=%v", o.PlatformConstraints)
+	o.log.Debugf("DockerNetwork=%q", o.DockerNetwork)
+	o.log.Debugf("DockerRunAsRoot=%v", o.DockerRunAsRoot)
+	o.log.Debugf("DockerPrivileged=%v", o.DockerPrivileged)
+	o.log.Debugf("IsolateProbes=%v", o.IsolateProbes)
+	o.log.Debugf("RunEntrypoint=%v", o.RunEntrypoint)
+	o.log.Debugf("InitCommand=%q", o.InitCommand)
+	o.log.Debugf("ContainerTmpfsSize=%q", o.ContainerTmpfsSize)
+	o.log.Debugf("ScratchMount=%q", o.ScratchMount)
+	o.log.Debugf("ContainerRunFlags=%q", redactContainerRunFlags(o.ContainerRunFlags))
+	o.log.Debugf("DetectResources=%v", o.DetectResources)
+	o.log.Debugf("SupportsWorkers=%v", o.SupportsWorkers)
+	o.log.Debugf("WorkerKeyMnemonics=%v", o.WorkerKeyMnemonics)
+	o.log.Debugf("ImageTarball=%q", o.ImageTarball)
+	o.log.Debugf("ExistingContainer=%q", o.ExistingContainer)
+	o.log.Debugf("Dockerfile=%q", o.Dockerfile)
+	o.log.Debugf("ApptainerImage=%q", o.ApptainerImage)
+	o.log.Debugf("BuildContext=%q", o.BuildContext)
+	o.log.Debugf("RegistryCACert=%q", o.RegistryCACert)
+	o.log.Debugf("InsecureRegistry=%v", o.InsecureRegistry)
+	o.log.Debugf("HTTPUserAgent=%q", o.HTTPUserAgent)
+	o.log.Debugf("BazeliskSHA256=%q", o.BazeliskSHA256)
+	o.log.Debugf("ExecOS=%q", o.ExecOS)
+	o.log.Debugf("TargetOS=%q", o.TargetOS)
+	o.log.Debugf("ExecCPU=%q", o.ExecCPU)
+	o.log.Debugf("TargetCPU=%q", o.TargetCPU)
+	o.log.Debugf("TargetSysroot=%q", o.TargetSysroot)
+	o.log.Debugf("DockerPlatform=%q", o.DockerPlatform)
+	o.log.Debugf("AllowEmulation=%v", o.AllowEmulation)
+	o.log.Debugf("NoShell=%v", o.NoShell)
+	o.log.Debugf("ProbeHelper=%q", o.ProbeHelper)
+	o.log.Debugf("OutputTarball=%q", o.OutputTarball)
+	o.log.Debugf("TarballWriter=%v", o.TarballWriter != nil)
+	o.log.Debugf("TarballPrefix=%q", o.TarballPrefix)
+	o.log.Debugf("TarballFormat=%q", o.TarballFormat)
+	o.log.Debugf("OutputSourceRoot=%q", o.OutputSourceRoot)
+	o.log.Debugf("OutputConfigPath=%q", o.OutputConfigPath)
+	o.log.Debugf("NoTarball=%v", o.NoTarball)
+	o.log.Debugf("OutputManifest=%q", o.OutputManifest)
+	o.log.Debugf("EmbedManifest=%v", o.EmbedManifest)
+	o.log.Debugf("BazelrcOutput=%q", o.BazelrcOutput)
+	o.log.Debugf("Bazelrc=%+v", o.Bazelrc)
+	o.log.Debugf("RepoName=%q", o.RepoName)
+	o.log.Debugf("PlatformName=%q", o.PlatformName)
+	o.log.Debugf("OutputSummary=%q", o.OutputSummary)
+	o.log.Debugf("PostHook=%q", o.PostHook)
+	o.log.Debugf("SimulateRBE=%v", o.SimulateRBE)
+	o.log.Debugf("DumpDetectionFacts=%q", o.DumpDetectionFacts)
+	o.log.Debugf("ValidateOnly=%q", o.ValidateOnly)
+	o.log.Debugf("WarningsAsErrors=%v", o.WarningsAsErrors)
+	o.log.Debugf("PlatformParams=%v", *o.PlatformParams)
+	o.log.Debugf("GenCPPConfigs=%v", o.GenCPPConfigs)
+	o.log.Debugf("CPPConfigTargets=%v", o.CPPConfigTargets)
+	o.log.Debugf("CPPConfigRepo=%q", o.CPPConfigRepo)
+	o.log.Debugf("CppBazelCmd=%q", o.CppBazelCmd)
+	o.log.Debugf("CppGenEnv=%v", o.CppGenEnv)
+	o.log.Debugf("CppGenEnvJSON=%q", o.CppGenEnvJSON)
+	o.log.Debugf("CppCompiler=%q", o.CppCompiler)
+	o.log.Debugf("CppStdlib=%q", o.CppStdlib)
+	o.log.Debugf("CxxBuiltinIncludeDirectories=%v", o.CxxBuiltinIncludeDirectories)
+	o.log.Debugf("ExtraCxxBuiltinIncludeDirectories=%v", o.ExtraCxxBuiltinIncludeDirectories)
+	o.log.Debugf("ExcludeCxxBuiltinIncludeDirectories=%v", o.ExcludeCxxBuiltinIncludeDirectories)
+	o.log.Debugf("LinkerFlags=%v", o.LinkerFlags)
+	o.log.Debugf("ReplaceLinkerFlags=%v", o.ReplaceLinkerFlags)
+	o.log.Debugf("CppFeatures=%v", o.CppFeatures)
+	o.log.Debugf("ExtraCppFeatures=%v", o.ExtraCppFeatures)
+	o.log.Debugf("CppActions=%v", o.CppActions)
+	o.log.Debugf("VerifyCPP=%v", o.VerifyCPP)
+	o.log.Debugf("CppToolchainResolution=%v", o.CppToolchainResolution)
+	o.log.Debugf("GenJavaConfigs=%v", o.GenJavaConfigs)
+	o.log.Debugf("JavaUseLocalRuntime=%v", o.JavaUseLocalRuntime)
+	if o.ForceLocalJavaRuntime != nil {
+		o.log.Debugf("ForceLocalJavaRuntime=%v", *o.ForceLocalJavaRuntime)
+	}
+	o.log.Debugf("JavaCompat=%q", o.JavaCompat)
+	o.log.Debugf("StrictJavaVersion=%v", o.StrictJavaVersion)
+	o.log.Debugf("JavaHome=%q", o.JavaHome)
+	o.log.Debugf("JavaSourceVersion=%q", o.JavaSourceVersion)
+	o.log.Debugf("JavaTargetVersion=%q", o.JavaTargetVersion)
+	o.log.Debugf("GenRustConfigs=%v", o.GenRustConfigs)
+	o.log.Debugf("FormatBuildFiles=%v", o.FormatBuildFiles)
+	o.log.Debugf("BuildifierPath=%q", o.BuildifierPath)
+	o.log.Debugf("Only=%q", o.Only)
+	o.log.Debugf("TempWorkDir=%q", o.TempWorkDir)
+	o.log.Debugf("Cleanup=%v", o.Cleanup)
+	o.log.Debugf("CacheDir=%q", o.CacheDir)
+	o.log.Debugf("NoCache=%v", o.NoCache)
+	return nil
+}
+
+// genTarball returns whether the given options request generating a configs tarball.
+func (o *Options) genTarball() bool {
+	return o.OutputTarball != "" || o.TarballWriter != nil
+}
+
+// validateContainerRunFlags verifies the given ContainerRunFlags are in the --name=value form &
+// don't override the flags set by this tool.
+func validateContainerRunFlags(flags []string) error {
+	for _, f := range flags {
+		if !containerRunFlagRegexp.MatchString(f) {
+			return fmt.Errorf("invalid ContainerRunFlags %q, want a long flag with its value after =, e.g., --network=host or --env=FOO=bar", RedactContainerRunFlag(f))
+		}
+		if strListContains(reservedContainerRunFlags, strings.SplitN(f, "=", 2)[0]) {
+			return fmt.Errorf("ContainerRunFlags %q can't be specified because the flag is set by this tool", RedactContainerRunFlag(f))
+		}
+	}
 	return nil
 }
+
+// validatePlatformName defaults the given platform name to DefaultPlatformName if blank &
+// verifies it's a valid target name that doesn't collide with the other targets in the config
+// package.
+func validatePlatformName(name *string) error {
+	if *name == "" {
+		*name = DefaultPlatformName
+	}
+	if !targetNameRegexp.MatchString(*name) {
+		return fmt.Errorf("invalid PlatformName %q, must only contain letters, digits, '_', '-', '+' or '.' & not start with '-', '+' or '.'", *name)
+	}
+	if *name == "cc-toolchain" {
+		return fmt.Errorf("PlatformName %q collides with the C++ toolchain target in the config package", *name)
+	}
+	return nil
+}
+
+// writesConfigs returns whether config files of the given kind are written according to Only.
+func (o *Options) writesConfigs(kind string) bool {
+	return len(o.Only) == 0 || o.Only == OnlyAll || o.Only == kind
+}
+
+// detectionOptions returns a copy of the given options with C++, Java and/or Rust config
+// generation disabled if Only excludes their config files so the detection they need is skipped.
+func (o *Options) detectionOptions() *Options {
+	do := *o
+	do.GenCPPConfigs = o.GenCPPConfigs && o.writesConfigs(OnlyCC)
+	do.GenJavaConfigs = o.GenJavaConfigs && o.writesConfigs(OnlyJava)
+	do.GenRustConfigs = o.GenRustConfigs && o.writesConfigs(OnlyRust)
+	return &do
+}
+
+// tarballName returns the name of the configs tarball used in log & error messages.
+func (o *Options) tarballName() string {
+	if o.TarballWriter != nil {
+		return "<stream>"
+	}
+	return o.OutputTarball
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// missingUtilsScript prints the name of each of its arguments that isn't an executable in a
+// directory on the PATH of the toolchain container. Shell builtins like "test" don't count because
+// the utilities are run with docker exec instead of the shell.
+const missingUtilsScript = `for u in "$@"; do
+  found=
+  IFS=:
+  for p in $PATH; do
+    if [ -x "$p/$u" ]; then
+      found=1
+      break
+    fi
+  done
+  unset IFS
+  if [ -z "$found" ]; then
+    echo "$u"
+  fi
+done`
+
+// containerUtils returns the utilities run in a Linux toolchain container with a shell to
+// generate the configs requested by the given options. needsBazel is true if Bazel is run inside
+// the container, i.e., to generate the C++ configs.
+func containerUtils(o *Options, needsBazel bool) []string {
+	utils := []string{"mkdir", "test"}
+	if !needsBazel {
+		return utils
+	}
+	if o.BazelPath == "" {
+		// Bazelisk is made executable once it was copied into the container.
+		utils = append(utils, "chmod")
+	}
+	if o.GenCPPConfigs {
+		utils = append(utils, "touch", "find", "readlink", "ln", "tar")
+	}
+	return utils
+}
+
+// checkContainerUtils verifies the running Linux toolchain container represented by the given
+// docker runner has the given utilities before they're run so that minimal images fail with an
+// error naming the missing utilities. If only tar is missing, files are copied out of the
+// container with docker cp & archived locally instead. Nothing is checked if the runner uses the
+// probe helper or the container has no sh to check with.
+func checkContainerUtils(d *dockerRunner, utils []string) error {
+	if d.execOS != OSLinux || d.probeHelper != "" || len(utils) == 0 {
+		return nil
+	}
+	out, err := d.execCmd(append([]string{"sh", "-c", missingUtilsScript, "sh"}, utils...)...)
+	if err != nil {
+		d.log.Warningf("Unable to check whether the toolchain container has the utilities %s because it has no working sh, specify NoShell if config generation fails because one of them is missing: %v", strings.Join(utils, ", "), err)
+		return nil
+	}
+	var missing []string
+	for _, u := range strings.Fields(out) {
+		if u == "tar" {
+			d.noTar = true
+			continue
+		}
+		missing = append(missing, u)
+	}
+	if len(missing) != 0 {
+		return fmt.Errorf("the toolchain container doesn't have the utilities %s needed to generate configs, install them in the toolchain image or specify NoShell to use the probe helper instead", strings.Join(missing, ", "))
+	}
+	if d.noTar {
+		d.log.Warningf("The toolchain container doesn't have tar, generated files will be copied out of it with docker cp & archived locally instead.")
+	}
+	return nil
+}
+
+// copyDirFromContainerAsTarball writes the regular files in the given directory inside the
+// container to a local tarball at the given path without running tar inside the container. The
+// directory is copied into the given local temporary working directory with docker cp first.
+func copyDirFromContainerAsTarball(d *dockerRunner, dir, tempWorkDir, tarballPath string) error {
+	localDir := path.Join(tempWorkDir, strings.TrimSuffix(path.Base(tarballPath), path.Ext(tarballPath)))
+	if err := d.copyFromContainer(dir+"/.", localDir); err != nil {
+		return err
+	}
+	if err := dirToProbeTarball(localDir, tarballPath); err != nil {
+		return fmt.Errorf("unable to archive the files copied out of the container from %q: %w", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestCheckContainerUtils(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake docker client is a shell script")
+	}
+	utils := containerUtils(&Options{GenCPPConfigs: true}, true)
+	tests := []struct {
+		name string
+		// missing are the utilities the fake toolchain container doesn't have.
+		missing   []string
+		wantErr   string
+		wantNoTar bool
+	}{
+		{name: "All utilities"},
+		{name: "No tar", missing: []string{"tar"}, wantNoTar: true},
+		{name: "No find & tar", missing: []string{"find", "tar"}, wantErr: "utilities find needed"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			dir := t.TempDir()
+			// The PATH of the fake toolchain container has an executable for every utility that
+			// isn't missing.
+			binDir := filepath.Join(dir, "bin")
+			if err := os.Mkdir(binDir, 0755); err != nil {
+				t.Fatalf("Unable to create the PATH directory of the fake toolchain container: %v", err)
+			}
+			for _, u := range utils {
+				if strListContains(tc.missing, u) {
+					continue
+				}
+				if err := ioutil.WriteFile(filepath.Join(binDir, u), nil, 0755); err != nil {
+					t.Fatalf("Unable to write fake utility %q: %v", u, err)
+				}
+			}
+			// The fake docker client runs the command passed to docker exec locally with the PATH
+			// of the fake toolchain container.
+			dockerPath := filepath.Join(dir, "docker")
+			script := fmt.Sprintf("#!/bin/sh\nshift 2\nshell=\"$(command -v \"$1\")\"\nshift\nPATH=%q exec \"$shell\" \"$@\"\n", binDir)
+			if err := ioutil.WriteFile(dockerPath, []byte(script), 0755); err != nil {
+				t.Fatalf("Unable to write fake docker client: %v", err)
+			}
+			d := &dockerRunner{
+				dockerPath:  dockerPath,
+				containerID: "cid123",
+				execOS:      OSLinux,
+				ctx:         context.Background(),
+			}
+			err := checkContainerUtils(d, utils)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("checkContainerUtils() = %v, want error containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("checkContainerUtils() failed: %v", err)
+			}
+			if d.noTar != tc.wantNoTar {
+				t.Errorf("checkContainerUtils() set noTar to %v, want %v", d.noTar, tc.wantNoTar)
+			}
+		})
+	}
+}
+
+func TestContainerUtils(t *testing.T) {
+	tests := []struct {
+		name       string
+		o          *Options
+		needsBazel bool
+		want       []string
+	}{
+		{
+			name: "No Bazel",
+			o:    &Options{GenCPPConfigs: true},
+			want: []string{"mkdir", "test"},
+		},
+		{
+			name:       "C++ with Bazelisk",
+			o:          &Options{GenCPPConfigs: true},
+			needsBazel: true,
+			want:       []string{"mkdir", "test", "chmod", "touch", "find", "readlink", "ln", "tar"},
+		},
+		{
+			name:       "Preinstalled Bazel without C++",
+			o:          &Options{BazelPath: "/usr/bin/bazel"},
+			needsBazel: true,
+			want:       []string{"mkdir", "test"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := containerUtils(tc.o, tc.needsBazel); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("containerUtils() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+const (
+	// ProbeCmd is the first argument the probe helper is invoked with inside the toolchain
+	// container. Binaries used as the probe helper must call RunProbe with the remaining arguments
+	// when invoked with it.
+	ProbeCmd = "probe"
+	// probeContainerPath is the path the probe helper is copied to inside the toolchain container.
+	probeContainerPath = "/rbe_configs_gen_probe"
+)
+
+// probeCmds are the commands implemented by RunProbe in place of the shell & the shell utilities
+// used to probe toolchain containers. Each receives the arguments after the command name.
+var probeCmds = map[string]func(args []string, stdout io.Writer) error{
+	// sleep blocks until the process is terminated, i.e., keeps the container running.
+	"sleep": func(_ []string, _ io.Writer) error {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+		<-c
+		return nil
+	},
+	// mkdir creates the given directories.
+	"mkdir": func(args []string, _ io.Writer) error {
+		for _, a := range args {
+			if err := os.Mkdir(a, os.ModePerm); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// touch creates the given files if they don't exist.
+	"touch": func(args []string, _ io.Writer) error {
+		for _, a := range args {
+			f, err := os.OpenFile(a, os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// exists fails if any of the given paths doesn't exist.
+	"exists": func(args []string, _ io.Writer) error {
+		for _, a := range args {
+			if _, err := os.Stat(a); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// chmod+x marks the given files as executable.
+	"chmod+x": func(args []string, _ io.Writer) error {
+		for _, a := range args {
+			s, err := os.Stat(a)
+			if err != nil {
+				return err
+			}
+			if err := os.Chmod(a, s.Mode()|0111); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// cat prints the contents of the given files.
+	"cat": func(args []string, stdout io.Writer) error {
+		for _, a := range args {
+			blob, err := ioutil.ReadFile(a)
+			if err != nil {
+				return err
+			}
+			if _, err := stdout.Write(blob); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// find-compilers prints the compilers with the given names, cppCompilerNames if none were
+	// given, like the script returned by findCppCompilersScript.
+	"find-compilers": func(args []string, stdout io.Writer) error {
+		names := args
+		if len(names) == 0 {
+			names = cppCompilerNames
+		}
+		for _, c := range names {
+			if p := findCompiler(c); p != "" {
+				fmt.Fprintf(stdout, "%s %s\n", c, p)
+			}
+		}
+		return nil
+	},
+	// find-symlinks prints the paths of the symlinks in the given directory.
+	"find-symlinks": func(args []string, stdout io.Writer) error {
+		if len(args) != 1 {
+			return fmt.Errorf("want 1 directory, got %d arguments", len(args))
+		}
+		return filepath.Walk(args[0], func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				fmt.Fprintln(stdout, p)
+			}
+			return nil
+		})
+	},
+	// readlink prints the target of the given symlink.
+	"readlink": func(args []string, stdout io.Writer) error {
+		if len(args) != 1 {
+			return fmt.Errorf("want 1 symlink, got %d arguments", len(args))
+		}
+		t, err := os.Readlink(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, t)
+		return nil
+	},
+	// ln-f replaces the given link with a hard link to the given target like 'ln -f'.
+	"ln-f": func(args []string, _ io.Writer) error {
+		if len(args) != 2 {
+			return fmt.Errorf("want a target & a link, got %d arguments", len(args))
+		}
+		if err := os.Remove(args[1]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return os.Link(args[0], args[1])
+	},
+	// tar writes a tarball at the first argument with the regular files in the directory given as
+	// the second argument like 'tar -cf <tarball> -C <dir> .'.
+	"tar": func(args []string, _ io.Writer) error {
+		if len(args) != 2 {
+			return fmt.Errorf("want a tarball & a directory, got %d arguments", len(args))
+		}
+		return dirToProbeTarball(args[1], args[0])
+	},
+	// rm deletes the given paths recursively.
+	"rm": func(args []string, _ io.Writer) error {
+		for _, a := range args {
+			if err := os.RemoveAll(a); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// RunProbe runs the probe helper command with the given arguments, i.e., the name of the command
+// followed by its arguments, & writes the output to stdout. The probe helper performs the
+// operations that otherwise rely on the shell & shell utilities in toolchain containers without
+// them, e.g., distroless images, if the NoShell option is set.
+func RunProbe(args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no probe command was specified")
+	}
+	c, ok := probeCmds[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown probe command %q", args[0])
+	}
+	if err := c(args[1:], stdout); err != nil {
+		return fmt.Errorf("probe command %q failed: %w", args[0], err)
+	}
+	return nil
+}
+
+// findCompiler returns the path of the compiler with the given name on the PATH or in one of
+// cppCompilerDirs or "" if it wasn't found.
+func findCompiler(name string) string {
+	if p, err := exec.LookPath(name); err == nil {
+		if a, err := filepath.Abs(p); err == nil {
+			return a
+		}
+	}
+	for _, d := range cppCompilerDirs {
+		dirs, err := filepath.Glob(d)
+		if err != nil {
+			continue
+		}
+		sort.Strings(dirs)
+		for _, dir := range dirs {
+			p := filepath.Join(dir, name)
+			if s, err := os.Stat(p); err == nil && s.Mode().IsRegular() && s.Mode()&0111 != 0 {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+// dirToProbeTarball writes the regular files in the given directory to a tarball at the given
+// path with names relative to the directory.
+func dirToProbeTarball(dir, tarballPath string) error {
+	out, err := os.Create(tarballPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	outTar := tar.NewWriter(out)
+	if err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || p == tarballPath {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if err := outTar.WriteHeader(&tar.Header{
+			Name:    filepath.ToSlash(rel),
+			Size:    info.Size(),
+			Mode:    int64(info.Mode().Perm()),
+			ModTime: time.Unix(0, 0),
+		}); err != nil {
+			return err
+		}
+		in, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		_, err = io.Copy(outTar, in)
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := outTar.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,133 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// runProbe runs the given probe command & returns its output, failing the test on errors.
+func runProbe(t *testing.T, args ...string) string {
+	t.Helper()
+	var out bytes.Buffer
+	if err := RunProbe(args, &out); err != nil {
+		t.Fatalf("RunProbe(%v) failed: %v", args, err)
+	}
+	return out.String()
+}
+
+func TestRunProbe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "probe_test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	work := filepath.Join(dir, "work")
+	runProbe(t, "mkdir", work)
+	file := filepath.Join(work, "BUILD")
+	runProbe(t, "touch", file)
+	runProbe(t, "exists", work, file)
+	if err := ioutil.WriteFile(file, []byte("cc_library()\n"), 0644); err != nil {
+		t.Fatalf("Failed to write %q: %v", file, err)
+	}
+	if got := runProbe(t, "cat", file); got != "cc_library()\n" {
+		t.Errorf("cat %q=%q, want %q", file, got, "cc_library()\n")
+	}
+
+	link := filepath.Join(work, "link")
+	if err := os.Symlink(file, link); err != nil {
+		t.Fatalf("Failed to create symlink %q: %v", link, err)
+	}
+	if got := runProbe(t, "find-symlinks", work); got != link+"\n" {
+		t.Errorf("find-symlinks %q=%q, want %q", work, got, link+"\n")
+	}
+	if got := runProbe(t, "readlink", link); got != file+"\n" {
+		t.Errorf("readlink %q=%q, want %q", link, got, file+"\n")
+	}
+	runProbe(t, "ln-f", file, link)
+	if s, err := os.Lstat(link); err != nil || s.Mode()&os.ModeSymlink != 0 {
+		t.Errorf("ln-f didn't replace symlink %q with a hard link: %v", link, err)
+	}
+
+	tarball := filepath.Join(dir, "out.tar")
+	runProbe(t, "tar", tarball, work)
+	f, err := os.Open(tarball)
+	if err != nil {
+		t.Fatalf("Failed to open %q: %v", tarball, err)
+	}
+	defer f.Close()
+	var names []string
+	r := tar.NewReader(f)
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read %q: %v", tarball, err)
+		}
+		names = append(names, h.Name)
+	}
+	if want := []string{"BUILD", "link"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("tar %q had files %v, want %v", tarball, names, want)
+	}
+
+	runProbe(t, "rm", work)
+	if err := RunProbe([]string{"exists", work}, ioutil.Discard); err == nil {
+		t.Errorf("exists %q succeeded after rm, want error", work)
+	}
+}
+
+func TestRunProbeErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		wantErrMsg string
+	}{
+		{
+			name:       "No command",
+			wantErrMsg: "no probe command",
+		},
+		{
+			name:       "Unknown command",
+			args:       []string{"bash"},
+			wantErrMsg: `unknown probe command "bash"`,
+		},
+		{
+			name:       "Wrong arguments",
+			args:       []string{"readlink"},
+			wantErrMsg: "want 1 symlink",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			err := RunProbe(tc.args, ioutil.Discard)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErrMsg) {
+				t.Errorf("RunProbe(%v)=%v, want error containing %q", tc.args, err, tc.wantErrMsg)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bazelbuild/bazel-toolchains/pkg/logging"
+)
+
+var (
+	// pullProgressInterval is how often the progress of pulling the toolchain image is reported.
+	pullProgressInterval = 5 * time.Second
+
+	// pullLayerRegexp matches the status lines docker pull prints for every layer of the image,
+	// e.g., "a1b2c3d4e5f6: Pull complete", & captures the layer ID & the status.
+	pullLayerRegexp = regexp.MustCompile(`^([0-9a-f]{12,}): (.+)$`)
+)
+
+// pullReporter is called periodically while the toolchain image is pulled with the number of
+// layers pulled so far, the number of layers of the image known so far & how long the pull has
+// been running.
+type pullReporter func(pulled, total int, elapsed time.Duration)
+
+// layerProgress tracks which layers of an image being pulled are complete from the output of
+// docker pull.
+type layerProgress struct {
+	mu sync.Mutex
+	// layers maps the IDs of the layers seen so far to whether they're complete.
+	layers map[string]bool
+}
+
+// update records the status of a layer from the given line of docker pull output. Returns the
+// layer ID & status or false if the line isn't the status of a layer.
+func (p *layerProgress) update(line string) (string, string, bool) {
+	m := pullLayerRegexp.FindStringSubmatch(strings.TrimSpace(line))
+	if m == nil {
+		return "", "", false
+	}
+	id, status := m[1], m[2]
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.layers == nil {
+		p.layers = make(map[string]bool)
+	}
+	p.layers[id] = p.layers[id] || status == "Pull complete" || status == "Already exists"
+	return id, status, true
+}
+
+// counts returns the number of complete layers & the number of layers seen so far.
+func (p *layerProgress) counts() (int, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pulled := 0
+	for _, done := range p.layers {
+		if done {
+			pulled++
+		}
+	}
+	return pulled, len(p.layers)
+}
+
+// pullImage pulls the given image using the docker binary at the given path, calling the given
+// reporter every pullProgressInterval until the pull completes. Like runCmd, the output is logged
+// if the pull fails & docker is killed if the given context is done.
+func pullImage(ctx context.Context, log *logging.Logger, dockerPath, image string, report pullReporter) error {
+	log.Debugf("Running: '%s pull %s'", dockerPath, image)
+	c := exec.CommandContext(ctx, dockerPath, "pull", image)
+	r, w := io.Pipe()
+	c.Stdout, c.Stderr = w, w
+	if err := c.Start(); err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	p := &layerProgress{}
+	scanned := make(chan struct{})
+	go func() {
+		defer close(scanned)
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			out.WriteString(s.Text() + "\n")
+			if id, status, ok := p.update(s.Text()); ok {
+				log.Debugf("Layer %s of %q: %s.", id, image, status)
+			}
+		}
+		// Keep draining the output so docker doesn't block if a line was too long to scan.
+		io.Copy(ioutil.Discard, r)
+	}()
+	waited := make(chan error, 1)
+	go func() {
+		err := c.Wait()
+		w.Close()
+		waited <- err
+	}()
+
+	start := time.Now()
+	t := time.NewTicker(pullProgressInterval)
+	defer t.Stop()
+	for {
+		select {
+		case err := <-waited:
+			<-scanned
+			if err != nil {
+				log.Warningf("Output: %s", out.String())
+				return &cmdError{err: err, output: out.String()}
+			}
+			_, total := p.counts()
+			log.Infof("Pulled toolchain image %q with %d layers in %v.", image, total, time.Since(start).Round(time.Second))
+			return nil
+		case <-t.C:
+			pulled, total := p.counts()
+			report(pulled, total, time.Since(start))
+		}
+	}
+}
+
+// pullProgressReporter returns the reporter logging the progress of pulling the given image &
+// notifying the Observer of the given options if it's a ProgressObserver.
+func pullProgressReporter(o *Options, image string) pullReporter {
+	return func(pulled, total int, elapsed time.Duration) {
+		if total == 0 {
+			o.log.Infof("Still pulling toolchain image %q after %v.", image, elapsed.Round(time.Second))
+		} else {
+			o.log.Infof("Still pulling toolchain image %q after %v: %d of %d layers pulled.", image, elapsed.Round(time.Second), pulled, total)
+		}
+		o.progress(StagePull, StageProgress{Done: pulled, Total: total, Elapsed: elapsed})
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bazelbuild/bazel-toolchains/pkg/logging"
+)
+
+func TestLayerProgress(t *testing.T) {
+	p := &layerProgress{}
+	for _, l := range []string{
+		"latest: Pulling from google/rbe-ubuntu16-04",
+		"a1b2c3d4e5f6: Pulling fs layer",
+		"b1b2c3d4e5f6: Pulling fs layer",
+		"c1b2c3d4e5f6: Already exists",
+		"a1b2c3d4e5f6: Verifying Checksum",
+		"a1b2c3d4e5f6: Download complete",
+		"a1b2c3d4e5f6: Pull complete",
+		"b1b2c3d4e5f6: Downloading",
+		"Digest: sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+	} {
+		p.update(l)
+	}
+	if pulled, total := p.counts(); pulled != 2 || total != 3 {
+		t.Errorf("counts()=(%d, %d), want (2, 3)", pulled, total)
+	}
+	if _, _, ok := p.update("Status: Downloaded newer image for gcr.io/foo/bar:latest"); ok {
+		t.Errorf("update() parsed a line that isn't the status of a layer")
+	}
+}
+
+func TestPullImageProgress(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake docker client is a shell script")
+	}
+	dockerPath := filepath.Join(t.TempDir(), "docker")
+	// The fake docker client pulls one of two layers before pausing long enough for the progress
+	// to be reported.
+	script := "#!/bin/sh\necho 'a1b2c3d4e5f6: Pulling fs layer'\necho 'b1b2c3d4e5f6: Pulling fs layer'\necho 'a1b2c3d4e5f6: Pull complete'\nsleep 1\necho 'b1b2c3d4e5f6: Pull complete'\n"
+	if err := ioutil.WriteFile(dockerPath, []byte(script), 0755); err != nil {
+		t.Fatalf("Unable to write fake docker client: %v", err)
+	}
+	oldInterval := pullProgressInterval
+	pullProgressInterval = 100 * time.Millisecond
+	defer func() { pullProgressInterval = oldInterval }()
+
+	var mu sync.Mutex
+	var reports [][2]int
+	report := func(pulled, total int, _ time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		reports = append(reports, [2]int{pulled, total})
+	}
+	if err := pullImage(context.Background(), nil, dockerPath, "gcr.io/foo/bar:latest", report); err != nil {
+		t.Fatalf("pullImage() failed: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reports) == 0 {
+		t.Fatalf("pullImage() didn't report any progress")
+	}
+	if got := reports[len(reports)-1]; got != [2]int{1, 2} {
+		t.Errorf("pullImage() last reported %d of %d layers pulled, want 1 of 2", got[0], got[1])
+	}
+}
+
+func TestPullImageConcurrentLoggers(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake docker client is a shell script")
+	}
+	dockerPath := filepath.Join(t.TempDir(), "docker")
+	// The fake docker client fails to pull every image so the output naming the image is logged.
+	script := "#!/bin/sh\necho \"unable to pull $2\"\nexit 1\n"
+	if err := ioutil.WriteFile(dockerPath, []byte(script), 0755); err != nil {
+		t.Fatalf("Unable to write fake docker client: %v", err)
+	}
+	images := []string{"gcr.io/foo/a:latest", "gcr.io/foo/b:latest"}
+	observers := make([]*recordingObserver, len(images))
+	var wg sync.WaitGroup
+	for i, image := range images {
+		observers[i] = &recordingObserver{}
+		wg.Add(1)
+		go func(image string, log *logging.Logger) {
+			defer wg.Done()
+			if err := pullImage(context.Background(), log, dockerPath, image, func(int, int, time.Duration) {}); err == nil {
+				t.Errorf("pullImage(%q) succeeded, want error", image)
+			}
+		}(image, logging.NewLogger(observers[i].OnLog))
+	}
+	wg.Wait()
+	for i, image := range images {
+		want := []string{fmt.Sprintf("log Output: unable to pull %s\n", image)}
+		if !reflect.DeepEqual(observers[i].events, want) {
+			t.Errorf("Observer of the pull of %q received %q, want %q", image, observers[i].events, want)
+		}
+	}
+}
+
+func TestEnsurePulled(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake docker client is a shell script")
+	}
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "docker.log")
+	// The fake docker client records its arguments & reports an amd64 image on an amd64 server.
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %q\necho amd64\n", logPath)
+	dockerPath := filepath.Join(dir, "docker")
+	if err := ioutil.WriteFile(dockerPath, []byte(script), 0755); err != nil {
+		t.Fatalf("Unable to write fake docker client: %v", err)
+	}
+	d := newUnpulledDockerRunner(context.Background(), nil, "gcr.io/foo/bar:1.0", "sha256:"+strings.Repeat("a", 64), "", OSLinux, true, nil)
+	d.dockerPath = dockerPath
+	if want := "gcr.io/foo/bar@sha256:" + strings.Repeat("a", 64); d.resolvedImage != want {
+		t.Errorf("newUnpulledDockerRunner resolved the image to %q, want %q", d.resolvedImage, want)
+	}
+	timings := &StageTimings{}
+	o := &Options{ExecCPU: CPUX8664, Timings: timings}
+	if err := ensurePulled(d, o); err != nil {
+		t.Fatalf("ensurePulled failed: %v", err)
+	}
+	if d.unpulled || d.arch != "amd64" {
+		t.Errorf("ensurePulled left the runner with unpulled=%v & architecture %q, want a pulled amd64 image", d.unpulled, d.arch)
+	}
+	// The image is only pulled once.
+	if err := ensurePulled(d, o); err != nil {
+		t.Fatalf("ensurePulled of a pulled image failed: %v", err)
+	}
+	blob, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("Unable to read the fake docker client log: %v", err)
+	}
+	if n := strings.Count(string(blob), "pull "+d.resolvedImage); n != 1 {
+		t.Errorf("ensurePulled pulled %q %d times, want once, docker was invoked with:\n%s", d.resolvedImage, n, blob)
+	}
+	if s := timings.Stages(); len(s) != 1 || s[0].Stage != StagePull {
+		t.Errorf("ensurePulled recorded the stages %v, want a single %s stage", s, StagePull)
+	}
+}
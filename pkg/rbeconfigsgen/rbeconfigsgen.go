@@ -17,6 +17,7 @@ package rbeconfigsgen
 import (
 	"archive/tar"
 	"bytes"
+	"context"
 	"crypto/sha256"
 	_ "embed"
 	"encoding/hex"
@@ -24,17 +25,21 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
+	"github.com/bazelbuild/bazel-toolchains/pkg/logging"
 	"github.com/coreos/go-semver/semver"
 )
 
@@ -56,9 +61,27 @@ const (
 # This file is auto-generated by github.com/bazelbuild/bazel-toolchains/pkg/rbeconfigsgen
 # and should not be modified directly.
 `
+
+	// cleanupTimeout is how long removing the toolchain container is allowed to take.
+	cleanupTimeout = 30 * time.Second
+
+	// osUnknown is recorded as the OS distribution & version of toolchain containers where they
+	// couldn't be determined.
+	osUnknown = "unknown"
+
+	// bazeliskVersion is the release of Bazelisk downloaded to run Bazel unless a different release
+	// is requested.
+	bazeliskVersion = "v1.19.0"
 )
 
 var (
+	// bazelReleasesURL is the GitHub releases page of Bazel the releases ValidateBazelVersion looks
+	// up & the latest release used if BazelVersion isn't specified are under. Overridden in tests.
+	bazelReleasesURL = "https://github.com/bazelbuild/bazel/releases"
+	// bazeliskReleasesURL is where the executables of Bazelisk releases are downloaded from.
+	// Overridden in tests.
+	bazeliskReleasesURL = "https://github.com/bazelbuild/bazelisk/releases/download"
+
 	// platformsToolchainBuildTemplate is the template for the BUILD file with the crosstool top
 	// toolchain entrypoint target and the default platform definition.
 	platformsToolchainBuildTemplate = template.Must(template.New("platformsBuild").Parse(buildHeader + `
@@ -78,15 +101,17 @@ toolchain(
 ){{ end }}
 
 platform(
-    name = "platform",
+    name = "{{ .PlatformName }}",
     parents = ["@local_config_platform//:host"],
     constraint_values = [
 {{ range .ExecConstraints }}        "{{ . }}",
+{{ end }}{{ range .ExtraPlatformConstraints }}        "{{ . }}",
 {{ end }}    ],
     exec_properties = {
         "container-image": "docker://{{.ToolchainContainer}}",
         "OSFamily": "{{.OSFamily}}",
-    },
+{{ range .ExtraExecProperties }}        "{{ .Name }}": "{{ .Value }}",
+{{ end }}    },
 )
 `))
 	// legacyJavaBuildTemplate is the Java toolchain config BUILD file template for Bazel versions
@@ -104,7 +129,8 @@ java_runtime(
 	// javaBuildTemplateLt7 is the Java toolchain config BUILD file template for Bazel versions
 	// >=5.0.0 (tentative?) and < 7.0.0.
 	javaBuildTemplateLt7 = template.Must(template.New("javaBuild").Parse(buildHeader + `
-load("@bazel_tools//tools/jdk:local_java_repository.bzl", "local_java_runtime")
+{{ if .JavaSourceVersion }}load("@bazel_tools//tools/jdk:default_java_toolchain.bzl", "default_java_toolchain")
+{{ end }}load("@bazel_tools//tools/jdk:local_java_repository.bzl", "local_java_runtime")
 
 package(default_visibility = ["//visibility:public"])
 
@@ -118,14 +144,25 @@ local_java_runtime(
     java_home = "{{ .JavaHome }}",
     version = "{{ .JavaVersion }}",
 )
-`))
+{{ if .JavaSourceVersion }}
+# Java toolchain for --java_language_version={{ .JavaSourceVersion }} running on rbe_jdk.
+# Registered with --extra_toolchains, it takes precedence over the Java toolchains registered by
+# Bazel.
+default_java_toolchain(
+    name = "rbe_java_toolchain",
+    java_runtime = ":rbe_jdk",
+    source_version = "{{ .JavaSourceVersion }}",
+    target_version = "{{ .JavaTargetVersion }}",
+)
+{{ end }}`))
 
 	// javaBuildTemplate is the Java toolchain config BUILD file template for Bazel versions
 	// >=7.0.0 (including pre-releases).
 	// The difference between the older template is directly referencing to @rules_java
 	// instead of the indirection via @bazel_tools
 	javaBuildTemplate = template.Must(template.New("javaBuild").Parse(buildHeader + `
-load("@rules_java//toolchains:local_java_repository.bzl", "local_java_runtime")
+{{ if .JavaSourceVersion }}load("@rules_java//toolchains:default_java_toolchain.bzl", "default_java_toolchain")
+{{ end }}load("@rules_java//toolchains:local_java_repository.bzl", "local_java_runtime")
 
 package(default_visibility = ["//visibility:public"])
 
@@ -139,7 +176,88 @@ local_java_runtime(
     java_home = "{{ .JavaHome }}",
     version = "{{ .JavaVersion }}",
 )
-`))
+{{ if .JavaSourceVersion }}
+# Java toolchain for --java_language_version={{ .JavaSourceVersion }} running on rbe_jdk.
+# Registered with --extra_toolchains, it takes precedence over the Java toolchains registered by
+# Bazel.
+default_java_toolchain(
+    name = "rbe_java_toolchain",
+    java_runtime = ":rbe_jdk",
+    source_version = "{{ .JavaSourceVersion }}",
+    target_version = "{{ .JavaTargetVersion }}",
+)
+{{ end }}`))
+
+	// dualJavaBuildTemplate is the Java toolchain config BUILD file template for JavaCompatBoth
+	// defining both the java_runtime used as --javabase by Bazel versions <5.0.0 & the
+	// local_java_runtime based Java toolchains used by Bazel versions >=5.0.0 and < 7.0.0.
+	dualJavaBuildTemplate = template.Must(template.New("javaBuild").Parse(buildHeader + `
+{{ if .JavaSourceVersion }}load("@bazel_tools//tools/jdk:default_java_toolchain.bzl", "default_java_toolchain")
+{{ end }}load("@bazel_tools//tools/jdk:local_java_repository.bzl", "local_java_runtime")
+
+package(default_visibility = ["//visibility:public"])
+
+# Used with --javabase by Bazel versions < 5.0.0.
+java_runtime(
+    name = "jdk",
+    srcs = [],
+    java_home = "{{ .JavaHome }}",
+)
+
+# Used with --java_runtime_version=rbe_jdk by Bazel versions >= 5.0.0.
+local_java_runtime(
+    name = "rbe_jdk",
+    java_home = "{{ .JavaHome }}",
+    version = "{{ .JavaVersion }}",
+)
+{{ if .JavaSourceVersion }}
+# Java toolchain for --java_language_version={{ .JavaSourceVersion }} running on rbe_jdk.
+# Registered with --extra_toolchains, it takes precedence over the Java toolchains registered by
+# Bazel.
+default_java_toolchain(
+    name = "rbe_java_toolchain",
+    java_runtime = ":rbe_jdk",
+    source_version = "{{ .JavaSourceVersion }}",
+    target_version = "{{ .JavaTargetVersion }}",
+)
+{{ end }}`))
+
+	// javaTemplateMinMajorVersions is the minimum major version of the JDK in the toolchain
+	// container the Java toolchain defined by a Java toolchain config BUILD file template is
+	// expected to need, i.e., the JDKs the Java tools of the Bazel versions using the template are
+	// known to run with. Bazel doesn't document a minimum JDK for a java_runtime, so an older JDK
+	// is only reported as a warning unless StrictJavaVersion is specified. Templates not listed
+	// here aren't expected to need a minimum version.
+	javaTemplateMinMajorVersions = map[*template.Template]int{
+		javaBuildTemplateLt7:  11,
+		javaBuildTemplate:     17,
+		dualJavaBuildTemplate: 11,
+	}
+
+	// bazeliskPlatforms maps the OSs Bazelisk is released for to the CPU architectures it's
+	// released for on that OS.
+	bazeliskPlatforms = map[string][]string{
+		"darwin":  {"amd64", "arm64"},
+		OSLinux:   {"amd64", "arm64"},
+		OSWindows: {"amd64", "arm64"},
+	}
+
+	// bazeliskSHA256s maps Bazelisk releases to the hex encoded sha256 digests of their executables
+	// by OS & CPU architecture, e.g., "linux/amd64". Downloaded executables must match the listed
+	// digest. Executables without a listed digest are only downloaded if their digest is specified
+	// explicitly, e.g., with the BazeliskSHA256 option. No digests of bazeliskVersion are listed yet
+	// so its digest must be specified explicitly until they're copied from its GitHub release.
+	bazeliskSHA256s = map[string]map[string]string{
+		bazeliskVersion: {},
+	}
+	// sha256Regexp matches hex encoded sha256 digests.
+	sha256Regexp = regexp.MustCompile(`^[a-f0-9]{64}$`)
+
+	// bazeliskVersionRegexp matches Bazelisk release versions optionally prefixed with "v" like the
+	// tags of Bazelisk releases on GitHub, e.g., "v1.19.0" or "1.19.0".
+	bazeliskVersionRegexp = regexp.MustCompile(`^v?[0-9]+\.[0-9]+\.[0-9]+$`)
+	// bazelCoreVersionRegexp matches the major.minor.patch prefix of a Bazel version string.
+	bazelCoreVersionRegexp = regexp.MustCompile(`^[0-9]+\.[0-9]+\.[0-9]+`)
 
 	// imageDigestRegexp is the regex to extract the sha256 digest from a docker image name
 	// referenced by its digest.
@@ -160,17 +278,87 @@ type PlatformToolchainsTemplateParams struct {
 	CppToolchainTarget string
 	ToolchainContainer string
 	OSFamily           string
+	// PlatformName is the name of the platform target.
+	PlatformName string
+	// ExtraPlatformConstraints are user supplied constraint values only added to the platform.
+	ExtraPlatformConstraints []string
+	// ExtraExecProperties are exec properties added to the platform after the toolchain container
+	// & the OS family.
+	ExtraExecProperties []ExecProperty
+}
+
+// ExecProperty is an exec property of the generated platform.
+type ExecProperty struct {
+	Name  string
+	Value string
 }
 
 func (p PlatformToolchainsTemplateParams) String() string {
-	return fmt.Sprintf("{ExecConstraints: %v, TargetConstraints: %v, CppToolchainTarget: %q, ToolchainContainer: %q, OSFamily: %q}",
-		p.ExecConstraints, p.TargetConstraints, p.CppToolchainTarget, p.ToolchainContainer, p.OSFamily)
+	return fmt.Sprintf("{ExecConstraints: %v, TargetConstraints: %v, CppToolchainTarget: %q, ToolchainContainer: %q, OSFamily: %q, PlatformName: %q, ExtraPlatformConstraints: %v, ExtraExecProperties: %v}",
+		p.ExecConstraints, p.TargetConstraints, p.CppToolchainTarget, p.ToolchainContainer, p.OSFamily, p.PlatformName, p.ExtraPlatformConstraints, p.ExtraExecProperties)
 }
 
 // javaBuildTemplateParams is used as the input to the Java toolchains BUILD file template.
 type javaBuildTemplateParams struct {
 	JavaHome    string
 	JavaVersion string
+	// JavaSourceVersion & JavaTargetVersion are the source & target versions of the generated
+	// Java toolchain. No Java toolchain is generated if blank.
+	JavaSourceVersion string
+	JavaTargetVersion string
+}
+
+// detectionFacts are the details detected inside the toolchain container that are used to generate
+// configs. Facts can be cached across runs for the same toolchain image.
+type detectionFacts struct {
+	// CppConfigsTarball is the local path to the tarball containing the C++ configs generated by
+	// Bazel inside the toolchain container. The tarball is cached as a separate file.
+	CppConfigsTarball string `json:"-"`
+	// JavaHome is the value of JAVA_HOME in the toolchain image.
+	JavaHome string `json:"java_home,omitempty"`
+	// JavaVersion is the version of the JDK installed in JavaHome.
+	JavaVersion string `json:"java_version,omitempty"`
+	// OSID is the ID of the OS distribution in the toolchain container as reported by
+	// /etc/os-release, e.g., "ubuntu" or osUnknown if it couldn't be determined.
+	OSID string `json:"os_id,omitempty"`
+	// OSVersionID is the VERSION_ID of the OS distribution in the toolchain container as reported
+	// by /etc/os-release, e.g., "20.04" or osUnknown if it couldn't be determined.
+	OSVersionID string `json:"os_version_id,omitempty"`
+	// ResourceCPUs & ResourceMemory are the CPUs, e.g., "4", & memory, e.g., "16Gi", available to
+	// the toolchain container. Blank unless DetectResources was specified.
+	ResourceCPUs   string `json:"resource_cpus,omitempty"`
+	ResourceMemory string `json:"resource_memory,omitempty"`
+	// Libc is the C library in the toolchain container in the format of Bazel's target_libc, e.g.,
+	// "glibc_2.31". Blank if it couldn't be determined.
+	Libc string `json:"libc,omitempty"`
+	// CppCompiler is the name of the compiler used to generate the C++ configs, e.g., "clang".
+	// Blank if it couldn't be determined.
+	CppCompiler string `json:"cpp_compiler,omitempty"`
+	// CppCompilerPath is the path of CppCompiler in the toolchain container.
+	CppCompilerPath string `json:"cpp_compiler_path,omitempty"`
+	// CppCompilerVersion is the version of CppCompiler, e.g., "10.0.0" or osUnknown if it couldn't
+	// be determined.
+	CppCompilerVersion string `json:"cpp_compiler_version,omitempty"`
+	// LinkerVersion is the version of the linker used by CppCompiler, e.g., "2.34". Blank if it
+	// couldn't be determined.
+	LinkerVersion string `json:"linker_version,omitempty"`
+	// CppSysroot is the sysroot of the C++ cross compiler. Blank if not cross-compiling or the
+	// cross compiler doesn't use a sysroot.
+	CppSysroot string `json:"cpp_sysroot,omitempty"`
+	// RustcVersion is the release of rustc in the toolchain container, e.g., "1.75.0".
+	RustcVersion string `json:"rustc_version,omitempty"`
+	// RustHostTriple is the target triple rustc runs on, e.g., "x86_64-unknown-linux-gnu".
+	RustHostTriple string `json:"rust_host_triple,omitempty"`
+	// RustSysroot is the root of the Rust toolchain in the toolchain container.
+	RustSysroot string `json:"rust_sysroot,omitempty"`
+	// CargoVersion is the version of cargo next to rustc. Blank if cargo isn't installed.
+	CargoVersion string `json:"cargo_version,omitempty"`
+	// ImageArch is the CPU architecture of the toolchain image as reported by docker, e.g., "amd64",
+	// so it's known without pulling the image when the facts are loaded from the cache.
+	ImageArch string `json:"image_arch,omitempty"`
+	// Warnings are the warnings reported while detecting the facts so they're reported again when
+	// the facts are loaded from the cache.
+	Warnings []Warning `json:"warnings,omitempty"`
 }
 
 // dockerRunner allows starting a container for a given docker image and subsequently running
@@ -181,8 +369,23 @@ type dockerRunner struct {
 	// containerImage is the docker image to spin up as a running container. This could be a tagged
 	// or floating reference to a docker image but in a format acceptable to the docker client.
 	containerImage string
+	// dockerPlatform is passed as --platform when creating the container if set.
+	dockerPlatform string
 	// stopContainer determines if the running container will be deleted once we're done with it.
 	stopContainer bool
+	// execOS is the OS of the toolchain container. It determines the shell utilities used to
+	// run commands like creating directories inside the container.
+	execOS string
+	// probeHelper is the local path to the probe helper copied into the container to run commands
+	// instead of the shell & shell utilities. The container is assumed to have a shell if unset.
+	probeHelper string
+	// tmpfsSize is the size of the tmpfs mounted at /tmp when creating the container if set.
+	tmpfsSize string
+	// scratchMount is the local directory bind mounted at /tmp when creating the container if set.
+	scratchMount string
+	// runFlags are the raw flags supplied by the user appended to the docker create command after
+	// the flags of this tool.
+	runFlags []string
 
 	// Parameters that affect how commands are executed inside the running toolchain container.
 	// These parameters can be changed between calls to the execCmd function.
@@ -192,14 +395,57 @@ type dockerRunner struct {
 	// env is the environment variables to set when executing commands specified in the given order
 	// as KEY=VALUE strings.
 	env []string
+	// initEnv is the environment initialized by the entrypoint of the image or the init command
+	// as KEY=VALUE strings. It's set for every command executed inside the container before env.
+	initEnv []string
 
 	// Populated by the runner.
 	// dockerPath is the path to the docker client.
 	dockerPath string
-	// containerID is the ID of the running docker container.
+	// containerName is the name given to the docker container when it's created. Used to remove
+	// the container if creating it was interrupted before its ID was known.
+	containerName string
+	// containerID is the ID of the running docker container. For Apptainer images, it's the local
+	// directory of the container created by startContainer because Apptainer doesn't keep containers
+	// running between commands.
 	containerID string
-	// resolvedImage is the container image referenced by its sha256 digest.
+	// resolvedImage is the container image referenced by its sha256 digest. For images loaded from
+	// a tarball that were never pushed to a registry, this is the image ID.
 	resolvedImage string
+	// repoTags are the repo tags of the image if it was loaded from an image tarball.
+	repoTags []string
+	// builtImage is the unique tag of the image built from a Dockerfile, which is removed on
+	// cleanup.
+	builtImage string
+	// arch is the CPU architecture of the resolved image as reported by docker, e.g., "amd64".
+	arch string
+	// unpulled is true if the toolchain image was resolved to its digest in the registry without
+	// pulling it because cached facts may make running it unnecessary. The image must be pulled
+	// with pull before it's inspected or run.
+	unpulled bool
+	// report is called periodically with the progress of pulling an unpulled image.
+	report pullReporter
+	// apptainerDir is the local directory the containers of an Apptainer image are created in.
+	// Blank unless the toolchain image is a local Apptainer image run with "apptainer exec"
+	// instead of docker, in which case dockerPath is the Apptainer client.
+	apptainerDir string
+	// apptainerEnvPrefix is the prefix of the environment variables of the Apptainer client it
+	// sets in the container.
+	apptainerEnvPrefix string
+	// imageLabels are the labels embedded in the metadata of an Apptainer image.
+	imageLabels map[string]string
+	// warnings records the warnings reported with warnf.
+	warnings *Warnings
+	// noTar is true if the Linux toolchain container has no tar so generated files are copied out
+	// of it with docker cp & archived locally instead.
+	noTar bool
+	// existing is true if the runner attached to an already running container supplied by the
+	// user instead of creating its own. Such containers are never removed.
+	existing bool
+	// ctx is the context used to run docker commands. Commands are killed once it's done.
+	ctx context.Context
+	// log is the logger of the run the runner was created for.
+	log *logging.Logger
 }
 
 // generatedFile represents a file part of the toolchain configs generated by the rbeconfigsgen
@@ -221,130 +467,742 @@ type outputConfigs struct {
 	// licence will contain the OSS license applicable for the generated configs.
 	license generatedFile
 	// cppConfigsTarball is the path to the tarball file containing the C++ configs generated by
-	// Bazel inside the toolchain container.
+	// Bazel inside the toolchain container. Blank if C++ configs aren't written.
 	cppConfigsTarball string
 	// configBuild represents the BUILD file containing the C++ crosstool top toolchain target
-	// and the default platform definition.
+	// and the default platform definition. The name is blank if the file isn't written.
 	configBuild generatedFile
-	// javaBuild represents the BUILD file containing the java toolchain rule.
+	// aliasBuild represents the top-level BUILD file with the alias targets pointing at the
+	// canonical targets. The name is blank if the file isn't written.
+	aliasBuild generatedFile
+	// javaBuild represents the BUILD file containing the java toolchain rule. The name is blank if
+	// Java configs aren't written.
 	javaBuild generatedFile
+	// rustConfigs are the files of the rust package exposing the Rust toolchain. Empty if Rust
+	// configs aren't written.
+	rustConfigs []generatedFile
+	// manifest represents the JSON manifest embedded in the output tarball. The name is blank if
+	// the manifest isn't embedded.
+	manifest generatedFile
 }
 
 // runCmd runs an arbitrary command in a shell, logs the exact command that was run and returns
-// the generated stdout/stderr. If the command fails, the stdout/stderr is always logged.
-func runCmd(cmd string, args ...string) (string, error) {
-	cmdStr := fmt.Sprintf("'%s'", strings.Join(append([]string{cmd}, args...), " "))
-	log.Printf("Running: %s", cmdStr)
-	c := exec.Command(cmd, args...)
+// the generated stdout/stderr. If the command fails, the stdout/stderr is always logged. Messages
+// are logged with the given logger. The command is killed if the given context is done before the
+// command completes.
+func runCmd(ctx context.Context, log *logging.Logger, cmd string, args ...string) (string, error) {
+	return runCmdLogged(ctx, log, args, cmd, args...)
+}
+
+// runCmdLogged is like runCmd but logs the given arguments instead of the ones the command is run
+// with, e.g., to redact secrets.
+func runCmdLogged(ctx context.Context, log *logging.Logger, logArgs []string, cmd string, args ...string) (string, error) {
+	return runCmdLoggedEnv(ctx, log, logArgs, nil, cmd, args...)
+}
+
+// runCmdEnv is like runCmd but runs the command with the given KEY=VALUE environment variables
+// added to the environment of this process.
+func runCmdEnv(ctx context.Context, log *logging.Logger, env []string, cmd string, args ...string) (string, error) {
+	return runCmdLoggedEnv(ctx, log, args, env, cmd, args...)
+}
+
+// runCmdLoggedEnv is like runCmdLogged but runs the command with the given KEY=VALUE environment
+// variables added to the environment of this process.
+func runCmdLoggedEnv(ctx context.Context, log *logging.Logger, logArgs, env []string, cmd string, args ...string) (string, error) {
+	cmdStr := fmt.Sprintf("'%s'", strings.Join(append(append([]string(nil), env...), append([]string{cmd}, logArgs...)...), " "))
+	log.Debugf("Running: %s", cmdStr)
+	c := exec.CommandContext(ctx, cmd, args...)
+	if len(env) != 0 {
+		c.Env = append(os.Environ(), env...)
+	}
 	o, err := c.CombinedOutput()
 	if err != nil {
-		log.Printf("Output: %s", o)
-		return "", err
+		log.Warningf("Output: %s", o)
+		return "", &cmdError{err: err, output: string(o)}
 	}
 	return string(o), nil
 }
 
 // workdir returns the root working directory to use inside the toolchain container for the given
 // OS where the OS refers to the OS of the toolchain container.
-func workdir(os string) string {
+func workdir(os string) (string, error) {
 	switch os {
 	case OSLinux:
-		return "/workdir"
+		return "/workdir", nil
 	case OSWindows:
-		return "C:/workdir"
+		return "C:/workdir", nil
 	}
-	log.Fatalf("Invalid OS: %q", os)
-	return ""
+	return "", fmt.Errorf("invalid OS %q, want %q or %q", os, OSLinux, OSWindows)
 }
 
 // BazeliskDownloadInfo returns the URL and name of the local downloaded file to use for downloading
-// bazelisk for the given OS.
+// bazelisk for the given OS on x86_64.
 func BazeliskDownloadInfo(os string) (string, string, error) {
-	switch os {
-	case OSLinux:
-		return "https://github.com/bazelbuild/bazelisk/releases/download/v1.19.0/bazelisk-linux-amd64", "bazelisk", nil
-	case OSWindows:
-		return "https://github.com/bazelbuild/bazelisk/releases/download/v1.19.0/bazelisk-windows-amd64.exe", "bazelisk.exe", nil
+	u, f, _, err := BazeliskDownloadInfoForPlatform(os, "amd64", "")
+	return u, f, err
+}
+
+// BazeliskDownloadInfoForPlatform returns the URL and name of the local downloaded file to use for
+// downloading the given release of bazelisk, e.g., "v1.19.0" or "1.19.0", for the given OS & CPU
+// architecture named like runtime.GOOS & runtime.GOARCH respectively. The Bazelisk release
+// installed by config generation is used if the given release is blank. Also returns the resolved
+// Bazelisk release.
+func BazeliskDownloadInfoForPlatform(os, arch, version string) (string, string, string, error) {
+	archs, ok := bazeliskPlatforms[os]
+	if !ok {
+		return "", "", "", fmt.Errorf("invalid OS %q", os)
+	}
+	if !strListContains(archs, arch) {
+		return "", "", "", fmt.Errorf("invalid CPU architecture %q for OS %q, want one of %s", arch, os, strings.Join(archs, ", "))
+	}
+	if len(version) == 0 {
+		version = bazeliskVersion
+	}
+	if !bazeliskVersionRegexp.MatchString(version) {
+		return "", "", "", fmt.Errorf("invalid Bazelisk version %q, want a release like %s", version, bazeliskVersion)
+	}
+	if !strings.HasPrefix(version, "v") {
+		version = "v" + version
+	}
+	asset := fmt.Sprintf("bazelisk-%s-%s", os, arch)
+	filename := "bazelisk"
+	if os == OSWindows {
+		asset += ".exe"
+		filename += ".exe"
+	}
+	return fmt.Sprintf("%s/%s/%s", bazeliskReleasesURL, version, asset), filename, version, nil
+}
+
+// BazeliskSHA256 returns the hex encoded sha256 digest of the executable of the given release of
+// Bazelisk, or the release installed by config generation if blank, for the given OS & CPU
+// architecture named like runtime.GOOS & runtime.GOARCH respectively. Returns a blank string if
+// the digest isn't known.
+func BazeliskSHA256(os, arch, version string) string {
+	if len(version) == 0 {
+		version = bazeliskVersion
+	}
+	if !strings.HasPrefix(version, "v") {
+		version = "v" + version
+	}
+	return bazeliskSHA256s[version][os+"/"+arch]
+}
+
+// DownloadBazelisk downloads the given release of Bazelisk, or the release installed by config
+// generation if blank, for the given OS & CPU architecture named like runtime.GOOS &
+// runtime.GOARCH respectively to the given directory using the given HTTP client. The executable
+// must have the given hex encoded sha256 digest or, if blank, the digest known for the release.
+// Returns an error without downloading if neither is available. Returns the path to the downloaded
+// executable.
+func DownloadBazelisk(c *http.Client, os, arch, version, dir, wantSHA256 string) (string, error) {
+	url, filename, version, err := BazeliskDownloadInfoForPlatform(os, arch, version)
+	if err != nil {
+		return "", err
+	}
+	if len(wantSHA256) == 0 {
+		wantSHA256 = BazeliskSHA256(os, arch, version)
+	}
+	localPath := filepath.Join(dir, filename)
+	if err := downloadBazelisk(c, url, localPath, wantSHA256); err != nil {
+		return "", err
+	}
+	return localPath, nil
+}
+
+// VerifyBazelisk verifies the Bazelisk executable at the given local path has the given hex
+// encoded sha256 digest.
+func VerifyBazelisk(localPath, wantSHA256 string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("unable to open Bazelisk executable %q to verify its digest: %w", localPath, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("error while hashing Bazelisk executable %q: %w", localPath, err)
+	}
+	return checkBazeliskSHA256(localPath, hex.EncodeToString(h.Sum(nil)), wantSHA256)
+}
+
+// checkBazeliskSHA256 returns an error if the given hex encoded sha256 digest of the Bazelisk
+// executable from the given source doesn't match the given expected digest.
+func checkBazeliskSHA256(source, got, want string) error {
+	if got != want {
+		return fmt.Errorf("Bazelisk executable %s has sha256 digest %s, want %s", source, got, want)
+	}
+	return nil
+}
+
+// downloadBazelisk downloads the Bazelisk executable at the given URL to the given local path
+// using the given HTTP client & verifies it has the given hex encoded sha256 digest. Nothing is
+// downloaded if the digest is blank. The downloaded file is removed if the digest doesn't match.
+func downloadBazelisk(c *http.Client, url, localPath, wantSHA256 string) error {
+	if len(wantSHA256) == 0 {
+		return fmt.Errorf("refusing to download Bazelisk from %s because its sha256 digest isn't known, specify the expected digest explicitly, e.g., with the BazeliskSHA256 option", url)
+	}
+	resp, err := c.Get(url)
+	if err != nil {
+		return fmt.Errorf("unable to initiate download for Bazelisk from %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unable to download Bazelisk from %s: got HTTP status %q", url, resp.Status)
+	}
+
+	o, err := os.Create(localPath)
+	if err != nil {
+		return fmt.Errorf("unable to open a file at %q to download Bazelisk to: %w", localPath, err)
+	}
+	defer o.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(o, h), resp.Body); err != nil {
+		return fmt.Errorf("error while downloading Bazelisk to %s: %w", localPath, err)
+	}
+	if err := checkBazeliskSHA256("downloaded from "+url, hex.EncodeToString(h.Sum(nil)), wantSHA256); err != nil {
+		o.Close()
+		os.Remove(localPath)
+		return err
+	}
+	return nil
+}
+
+// ValidateBazelVersion verifies that the given Bazel version, e.g., 6.4.0 or 7.0.0rc2, is a
+// published Bazel release or release candidate by looking up its release on GitHub using the given
+// HTTP client.
+func ValidateBazelVersion(c *http.Client, bazelVersion string) error {
+	if _, err := bazelCoreVersion(bazelVersion); err != nil {
+		return fmt.Errorf("invalid Bazel version: %w", err)
+	}
+	u := fmt.Sprintf("%s/tag/%s", bazelReleasesURL, url.PathEscape(bazelVersion))
+	resp, err := c.Head(u)
+	if err != nil {
+		return tagged(ErrNetwork, fmt.Errorf("unable to look up Bazel release %q at %s: %w", bazelVersion, u, err))
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("Bazel version %q doesn't exist, see %s for the available releases", bazelVersion, bazelReleasesURL)
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return tagged(ErrNetwork, fmt.Errorf("unable to look up Bazel release %q at %s: got HTTP status %q", bazelVersion, u, resp.Status))
+	}
+	return nil
+}
+
+// windowsPath converts the given path with forward slashes to one with backslashes as expected by
+// Windows builtin commands like mkdir.
+func windowsPath(p string) string {
+	return strings.ReplaceAll(p, "/", "\\")
+}
+
+// keepAliveCmd returns the command used as the entrypoint of the toolchain container to keep it
+// running until it's explicitly stopped for the given OS.
+func keepAliveCmd(os string) []string {
+	if os == OSWindows {
+		// Windows container images don't ship a sleep binary.
+		return []string{"cmd", "/c", "ping", "-t", "localhost"}
 	}
-	return "", "", fmt.Errorf("invalid OS %q", os)
+	return []string{"sleep", "infinity"}
 }
 
-// newDockerRunner creates a new running container of the given containerImage. stopContainer
-// determines if the cleanup function on the dockerRunner will stop the running container when
-// called.
-func newDockerRunner(containerImage string, dockerPlatform string, stopContainer bool) (*dockerRunner, error) {
-	if containerImage == "" {
-		return nil, fmt.Errorf("container image was not specified")
+// newDockerRunner pulls the given containerImage and resolves it to a reference by digest. If
+// imageTarball is specified, the image is loaded from the tarball instead of being pulled from a
+// registry. The container isn't started until startContainer is called. stopContainer determines
+// if the cleanup function on the dockerRunner will stop the running container when called. execOS
+// is the OS of the toolchain container. The given reporter is called periodically with the progress
+// of the pull. Docker commands are killed once the given context is done.
+func newDockerRunner(ctx context.Context, log *logging.Logger, containerImage, imageTarball, dockerPlatform, execOS string, stopContainer bool, report pullReporter) (*dockerRunner, error) {
+	if containerImage == "" && imageTarball == "" {
+		return nil, fmt.Errorf("neither a container image nor an image tarball was specified")
+	}
+	d := &dockerRunner{
+		containerImage: containerImage,
+		dockerPlatform: dockerPlatform,
+		stopContainer:  stopContainer,
+		execOS:         execOS,
+		dockerPath:     "docker",
+		ctx:            ctx,
+		log:            log,
+	}
+	if imageTarball != "" {
+		if err := d.loadImage(imageTarball); err != nil {
+			return nil, fmt.Errorf("docker was unable to load the toolchain container image from tarball %q: %w", imageTarball, err)
+		}
+	} else if err := pullImage(d.ctx, d.log, d.dockerPath, d.containerImage, report); err != nil {
+		return nil, fmt.Errorf("docker was unable to pull the toolchain container image %q: %w", d.containerImage, classifyPullError(err))
+	}
+	if err := d.resolveImage(); err != nil {
+		return nil, err
 	}
+	return d, nil
+}
+
+// newUnpulledDockerRunner returns a docker runner for the given containerImage already resolved to
+// the given digest in its registry without pulling the image, which is pulled by digest once pull
+// is called. The remaining arguments are like those of newDockerRunner.
+func newUnpulledDockerRunner(ctx context.Context, log *logging.Logger, containerImage, digest, dockerPlatform, execOS string, stopContainer bool, report pullReporter) *dockerRunner {
 	d := &dockerRunner{
 		containerImage: containerImage,
+		dockerPlatform: dockerPlatform,
+		stopContainer:  stopContainer,
+		execOS:         execOS,
+		dockerPath:     "docker",
+		resolvedImage:  parseImageRef(containerImage).repo + "@" + digest,
+		unpulled:       true,
+		report:         report,
+		ctx:            ctx,
+		log:            log,
+	}
+	d.log.Infof("Resolved toolchain image %q to fully qualified reference %q in its registry without pulling it.", d.containerImage, d.resolvedImage)
+	return d
+}
+
+// pull pulls the toolchain image of the runner by digest if it was resolved without pulling it.
+func (d *dockerRunner) pull() error {
+	if !d.unpulled {
+		return nil
+	}
+	if err := pullImage(d.ctx, d.log, d.dockerPath, d.resolvedImage, d.report); err != nil {
+		return fmt.Errorf("docker was unable to pull the toolchain container image %q: %w", d.resolvedImage, classifyPullError(err))
+	}
+	d.unpulled = false
+	return nil
+}
+
+// newDockerfileRunner returns a docker runner for the toolchain container image built from the
+// given Dockerfile & build context directory with "docker build" & tagged with a unique tag in
+// BuildImageRepository. The remaining arguments are like those of newDockerRunner.
+func newDockerfileRunner(ctx context.Context, log *logging.Logger, dockerfile, buildContext, dockerPlatform, execOS string, stopContainer bool) (*dockerRunner, error) {
+	tag := fmt.Sprintf("%s:%d_%d", BuildImageRepository, os.Getpid(), time.Now().UnixNano())
+	d := &dockerRunner{
+		containerImage: tag,
+		dockerPlatform: dockerPlatform,
 		stopContainer:  stopContainer,
+		execOS:         execOS,
 		dockerPath:     "docker",
+		builtImage:     tag,
+		ctx:            ctx,
+		log:            log,
+	}
+	if err := buildImage(d.ctx, d.log, d.dockerPath, dockerfile, buildContext, d.containerImage, d.dockerPlatform); err != nil {
+		return nil, fmt.Errorf("docker was unable to build the toolchain container image from %q: %w", dockerfile, err)
+	}
+	if err := d.resolveImage(); err != nil {
+		d.removeBuiltImage()
+		return nil, err
 	}
-	if _, err := runCmd(d.dockerPath, "pull", d.containerImage); err != nil {
-		return nil, fmt.Errorf("docker was unable to pull the toolchain container image %q: %w", d.containerImage, err)
+	return d, nil
+}
+
+// buildImage builds the image from the given Dockerfile & build context directory using the docker
+// binary at the given path & tags it with the given tag. The image is built for the given docker
+// platform, e.g., "linux/arm64", if not blank.
+func buildImage(ctx context.Context, log *logging.Logger, dockerPath, dockerfile, buildContext, tag, dockerPlatform string) error {
+	args := []string{"build", "-f", dockerfile, "-t", tag}
+	if len(dockerPlatform) != 0 {
+		args = append(args, "--platform", dockerPlatform)
 	}
-	resolvedImage, err := runCmd(d.dockerPath, "inspect", "--format={{index .RepoDigests 0}}", d.containerImage)
+	log.Infof("Building toolchain image %q from %q with build context %q.", tag, dockerfile, buildContext)
+	_, err := runCmd(ctx, log, dockerPath, append(args, buildContext)...)
+	return err
+}
+
+// resolveImage resolves the container image of the runner to a fully qualified reference by
+// digest, or to its image ID if the image was never pushed to a registry.
+func (d *dockerRunner) resolveImage() error {
+	resolvedImage, err := runCmd(d.ctx, d.log, d.dockerPath, "inspect", "--format={{if .RepoDigests}}{{index .RepoDigests 0}}{{else}}{{.Id}}{{end}}", d.containerImage)
 	if err != nil {
-		return nil, fmt.Errorf("failed to convert toolchain container image %q into a fully qualified image name by digest: %w", d.containerImage, err)
+		return fmt.Errorf("failed to convert toolchain container image %q into a fully qualified image name by digest: %w", d.containerImage, err)
 	}
 	resolvedImage = strings.TrimSpace(resolvedImage)
-	log.Printf("Resolved toolchain image %q to fully qualified reference %q.", d.containerImage, resolvedImage)
+	d.log.Infof("Resolved toolchain image %q to fully qualified reference %q.", d.containerImage, resolvedImage)
+	if strings.HasPrefix(resolvedImage, "sha256:") {
+		d.log.Warningf("Toolchain image %q has no registry digest because it was never pushed. The generated platform will reference it by image ID which remote execution backends won't be able to pull.", d.containerImage)
+	}
 	d.resolvedImage = resolvedImage
+	return nil
+}
 
-	args := []string{"create", "--rm"}
-	if dockerPlatform != "" {
-		args = append(args, "--platform", dockerPlatform)
+// newExistingDockerRunner returns a docker runner attached to the given already running container
+// referenced by name or ID instead of creating a new container. The image the container is based
+// on is resolved to a reference by digest using docker inspect. The container is never stopped or
+// removed by the runner. execOS is the OS of the container. Docker commands are killed once the
+// given context is done.
+func newExistingDockerRunner(ctx context.Context, log *logging.Logger, container, execOS string) (*dockerRunner, error) {
+	d := &dockerRunner{
+		execOS:     execOS,
+		dockerPath: "docker",
+		existing:   true,
+		ctx:        ctx,
+		log:        log,
+	}
+	o, err := runCmd(d.ctx, d.log, d.dockerPath, "inspect", "--type=container", "--format={{.Id}} {{.State.Running}} {{.Image}} {{.Config.Image}}", container)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect container %q: %w", container, err)
+	}
+	s := strings.Fields(o)
+	if len(s) != 4 {
+		return nil, fmt.Errorf("unexpected output from inspecting container %q, got %q, want <ID> <running> <image ID> <image>", container, o)
+	}
+	if s[1] != "true" {
+		return nil, fmt.Errorf("container %q isn't running", container)
+	}
+	d.containerID = s[0]
+	d.containerImage = s[3]
+	resolvedImage, err := runCmd(d.ctx, d.log, d.dockerPath, "inspect", "--type=image", "--format={{if .RepoDigests}}{{index .RepoDigests 0}}{{else}}{{.Id}}{{end}}", s[2])
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert image %q of container %q into a fully qualified image name by digest: %w", s[3], container, err)
+	}
+	d.resolvedImage = strings.TrimSpace(resolvedImage)
+	d.log.Infof("Attached to existing container %v of toolchain image %q resolved to %q.", d.containerID, d.containerImage, d.resolvedImage)
+	if strings.HasPrefix(d.resolvedImage, "sha256:") {
+		d.log.Warningf("Image %q of container %q has no registry digest because it was never pushed. The generated platform will reference it by image ID which remote execution backends won't be able to pull.", d.containerImage, container)
+	}
+	return d, nil
+}
+
+// loadImage loads the docker image from the image tarball at the given path which can either be
+// in the format produced by "docker save" or an OCI image layout tarball if supported by the
+// docker server. The loaded image becomes the container image of the runner and any repo tags
+// recorded in the tarball metadata are saved in repoTags.
+func (d *dockerRunner) loadImage(tarballPath string) error {
+	o, err := runCmd(d.ctx, d.log, d.dockerPath, "load", "-i", tarballPath)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for _, line := range strings.Split(o, "\n") {
+		line = strings.TrimSpace(line)
+		if t := strings.TrimPrefix(line, "Loaded image: "); t != line {
+			d.repoTags = append(d.repoTags, t)
+		} else if id := strings.TrimPrefix(line, "Loaded image ID: "); id != line {
+			ids = append(ids, id)
+		}
+	}
+	switch {
+	case len(d.repoTags) != 0:
+		d.containerImage = d.repoTags[0]
+	case len(ids) != 0:
+		d.containerImage = ids[0]
+	default:
+		return fmt.Errorf("unable to determine the loaded image from the output of docker load: %q", o)
+	}
+	if len(d.repoTags)+len(ids) > 1 {
+		d.log.Warningf("Image tarball %q contained multiple images. Using %q.", tarballPath, d.containerImage)
 	}
-	args = append(args, d.resolvedImage, "sleep", "infinity")
+	d.log.Infof("Loaded toolchain image %q from tarball %q.", d.containerImage, tarballPath)
+	return nil
+}
+
+// startContainer creates & starts a running container of the resolved toolchain container image.
+// Nothing is done if the runner is attached to an existing container.
+func (d *dockerRunner) startContainer() error {
+	if d.existing {
+		return d.copyProbeHelper()
+	}
+	if d.apptainerDir != "" {
+		return d.startApptainerContainer()
+	}
+	d.containerName = fmt.Sprintf("rbe_configs_gen_%d_%d", os.Getpid(), time.Now().UnixNano())
+	args := []string{"create", "--rm", "--name", d.containerName}
+	if d.dockerPlatform != "" {
+		args = append(args, "--platform", d.dockerPlatform)
+	}
+	args = append(args, d.scratchArgs()...)
+	if d.probeHelper != "" {
+		args = append(args, "--entrypoint", probeContainerPath)
+	}
+	logArgs := append([]string(nil), args...)
+	if len(d.runFlags) != 0 {
+		redacted := redactContainerRunFlags(d.runFlags)
+		d.log.Infof("Passing the extra flags %s to docker create.", strings.Join(redacted, " "))
+		args = append(args, d.runFlags...)
+		logArgs = append(logArgs, redacted...)
+	}
+	var cmd []string
+	if d.probeHelper != "" {
+		// The image may not have a sleep binary so the probe helper keeps the container running.
+		cmd = []string{d.resolvedImage, ProbeCmd, "sleep"}
+	} else {
+		cmd = append([]string{d.resolvedImage}, keepAliveCmd(d.execOS)...)
+	}
+	args = append(args, cmd...)
+	logArgs = append(logArgs, cmd...)
 
-	cid, err := runCmd(d.dockerPath, args...)
+	cid, err := runCmdLogged(d.ctx, d.log, logArgs, d.dockerPath, args...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create a container with the toolchain container image: %w", err)
+		return fmt.Errorf("failed to create a container with the toolchain container image: %w", classifyRunFlagsError(err, d.runFlags))
 	}
 	cid = strings.TrimSpace(cid)
 	if len(cid) != 64 {
-		return nil, fmt.Errorf("container ID %q extracted from the stdout of the container create command had unexpected length, got %d, want 64", cid, len(cid))
+		return fmt.Errorf("container ID %q extracted from the stdout of the container create command had unexpected length, got %d, want 64", cid, len(cid))
 	}
 	d.containerID = cid
-	log.Printf("Created container ID %v for toolchain container image %v.", d.containerID, d.resolvedImage)
-	if _, err := runCmd(d.dockerPath, "start", d.containerID); err != nil {
-		return nil, fmt.Errorf("failed to run the toolchain container: %w", err)
+	d.log.Infof("Created container ID %v for toolchain container image %v.", d.containerID, d.resolvedImage)
+	if err := d.copyProbeHelper(); err != nil {
+		return err
 	}
-	return d, nil
+	if _, err := runCmd(d.ctx, d.log, d.dockerPath, "start", d.containerID); err != nil {
+		return fmt.Errorf("failed to run the toolchain container: %w", err)
+	}
+	return nil
+}
+
+// redactedValue replaces the values of container run flags that may contain secrets in logs.
+const redactedValue = "REDACTED"
+
+var (
+	// sensitiveFlagRegexp matches container run flags whose values may contain secrets.
+	sensitiveFlagRegexp = regexp.MustCompile(`(?i)(token|secret|passw|credential|auth|api_?key)`)
+	// envFlagRegexp matches every spelling of docker's -e & --env flags with the environment
+	// variable in the same argument, e.g., "--env=FOO=bar", "-e=FOO=bar", "-eFOO=bar" or
+	// "-e FOO=bar", & captures the flag & the variable.
+	envFlagRegexp = regexp.MustCompile(`^(-e[= ]?|--env[= ])(.*)$`)
+)
+
+// RedactContainerRunFlag returns the given raw docker run flag with values that may contain
+// secrets replaced for logging. The value of an environment variable passed with -e or --env is
+// always redacted while its name is kept, whichever way the flag is spelled. The value of any
+// other flag is redacted if the flag mentions something like a token, secret, password or
+// credential.
+func RedactContainerRunFlag(f string) string {
+	if m := envFlagRegexp.FindStringSubmatch(f); m != nil {
+		return m[1] + redactEnvVar(m[2])
+	}
+	i := strings.IndexAny(f, "= ")
+	if i < 0 {
+		return f
+	}
+	if sensitiveFlagRegexp.MatchString(f) {
+		return f[:i+1] + redactedValue
+	}
+	return f
+}
+
+// redactEnvVar returns the given NAME=value environment variable with its value redacted. A
+// variable without a value, i.e., passed through from the environment of docker, is returned as
+// is.
+func redactEnvVar(v string) string {
+	if i := strings.Index(v, "="); i >= 0 {
+		return v[:i+1] + redactedValue
+	}
+	return v
+}
+
+// redactContainerRunFlags returns the given raw docker run flags redacted for logging with
+// RedactContainerRunFlag. The environment variable in the argument after a bare -e or --env flag
+// is redacted too.
+func redactContainerRunFlags(flags []string) []string {
+	var r []string
+	for i, f := range flags {
+		if i > 0 && (flags[i-1] == "-e" || flags[i-1] == "--env") {
+			r = append(r, redactEnvVar(f))
+			continue
+		}
+		r = append(r, RedactContainerRunFlag(f))
+	}
+	return r
+}
+
+// scratchContainerPath is the directory in Linux toolchain containers the tmpfs or the local
+// scratch directory is mounted at.
+const scratchContainerPath = "/tmp"
+
+// scratchArgs returns the arguments of docker create mounting the tmpfs or the local scratch
+// directory of the runner at /tmp in the container, if any. The tmpfs allows executables like
+// a regular /tmp, unlike the docker default.
+func (d *dockerRunner) scratchArgs() []string {
+	switch {
+	case d.tmpfsSize != "":
+		return []string{"--tmpfs", fmt.Sprintf("%s:rw,exec,size=%s", scratchContainerPath, d.tmpfsSize)}
+	case d.scratchMount != "":
+		return []string{"-v", fmt.Sprintf("%s:%s", d.scratchMount, scratchContainerPath)}
+	}
+	return nil
 }
 
 // execCmd runs the given command inside the docker container and returns the output with whitespace
 // trimmed from the edges.
 func (d *dockerRunner) execCmd(args ...string) (string, error) {
+	if d.apptainerDir != "" {
+		return d.execApptainer(args...)
+	}
 	a := []string{"exec"}
 	if d.workdir != "" {
 		a = append(a, "-w", d.workdir)
 	}
-	for _, e := range d.env {
+	for _, e := range append(append([]string(nil), d.initEnv...), d.env...) {
 		a = append(a, "-e", e)
 	}
 	a = append(a, d.containerID)
 	a = append(a, args...)
-	o, err := runCmd(d.dockerPath, a...)
+	o, err := runCmd(d.ctx, d.log, d.dockerPath, a...)
 	return strings.TrimSpace(o), err
 }
 
+// copyProbeHelper copies the probe helper into the container if one was specified. Works for
+// containers that were created but not started yet.
+func (d *dockerRunner) copyProbeHelper() error {
+	if d.probeHelper == "" {
+		return nil
+	}
+	if err := d.copyToContainer(d.probeHelper, probeContainerPath); err != nil {
+		return fmt.Errorf("failed to copy the probe helper %q into the toolchain container: %w", d.probeHelper, err)
+	}
+	return nil
+}
+
+// execUtil runs the given command relying on the shell or shell utilities inside the container
+// or the equivalent probe helper command given by probeArgs if the container has no shell. See
+// RunProbe for the probe helper commands.
+func (d *dockerRunner) execUtil(cmd []string, probeArgs ...string) (string, error) {
+	if d.probeHelper != "" {
+		return d.execCmd(append([]string{probeContainerPath, ProbeCmd}, probeArgs...)...)
+	}
+	return d.execCmd(cmd...)
+}
+
+// mkdir creates the given directory inside the container.
+func (d *dockerRunner) mkdir(dir string) error {
+	if d.execOS == OSWindows {
+		_, err := d.execCmd("cmd", "/c", "mkdir", windowsPath(dir))
+		return err
+	}
+	_, err := d.execUtil([]string{"mkdir", dir}, "mkdir", dir)
+	return err
+}
+
+// touch creates the given empty files in the working directory inside the container.
+func (d *dockerRunner) touch(files ...string) error {
+	if d.execOS == OSWindows {
+		var cmds []string
+		for _, f := range files {
+			cmds = append(cmds, fmt.Sprintf("type nul > %s", windowsPath(f)))
+		}
+		_, err := d.execCmd("cmd", "/c", strings.Join(cmds, " && "))
+		return err
+	}
+	t := append([]string{"touch"}, files...)
+	_, err := d.execUtil(t, t...)
+	return err
+}
+
+// pathExists returns whether the given path exists inside the container.
+func (d *dockerRunner) pathExists(p string) bool {
+	if d.execOS == OSWindows {
+		_, err := d.execCmd("cmd", "/c", fmt.Sprintf("if not exist \"%s\" exit 1", windowsPath(p)))
+		return err == nil
+	}
+	_, err := d.execUtil([]string{"test", "-e", p}, "exists", p)
+	return err == nil
+}
+
+// hardenSymlink replaces the given symlink inside the container with the file it points to.
+func (d *dockerRunner) hardenSymlink(link string) error {
+	if d.execOS == OSWindows {
+		// Windows containers have neither readlink nor ln. Relative targets are relative to the
+		// directory of the symlink, which Combine ignores for absolute targets.
+		script := fmt.Sprintf("$ErrorActionPreference = 'Stop'; $l = Get-Item -LiteralPath %s; $t = [IO.Path]::Combine($l.DirectoryName, [string]$l.Target); Remove-Item -LiteralPath $l.FullName -Force; Copy-Item -LiteralPath $t -Destination $l.FullName -Recurse", powerShellQuote(windowsPath(link)))
+		if _, err := d.execCmd("powershell", "-NoProfile", "-NonInteractive", "-Command", script); err != nil {
+			return fmt.Errorf("unable to replace the symlink with a copy of its target using PowerShell: %w", err)
+		}
+		return nil
+	}
+	resolvedPath, err := d.execUtil([]string{"readlink", link}, "readlink", link)
+	if err != nil {
+		return fmt.Errorf("unable to determine what the symlink points to: %w", err)
+	}
+	if _, err := d.execUtil([]string{"ln", "-f", resolvedPath, link}, "ln-f", resolvedPath, link); err != nil {
+		return fmt.Errorf("failed to replace the symlink with %q: %w", resolvedPath, err)
+	}
+	return nil
+}
+
+// powerShellQuote returns the given string as a single quoted PowerShell string literal.
+func powerShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
 // cleanup stops the running container if stopContainer was true when the dockerRunner was created.
+// Nothing is done if the container was never started. Existing containers supplied by the user are
+// never stopped & only the working directory created in them is removed.
 func (d *dockerRunner) cleanup() {
+	if d.existing {
+		d.cleanupWorkdir()
+		return
+	}
+	if d.apptainerDir != "" {
+		d.cleanupApptainer()
+		return
+	}
+	// The container must be removed before the image it was created from.
+	defer d.removeBuiltImage()
+	c := d.containerID
+	if c == "" {
+		c = d.containerName
+	}
+	if c == "" {
+		return
+	}
+	if !d.stopContainer {
+		d.log.Infof("Not stopping container %v of image %v because the Cleanup option was set to false.", c, d.resolvedImage)
+		return
+	}
+	// The runner's context may have been cancelled, e.g., by an interrupt, so the container is
+	// removed using a new context to ensure it doesn't outlive this process.
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+	if _, err := runCmd(ctx, d.log, d.dockerPath, "rm", "-f", c); err != nil {
+		d.log.Warningf("Failed to remove container %v of toolchain image %v but it's ok to ignore this error if config generation & extraction succeeded.", c, d.resolvedImage)
+	}
+}
+
+// removeBuiltImage removes the unique tag of the image built from a Dockerfile unless the Cleanup
+// option was false. Docker removes the image with the tag unless it has other tags.
+func (d *dockerRunner) removeBuiltImage() {
+	if d.builtImage == "" {
+		return
+	}
 	if !d.stopContainer {
-		log.Printf("Not stopping container %v of image %v because the Cleanup option was set to false.", d.containerID, d.resolvedImage)
+		d.log.Infof("Not removing toolchain image %v built from the Dockerfile because the Cleanup option was set to false.", d.builtImage)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+	if _, err := runCmd(ctx, d.log, d.dockerPath, "rmi", d.builtImage); err != nil {
+		d.log.Warningf("Failed to remove toolchain image %v built from the Dockerfile: %v", d.builtImage, err)
+	}
+}
+
+// cleanupWorkdir removes the working directory created inside an existing container.
+func (d *dockerRunner) cleanupWorkdir() {
+	if d.workdir == "" {
 		return
 	}
-	if _, err := runCmd(d.dockerPath, "stop", "-t", "0", d.containerID); err != nil {
-		log.Printf("Failed to stop container %v of toolchain image %v but it's ok to ignore this error if config generation & extraction succeeded.", d.containerID, d.resolvedImage)
+	args := []string{"exec", d.containerID, "rm", "-rf", d.workdir}
+	if d.probeHelper != "" {
+		// Running executables can remove themselves on Linux.
+		args = []string{"exec", d.containerID, probeContainerPath, ProbeCmd, "rm", d.workdir, probeContainerPath}
+	}
+	if d.execOS == OSWindows {
+		args = []string{"exec", d.containerID, "cmd", "/c", "rmdir", "/s", "/q", windowsPath(d.workdir)}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+	if _, err := runCmd(ctx, d.log, d.dockerPath, args...); err != nil {
+		d.log.Warningf("Failed to remove working directory %q from existing container %v: %v", d.workdir, d.containerID, err)
 	}
 }
 
 // copyToContainer copies the local file at 'src' to the container where 'dst' is the path inside
 // the container. d.workdir has no impact on this function.
 func (d *dockerRunner) copyToContainer(src, dst string) error {
-	if _, err := runCmd(d.dockerPath, "cp", src, fmt.Sprintf("%s:%s", d.containerID, dst)); err != nil {
+	if d.apptainerDir != "" {
+		l, err := d.apptainerLocalPath(dst)
+		if err != nil {
+			return err
+		}
+		return copyLocalTree(l, src)
+	}
+	if _, err := runCmd(d.ctx, d.log, d.dockerPath, "cp", src, fmt.Sprintf("%s:%s", d.containerID, dst)); err != nil {
 		return err
 	}
 	return nil
@@ -353,7 +1211,14 @@ func (d *dockerRunner) copyToContainer(src, dst string) error {
 // copyFromContainer extracts the file at 'src' from inside the container and copies it to the path
 // 'dst' locally. d.workdir has no impact on this function.
 func (d *dockerRunner) copyFromContainer(src, dst string) error {
-	if _, err := runCmd(d.dockerPath, "cp", fmt.Sprintf("%s:%s", d.containerID, src), dst); err != nil {
+	if d.apptainerDir != "" {
+		l, err := d.apptainerLocalPath(src)
+		if err != nil {
+			return err
+		}
+		return copyLocalTree(dst, l)
+	}
+	if _, err := runCmd(d.ctx, d.log, d.dockerPath, "cp", fmt.Sprintf("%s:%s", d.containerID, src), dst); err != nil {
 		return err
 	}
 	return nil
@@ -365,8 +1230,17 @@ func (d *dockerRunner) copyFromContainer(src, dst string) error {
 // The return value of this function is a map from env keys to their values. If the image config,
 // specifies the same env key multiple times, later values supercede earlier ones.
 func (d *dockerRunner) getEnv() (map[string]string, error) {
+	if d.apptainerDir != "" {
+		return d.getApptainerEnv()
+	}
 	result := make(map[string]string)
-	o, err := runCmd(d.dockerPath, "inspect", "-f", "{{range $i, $v := .Config.Env}}{{println $v}}{{end}}", d.resolvedImage)
+	// The environment of an existing container may differ from its image, e.g., if it was started
+	// with extra environment variables.
+	target := d.resolvedImage
+	if d.existing {
+		target = d.containerID
+	}
+	o, err := runCmd(d.ctx, d.log, d.dockerPath, "inspect", "-f", "{{range $i, $v := .Config.Env}}{{println $v}}{{end}}", target)
 	if err != nil {
 		return nil, fmt.Errorf("failed to inspect the docker image to get environment variables: %w", err)
 	}
@@ -393,27 +1267,26 @@ func (d *dockerRunner) getEnv() (map[string]string, error) {
 	return result, nil
 }
 
-// installBazelisk downloads bazelisk locally to the specified directory for the given os and copies
-// it into the running toolchain container.
+// installBazelisk downloads bazelisk locally to the specified directory for the given os & CPU
+// architecture, e.g., CPUAarch64, using the given HTTP client, verifies it has the given hex
+// encoded sha256 digest or, if blank, its known digest and copies it into the running toolchain
+// container.
 // Returns the path Bazelisk was installed to inside the running toolchain container.
-func installBazelisk(d *dockerRunner, downloadDir, execOS string) (string, error) {
-	url, filename, err := BazeliskDownloadInfo(execOS)
+func installBazelisk(c *http.Client, d *dockerRunner, downloadDir, execOS, execCPU, wantSHA256 string) (string, error) {
+	arch, err := cpuDockerArch(execCPU)
 	if err != nil {
-		return "", fmt.Errorf("unable to determine how to download Bazelisk for execution OS %q: %w", execOS, err)
+		return "", fmt.Errorf("unable to determine how to download Bazelisk for execution CPU %q: %w", execCPU, err)
 	}
-	resp, err := http.Get(url)
+	url, filename, _, err := BazeliskDownloadInfoForPlatform(execOS, arch, "")
 	if err != nil {
-		return "", fmt.Errorf("unable to initiate download for Bazelisk from %s: %w", url, err)
+		return "", fmt.Errorf("unable to determine how to download Bazelisk for execution OS %q & CPU %q: %w", execOS, execCPU, err)
 	}
-	defer resp.Body.Close()
-
-	localPath := path.Join(downloadDir, filename)
-	o, err := os.Create(localPath)
-	if err != nil {
-		return "", fmt.Errorf("unable to open a file at %q to download Bazelisk to: %w", localPath, err)
+	if len(wantSHA256) == 0 {
+		wantSHA256 = BazeliskSHA256(execOS, arch, "")
 	}
-	if _, err := io.Copy(o, resp.Body); err != nil {
-		return "", fmt.Errorf("error while downloading Bazelisk to %s: %w", localPath, err)
+	localPath := path.Join(downloadDir, filename)
+	if err := downloadBazelisk(c, url, localPath, wantSHA256); err != nil {
+		return "", err
 	}
 
 	bazeliskContainerPath := path.Join(d.workdir, filename)
@@ -421,7 +1294,11 @@ func installBazelisk(d *dockerRunner, downloadDir, execOS string) (string, error
 		return "", fmt.Errorf("failed to copy the downloaded Bazelisk binary into the container: %w", err)
 	}
 
-	if _, err := d.execCmd("chmod", "+x", bazeliskContainerPath); err != nil {
+	// Windows determines whether a file is executable from its extension.
+	if execOS == OSWindows {
+		return bazeliskContainerPath, nil
+	}
+	if _, err := d.execUtil([]string{"chmod", "+x", bazeliskContainerPath}, "chmod+x", bazeliskContainerPath); err != nil {
 		return "", fmt.Errorf("failed to mark the Bazelisk binary as executable inside the container: %w", err)
 	}
 	return bazeliskContainerPath, nil
@@ -455,11 +1332,77 @@ func appendCppEnv(env []string, o *Options) ([]string, error) {
 	return env, nil
 }
 
-// genCppConfigs generates C++ configs inside the running toolchain container represented by the
-// given docker runner according to the given options. bazelPath is the path to the Bazel
-// binary inside the running toolchain container.
+// parseSymlinks returns the paths of the symlinks in the given directory inside a container running
+// the given OS from the given output of "find <dir> -type l", which lists one path per line. On
+// Windows, the output is that of "dir <dir> /a:l /b", which lists the bare names of the symlinks
+// with CRLF line endings instead.
+func parseSymlinks(out, dir, execOS string) []string {
+	var result []string
+	for _, s := range strings.Split(out, "\n") {
+		s = strings.TrimRight(s, "\r")
+		if s == "" {
+			continue
+		}
+		if execOS == OSWindows {
+			s = windowsPath(dir) + "\\" + s
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+// envContains returns whether the given environment of "key=value" strings sets the given key.
+func envContains(env []string, key string) bool {
+	for _, e := range env {
+		if strings.HasPrefix(e, key+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// appendMSVCEnv locates the MSVC compiler cl.exe inside the running Windows toolchain container and
+// appends the environment variables Bazel's C++ toolchain autodetection needs to find MSVC to the
+// given environment. BAZEL_VC is derived from the location of cl.exe unless it was already
+// specified. INCLUDE & LIB are forwarded from the image config because "docker exec" doesn't run
+// the Visual Studio developer command prompt that usually sets them.
+func appendMSVCEnv(d *dockerRunner, env []string) ([]string, error) {
+	out, err := d.execCmd("cmd", "/c", "where", "cl.exe")
+	if err != nil {
+		return nil, fmt.Errorf("unable to locate the MSVC compiler cl.exe in the toolchain container: %w", err)
+	}
+	// "where" prints every match on a separate line. The first match is the one cmd would use.
+	clPath := strings.TrimSpace(strings.Split(out, "\n")[0])
+	d.log.Infof("Found MSVC compiler at %q.", clPath)
+	if !envContains(env, "BAZEL_VC") {
+		i := strings.Index(strings.ToLower(clPath), "\\vc\\")
+		if i == -1 {
+			return nil, fmt.Errorf("unable to determine BAZEL_VC from the path %q to cl.exe because it wasn't in a VC directory", clPath)
+		}
+		vcDir := clPath[:i+len("\\vc")]
+		d.log.Debugf("Setting BAZEL_VC=%q.", vcDir)
+		env = append(env, fmt.Sprintf("BAZEL_VC=%s", vcDir))
+	}
+	imageEnv, err := d.getEnv()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the environment of the toolchain image to determine the MSVC INCLUDE & LIB paths: %w", err)
+	}
+	for _, k := range []string{"INCLUDE", "LIB"} {
+		v, ok := imageEnv[k]
+		if !ok || envContains(env, k) {
+			continue
+		}
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+	return env, nil
+}
+
+// genCppConfigs generates C++ configs inside the running toolchain container represented by the
+// given docker runner according to the given options. bazelPath is the path to the Bazel
+// binary inside the running toolchain container. compilerPath overrides CC in the C++ config
+// generation environment if set.
 // The return value is the path to the C++ configs tarball copied out of the toolchain container.
-func genCppConfigs(d *dockerRunner, o *Options, bazelPath string) (string, error) {
+func genCppConfigs(d *dockerRunner, o *Options, bazelPath, compilerPath string) (string, error) {
 	if !o.GenCPPConfigs {
 		return "", nil
 	}
@@ -467,7 +1410,7 @@ func genCppConfigs(d *dockerRunner, o *Options, bazelPath string) (string, error
 	// Change the working directory to a dedicated empty directory for C++ configs for each
 	// command we run in this function.
 	cppProjDir := path.Join(d.workdir, "cpp_configs_project")
-	if _, err := d.execCmd("mkdir", cppProjDir); err != nil {
+	if err := d.mkdir(cppProjDir); err != nil {
 		return "", fmt.Errorf("failed to create empty directory %q inside the toolchain container: %w", cppProjDir, err)
 	}
 	oldWorkDir := d.workdir
@@ -476,7 +1419,7 @@ func genCppConfigs(d *dockerRunner, o *Options, bazelPath string) (string, error
 		d.workdir = oldWorkDir
 	}()
 
-	if _, err := d.execCmd("touch", "WORKSPACE", "BUILD.bazel"); err != nil {
+	if err := d.touch("WORKSPACE", "BUILD.bazel"); err != nil {
 		return "", fmt.Errorf("failed to create empty build & workspace files in the container to initialize a blank Bazel repository: %w", err)
 	}
 
@@ -496,6 +1439,17 @@ func genCppConfigs(d *dockerRunner, o *Options, bazelPath string) (string, error
 	if err != nil {
 		return "", fmt.Errorf("failed to add additional environment variables to the C++ config generation docker command: %w", err)
 	}
+	if len(compilerPath) != 0 {
+		generationEnv = setEnv(generationEnv, "CC", compilerPath)
+	}
+	generationEnv = applyCrossCppEnv(o, generationEnv)
+	generationEnv = applyCppStdlibEnv(o, generationEnv)
+	if o.ExecOS == OSWindows {
+		generationEnv, err = appendMSVCEnv(d, generationEnv)
+		if err != nil {
+			return "", fmt.Errorf("failed to detect MSVC in the Windows toolchain container: %w", err)
+		}
+	}
 	d.env = generationEnv
 
 	cmd := []string{
@@ -514,7 +1468,7 @@ func genCppConfigs(d *dockerRunner, o *Options, bazelPath string) (string, error
 		return "", fmt.Errorf("unable to determine the build output directory where Bazel produced C++ configs in the toolchain container: %w", err)
 	}
 	cppConfigDir := path.Join(bazelOutputRoot, "external", o.CPPConfigRepo)
-	log.Printf("Extracting C++ config files generated by Bazel at %q from the toolchain container.", cppConfigDir)
+	o.log.Infof("Extracting C++ config files generated by Bazel at %q from the toolchain container.", cppConfigDir)
 
 	// Restore the old env now that we're done with Bazelisk commands. This is purely to reduce
 	// noise in the logs.
@@ -526,9 +1480,9 @@ func genCppConfigs(d *dockerRunner, o *Options, bazelPath string) (string, error
 	// 4. Copy the tarball from the container to the local temp directory.
 	var out string
 	if o.ExecOS == "windows" {
-		out, err = d.execCmd("cmd", "/r", "dir", filepath.Clean(cppConfigDir), "/a:l", "/b")
+		out, err = d.execCmd("cmd", "/r", "dir", windowsPath(cppConfigDir), "/a:l", "/b")
 	} else {
-		out, err = d.execCmd("find", cppConfigDir, "-type", "l")
+		out, err = d.execUtil([]string{"find", cppConfigDir, "-type", "l"}, "find-symlinks", cppConfigDir)
 	}
 	if err != nil {
 		errMsg := fmt.Sprintf("unable to list symlinks in the C++ config generation build output directory: ")
@@ -537,22 +1491,14 @@ func genCppConfigs(d *dockerRunner, o *Options, bazelPath string) (string, error
 		switch o.ExecOS {
 		case "windows":
 			out = ""
-			log.Printf("Ignoring error indicating no symlinks were found in the Bazel output directory: %v", err)
+			o.log.Debugf("Ignoring error indicating no symlinks were found in the Bazel output directory: %v", err)
 		default:
 			return "", fmt.Errorf("%s%w", errMsg, err)
 		}
 	}
-	symlinks := strings.Split(out, "\n")
-	for _, s := range symlinks {
-		if s == "" {
-			continue
-		}
-		resolvedPath, err := d.execCmd("readlink", s)
-		if err != nil {
-			return "", fmt.Errorf("unable to determine what the symlink %q in %q in the toolchain container points to: %w", s, cppConfigDir, err)
-		}
-		if _, err := d.execCmd("ln", "-f", resolvedPath, s); err != nil {
-			return "", fmt.Errorf("failed to harden symlink %q in %q pointing to %q: %w", s, cppConfigDir, resolvedPath, err)
+	for _, s := range parseSymlinks(out, cppConfigDir, o.ExecOS) {
+		if err := d.hardenSymlink(s); err != nil {
+			return "", fmt.Errorf("failed to harden symlink %q in %q: %w", s, cppConfigDir, err)
 		}
 	}
 
@@ -560,70 +1506,135 @@ func genCppConfigs(d *dockerRunner, o *Options, bazelPath string) (string, error
 	// Explicitly use absolute paths to avoid confusion on what's the working directory.
 	outputTarballPath := path.Join(o.TempWorkDir, outputTarball)
 	outputTarballContainerPath := path.Join(cppProjDir, outputTarball)
-	if _, err := d.execCmd("tar", "-cf", outputTarballContainerPath, "-C", cppConfigDir, "."); err != nil {
+	// Windows toolchain containers don't ship tar so the configs are archived locally like for
+	// Linux containers without tar.
+	if d.noTar || o.ExecOS == OSWindows {
+		if err := copyDirFromContainerAsTarball(d, cppConfigDir, o.TempWorkDir, outputTarballPath); err != nil {
+			return "", fmt.Errorf("failed to copy the C++ configs out of the toolchain container without tar: %w", err)
+		}
+		o.log.Infof("Generated C++ configs at %s.", outputTarballPath)
+		return outputTarballPath, nil
+	}
+	if _, err := d.execUtil([]string{"tar", "-cf", outputTarballContainerPath, "-C", cppConfigDir, "."}, "tar", outputTarballContainerPath, cppConfigDir); err != nil {
 		return "", fmt.Errorf("failed to archive the C++ configs into a tarball inside the toolchain container: %w", err)
 	}
 	if err := d.copyFromContainer(outputTarballContainerPath, outputTarballPath); err != nil {
 		return "", fmt.Errorf("failed to copy the C++ config tarball out of the toolchain container: %w", err)
 	}
-	log.Printf("Generated C++ configs at %s.", outputTarballPath)
+	o.log.Infof("Generated C++ configs at %s.", outputTarballPath)
 	return outputTarballPath, nil
 }
 
+// bazelCoreVersion returns the major.minor.patch core of the given Bazel version string ignoring
+// any pre-release or build suffix, e.g., 7.0.0 for "7.0.0rc2" or "7.0.0-pre.20230101".
+func bazelCoreVersion(bazelVersion string) (*semver.Version, error) {
+	m := bazelCoreVersionRegexp.FindString(bazelVersion)
+	if len(m) == 0 {
+		return nil, fmt.Errorf("Bazel version %q didn't start with a <major>.<minor>.<patch> version", bazelVersion)
+	}
+	bv, err := semver.NewVersion(m)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %q from Bazel version %q as a semver: %w", m, bazelVersion, err)
+	}
+	return bv, nil
+}
+
 // UsesLocalJavaRuntime returns whether the given bazel version string uses the local_java_runtime
-// rule for Java toolchains instead of java_runtime.
+// rule for Java toolchains instead of java_runtime. Only the core version is compared, i.e.,
+// pre-releases & custom builds of a Bazel version behave like the release.
 // Bazel is expected to switch to local_java_runtime in Bazel 5.0.0. See:
 // https://github.com/bazelbuild/bazel-toolchains/pull/926.
 func UsesLocalJavaRuntime(bazelVersion string) (bool, error) {
-	bv, err := semver.NewVersion(bazelVersion)
+	bv, err := bazelCoreVersion(bazelVersion)
 	if err != nil {
-		return false, fmt.Errorf("unable to parse Bazel version %q as a semver: %w", bazelVersion, err)
+		return false, err
 	}
 	// Returns if bv >= 5.0.0.
 	return !bv.LessThan(*semver.New("5.0.0")), nil
 }
 
+// UsesCcToolchainResolution returns whether the given bazel version string resolves the C++
+// toolchain using platforms & the registered toolchains by default instead of --crosstool_top.
+// Bazel enabled --incompatible_enable_cc_toolchain_resolution by default in Bazel 7.0.0.
+func UsesCcToolchainResolution(bazelVersion string) (bool, error) {
+	bv, err := bazelCoreVersion(bazelVersion)
+	if err != nil {
+		return false, err
+	}
+	// Returns if bv >= 7.0.0.
+	return !bv.LessThan(*semver.New("7.0.0")), nil
+}
+
+// usesCcToolchainResolution returns whether the C++ configs generated according to the given
+// options are expected to be used with platform based C++ toolchain resolution.
+func usesCcToolchainResolution(o *Options) (bool, error) {
+	if o.CppToolchainResolution {
+		return true, nil
+	}
+	u, err := UsesCcToolchainResolution(o.BazelVersion)
+	if err != nil {
+		return false, fmt.Errorf("unable to determine whether Bazel %q uses C++ toolchain resolution: %w", o.BazelVersion, err)
+	}
+	return u, nil
+}
+
+// usesLocalJavaRuntime returns whether the Java configs generated according to the given options
+// use the local_java_runtime rule for Java toolchains instead of java_runtime.
+func usesLocalJavaRuntime(o *Options) (bool, error) {
+	if o.ForceLocalJavaRuntime != nil {
+		return *o.ForceLocalJavaRuntime, nil
+	}
+	if o.JavaUseLocalRuntime {
+		return true, nil
+	}
+	u, err := UsesLocalJavaRuntime(o.BazelVersion)
+	if err != nil {
+		return false, fmt.Errorf("unable to determine what Java toolchain rule to use for Bazel %q: %w", o.BazelVersion, err)
+	}
+	return u, nil
+}
+
+// getJavaTemplate returns the template of the BUILD file of the Java configs generated according to
+// the given options. Bazel 7.0.0 & later, including pre-releases, reference @rules_java directly
+// instead of through @bazel_tools. The latest template is used if BazelVersion is unspecified.
 func getJavaTemplate(o *Options) (*template.Template, error) {
-  usesNewJavaRule := o.JavaUseLocalRuntime
+	if o.JavaCompat == JavaCompatBoth {
+		return dualJavaBuildTemplate, nil
+	}
+	usesNewJavaRule, err := usesLocalJavaRuntime(o)
+	if err != nil {
+		return nil, err
+	}
 	if !usesNewJavaRule {
-  	var err error
-		usesNewJavaRule, err = UsesLocalJavaRuntime(o.BazelVersion)
-    if (err != nil) {
-      return nil, fmt.Errorf("unable to determine what Java toolchain rule to use for Bazel %q: %w", o.BazelVersion, err)
-    }
-	}
-  if !usesNewJavaRule {
-    return legacyJavaBuildTemplate, nil
-	}
-	// use latest template if BazelVersion is unspecified
-  if o.BazelVersion != "" && o.BazelVersion < "7" {
-    return javaBuildTemplateLt7, nil
-  }
-  return javaBuildTemplate, nil
-}
-
-// genJavaConfigs returns a BUILD file containing a Java toolchain rule definition that contains
-// the following attributes determined by probing details about the JDK version installed in the
-// running toolchain container.
-// 1. Value of the JAVA_HOME environment variable set in the toolchain image.
+		return legacyJavaBuildTemplate, nil
+	}
+	if o.BazelVersion == "" {
+		return javaBuildTemplate, nil
+	}
+	bv, err := bazelCoreVersion(o.BazelVersion)
+	if err != nil {
+		return nil, fmt.Errorf("unable to determine the Java toolchain template for Bazel %q: %w", o.BazelVersion, err)
+	}
+	if bv.LessThan(*semver.New("7.0.0")) {
+		return javaBuildTemplateLt7, nil
+	}
+	return javaBuildTemplate, nil
+}
+
+// detectJava determines the following details about the JDK installed in the running toolchain
+// container needed to generate Java configs and records them in the given facts.
+// 1. Value of the JAVA_HOME environment variable set in the toolchain image unless JavaHome was
+//    specified in the given options.
 // 2. Value of the Java version as reported by the java binary installed in JAVA_HOME inside the
 //    running toolchain container.
-func genJavaConfigs(d *dockerRunner, o *Options) (generatedFile, error) {
+func detectJava(d *dockerRunner, o *Options, f *detectionFacts) error {
 	if !o.GenJavaConfigs {
-		return generatedFile{}, nil
+		return nil
 	}
-	imageEnv, err := d.getEnv()
+	javaHome, err := javaHomeInContainer(d, o)
 	if err != nil {
-		return generatedFile{}, fmt.Errorf("unable to get the environment of the toolchain image to determine JAVA_HOME: %w", err)
-	}
-	javaHome, ok := imageEnv["JAVA_HOME"]
-	if !ok {
-		return generatedFile{}, fmt.Errorf("toolchain image didn't specify environment value JAVA_HOME")
-	}
-	if len(javaHome) == 0 {
-		return generatedFile{}, fmt.Errorf("the value of the JAVA_HOME environment variable was blank in the toolchain image")
+		return err
 	}
-	log.Printf("JAVA_HOME was %q.", javaHome)
 	javaBin := path.Join(javaHome, "bin/java")
 	// "-XshowSettings:properties" is actually what makes java output the version string we're
 	// looking for in a more deterministic format. "-version" is just a placeholder so that the
@@ -631,7 +1642,7 @@ func genJavaConfigs(d *dockerRunner, o *Options) (generatedFile, error) {
 	// some non-deterministic prefix.
 	out, err := d.execCmd(javaBin, "-XshowSettings:properties", "-version")
 	if err != nil {
-		return generatedFile{}, fmt.Errorf("unable to determine the Java version installed in the toolchain container: %w", err)
+		return fmt.Errorf("unable to determine the Java version installed in the toolchain container: %w", err)
 	}
 	javaVersion := ""
 	for _, line := range strings.Split(out, "\n") {
@@ -649,19 +1660,175 @@ func genJavaConfigs(d *dockerRunner, o *Options) (generatedFile, error) {
 		javaVersion = val
 	}
 	if len(javaVersion) == 0 {
-		return generatedFile{}, fmt.Errorf("unable to determine the java version installed in the container by running 'java -XshowSettings:properties' in the container because it didn't return a line that looked like java.version = <version>")
+		return fmt.Errorf("unable to determine the java version installed in the container by running 'java -XshowSettings:properties' in the container because it didn't return a line that looked like java.version = <version>")
+	}
+	o.log.Infof("Java version: '%s'.", javaVersion)
+	f.JavaHome = javaHome
+	f.JavaVersion = javaVersion
+	return nil
+}
+
+// javaHomeInContainer returns the JavaHome specified in the given options after verifying it
+// contains bin/java inside the running toolchain container or the value of JAVA_HOME in the
+// toolchain image otherwise.
+func javaHomeInContainer(d *dockerRunner, o *Options) (string, error) {
+	if len(o.JavaHome) != 0 {
+		javaBin := path.Join(o.JavaHome, "bin/java")
+		if d.execOS == OSWindows {
+			javaBin += ".exe"
+		}
+		if !d.pathExists(javaBin) {
+			return "", fmt.Errorf("JavaHome %q doesn't contain %s in the toolchain container", o.JavaHome, path.Base(javaBin))
+		}
+		o.log.Infof("Using Java home %q instead of JAVA_HOME in the toolchain image.", o.JavaHome)
+		return o.JavaHome, nil
+	}
+	imageEnv, err := d.getEnv()
+	if err != nil {
+		return "", fmt.Errorf("unable to get the environment of the toolchain image to determine JAVA_HOME: %w", err)
+	}
+	javaHome, ok := imageEnv["JAVA_HOME"]
+	if !ok {
+		return "", fmt.Errorf("toolchain image didn't specify environment value JAVA_HOME")
+	}
+	if len(javaHome) == 0 {
+		return "", fmt.Errorf("the value of the JAVA_HOME environment variable was blank in the toolchain image")
+	}
+	o.log.Infof("JAVA_HOME was %q.", javaHome)
+	return javaHome, nil
+}
+
+// parseOSRelease returns the values of the ID & VERSION_ID fields in the given contents of an
+// os-release file. Missing fields are returned as osUnknown.
+func parseOSRelease(contents string) (string, string) {
+	id, versionID := osUnknown, osUnknown
+	for _, line := range strings.Split(contents, "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		val := strings.Trim(strings.TrimSpace(kv[1]), `"'`)
+		if len(val) == 0 {
+			continue
+		}
+		switch kv[0] {
+		case "ID":
+			id = val
+		case "VERSION_ID":
+			versionID = val
+		}
+	}
+	return id, versionID
+}
+
+// detectOS determines the OS distribution & version in the running toolchain container from
+// /etc/os-release and records them in the given facts. Both are recorded as osUnknown if the
+// toolchain container doesn't have /etc/os-release.
+func detectOS(d *dockerRunner, o *Options, f *detectionFacts) {
+	f.OSID, f.OSVersionID = osUnknown, osUnknown
+	if o.ExecOS != OSLinux {
+		return
+	}
+	out, err := d.execUtil([]string{"cat", "/etc/os-release"}, "cat", "/etc/os-release")
+	if err != nil {
+		d.warnf(WarningUnknownOS, "Unable to read /etc/os-release in the toolchain container, the OS distribution will be recorded as %q: %v", osUnknown, err)
+		return
+	}
+	f.OSID, f.OSVersionID = parseOSRelease(out)
+	o.log.Infof("OS distribution: %q, version: %q.", f.OSID, f.OSVersionID)
+}
+
+// parseLibcVersion returns the given output of "getconf GNU_LIBC_VERSION", e.g., "glibc 2.31", in
+// the format of Bazel's target_libc, e.g., "glibc_2.31". Blank if the output isn't recognized.
+func parseLibcVersion(out string) string {
+	s := strings.Fields(out)
+	if len(s) != 2 || s[0] != "glibc" {
+		return ""
+	}
+	return s[0] + "_" + s[1]
+}
+
+// detectLibc determines the C library in the running toolchain container & records it in the given
+// facts. Only glibc is detected. The C library is left blank if it couldn't be determined, e.g.,
+// because the container has no shell utilities.
+func detectLibc(d *dockerRunner, o *Options, f *detectionFacts) {
+	if o.ExecOS != OSLinux || d.probeHelper != "" {
+		return
+	}
+	out, err := d.execCmd("getconf", "GNU_LIBC_VERSION")
+	if err != nil {
+		o.log.Debugf("Unable to determine the glibc version in the toolchain container: %v", err)
+		return
+	}
+	if f.Libc = parseLibcVersion(out); len(f.Libc) != 0 {
+		o.log.Infof("C library: %q.", f.Libc)
+	}
+}
+
+// javaMajorVersion returns the major version of the given Java version string as reported by the
+// java.version property, e.g., 8 for "1.8.0_292" and 11 for "11.0.2".
+func javaMajorVersion(javaVersion string) (int, error) {
+	s := strings.SplitN(javaVersion, ".", 3)
+	if len(s) >= 2 && s[0] == "1" {
+		// Java 8 & older report versions like 1.<major>.<minor>.
+		s = s[1:]
+	}
+	v := strings.TrimFunc(s[0], func(r rune) bool { return r < '0' || r > '9' })
+	m, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse the major version of Java version %q: %w", javaVersion, err)
+	}
+	return m, nil
+}
+
+// verifyJavaVersion verifies the JDK version in the given facts is compatible with the Java
+// toolchain rules used by the Java configs generated for the Bazel version in the given options.
+// An incompatible JDK version is only logged as a warning unless the options require a strict
+// match.
+func verifyJavaVersion(o *Options, f *detectionFacts) error {
+	t, err := getJavaTemplate(o)
+	if err != nil {
+		return err
+	}
+	min, ok := javaTemplateMinMajorVersions[t]
+	if !ok {
+		return nil
+	}
+	m, err := javaMajorVersion(f.JavaVersion)
+	if err != nil {
+		return err
 	}
-	log.Printf("Java version: '%s'.", javaVersion)
+	if m >= min {
+		return nil
+	}
+	err = fmt.Errorf("JDK version %q in the toolchain container is older than JDK %d expected by the local_java_runtime based Java toolchain generated for Bazel %q", f.JavaVersion, min, o.BazelVersion)
+	if o.StrictJavaVersion {
+		return err
+	}
+	o.log.Warningf("%v, remote Java builds may fail.", err)
+	return nil
+}
 
+// genJavaConfigs returns a BUILD file containing a Java toolchain rule definition using the JDK
+// details in the given facts detected in the toolchain container.
+func genJavaConfigs(o *Options, f *detectionFacts) (generatedFile, error) {
+	if !o.GenJavaConfigs {
+		return generatedFile{}, nil
+	}
+	if err := verifyJavaVersion(o, f); err != nil {
+		return generatedFile{}, fmt.Errorf("Java version verification failed: %w", err)
+	}
 	t, err := getJavaTemplate(o)
-  if err != nil {
-    return generatedFile{}, err
-  }
+	if err != nil {
+		return generatedFile{}, err
+	}
 
 	buf := bytes.NewBuffer(nil)
 	if err := t.Execute(buf, &javaBuildTemplateParams{
-		JavaHome:    javaHome,
-		JavaVersion: javaVersion,
+		JavaHome:          f.JavaHome,
+		JavaVersion:       f.JavaVersion,
+		JavaSourceVersion: o.JavaSourceVersion,
+		JavaTargetVersion: o.JavaTargetVersion,
 	}); err != nil {
 		return generatedFile{}, fmt.Errorf("failed to generate the contents of the BUILD file with the Java toolchain definition: %w", err)
 	}
@@ -671,6 +1838,276 @@ func genJavaConfigs(d *dockerRunner, o *Options) (generatedFile, error) {
 	}, nil
 }
 
+// detectionStep is a named step probing the running toolchain container to generate configs.
+type detectionStep struct {
+	name string
+	// needsBazel is true if the step runs Bazel inside the toolchain container.
+	needsBazel bool
+	run        func(d *dockerRunner) error
+}
+
+// runDetectionSteps runs the given detection steps concurrently in the running toolchain container
+// represented by the given docker runner. The first failing step cancels the remaining steps. The
+// returned error names every step that failed before the remaining steps were cancelled.
+func runDetectionSteps(ctx context.Context, d *dockerRunner, steps ...detectionStep) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		serr = &stepsError{total: len(steps)}
+	)
+	for _, s := range steps {
+		s := s
+		// Each step gets a copy of the runner because steps change the working directory & the
+		// environment used to run commands inside the container.
+		r := *d
+		r.ctx = ctx
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.run(&r)
+			if err == nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			// Ignore failures caused by an earlier failing step cancelling this one.
+			if len(serr.errs) != 0 && ctx.Err() != nil {
+				return
+			}
+			serr.names = append(serr.names, s.name)
+			serr.errs = append(serr.errs, err)
+			cancel()
+		}()
+	}
+	wg.Wait()
+	if len(serr.errs) != 0 {
+		return serr
+	}
+	return nil
+}
+
+// runIsolatedDetectionSteps runs the given detection steps one after the other, each in a fresh
+// container of the toolchain image represented by the given docker runner that's removed once the
+// step is done. The path of Bazel inside the container of a step is stored in bazelPath before the
+// step runs.
+func runIsolatedDetectionSteps(d *dockerRunner, o *Options, bazelPath *string, steps ...detectionStep) error {
+	var startup time.Duration
+	for _, s := range steps {
+		r := *d
+		r.containerName, r.containerID, r.workdir, r.env, r.initEnv = "", "", "", nil, nil
+		start := time.Now()
+		p, err := startProbeContainer(&r, o, s.needsBazel)
+		startup += time.Since(start)
+		if err != nil {
+			r.cleanup()
+			return fmt.Errorf("unable to start the toolchain container for the %s detection step: %w", s.name, err)
+		}
+		*bazelPath = p
+		err = s.run(&r)
+		r.cleanup()
+		if err != nil {
+			return fmt.Errorf("%s detection step failed: %w", s.name, err)
+		}
+	}
+	o.log.Infof("Started %d toolchain containers, one per detection step, in %v. Reusing a single container avoids this overhead.", len(steps), startup.Round(100*time.Millisecond))
+	return nil
+}
+
+// startProbeContainer starts the toolchain container represented by the given docker runner,
+// creates the working directory inside it & installs Bazelisk into it if needsBazel is true &
+// BazelPath wasn't specified. Returns the path of Bazel inside the container.
+func startProbeContainer(d *dockerRunner, o *Options, needsBazel bool) (string, error) {
+	bazelPath := o.BazelPath
+	err := o.stage(StageStart, func() error {
+		if err := d.startContainer(); err != nil {
+			return fmt.Errorf("failed to start the toolchain container: %w", err)
+		}
+		if err := initContainerEnv(d, o); err != nil {
+			return err
+		}
+		if err := checkContainerUtils(d, containerUtils(o, needsBazel)); err != nil {
+			return err
+		}
+		wd, err := workdir(o.ExecOS)
+		if err != nil {
+			return fmt.Errorf("unable to determine the working directory in the toolchain container: %w", err)
+		}
+		if d.existing {
+			// An existing container may have a working directory left behind by a previous run.
+			wd = fmt.Sprintf("%s_%d_%d", wd, os.Getpid(), time.Now().UnixNano())
+		}
+		if d.apptainerDir != "" {
+			wd = path.Join(apptainerBindPath, "workdir")
+		}
+		if err := d.mkdir(wd); err != nil {
+			return fmt.Errorf("failed to create an empty working directory in the container")
+		}
+		d.workdir = wd
+		if bazelPath != "" || !needsBazel {
+			return nil
+		}
+		c, err := newHTTPClient(o.log, o.RegistryCACert, o.InsecureRegistry, o.HTTPUserAgent)
+		if err != nil {
+			return fmt.Errorf("failed to initialize the HTTP client to download Bazelisk: %w", err)
+		}
+		if bazelPath, err = installBazelisk(c, d, o.TempWorkDir, o.ExecOS, o.ExecCPU, o.BazeliskSHA256); err != nil {
+			return fmt.Errorf("failed to install Bazelisk into the toolchain container: %w", err)
+		}
+		return nil
+	})
+	return bazelPath, err
+}
+
+// probeContainer starts the toolchain container represented by the given docker runner and
+// detects the facts needed to generate configs inside it. With IsolateProbes, every detection step
+// runs in its own container instead.
+func probeContainer(d *dockerRunner, o *Options) (*detectionFacts, error) {
+	f := &detectionFacts{}
+	var bazelPath string
+	steps := []detectionStep{
+		{
+			name:       "C++",
+			needsBazel: true,
+			run: func(d *dockerRunner) error {
+				return o.stage(StageDetectCpp, func() error {
+					var err error
+					if o.GenCPPConfigs {
+						if err := detectCppCompiler(d, o, f); err != nil {
+							return fmt.Errorf("failed to detect the C++ compiler: %w", err)
+						}
+						detectLinker(d, f)
+					}
+					var compilerPath string
+					if len(o.CppCompiler) != 0 || isCrossCompiling(o) {
+						compilerPath = f.CppCompilerPath
+					}
+					if f.CppConfigsTarball, err = genCppConfigs(d, o, bazelPath, compilerPath); err != nil {
+						return fmt.Errorf("failed to generate C++ configs: %w", err)
+					}
+					if o.GenCPPConfigs {
+						if err := checkCxxBuiltinIncludeDirs(d, f.CppConfigsTarball); err != nil {
+							return fmt.Errorf("failed to check the builtin include directories of the generated C++ configs: %w", err)
+						}
+						if err := verifyCppActions(d, o, f.CppConfigsTarball); err != nil {
+							return fmt.Errorf("failed to verify the compiler supports the CppActions: %w", err)
+						}
+					}
+					if o.GenCPPConfigs && o.VerifyCPP {
+						if err := verifyCxxBuiltinIncludeDirs(d, o, f.CppConfigsTarball); err != nil {
+							return fmt.Errorf("failed to verify the generated C++ configs: %w", err)
+						}
+						if err := verifyExcludedCxxBuiltinIncludeDirs(d, o, f.CppConfigsTarball); err != nil {
+							return fmt.Errorf("failed to verify the excluded builtin include directories of the generated C++ configs: %w", err)
+						}
+						if err := verifyLinkFlags(d, o, f.CppConfigsTarball); err != nil {
+							return fmt.Errorf("failed to verify the link flags of the generated C++ configs: %w", err)
+						}
+					}
+					return nil
+				})
+			},
+		},
+		{
+			name: "Java",
+			run: func(d *dockerRunner) error {
+				return o.stage(StageDetectJava, func() error {
+					if err := detectJava(d, o, f); err != nil {
+						return fmt.Errorf("failed to extract information about the installed JDK version in the toolchain container needed to generate Java configs: %w", err)
+					}
+					return nil
+				})
+			},
+		},
+		{
+			name: "Rust",
+			run: func(d *dockerRunner) error {
+				return o.stage(StageDetectRust, func() error {
+					if err := detectRust(d, o, f); err != nil {
+						return fmt.Errorf("failed to detect the Rust toolchain installed in the toolchain container needed to generate Rust configs: %w", err)
+					}
+					return nil
+				})
+			},
+		},
+		{
+			name: "OS",
+			run: func(d *dockerRunner) error {
+				return o.stage(StageDetectOS, func() error {
+					detectOS(d, o, f)
+					detectLibc(d, o, f)
+					detectResources(d, o, f)
+					return nil
+				})
+			},
+		},
+	}
+	if o.IsolateProbes {
+		if err := runIsolatedDetectionSteps(d, o, &bazelPath, steps...); err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+
+	var err error
+	if bazelPath, err = startProbeContainer(d, o, true); err != nil {
+		return nil, err
+	}
+	// C++, Java, Rust & OS detection only read state from the toolchain container so they can run
+	// concurrently.
+	if err := runDetectionSteps(d.ctx, d, steps...); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// detectFacts returns the facts needed to generate configs for the toolchain image represented by
+// the given docker runner. If a cache directory was specified in the given options, facts cached
+// for the resolved toolchain image are used instead of running the toolchain container unless
+// the NoCache option was set. Freshly detected facts are always written to the cache.
+func detectFacts(d *dockerRunner, o *Options) (*detectionFacts, error) {
+	c, err := newFactsCache(o, d.resolvedImage)
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize the detection cache: %w", err)
+	}
+	// Verification needs the running toolchain container. Existing containers may have been set up
+	// differently from their image so cached facts for the image don't apply.
+	if c != nil && !o.NoCache && !o.VerifyCPP && !d.existing {
+		// The architecture of an image that wasn't pulled is only known from the cached facts.
+		if f, ok := c.load(o); ok && (!d.unpulled || len(f.ImageArch) != 0) {
+			o.log.Infof("Using facts cached at %q instead of running the toolchain container.", c.dir)
+			if d.unpulled {
+				d.arch = f.ImageArch
+				warnImageArchMismatch(d, o, d.arch)
+			}
+			for _, w := range f.Warnings {
+				o.log.Warningf("%s (cached)", w)
+			}
+			d.warnings.add(f.Warnings...)
+			return f, nil
+		}
+	}
+	if err := ensurePulled(d, o); err != nil {
+		return nil, err
+	}
+	// Warnings reported before detection, e.g., about the image architecture, aren't cached.
+	before := len(d.warnings.All())
+	f, err := probeContainer(d, o)
+	if err != nil {
+		return nil, err
+	}
+	f.Warnings = d.warnings.All()[before:]
+	f.ImageArch = d.arch
+	if c != nil && !d.existing {
+		if err := c.store(o, f); err != nil {
+			o.log.Warningf("Unable to cache detected facts in %q: %v", c.dir, err)
+		}
+	}
+	return f, nil
+}
+
 // processTempDir creates a local temporary working directory to store intermediate files.
 func processTempDir(o *Options) error {
 	if o.TempWorkDir != "" {
@@ -709,10 +2146,13 @@ func genConfigBuild(o *Options) (generatedFile, error) {
 		o.PlatformParams.CppToolchainTarget = genCppToolchainTarget(o)
 	} else {
 		o.PlatformParams.CppToolchainTarget = ""
-		log.Printf("Not generating a toolchain target to be used for the C++ Crosstool top because C++ config generation is disabled.")
+		o.log.Infof("Not generating a toolchain target to be used for the C++ Crosstool top because C++ config generation is disabled.")
 	}
+	o.PlatformParams.PlatformName = platformName(o)
+	o.PlatformParams.ExtraPlatformConstraints = o.PlatformConstraints
+	o.PlatformParams.ExtraExecProperties = extraExecProperties(o)
 	buf := bytes.NewBuffer(nil)
-	log.Printf("Fully resolved platform params=%v", o.PlatformParams)
+	o.log.Debugf("Fully resolved platform params=%v", o.PlatformParams)
 	if err := platformsToolchainBuildTemplate.Execute(buf, o.PlatformParams); err != nil {
 		return generatedFile{}, fmt.Errorf("failed to generate platform BUILD file: %w", err)
 	}
@@ -722,113 +2162,123 @@ func genConfigBuild(o *Options) (generatedFile, error) {
 	}, nil
 }
 
-// copyCppConfigsToTarball copies the C++ configs generated by Bazel from the local filesystem at
-// 'inTarPath' to the output tarball represented by `outTar`.
-func copyCppConfigsToTarball(inTarPath string, outTar *tar.Writer) error {
-	in, err := os.Open(inTarPath)
-	if err != nil {
-		return fmt.Errorf("unable to open input tarball %q for reading: %w", inTarPath, err)
-	}
-	defer in.Close()
-	inTar := tar.NewReader(in)
-	pathPrefix := "cc"
+// extraExecProperties returns the exec properties of the generated platform following the
+// container image & the OS family according to the given options.
+func extraExecProperties(o *Options) []ExecProperty {
+	return append(dockerExecProperties(o), workerExecProperties(o)...)
+}
 
-	for {
-		h, err := inTar.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return fmt.Errorf("error while reading input tarball %q: %w", inTarPath, err)
+// PlatformExecProperties returns the exec_properties of the platform that would be generated
+// according to the given validated options without pulling the toolchain image. The container
+// image is PlatformImageOverride if specified. Otherwise, it's ToolchainContainer which is only
+// the exact image of the generated platform if it's referenced by digest because generation
+// references the digest the image resolves to once pulled. Images that are loaded, built or
+// attached to are only known once config generation runs, which is an error unless
+// PlatformImageOverride was specified.
+func PlatformExecProperties(o *Options) (map[string]string, error) {
+	image := strings.TrimPrefix(o.PlatformImageOverride, "docker://")
+	if len(image) == 0 {
+		if len(o.ToolchainContainer) == 0 {
+			return nil, fmt.Errorf("the container image of the platform is only known once the toolchain image was loaded, built or attached to, specify PlatformImageOverride to determine the exec properties without generating configs")
 		}
-		switch h.Typeflag {
-		case tar.TypeDir:
-			break
-		case tar.TypeReg:
-			if strings.HasSuffix(h.Name, "WORKSPACE") {
-				break
-			}
-			outH := *h
-			// Update the name to be in a 'cc' directory and set the mod time to epoch because:
-			// 1. The output becomes deterministic.
-			// 2. The mod times of the files archived inside the toolchain container sometimes
-			//    seem to be well into the future and I didn't bother figuring out why. Maybe it
-			//    only happens on my machine (shrug).
-			outH.Name = path.Join(pathPrefix, h.Name)
-			outH.ModTime = time.Unix(0, 0)
-			if err := outTar.WriteHeader(&outH); err != nil {
-				return fmt.Errorf("error while adding tar header for %q from input tarball to output tarball: %w", h.Name, err)
-			}
-			if _, err := io.Copy(outTar, inTar); err != nil {
-				return fmt.Errorf("failed to copy the contents of %q from intput tarball to the output tarball: %w", h.Name, err)
-			}
-		default:
-			return fmt.Errorf("got unexpected entry with name %q of type %v in tarball %q: %w", h.Name, h.Typeflag, inTarPath, err)
+		r := parseImageRef(o.ToolchainContainer)
+		if len(r.digest) == 0 {
+			o.log.Warningf("Toolchain image %q isn't referenced by digest. The generated platform will reference the digest it resolves to once pulled instead.", o.ToolchainContainer)
+			image = o.ToolchainContainer
+		} else {
+			image = r.repo + "@" + r.digest
 		}
 	}
-	return nil
+	props := map[string]string{
+		"container-image": "docker://" + image,
+		"OSFamily":        o.PlatformParams.OSFamily,
+	}
+	for _, p := range extraExecProperties(o) {
+		props[p.Name] = p.Value
+	}
+	return props, nil
 }
 
-// writeGeneratedFileToTarball writes the given generatedFile 'g' to the given output tarball
-// 'outTar'.
-func writeGeneratedFileToTarball(g generatedFile, outTar *tar.Writer) error {
-	if err := outTar.WriteHeader(&tar.Header{
-		Name:    g.name,
-		Size:    int64(len(g.contents)),
-		Mode:    int64(os.ModePerm),
-		ModTime: time.Unix(0, 0),
-	}); err != nil {
-		return fmt.Errorf("failed to write tar header for %q: %w", g.name, err)
+// dockerExecProperties returns the exec properties of the generated platform configuring the
+// docker container remote actions run in according to the given options. The boolean properties
+// use the same "True" value create_rbe_exec_properties_dict does.
+func dockerExecProperties(o *Options) []ExecProperty {
+	var props []ExecProperty
+	if o.DockerNetwork != "" {
+		props = append(props, ExecProperty{Name: "dockerNetwork", Value: o.DockerNetwork})
 	}
-	if _, err := io.Copy(outTar, bytes.NewBuffer(g.contents)); err != nil {
-		return fmt.Errorf("failed to copy the contents of %q to the output tarball: %w", g.name, err)
+	if o.DockerPrivileged {
+		props = append(props, ExecProperty{Name: "dockerPrivileged", Value: "True"})
 	}
-	return nil
+	if o.DockerRunAsRoot {
+		props = append(props, ExecProperty{Name: "dockerRunAsRoot", Value: "True"})
+	}
+	return props
+}
+
+// workerExecProperties returns the exec properties of the generated platform enabling remote
+// persistent workers according to the given options.
+func workerExecProperties(o *Options) []ExecProperty {
+	if !o.SupportsWorkers {
+		return nil
+	}
+	props := []ExecProperty{{Name: "supportsWorkers", Value: "True"}}
+	if len(o.WorkerKeyMnemonics) != 0 {
+		props = append(props, ExecProperty{Name: "workerKeyMnemonics", Value: strings.Join(o.WorkerKeyMnemonics, ",")})
+	}
+	return props
 }
 
 // assembleConfigTarball combines the C++/Java configs represented by 'oc' into a single output
-// tarball if requested in the given options.
-func assembleConfigTarball(o *Options, oc outputConfigs) error {
-	out, err := os.Create(o.OutputTarball)
+// tarball in the TarballFormat written to the TarballWriter or the OutputTarball file in the given
+// options. The configs are written to a staging directory first which is archived with TarballDir
+// so the tarball is byte identical to one written by TarballDir from the extracted configs.
+// Returns the sha256 digest of the bytes written, i.e., of the compressed tarball.
+func assembleConfigTarball(o *Options, oc outputConfigs) (string, error) {
+	stagingDir, err := ioutil.TempDir(o.TempWorkDir, "tarball_")
 	if err != nil {
-		return fmt.Errorf("unable to open output tarball %q for writing: %w", o.OutputTarball, err)
+		return "", fmt.Errorf("unable to create a staging directory for the output tarball %q: %w", o.tarballName(), err)
 	}
-	outTar := tar.NewWriter(out)
-
-	// Always write the LICENSE first.
-	if err := writeGeneratedFileToTarball(oc.license, outTar); err != nil {
-		return fmt.Errorf("unable to write the %q file to the output tarball %q: %w", oc.license.name, o.OutputTarball, err)
+	defer os.RemoveAll(stagingDir)
+	// C++ configs are extracted without the WORKSPACE files Bazel generated for the repository.
+	if err := writeConfigsToDir(stagingDir, oc, true); err != nil {
+		return "", fmt.Errorf("unable to stage the configs for the output tarball %q: %w", o.tarballName(), err)
 	}
-
-	if o.GenCPPConfigs {
-		if err := copyCppConfigsToTarball(oc.cppConfigsTarball, outTar); err != nil {
-			return fmt.Errorf("unable to copy C++ configs from the C++ config tarball %q to the output tarball %q: %w", oc.cppConfigsTarball, o.OutputTarball, err)
+	if len(oc.manifest.name) != 0 {
+		if err := writeGeneratedFile(stagingDir, oc.manifest); err != nil {
+			return "", fmt.Errorf("unable to stage the manifest %q for the output tarball %q: %w", oc.manifest.name, o.tarballName(), err)
 		}
 	}
-	if o.GenJavaConfigs {
-		if err := writeGeneratedFileToTarball(oc.javaBuild, outTar); err != nil {
-			return fmt.Errorf("unable to write the BUILD file %q containing the Java toolchain definition to the output tarball %q: %w", oc.javaBuild.name, o.OutputTarball, err)
+
+	out := o.TarballWriter
+	var f *os.File
+	if out == nil {
+		if f, err = os.Create(o.OutputTarball); err != nil {
+			return "", fmt.Errorf("unable to open output tarball %q for writing: %w", o.OutputTarball, err)
 		}
+		defer f.Close()
+		out = f
 	}
-	if err := writeGeneratedFileToTarball(oc.configBuild, outTar); err != nil {
-		return fmt.Errorf("unable to write the crosstool top/platform BUILD file %q to the output tarball %q: %w", oc.configBuild.name, o.OutputTarball, err)
+	// The tarball is hashed as it's written because a streamed tarball can't be read back.
+	digest, err := TarballDir(stagingDir, out, TarOptions{Prefix: o.TarballPrefix, Format: o.TarballFormat})
+	if err != nil {
+		return "", fmt.Errorf("unable to write the output tarball %q: %w", o.tarballName(), err)
 	}
-
-	// Can't ignore failures when closing the output tarball because it writes metadata without which
-	// the tarball is invalid.
-	if err := outTar.Close(); err != nil {
-		return fmt.Errorf("error trying to finish writing the output tarball %q: %w", o.OutputTarball, err)
+	if f != nil {
+		if err := f.Close(); err != nil {
+			return "", fmt.Errorf("error trying to close the output tarball %q: %w", o.tarballName(), err)
+		}
 	}
 
-	log.Printf("Generated Bazel toolchain configs output tarball %q.", o.OutputTarball)
-	return nil
+	o.log.Infof("Generated Bazel toolchain configs output tarball %q.", o.tarballName())
+	return digest, nil
 }
 
 // copyCppConfigsToOutputDir extracts the contents of the C++ config tarball at `cppConfigsTarball`
 // to the directory at 'outDir'. The C++ config tarball is assumed to contain only regular files,
 // i.e., all non-regular files (directories, links, etc) are ignored during the extraction
-// process.
-func copyCppConfigsToOutputDir(outDir string, cppConfigsTarball string) error {
+// process. WORKSPACE files are skipped too if skipWorkspace is true.
+func copyCppConfigsToOutputDir(outDir string, cppConfigsTarball string, skipWorkspace bool) error {
 	in, err := os.Open(cppConfigsTarball)
 	if err != nil {
 		return fmt.Errorf("unable to open input tarball %q for reading: %w", cppConfigsTarball, err)
@@ -845,7 +2295,7 @@ func copyCppConfigsToOutputDir(outDir string, cppConfigsTarball string) error {
 		if err != nil {
 			return fmt.Errorf("error while reading input tarball %q: %w", cppConfigsTarball, err)
 		}
-		if h.Typeflag != tar.TypeReg {
+		if h.Typeflag != tar.TypeReg || (skipWorkspace && strings.HasSuffix(h.Name, "WORKSPACE")) {
 			continue
 		}
 		filePath := path.Join(outDir, h.Name)
@@ -879,32 +2329,52 @@ func writeGeneratedFile(outDir string, g generatedFile) error {
 	return nil
 }
 
-// copyConfigsToOutputDir copies the C++/Java configs represented by 'oc' to an output directory
-// if one was specified in the given options. This involves extracting C++ configs and generating
-// BUILD files for the Java & toolchain entrypoint & platform targets.
-func copyConfigsToOutputDir(o *Options, oc outputConfigs) error {
-	configsRootDir := path.Join(o.OutputSourceRoot, o.OutputConfigPath)
+// writeConfigsToDir writes the C++/Java configs represented by 'oc' to the given directory. This
+// involves extracting C++ configs, skipping the WORKSPACE files among them if skipWorkspace is
+// true, and generating BUILD files for the Java & toolchain entrypoint & platform targets.
+func writeConfigsToDir(configsRootDir string, oc outputConfigs, skipWorkspace bool) error {
 	if err := os.MkdirAll(configsRootDir, os.ModePerm); err != nil {
 		return fmt.Errorf("unable to create directory %q for writing configs: %w", configsRootDir, err)
 	}
-	// Always write the LICENSE first.
 	if err := writeGeneratedFile(configsRootDir, oc.license); err != nil {
 		return fmt.Errorf("unable to write the %q file to the output directory %q: %w", oc.license.name, configsRootDir, err)
 	}
-	if o.GenCPPConfigs {
-		if err := copyCppConfigsToOutputDir(configsRootDir, oc.cppConfigsTarball); err != nil {
+	if len(oc.cppConfigsTarball) != 0 {
+		if err := copyCppConfigsToOutputDir(configsRootDir, oc.cppConfigsTarball, skipWorkspace); err != nil {
 			return fmt.Errorf("unable to extract C++ configs into output directory %q: %w", configsRootDir, err)
 		}
 	}
-	if o.GenJavaConfigs {
+	if len(oc.javaBuild.name) != 0 {
 		if err := writeGeneratedFile(configsRootDir, oc.javaBuild); err != nil {
 			return fmt.Errorf("unable to write Java configs into output directory %q: %w", configsRootDir, err)
 		}
 	}
-	if err := writeGeneratedFile(configsRootDir, oc.configBuild); err != nil {
-		return fmt.Errorf("unable to write the crostool top/platform BUILD file into output directory %q: %w", configsRootDir, err)
+	for _, g := range oc.rustConfigs {
+		if err := writeGeneratedFile(configsRootDir, g); err != nil {
+			return fmt.Errorf("unable to write Rust configs into output directory %q: %w", configsRootDir, err)
+		}
+	}
+	if len(oc.configBuild.name) != 0 {
+		if err := writeGeneratedFile(configsRootDir, oc.configBuild); err != nil {
+			return fmt.Errorf("unable to write the crostool top/platform BUILD file into output directory %q: %w", configsRootDir, err)
+		}
+	}
+	if len(oc.aliasBuild.name) != 0 {
+		if err := writeGeneratedFile(configsRootDir, oc.aliasBuild); err != nil {
+			return fmt.Errorf("unable to write the BUILD file with the alias targets into output directory %q: %w", configsRootDir, err)
+		}
 	}
-	log.Printf("Copied generated configs to directory %q.", configsRootDir)
+	return nil
+}
+
+// copyConfigsToOutputDir copies the C++/Java configs represented by 'oc' to an output directory
+// if one was specified in the given options.
+func copyConfigsToOutputDir(o *Options, oc outputConfigs) error {
+	configsRootDir := path.Join(o.OutputSourceRoot, o.OutputConfigPath)
+	if err := writeConfigsToDir(configsRootDir, oc, false); err != nil {
+		return err
+	}
+	o.log.Infof("Copied generated configs to directory %q.", configsRootDir)
 	return nil
 }
 
@@ -912,18 +2382,131 @@ func copyConfigsToOutputDir(o *Options, oc outputConfigs) error {
 // given options. This could involve:
 // 1. Generate a single output tarball.
 // 2. Copy all configs into a specified directory.
-func assembleConfigs(o *Options, oc outputConfigs) error {
-	if len(o.OutputTarball) != 0 {
-		if err := assembleConfigTarball(o, oc); err != nil {
-			return fmt.Errorf("failed to assemble configs into a tarball: %w", err)
+// Returns the sha256 digest of the output tarball if one was generated.
+func assembleConfigs(o *Options, oc outputConfigs) (string, error) {
+	var digest string
+	if o.genTarball() {
+		d, err := assembleConfigTarball(o, oc)
+		if err != nil {
+			return "", fmt.Errorf("failed to assemble configs into a tarball: %w", err)
 		}
+		digest = d
 	}
 	if len(o.OutputSourceRoot) != 0 {
 		if err := copyConfigsToOutputDir(o, oc); err != nil {
-			return fmt.Errorf("failed to write configs to directory %q: %w", o.OutputSourceRoot, err)
+			return "", fmt.Errorf("failed to write configs to directory %q: %w", o.OutputSourceRoot, err)
 		}
 	}
-	return nil
+	return digest, nil
+}
+
+// configsDirDigest returns the digest of the configs represented by 'oc' that are copied to the
+// output directory. This is the hex encoded sha256 digest of the lines
+// "<sha256 of the file>  <path of the file relative to the configs root>\n" for every file sorted
+// by path, i.e., the output of sha256sum run from the configs root, so it doesn't depend on the
+// mod times of the files or any other files in the output directory.
+func configsDirDigest(o *Options, oc outputConfigs) (string, error) {
+	digests := make(map[string]string)
+	for _, f := range append([]generatedFile{oc.license, oc.configBuild, oc.aliasBuild, oc.javaBuild}, oc.rustConfigs...) {
+		if len(f.name) == 0 {
+			continue
+		}
+		d := sha256.Sum256(f.contents)
+		digests[f.name] = hex.EncodeToString(d[:])
+	}
+	if len(oc.cppConfigsTarball) != 0 {
+		cpp, err := tarballFileDigests(oc.cppConfigsTarball, "")
+		if err != nil {
+			return "", fmt.Errorf("unable to hash the C++ configs: %w", err)
+		}
+		// The C++ configs are extracted into the cc directory.
+		for name, d := range cpp {
+			digests[path.Join("cc", name)] = d
+		}
+	}
+	var names []string
+	for name := range digests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s  %s\n", digests[name], name)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// genOutputConfigs generates the configs written according to the given options from the facts
+// detected according to the given detection options.
+func genOutputConfigs(o, do *Options, f *detectionFacts) (outputConfigs, error) {
+	javaBuild, err := genJavaConfigs(do, f)
+	if err != nil {
+		return outputConfigs{}, fmt.Errorf("unable to generate the BUILD file with the Java toolchain definition: %w", err)
+	}
+	rustConfigs, err := genRustConfigs(do, f)
+	if err != nil {
+		return outputConfigs{}, fmt.Errorf("unable to generate the Rust configs: %w", err)
+	}
+
+	configBuild, err := genConfigBuild(o)
+	if err != nil {
+		return outputConfigs{}, fmt.Errorf("unable to generate the BUILD file with the C++ crosstool and/or the default platform definition: %w", err)
+	}
+	if !o.writesConfigs(OnlyPlatform) {
+		configBuild = generatedFile{}
+	}
+	aliasBuild, err := genAliasBuild(o)
+	if err != nil {
+		return outputConfigs{}, err
+	}
+	if len(o.Only) != 0 && o.Only != OnlyAll {
+		o.log.Infof("Only writing the %s configs.", o.Only)
+	}
+
+	return outputConfigs{
+		license: generatedFile{
+			name:     "LICENSE",
+			contents: licenseBlob,
+		},
+		cppConfigsTarball: f.CppConfigsTarball,
+		configBuild:       configBuild,
+		aliasBuild:        aliasBuild,
+		javaBuild:         javaBuild,
+		rustConfigs:       rustConfigs,
+	}, nil
+}
+
+// assembleOptions returns the options the configs generated according to the given options are
+// assembled with. With ValidateOnly, the labels in the configs were generated according to
+// OutputSourceRoot & OutputConfigPath but the configs are written to a scratch directory in the
+// TempWorkDir compared with the configs to validate instead.
+func assembleOptions(o *Options) *Options {
+	if len(o.ValidateOnly) == 0 {
+		return o
+	}
+	vo := *o
+	vo.OutputSourceRoot = path.Join(o.TempWorkDir, "validate_only")
+	vo.OutputConfigPath = ""
+	return &vo
+}
+
+// validateConfigsDir compares the digests of the configs generated into the OutputSourceRoot of
+// the given options with the ones in the ValidateOnly directory. Returns an error matching
+// ErrConfigsMismatch listing the files that differ if they don't match.
+func validateConfigsDir(o *Options) error {
+	want, err := dirFileDigests(o.ValidateOnly)
+	if err != nil {
+		return err
+	}
+	got, err := dirFileDigests(o.OutputSourceRoot)
+	if err != nil {
+		return err
+	}
+	d := Diff(&ConfigSet{Files: want}, &ConfigSet{Files: got})
+	if d.Empty() {
+		return nil
+	}
+	return fmt.Errorf("%w in %q, re-generate them to fix the files that would be added (+), removed (-) or modified (M):\n%s", ErrConfigsMismatch, o.ValidateOnly, strings.TrimSuffix(d.String(), "\n"))
 }
 
 // digestFile returns the sha256 digest of the contents of the given file.
@@ -943,18 +2526,146 @@ func digestFile(filePath string) (string, error) {
 
 // Manifest contains metadata about the configs generated by this package.
 type Manifest struct {
-	BazelVersion         string `json:"bazel_version"`
-	ToolchainContainer   string `json:"toolchain_container"`
-	ImageDigest          string `json:"image_digest"`
+	// SchemaVersion is the version of the format of the manifest. It's bumped when a change breaks
+	// existing consumers, e.g., a field changes meaning, but not when optional fields are added.
+	// Blank in manifests written before the schema was versioned, which have schema version 1.
+	SchemaVersion int    `json:"schema_version,omitempty"`
+	BazelVersion  string `json:"bazel_version"`
+	// MinBazelVersion is the minimum Bazel version (inclusive) the configs are expected to be
+	// compatible with. Blank if there's no known lower bound.
+	MinBazelVersion string `json:"min_bazel_version,omitempty"`
+	// MaxBazelVersion is the first Bazel version the configs are expected to be incompatible with,
+	// i.e., the maximum is exclusive. Blank if there's no known upper bound.
+	MaxBazelVersion    string `json:"max_bazel_version,omitempty"`
+	ToolchainContainer string `json:"toolchain_container"`
+	// ImageDigest is the sha256 registry digest of the toolchain image. Blank if the image was
+	// never pushed to a registry, in which case ImageID is set instead.
+	ImageDigest string `json:"image_digest"`
+	// ImageID is the sha256 local image ID of the toolchain image if it has no registry digest,
+	// e.g., because it was loaded from an image tarball without RepoDigests or built from a
+	// Dockerfile. Remote execution backends can't pull an image by its ID.
+	ImageID              string `json:"image_id,omitempty"`
 	ExecOS               string `json:"exec_os"`
 	ConfigsTarballDigest string `json:"configs_tarball_digest"`
+	// ConfigsDirDigest is the digest of the configs copied to the output source root if no configs
+	// tarball was generated. See configsDirDigest for how it's computed. Blank if a configs tarball
+	// was generated.
+	ConfigsDirDigest string `json:"configs_dir_digest,omitempty"`
+	// ConfigsTarballURL is the URL the configs tarball was published at so that consumers can find
+	// the tarball from the manifest alone. Set by rbe_configs_upload with --set_tarball_url. Blank
+	// in manifests written by rbe_configs_gen.
+	ConfigsTarballURL string `json:"configs_tarball_url,omitempty"`
+	// ExecCPU is the CPU architecture of the toolchain container, i.e., of the execution platform.
+	// Blank in manifests generated before the CPU was configurable, in which case CPUX8664 is
+	// implied.
+	ExecCPU string `json:"exec_cpu,omitempty"`
+	// TargetOS is the OS artifacts built with the configs target.
+	TargetOS string `json:"target_os,omitempty"`
+	// TargetCPU is the CPU architecture artifacts built with the configs target. Differs from
+	// ExecCPU if the C++ configs cross-compile.
+	TargetCPU string `json:"target_cpu,omitempty"`
+	// CppSysroot is the sysroot of the C++ cross compiler. Blank unless the C++ configs
+	// cross-compile with a sysroot.
+	CppSysroot string `json:"cpp_sysroot,omitempty"`
+	// RepoName is the name of the Bazel external repository the configs are expected to be
+	// imported as. Blank in manifests generated before this was configurable, in which case
+	// DefaultRepoName is implied.
+	RepoName string `json:"repo_name,omitempty"`
+	// PlatformName is the name of the platform target in the config package. Blank in manifests
+	// generated before this was configurable, in which case DefaultPlatformName is implied.
+	PlatformName string `json:"platform_name,omitempty"`
+	// JavaVersion is the version of the JDK detected in the toolchain container. Blank if Java
+	// configs weren't generated.
+	JavaVersion string `json:"java_version,omitempty"`
+	// JavaCompat is JavaCompatBoth if java/BUILD defines both the java_runtime & the
+	// local_java_runtime based Java runtimes so the configs work with Bazel versions on either side
+	// of 5.0.0. Blank if the Java runtime was picked by the Bazel version.
+	JavaCompat string `json:"java_compat,omitempty"`
+	// OSID is the ID of the OS distribution in the toolchain container, e.g., "ubuntu", "debian"
+	// or "alpine". "unknown" if the toolchain container doesn't have /etc/os-release.
+	OSID string `json:"os_id,omitempty"`
+	// OSVersionID is the version of the OS distribution in the toolchain container, e.g., "20.04".
+	// "unknown" if the toolchain container doesn't have /etc/os-release.
+	OSVersionID string `json:"os_version_id,omitempty"`
+	// CppCompiler is the name of the compiler used to generate the C++ configs, e.g., "clang".
+	// Blank if C++ configs weren't generated or the compiler couldn't be determined.
+	CppCompiler string `json:"cpp_compiler,omitempty"`
+	// CppCompilerVersion is the version of CppCompiler, e.g., "10.0.0". "unknown" if the compiler
+	// didn't report a version.
+	CppCompilerVersion string `json:"cpp_compiler_version,omitempty"`
+	// LinkerVersion is the version of the linker used by CppCompiler, e.g., "2.34" for GNU ld.
+	// Blank if C++ configs weren't generated or the linker didn't report a version.
+	LinkerVersion string `json:"linker_version,omitempty"`
+	// CppStdlib is the C++ standard library the C++ configs were generated for, e.g., "libc++".
+	// Blank if C++ configs weren't generated or CppStdlib wasn't specified.
+	CppStdlib string `json:"cpp_stdlib,omitempty"`
+	// CppToolchainResolution is true if the C++ configs are expected to be used with platform based
+	// C++ toolchain resolution, i.e., without --crosstool_top.
+	CppToolchainResolution bool `json:"cc_toolchain_resolution,omitempty"`
+	// ProbedImage is the resolved toolchain image that was probed to generate the configs. Only
+	// set if the generated platform uses a different image.
+	ProbedImage string `json:"probed_image,omitempty"`
+	// PlatformImage is the image the generated platform uses if it was overridden to differ from
+	// the probed image, e.g., the same image in a different registry.
+	PlatformImage string `json:"platform_image,omitempty"`
+	// TarballPrefix is the directory inside the configs tarball containing the configs, i.e., the
+	// strip_prefix of the http_archive importing the configs tarball. Blank if the configs are at
+	// the root of the tarball.
+	TarballPrefix string `json:"tarball_prefix,omitempty"`
+	// TarballFormat is how the configs tarball is compressed, e.g., "tar.zst". Blank in manifests
+	// of uncompressed tarballs written before the format was recorded.
+	TarballFormat string `json:"tarball_format,omitempty"`
+	// ImageArch is the CPU architecture of the toolchain image as reported by docker, e.g., "amd64"
+	// or "arm64". Blank in manifests generated before the architecture was recorded.
+	ImageArch string `json:"image_arch,omitempty"`
+	// RepoTags are the repo tags recorded in the metadata of the image tarball the toolchain image
+	// was loaded from, if any.
+	RepoTags []string `json:"repo_tags,omitempty"`
+	// ApptainerImage is the absolute path of the local Apptainer (Singularity) SIF image the
+	// configs were generated for instead of a docker image. The ImageDigest is the sha256 digest of
+	// the SIF file.
+	ApptainerImage string `json:"apptainer_image,omitempty"`
+	// ImageLabels are the labels embedded in the metadata of the ApptainerImage, if any.
+	ImageLabels map[string]string `json:"image_labels,omitempty"`
+	// RustcVersion is the release of rustc in the toolchain container if Rust configs were
+	// generated, e.g., "1.75.0".
+	RustcVersion string `json:"rustc_version,omitempty"`
+	// RustHostTriple is the target triple rustc runs on if Rust configs were generated.
+	RustHostTriple string `json:"rust_host_triple,omitempty"`
+	// RustSysroot is the root of the Rust toolchain in the toolchain container if Rust configs were
+	// generated.
+	RustSysroot string `json:"rust_sysroot,omitempty"`
+	// CargoVersion is the version of cargo in the toolchain container if Rust configs were
+	// generated & cargo is installed.
+	CargoVersion string `json:"cargo_version,omitempty"`
+	// Only is the only kind of config files that were written if the configs are a partial
+	// generation, e.g., "platform". Blank if all config files were written.
+	Only string `json:"only,omitempty"`
+	// GeneratorVersion is the version of the binary that generated the configs or the manifest,
+	// see GeneratorVersion. Blank in manifests written before the version was recorded.
+	GeneratorVersion string `json:"generator_version,omitempty"`
+	// RecommendedCPU & RecommendedMemory are the CPUs, e.g., "4", & memory, e.g., "16Gi",
+	// available to the toolchain container during detection as a starting point to size the remote
+	// workers. They're advisory because they describe the docker host running detection. Blank
+	// unless DetectResources was specified.
+	RecommendedCPU    string `json:"recommended_cpu,omitempty"`
+	RecommendedMemory string `json:"recommended_memory,omitempty"`
+}
+
+// toJSON returns the given manifest encoded as JSON.
+func (m *Manifest) toJSON() ([]byte, error) {
+	blob, err := json.MarshalIndent(m, "", " ")
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate JSON for given manifest: %w", err)
+	}
+	return blob, nil
 }
 
 // ToJSONFile writes the given manifest to a JSON file at the given path.
 func (m *Manifest) ToJSONFile(filePath string) error {
-	blob, err := json.MarshalIndent(m, "", " ")
+	blob, err := m.toJSON()
 	if err != nil {
-		return fmt.Errorf("unable to generate JSON for given manifest: %w", err)
+		return err
 	}
 	if err := ioutil.WriteFile(filePath, blob, os.ModePerm); err != nil {
 		return fmt.Errorf("unable to write the given manifest as JSON to %q: %w", filePath, err)
@@ -973,40 +2684,189 @@ func ManifestFromJSONFile(filePath string) (*Manifest, error) {
 	if err := json.Unmarshal(blob, m); err != nil {
 		return nil, fmt.Errorf("unable to parse the contents of %q as a JSON manifest: %w", filePath, err)
 	}
-
+	if err := checkSchemaVersion(m, false); err != nil {
+		return nil, err
+	}
 	return m, nil
 }
 
-// createManifest writes a manifest JSON file containing information about the generated configs if
-// the given options specified a manifest file.
-func createManifest(o *Options) error {
-	if len(o.OutputManifest) == 0 {
-		return nil
-	}
-	m := Manifest{
+// newManifest returns the manifest containing information about the generated configs without the
+// digest of the configs tarball. d is the docker runner of the toolchain image that was probed & f
+// are the facts detected in it.
+func newManifest(o *Options, d *dockerRunner, f *detectionFacts) (*Manifest, error) {
+	m := &Manifest{
+		SchemaVersion:      ManifestSchemaVersion,
+		GeneratorVersion:   GeneratorVersion(),
 		BazelVersion:       o.BazelVersion,
-		ToolchainContainer: o.ToolchainContainer,
+		ToolchainContainer: parseImageRef(o.ToolchainContainer).name(),
 		ExecOS:             o.PlatformParams.OSFamily,
+		ExecCPU:            o.ExecCPU,
+		TargetOS:           o.TargetOS,
+		TargetCPU:          o.TargetCPU,
+		RepoName:           repoName(o),
+		PlatformName:       platformName(o),
+		JavaVersion:        f.JavaVersion,
+		TarballPrefix:      o.TarballPrefix,
+		TarballFormat:      o.TarballFormat,
+		OSID:               f.OSID,
+		OSVersionID:        f.OSVersionID,
+		RepoTags:           d.repoTags,
+		ImageArch:          d.arch,
+	}
+	if o.Only != OnlyAll {
+		m.Only = o.Only
+	}
+	if len(m.ToolchainContainer) == 0 && len(d.repoTags) != 0 {
+		m.ToolchainContainer = d.repoTags[0]
+	}
+	// The unique tag of an image built from a Dockerfile would make the manifest differ per run.
+	if len(m.ToolchainContainer) == 0 && len(d.builtImage) != 0 {
+		m.ToolchainContainer = BuildImageRepository
+	}
+	if len(m.ToolchainContainer) == 0 && d.existing {
+		m.ToolchainContainer = d.containerImage
+	}
+	if d.apptainerDir != "" {
+		m.ApptainerImage = d.containerImage
+		m.ImageLabels = d.imageLabels
 	}
-	// Extract the sha256 digest from the image name to be included in the manifest.
-	s := imageDigestRegexp.FindStringSubmatch(o.PlatformParams.ToolchainContainer)
-	if len(s) != 2 {
-		return fmt.Errorf("failed to extract sha256 digest using regex from image name %q, got %d substrings, want 2", o.PlatformParams.ToolchainContainer, len(s))
-	}
-	m.ImageDigest = s[1]
-	// Include the sha256 digest of the configs tarball if output tarball generation was enabled by
-	// actually hashing the contents of the output tarball.
-	if len(o.OutputTarball) != 0 {
-		d, err := digestFile(o.OutputTarball)
+	if o.GenCPPConfigs {
+		m.CppCompiler = f.CppCompiler
+		m.CppCompilerVersion = f.CppCompilerVersion
+		m.LinkerVersion = f.LinkerVersion
+		m.CppStdlib = o.CppStdlib
+		m.CppSysroot = o.TargetSysroot
+		u, err := usesCcToolchainResolution(o)
 		if err != nil {
-			return fmt.Errorf("unable to compute the sha256 digest of the output tarball file for the output manifest: %w", err)
+			return nil, err
 		}
-		m.ConfigsTarballDigest = d
+		m.CppToolchainResolution = u
+	}
+	if o.GenJavaConfigs && o.JavaCompat == JavaCompatBoth {
+		m.JavaCompat = o.JavaCompat
+	}
+	if o.DetectResources {
+		m.RecommendedCPU = f.ResourceCPUs
+		m.RecommendedMemory = f.ResourceMemory
 	}
+	if o.GenRustConfigs {
+		m.RustcVersion = f.RustcVersion
+		m.RustHostTriple = f.RustHostTriple
+		m.RustSysroot = f.RustSysroot
+		m.CargoVersion = f.CargoVersion
+	}
+	min, max, err := bazelVersionRange(o)
+	if err != nil {
+		return nil, err
+	}
+	m.MinBazelVersion, m.MaxBazelVersion = min, max
+	if len(o.PlatformImageOverride) != 0 {
+		m.ProbedImage = d.resolvedImage
+		m.PlatformImage = o.PlatformParams.ToolchainContainer
+	}
+	m.ImageDigest, m.ImageID, err = imageDigestOrID(d.resolvedImage)
+	if err != nil {
+		return nil, err
+	}
+	if r := parseImageRef(o.ToolchainContainer); len(r.digest) != 0 && r.digest != "sha256:"+m.ImageDigest {
+		o.log.Warningf("Toolchain image %q resolved to %q with a different digest, recording the resolved digest in the manifest.", o.ToolchainContainer, d.resolvedImage)
+	}
+	return m, nil
+}
+
+// imageDigestOrID returns the sha256 digest of the given resolved image referenced by digest or, if
+// the image was resolved to its local image ID because it has no registry digest, the image ID.
+func imageDigestOrID(resolvedImage string) (string, string, error) {
+	s := imageDigestRegexp.FindStringSubmatch(resolvedImage)
+	if len(s) != 2 {
+		return "", "", fmt.Errorf("failed to extract sha256 digest using regex from image name %q, got %d substrings, want 2", resolvedImage, len(s))
+	}
+	if resolvedImage == s[0] {
+		return "", s[1], nil
+	}
+	return s[1], "", nil
+}
+
+// embeddedManifest returns the given manifest as the JSON file embedded in the output tarball.
+// Must be called before the digest of the configs tarball is set in the manifest.
+func embeddedManifest(m *Manifest) (generatedFile, error) {
+	blob, err := m.toJSON()
+	if err != nil {
+		return generatedFile{}, err
+	}
+	return generatedFile{name: EmbeddedManifestFile, contents: blob}, nil
+}
+
+// createManifest writes the given manifest to a JSON file if the given options specified a manifest
+// file. tarballDigest is the sha256 digest of the output tarball, if one was generated.
+func createManifest(o *Options, m *Manifest, tarballDigest string) error {
+	if len(o.OutputManifest) == 0 {
+		return nil
+	}
+	// Include the sha256 digest of the configs tarball if output tarball generation was enabled.
+	// The digest is computed over the bytes actually written, i.e., it's also correct if the
+	// tarball was streamed.
+	m.ConfigsTarballDigest = tarballDigest
 	if err := m.ToJSONFile(o.OutputManifest); err != nil {
 		return fmt.Errorf("error writing manifest file: %w", err)
 	}
-	log.Printf("Wrote JSON manifest to %q.", o.OutputManifest)
+	o.log.Infof("Wrote JSON manifest to %q.", o.OutputManifest)
+	return nil
+}
+
+// withRegistryTrust calls the given function pulling ToolchainContainer in the given options while
+// the docker daemon trusts RegistryCACert, if specified.
+func withRegistryTrust(o *Options, pull func() error) error {
+	if len(o.ToolchainContainer) != 0 && len(o.RegistryCACert) != 0 {
+		restore, err := installRegistryCACert(o.log, o.ToolchainContainer, o.RegistryCACert)
+		if err != nil {
+			return fmt.Errorf("unable to make docker trust the registry CA certificate: %w", err)
+		}
+		// The CA certificate is only trusted while the image is pulled.
+		defer restore()
+	}
+	if len(o.ToolchainContainer) != 0 && o.InsecureRegistry {
+		o.log.Warningf("InsecureRegistry CAN'T DISABLE TLS VERIFICATION FOR DOCKER PULLS. The registry of %q must be listed in the \"insecure-registries\" of the docker daemon configuration to pull from it without verification.", o.ToolchainContainer)
+	}
+	return pull()
+}
+
+// resolveWithoutPull returns a runner for ToolchainContainer in the given options resolved to its
+// digest in the registry without pulling the image if facts cached in CacheDir may make running
+// the image unnecessary. Returns nil if the image must be pulled right away, e.g., because it's
+// loaded from a tarball or the registry couldn't be queried, in which case the digest is resolved
+// by docker after pulling.
+func resolveWithoutPull(ctx context.Context, o *Options) *dockerRunner {
+	if len(o.CacheDir) == 0 || o.NoCache || o.VerifyCPP || len(o.ToolchainContainer) == 0 || len(o.ImageTarball) != 0 {
+		return nil
+	}
+	c, err := newHTTPClient(o.log, o.RegistryCACert, o.InsecureRegistry, o.HTTPUserAgent)
+	if err != nil {
+		o.log.Warningf("Unable to initialize the HTTP client to resolve toolchain image %q in its registry, pulling it instead: %v", o.ToolchainContainer, err)
+		return nil
+	}
+	digest, err := resolveRegistryDigest(ctx, c, o.ToolchainContainer)
+	if err != nil {
+		o.log.Infof("Unable to resolve toolchain image %q in its registry without pulling it, pulling it instead: %v", o.ToolchainContainer, err)
+		return nil
+	}
+	return newUnpulledDockerRunner(ctx, o.log, o.ToolchainContainer, digest, o.DockerPlatform, o.ExecOS, o.Cleanup, pullProgressReporter(o, o.ToolchainContainer))
+}
+
+// ensurePulled pulls the toolchain image of the given runner if it was resolved without pulling it
+// & verifies its architecture like it's verified for images pulled right away.
+func ensurePulled(d *dockerRunner, o *Options) error {
+	if !d.unpulled {
+		return nil
+	}
+	if err := o.stage(StagePull, func() error { return withRegistryTrust(o, d.pull) }); err != nil {
+		return fmt.Errorf("failed to pull the toolchain container image: %w", err)
+	}
+	arch, err := verifyImageArch(d, o)
+	if err != nil {
+		return err
+	}
+	d.arch = arch
 	return nil
 }
 
@@ -1019,66 +2879,180 @@ func createManifest(o *Options) error {
 //  - config- Toolchain entrypoint target for cc_crosstool_top & the auto-generated platform target.
 //  - java- Java toolchain definition.
 func Run(o Options) error {
+	return RunWithContext(context.Background(), o)
+}
+
+// RunWithContext is like Run but stops config generation once the given context is done, e.g.,
+// because the user interrupted this tool. The toolchain container is removed regardless of how
+// config generation ends.
+func RunWithContext(ctx context.Context, o Options) error {
+	if o.Observer != nil {
+		o.log = logging.NewLogger(o.Observer.OnLog)
+	}
 	if err := processTempDir(&o); err != nil {
 		return fmt.Errorf("unable to initialize a local temporary working directory to store intermediate files: %w", err)
 	}
-	d, err := newDockerRunner(o.ToolchainContainer, o.DockerPlatform, o.Cleanup)
-	if err != nil {
+	var d *dockerRunner
+	if err := o.stage(StagePull, func() error {
+		var err error
+		if len(o.ExistingContainer) != 0 {
+			d, err = newExistingDockerRunner(ctx, o.log, o.ExistingContainer, o.ExecOS)
+			return err
+		}
+		if len(o.ApptainerImage) != 0 {
+			d, err = newApptainerRunner(ctx, o.log, o.ApptainerImage, o.TempWorkDir, o.Cleanup)
+			return err
+		}
+		if len(o.Dockerfile) != 0 {
+			d, err = newDockerfileRunner(ctx, o.log, o.Dockerfile, o.BuildContext, o.DockerPlatform, o.ExecOS, o.Cleanup)
+			return err
+		}
+		if d = resolveWithoutPull(ctx, &o); d != nil {
+			return nil
+		}
+		return withRegistryTrust(&o, func() error {
+			d, err = newDockerRunner(ctx, o.log, o.ToolchainContainer, o.ImageTarball, o.DockerPlatform, o.ExecOS, o.Cleanup, pullProgressReporter(&o, o.ToolchainContainer))
+			return err
+		})
+	}); err != nil {
 		return fmt.Errorf("failed to initialize a docker container: %w", err)
 	}
 	defer d.cleanup()
-
-	o.PlatformParams.ToolchainContainer = d.resolvedImage
-
-	if _, err := d.execCmd("mkdir", workdir(o.ExecOS)); err != nil {
-		return fmt.Errorf("failed to create an empty working directory in the container")
+	if o.Warnings == nil {
+		o.Warnings = &Warnings{}
 	}
-	d.workdir = workdir(o.ExecOS)
-
-	bazelPath := o.BazelPath
-	if bazelPath == "" {
-		bazelPath, err = installBazelisk(d, o.TempWorkDir, o.ExecOS)
+	d.warnings = o.Warnings
+	// The architecture of an image that wasn't pulled yet is verified once it's pulled.
+	if !d.unpulled {
+		arch, err := verifyImageArch(d, &o)
 		if err != nil {
-			return fmt.Errorf("failed to install Bazelisk into the toolchain container: %w", err)
+			return err
 		}
+		d.arch = arch
+	}
+	if o.NoShell {
+		d.probeHelper = o.ProbeHelper
 	}
+	d.tmpfsSize = o.ContainerTmpfsSize
+	d.scratchMount = o.ScratchMount
+	d.runFlags = o.ContainerRunFlags
 
-	cppConfigsTarball, err := genCppConfigs(d, &o, bazelPath)
+	o.PlatformParams.ToolchainContainer = d.resolvedImage
+	if len(o.PlatformImageOverride) != 0 {
+		o.PlatformParams.ToolchainContainer = strings.TrimPrefix(o.PlatformImageOverride, "docker://")
+		o.log.Infof("Generated platform will use image %q instead of the probed image %q.", o.PlatformParams.ToolchainContainer, d.resolvedImage)
+	}
+
+	// Options with C++ and/or Java config generation disabled if their config files aren't written.
+	do := o.detectionOptions()
+	f, err := detectFacts(d, do)
 	if err != nil {
-		return fmt.Errorf("failed to generate C++ configs: %w", err)
+		return fmt.Errorf("failed to detect the toolchains installed in the toolchain container: %w", err)
+	}
+	if err := warningsError(&o, o.Warnings.All()); err != nil {
+		return err
 	}
-	javaBuild, err := genJavaConfigs(d, &o)
+	if do.GenCPPConfigs && isCrossCompiling(&o) {
+		o.TargetSysroot = f.CppSysroot
+		do.TargetSysroot = f.CppSysroot
+	}
+	if len(o.DumpDetectionFacts) != 0 {
+		if err := dumpDetectionFacts(do, d, f); err != nil {
+			return fmt.Errorf("unable to dump the detected facts: %w", err)
+		}
+		o.log.Infof("Wrote the detected facts to %q without generating configs.", o.DumpDetectionFacts)
+		removeTempWorkDir(&o)
+		return nil
+	}
+	if do.GenCPPConfigs && hasCppBuildOverrides(&o) {
+		p := path.Join(o.TempWorkDir, "cpp_configs_overridden.tar")
+		if err := applyCppBuildOverrides(&o, f.CppConfigsTarball, p); err != nil {
+			return fmt.Errorf("unable to apply C++ overrides to the generated C++ configs: %w", err)
+		}
+		f.CppConfigsTarball = p
+	}
+	oc, err := genOutputConfigs(&o, do, f)
 	if err != nil {
-		return fmt.Errorf("failed to extract information about the installed JDK version in the toolchain container needed to generate Java configs: %w", err)
+		return err
 	}
-
-	configBuild, err := genConfigBuild(&o)
+	m, err := newManifest(do, d, f)
 	if err != nil {
-		return fmt.Errorf("unable to generate the BUILD file with the C++ crosstool and/or the default platform definition: %w", err)
+		return fmt.Errorf("unable to create the manifest: %w", err)
 	}
-
-	oc := outputConfigs{
-		license: generatedFile{
-			name:     "LICENSE",
-			contents: licenseBlob,
-		},
-		cppConfigsTarball: cppConfigsTarball,
-		configBuild:       configBuild,
-		javaBuild:         javaBuild,
+	if o.EmbedManifest {
+		if oc.manifest, err = embeddedManifest(m); err != nil {
+			return fmt.Errorf("unable to create the manifest to embed in the output tarball: %w", err)
+		}
 	}
-	if err := assembleConfigs(&o, oc); err != nil {
+	ao := assembleOptions(&o)
+	var tarballDigest string
+	if err := o.stage(StageTar, func() error {
+		if err := formatOutputConfigs(ctx, &o, &oc); err != nil {
+			return fmt.Errorf("unable to format the generated configs: %w", err)
+		}
+		var err error
+		if tarballDigest, err = assembleConfigs(ao, oc); err != nil {
+			return err
+		}
+		if !o.genTarball() {
+			if m.ConfigsDirDigest, err = configsDirDigest(&o, oc); err != nil {
+				return fmt.Errorf("unable to compute the digest of the configs copied to %q: %w", o.OutputSourceRoot, err)
+			}
+		}
+		return nil
+	}); err != nil {
 		return fmt.Errorf("unable to assemble C++/Java/Crosstool top/Platform definitions to generate the final toolchain configs output: %w", err)
 	}
+	if o.SimulateRBE {
+		if err := ensurePulled(d, &o); err != nil {
+			return err
+		}
+	}
+	if err := o.stage(StageSimulate, func() error { return simulateRBE(d, &o, oc) }); err != nil {
+		return fmt.Errorf("simulating remote builds with the generated configs failed: %w", err)
+	}
+	if len(o.ValidateOnly) != 0 {
+		if err := validateConfigsDir(ao); err != nil {
+			return err
+		}
+		o.log.Infof("The generated configs match the configs in %q.", o.ValidateOnly)
+		removeTempWorkDir(&o)
+		return nil
+	}
 
-	if err := createManifest(&o); err != nil {
+	if err := createManifest(&o, m, tarballDigest); err != nil {
 		return fmt.Errorf("unable to create the manifest file: %w", err)
 	}
+	if err := createBazelrc(&o, m, tarballDigest); err != nil {
+		return fmt.Errorf("unable to create the bazelrc file: %w", err)
+	}
 
-	if o.Cleanup {
-		if err := os.RemoveAll(o.TempWorkDir); err != nil {
-			log.Printf("Warning: Unable to delete temporary working directory %q: %v", o.TempWorkDir, err)
+	if len(o.OutputSummary) != 0 {
+		s, err := NewSummary(&o)
+		if err != nil {
+			return fmt.Errorf("unable to determine the labels of the generated configs: %w", err)
 		}
+		if err := s.ToJSONFile(o.OutputSummary); err != nil {
+			return fmt.Errorf("error writing summary file: %w", err)
+		}
+		o.log.Infof("Wrote JSON summary to %q.", o.OutputSummary)
 	}
 
+	if err := o.stage(StagePostHook, func() error { return runPostHook(ctx, &o, oc) }); err != nil {
+		return err
+	}
+
+	removeTempWorkDir(&o)
 	return nil
 }
+
+// removeTempWorkDir deletes the local temporary working directory if the given options specified
+// Cleanup.
+func removeTempWorkDir(o *Options) {
+	if !o.Cleanup {
+		return
+	}
+	if err := os.RemoveAll(o.TempWorkDir); err != nil {
+		o.log.Warningf("Unable to delete temporary working directory %q: %v", o.TempWorkDir, err)
+	}
+}
@@ -15,8 +15,27 @@
 package rbeconfigsgen
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
 	"testing"
-  "text/template"
+	"text/template"
+	"time"
 )
 
 func TestGenCppToolchainTarget(t *testing.T) {
@@ -86,6 +105,366 @@ func TestGenCppToolchainTarget(t *testing.T) {
 	}
 }
 
+func TestGenConfigBuildPlatformConstraints(t *testing.T) {
+	o := &Options{
+		ExecOS:              OSLinux,
+		GenCPPConfigs:       true,
+		PlatformConstraints: []string{"@mycorp//constraints:toolchain_flavor", "//constraints:gpu"},
+	}
+	if err := o.ApplyDefaults(o.ExecOS); err != nil {
+		t.Fatalf("ApplyDefaults: Failed to apply defaults=%v", err)
+	}
+	g, err := genConfigBuild(o)
+	if err != nil {
+		t.Fatalf("genConfigBuild failed: %v", err)
+	}
+	build := string(g.contents)
+	i := strings.Index(build, "platform(")
+	if i < 0 {
+		t.Fatalf("Generated BUILD file didn't define a platform:\n%s", build)
+	}
+	platform := build[i:]
+	for _, c := range append(o.PlatformParams.ExecConstraints, o.PlatformConstraints...) {
+		if !strings.Contains(platform, fmt.Sprintf("        %q,\n", c)) {
+			t.Errorf("Generated platform didn't have constraint value %q:\n%s", c, platform)
+		}
+	}
+	if strings.Contains(build[:i], "toolchain_flavor") {
+		t.Errorf("Extra platform constraints were added to the C++ toolchain:\n%s", build[:i])
+	}
+}
+
+func TestGenConfigBuildPlatformName(t *testing.T) {
+	o := &Options{
+		ExecOS:        OSLinux,
+		GenCPPConfigs: true,
+		PlatformName:  "ubuntu_platform",
+	}
+	if err := o.ApplyDefaults(o.ExecOS); err != nil {
+		t.Fatalf("ApplyDefaults: Failed to apply defaults=%v", err)
+	}
+	g, err := genConfigBuild(o)
+	if err != nil {
+		t.Fatalf("genConfigBuild failed: %v", err)
+	}
+	if want := "platform(\n    name = \"ubuntu_platform\",\n"; !strings.Contains(string(g.contents), want) {
+		t.Errorf("Generated BUILD file didn't define the platform %q:\n%s", o.PlatformName, g.contents)
+	}
+	if a := configAliases(o)[0]; a.Actual != "//config:ubuntu_platform" {
+		t.Errorf("platform alias points at %q, want %q", a.Actual, "//config:ubuntu_platform")
+	}
+}
+
+func TestGenConfigBuildDockerExecProperties(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(o *Options)
+		want   []string
+	}{
+		{
+			name:   "None",
+			modify: func(o *Options) {},
+		},
+		{
+			name: "Network",
+			modify: func(o *Options) {
+				o.DockerNetwork = "standard"
+			},
+			want: []string{`"dockerNetwork": "standard"`},
+		},
+		{
+			name: "All",
+			modify: func(o *Options) {
+				o.DockerNetwork = "off"
+				o.DockerRunAsRoot = true
+				o.DockerPrivileged = true
+			},
+			want: []string{`"dockerNetwork": "off"`, `"dockerPrivileged": "True"`, `"dockerRunAsRoot": "True"`},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			o := &Options{
+				ExecOS:        OSLinux,
+				GenCPPConfigs: true,
+			}
+			if err := o.ApplyDefaults(o.ExecOS); err != nil {
+				t.Fatalf("ApplyDefaults: Failed to apply defaults=%v", err)
+			}
+			tc.modify(o)
+			g, err := genConfigBuild(o)
+			if err != nil {
+				t.Fatalf("genConfigBuild failed: %v", err)
+			}
+			build := string(g.contents)
+			i := strings.Index(build, "exec_properties = {")
+			if i < 0 {
+				t.Fatalf("Generated BUILD file didn't define exec properties:\n%s", build)
+			}
+			props := build[i:]
+			for _, p := range tc.want {
+				if !strings.Contains(props, "        "+p+",\n") {
+					t.Errorf("Generated platform didn't have exec property %s:\n%s", p, props)
+				}
+			}
+			if n := len(regexp.MustCompile(`"docker[A-Z]`).FindAllString(props, -1)); n != len(tc.want) {
+				t.Errorf("Generated platform had %d docker exec properties, want %d:\n%s", n, len(tc.want), props)
+			}
+		})
+	}
+}
+
+func TestWorkerExecProperties(t *testing.T) {
+	tests := []struct {
+		name string
+		o    *Options
+		want []ExecProperty
+	}{
+		{
+			name: "Disabled",
+			o:    &Options{},
+		},
+		{
+			name: "Supports workers",
+			o:    &Options{SupportsWorkers: true},
+			want: []ExecProperty{{Name: "supportsWorkers", Value: "True"}},
+		},
+		{
+			name: "Mnemonics",
+			o:    &Options{SupportsWorkers: true, WorkerKeyMnemonics: []string{"Javac", "Scalac"}},
+			want: []ExecProperty{{Name: "supportsWorkers", Value: "True"}, {Name: "workerKeyMnemonics", Value: "Javac,Scalac"}},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if got := workerExecProperties(tc.o); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("workerExecProperties()=%v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPlatformExecProperties(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	tests := []struct {
+		name    string
+		o       Options
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "Image by digest",
+			o:    Options{ToolchainContainer: "gcr.io/foo/bar:1.0@" + digest},
+			want: map[string]string{"container-image": "docker://gcr.io/foo/bar@" + digest, "OSFamily": "Linux"},
+		},
+		{
+			name: "Image by tag",
+			o:    Options{ToolchainContainer: "gcr.io/foo/bar:1.0"},
+			want: map[string]string{"container-image": "docker://gcr.io/foo/bar:1.0", "OSFamily": "Linux"},
+		},
+		{
+			name: "Override & custom properties",
+			o: Options{
+				ToolchainContainer:    "gcr.io/foo/bar:1.0",
+				PlatformImageOverride: "docker://mirror.io/bar@" + digest,
+				DockerNetwork:         "standard",
+				SupportsWorkers:       true,
+			},
+			want: map[string]string{
+				"container-image": "docker://mirror.io/bar@" + digest,
+				"OSFamily":        "Linux",
+				"dockerNetwork":   "standard",
+				"supportsWorkers": "True",
+			},
+		},
+		{
+			name:    "Image tarball",
+			o:       Options{ImageTarball: "image.tar"},
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if err := tc.o.ApplyDefaults(OSLinux); err != nil {
+				t.Fatalf("ApplyDefaults() failed: %v", err)
+			}
+			got, err := PlatformExecProperties(&tc.o)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("PlatformExecProperties() returned error %v, want error %v", err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("PlatformExecProperties()=%v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAssembleConfigTarballWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "assemble_tarball_test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	oc := outputConfigs{
+		license:     generatedFile{name: "LICENSE", contents: []byte("license")},
+		configBuild: generatedFile{name: "config/BUILD", contents: []byte("platform")},
+	}
+
+	fo := &Options{OutputTarball: filepath.Join(dir, "configs.tar")}
+	fileDigest, err := assembleConfigTarball(fo, oc)
+	if err != nil {
+		t.Fatalf("assembleConfigTarball(OutputTarball=%q) failed: %v", fo.OutputTarball, err)
+	}
+	want, err := ioutil.ReadFile(fo.OutputTarball)
+	if err != nil {
+		t.Fatalf("Failed to read the output tarball: %v", err)
+	}
+	if d, err := digestFile(fo.OutputTarball); err != nil || d != fileDigest {
+		t.Errorf("assembleConfigTarball(OutputTarball=%q) returned digest %q, want %q (err=%v)", fo.OutputTarball, fileDigest, d, err)
+	}
+
+	buf := &bytes.Buffer{}
+	streamDigest, err := assembleConfigTarball(&Options{TarballWriter: buf}, oc)
+	if err != nil {
+		t.Fatalf("assembleConfigTarball(TarballWriter) failed: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("assembleConfigTarball(TarballWriter) wrote %d bytes different from the %d bytes written to a file", buf.Len(), len(want))
+	}
+	if streamDigest != fileDigest {
+		t.Errorf("assembleConfigTarball(TarballWriter) returned digest %q, want %q", streamDigest, fileDigest)
+	}
+}
+
+func TestAssembleConfigTarballEmbeddedManifest(t *testing.T) {
+	m := &Manifest{BazelVersion: "6.4.0", ImageDigest: "abcd"}
+	em, err := embeddedManifest(m)
+	if err != nil {
+		t.Fatalf("embeddedManifest() failed: %v", err)
+	}
+	oc := outputConfigs{
+		license:     generatedFile{name: "LICENSE", contents: []byte("license")},
+		configBuild: generatedFile{name: "config/BUILD", contents: []byte("platform")},
+		manifest:    em,
+	}
+	buf := &bytes.Buffer{}
+	if _, err := assembleConfigTarball(&Options{TarballWriter: buf, TarballPrefix: "rbe_default"}, oc); err != nil {
+		t.Fatalf("assembleConfigTarball() failed: %v", err)
+	}
+
+	want := "rbe_default/" + EmbeddedManifestFile
+	r := tar.NewReader(buf)
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			t.Fatalf("Output tarball didn't contain the embedded manifest %q", want)
+		}
+		if err != nil {
+			t.Fatalf("Failed to read the output tarball: %v", err)
+		}
+		if h.Name != want {
+			continue
+		}
+		got := &Manifest{}
+		if err := json.NewDecoder(r).Decode(got); err != nil {
+			t.Fatalf("Failed to parse the embedded manifest: %v", err)
+		}
+		if got.BazelVersion != m.BazelVersion || got.ImageDigest != m.ImageDigest || got.ConfigsTarballDigest != "" {
+			t.Errorf("Embedded manifest=%+v, want %+v without a configs tarball digest", got, m)
+		}
+		return
+	}
+}
+
+func TestConfigsDirDigest(t *testing.T) {
+	oc := outputConfigs{
+		license:           generatedFile{name: "LICENSE", contents: []byte("license")},
+		cppConfigsTarball: writeTestTarball(t, map[string]string{"BUILD": "cc"}),
+		configBuild:       generatedFile{name: "config/BUILD", contents: []byte("platform")},
+		javaBuild:         generatedFile{name: "java/BUILD", contents: []byte("java")},
+	}
+	o := &Options{OutputSourceRoot: t.TempDir(), GenCPPConfigs: true, GenJavaConfigs: true}
+	got, err := configsDirDigest(o, oc)
+	if err != nil {
+		t.Fatalf("configsDirDigest() failed: %v", err)
+	}
+
+	// The digest matches the output of sha256sum for the files copied to the output directory.
+	if err := copyConfigsToOutputDir(o, oc); err != nil {
+		t.Fatalf("copyConfigsToOutputDir() failed: %v", err)
+	}
+	var lines []string
+	for _, f := range []string{"LICENSE", "cc/BUILD", "config/BUILD", "java/BUILD"} {
+		blob, err := ioutil.ReadFile(filepath.Join(o.OutputSourceRoot, f))
+		if err != nil {
+			t.Fatalf("Failed to read %q from the output directory: %v", f, err)
+		}
+		d := sha256.Sum256(blob)
+		lines = append(lines, fmt.Sprintf("%s  %s\n", hex.EncodeToString(d[:]), f))
+	}
+	d := sha256.Sum256([]byte(strings.Join(lines, "")))
+	if want := hex.EncodeToString(d[:]); got != want {
+		t.Errorf("configsDirDigest()=%q, want %q", got, want)
+	}
+}
+
+func TestDetectionOptions(t *testing.T) {
+	tests := []struct {
+		only     string
+		wantCpp  bool
+		wantJava bool
+	}{
+		{only: "", wantCpp: true, wantJava: true},
+		{only: OnlyAll, wantCpp: true, wantJava: true},
+		{only: OnlyPlatform},
+		{only: OnlyCC, wantCpp: true},
+		{only: OnlyJava, wantJava: true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.only, func(t *testing.T) {
+			t.Parallel()
+			o := &Options{GenCPPConfigs: true, GenJavaConfigs: true, Only: tc.only}
+			do := o.detectionOptions()
+			if do.GenCPPConfigs != tc.wantCpp || do.GenJavaConfigs != tc.wantJava {
+				t.Errorf("detectionOptions() with Only=%q has (GenCPPConfigs, GenJavaConfigs)=(%v, %v), want (%v, %v)", tc.only, do.GenCPPConfigs, do.GenJavaConfigs, tc.wantCpp, tc.wantJava)
+			}
+			if !o.GenCPPConfigs || !o.GenJavaConfigs {
+				t.Errorf("detectionOptions() modified the given options")
+			}
+		})
+	}
+}
+
+func TestAssembleConfigTarballPartial(t *testing.T) {
+	// Only the platform BUILD file is written besides the LICENSE.
+	oc := outputConfigs{
+		license:     generatedFile{name: "LICENSE", contents: []byte("license")},
+		configBuild: generatedFile{name: "config/BUILD", contents: []byte("platform")},
+	}
+	o := &Options{OutputTarball: filepath.Join(t.TempDir(), "configs.tar"), GenCPPConfigs: true, GenJavaConfigs: true, Only: OnlyPlatform}
+	if _, err := assembleConfigTarball(o, oc); err != nil {
+		t.Fatalf("assembleConfigTarball() failed: %v", err)
+	}
+	got, err := tarballFileDigests(o.OutputTarball, "")
+	if err != nil {
+		t.Fatalf("tarballFileDigests() failed: %v", err)
+	}
+	var names []string
+	for name := range got {
+		names = append(names, name)
+	}
+	if len(names) != 2 || len(got["LICENSE"]) == 0 || len(got["config/BUILD"]) == 0 {
+		t.Errorf("assembleConfigTarball() wrote files %v, want only LICENSE & config/BUILD", names)
+	}
+}
+
 func TestGetJavaTemplate(t *testing.T) {
 	tests := []struct {
 		name string
@@ -96,75 +475,90 @@ func TestGetJavaTemplate(t *testing.T) {
 			name: "bazel 4, choose legacy",
 			want: legacyJavaBuildTemplate,
 			opt: &Options{
-        BazelVersion: "4.0.0",
-      },
+				BazelVersion: "4.0.0",
+			},
 		},
 		{
 			name: "bazel 5, choose BazelLt7",
 			want: javaBuildTemplateLt7,
 			opt: &Options{
-        BazelVersion: "5.0.0",
+				BazelVersion: "5.0.0",
 			},
 		},
 		{
 			name: "bazel 7, choose latest",
 			want: javaBuildTemplate,
 			opt: &Options{
-        BazelVersion: "7.0.0",
+				BazelVersion: "7.0.0",
+			},
+		},
+		{
+			name: "bazel 10, choose latest",
+			want: javaBuildTemplate,
+			opt: &Options{
+				BazelVersion: "10.0.0",
 			},
 		},
 		{
 			name: "bazel 7-pre, choose latest",
 			want: javaBuildTemplate,
 			opt: &Options{
-        BazelVersion: "7.0.0-pre.20230724.1",
+				BazelVersion: "7.0.0-pre.20230724.1",
 			},
 		},
 		{
 			name: "useLocalRuntime forced, choose latest",
 			want: javaBuildTemplate,
 			opt: &Options{
-			  JavaUseLocalRuntime: true,
+				JavaUseLocalRuntime: true,
 			},
 		},
 		{
 			name: "useLocalRuntime forced, bazel 4, choose BazelLt7",
 			want: javaBuildTemplateLt7,
 			opt: &Options{
-			  BazelVersion: "4.0.0",
-			  JavaUseLocalRuntime: true,
+				BazelVersion:        "4.0.0",
+				JavaUseLocalRuntime: true,
 			},
 		},
 		{
 			name: "useLocalRuntime forced, bazel 5, choose BazelLt7",
 			want: javaBuildTemplateLt7,
 			opt: &Options{
-			  BazelVersion: "5.0.0",
-			  JavaUseLocalRuntime: true,
+				BazelVersion:        "5.0.0",
+				JavaUseLocalRuntime: true,
 			},
 		},
 		{
 			name: "useLocalRuntime forced, bazel 6, choose BazelLt7",
 			want: javaBuildTemplateLt7,
 			opt: &Options{
-			  BazelVersion: "6.0.0",
-			  JavaUseLocalRuntime: true,
+				BazelVersion:        "6.0.0",
+				JavaUseLocalRuntime: true,
 			},
 		},
 		{
 			name: "useLocalRuntime forced, bazel 7, choose latest",
 			want: javaBuildTemplate,
 			opt: &Options{
-			  BazelVersion: "7.0.0",
-			  JavaUseLocalRuntime: true,
+				BazelVersion:        "7.0.0",
+				JavaUseLocalRuntime: true,
 			},
 		},
 		{
 			name: "useLocalRuntime forced, bazel 7-pre, choose latest",
 			want: javaBuildTemplate,
 			opt: &Options{
-			  BazelVersion: "7.0.0-pre.20200202",
-			  JavaUseLocalRuntime: true,
+				BazelVersion:        "7.0.0-pre.20200202",
+				JavaUseLocalRuntime: true,
+			},
+		},
+		{
+			name: "both Java compat, bazel 4, choose dual",
+			want: dualJavaBuildTemplate,
+			opt: &Options{
+				BazelVersion: "4.0.0",
+				JavaCompat:   JavaCompatBoth,
 			},
 		},
 	}
@@ -175,12 +569,1169 @@ func TestGetJavaTemplate(t *testing.T) {
 			t.Parallel()
 			// We skip validation since we don't set all options required for
 			// regular execution.
-			got, err := getJavaTemplate(tc.opt);
+			got, err := getJavaTemplate(tc.opt)
 			if err != nil {
-			  t.Fatalf("getJavaTemplate failed: %v, wanted: %v", err, tc.want)
+				t.Fatalf("getJavaTemplate failed: %v, wanted: %v", err, tc.want)
 			} else if got != tc.want {
 				t.Fatalf("getJavaTemplate: %v, wanted %v", got, tc.want)
 			}
 		})
 	}
 }
+
+func TestUsesLocalJavaRuntime(t *testing.T) {
+	tests := []struct {
+		version string
+		want    bool
+	}{
+		{version: "4.2.1", want: false},
+		{version: "5.0.0-pre.20210101", want: true},
+		{version: "6.0.0-pre.20230101", want: true},
+		{version: "6.4.0-mycorp", want: true},
+		{version: "7.0.0rc2", want: true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.version, func(t *testing.T) {
+			t.Parallel()
+			got, err := UsesLocalJavaRuntime(tc.version)
+			if err != nil {
+				t.Fatalf("UsesLocalJavaRuntime(%q) failed: %v", tc.version, err)
+			}
+			if got != tc.want {
+				t.Errorf("UsesLocalJavaRuntime(%q) = %v, want %v", tc.version, got, tc.want)
+			}
+		})
+	}
+	if _, err := UsesLocalJavaRuntime("mycorp-head"); err == nil {
+		t.Errorf("UsesLocalJavaRuntime(%q) succeeded, want error", "mycorp-head")
+	}
+}
+
+func TestForceLocalJavaRuntime(t *testing.T) {
+	f := false
+	o := &Options{
+		BazelVersion:          "mycorp-head",
+		JavaUseLocalRuntime:   true,
+		ForceLocalJavaRuntime: &f,
+	}
+	got, err := getJavaTemplate(o)
+	if err != nil {
+		t.Fatalf("getJavaTemplate failed: %v", err)
+	}
+	if got != legacyJavaBuildTemplate {
+		t.Errorf("getJavaTemplate: %v, wanted legacy template %v", got, legacyJavaBuildTemplate)
+	}
+}
+
+func TestGenJavaConfigsSourceTargetVersion(t *testing.T) {
+	tests := []struct {
+		name         string
+		bazelVersion string
+		javaCompat   string
+		source       string
+		target       string
+		want         []string
+		notWant      []string
+	}{
+		{
+			name:         "No versions",
+			bazelVersion: "7.0.0",
+			notWant:      []string{"default_java_toolchain"},
+		},
+		{
+			name:         "Bazel 7",
+			bazelVersion: "7.0.0",
+			source:       "11",
+			target:       "17",
+			want: []string{
+				`load("@rules_java//toolchains:default_java_toolchain.bzl", "default_java_toolchain")`,
+				`source_version = "11",`,
+				`target_version = "17",`,
+				`java_runtime = ":rbe_jdk",`,
+			},
+		},
+		{
+			name:         "Bazel 6",
+			bazelVersion: "6.4.0",
+			source:       "11",
+			target:       "11",
+			want: []string{
+				`load("@bazel_tools//tools/jdk:default_java_toolchain.bzl", "default_java_toolchain")`,
+				`source_version = "11",`,
+				`target_version = "11",`,
+			},
+		},
+		{
+			name:         "Both Java runtimes",
+			bazelVersion: "4.2.2",
+			javaCompat:   JavaCompatBoth,
+			source:       "11",
+			target:       "11",
+			want: []string{
+				"java_runtime(\n    name = \"jdk\",",
+				"local_java_runtime(\n    name = \"rbe_jdk\",",
+				`load("@bazel_tools//tools/jdk:default_java_toolchain.bzl", "default_java_toolchain")`,
+				`source_version = "11",`,
+			},
+			notWant: []string{"alias(", "@rules_java"},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			o := &Options{
+				BazelVersion:      tc.bazelVersion,
+				GenJavaConfigs:    true,
+				JavaCompat:        tc.javaCompat,
+				JavaSourceVersion: tc.source,
+				JavaTargetVersion: tc.target,
+			}
+			f := &detectionFacts{JavaHome: "/usr/lib/jvm/java-17", JavaVersion: "17.0.2"}
+			got, err := genJavaConfigs(o, f)
+			if err != nil {
+				t.Fatalf("genJavaConfigs() failed: %v", err)
+			}
+			build := string(got.contents)
+			for _, w := range tc.want {
+				if !strings.Contains(build, w) {
+					t.Errorf("genJavaConfigs() generated java/BUILD without %q:\n%s", w, build)
+				}
+			}
+			for _, w := range tc.notWant {
+				if strings.Contains(build, w) {
+					t.Errorf("genJavaConfigs() generated java/BUILD with %q:\n%s", w, build)
+				}
+			}
+		})
+	}
+}
+
+func TestCleanupAfterCancel(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake docker client is a shell script")
+	}
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "docker.log")
+	dockerPath := filepath.Join(dir, "docker")
+	// The fake docker client records its arguments & hangs when running a command inside the
+	// container until it's killed.
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %q\nif [ \"$1\" = exec ]; then exec sleep 60; fi\n", logPath)
+	if err := ioutil.WriteFile(dockerPath, []byte(script), 0755); err != nil {
+		t.Fatalf("Unable to write fake docker client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &dockerRunner{
+		dockerPath:    dockerPath,
+		containerName: "rbe_configs_gen_test",
+		containerID:   "abc123",
+		stopContainer: true,
+		execOS:        OSLinux,
+		ctx:           ctx,
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := d.execCmd("true"); err == nil {
+		t.Fatalf("execCmd succeeded, want error after the context was cancelled")
+	}
+	d.cleanup()
+
+	blob, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("Unable to read the fake docker client log: %v", err)
+	}
+	if !strings.Contains(string(blob), "rm -f abc123") {
+		t.Errorf("cleanup didn't remove the container after the context was cancelled, docker was invoked with:\n%s", blob)
+	}
+}
+
+func TestExistingDockerRunner(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake docker client is a shell script")
+	}
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "docker.log")
+	dockerPath := filepath.Join(dir, "docker")
+	digest := strings.Repeat("a", 64)
+	// The fake docker client records its arguments & reports a running container of an image
+	// pushed to a registry.
+	script := fmt.Sprintf(`#!/bin/sh
+echo "$@" >> %q
+case "$2" in
+--type=container) echo "cid123 true sha256:imageid toolchain:latest" ;;
+--type=image) echo "gcr.io/test/toolchain@sha256:%s" ;;
+esac
+`, logPath, digest)
+	if err := ioutil.WriteFile(dockerPath, []byte(script), 0755); err != nil {
+		t.Fatalf("Unable to write fake docker client: %v", err)
+	}
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(filepath.ListSeparator)+oldPath)
+	defer os.Setenv("PATH", oldPath)
+
+	d, err := newExistingDockerRunner(context.Background(), nil, "my_container", OSLinux)
+	if err != nil {
+		t.Fatalf("newExistingDockerRunner failed: %v", err)
+	}
+	if d.containerID != "cid123" || d.containerImage != "toolchain:latest" || d.resolvedImage != "gcr.io/test/toolchain@sha256:"+digest {
+		t.Errorf("newExistingDockerRunner returned runner with (containerID, containerImage, resolvedImage) = (%q, %q, %q), want (%q, %q, %q)", d.containerID, d.containerImage, d.resolvedImage, "cid123", "toolchain:latest", "gcr.io/test/toolchain@sha256:"+digest)
+	}
+	if err := d.startContainer(); err != nil {
+		t.Fatalf("startContainer failed: %v", err)
+	}
+	d.workdir = "/workdir_test"
+	d.cleanup()
+
+	blob, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("Unable to read the fake docker client log: %v", err)
+	}
+	log := string(blob)
+	if strings.Contains(log, "create") || strings.Contains(log, "rm -f") {
+		t.Errorf("Runner created or removed a container instead of using the existing one, docker was invoked with:\n%s", log)
+	}
+	if !strings.Contains(log, "exec cid123 rm -rf /workdir_test") {
+		t.Errorf("cleanup didn't remove the working directory from the existing container, docker was invoked with:\n%s", log)
+	}
+}
+
+func TestWorkdir(t *testing.T) {
+	for os, want := range map[string]string{OSLinux: "/workdir", OSWindows: "C:/workdir"} {
+		if got, err := workdir(os); err != nil || got != want {
+			t.Errorf("workdir(%q)=(%q, %v), want %q", os, got, err, want)
+		}
+	}
+	if got, err := workdir("plan9"); err == nil {
+		t.Errorf("workdir(%q)=%q, want error", "plan9", got)
+	}
+}
+
+func TestWindowsPath(t *testing.T) {
+	tests := []struct {
+		p    string
+		want string
+	}{
+		{p: "C:/rbe_configs_gen/workdir", want: "C:\\rbe_configs_gen\\workdir"},
+		{p: "C:\\rbe_configs_gen\\workdir", want: "C:\\rbe_configs_gen\\workdir"},
+		{p: "cpp_configs_project/WORKSPACE", want: "cpp_configs_project\\WORKSPACE"},
+		{p: "WORKSPACE", want: "WORKSPACE"},
+	}
+	for _, tc := range tests {
+		if got := windowsPath(tc.p); got != tc.want {
+			t.Errorf("windowsPath(%q)=%q, want %q", tc.p, got, tc.want)
+		}
+	}
+}
+
+func TestParseSymlinks(t *testing.T) {
+	tests := []struct {
+		name   string
+		out    string
+		dir    string
+		execOS string
+		want   []string
+	}{
+		{
+			name:   "Linux",
+			out:    "/out/external/local_config_cc/cc_wrapper.sh\n/out/external/local_config_cc/tools",
+			dir:    "/out/external/local_config_cc",
+			execOS: OSLinux,
+			want:   []string{"/out/external/local_config_cc/cc_wrapper.sh", "/out/external/local_config_cc/tools"},
+		},
+		{
+			name:   "Linux no symlinks",
+			dir:    "/out/external/local_config_cc",
+			execOS: OSLinux,
+		},
+		{
+			name:   "Windows",
+			out:    "msys_gcc_installation.bzl\r\ntools\r\n",
+			dir:    "C:/out/external/local_config_cc",
+			execOS: OSWindows,
+			want:   []string{"C:\\out\\external\\local_config_cc\\msys_gcc_installation.bzl", "C:\\out\\external\\local_config_cc\\tools"},
+		},
+		{
+			name:   "Windows no symlinks",
+			out:    "\r\n",
+			dir:    "C:/out/external/local_config_cc",
+			execOS: OSWindows,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if got := parseSymlinks(tc.out, tc.dir, tc.execOS); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("parseSymlinks(%q, %q, %q)=%q, want %q", tc.out, tc.dir, tc.execOS, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWindowsDockerRunner(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake docker client is a shell script")
+	}
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "docker.log")
+	dockerPath := filepath.Join(dir, "docker")
+	// The fake docker client records its arguments, finds cl.exe in a Visual Studio installation
+	// & reports the MSVC environment of the image config.
+	script := fmt.Sprintf(`#!/bin/sh
+printf '%%s\n' "$*" >> %q
+case "$*" in
+*"where cl.exe"*) printf 'C:\\BuildTools\\VC\\Tools\\MSVC\\14.29\\bin\\Hostx64\\x64\\cl.exe\r\nC:\\Other\\cl.exe\r\n' ;;
+inspect*) printf 'INCLUDE=C:\\BuildTools\\include\nLIB=C:\\BuildTools\\lib\n' ;;
+esac
+`, logPath)
+	if err := ioutil.WriteFile(dockerPath, []byte(script), 0755); err != nil {
+		t.Fatalf("Unable to write fake docker client: %v", err)
+	}
+	d := &dockerRunner{
+		execOS:        OSWindows,
+		dockerPath:    dockerPath,
+		containerID:   "cid123",
+		resolvedImage: "gcr.io/test/toolchain@sha256:" + strings.Repeat("a", 64),
+		ctx:           context.Background(),
+	}
+	if err := d.mkdir("C:/rbe_configs_gen/cpp_configs_project"); err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+	if err := d.touch("WORKSPACE", "BUILD.bazel"); err != nil {
+		t.Fatalf("touch failed: %v", err)
+	}
+	if !d.pathExists("C:/rbe_configs_gen/bazelisk.exe") {
+		t.Errorf("pathExists returned false for a path the fake docker client reported as existing")
+	}
+	if err := d.hardenSymlink("C:/out/external/local_config_cc/it's_a_link"); err != nil {
+		t.Fatalf("hardenSymlink failed: %v", err)
+	}
+	env, err := appendMSVCEnv(d, []string{"LIB=C:\\custom\\lib"})
+	if err != nil {
+		t.Fatalf("appendMSVCEnv failed: %v", err)
+	}
+	// LIB was already set & isn't overridden with the value of the image config.
+	wantEnv := []string{"LIB=C:\\custom\\lib", "BAZEL_VC=C:\\BuildTools\\VC", "INCLUDE=C:\\BuildTools\\include"}
+	if !reflect.DeepEqual(env, wantEnv) {
+		t.Errorf("appendMSVCEnv returned the environment %q, want %q", env, wantEnv)
+	}
+
+	blob, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("Unable to read the fake docker client log: %v", err)
+	}
+	log := string(blob)
+	for _, want := range []string{
+		"exec cid123 cmd /c mkdir C:\\rbe_configs_gen\\cpp_configs_project",
+		"exec cid123 cmd /c type nul > WORKSPACE && type nul > BUILD.bazel",
+		`exec cid123 cmd /c if not exist "C:\rbe_configs_gen\bazelisk.exe" exit 1`,
+		`exec cid123 powershell -NoProfile -NonInteractive -Command $ErrorActionPreference = 'Stop'; $l = Get-Item -LiteralPath 'C:\out\external\local_config_cc\it''s_a_link';`,
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("Runner didn't run %q, docker was invoked with:\n%s", want, log)
+		}
+	}
+	// Windows containers don't have the Linux utilities.
+	for _, cmd := range []string{"readlink", "ln -f", "tar"} {
+		if strings.Contains(log, "cid123 "+cmd) {
+			t.Errorf("Runner ran %q in the Windows container, docker was invoked with:\n%s", cmd, log)
+		}
+	}
+	if got, want := keepAliveCmd(OSWindows), []string{"cmd", "/c", "ping", "-t", "localhost"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keepAliveCmd(%q)=%q, want %q", OSWindows, got, want)
+	}
+}
+
+func TestImageDigestOrID(t *testing.T) {
+	digest := strings.Repeat("a", 64)
+	tests := []struct {
+		name       string
+		image      string
+		wantDigest string
+		wantID     string
+		wantErr    bool
+	}{
+		{
+			name:       "Registry digest",
+			image:      "gcr.io/foo/bar@sha256:" + digest,
+			wantDigest: digest,
+		},
+		{
+			name:       "Apptainer image digest",
+			image:      "/images/toolchain.sif@sha256:" + digest,
+			wantDigest: digest,
+		},
+		{
+			name:   "Image ID",
+			image:  "sha256:" + digest,
+			wantID: digest,
+		},
+		{
+			name:    "Tag",
+			image:   "gcr.io/foo/bar:latest",
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			gotDigest, gotID, err := imageDigestOrID(tc.image)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("imageDigestOrID(%q) returned error %v, want error: %v", tc.image, err, tc.wantErr)
+			}
+			if gotDigest != tc.wantDigest || gotID != tc.wantID {
+				t.Errorf("imageDigestOrID(%q) = (%q, %q), want (%q, %q)", tc.image, gotDigest, gotID, tc.wantDigest, tc.wantID)
+			}
+		})
+	}
+}
+
+func TestNewDockerfileRunner(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake docker client is a shell script")
+	}
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "docker.log")
+	dockerPath := filepath.Join(dir, "docker")
+	id := strings.Repeat("b", 64)
+	// The fake docker client records its arguments & reports the ID of the built image which has
+	// no registry digest.
+	script := fmt.Sprintf(`#!/bin/sh
+echo "$@" >> %q
+case "$1" in
+inspect) echo "sha256:%s" ;;
+esac
+`, logPath, id)
+	if err := ioutil.WriteFile(dockerPath, []byte(script), 0755); err != nil {
+		t.Fatalf("Unable to write fake docker client: %v", err)
+	}
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(filepath.ListSeparator)+oldPath)
+	defer os.Setenv("PATH", oldPath)
+
+	d, err := newDockerfileRunner(context.Background(), nil, "/src/toolchain/Dockerfile", "/src", "linux/arm64", OSLinux, true)
+	if err != nil {
+		t.Fatalf("newDockerfileRunner failed: %v", err)
+	}
+	tag := d.builtImage
+	if !strings.HasPrefix(tag, BuildImageRepository+":") || d.containerImage != tag || d.resolvedImage != "sha256:"+id {
+		t.Errorf("newDockerfileRunner returned runner with (builtImage, containerImage, resolvedImage) = (%q, %q, %q), want a unique tag in %q & the image ID %q", tag, d.containerImage, d.resolvedImage, BuildImageRepository, "sha256:"+id)
+	}
+	if digest, gotID, err := imageDigestOrID(d.resolvedImage); err != nil || digest != "" || gotID != id {
+		t.Errorf("imageDigestOrID(%q) = (%q, %q, %v), want the image ID %q recorded in the manifest instead of a digest", d.resolvedImage, digest, gotID, err, id)
+	}
+	other, err := newDockerfileRunner(context.Background(), nil, "/src/toolchain/Dockerfile", "/src", "linux/arm64", OSLinux, true)
+	if err != nil {
+		t.Fatalf("newDockerfileRunner failed: %v", err)
+	}
+	if other.builtImage == tag {
+		t.Errorf("newDockerfileRunner tagged the images of two runs with the same tag %q", tag)
+	}
+	d.cleanup()
+
+	blob, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("Unable to read the fake docker client log: %v", err)
+	}
+	want := "build -f /src/toolchain/Dockerfile -t " + tag + " --platform linux/arm64 /src\n"
+	if log := string(blob); !strings.HasPrefix(log, want) {
+		t.Errorf("newDockerfileRunner didn't build the image first, docker was invoked with:\n%s\nwant it to start with:\n%s", log, want)
+	}
+	if want := "rmi " + tag + "\n"; !strings.HasSuffix(string(blob), want) {
+		t.Errorf("cleanup didn't remove the built image last, docker was invoked with:\n%s\nwant it to end with:\n%s", blob, want)
+	}
+}
+
+func TestStartContainerScratch(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake docker client is a shell script")
+	}
+	cid := strings.Repeat("c", 64)
+	tests := []struct {
+		name         string
+		tmpfsSize    string
+		scratchMount string
+		runFlags     []string
+		// wantCreate is the expected docker create command without the container name.
+		wantCreate string
+	}{
+		{
+			name:       "Default",
+			wantCreate: "sha256:imageid sleep infinity",
+		},
+		{
+			name:       "Tmpfs",
+			tmpfsSize:  "2g",
+			wantCreate: "--tmpfs /tmp:rw,exec,size=2g sha256:imageid sleep infinity",
+		},
+		{
+			name:         "Scratch mount",
+			scratchMount: "/mnt/scratch",
+			wantCreate:   "-v /mnt/scratch:/tmp sha256:imageid sleep infinity",
+		},
+		{
+			name:         "Run flags after the flags of the tool",
+			scratchMount: "/mnt/scratch",
+			runFlags:     []string{"--network=host", "--cap-add=SYS_PTRACE"},
+			wantCreate:   "-v /mnt/scratch:/tmp --network=host --cap-add=SYS_PTRACE sha256:imageid sleep infinity",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			dir := t.TempDir()
+			logPath := filepath.Join(dir, "docker.log")
+			dockerPath := filepath.Join(dir, "docker")
+			// The fake docker client records its arguments & reports the ID of the created container.
+			script := fmt.Sprintf(`#!/bin/sh
+echo "$@" >> %q
+case "$1" in
+create) echo %q ;;
+esac
+`, logPath, cid)
+			if err := ioutil.WriteFile(dockerPath, []byte(script), 0755); err != nil {
+				t.Fatalf("Unable to write fake docker client: %v", err)
+			}
+			d := &dockerRunner{
+				dockerPath:    dockerPath,
+				resolvedImage: "sha256:imageid",
+				execOS:        OSLinux,
+				tmpfsSize:     tc.tmpfsSize,
+				scratchMount:  tc.scratchMount,
+				runFlags:      tc.runFlags,
+				ctx:           context.Background(),
+			}
+			if err := d.startContainer(); err != nil {
+				t.Fatalf("startContainer failed: %v", err)
+			}
+			blob, err := ioutil.ReadFile(logPath)
+			if err != nil {
+				t.Fatalf("Unable to read the fake docker client log: %v", err)
+			}
+			want := fmt.Sprintf("create --rm --name %s %s\n", d.containerName, tc.wantCreate)
+			if log := string(blob); !strings.HasPrefix(log, want) {
+				t.Errorf("startContainer didn't create the container with the expected arguments, docker was invoked with:\n%s\nwant it to start with:\n%s", log, want)
+			}
+		})
+	}
+}
+
+func TestRedactContainerRunFlag(t *testing.T) {
+	tests := []struct {
+		flag string
+		want string
+	}{
+		{flag: "--network=host", want: "--network=host"},
+		{flag: "--privileged", want: "--privileged"},
+		{flag: "--env=NPM_TOKEN=abc", want: "--env=NPM_TOKEN=REDACTED"},
+		{flag: "-e=HOME=/root", want: "-e=HOME=REDACTED"},
+		{flag: "-eNPM_TOKEN=abc", want: "-eNPM_TOKEN=REDACTED"},
+		{flag: "-e NPM_TOKEN=abc", want: "-e NPM_TOKEN=REDACTED"},
+		{flag: "--env NPM_TOKEN=abc", want: "--env NPM_TOKEN=REDACTED"},
+		{flag: "-eHTTP_PROXY", want: "-eHTTP_PROXY"},
+		{flag: "--env-file=/tmp/env.list", want: "--env-file=/tmp/env.list"},
+		{flag: "--env=HTTP_PROXY", want: "--env=HTTP_PROXY"},
+		{flag: "--label=registry_password=hunter2", want: "--label=REDACTED"},
+		{flag: "--label registry_password=hunter2", want: "--label REDACTED"},
+		{flag: "--security-opt=seccomp=unconfined", want: "--security-opt=seccomp=unconfined"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.flag, func(t *testing.T) {
+			t.Parallel()
+			if got := RedactContainerRunFlag(tc.flag); got != tc.want {
+				t.Errorf("RedactContainerRunFlag(%q) = %q, want %q", tc.flag, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRedactContainerRunFlags(t *testing.T) {
+	flags := []string{"-e", "NPM_TOKEN=abc", "--env", "HTTP_PROXY", "--env", "FOO=bar", "--network=host"}
+	want := []string{"-e", "NPM_TOKEN=REDACTED", "--env", "HTTP_PROXY", "--env", "FOO=REDACTED", "--network=host"}
+	if got := redactContainerRunFlags(flags); !reflect.DeepEqual(got, want) {
+		t.Errorf("redactContainerRunFlags(%q) = %q, want %q", flags, got, want)
+	}
+}
+
+func TestValidateContainerRunFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		flags   []string
+		wantErr string
+	}{
+		{
+			name:  "Long flags with values",
+			flags: []string{"--network=host", "--env=FOO=bar", "--privileged=true"},
+		},
+		{
+			name:    "Short env flag",
+			flags:   []string{"-eFOO=bar"},
+			wantErr: `invalid ContainerRunFlags "-eFOO=REDACTED"`,
+		},
+		{
+			name:    "Short env flag with separate value",
+			flags:   []string{"-e FOO=bar"},
+			wantErr: `invalid ContainerRunFlags "-e FOO=REDACTED"`,
+		},
+		{
+			name:    "Flag without value",
+			flags:   []string{"--privileged"},
+			wantErr: "want a long flag with its value after =",
+		},
+		{
+			name:    "Not a flag",
+			flags:   []string{"host"},
+			wantErr: "want a long flag with its value after =",
+		},
+		{
+			name:    "Reserved flag",
+			flags:   []string{"--entrypoint=/bin/sh"},
+			wantErr: "set by this tool",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			err := validateContainerRunFlags(tc.flags)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateContainerRunFlags(%q) failed: %v", tc.flags, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("validateContainerRunFlags(%q) = %v, want error containing %q", tc.flags, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunDetectionSteps(t *testing.T) {
+	tests := []struct {
+		name    string
+		errs    []error
+		wantErr []string
+	}{
+		{
+			name: "all steps succeed",
+			errs: []error{nil, nil},
+		},
+		{
+			name:    "one step fails",
+			errs:    []error{nil, fmt.Errorf("boom")},
+			wantErr: []string{"step1: boom"},
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			var steps []detectionStep
+			ran := make([]bool, len(tc.errs))
+			for i, err := range tc.errs {
+				i, err := i, err
+				steps = append(steps, detectionStep{
+					name: fmt.Sprintf("step%d", i),
+					run: func(d *dockerRunner) error {
+						ran[i] = true
+						return err
+					},
+				})
+			}
+			d := &dockerRunner{ctx: context.Background()}
+			err := runDetectionSteps(d.ctx, d, steps...)
+			for i, r := range ran {
+				if !r {
+					t.Errorf("runDetectionSteps did not run step%d", i)
+				}
+			}
+			if len(tc.wantErr) == 0 {
+				if err != nil {
+					t.Fatalf("runDetectionSteps failed: %v, wanted no error", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("runDetectionSteps succeeded, wanted error containing %v", tc.wantErr)
+			}
+			for _, w := range tc.wantErr {
+				if !strings.Contains(err.Error(), w) {
+					t.Errorf("runDetectionSteps returned error %q, wanted it to contain %q", err, w)
+				}
+			}
+		})
+	}
+}
+
+func TestJavaMajorVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    int
+	}{
+		{version: "1.8.0_292", want: 8},
+		{version: "11.0.2", want: 11},
+		{version: "17", want: 17},
+		{version: "21-ea", want: 21},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.version, func(t *testing.T) {
+			t.Parallel()
+			got, err := javaMajorVersion(tc.version)
+			if err != nil {
+				t.Fatalf("javaMajorVersion(%q) failed: %v", tc.version, err)
+			}
+			if got != tc.want {
+				t.Errorf("javaMajorVersion(%q) = %d, want %d", tc.version, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseOSRelease(t *testing.T) {
+	tests := []struct {
+		name          string
+		contents      string
+		wantID        string
+		wantVersionID string
+	}{
+		{
+			name:          "Ubuntu",
+			contents:      "NAME=\"Ubuntu\"\nVERSION=\"20.04.6 LTS (Focal Fossa)\"\nID=ubuntu\nID_LIKE=debian\nVERSION_ID=\"20.04\"\n",
+			wantID:        "ubuntu",
+			wantVersionID: "20.04",
+		}, {
+			name:          "Alpine",
+			contents:      "NAME=\"Alpine Linux\"\nID=alpine\nVERSION_ID=3.19.1\n",
+			wantID:        "alpine",
+			wantVersionID: "3.19.1",
+		}, {
+			name:          "Debian sid without VERSION_ID",
+			contents:      "PRETTY_NAME=\"Debian GNU/Linux trixie/sid\"\nID=debian\n",
+			wantID:        "debian",
+			wantVersionID: "unknown",
+		}, {
+			name:          "Empty",
+			wantID:        "unknown",
+			wantVersionID: "unknown",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			id, versionID := parseOSRelease(tc.contents)
+			if id != tc.wantID || versionID != tc.wantVersionID {
+				t.Errorf("parseOSRelease() = (%q, %q), want (%q, %q)", id, versionID, tc.wantID, tc.wantVersionID)
+			}
+		})
+	}
+}
+
+func TestParseLibcVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want string
+	}{
+		{
+			name: "glibc",
+			out:  "glibc 2.31",
+			want: "glibc_2.31",
+		}, {
+			name: "Unrecognized",
+			out:  "musl libc (x86_64)",
+		}, {
+			name: "Empty",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if got := parseLibcVersion(tc.out); got != tc.want {
+				t.Errorf("parseLibcVersion(%q) = %q, want %q", tc.out, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestVerifyJavaVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		opt     *Options
+		version string
+		wantErr bool
+	}{
+		{
+			name:    "Legacy rules accept JDK 8",
+			opt:     &Options{BazelVersion: "4.2.1"},
+			version: "1.8.0_292",
+		}, {
+			name:    "local_java_runtime warns about JDK 8",
+			opt:     &Options{BazelVersion: "5.0.0"},
+			version: "1.8.0_292",
+		}, {
+			name:    "local_java_runtime rejects JDK 8 strictly",
+			opt:     &Options{BazelVersion: "5.0.0", StrictJavaVersion: true},
+			version: "1.8.0_292",
+			wantErr: true,
+		}, {
+			name:    "local_java_runtime accepts JDK 11",
+			opt:     &Options{BazelVersion: "6.4.0"},
+			version: "11.0.2",
+		}, {
+			name:    "Bazel 7 rejects JDK 11 strictly",
+			opt:     &Options{BazelVersion: "7.0.0", StrictJavaVersion: true},
+			version: "11.0.2",
+			wantErr: true,
+		}, {
+			name:    "Bazel 7 accepts JDK 17 strictly",
+			opt:     &Options{BazelVersion: "7.0.0", StrictJavaVersion: true},
+			version: "17.0.2",
+		}, {
+			name:    "Bazel 7 warns about JDK 11",
+			opt:     &Options{BazelVersion: "7.0.0"},
+			version: "11.0.2",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			err := verifyJavaVersion(tc.opt, &detectionFacts{JavaVersion: tc.version})
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("verifyJavaVersion() returned error %v, want error: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunIsolatedDetectionSteps(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake docker client is a shell script")
+	}
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "docker.log")
+	countPath := filepath.Join(dir, "count")
+	dockerPath := filepath.Join(dir, "docker")
+	// The fake docker client records its arguments & creates containers with IDs numbering them.
+	script := fmt.Sprintf(`#!/bin/sh
+echo "$@" >> %q
+if [ "$1" = create ]; then
+  echo x >> %q
+  printf '%%064d\n' "$(wc -l < %q)"
+fi
+`, logPath, countPath, countPath)
+	if err := ioutil.WriteFile(dockerPath, []byte(script), 0755); err != nil {
+		t.Fatalf("Unable to write fake docker client: %v", err)
+	}
+	d := &dockerRunner{
+		dockerPath:    dockerPath,
+		resolvedImage: "gcr.io/foo/bar@sha256:aaaa",
+		stopContainer: true,
+		execOS:        OSLinux,
+		ctx:           context.Background(),
+	}
+	o := &Options{ExecOS: OSLinux, BazelPath: "/usr/bin/bazel", Timings: &StageTimings{}}
+	var containers []string
+	record := func(d *dockerRunner) error {
+		containers = append(containers, d.containerID)
+		return nil
+	}
+	var bazelPath string
+	if err := runIsolatedDetectionSteps(d, o, &bazelPath,
+		detectionStep{name: "first", needsBazel: true, run: record},
+		detectionStep{name: "second", run: record},
+	); err != nil {
+		t.Fatalf("runIsolatedDetectionSteps() failed: %v", err)
+	}
+	if len(containers) != 2 || containers[0] == containers[1] {
+		t.Errorf("runIsolatedDetectionSteps() ran the steps in containers %q, want 2 different containers", containers)
+	}
+	if bazelPath != o.BazelPath {
+		t.Errorf("runIsolatedDetectionSteps() set the Bazel path to %q, want %q", bazelPath, o.BazelPath)
+	}
+	blob, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("Unable to read the fake docker client log: %v", err)
+	}
+	for _, c := range containers {
+		if !strings.Contains(string(blob), "rm -f "+c) {
+			t.Errorf("Container %s wasn't removed, docker was run with:\n%s", c, blob)
+		}
+	}
+	var starts int
+	for _, st := range o.Timings.Stages() {
+		if st.Stage == StageStart {
+			starts++
+		}
+	}
+	if starts != 2 {
+		t.Errorf("runIsolatedDetectionSteps() recorded %d %s stages, want 2", starts, StageStart)
+	}
+}
+
+func TestJavaHomeInContainer(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake docker client is a shell script")
+	}
+	dockerPath := filepath.Join(t.TempDir(), "docker")
+	// The fake docker client only has bin/java in /opt/jdk.
+	script := "#!/bin/sh\nif [ \"$5\" = /opt/jdk/bin/java ]; then exit 0; fi\nexit 1\n"
+	if err := ioutil.WriteFile(dockerPath, []byte(script), 0755); err != nil {
+		t.Fatalf("Unable to write fake docker client: %v", err)
+	}
+	d := &dockerRunner{dockerPath: dockerPath, containerID: "container", execOS: OSLinux, ctx: context.Background()}
+	got, err := javaHomeInContainer(d, &Options{JavaHome: "/opt/jdk"})
+	if err != nil {
+		t.Fatalf("javaHomeInContainer() failed: %v", err)
+	}
+	if got != "/opt/jdk" {
+		t.Errorf("javaHomeInContainer()=%q, want %q", got, "/opt/jdk")
+	}
+	if _, err := javaHomeInContainer(d, &Options{JavaHome: "/opt/jre"}); err == nil {
+		t.Errorf("javaHomeInContainer() succeeded for a Java home without bin/java, want error")
+	}
+}
+
+func TestBazeliskDownloadInfoForPlatform(t *testing.T) {
+	tests := []struct {
+		os          string
+		arch        string
+		version     string
+		wantURL     string
+		wantFile    string
+		wantVersion string
+	}{
+		{os: "linux", arch: "amd64", wantURL: "https://github.com/bazelbuild/bazelisk/releases/download/v1.19.0/bazelisk-linux-amd64", wantFile: "bazelisk", wantVersion: "v1.19.0"},
+		{os: "linux", arch: "arm64", wantURL: "https://github.com/bazelbuild/bazelisk/releases/download/v1.19.0/bazelisk-linux-arm64", wantFile: "bazelisk", wantVersion: "v1.19.0"},
+		{os: "darwin", arch: "amd64", wantURL: "https://github.com/bazelbuild/bazelisk/releases/download/v1.19.0/bazelisk-darwin-amd64", wantFile: "bazelisk", wantVersion: "v1.19.0"},
+		{os: "darwin", arch: "arm64", wantURL: "https://github.com/bazelbuild/bazelisk/releases/download/v1.19.0/bazelisk-darwin-arm64", wantFile: "bazelisk", wantVersion: "v1.19.0"},
+		{os: "windows", arch: "amd64", wantURL: "https://github.com/bazelbuild/bazelisk/releases/download/v1.19.0/bazelisk-windows-amd64.exe", wantFile: "bazelisk.exe", wantVersion: "v1.19.0"},
+		{os: "windows", arch: "arm64", wantURL: "https://github.com/bazelbuild/bazelisk/releases/download/v1.19.0/bazelisk-windows-arm64.exe", wantFile: "bazelisk.exe", wantVersion: "v1.19.0"},
+		{os: "linux", arch: "amd64", version: "v1.17.0", wantURL: "https://github.com/bazelbuild/bazelisk/releases/download/v1.17.0/bazelisk-linux-amd64", wantFile: "bazelisk", wantVersion: "v1.17.0"},
+		{os: "linux", arch: "amd64", version: "1.17.0", wantURL: "https://github.com/bazelbuild/bazelisk/releases/download/v1.17.0/bazelisk-linux-amd64", wantFile: "bazelisk", wantVersion: "v1.17.0"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.os+"/"+tc.arch+"@"+tc.version, func(t *testing.T) {
+			t.Parallel()
+			gotURL, gotFile, gotVersion, err := BazeliskDownloadInfoForPlatform(tc.os, tc.arch, tc.version)
+			if err != nil {
+				t.Fatalf("BazeliskDownloadInfoForPlatform(%q, %q, %q) failed: %v", tc.os, tc.arch, tc.version, err)
+			}
+			if gotURL != tc.wantURL || gotFile != tc.wantFile || gotVersion != tc.wantVersion {
+				t.Errorf("BazeliskDownloadInfoForPlatform(%q, %q, %q) = (%q, %q, %q), want (%q, %q, %q)", tc.os, tc.arch, tc.version, gotURL, gotFile, gotVersion, tc.wantURL, tc.wantFile, tc.wantVersion)
+			}
+		})
+	}
+	for _, p := range [][]string{{"linux", "386", ""}, {"freebsd", "amd64", ""}, {"linux", "amd64", "latest"}} {
+		if _, _, _, err := BazeliskDownloadInfoForPlatform(p[0], p[1], p[2]); err == nil {
+			t.Errorf("BazeliskDownloadInfoForPlatform(%q, %q, %q) succeeded, want error", p[0], p[1], p[2])
+		}
+	}
+}
+
+func TestDownloadBazelisk(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bazelisk" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("bazelisk"))
+	}))
+	defer s.Close()
+	sum := sha256.Sum256([]byte("bazelisk"))
+	digest := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr string
+	}{
+		{name: "Matching digest", path: "/bazelisk", want: digest},
+		{name: "Missing digest", path: "/bazelisk", wantErr: "sha256 digest isn't known"},
+		{name: "Mismatched digest", path: "/bazelisk", want: strings.Repeat("0", 64), wantErr: "has sha256 digest " + digest},
+		{name: "Not found", path: "/missing", want: digest, wantErr: "got HTTP status"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			localPath := filepath.Join(t.TempDir(), "bazelisk")
+			err := downloadBazelisk(s.Client(), s.URL+tc.path, localPath, tc.want)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("downloadBazelisk() failed: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("downloadBazelisk() = %v, want error containing %q", err, tc.wantErr)
+			}
+			if _, err := os.Stat(localPath); !os.IsNotExist(err) {
+				t.Errorf("downloadBazelisk() left the rejected executable at %q: %v", localPath, err)
+			}
+		})
+	}
+}
+
+func TestDownloadBazeliskRelease(t *testing.T) {
+	var requests int
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("bazelisk"))
+	}))
+	defer s.Close()
+	oldURL := bazeliskReleasesURL
+	bazeliskReleasesURL = s.URL
+	defer func() { bazeliskReleasesURL = oldURL }()
+	c := s.Client()
+	sum := sha256.Sum256([]byte("bazelisk"))
+	digest := hex.EncodeToString(sum[:])
+	old := bazeliskSHA256s
+	bazeliskSHA256s = map[string]map[string]string{bazeliskVersion: {"linux/amd64": digest, "linux/arm64": strings.Repeat("0", 64)}}
+	defer func() { bazeliskSHA256s = old }()
+
+	tests := []struct {
+		name    string
+		arch    string
+		want    string
+		wantErr string
+	}{
+		{name: "Known digest", arch: "amd64"},
+		{name: "Mismatched known digest", arch: "arm64", wantErr: "has sha256 digest " + digest},
+		{name: "Explicit digest", arch: "arm64", want: digest},
+		{name: "Mismatched explicit digest", arch: "amd64", want: strings.Repeat("0", 64), wantErr: "has sha256 digest " + digest},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			got, err := DownloadBazelisk(c, "linux", tc.arch, "", dir, tc.want)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("DownloadBazelisk(%q) = (%q, %v), want error containing %q", tc.arch, got, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DownloadBazelisk(%q) failed: %v", tc.arch, err)
+			}
+			if want := filepath.Join(dir, "bazelisk"); got != want {
+				t.Errorf("DownloadBazelisk(%q) downloaded to %q, want %q", tc.arch, got, want)
+			}
+			if err := VerifyBazelisk(got, digest); err != nil {
+				t.Errorf("VerifyBazelisk() of the downloaded executable failed: %v", err)
+			}
+			if err := VerifyBazelisk(got, strings.Repeat("0", 64)); err == nil {
+				t.Errorf("VerifyBazelisk() with a mismatched digest succeeded, want error")
+			}
+		})
+	}
+
+	// Releases without a known digest aren't downloaded at all.
+	before := requests
+	if _, err := DownloadBazelisk(c, "darwin", "amd64", "", t.TempDir(), ""); err == nil || !strings.Contains(err.Error(), "sha256 digest isn't known") {
+		t.Errorf("DownloadBazelisk() without a known digest = %v, want error", err)
+	}
+	if requests != before {
+		t.Errorf("DownloadBazelisk() without a known digest sent %d requests, want none", requests-before)
+	}
+}
+
+func TestBazeliskSHA256(t *testing.T) {
+	old := bazeliskSHA256s
+	bazeliskSHA256s = map[string]map[string]string{bazeliskVersion: {"linux/amd64": "abc"}}
+	defer func() { bazeliskSHA256s = old }()
+	for _, version := range []string{"", bazeliskVersion, strings.TrimPrefix(bazeliskVersion, "v")} {
+		if got := BazeliskSHA256("linux", "amd64", version); got != "abc" {
+			t.Errorf("BazeliskSHA256(%q, %q, %q)=%q, want %q", "linux", "amd64", version, got, "abc")
+		}
+	}
+	if got := BazeliskSHA256("linux", "arm64", ""); got != "" {
+		t.Errorf("BazeliskSHA256() for a platform without a known digest=%q, want blank", got)
+	}
+}
+
+func TestValidateBazelVersion(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/tag/6.4.0", "/tag/7.0.0rc2":
+			w.WriteHeader(http.StatusOK)
+		case "/tag/5.0.0":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+	oldURL := bazelReleasesURL
+	bazelReleasesURL = s.URL
+	defer func() { bazelReleasesURL = oldURL }()
+
+	tests := []struct {
+		version string
+		wantErr string
+	}{
+		{version: "6.4.0"},
+		{version: "7.0.0rc2"},
+		{version: "6.4.1", wantErr: "doesn't exist"},
+		{version: "6.40", wantErr: "invalid Bazel version"},
+		{version: "5.0.0", wantErr: "500"},
+	}
+	for _, tc := range tests {
+		err := ValidateBazelVersion(s.Client(), tc.version)
+		if tc.wantErr == "" {
+			if err != nil {
+				t.Errorf("ValidateBazelVersion(%q) failed: %v", tc.version, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("ValidateBazelVersion(%q) returned error %v, want error containing %q", tc.version, err, tc.wantErr)
+		}
+	}
+}
+
+func TestLatestBazelVersion(t *testing.T) {
+	latest := "/tag/7.1.0"
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/latest":
+			http.Redirect(w, r, latest, http.StatusFound)
+		case strings.HasPrefix(r.URL.Path, "/tag/"):
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+	oldURL := bazelReleasesURL
+	bazelReleasesURL = s.URL
+	defer func() { bazelReleasesURL = oldURL }()
+
+	v, err := latestBazelVersion(s.Client())
+	if err != nil {
+		t.Fatalf("latestBazelVersion() failed: %v", err)
+	}
+	if v != "7.1.0" {
+		t.Errorf("latestBazelVersion()=%q, want %q", v, "7.1.0")
+	}
+	latest = "/missing"
+	if _, err := latestBazelVersion(s.Client()); !errors.Is(err, ErrNetwork) {
+		t.Errorf("latestBazelVersion() redirected to a missing page returned error %v, want an error matching ErrNetwork", err)
+	}
+	latest = "/tag/latest"
+	if _, err := latestBazelVersion(s.Client()); err == nil || errors.Is(err, ErrNetwork) {
+		t.Errorf("latestBazelVersion() redirected to an invalid version returned error %v, want a non-network error", err)
+	}
+}
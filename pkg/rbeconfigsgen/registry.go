@@ -0,0 +1,320 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"strings"
+
+	"github.com/bazelbuild/bazel-toolchains/pkg/logging"
+)
+
+// dockerCertsDir is the directory the docker daemon reads additional per registry CA certificates
+// from when pulling images. See https://docs.docker.com/engine/security/certificates/.
+var dockerCertsDir = "/etc/docker/certs.d"
+
+// dockerHubRegistry is the host serving the registry API of Docker Hub.
+const dockerHubRegistry = "registry-1.docker.io"
+
+var (
+	// registryManifestTypes are the media types of the manifest lists & image manifests accepted
+	// when resolving a tag in a registry. Manifest lists are preferred like docker does so the
+	// digest matches the one docker records when pulling the tag.
+	registryManifestTypes = []string{
+		"application/vnd.docker.distribution.manifest.list.v2+json",
+		"application/vnd.oci.image.index.v1+json",
+		"application/vnd.docker.distribution.manifest.v2+json",
+		"application/vnd.oci.image.manifest.v1+json",
+	}
+	// bearerParamRegexp matches a parameter of the Bearer challenge in the WWW-Authenticate header
+	// of a registry, e.g., realm="https://auth.docker.io/token".
+	bearerParamRegexp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+)
+
+// DefaultUserAgent returns the User-Agent of outbound HTTP requests unless overridden, i.e.,
+// "rbe_configs_gen/<version>" where the version is that of the module the binary was built from or
+// "devel" for builds from a source checkout.
+func DefaultUserAgent() string {
+	v := "devel"
+	if bi, ok := debug.ReadBuildInfo(); ok && len(bi.Main.Version) != 0 && bi.Main.Version != "(devel)" {
+		v = bi.Main.Version
+	}
+	return "rbe_configs_gen/" + v
+}
+
+// userAgentTransport sets the User-Agent of the requests it sends unless already set.
+type userAgentTransport struct {
+	userAgent string
+	base      http.RoundTripper
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(req.Header.Get("User-Agent")) != 0 {
+		return t.base.RoundTrip(req)
+	}
+	// RoundTrippers must not modify the given request.
+	r := req.Clone(req.Context())
+	r.Header.Set("User-Agent", t.userAgent)
+	return t.base.RoundTrip(r)
+}
+
+// withUserAgent returns a transport sending the requests of the given transport with the given
+// User-Agent or DefaultUserAgent if blank.
+func withUserAgent(base http.RoundTripper, userAgent string) http.RoundTripper {
+	if len(userAgent) == 0 {
+		userAgent = DefaultUserAgent()
+	}
+	return &userAgentTransport{userAgent: userAgent, base: base}
+}
+
+// NewHTTPClient returns a HTTP client for downloads that trusts the PEM encoded CA certificates in
+// the file at the given path in addition to the system trust store. If insecure is true, TLS
+// certificates aren't verified at all which should only be used with development servers. Requests
+// are sent with the given User-Agent or DefaultUserAgent if blank.
+func NewHTTPClient(caCertPath string, insecure bool, userAgent string) (*http.Client, error) {
+	return newHTTPClient(nil, caCertPath, insecure, userAgent)
+}
+
+// newHTTPClient is like NewHTTPClient but logs warnings with the given logger.
+func newHTTPClient(log *logging.Logger, caCertPath string, insecure bool, userAgent string) (*http.Client, error) {
+	if len(caCertPath) == 0 && !insecure {
+		return &http.Client{Transport: withUserAgent(http.DefaultTransport, userAgent)}, nil
+	}
+	c := &tls.Config{}
+	if len(caCertPath) != 0 {
+		pem, err := ioutil.ReadFile(caCertPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA certificate file %q: %w", caCertPath, err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			log.Warningf("Unable to load the system trust store, only trusting the CA certificates in %q: %v", caCertPath, err)
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM encoded certificates found in CA certificate file %q", caCertPath)
+		}
+		c.RootCAs = pool
+	}
+	if insecure {
+		log.Warningf("TLS CERTIFICATE VERIFICATION IS DISABLED FOR DOWNLOADS. THIS IS INSECURE & SHOULD ONLY BE USED WITH DEVELOPMENT REGISTRIES.")
+		c.InsecureSkipVerify = true
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = c
+	return &http.Client{Transport: withUserAgent(t, userAgent)}, nil
+}
+
+// registryHost returns the host of the registry the given docker image reference points to or
+// blank if it refers to Docker Hub.
+func registryHost(image string) string {
+	i := strings.Index(image, "/")
+	if i < 0 {
+		return ""
+	}
+	h := image[:i]
+	if h != "localhost" && !strings.ContainsAny(h, ".:") {
+		return ""
+	}
+	return h
+}
+
+// installRegistryCACert makes the docker daemon trust the CA certificate in the file at the given
+// path when pulling the given image by copying it to the daemon's certificate directory for the
+// image's registry. Docker reads this directory on every pull so the daemon doesn't need to be
+// restarted. This only works if the docker daemon runs on this machine. Returns a function that
+// restores the certificate previously installed for the registry, or removes the installed
+// certificate if there was none, which must be called once the image was pulled so the daemon
+// doesn't trust the CA certificate permanently. Messages are logged with the given logger.
+func installRegistryCACert(log *logging.Logger, image, caCertPath string) (func(), error) {
+	h := registryHost(image)
+	if len(h) == 0 {
+		return nil, fmt.Errorf("image %q doesn't specify a registry host to trust the CA certificate for", image)
+	}
+	pem, err := ioutil.ReadFile(caCertPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read CA certificate file %q: %w", caCertPath, err)
+	}
+	dir := filepath.Join(dockerCertsDir, h)
+	dst := filepath.Join(dir, "ca.crt")
+	existing, err := ioutil.ReadFile(dst)
+	if err == nil && bytes.Equal(existing, pem) {
+		log.Debugf("The docker daemon already trusts %q for registry %q.", caCertPath, h)
+		return func() {}, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("unable to back up the CA certificate %q the docker daemon trusts for registry %q: %w", dst, h, err)
+	}
+	hadCert := err == nil
+	_, err = os.Stat(dir)
+	hadDir := err == nil
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create docker certificate directory %q, install %q as %q manually or run with permissions to write to it: %w", dir, caCertPath, dst, err)
+	}
+	if err := ioutil.WriteFile(dst, pem, 0644); err != nil {
+		return nil, fmt.Errorf("unable to install CA certificate %q as %q, install it manually or run with permissions to write to it: %w", caCertPath, dst, err)
+	}
+	log.Infof("Installed CA certificate %q as %q so the docker daemon trusts registry %q.", caCertPath, dst, h)
+	return func() {
+		if hadCert {
+			if err := ioutil.WriteFile(dst, existing, 0644); err != nil {
+				log.Warningf("Failed to restore the CA certificate %q the docker daemon trusted for registry %q before, restore it manually: %v", dst, h, err)
+				return
+			}
+			log.Infof("Restored the CA certificate %q the docker daemon trusted for registry %q before.", dst, h)
+			return
+		}
+		if err := os.Remove(dst); err != nil {
+			log.Warningf("Failed to remove CA certificate %q, remove it manually so the docker daemon stops trusting it for registry %q: %v", dst, h, err)
+			return
+		}
+		if !hadDir {
+			os.Remove(dir)
+		}
+		log.Infof("Removed CA certificate %q so the docker daemon no longer trusts it for registry %q.", dst, h)
+	}, nil
+}
+
+// resolveRegistryDigest returns the digest of the manifest the given docker image reference points
+// to in its registry without pulling the image, i.e., the digest docker records in the repo digests
+// of the image when pulling it. Registries requiring a bearer token are sent an anonymous one so
+// images needing credentials can't be resolved this way & must be pulled instead.
+func resolveRegistryDigest(ctx context.Context, c *http.Client, image string) (string, error) {
+	r := parseImageRef(image)
+	if err := r.validate(); err != nil {
+		return "", fmt.Errorf("invalid image reference %q: %w", image, err)
+	}
+	if len(r.digest) != 0 {
+		return r.digest, nil
+	}
+	host := registryHost(r.repo)
+	repo := strings.TrimPrefix(r.repo, host+"/")
+	if len(host) == 0 || host == "docker.io" || host == "index.docker.io" {
+		host = dockerHubRegistry
+		// Official images are in the library namespace of Docker Hub.
+		if !strings.Contains(repo, "/") {
+			repo = "library/" + repo
+		}
+	}
+	tag := r.tag
+	if len(tag) == 0 {
+		tag = "latest"
+	}
+	u := fmt.Sprintf("https://%s/v2/%s/manifests/%s", host, repo, tag)
+	resp, err := headManifest(ctx, c, u, "")
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		token, err := registryToken(ctx, c, resp.Header.Get("WWW-Authenticate"))
+		if err != nil {
+			return "", fmt.Errorf("unable to get an anonymous token to look up %s: %w", u, err)
+		}
+		if resp, err = headManifest(ctx, c, u, token); err != nil {
+			return "", err
+		}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("unable to look up %s: got HTTP status %q", u, resp.Status)
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if len(digest) == 0 || imageDigestRegexp.FindString(digest) != digest {
+		return "", fmt.Errorf("registry returned invalid digest %q for %s, want sha256:<64 lowercase hex characters>", digest, u)
+	}
+	return digest, nil
+}
+
+// headManifest sends a HEAD request for the manifest at the given URL with the given bearer token,
+// if any, using the given HTTP client. The body of the returned response is already closed.
+func headManifest(ctx context.Context, c *http.Client, u, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create the request to look up %s: %w", u, err)
+	}
+	req.Header.Set("Accept", strings.Join(registryManifestTypes, ", "))
+	if len(token) != 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to look up %s: %w", u, err)
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// registryToken requests an anonymous token from the token server in the given Bearer challenge of
+// the WWW-Authenticate header of a registry using the given HTTP client.
+func registryToken(ctx context.Context, c *http.Client, challenge string) (string, error) {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return "", fmt.Errorf("registry requires unsupported authentication %q", challenge)
+	}
+	params := make(map[string]string)
+	for _, m := range bearerParamRegexp.FindAllStringSubmatch(challenge, -1) {
+		params[m[1]] = m[2]
+	}
+	realm := params["realm"]
+	if len(realm) == 0 {
+		return "", fmt.Errorf("challenge %q doesn't specify the realm of the token server", challenge)
+	}
+	q := url.Values{}
+	for _, k := range []string{"service", "scope"} {
+		if v, ok := params[k]; ok {
+			q.Set(k, v)
+		}
+	}
+	u := realm
+	if len(q) != 0 {
+		u += "?" + q.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to create the token request %s: %w", u, err)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request %s failed: %w", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("token request %s failed: got HTTP status %q", u, resp.Status)
+	}
+	var t struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", fmt.Errorf("unable to parse the response to token request %s: %w", u, err)
+	}
+	if len(t.Token) != 0 {
+		return t.Token, nil
+	}
+	if len(t.AccessToken) != 0 {
+		return t.AccessToken, nil
+	}
+	return "", fmt.Errorf("response to token request %s has no token", u)
+}
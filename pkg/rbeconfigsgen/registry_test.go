@@ -0,0 +1,232 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewHTTPClient(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(srv.Close)
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	blob := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := ioutil.WriteFile(caPath, blob, 0644); err != nil {
+		t.Fatalf("Unable to write CA certificate: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		caPath   string
+		insecure bool
+		wantErr  bool
+	}{
+		{name: "Untrusted server", wantErr: true},
+		{name: "Custom CA", caPath: caPath},
+		{name: "Insecure", insecure: true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			c, err := NewHTTPClient(tc.caPath, tc.insecure, "")
+			if err != nil {
+				t.Fatalf("NewHTTPClient failed: %v", err)
+			}
+			resp, err := c.Get(srv.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err != nil) != tc.wantErr {
+				t.Errorf("GET %s returned error %v, want error: %v", srv.URL, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewHTTPClientUserAgent(t *testing.T) {
+	agents := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents <- r.UserAgent()
+	}))
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		name      string
+		userAgent string
+		insecure  bool
+		want      string
+	}{
+		{name: "Default", want: DefaultUserAgent()},
+		{name: "Override", userAgent: "mycorp-rbe/1.0", want: "mycorp-rbe/1.0"},
+		{name: "Override with custom TLS", userAgent: "mycorp-rbe/1.0", insecure: true, want: "mycorp-rbe/1.0"},
+	}
+	// The server records one User-Agent at a time so the cases don't run in parallel.
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := NewHTTPClient("", tc.insecure, tc.userAgent)
+			if err != nil {
+				t.Fatalf("NewHTTPClient failed: %v", err)
+			}
+			resp, err := c.Get(srv.URL)
+			if err != nil {
+				t.Fatalf("GET %s failed: %v", srv.URL, err)
+			}
+			resp.Body.Close()
+			if got := <-agents; got != tc.want {
+				t.Errorf("GET %s sent User-Agent %q, want %q", srv.URL, got, tc.want)
+			}
+		})
+	}
+	if got := DefaultUserAgent(); !strings.HasPrefix(got, "rbe_configs_gen/") {
+		t.Errorf("DefaultUserAgent()=%q, want prefix rbe_configs_gen/", got)
+	}
+}
+
+func TestRegistryHost(t *testing.T) {
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{image: "ubuntu:20.04", want: ""},
+		{image: "library/ubuntu", want: ""},
+		{image: "gcr.io/project/image:latest", want: "gcr.io"},
+		{image: "registry.corp:5000/image@sha256:abcd", want: "registry.corp:5000"},
+		{image: "localhost/image", want: "localhost"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.image, func(t *testing.T) {
+			t.Parallel()
+			if got := registryHost(tc.image); got != tc.want {
+				t.Errorf("registryHost(%q) = %q, want %q", tc.image, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestInstallRegistryCACert(t *testing.T) {
+	oldDir := dockerCertsDir
+	dockerCertsDir = t.TempDir()
+	defer func() { dockerCertsDir = oldDir }()
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(caPath, []byte("ca"), 0644); err != nil {
+		t.Fatalf("Unable to write CA certificate: %v", err)
+	}
+	installed := filepath.Join(dockerCertsDir, "registry.corp:5000", "ca.crt")
+	restore, err := installRegistryCACert(nil, "registry.corp:5000/image:latest", caPath)
+	if err != nil {
+		t.Fatalf("installRegistryCACert failed: %v", err)
+	}
+	got, err := ioutil.ReadFile(installed)
+	if err != nil {
+		t.Fatalf("CA certificate wasn't installed for the registry: %v", err)
+	}
+	if string(got) != "ca" {
+		t.Errorf("Installed CA certificate = %q, want %q", got, "ca")
+	}
+	restore()
+	if _, err := os.Stat(filepath.Dir(installed)); !os.IsNotExist(err) {
+		t.Errorf("Restoring didn't remove the certificate directory of the registry it created: %v", err)
+	}
+
+	// A certificate already installed for the registry is restored.
+	if err := os.MkdirAll(filepath.Dir(installed), 0755); err != nil {
+		t.Fatalf("Unable to create the certificate directory of the registry: %v", err)
+	}
+	if err := ioutil.WriteFile(installed, []byte("previous ca"), 0644); err != nil {
+		t.Fatalf("Unable to write the previously installed CA certificate: %v", err)
+	}
+	if restore, err = installRegistryCACert(nil, "registry.corp:5000/image:latest", caPath); err != nil {
+		t.Fatalf("installRegistryCACert failed: %v", err)
+	}
+	if got, err := ioutil.ReadFile(installed); err != nil || string(got) != "ca" {
+		t.Errorf("Installed CA certificate = %q, %v, want %q", got, err, "ca")
+	}
+	restore()
+	if got, err := ioutil.ReadFile(installed); err != nil || string(got) != "previous ca" {
+		t.Errorf("Restored CA certificate = %q, %v, want %q", got, err, "previous ca")
+	}
+
+	if _, err := installRegistryCACert(nil, "ubuntu:20.04", caPath); err == nil {
+		t.Errorf("installRegistryCACert succeeded for an image without a registry host, want error")
+	}
+}
+
+func TestResolveRegistryDigest(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	var srv *httptest.Server
+	// The fake registry requires an anonymous bearer token like Docker Hub & serves foo/bar:1.0.
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			if got, want := r.URL.Query().Get("scope"), "repository:foo/bar:pull"; got != want {
+				t.Errorf("Token request for scope %q, want %q", got, want)
+			}
+			fmt.Fprint(w, `{"token":"anonymous"}`)
+		case r.Header.Get("Authorization") != "Bearer anonymous":
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry",scope="repository:foo/bar:pull"`, srv.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.Method != http.MethodHead || !strings.Contains(r.Header.Get("Accept"), "manifest.list.v2+json"):
+			t.Errorf("Got %s request accepting %q, want a HEAD request accepting manifest lists", r.Method, r.Header.Get("Accept"))
+			w.WriteHeader(http.StatusBadRequest)
+		case r.URL.Path == "/v2/foo/bar/manifests/1.0":
+			w.Header().Set("Docker-Content-Digest", digest)
+		case r.URL.Path == "/v2/foo/bar/manifests/invalid":
+			w.Header().Set("Docker-Content-Digest", "sha256:1234")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	host := strings.TrimPrefix(srv.URL, "https://")
+
+	tests := []struct {
+		name    string
+		image   string
+		want    string
+		wantErr string
+	}{
+		{name: "Tag", image: host + "/foo/bar:1.0", want: digest},
+		{name: "Digest", image: host + "/foo/bar@sha256:" + strings.Repeat("b", 64), want: "sha256:" + strings.Repeat("b", 64)},
+		{name: "Missing tag", image: host + "/foo/bar:2.0", wantErr: "404"},
+		{name: "Latest", image: host + "/foo/bar", wantErr: "/v2/foo/bar/manifests/latest"},
+		{name: "Invalid digest", image: host + "/foo/bar:invalid", wantErr: "invalid digest"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := resolveRegistryDigest(context.Background(), srv.Client(), tc.image)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("resolveRegistryDigest(%q)=(%q, %v), want error containing %q", tc.image, got, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tc.want {
+				t.Errorf("resolveRegistryDigest(%q)=(%q, %v), want %q", tc.image, got, err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Files in Linux toolchain containers describing the resources available to the container.
+	// cgroup v2 exposes the limits of the container directly under /sys/fs/cgroup while cgroup v1
+	// has a directory per controller.
+	cpuInfoFile        = "/proc/cpuinfo"
+	memInfoFile        = "/proc/meminfo"
+	cgroupV2CPUMax     = "/sys/fs/cgroup/cpu.max"
+	cgroupV2MemoryMax  = "/sys/fs/cgroup/memory.max"
+	cgroupV1CPUQuota   = "/sys/fs/cgroup/cpu/cpu.cfs_quota_us"
+	cgroupV1CPUPeriod  = "/sys/fs/cgroup/cpu/cpu.cfs_period_us"
+	cgroupV1MemoryMax  = "/sys/fs/cgroup/memory/memory.limit_in_bytes"
+	memInfoTotalPrefix = "MemTotal:"
+
+	bytesPerMiB = 1 << 20
+	bytesPerGiB = 1 << 30
+)
+
+// containerResources are the CPUs & memory available to the toolchain container.
+type containerResources struct {
+	// cpus is the number of CPUs the container can use, e.g., 1.5 if its cgroup quota is half of
+	// two CPUs.
+	cpus float64
+	// memory is the memory in bytes the container can use.
+	memory int64
+	// limited is true if either was capped by a cgroup limit of the container rather than by the
+	// docker host.
+	limited bool
+}
+
+// countProcessors returns the number of "processor" entries in the given contents of
+// /proc/cpuinfo.
+func countProcessors(cpuInfo string) int {
+	n := 0
+	for _, line := range strings.Split(cpuInfo, "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == "processor" {
+			n++
+		}
+	}
+	return n
+}
+
+// parseMemTotal returns the MemTotal in bytes in the given contents of /proc/meminfo or 0 if it
+// isn't there.
+func parseMemTotal(memInfo string) int64 {
+	for _, line := range strings.Split(memInfo, "\n") {
+		if !strings.HasPrefix(line, memInfoTotalPrefix) {
+			continue
+		}
+		// The total is reported in kB, e.g., "MemTotal:       16384000 kB".
+		s := strings.Fields(strings.TrimPrefix(line, memInfoTotalPrefix))
+		if len(s) == 0 {
+			return 0
+		}
+		kb, err := strconv.ParseInt(s[0], 10, 64)
+		if err != nil {
+			return 0
+		}
+		return kb * 1024
+	}
+	return 0
+}
+
+// parseCPUQuota returns the CPUs of the given cgroup CPU quota & period in microseconds or 0 if
+// the quota is unlimited, i.e., "max" for cgroup v2 or "-1" for cgroup v1.
+func parseCPUQuota(quota, period string) float64 {
+	q, err := strconv.ParseInt(strings.TrimSpace(quota), 10, 64)
+	if err != nil || q <= 0 {
+		return 0
+	}
+	p, err := strconv.ParseInt(strings.TrimSpace(period), 10, 64)
+	if err != nil || p <= 0 {
+		return 0
+	}
+	return float64(q) / float64(p)
+}
+
+// parseMemoryLimit returns the given cgroup memory limit in bytes or 0 if it's unlimited, i.e.,
+// "max" for cgroup v2.
+func parseMemoryLimit(limit string) int64 {
+	l, err := strconv.ParseInt(strings.TrimSpace(limit), 10, 64)
+	if err != nil || l <= 0 {
+		return 0
+	}
+	return l
+}
+
+// formatCPUs formats the given number of CPUs, e.g., "4" or "1.5".
+func formatCPUs(cpus float64) string {
+	return strconv.FormatFloat(cpus, 'f', -1, 64)
+}
+
+// formatMemory formats the given memory in bytes in whole GiB if possible & in whole MiB rounded
+// down otherwise, e.g., "16Gi" or "1536Mi".
+func formatMemory(bytes int64) string {
+	if bytes%bytesPerGiB == 0 {
+		return fmt.Sprintf("%dGi", bytes/bytesPerGiB)
+	}
+	return fmt.Sprintf("%dMi", bytes/bytesPerMiB)
+}
+
+// readContainerResources returns the CPUs & memory available to the running Linux toolchain
+// container represented by the given docker runner. The CPUs & memory of the docker host as seen
+// by the container are capped by the cgroup v2 or v1 limits of the container, if any. Only cat is
+// used so this works with the probe helper.
+func readContainerResources(d *dockerRunner) (*containerResources, error) {
+	cat := func(p string) (string, error) {
+		return d.execUtil([]string{"cat", p}, "cat", p)
+	}
+	cpuInfo, err := cat(cpuInfoFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", cpuInfoFile, err)
+	}
+	memInfo, err := cat(memInfoFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", memInfoFile, err)
+	}
+	r := &containerResources{
+		cpus:   float64(countProcessors(cpuInfo)),
+		memory: parseMemTotal(memInfo),
+	}
+	if r.cpus == 0 || r.memory == 0 {
+		return nil, fmt.Errorf("unable to determine the CPUs & memory of the docker host from %s & %s", cpuInfoFile, memInfoFile)
+	}
+
+	var cpuLimit float64
+	var memLimit int64
+	if d.pathExists(cgroupV2CPUMax) {
+		// cpu.max has the quota & period on a single line, e.g., "150000 100000" or "max 100000".
+		if s, err := cat(cgroupV2CPUMax); err == nil {
+			if f := strings.Fields(s); len(f) == 2 {
+				cpuLimit = parseCPUQuota(f[0], f[1])
+			}
+		}
+		if s, err := cat(cgroupV2MemoryMax); err == nil {
+			memLimit = parseMemoryLimit(s)
+		}
+	} else if d.pathExists(cgroupV1CPUQuota) {
+		quota, qerr := cat(cgroupV1CPUQuota)
+		period, perr := cat(cgroupV1CPUPeriod)
+		if qerr == nil && perr == nil {
+			cpuLimit = parseCPUQuota(quota, period)
+		}
+		if s, err := cat(cgroupV1MemoryMax); err == nil {
+			memLimit = parseMemoryLimit(s)
+		}
+	} else {
+		d.log.Debugf("No cgroup limits found in the toolchain container, using the CPUs & memory of the docker host.")
+	}
+	if cpuLimit > 0 && cpuLimit < r.cpus {
+		r.cpus, r.limited = cpuLimit, true
+	}
+	// cgroup v1 reports an unlimited memory limit as a huge number which exceeds the host memory.
+	if memLimit > 0 && memLimit < r.memory {
+		r.memory, r.limited = memLimit, true
+	}
+	return r, nil
+}
+
+// detectResources records the CPUs & memory available to the running toolchain container in the
+// given facts as advisory sizing hints for remote workers if the given options specified
+// DetectResources. Nothing is recorded if they couldn't be determined.
+func detectResources(d *dockerRunner, o *Options, f *detectionFacts) {
+	if !o.DetectResources {
+		return
+	}
+	r, err := readContainerResources(d)
+	if err != nil {
+		d.warnf(WarningNoResources, "Unable to detect the CPUs & memory available to the toolchain container, no resource hints will be recorded: %v", err)
+		return
+	}
+	f.ResourceCPUs, f.ResourceMemory = formatCPUs(r.cpus), formatMemory(r.memory)
+	source := "the docker host"
+	if r.limited {
+		source = "the cgroup limits of the container"
+	}
+	d.log.Infof("The toolchain container can use %s CPUs & %s of memory according to %s. Remote workers running it should provide at least as much, e.g., advertised with exec_properties like gceMachineType or min-cpu if the remote execution service supports them. This is only a hint because the workers aren't known.", f.ResourceCPUs, f.ResourceMemory, source)
+}
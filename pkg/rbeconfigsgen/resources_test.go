@@ -0,0 +1,167 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestFormatMemory(t *testing.T) {
+	tests := []struct {
+		bytes int64
+		want  string
+	}{
+		{bytes: 16 << 30, want: "16Gi"},
+		{bytes: 1536 << 20, want: "1536Mi"},
+		{bytes: 1536<<20 + 123, want: "1536Mi"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.want, func(t *testing.T) {
+			t.Parallel()
+			if got := formatMemory(tc.bytes); got != tc.want {
+				t.Errorf("formatMemory(%d) = %q, want %q", tc.bytes, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReadContainerResources(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake docker client is a shell script")
+	}
+	const (
+		cpuInfo = "processor\t: 0\nmodel name\t: Fake CPU\n\nprocessor\t: 1\n\nprocessor\t: 2\n\nprocessor\t: 3\n"
+		memInfo = "MemTotal:       16777216 kB\nMemFree:         1024 kB\n"
+	)
+	tests := []struct {
+		name string
+		// files are the contents of the files in the fake container by path.
+		files       map[string]string
+		wantCPUs    float64
+		wantMemory  int64
+		wantLimited bool
+		wantErr     bool
+	}{
+		{
+			name:       "No cgroup limits",
+			files:      map[string]string{cpuInfoFile: cpuInfo, memInfoFile: memInfo},
+			wantCPUs:   4,
+			wantMemory: 16 << 30,
+		},
+		{
+			name: "cgroup v2 limits",
+			files: map[string]string{
+				cpuInfoFile:       cpuInfo,
+				memInfoFile:       memInfo,
+				cgroupV2CPUMax:    "150000 100000",
+				cgroupV2MemoryMax: "2147483648",
+			},
+			wantCPUs:    1.5,
+			wantMemory:  2 << 30,
+			wantLimited: true,
+		},
+		{
+			name: "cgroup v2 unlimited",
+			files: map[string]string{
+				cpuInfoFile:       cpuInfo,
+				memInfoFile:       memInfo,
+				cgroupV2CPUMax:    "max 100000",
+				cgroupV2MemoryMax: "max",
+			},
+			wantCPUs:   4,
+			wantMemory: 16 << 30,
+		},
+		{
+			name: "cgroup v1 limits above the host",
+			files: map[string]string{
+				cpuInfoFile:       cpuInfo,
+				memInfoFile:       memInfo,
+				cgroupV1CPUQuota:  "800000",
+				cgroupV1CPUPeriod: "100000",
+				cgroupV1MemoryMax: "9223372036854771712",
+			},
+			wantCPUs:   4,
+			wantMemory: 16 << 30,
+		},
+		{
+			name: "cgroup v1 CPU quota",
+			files: map[string]string{
+				cpuInfoFile:       cpuInfo,
+				memInfoFile:       memInfo,
+				cgroupV1CPUQuota:  "200000",
+				cgroupV1CPUPeriod: "100000",
+				cgroupV1MemoryMax: "9223372036854771712",
+			},
+			wantCPUs:    2,
+			wantMemory:  16 << 30,
+			wantLimited: true,
+		},
+		{
+			name:    "No meminfo",
+			files:   map[string]string{cpuInfoFile: cpuInfo},
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			dir := t.TempDir()
+			// The fake docker client serves "exec <cid> cat <file>" & "exec <cid> test -e <file>"
+			// from a directory mirroring the files in the container.
+			root := filepath.Join(dir, "root")
+			for p, contents := range tc.files {
+				local := filepath.Join(root, p)
+				if err := os.MkdirAll(filepath.Dir(local), os.ModePerm); err != nil {
+					t.Fatalf("Unable to create the directory of %q: %v", p, err)
+				}
+				if err := ioutil.WriteFile(local, []byte(contents), 0644); err != nil {
+					t.Fatalf("Unable to write %q: %v", p, err)
+				}
+			}
+			dockerPath := filepath.Join(dir, "docker")
+			script := fmt.Sprintf(`#!/bin/sh
+shift 2
+case "$1" in
+cat) exec cat %[1]q"$2" ;;
+test) exec test -e %[1]q"$3" ;;
+esac
+exit 1
+`, root)
+			if err := ioutil.WriteFile(dockerPath, []byte(script), 0755); err != nil {
+				t.Fatalf("Unable to write fake docker client: %v", err)
+			}
+			d := &dockerRunner{dockerPath: dockerPath, containerID: strings.Repeat("c", 64), execOS: OSLinux, ctx: context.Background()}
+			r, err := readContainerResources(d)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("readContainerResources() = %v, want error %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if r.cpus != tc.wantCPUs || r.memory != tc.wantMemory || r.limited != tc.wantLimited {
+				t.Errorf("readContainerResources() = %+v, want {cpus:%v memory:%v limited:%v}", *r, tc.wantCPUs, tc.wantMemory, tc.wantLimited)
+			}
+		})
+	}
+}
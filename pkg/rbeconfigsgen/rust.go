@@ -0,0 +1,150 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+)
+
+var (
+	// rustcPaths are the rustc binaries probed for in the toolchain container in order, i.e., rustc
+	// on the PATH followed by the install directories of the official Rust images & rustup.
+	rustcPaths = []string{
+		"rustc",
+		"/usr/local/cargo/bin/rustc",
+		"/root/.cargo/bin/rustc",
+	}
+
+	// rustBuildTemplate is the template of the BUILD file of the rust package exposing the
+	// metadata of the Rust toolchain in the toolchain container in toolchain.bzl.
+	rustBuildTemplate = template.Must(template.New("rustBuild").Parse(buildHeader + `
+# rustc {{ .RustcVersion }} for {{ .RustHostTriple }} installed in the toolchain container at
+# {{ .RustSysroot }}. Load the toolchain metadata from toolchain.bzl, e.g., in rules_rust macros.
+
+package(default_visibility = ["//visibility:public"])
+
+exports_files(["toolchain.bzl"])
+`))
+
+	// rustDefsTemplate is the template of toolchain.bzl in the rust package.
+	rustDefsTemplate = template.Must(template.New("rustDefs").Parse(buildHeader + `
+"""Metadata of the Rust toolchain installed in the toolchain container."""
+
+# Version of rustc, e.g., "1.75.0".
+RUSTC_VERSION = "{{ .RustcVersion }}"
+
+# Target triple rustc runs on in the toolchain container, e.g., "x86_64-unknown-linux-gnu".
+RUST_HOST_TRIPLE = "{{ .RustHostTriple }}"
+
+# Root of the Rust toolchain in the toolchain container as reported by 'rustc --print sysroot'.
+RUST_SYSROOT = "{{ .RustSysroot }}"
+
+# Version of cargo or "" if cargo isn't installed.
+CARGO_VERSION = "{{ .CargoVersion }}"
+`))
+)
+
+// parseRustcVersion returns the values of the "release" & "host" fields printed by 'rustc -vV',
+// e.g., "1.75.0" & "x86_64-unknown-linux-gnu".
+func parseRustcVersion(out string) (string, string) {
+	var release, host string
+	for _, line := range strings.Split(out, "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case "release":
+			release = strings.TrimSpace(kv[1])
+		case "host":
+			host = strings.TrimSpace(kv[1])
+		}
+	}
+	return release, host
+}
+
+// detectRust determines the version, host triple & sysroot of the rustc installed in the running
+// toolchain container & the version of cargo next to it, if any, and records them in the given
+// facts.
+func detectRust(d *dockerRunner, o *Options, f *detectionFacts) error {
+	if !o.GenRustConfigs {
+		return nil
+	}
+	var rustc, out string
+	for _, p := range rustcPaths {
+		var err error
+		if out, err = d.execCmd(p, "-vV"); err == nil {
+			rustc = p
+			break
+		}
+	}
+	if len(rustc) == 0 {
+		return fmt.Errorf("rustc wasn't found in the toolchain container, looked for %s", strings.Join(rustcPaths, ", "))
+	}
+	release, host := parseRustcVersion(out)
+	if len(release) == 0 || len(host) == 0 {
+		return fmt.Errorf("unable to determine the version & host of rustc from the output of '%s -vV': %q", rustc, out)
+	}
+	sysroot, err := d.execCmd(rustc, "--print", "sysroot")
+	if err != nil {
+		return fmt.Errorf("unable to determine the sysroot of %s: %w", rustc, err)
+	}
+	if len(sysroot) == 0 {
+		return fmt.Errorf("'%s --print sysroot' didn't print the sysroot", rustc)
+	}
+	o.log.Infof("rustc %s for %s at %q with sysroot %q.", release, host, rustc, sysroot)
+	f.RustcVersion = release
+	f.RustHostTriple = host
+	f.RustSysroot = sysroot
+
+	cargo := "cargo"
+	if strings.Contains(rustc, "/") {
+		cargo = path.Join(path.Dir(rustc), "cargo")
+	}
+	// cargo prints its version like "cargo 1.75.0 (1d8b05cdd 2023-11-20)".
+	if out, err := d.execCmd(cargo, "--version"); err != nil {
+		d.warnf(WarningNoCargo, "cargo wasn't found in the toolchain container next to %s: %v", rustc, err)
+	} else if fields := strings.Fields(out); len(fields) >= 2 {
+		f.CargoVersion = fields[1]
+	}
+	return nil
+}
+
+// genRustConfigs returns the BUILD file & toolchain.bzl of the rust package exposing the Rust
+// toolchain detected in the toolchain container or nothing if Rust configs aren't generated.
+func genRustConfigs(o *Options, f *detectionFacts) ([]generatedFile, error) {
+	if !o.GenRustConfigs {
+		return nil, nil
+	}
+	var files []generatedFile
+	for _, g := range []struct {
+		name string
+		t    *template.Template
+	}{
+		{"rust/BUILD", rustBuildTemplate},
+		{"rust/toolchain.bzl", rustDefsTemplate},
+	} {
+		buf := bytes.NewBuffer(nil)
+		if err := g.t.Execute(buf, f); err != nil {
+			return nil, fmt.Errorf("failed to generate the contents of %s: %w", g.name, err)
+		}
+		files = append(files, generatedFile{name: g.name, contents: buf.Bytes()})
+	}
+	return files, nil
+}
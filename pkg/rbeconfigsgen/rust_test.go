@@ -0,0 +1,126 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestParseRustcVersion(t *testing.T) {
+	tests := []struct {
+		name        string
+		out         string
+		wantRelease string
+		wantHost    string
+	}{
+		{
+			name:        "Stable",
+			out:         "rustc 1.75.0 (82e1608df 2023-12-21)\nbinary: rustc\ncommit-hash: 82e1608dfa6e0b5569232559e3d385fea5a93112\ncommit-date: 2023-12-21\nhost: x86_64-unknown-linux-gnu\nrelease: 1.75.0\nLLVM version: 17.0.6",
+			wantRelease: "1.75.0",
+			wantHost:    "x86_64-unknown-linux-gnu",
+		},
+		{
+			name:        "Nightly",
+			out:         "rustc 1.77.0-nightly (2023-12-27)\nhost: aarch64-unknown-linux-gnu\nrelease: 1.77.0-nightly",
+			wantRelease: "1.77.0-nightly",
+			wantHost:    "aarch64-unknown-linux-gnu",
+		},
+		{
+			name: "Not verbose",
+			out:  "rustc 1.75.0 (82e1608df 2023-12-21)",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			release, host := parseRustcVersion(tc.out)
+			if release != tc.wantRelease || host != tc.wantHost {
+				t.Errorf("parseRustcVersion()=(%q, %q), want (%q, %q)", release, host, tc.wantRelease, tc.wantHost)
+			}
+		})
+	}
+}
+
+func TestDetectRust(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake docker client is a shell script")
+	}
+	dockerPath := filepath.Join(t.TempDir(), "docker")
+	// The fake docker client only has rustc & cargo in /usr/local/cargo/bin.
+	script := `#!/bin/sh
+case "$3 $4" in
+"/usr/local/cargo/bin/rustc -vV") printf 'rustc 1.75.0\nhost: x86_64-unknown-linux-gnu\nrelease: 1.75.0\n' ;;
+"/usr/local/cargo/bin/rustc --print") echo /usr/local/rustup/toolchains/1.75.0-x86_64-unknown-linux-gnu ;;
+"/usr/local/cargo/bin/cargo --version") echo 'cargo 1.75.0 (1d8b05cdd 2023-11-20)' ;;
+*) exit 1 ;;
+esac
+`
+	if err := ioutil.WriteFile(dockerPath, []byte(script), 0755); err != nil {
+		t.Fatalf("Unable to write fake docker client: %v", err)
+	}
+	d := &dockerRunner{dockerPath: dockerPath, containerID: "container", execOS: OSLinux, ctx: context.Background()}
+	f := &detectionFacts{}
+	if err := detectRust(d, &Options{GenRustConfigs: true}, f); err != nil {
+		t.Fatalf("detectRust() failed: %v", err)
+	}
+	want := detectionFacts{
+		RustcVersion:   "1.75.0",
+		RustHostTriple: "x86_64-unknown-linux-gnu",
+		RustSysroot:    "/usr/local/rustup/toolchains/1.75.0-x86_64-unknown-linux-gnu",
+		CargoVersion:   "1.75.0",
+	}
+	if f.RustcVersion != want.RustcVersion || f.RustHostTriple != want.RustHostTriple || f.RustSysroot != want.RustSysroot || f.CargoVersion != want.CargoVersion {
+		t.Errorf("detectRust() detected (%q, %q, %q, %q), want (%q, %q, %q, %q)", f.RustcVersion, f.RustHostTriple, f.RustSysroot, f.CargoVersion, want.RustcVersion, want.RustHostTriple, want.RustSysroot, want.CargoVersion)
+	}
+
+	f = &detectionFacts{}
+	if err := detectRust(d, &Options{}, f); err != nil || len(f.RustcVersion) != 0 {
+		t.Errorf("detectRust() with GenRustConfigs=false detected rustc %q, error %v, want nothing", f.RustcVersion, err)
+	}
+}
+
+func TestGenRustConfigs(t *testing.T) {
+	f := &detectionFacts{
+		RustcVersion:   "1.75.0",
+		RustHostTriple: "x86_64-unknown-linux-gnu",
+		RustSysroot:    "/usr/local/rustup/toolchains/1.75.0-x86_64-unknown-linux-gnu",
+	}
+	got, err := genRustConfigs(&Options{GenRustConfigs: true}, f)
+	if err != nil {
+		t.Fatalf("genRustConfigs() failed: %v", err)
+	}
+	if len(got) != 2 || got[0].name != "rust/BUILD" || got[1].name != "rust/toolchain.bzl" {
+		t.Fatalf("genRustConfigs() returned %d files, want rust/BUILD & rust/toolchain.bzl", len(got))
+	}
+	for _, want := range []string{
+		`RUSTC_VERSION = "1.75.0"`,
+		`RUST_HOST_TRIPLE = "x86_64-unknown-linux-gnu"`,
+		`RUST_SYSROOT = "/usr/local/rustup/toolchains/1.75.0-x86_64-unknown-linux-gnu"`,
+		`CARGO_VERSION = ""`,
+	} {
+		if !strings.Contains(string(got[1].contents), want) {
+			t.Errorf("rust/toolchain.bzl doesn't contain %q:\n%s", want, got[1].contents)
+		}
+	}
+	if got, err := genRustConfigs(&Options{}, f); err != nil || len(got) != 0 {
+		t.Errorf("genRustConfigs() with GenRustConfigs=false returned %d files, error %v, want none", len(got), err)
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// SelfTestImage is the public toolchain image the self test generates configs for by default.
+	// It's pinned by digest so the self test doesn't change when the tag is moved.
+	SelfTestImage = "l.gcr.io/google/rbe-ubuntu16-04@sha256:f6568d8168b14aafd1b707019927a63c2d37113a03bcee188218f99bd0327ea1"
+	// SelfTestBazelVersion is the Bazel version the self test generates configs for by default. It's
+	// pinned so the self test doesn't depend on the latest Bazel release.
+	SelfTestBazelVersion = "6.4.0"
+)
+
+// selfTestFiles are the files the configs generated by the self test must contain.
+var selfTestFiles = []string{
+	"BUILD",
+	"LICENSE",
+	"cc/BUILD",
+	"cc/cc_toolchain_config.bzl",
+	"config/BUILD",
+	"java/BUILD",
+}
+
+// SelfTestOptions are the options of the self test.
+type SelfTestOptions struct {
+	// ToolchainContainer is the Linux toolchain image to generate configs for. Defaults to
+	// SelfTestImage.
+	ToolchainContainer string
+	// BazelVersion is the version of Bazel to generate configs for. Defaults to
+	// SelfTestBazelVersion.
+	BazelVersion string
+	// OutputDir is the directory the configs tarball & manifest are written to. The outputs are
+	// written to a temporary directory that's deleted afterwards if blank.
+	OutputDir string
+}
+
+// selfTestOptions returns the options to generate configs for the self test with the given options
+// writing the outputs to the given directory.
+func selfTestOptions(so SelfTestOptions, dir string) (Options, error) {
+	o := Options{
+		BazelVersion:       so.BazelVersion,
+		ToolchainContainer: so.ToolchainContainer,
+		ExecOS:             OSLinux,
+		TargetOS:           OSLinux,
+		OutputTarball:      filepath.Join(dir, "rbe_default.tar"),
+		OutputManifest:     filepath.Join(dir, "manifest.json"),
+		GenCPPConfigs:      true,
+		VerifyCPP:          true,
+		GenJavaConfigs:     true,
+		TempWorkDir:        filepath.Join(dir, "work"),
+		Cleanup:            true,
+		NoCache:            true,
+	}
+	if len(o.ToolchainContainer) == 0 {
+		o.ToolchainContainer = SelfTestImage
+	}
+	if len(o.BazelVersion) == 0 {
+		o.BazelVersion = SelfTestBazelVersion
+	}
+	if err := os.MkdirAll(o.TempWorkDir, os.ModePerm); err != nil {
+		return Options{}, fmt.Errorf("unable to create the temporary working directory of the self test: %w", err)
+	}
+	if err := o.ApplyDefaults(o.ExecOS); err != nil {
+		return Options{}, fmt.Errorf("failed to apply default options: %w", err)
+	}
+	if err := o.Validate(); err != nil {
+		return Options{}, fmt.Errorf("invalid options: %w", err)
+	}
+	return o, nil
+}
+
+// SelfTest generates C++ & Java configs for a public Linux toolchain image locally, verifying the
+// generated C++ configs against the toolchain container, & checks the expected files & labels
+// were produced. This requires docker but no remote execution service. Returns an error listing
+// every discrepancy that was found.
+func SelfTest(ctx context.Context, so SelfTestOptions) error {
+	dir := so.OutputDir
+	if len(dir) == 0 {
+		var err error
+		if dir, err = ioutil.TempDir("", "rbe_configs_gen_selftest"); err != nil {
+			return fmt.Errorf("unable to create a temporary directory for the outputs of the self test: %w", err)
+		}
+		defer os.RemoveAll(dir)
+	} else if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("unable to create the output directory of the self test: %w", err)
+	}
+	o, err := selfTestOptions(so, dir)
+	if err != nil {
+		return err
+	}
+	o.log.Infof("Generating configs for Bazel %s & toolchain image %q in %s.", o.BazelVersion, o.ToolchainContainer, dir)
+	if err := RunWithContext(ctx, o); err != nil {
+		return fmt.Errorf("config generation failed: %w", err)
+	}
+	if problems := checkSelfTestOutputs(&o); len(problems) != 0 {
+		return fmt.Errorf("self test found %d discrepancies in the generated configs:\n%s", len(problems), strings.Join(problems, "\n"))
+	}
+	o.log.Infof("Self test passed.")
+	return nil
+}
+
+// checkSelfTestOutputs returns the discrepancies between the outputs of generating configs
+// according to the given options & the outputs expected by the self test. Every file in
+// selfTestFiles must be in the configs tarball & every label in the summary must be defined by
+// the BUILD file of its package in the configs tarball.
+func checkSelfTestOutputs(o *Options) []string {
+	var problems []string
+	m, err := ManifestFromJSONFile(o.OutputManifest)
+	if err != nil {
+		return []string{fmt.Sprintf("unable to read the manifest: %v", err)}
+	}
+	if m.BazelVersion != o.BazelVersion {
+		problems = append(problems, fmt.Sprintf("manifest has Bazel version %q, want %q", m.BazelVersion, o.BazelVersion))
+	}
+	if len(m.ImageDigest) == 0 {
+		problems = append(problems, "manifest doesn't specify the digest of the toolchain image")
+	}
+	if len(m.ConfigsTarballDigest) == 0 {
+		problems = append(problems, "manifest doesn't specify the digest of the configs tarball")
+	}
+
+	builds := make(map[string]string)
+	files := make(map[string]bool)
+	if err := walkTarball(o.OutputTarball, m.TarballPrefix, func(name string, r io.Reader) error {
+		files[name] = true
+		if filepath.Base(name) != "BUILD" {
+			return nil
+		}
+		blob, err := ioutil.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("unable to read %q: %w", name, err)
+		}
+		// The top-level BUILD file is the package "".
+		builds[strings.TrimSuffix(strings.TrimSuffix(name, "BUILD"), "/")] = string(blob)
+		return nil
+	}); err != nil {
+		return append(problems, fmt.Sprintf("unable to read the configs tarball: %v", err))
+	}
+	for _, f := range selfTestFiles {
+		if !files[f] {
+			problems = append(problems, fmt.Sprintf("configs tarball doesn't contain %s", f))
+		}
+	}
+
+	s, err := NewSummary(o)
+	if err != nil {
+		return append(problems, fmt.Sprintf("unable to determine the labels of the configs: %v", err))
+	}
+	labels := []string{s.Platform, s.CCToolchain, s.CCCrosstoolTop, s.JavaRuntime}
+	var aliases []string
+	for _, l := range s.Aliases {
+		aliases = append(aliases, l)
+	}
+	sort.Strings(aliases)
+	labels = append(labels, aliases...)
+	for _, l := range append(labels, s.JavaToolchains...) {
+		if len(l) == 0 {
+			continue
+		}
+		pkg, name, ok := splitLabel(l)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("summary has malformed label %q", l))
+			continue
+		}
+		// ":all" is a target pattern matching every target in the package.
+		if name == "all" {
+			if _, ok := builds[pkg]; !ok {
+				problems = append(problems, fmt.Sprintf("package %q of label %s doesn't exist", pkg, l))
+			}
+			continue
+		}
+		if !regexp.MustCompile(`name\s*=\s*"` + regexp.QuoteMeta(name) + `"`).MatchString(builds[pkg]) {
+			problems = append(problems, fmt.Sprintf("label %s isn't defined in %s", l, strings.TrimPrefix(pkg+"/BUILD", "/")))
+		}
+	}
+	return problems
+}
+
+// splitLabel returns the package & the target name of the given label in an external repository,
+// e.g., "config" & "platform" for "@rbe_default//config:platform".
+func splitLabel(l string) (string, string, bool) {
+	i := strings.Index(l, "//")
+	if i < 0 {
+		return "", "", false
+	}
+	parts := strings.SplitN(l[i+2:], ":", 2)
+	if len(parts) != 2 || len(parts[1]) == 0 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
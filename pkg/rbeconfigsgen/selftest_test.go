@@ -0,0 +1,102 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// selfTestConfigs returns the files of configs that pass the self test.
+func selfTestConfigs() map[string]string {
+	return map[string]string{
+		"BUILD":                      "alias(\n    name = \"platform\",\n)\nalias(\n    name = \"toolchain\",\n)\nalias(\n    name = \"jdk\",\n)",
+		"LICENSE":                    "license",
+		"cc/BUILD":                   "cc_toolchain_suite(\n    name = \"toolchain\",\n)",
+		"cc/cc_toolchain_config.bzl": "cc_toolchain_config",
+		"config/BUILD":               "toolchain(\n    name = \"cc-toolchain\",\n)\nplatform(\n    name = \"platform\",\n)",
+		"java/BUILD":                 "alias(\n    name = \"jdk\",\n)",
+	}
+}
+
+func TestCheckSelfTestOutputs(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(files map[string]string, m *Manifest)
+		want   []string
+	}{
+		{
+			name:   "Valid",
+			modify: func(files map[string]string, m *Manifest) {},
+		},
+		{
+			name: "Missing file",
+			modify: func(files map[string]string, m *Manifest) {
+				delete(files, "cc/cc_toolchain_config.bzl")
+			},
+			want: []string{"configs tarball doesn't contain cc/cc_toolchain_config.bzl"},
+		},
+		{
+			name: "Undefined label",
+			modify: func(files map[string]string, m *Manifest) {
+				files["config/BUILD"] = "platform(\n    name = \"platform\",\n)"
+			},
+			want: []string{"label @rbe_default//config:cc-toolchain isn't defined in config/BUILD"},
+		},
+		{
+			name: "Undefined alias",
+			modify: func(files map[string]string, m *Manifest) {
+				files["BUILD"] = "alias(\n    name = \"platform\",\n)\nalias(\n    name = \"jdk\",\n)"
+			},
+			want: []string{"label @rbe_default//:toolchain isn't defined in BUILD"},
+		},
+		{
+			name: "Wrong manifest",
+			modify: func(files map[string]string, m *Manifest) {
+				m.BazelVersion = "7.0.0"
+				m.ImageDigest = ""
+			},
+			want: []string{
+				`manifest has Bazel version "7.0.0", want "6.4.0"`,
+				"manifest doesn't specify the digest of the toolchain image",
+			},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			files := selfTestConfigs()
+			m := &Manifest{BazelVersion: "6.4.0", ImageDigest: "aaaa", ConfigsTarballDigest: "bbbb"}
+			tc.modify(files, m)
+			manifestPath := filepath.Join(t.TempDir(), "manifest.json")
+			if err := m.ToJSONFile(manifestPath); err != nil {
+				t.Fatalf("Unable to write manifest: %v", err)
+			}
+			o := &Options{
+				BazelVersion:   "6.4.0",
+				ExecOS:         OSLinux,
+				OutputTarball:  writeTestTarball(t, files),
+				OutputManifest: manifestPath,
+				GenCPPConfigs:  true,
+				GenJavaConfigs: true,
+			}
+			if got := checkSelfTestOutputs(o); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("checkSelfTestOutputs() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/coreos/go-semver/semver"
+)
+
+const (
+	// simulationPkg is the package of the simulation workspace with the hello world targets.
+	simulationPkg = "simulate_rbe"
+
+	simulationCppSource = `#include <iostream>
+
+int main() {
+  std::cout << "Hello from the generated C++ toolchain" << std::endl;
+  return 0;
+}
+`
+
+	simulationJavaSource = `public class HelloJava {
+  public static void main(String[] args) {
+    System.out.println("Hello from the generated Java toolchain");
+  }
+}
+`
+)
+
+// simulationCppActionRules are the rules of the targets built from the probe source files of the
+// actions of each group of CppActions so that the action configs of the actions are used.
+var simulationCppActionRules = map[string]string{
+	CppActionsObjC: "objc_library",
+	CppActionsAsm:  "cc_library",
+}
+
+// simulationBuild returns the BUILD file of the hello world targets built with the configs
+// generated according to the given options.
+func simulationBuild(o *Options) string {
+	var b strings.Builder
+	b.WriteString(buildHeader)
+	if o.GenCPPConfigs {
+		b.WriteString(`
+cc_binary(
+    name = "hello_cc",
+    srcs = ["hello.cc"],
+)
+`)
+		for _, g := range o.CppActions {
+			var srcs []string
+			for _, p := range cppActionProbes[g] {
+				srcs = append(srcs, fmt.Sprintf("%q", p.file))
+			}
+			fmt.Fprintf(&b, "\n%s(\n    name = \"hello_%s\",\n    srcs = [%s],\n)\n", simulationCppActionRules[g], g, strings.Join(srcs, ", "))
+		}
+	}
+	if o.GenJavaConfigs {
+		b.WriteString(`
+java_binary(
+    name = "HelloJava",
+    srcs = ["HelloJava.java"],
+    main_class = "HelloJava",
+)
+`)
+	}
+	return b.String()
+}
+
+// simulationFlags returns the Bazel flags to build with the configs generated according to the
+// given options in the simulation workspace using local execution, i.e., the flags the bazelrc
+// for remote builds specifies except for the remote execution service.
+func simulationFlags(o *Options) ([]string, error) {
+	platform := repoLabel(o, "config", platformName(o))
+	flags := []string{
+		"--spawn_strategy=local",
+		"--incompatible_strict_action_env=true",
+		"--extra_execution_platforms=" + platform,
+		"--host_platform=" + platform,
+		"--platforms=" + platform,
+	}
+	bv, err := bazelCoreVersion(o.BazelVersion)
+	if err != nil {
+		return nil, err
+	}
+	// The simulation workspace is a WORKSPACE based workspace which Bazel 8 doesn't support by
+	// default.
+	if !bv.LessThan(*semver.New("8.0.0")) {
+		flags = append(flags, "--enable_workspace")
+	}
+	if o.GenCPPConfigs {
+		u, err := usesCcToolchainResolution(o)
+		if err != nil {
+			return nil, err
+		}
+		byDefault, err := UsesCcToolchainResolution(o.BazelVersion)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case !u:
+			flags = append(flags, "--crosstool_top="+repoLabel(o, "cc", "toolchain"))
+		case !byDefault:
+			flags = append(flags, "--incompatible_enable_cc_toolchain_resolution")
+		}
+		flags = append(flags, "--action_env=BAZEL_DO_NOT_DETECT_CPP_TOOLCHAIN=1", "--extra_toolchains="+repoLabel(o, "config", "cc-toolchain"))
+	}
+	if o.GenJavaConfigs {
+		u, err := usesLocalJavaRuntime(o)
+		if err != nil {
+			return nil, err
+		}
+		if u {
+			flags = append(flags, "--java_runtime_version=rbe_jdk", "--tool_java_runtime_version=rbe_jdk", "--extra_toolchains="+repoLabel(o, "java", "all"))
+		} else {
+			jdk := repoLabel(o, "java", "jdk")
+			flags = append(flags, "--host_javabase="+jdk, "--javabase="+jdk, "--host_java_toolchain=@bazel_tools//tools/jdk:toolchain_hostjdk8", "--java_toolchain=@bazel_tools//tools/jdk:toolchain_hostjdk8")
+		}
+	}
+	return flags, nil
+}
+
+// writeSimulationWorkspace writes the workspace used to simulate remote builds to the given local
+// directory. The workspace is the repository containing the given configs laid out as if they were
+// copied to a source repository with a hello world package for each kind of generated toolchain.
+// The package builds the probe source files of the CppActions as well.
+func writeSimulationWorkspace(o *Options, oc outputConfigs, dir string) error {
+	if err := copyConfigsToOutputDir(&Options{OutputSourceRoot: dir, OutputConfigPath: o.OutputConfigPath}, oc); err != nil {
+		return err
+	}
+	files := []generatedFile{
+		{name: "WORKSPACE", contents: []byte("workspace(name = \"rbe_configs_simulation\")\n")},
+		{name: path.Join(simulationPkg, "BUILD"), contents: []byte(simulationBuild(o))},
+	}
+	if o.GenCPPConfigs {
+		files = append(files, generatedFile{name: path.Join(simulationPkg, "hello.cc"), contents: []byte(simulationCppSource)})
+		for _, g := range o.CppActions {
+			for _, p := range cppActionProbes[g] {
+				files = append(files, generatedFile{name: path.Join(simulationPkg, p.file), contents: []byte(p.source)})
+			}
+		}
+	}
+	if o.GenJavaConfigs {
+		files = append(files, generatedFile{name: path.Join(simulationPkg, "HelloJava.java"), contents: []byte(simulationJavaSource)})
+	}
+	for _, g := range files {
+		if err := writeGeneratedFile(dir, g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// simulateRBE builds hello world targets with the given generated configs using Bazel with local
+// execution inside a fresh container of the toolchain image represented by the given docker
+// runner, which is where remote actions would run with the configs. This catches inconsistent
+// paths & flags in the configs without a remote execution service. Nothing is done unless the
+// given options specified SimulateRBE.
+func simulateRBE(d *dockerRunner, o *Options, oc outputConfigs) error {
+	if !o.SimulateRBE {
+		return nil
+	}
+	flags, err := simulationFlags(o)
+	if err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir(o.TempWorkDir, "simulate_rbe_")
+	if err != nil {
+		return fmt.Errorf("unable to create a local directory for the simulation workspace: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := writeSimulationWorkspace(o, oc, dir); err != nil {
+		return fmt.Errorf("unable to write the simulation workspace: %w", err)
+	}
+
+	r := *d
+	r.workdir, r.env, r.initEnv = "", nil, nil
+	if !d.existing {
+		r.containerName, r.containerID = "", ""
+	}
+	bazelPath, err := startProbeContainer(&r, o, true)
+	defer r.cleanup()
+	if err != nil {
+		return fmt.Errorf("unable to start the toolchain container to simulate remote builds in: %w", err)
+	}
+	ws := path.Join(r.workdir, "simulation")
+	if err := r.copyToContainer(dir, ws); err != nil {
+		return fmt.Errorf("failed to copy the simulation workspace into the toolchain container: %w", err)
+	}
+	r.workdir = ws
+	r.env = []string{fmt.Sprintf("USE_BAZEL_VERSION=%s", o.BazelVersion)}
+	cmd := append([]string{bazelPath, "build"}, flags...)
+	cmd = append(cmd, "//"+simulationPkg+":all")
+	o.log.Infof("Simulating remote builds with the generated configs by building //%s:all with local execution in the toolchain container.", simulationPkg)
+	if _, err := r.execCmd(cmd...); err != nil {
+		return fmt.Errorf("Bazel was unable to build the hello world targets with the generated configs in the toolchain container: %w", err)
+	}
+	o.log.Infof("Built the hello world targets with the generated configs in the toolchain container.")
+	return nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSimulationFlags(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  *Options
+		want []string
+	}{
+		{
+			name: "Bazel 6 C++ and Java",
+			opt:  &Options{BazelVersion: "6.4.0", GenCPPConfigs: true, GenJavaConfigs: true},
+			want: []string{
+				"--spawn_strategy=local",
+				"--incompatible_strict_action_env=true",
+				"--extra_execution_platforms=//config:platform",
+				"--host_platform=//config:platform",
+				"--platforms=//config:platform",
+				"--crosstool_top=//cc:toolchain",
+				"--action_env=BAZEL_DO_NOT_DETECT_CPP_TOOLCHAIN=1",
+				"--extra_toolchains=//config:cc-toolchain",
+				"--java_runtime_version=rbe_jdk",
+				"--tool_java_runtime_version=rbe_jdk",
+				"--extra_toolchains=//java:all",
+			},
+		},
+		{
+			name: "Bazel 6 forced C++ toolchain resolution, source root",
+			opt:  &Options{BazelVersion: "6.4.0", GenCPPConfigs: true, CppToolchainResolution: true, OutputSourceRoot: "/src", OutputConfigPath: "configs/rbe"},
+			want: []string{
+				"--spawn_strategy=local",
+				"--incompatible_strict_action_env=true",
+				"--extra_execution_platforms=//configs/rbe/config:platform",
+				"--host_platform=//configs/rbe/config:platform",
+				"--platforms=//configs/rbe/config:platform",
+				"--incompatible_enable_cc_toolchain_resolution",
+				"--action_env=BAZEL_DO_NOT_DETECT_CPP_TOOLCHAIN=1",
+				"--extra_toolchains=//configs/rbe/config:cc-toolchain",
+			},
+		},
+		{
+			name: "Bazel 8 legacy Java rules",
+			opt:  &Options{BazelVersion: "8.0.0", GenJavaConfigs: true, ForceLocalJavaRuntime: new(bool)},
+			want: []string{
+				"--spawn_strategy=local",
+				"--incompatible_strict_action_env=true",
+				"--extra_execution_platforms=//config:platform",
+				"--host_platform=//config:platform",
+				"--platforms=//config:platform",
+				"--enable_workspace",
+				"--host_javabase=//java:jdk",
+				"--javabase=//java:jdk",
+				"--host_java_toolchain=@bazel_tools//tools/jdk:toolchain_hostjdk8",
+				"--java_toolchain=@bazel_tools//tools/jdk:toolchain_hostjdk8",
+			},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := simulationFlags(tc.opt)
+			if err != nil {
+				t.Fatalf("simulationFlags() failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("simulationFlags()=%q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWriteSimulationWorkspace(t *testing.T) {
+	dir := t.TempDir()
+	o := &Options{GenCPPConfigs: true, OutputSourceRoot: "/src", OutputConfigPath: "configs/rbe"}
+	oc := outputConfigs{
+		license:     generatedFile{name: "LICENSE", contents: []byte("license")},
+		configBuild: generatedFile{name: "config/BUILD", contents: []byte("platform")},
+	}
+	if err := writeSimulationWorkspace(o, oc, dir); err != nil {
+		t.Fatalf("writeSimulationWorkspace() failed: %v", err)
+	}
+	for _, f := range []string{"WORKSPACE", "configs/rbe/LICENSE", "configs/rbe/config/BUILD", "simulate_rbe/BUILD", "simulate_rbe/hello.cc"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+			t.Errorf("writeSimulationWorkspace() didn't write %s: %v", f, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "simulate_rbe", "HelloJava.java")); err == nil {
+		t.Errorf("writeSimulationWorkspace() wrote a Java source without Java configs")
+	}
+	blob, err := ioutil.ReadFile(filepath.Join(dir, "simulate_rbe", "BUILD"))
+	if err != nil {
+		t.Fatalf("Unable to read the hello world BUILD file: %v", err)
+	}
+	if got, want := string(blob), simulationBuild(o); got != want {
+		t.Errorf("writeSimulationWorkspace() wrote BUILD file:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestWriteSimulationWorkspaceCppActions(t *testing.T) {
+	dir := t.TempDir()
+	o := &Options{GenCPPConfigs: true, CppActions: []string{CppActionsAsm, CppActionsObjC}}
+	oc := outputConfigs{license: generatedFile{name: "LICENSE", contents: []byte("license")}}
+	if err := writeSimulationWorkspace(o, oc, dir); err != nil {
+		t.Fatalf("writeSimulationWorkspace() failed: %v", err)
+	}
+	for _, f := range []string{"action_probe.s", "action_probe.S", "action_probe.m", "action_probe.mm"} {
+		if _, err := os.Stat(filepath.Join(dir, "simulate_rbe", f)); err != nil {
+			t.Errorf("writeSimulationWorkspace() didn't write %s: %v", f, err)
+		}
+	}
+	build := simulationBuild(o)
+	for _, w := range []string{
+		"cc_library(\n    name = \"hello_asm\",\n    srcs = [\"action_probe.s\", \"action_probe.S\"],\n)",
+		"objc_library(\n    name = \"hello_objc\",\n    srcs = [\"action_probe.m\", \"action_probe.mm\"],\n)",
+	} {
+		if !strings.Contains(build, w) {
+			t.Errorf("simulationBuild() generated:\n%s\nwant it to contain:\n%s", build, w)
+		}
+	}
+}
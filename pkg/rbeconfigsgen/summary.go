@@ -0,0 +1,146 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// Summary lists the Bazel labels of the targets in the generated configs that are used to
+// configure Bazel for remote execution. If the configs were copied to a source repository, the
+// labels are relative to the main repository. Otherwise, the labels are in the external repository
+// the configs tarball is expected to be imported as.
+type Summary struct {
+	// RepoName is the name of the external repository the labels are in. Blank if the configs were
+	// copied to a source repository.
+	RepoName string `json:"repo_name,omitempty"`
+	// CCToolchain is the C++ toolchain target to specify to --extra_toolchains.
+	CCToolchain string `json:"cc_toolchain,omitempty"`
+	// CCCrosstoolTop is the C++ toolchain suite to specify to --crosstool_top. Blank if the C++
+	// toolchain is expected to be resolved using platforms.
+	CCCrosstoolTop string `json:"cc_crosstool_top,omitempty"`
+	// Platform is the platform target to specify to --platforms, --host_platform and
+	// --extra_execution_platforms.
+	Platform string `json:"platform"`
+	// JavaRuntime is the Java runtime target, i.e., --javabase for older Bazel versions.
+	JavaRuntime string `json:"java_runtime,omitempty"`
+	// JavaToolchains are the Java toolchain targets to specify to --extra_toolchains. Blank for
+	// older Bazel versions that don't register the Java runtime as a toolchain.
+	JavaToolchains []string `json:"java_toolchains,omitempty"`
+	// Aliases are the recommended labels of the alias targets in the top-level BUILD file of the
+	// configs keyed by the JSON name of the field with the label of the canonical target they
+	// point at, e.g., "platform" -> "@rbe_default//:platform". The aliases are stable even if the
+	// layout of the configs changes. Blank if the aliases weren't written.
+	Aliases map[string]string `json:"aliases,omitempty"`
+	// Timings are the durations of the config generation stages that finished when the summary
+	// was created. Blank unless the options specified Timings.
+	Timings []StageTiming `json:"timings,omitempty"`
+	// Warnings are the warnings about anomalies detected in the toolchain image reported when the
+	// summary was created. Blank unless the options specified Warnings.
+	Warnings []Warning `json:"warnings,omitempty"`
+}
+
+// repoName returns the name of the external repository the configs generated according to the
+// given options are expected to be imported as.
+func repoName(o *Options) string {
+	if len(o.RepoName) == 0 {
+		return DefaultRepoName
+	}
+	return o.RepoName
+}
+
+// platformName returns the name of the platform target generated according to the given options.
+func platformName(o *Options) string {
+	if len(o.PlatformName) == 0 {
+		return DefaultPlatformName
+	}
+	return o.PlatformName
+}
+
+// configsLabel returns the label of the target with the given name in the given package of the
+// generated configs.
+func configsLabel(o *Options, pkg, name string) string {
+	if len(o.OutputSourceRoot) != 0 {
+		return repoLabel(o, pkg, name)
+	}
+	return fmt.Sprintf("@%s//%s:%s", repoName(o), pkg, name)
+}
+
+// repoLabel returns the label of the target with the given name in the given package of the
+// generated configs relative to the repository containing the configs. The package is blank for
+// the top-level package of the configs.
+func repoLabel(o *Options, pkg, name string) string {
+	if len(o.OutputSourceRoot) != 0 && len(o.OutputConfigPath) != 0 {
+		pkg = path.Join(strings.ReplaceAll(o.OutputConfigPath, "\\", "/"), pkg)
+	}
+	return fmt.Sprintf("//%s:%s", pkg, name)
+}
+
+// NewSummary returns the summary of the labels of the configs generated according to the given
+// validated options.
+func NewSummary(o *Options) (*Summary, error) {
+	s := &Summary{
+		Platform: configsLabel(o, "config", platformName(o)),
+		Timings:  o.Timings.Stages(),
+		Warnings: o.Warnings.All(),
+	}
+	if len(o.OutputSourceRoot) == 0 {
+		s.RepoName = repoName(o)
+	}
+	if o.GenCPPConfigs {
+		s.CCToolchain = configsLabel(o, "config", "cc-toolchain")
+		u, err := usesCcToolchainResolution(o)
+		if err != nil {
+			return nil, err
+		}
+		if !u {
+			s.CCCrosstoolTop = configsLabel(o, "cc", "toolchain")
+		}
+	}
+	if o.GenJavaConfigs {
+		s.JavaRuntime = configsLabel(o, "java", "jdk")
+		u, err := usesLocalJavaRuntime(o)
+		if err != nil {
+			return nil, err
+		}
+		if u {
+			s.JavaToolchains = []string{configsLabel(o, "java", "all")}
+		}
+	}
+	for _, a := range configAliases(o) {
+		if s.Aliases == nil {
+			s.Aliases = make(map[string]string)
+		}
+		s.Aliases[a.field] = configsLabel(o, "", a.Name)
+	}
+	return s, nil
+}
+
+// ToJSONFile writes the given summary to a JSON file at the given path.
+func (s *Summary) ToJSONFile(filePath string) error {
+	blob, err := json.MarshalIndent(s, "", " ")
+	if err != nil {
+		return fmt.Errorf("unable to generate JSON for given summary: %w", err)
+	}
+	if err := ioutil.WriteFile(filePath, blob, os.ModePerm); err != nil {
+		return fmt.Errorf("unable to write the given summary as JSON to %q: %w", filePath, err)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewSummary(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  *Options
+		want *Summary
+	}{
+		{
+			name: "Tarball output, C++ and Java",
+			opt: &Options{
+				BazelVersion:   "5.0.0",
+				GenCPPConfigs:  true,
+				GenJavaConfigs: true,
+			},
+			want: &Summary{
+				RepoName:       "rbe_default",
+				CCToolchain:    "@rbe_default//config:cc-toolchain",
+				CCCrosstoolTop: "@rbe_default//cc:toolchain",
+				Platform:       "@rbe_default//config:platform",
+				JavaRuntime:    "@rbe_default//java:jdk",
+				JavaToolchains: []string{"@rbe_default//java:all"},
+				Aliases: map[string]string{
+					"platform":     "@rbe_default//:platform",
+					"cc_toolchain": "@rbe_default//:toolchain",
+					"java_runtime": "@rbe_default//:jdk",
+				},
+			},
+		}, {
+			name: "Tarball output, custom repo name",
+			opt: &Options{
+				BazelVersion:  "6.4.0",
+				RepoName:      "rbe_ubuntu",
+				GenCPPConfigs: true,
+			},
+			want: &Summary{
+				RepoName:       "rbe_ubuntu",
+				CCToolchain:    "@rbe_ubuntu//config:cc-toolchain",
+				CCCrosstoolTop: "@rbe_ubuntu//cc:toolchain",
+				Platform:       "@rbe_ubuntu//config:platform",
+				Aliases: map[string]string{
+					"platform":     "@rbe_ubuntu//:platform",
+					"cc_toolchain": "@rbe_ubuntu//:toolchain",
+				},
+			},
+		}, {
+			name: "Tarball output, custom platform name",
+			opt: &Options{
+				BazelVersion: "6.4.0",
+				RepoName:     "rbe_ubuntu",
+				PlatformName: "ubuntu_platform",
+			},
+			want: &Summary{
+				RepoName: "rbe_ubuntu",
+				Platform: "@rbe_ubuntu//config:ubuntu_platform",
+				Aliases: map[string]string{
+					"platform": "@rbe_ubuntu//:platform",
+				},
+			},
+		}, {
+			name: "Bazel 7 uses C++ toolchain resolution",
+			opt: &Options{
+				BazelVersion:  "7.0.0",
+				GenCPPConfigs: true,
+			},
+			want: &Summary{
+				RepoName:    "rbe_default",
+				CCToolchain: "@rbe_default//config:cc-toolchain",
+				Platform:    "@rbe_default//config:platform",
+				Aliases: map[string]string{
+					"platform":     "@rbe_default//:platform",
+					"cc_toolchain": "@rbe_default//:toolchain",
+				},
+			},
+		}, {
+			name: "C++ toolchain resolution forced for older Bazel",
+			opt: &Options{
+				BazelVersion:           "6.4.0",
+				GenCPPConfigs:          true,
+				CppToolchainResolution: true,
+			},
+			want: &Summary{
+				RepoName:    "rbe_default",
+				CCToolchain: "@rbe_default//config:cc-toolchain",
+				Platform:    "@rbe_default//config:platform",
+				Aliases: map[string]string{
+					"platform":     "@rbe_default//:platform",
+					"cc_toolchain": "@rbe_default//:toolchain",
+				},
+			},
+		}, {
+			name: "Source root output with config path, legacy Java rules",
+			opt: &Options{
+				BazelVersion:     "3.7.0",
+				OutputSourceRoot: "/src",
+				OutputConfigPath: "configs/rbe",
+				GenJavaConfigs:   true,
+			},
+			want: &Summary{
+				Platform:    "//configs/rbe/config:platform",
+				JavaRuntime: "//configs/rbe/java:jdk",
+				Aliases: map[string]string{
+					"platform":     "//configs/rbe:platform",
+					"java_runtime": "//configs/rbe:jdk",
+				},
+			},
+		}, {
+			name: "Source root output at root, C++ only",
+			opt: &Options{
+				BazelVersion:     "4.0.0",
+				OutputSourceRoot: "/src",
+				GenCPPConfigs:    true,
+			},
+			want: &Summary{
+				CCToolchain:    "//config:cc-toolchain",
+				CCCrosstoolTop: "//cc:toolchain",
+				Platform:       "//config:platform",
+			},
+		}, {
+			name: "Only C++ configs",
+			opt: &Options{
+				BazelVersion:  "7.0.0",
+				GenCPPConfigs: true,
+				Only:          OnlyCC,
+			},
+			want: &Summary{
+				RepoName:    "rbe_default",
+				CCToolchain: "@rbe_default//config:cc-toolchain",
+				Platform:    "@rbe_default//config:platform",
+			},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := NewSummary(tc.opt)
+			if err != nil {
+				t.Fatalf("NewSummary() failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("NewSummary() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
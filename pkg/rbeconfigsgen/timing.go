@@ -0,0 +1,104 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the config generation stages whose durations are recorded in StageTimings.
+const (
+	// StagePull is pulling, loading or building the toolchain image.
+	StagePull = "pull"
+	// StageStart is starting the toolchain container & installing Bazel into it.
+	StageStart = "start"
+	// StageDetectCpp is generating the C++ configs inside the toolchain container.
+	StageDetectCpp = "detect_cpp"
+	// StageDetectJava is detecting the JDK installed in the toolchain container.
+	StageDetectJava = "detect_java"
+	// StageDetectRust is detecting the Rust toolchain installed in the toolchain container.
+	StageDetectRust = "detect_rust"
+	// StageDetectOS is detecting the OS distribution of the toolchain container.
+	StageDetectOS = "detect_os"
+	// StageTar is assembling the generated configs into the output tarball and/or source root.
+	StageTar = "tar"
+	// StageSimulate is building hello world targets with the generated configs in the toolchain
+	// container.
+	StageSimulate = "simulate_rbe"
+	// StagePostHook is running the post hook.
+	StagePostHook = "post_hook"
+	// StageUpload is uploading the generated configs.
+	StageUpload = "upload"
+)
+
+// StageTiming is how long a single stage took.
+type StageTiming struct {
+	// Stage is the name of the stage, e.g., StagePull.
+	Stage string `json:"stage"`
+	// Seconds is the duration of the stage in seconds.
+	Seconds float64 `json:"seconds"`
+}
+
+// StageTimings records the duration of each stage in the order the stages finished. It's safe for
+// concurrent use because detection stages run concurrently. A nil *StageTimings records nothing.
+type StageTimings struct {
+	mu     sync.Mutex
+	stages []StageTiming
+}
+
+// Time runs the given function & records how long it took as the duration of the given stage
+// regardless of whether the function failed.
+func (t *StageTimings) Time(stage string, f func() error) error {
+	if t == nil {
+		return f()
+	}
+	start := time.Now()
+	err := f()
+	t.Record(stage, time.Since(start))
+	return err
+}
+
+// Record records the given duration for the given stage.
+func (t *StageTimings) Record(stage string, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stages = append(t.stages, StageTiming{Stage: stage, Seconds: d.Seconds()})
+}
+
+// Stages returns the recorded stage durations.
+func (t *StageTimings) Stages() []StageTiming {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]StageTiming(nil), t.stages...)
+}
+
+// String returns the recorded stage durations as a single line, e.g., "pull: 42s, detect_cpp: 8s".
+func (t *StageTimings) String() string {
+	var s []string
+	for _, st := range t.Stages() {
+		d := time.Duration(st.Seconds * float64(time.Second))
+		s = append(s, fmt.Sprintf("%s: %v", st.Stage, d.Round(100*time.Millisecond)))
+	}
+	return strings.Join(s, ", ")
+}
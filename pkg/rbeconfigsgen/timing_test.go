@@ -0,0 +1,51 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStageTimings(t *testing.T) {
+	st := &StageTimings{}
+	st.Record(StagePull, 42*time.Second)
+	wantErr := errors.New("failed")
+	if err := st.Time(StageDetectCpp, func() error { return wantErr }); err != wantErr {
+		t.Errorf("Time() returned error %v, want %v", err, wantErr)
+	}
+	got := st.Stages()
+	if len(got) != 2 || got[0].Stage != StagePull || got[0].Seconds != 42 || got[1].Stage != StageDetectCpp {
+		t.Fatalf("Stages() = %v, want pull (42s) followed by detect_cpp", got)
+	}
+	if s, want := st.String(), "pull: 42s, detect_cpp: 0s"; s != want {
+		t.Errorf("String() = %q, want %q", s, want)
+	}
+}
+
+func TestNilStageTimings(t *testing.T) {
+	var st *StageTimings
+	ran := false
+	if err := st.Time(StagePull, func() error { ran = true; return nil }); err != nil {
+		t.Errorf("Time() on nil StageTimings failed: %v", err)
+	}
+	if !ran {
+		t.Errorf("Time() on nil StageTimings didn't run the stage")
+	}
+	if got := st.Stages(); got != nil {
+		t.Errorf("Stages() on nil StageTimings = %v, want nil", got)
+	}
+}
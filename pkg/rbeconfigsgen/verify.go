@@ -0,0 +1,123 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// VerifyReport is the result of verifying a configs tarball against its manifest.
+type VerifyReport struct {
+	// ExpectedDigest is the sha256 digest of the configs tarball recorded in the manifest. Blank if
+	// the manifest doesn't record one, in which case the tarball can't be verified.
+	ExpectedDigest string `json:"expected_digest"`
+	// ActualDigest is the sha256 digest of the configs tarball.
+	ActualDigest string `json:"actual_digest"`
+	// FilesFound are the files expected according to the manifest that are in the configs tarball.
+	FilesFound []string `json:"files_found"`
+	// FilesMissing are the files expected according to the manifest that aren't in the configs
+	// tarball.
+	FilesMissing []string `json:"files_missing"`
+	// Passed is true if the digests match & no expected file is missing.
+	Passed bool `json:"passed"`
+}
+
+// expectedFiles returns the files the configs tarball described by the given manifest must contain
+// relative to its tarball prefix. The C++, Java & Rust configs are expected if the manifest records
+// the corresponding toolchain & the kind of configs was written. The top-level BUILD file isn't
+// expected because configs generated before it was added don't have one.
+func expectedFiles(m *Manifest) []string {
+	writes := func(kind string) bool {
+		return len(m.Only) == 0 || m.Only == OnlyAll || m.Only == kind
+	}
+	files := []string{"LICENSE"}
+	if writes(OnlyCC) && len(m.CppCompiler) != 0 {
+		files = append(files, "cc/BUILD")
+	}
+	if writes(OnlyPlatform) {
+		files = append(files, "config/BUILD")
+	}
+	if writes(OnlyJava) && len(m.JavaVersion) != 0 {
+		files = append(files, "java/BUILD")
+	}
+	if writes(OnlyRust) && len(m.RustcVersion) != 0 {
+		files = append(files, "rust/BUILD", "rust/toolchain.bzl")
+	}
+	return files
+}
+
+// VerifyTarball verifies the configs tarball at the given path against the JSON manifest at the
+// given path, i.e., the digest of the tarball must match the one recorded in the manifest & the
+// tarball must contain the files expected according to the manifest under its tarball prefix. An
+// error is only returned if the verification couldn't be performed.
+func VerifyTarball(manifestPath, tarballPath string) (*VerifyReport, error) {
+	m, err := ManifestFromJSONFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	d, err := digestFile(tarballPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to compute the digest of the configs tarball: %w", err)
+	}
+	files := make(map[string]bool)
+	if err := walkTarball(tarballPath, m.TarballPrefix, func(name string, r io.Reader) error {
+		files[name] = true
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	r := &VerifyReport{
+		ExpectedDigest: m.ConfigsTarballDigest,
+		ActualDigest:   d,
+		FilesFound:     []string{},
+		FilesMissing:   []string{},
+	}
+	for _, f := range expectedFiles(m) {
+		if files[f] {
+			r.FilesFound = append(r.FilesFound, f)
+		} else {
+			r.FilesMissing = append(r.FilesMissing, f)
+		}
+	}
+	r.Passed = len(r.ExpectedDigest) != 0 && r.ExpectedDigest == r.ActualDigest && len(r.FilesMissing) == 0
+	return r, nil
+}
+
+// String returns a human readable report of the verification.
+func (r *VerifyReport) String() string {
+	var b strings.Builder
+	switch {
+	case len(r.ExpectedDigest) == 0:
+		fmt.Fprintf(&b, "! digest: manifest doesn't record one, got sha256:%s\n", r.ActualDigest)
+	case r.ExpectedDigest != r.ActualDigest:
+		fmt.Fprintf(&b, "! digest: want sha256:%s, got sha256:%s\n", r.ExpectedDigest, r.ActualDigest)
+	default:
+		fmt.Fprintf(&b, "  digest: sha256:%s\n", r.ActualDigest)
+	}
+	for _, f := range r.FilesFound {
+		fmt.Fprintf(&b, "  %s\n", f)
+	}
+	for _, f := range r.FilesMissing {
+		fmt.Fprintf(&b, "- %s\n", f)
+	}
+	if r.Passed {
+		b.WriteString("Verification passed.\n")
+	} else {
+		b.WriteString("Verification failed.\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,109 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExpectedFiles(t *testing.T) {
+	tests := []struct {
+		name string
+		m    *Manifest
+		want []string
+	}{
+		{
+			name: "All configs",
+			m:    &Manifest{CppCompiler: "gcc", JavaVersion: "11.0.20", RustcVersion: "1.75.0"},
+			want: []string{"LICENSE", "cc/BUILD", "config/BUILD", "java/BUILD", "rust/BUILD", "rust/toolchain.bzl"},
+		},
+		{
+			name: "No Java or Rust configs",
+			m:    &Manifest{CppCompiler: "clang"},
+			want: []string{"LICENSE", "cc/BUILD", "config/BUILD"},
+		},
+		{
+			name: "Only Java",
+			m:    &Manifest{CppCompiler: "gcc", JavaVersion: "11.0.20", Only: OnlyJava},
+			want: []string{"LICENSE", "java/BUILD"},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if got := expectedFiles(tc.m); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expectedFiles()=%q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestVerifyTarball(t *testing.T) {
+	tarPath := writeTestTarball(t, map[string]string{
+		"configs/LICENSE":      "license",
+		"configs/cc/BUILD":     "cc_toolchain()",
+		"configs/config/BUILD": "platform()",
+	})
+	digest, err := digestFile(tarPath)
+	if err != nil {
+		t.Fatalf("Unable to compute the digest of the test tarball: %v", err)
+	}
+	tests := []struct {
+		name string
+		m    *Manifest
+		want VerifyReport
+	}{
+		{
+			name: "Passed",
+			m:    &Manifest{BazelVersion: "6.4.0", ConfigsTarballDigest: digest, TarballPrefix: "configs", CppCompiler: "gcc"},
+			want: VerifyReport{ExpectedDigest: digest, ActualDigest: digest, FilesFound: []string{"LICENSE", "cc/BUILD", "config/BUILD"}, FilesMissing: []string{}, Passed: true},
+		},
+		{
+			name: "Missing Java configs",
+			m:    &Manifest{BazelVersion: "6.4.0", ConfigsTarballDigest: digest, TarballPrefix: "configs", CppCompiler: "gcc", JavaVersion: "11.0.20"},
+			want: VerifyReport{ExpectedDigest: digest, ActualDigest: digest, FilesFound: []string{"LICENSE", "cc/BUILD", "config/BUILD"}, FilesMissing: []string{"java/BUILD"}},
+		},
+		{
+			name: "Digest mismatch",
+			m:    &Manifest{BazelVersion: "6.4.0", ConfigsTarballDigest: "abc", TarballPrefix: "configs"},
+			want: VerifyReport{ExpectedDigest: "abc", ActualDigest: digest, FilesFound: []string{"LICENSE", "config/BUILD"}, FilesMissing: []string{}},
+		},
+		{
+			name: "No recorded digest",
+			m:    &Manifest{BazelVersion: "6.4.0", TarballPrefix: "configs"},
+			want: VerifyReport{ActualDigest: digest, FilesFound: []string{"LICENSE", "config/BUILD"}, FilesMissing: []string{}},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			p := filepath.Join(t.TempDir(), "manifest.json")
+			if err := tc.m.ToJSONFile(p); err != nil {
+				t.Fatalf("Unable to write manifest: %v", err)
+			}
+			got, err := VerifyTarball(p, tarPath)
+			if err != nil {
+				t.Fatalf("VerifyTarball() failed: %v", err)
+			}
+			if !reflect.DeepEqual(*got, tc.want) {
+				t.Errorf("VerifyTarball()=%+v, want %+v", *got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"runtime/debug"
+)
+
+const (
+	// develVersion is the generator version of binaries whose version is unknown, e.g., built from
+	// a local checkout without BuildVersion.
+	develVersion = "devel"
+	// modulePath is the path of the Go module of this package.
+	modulePath = "github.com/bazelbuild/bazel-toolchains"
+)
+
+// BuildVersion & BuildCommit are the release & git commit SHA of the binary generating configs.
+// They're meant to be set at build time with
+// "-ldflags '-X github.com/bazelbuild/bazel-toolchains/pkg/rbeconfigsgen.BuildVersion=<version>'"
+// & likewise for BuildCommit. The version of this module recorded in the build info of the binary
+// is used if BuildVersion is blank, e.g., for binaries installed with
+// "go install <module>@<version>" or binaries of other modules depending on this package.
+var (
+	BuildVersion string
+	BuildCommit  string
+)
+
+// GeneratorVersion returns the version of the binary generating configs recorded in the manifest,
+// e.g., "v5.1.2" or "v5.1.2+1a2b3c4" if BuildCommit is set. The version is "devel" if unknown.
+func GeneratorVersion() string {
+	return generatorVersion(BuildVersion, BuildCommit, debug.ReadBuildInfo)
+}
+
+// generatorVersion implements GeneratorVersion with the given build version & commit & the given
+// function returning the build info of the binary.
+func generatorVersion(version, commit string, readBuildInfo func() (*debug.BuildInfo, bool)) string {
+	if len(version) == 0 {
+		version = develVersion
+		if bi, ok := readBuildInfo(); ok {
+			if v := moduleVersion(bi); len(v) != 0 {
+				version = v
+			}
+		}
+	}
+	if len(commit) != 0 {
+		version += "+" + commit
+	}
+	return version
+}
+
+// moduleVersion returns the version of this module in the given build info, i.e., the version of
+// the main module if it's this module or of the dependency on this module otherwise. Returns a
+// blank string if the version is unknown.
+func moduleVersion(bi *debug.BuildInfo) string {
+	m := &bi.Main
+	if m.Path != modulePath {
+		m = nil
+		for _, d := range bi.Deps {
+			if d.Path == modulePath {
+				m = d
+				break
+			}
+		}
+	}
+	// Binaries built from a local checkout have the main module version "(devel)".
+	if m == nil || m.Version == "(devel)" {
+		return ""
+	}
+	return m.Version
+}
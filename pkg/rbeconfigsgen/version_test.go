@@ -0,0 +1,63 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"runtime/debug"
+	"testing"
+)
+
+func TestGeneratorVersion(t *testing.T) {
+	buildInfo := func(v string) func() (*debug.BuildInfo, bool) {
+		return func() (*debug.BuildInfo, bool) {
+			return &debug.BuildInfo{Main: debug.Module{Path: "github.com/bazelbuild/bazel-toolchains", Version: v}}, true
+		}
+	}
+	dependency := func(v string) func() (*debug.BuildInfo, bool) {
+		return func() (*debug.BuildInfo, bool) {
+			return &debug.BuildInfo{
+				Main: debug.Module{Path: "example.com/tool", Version: "v1.0.0"},
+				Deps: []*debug.Module{{Path: "github.com/coreos/go-semver", Version: "v0.3.0"}, {Path: "github.com/bazelbuild/bazel-toolchains", Version: v}},
+			}, true
+		}
+	}
+	noBuildInfo := func() (*debug.BuildInfo, bool) { return nil, false }
+	tests := []struct {
+		name          string
+		version       string
+		commit        string
+		readBuildInfo func() (*debug.BuildInfo, bool)
+		want          string
+	}{
+		{name: "Stamped version & commit", version: "v5.1.2", commit: "1a2b3c4", readBuildInfo: buildInfo("v5.0.0"), want: "v5.1.2+1a2b3c4"},
+		{name: "Module version", readBuildInfo: buildInfo("v5.1.2"), want: "v5.1.2"},
+		{name: "Local checkout", readBuildInfo: buildInfo("(devel)"), want: "devel"},
+		{name: "Local checkout with commit", commit: "1a2b3c4", readBuildInfo: buildInfo("(devel)"), want: "devel+1a2b3c4"},
+		{name: "Dependency version", readBuildInfo: dependency("v5.1.2"), want: "v5.1.2"},
+		{name: "Other main module without dependency", readBuildInfo: func() (*debug.BuildInfo, bool) {
+			return &debug.BuildInfo{Main: debug.Module{Path: "example.com/tool", Version: "v1.0.0"}}, true
+		}, want: "devel"},
+		{name: "No build info", readBuildInfo: noBuildInfo, want: "devel"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if got := generatorVersion(tc.version, tc.commit, tc.readBuildInfo); got != tc.want {
+				t.Errorf("generatorVersion(%q, %q)=%q, want %q", tc.version, tc.commit, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Codes of the warnings about anomalies detected in the toolchain image that don't stop configs
+// from being generated unless WarningsAsErrors is specified.
+const (
+	// WarningUnknownCompiler is reported if the C++ compiler used to generate the C++ configs
+	// couldn't be determined.
+	WarningUnknownCompiler = "unknown_compiler"
+	// WarningUnknownCompilerVersion is reported if a C++ compiler didn't report its version.
+	WarningUnknownCompilerVersion = "unknown_compiler_version"
+	// WarningUnknownLinkerVersion is reported if the version of the linker used by the C++
+	// compiler couldn't be determined.
+	WarningUnknownLinkerVersion = "unknown_linker_version"
+	// WarningUnknownSysroot is reported if the sysroot of the C++ cross compiler couldn't be
+	// determined.
+	WarningUnknownSysroot = "unknown_sysroot"
+	// WarningDuplicateIncludeDir is reported if a directory is listed more than once in the
+	// cxx_builtin_include_directories detected by Bazel.
+	WarningDuplicateIncludeDir = "duplicate_include_dir"
+	// WarningUnknownOS is reported if the OS distribution of the toolchain container couldn't be
+	// determined.
+	WarningUnknownOS = "unknown_os"
+	// WarningImageArchMismatch is reported if the architecture of the toolchain image differs from
+	// the ExecCPU.
+	WarningImageArchMismatch = "image_arch_mismatch"
+	// WarningNoCargo is reported if cargo wasn't found next to rustc.
+	WarningNoCargo = "no_cargo"
+	// WarningNoResources is reported if the resources of the toolchain container couldn't be
+	// determined with DetectResources.
+	WarningNoResources = "no_resources"
+)
+
+// Warning is an anomaly detected in the toolchain image that didn't stop configs from being
+// generated, e.g., a C++ compiler that didn't report its version.
+type Warning struct {
+	// Code identifies the kind of anomaly, e.g., WarningUnknownCompilerVersion.
+	Code string `json:"code"`
+	// Message describes the anomaly.
+	Message string `json:"message"`
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s [%s]", w.Message, w.Code)
+}
+
+// Warnings collects the warnings reported while generating configs. It's safe for concurrent use
+// because detection steps run concurrently. A nil *Warnings collects nothing.
+type Warnings struct {
+	mu   sync.Mutex
+	list []Warning
+}
+
+// add records the given warnings.
+func (ws *Warnings) add(w ...Warning) {
+	if ws == nil {
+		return
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.list = append(ws.list, w...)
+}
+
+// All returns the recorded warnings in the order they were reported.
+func (ws *Warnings) All() []Warning {
+	if ws == nil {
+		return nil
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return append([]Warning(nil), ws.list...)
+}
+
+// warnf logs a warning with the given code & the message formatted in the manner of fmt.Printf
+// & records it in the warnings of the runner.
+func (d *dockerRunner) warnf(code, format string, v ...interface{}) {
+	w := Warning{Code: code, Message: fmt.Sprintf(format, v...)}
+	d.log.Warningf("%s", w)
+	d.warnings.add(w)
+}
+
+// warningsError returns an error listing the given warnings if WarningsAsErrors was specified in
+// the given options & there are any warnings.
+func warningsError(o *Options, ws []Warning) error {
+	if !o.WarningsAsErrors || len(ws) == 0 {
+		return nil
+	}
+	var msgs []string
+	for _, w := range ws {
+		msgs = append(msgs, w.String())
+	}
+	return fmt.Errorf("%w: %s", ErrWarnings, strings.Join(msgs, "; "))
+}
+
+// checkCxxBuiltinIncludeDirs warns about the directories listed more than once in the
+// cxx_builtin_include_directories of the C++ configs tarball at the given path.
+func checkCxxBuiltinIncludeDirs(d *dockerRunner, tarPath string) error {
+	build, err := readCppBuild(tarPath)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]int)
+	for _, dir := range quotedStrs(cxxBuiltinIncludeDirsRegexp, build) {
+		c := path.Clean(dir)
+		if seen[c]++; seen[c] == 2 {
+			d.warnf(WarningDuplicateIncludeDir, "Builtin include directory %q is listed more than once in the cxx_builtin_include_directories detected by Bazel.", dir)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckCxxBuiltinIncludeDirs(t *testing.T) {
+	tests := []struct {
+		name  string
+		build string
+		want  []string
+	}{
+		{
+			name:  "No duplicates",
+			build: testCppBuild,
+		},
+		{
+			name: "Duplicates",
+			build: `cc_toolchain_config(
+    name = "local",
+    cxx_builtin_include_directories = ["/usr/include",
+    "/usr/local/include",
+    "/usr/include/",
+    "/usr/local/include",
+    "/usr/include"],
+)
+`,
+			want: []string{`"/usr/include/"`, `"/usr/local/include"`},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			d := &dockerRunner{warnings: &Warnings{}}
+			tarPath := writeTestTarball(t, map[string]string{cppBuildFile: tc.build})
+			if err := checkCxxBuiltinIncludeDirs(d, tarPath); err != nil {
+				t.Fatalf("checkCxxBuiltinIncludeDirs() failed: %v", err)
+			}
+			ws := d.warnings.All()
+			if len(ws) != len(tc.want) {
+				t.Fatalf("checkCxxBuiltinIncludeDirs() reported warnings %v, want %d warnings", ws, len(tc.want))
+			}
+			for i, w := range ws {
+				if w.Code != WarningDuplicateIncludeDir || !strings.Contains(w.Message, tc.want[i]) {
+					t.Errorf("checkCxxBuiltinIncludeDirs() reported warning %v, want a %s warning about %s", w, WarningDuplicateIncludeDir, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestWarningsError(t *testing.T) {
+	ws := []Warning{
+		{Code: WarningUnknownCompilerVersion, Message: "no version"},
+		{Code: WarningNoCargo, Message: "no cargo"},
+	}
+	if err := warningsError(&Options{}, ws); err != nil {
+		t.Errorf("warningsError() without WarningsAsErrors = %v, want nil", err)
+	}
+	if err := warningsError(&Options{WarningsAsErrors: true}, nil); err != nil {
+		t.Errorf("warningsError() without warnings = %v, want nil", err)
+	}
+	err := warningsError(&Options{WarningsAsErrors: true}, ws)
+	if !errors.Is(err, ErrWarnings) {
+		t.Fatalf("warningsError() = %v, want an error matching ErrWarnings", err)
+	}
+	if want := "no version [unknown_compiler_version]; no cargo [no_cargo]"; !strings.HasSuffix(err.Error(), want) {
+		t.Errorf("warningsError() = %q, want it to list the warnings %q", err, want)
+	}
+}
+
+func TestNilWarnings(t *testing.T) {
+	var ws *Warnings
+	ws.add(Warning{Code: WarningUnknownOS})
+	if got := ws.All(); !reflect.DeepEqual(got, []Warning(nil)) {
+		t.Errorf("All() of nil Warnings = %v, want nil", got)
+	}
+}
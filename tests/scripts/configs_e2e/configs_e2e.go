@@ -17,13 +17,17 @@
 // 1. Take the URL to the toolchain configs tarball & manifest JSON generated by rbe_configs_gen and
 //    uploaded by rbe_configs_upload to GCS.
 // 2. Copying the example C++ & Java hello world examples from
-//    //examples/remotebuildexecution/hello_world in github.com/bazelbuild/bazel-toolchains and
+//    //examples/remotebuildexecution/hello_world in github.com/bazelbuild/bazel-toolchains (or the
+//    files listed in the file specified to --copy_manifest) and
 //    generating Bazel WORKSPACE & .bazelrc files configured to run a remote build using the
 //    toolchain configs available at the URLs from (1). This tool accepts a path to the
 //    root directory of the bazel-toolchains repo cloned locally.
 // 3. This tool also takes the path to an output directory where the test repository will be
-//    created and a Bazel remote build will be run. Existing contents of this directory will be
-//    deleted before the test files are created.
+//    created and a Bazel remote build will be run. The directory must be empty unless --force is
+//    specified in which case its existing contents are deleted before the test files are created.
+// With --compare_remote, this tool instead compares the configs from (1) with freshly generated
+// configs & exits with a distinct status depending on whether they differ so that uploading
+// configs that didn't change can be skipped.
 package main
 
 import (
@@ -34,32 +38,81 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
 	"strings"
 	"text/template"
 	"time"
 
+	"github.com/bazelbuild/bazel-toolchains/pkg/logging"
 	"github.com/bazelbuild/bazel-toolchains/pkg/monitoring"
 	"github.com/bazelbuild/bazel-toolchains/pkg/rbeconfigsgen"
 )
 
 var (
 	manifestURL           = flag.String("manifest_url", "", "Public URL to the JSON manifest uploaded to GCS by rbe_configs_upload.")
-	configsURL            = flag.String("configs_url", "", "Public URL to the configs tarball uploaded to GCS by rbe_configs_upload.")
+	configsURL            = flag.String("configs_url", "", "(Optional) Public URL to the configs tarball uploaded to GCS by rbe_configs_upload. Defaults to the configs_tarball_url recorded in the manifest at --manifest_url by rbe_configs_upload --set_tarball_url.")
 	srcRoot               = flag.String("src_root", "", "Path to root directory of the bazel-toolchains Github repo.")
 	destRoot              = flag.String("dest_root", "", "Path to an empty or non-existent output directory where the Bazel Hello world repo will be set up & a Bazel build will be executed.")
-	rbeInstance           = flag.String("rbe_instance", "", "Name of the RBE instance to test the configs on in the format projects/<GCP project ID>/instances/<RBE Instance ID>.")
+	force                 = flag.Bool("force", false, "(Optional) Delete the existing contents of a non-empty --dest_root before setting up the test repository. The filesystem root, the home & current directories, their parents & --src_root are never deleted. Defaults to false.")
+	dryRun                = flag.Bool("dry_run", false, "(Optional) List the existing contents of --dest_root that would be deleted with --force & exit without running the test. Defaults to false.")
+	rbeInstance           = flag.String("rbe_instance", "", "Name of the RBE instance to test the configs on. Must be in the format projects/<GCP project ID>/instances/<RBE Instance ID> when --rbe_backend=googleapis. Optional for other backends.")
+	rbeBackendName        = flag.String("rbe_backend", "googleapis", "(Optional) Remote execution backend preset (googleapis|buildbuddy|buildbarn|custom) the test build will run on. Defaults to googleapis.")
+	remoteExecutor        = flag.String("remote_executor", "", "(Optional) grpc:// or grpcs:// endpoint of the remote execution service overriding the endpoint of the --rbe_backend preset. Required if --rbe_backend is buildbarn or custom.")
+	workspaceTemplateFile = flag.String("workspace_template", "", "(Optional) Path to a Go text/template used to generate the WORKSPACE file of the test repository instead of the built-in one, e.g., to add mirror URLs or auth to the http_archive of the configs. See workspaceData in this binary for the available fields: ConfigsTarballURL, ConfigsTarballDigest, RepoName, StripPrefix, TarballFormat & AuthHost.")
+	workspaceAuth         = flag.String("workspace_auth", workspaceAuthNone, "(Optional) How Bazel authenticates downloading the configs tarball imported in the WORKSPACE file, one of none or netrc. With netrc, the http_archive notes that the credentials of the host of --configs_url must be in ~/.netrc or provided by --credential_helper. Defaults to none.")
+	copyManifest          = flag.String("copy_manifest", "", "(Optional) Path to a JSON list or a text file with one path per line of the files relative to --src_root to copy into the test repository. Blank lines & lines starting with '#' are ignored in text files. Defaults to the C++ & Java Hello World examples.")
+	registryCACert        = flag.String("registry_ca_cert", "", "(Optional) Path to a file with PEM encoded CA certificates to trust in addition to the system trust store when downloading the manifest, configs tarball & Bazelisk.")
+	httpTimeoutSeconds    = flag.Int("http_timeout_seconds", 300, "(Optional) Number of seconds each download of the manifest, configs tarball & Bazelisk may take, including reading the response. 0 disables the timeout. Defaults to 300.")
+	strict                = flag.Bool("strict", false, "(Optional) Fail if the downloaded manifest has a newer schema version than this binary understands instead of logging a warning. Unknown fields are ignored either way. Defaults to false.")
+	httpRetries           = flag.Int("http_retries", 3, "(Optional) Number of times a failed download of the manifest or the configs tarball is retried with exponential backoff on network errors & 5xx responses. Defaults to 3.")
+	httpUserAgent         = flag.String("http_user_agent", "", "(Optional) User-Agent of the requests downloading the manifest, configs tarball & Bazelisk. Defaults to rbe_configs_gen/<version>.")
+	insecureRegistry      = flag.Bool("insecure_registry", false, "(Optional) Skip TLS certificate verification when downloading the manifest, configs tarball & Bazelisk. Only use this with development servers. Defaults to false.")
+	bazeliskPath          = flag.String("bazelisk_path", "", "(Optional) Path to a Bazelisk executable to use instead of downloading Bazelisk, e.g., in offline environments.")
+	bazeliskVersion       = flag.String("bazelisk_version", "", "(Optional) Release of Bazelisk to download, e.g., v1.19.0, to keep the test reproducible across Bazelisk releases. Can't be used with --bazelisk_path. Defaults to the Bazelisk release rbe_configs_gen installs in the toolchain container.")
+	bazeliskSHA256        = flag.String("bazelisk_sha256", "", "(Optional) Expected sha256 digest of the Bazelisk executable, i.e., of the release chosen by --bazelisk_version for the OS & CPU architecture this test runs on or of the executable at --bazelisk_path. The test fails before running Bazelisk if the digest doesn't match. Defaults to the digest of the downloaded release known to rbe_configs_gen. Required to download a release whose digest isn't known. The executable at --bazelisk_path is only verified if specified.")
+	compareRemote         = flag.Bool("compare_remote", false, "(Optional) Instead of running a test build, compare the configs published at --manifest_url & --configs_url with the freshly generated configs at --new_manifest & --new_tarball, e.g., to skip uploading configs that didn't change. Exits with status 0 if they're identical or 3 if they differ. The digest of the configs tarball isn't compared because it changes with the mod times of the files in the tarball. Defaults to false.")
+	newManifest           = flag.String("new_manifest", "", "Path to the JSON manifest of the freshly generated configs. Required if --compare_remote is true.")
+	newTarball            = flag.String("new_tarball", "", "Path to the freshly generated configs tarball. Required if --compare_remote is true.")
+	extraStartupFlags     = stringList("extra_startup_flag", "(Optional, repeatable) Bazel startup flag, e.g., --host_jvm_args=-Xmx4g, passed before the command to every Bazel invocation of the test build.")
+	extraBuildFlags       = stringList("extra_build_flag", "(Optional, repeatable) Bazel flag, e.g., --experimental_remote_downloader=grpcs://downloader.example.com or --remote_cache=grpcs://cache.example.com, appended to the flags of the test build after --config=remote so it takes precedence over the generated .bazelrc.")
+	buildTargets          = flag.String("build_targets", "//examples/...", "(Optional) Comma separated Bazel target patterns built remotely by the test build in addition to //:license_exists_test, e.g., smoke targets added with --copy_manifest. Defaults to //examples/....")
+	testTargets           = flag.String("test_targets", "", "(Optional) Comma separated Bazel target patterns tested remotely with bazel test after the build succeeds to verify test execution with the configs, e.g., //examples/.... No tests are run if unspecified.")
+	testCacheBehavior     = flag.Bool("test_cache_behavior", false, "(Optional) Repeat the test build after a clean & fail unless every action is served from the remote cache. Defaults to false.")
 	timeoutSeconds        = flag.Int("timeout_seconds", 0, "Number of seconds before the Bazel build run in the test is killed and a timeout failure is declared.")
+	logLevel              = flag.String("log_level", "info", "(Optional) Minimum level (debug|info|warn|error) of log messages to print. Defaults to info.")
+	quiet                 = flag.Bool("quiet", false, "(Optional) Only print warnings & errors. Overrides --log_level.")
 	enableMonitoring      = flag.Bool("enable_monitoring", false, "(Optional) Enables reporting reporting results to Google Cloud Monitoring. Defaults to false.")
 	monitoringProjectID   = flag.String("monitoring_project_id", "", "GCP Project ID where monitoring results will be reported. Required if --enable_monitoring is true.")
 	monitoringDockerImage = flag.String("monitoring_docker_image", "", "Name of the toolchain docker image to be reported as a string label to monitoring. Required if --enable_monitoring is true.")
 
-	// filesToCopy are the files that'll be copied from srcRoot to destRoot.
-	filesToCopy = []string{
+	// rbeBackends are the remote execution backend presets accepted by --rbe_backend.
+	rbeBackends = map[string]rbeBackend{
+		"googleapis": {
+			executor:          "grpcs://remotebuildexecution.googleapis.com",
+			googleCredentials: true,
+			requireInstance:   true,
+			validateInstance:  validateRBEInstName,
+		},
+		"buildbuddy": {
+			executor: "grpcs://remote.buildbuddy.io",
+		},
+		// Buildbarn & custom backends are always self-hosted so there's no default endpoint.
+		"buildbarn": {},
+		"custom":    {},
+	}
+
+	// defaultFilesToCopy are the files that'll be copied from srcRoot to destRoot unless
+	// --copy_manifest is specified.
+	defaultFilesToCopy = []string{
 		// C++ Hello World example.
 		"examples/remotebuildexecution/hello_world/cc/BUILD",
 		"examples/remotebuildexecution/hello_world/cc/hello_world.cc",
@@ -72,14 +125,28 @@ var (
 		"examples/remotebuildexecution/hello_world/java/HelloWorld.java",
 	}
 
-	// workspaceTemplate is the template to create the Bazel WORKSPACE file in the test repo.
-	workspaceTemplate = template.Must(template.New("WORKSPACE").Parse(`
-load("@bazel_tools//tools/build_defs/repo:http.bzl", "http_archive")
+	// processSummaryRegexp matches the summary of the processes run by a Bazel build, e.g.,
+	// "INFO: 12 processes: 5 remote cache hit, 7 internal." & captures the list of process counts.
+	processSummaryRegexp = regexp.MustCompile(`INFO: [0-9]+ process(?:es)?: (.*)\.`)
+
+	// sha256Regexp matches hex encoded sha256 digests.
+	sha256Regexp = regexp.MustCompile(`^[a-f0-9]{64}$`)
 
+	// defaultWorkspaceTemplate is the template to create the Bazel WORKSPACE file in the test repo
+	// unless --workspace_template is specified.
+	defaultWorkspaceTemplate = template.Must(template.New("WORKSPACE").Parse(`
+load("@bazel_tools//tools/build_defs/repo:http.bzl", "http_archive")
+{{ if .AuthHost }}
+# The configs tarball is served by an authenticated artifact store. Bazel's downloader sends the
+# credentials of "machine {{ .AuthHost }}" in ~/.netrc (or the file in $NETRC) or the headers
+# returned for {{ .AuthHost }} by the --credential_helper. The download fails with HTTP 401 or 403
+# without them.{{ end }}
 http_archive(
-    name = "rbe_default",
+    name = "{{ .RepoName }}",
     urls = ["{{ .ConfigsTarballURL }}"],
-    sha256 = "{{ .ConfigsTarballDigest }}",
+    sha256 = "{{ .ConfigsTarballDigest }}",{{ if .StripPrefix }}
+    strip_prefix = "{{ .StripPrefix }}",{{ end }}{{ if .TarballFormat }}
+    type = "{{ .TarballFormat }}",{{ end }}
 	build_file_content="""
 exports_files(["LICENSE"])
 """
@@ -88,51 +155,270 @@ exports_files(["LICENSE"])
 `))
 )
 
-// downloadManifest downloads the JSON manifest generated by rbeconfigsgen from the given URL. We
-// ignore any fields added by rbe_configs_upload when it uploaded the manifest to GCS because they
-// don't serve any functional purpose.
-func downloadManifest(u string) (*rbeconfigsgen.Manifest, error) {
-	resp, err := http.Get(u)
+const (
+	// workspaceAuthNone imports the configs tarball without authentication.
+	workspaceAuthNone = "none"
+	// workspaceAuthNetrc imports the configs tarball with the credentials Bazel's downloader reads
+	// from .netrc or gets from a credential helper.
+	workspaceAuthNetrc = "netrc"
+)
+
+const (
+	// compareIdenticalExitCode is the exit status with --compare_remote if the published &
+	// the freshly generated configs are identical.
+	compareIdenticalExitCode = 0
+	// compareDifferentExitCode is the exit status with --compare_remote if the published & the
+	// freshly generated configs differ. Distinct from the exit status of other failures.
+	compareDifferentExitCode = 3
+)
+
+// stringListFlag is a flag.Value accumulating the values of a flag that can be repeated.
+type stringListFlag []string
+
+func (s *stringListFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringListFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// stringList defines a repeatable string flag with the given name & usage.
+func stringList(name, usage string) *stringListFlag {
+	s := &stringListFlag{}
+	flag.Var(s, name, usage)
+	return s
+}
+
+// rbeBackend describes how the test build connects to a remote execution backend.
+type rbeBackend struct {
+	// executor is the grpc:// or grpcs:// endpoint of the remote execution service.
+	executor string
+	// googleCredentials determines whether Bazel authenticates to the backend using Google
+	// application default credentials.
+	googleCredentials bool
+	// instance is the remote instance name. Bazel's --remote_instance_name isn't set if blank.
+	instance string
+	// requireInstance determines whether the backend requires a remote instance name.
+	requireInstance bool
+	// validateInstance validates the remote instance name if one was specified. Any instance name
+	// that isn't blank is accepted if unset.
+	validateInstance func(instName string) error
+}
+
+// bodyReader records errors reading the body of a HTTP response to tell network errors apart
+// from errors processing the downloaded contents.
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// downloadOnce sends a HTTP GET request for the given URL using the given HTTP client & passes
+// the body of the response to the given function. Returns whether a failure is worth retrying,
+// i.e., it was caused by a network error or a 5xx response.
+func downloadOnce(c *http.Client, u string, f func(body io.Reader) error) (bool, error) {
+	resp, err := c.Get(u)
 	if err != nil {
-		return nil, fmt.Errorf("unable to create a HTTP GET request to download the config manifest from %q: %w", u, err)
+		return true, fmt.Errorf("HTTP GET request failed: %w", err)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode >= 500, fmt.Errorf("got HTTP status %q", resp.Status)
+	}
+	b := &bodyReader{r: resp.Body}
+	if err := f(b); err != nil {
+		return b.err != nil, err
+	}
+	return false, nil
+}
 
-	result := &rbeconfigsgen.Manifest{}
-	um := json.NewDecoder(resp.Body)
-	if err := um.Decode(result); err != nil {
-		return nil, fmt.Errorf("failed to download/parse the manifest from %q: %w", u, err)
+// download downloads the given URL using the given HTTP client & passes the body of the response
+// to the given function. Network errors, including errors while the body is read, & 5xx responses
+// are retried the given number of times with exponential backoff. The function is called from
+// scratch for every attempt so the body is streamed instead of buffered.
+func download(c *http.Client, u string, retries int, f func(body io.Reader) error) error {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		retry, err := downloadOnce(c, u, f)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt > retries {
+			return fmt.Errorf("download of %q failed after %d attempt(s): %w", u, attempt, err)
+		}
+		logging.Warningf("Attempt %d to download %q failed, retrying in %v: %v", attempt, u, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
 	}
-	if len(result.BazelVersion) == 0 {
-		return nil, fmt.Errorf("manifest downloaded from %q did not specify a Bazel version", u)
+}
+
+// downloadManifest downloads the JSON manifest generated by rbeconfigsgen from the given URL using
+// the given HTTP client, retrying failed downloads the given number of times. We ignore any fields
+// added by rbe_configs_upload when it uploaded the manifest to GCS because they don't serve any
+// functional purpose. If strict is true, a manifest with a newer schema version than
+// rbeconfigsgen.ManifestSchemaVersion is an error.
+func downloadManifest(c *http.Client, u string, retries int, strict bool) (*rbeconfigsgen.Manifest, error) {
+	parse := rbeconfigsgen.ParseManifest
+	if strict {
+		parse = rbeconfigsgen.ParseManifestStrict
 	}
-	if len(result.ConfigsTarballDigest) == 0 {
-		return nil, fmt.Errorf("manifest downloaded from %q did not specify a configs tarball digest", u)
+	var result *rbeconfigsgen.Manifest
+	if err := download(c, u, retries, func(body io.Reader) error {
+		m, err := parse(body)
+		if err != nil {
+			return err
+		}
+		result = m
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to download/parse the manifest from %q: %w", u, err)
 	}
 	return result, nil
 }
 
-// verifyConfigSHA verifies the sha256 digest of the config tarball in the downloaded manifest
-// matches the digest of the configs tarball uploaded to the given URL. This function doesn't check
-// if the uploaded configs is a valid tarball.
-func verifyConfigSHA(m *rbeconfigsgen.Manifest, u string) error {
-	resp, err := http.Get(u)
-	if err != nil {
-		return fmt.Errorf("unable to create a HTTP GET request to download the configs tarball from %q: %w", u, err)
+// configsTarballURL returns the given URL of the configs tarball or the ConfigsTarballURL recorded
+// in the given manifest if the URL is blank.
+func configsTarballURL(m *rbeconfigsgen.Manifest, u string) (string, error) {
+	if len(u) != 0 {
+		return u, nil
 	}
-	defer resp.Body.Close()
+	if len(m.ConfigsTarballURL) == 0 {
+		return "", fmt.Errorf("--configs_url wasn't specified & the manifest doesn't record the configs_tarball_url")
+	}
+	return m.ConfigsTarballURL, nil
+}
 
-	h := sha256.New()
-	if _, err := io.Copy(h, resp.Body); err != nil {
+// verifyConfigSHA verifies the sha256 digest of the config tarball in the downloaded manifest
+// matches the digest of the configs tarball uploaded to the given URL. This function doesn't check
+// if the uploaded configs is a valid tarball. The configs tarball is downloaded using the given HTTP
+// client & hashed while it's downloaded, retrying failed downloads the given number of times.
+func verifyConfigSHA(c *http.Client, m *rbeconfigsgen.Manifest, u string, retries int) error {
+	var d string
+	if err := download(c, u, retries, func(body io.Reader) error {
+		h := sha256.New()
+		if _, err := io.Copy(h, body); err != nil {
+			return err
+		}
+		d = hex.EncodeToString(h.Sum(nil))
+		return nil
+	}); err != nil {
 		return fmt.Errorf("error while downloading & hashing the contents of the configs tarball from %q: %w", u, err)
 	}
-	d := hex.EncodeToString(h.Sum(nil))
 	if d != m.ConfigsTarballDigest {
 		return fmt.Errorf("digest %s for configs tarball specified in downloaded manifest did not match digest %s computed by actually downloading the contents of configs tarball at %s", m.ConfigsTarballDigest, d, u)
 	}
 	return nil
 }
 
+// saveConfigsTarball downloads the configs tarball from the given URL to the given path using the
+// given HTTP client, retrying failed downloads the given number of times, & verifies its sha256
+// digest matches the digest of the configs tarball in the given manifest.
+func saveConfigsTarball(c *http.Client, m *rbeconfigsgen.Manifest, u string, retries int, dst string) error {
+	var d string
+	if err := download(c, u, retries, func(body io.Reader) error {
+		f, err := os.Create(dst)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(f, h), body); err != nil {
+			return err
+		}
+		d = hex.EncodeToString(h.Sum(nil))
+		return f.Close()
+	}); err != nil {
+		return fmt.Errorf("error while downloading the configs tarball from %q to %q: %w", u, dst, err)
+	}
+	if d != m.ConfigsTarballDigest {
+		return fmt.Errorf("digest %s for configs tarball specified in downloaded manifest did not match digest %s of the configs tarball downloaded from %s", m.ConfigsTarballDigest, d, u)
+	}
+	return nil
+}
+
+// diffPublishedConfigs returns the differences between the configs published at the given manifest &
+// configs tarball URLs & the configs described by the local manifest & tarball at the given paths.
+// The configs tarball URL may be blank to use the one recorded in the published manifest.
+// The published configs are downloaded into the given directory using the given HTTP client,
+// retrying failed downloads the given number of times. The published manifest is parsed strictly
+// if strict is true. The digests of the configs tarballs aren't compared because they change
+// whenever the configs are regenerated. The files in the tarballs are compared instead.
+func diffPublishedConfigs(c *http.Client, manifestURL, configsURL string, retries int, strict bool, newManifest, newTarball, dir string) (*rbeconfigsgen.ConfigsDiff, error) {
+	m, err := downloadManifest(c, manifestURL, retries, strict)
+	if err != nil {
+		return nil, err
+	}
+	if configsURL, err = configsTarballURL(m, configsURL); err != nil {
+		return nil, err
+	}
+	tarball := filepath.Join(dir, "published_configs")
+	if err := saveConfigsTarball(c, m, configsURL, retries, tarball); err != nil {
+		return nil, err
+	}
+	o, err := rbeconfigsgen.NewConfigSet(m, tarball)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load the published configs: %w", err)
+	}
+	n, err := rbeconfigsgen.LoadConfigSet(newManifest, newTarball)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load the new configs: %w", err)
+	}
+	d := rbeconfigsgen.Diff(o, n)
+	var fields []rbeconfigsgen.FieldChange
+	for _, f := range d.ChangedFields {
+		if f.Name != "configs_tarball_digest" {
+			fields = append(fields, f)
+		}
+	}
+	d.ChangedFields = fields
+	return d, nil
+}
+
+// runCompareRemote implements --compare_remote & returns the exit status of this binary.
+func runCompareRemote() int {
+	if len(*newManifest) == 0 {
+		log.Fatalf("--new_manifest is required because --compare_remote is true.")
+	}
+	if len(*newTarball) == 0 {
+		log.Fatalf("--new_tarball is required because --compare_remote is true.")
+	}
+	c, err := rbeconfigsgen.NewHTTPClient(*registryCACert, *insecureRegistry, *httpUserAgent)
+	if err != nil {
+		log.Fatalf("Unable to initialize the HTTP client for downloads: %v", err)
+	}
+	c.Timeout = time.Duration(*httpTimeoutSeconds) * time.Second
+	dir, err := ioutil.TempDir("", "configs_e2e_compare")
+	if err != nil {
+		log.Fatalf("Unable to create a temporary directory for the published configs: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := diffPublishedConfigs(c, *manifestURL, *configsURL, *httpRetries, *strict, *newManifest, *newTarball, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		log.Fatalf("Unable to compare the published configs with the new configs: %v", err)
+	}
+	fmt.Print(d.String())
+	published := *configsURL
+	if len(published) == 0 {
+		published = *manifestURL
+	}
+	if d.Empty() {
+		logging.Infof("The configs published at %s are identical to the new configs.", published)
+		return compareIdenticalExitCode
+	}
+	logging.Infof("The configs published at %s differ from the new configs.", published)
+	return compareDifferentExitCode
+}
+
 // copyFile copies regular files from 'src' to 'dst' creating directories if necessary.
 func copyFile(dst, src string) error {
 	dir := path.Dir(dst)
@@ -157,29 +443,93 @@ func copyFile(dst, src string) error {
 	return nil
 }
 
-func createWorkspaceFile(m *rbeconfigsgen.Manifest, configTarballURL string, outputDir string) error {
+// manifestRepoName returns the name of the external repository the configs described by the given
+// manifest are expected to be imported as.
+func manifestRepoName(m *rbeconfigsgen.Manifest) string {
+	if len(m.RepoName) == 0 {
+		return rbeconfigsgen.DefaultRepoName
+	}
+	return m.RepoName
+}
+
+// workspaceData are the fields available to the template generating the WORKSPACE file of the test
+// repo.
+type workspaceData struct {
+	// RepoName is the name of the external repository the configs must be imported as.
+	RepoName string
+	// ConfigsTarballURL is the URL of the configs tarball, i.e., --configs_url.
+	ConfigsTarballURL string
+	// ConfigsTarballDigest is the sha256 digest of the configs tarball from the manifest.
+	ConfigsTarballDigest string
+	// StripPrefix is the directory inside the configs tarball containing the configs. Blank if
+	// the configs are at the root of the tarball.
+	StripPrefix string
+	// TarballFormat is how the configs tarball is compressed, e.g., "tar.zst". Blank if the
+	// manifest didn't record it.
+	TarballFormat string
+	// AuthHost is the host of ConfigsTarballURL Bazel must send credentials to with
+	// --workspace_auth=netrc. Blank if the configs tarball is downloaded without authentication.
+	AuthHost string
+}
+
+// loadWorkspaceTemplate returns the template at the given path used to generate the WORKSPACE file
+// of the test repo or the default template if the path is blank. A template that fails to parse
+// or references fields other than those of workspaceData is an error.
+func loadWorkspaceTemplate(p string) (*template.Template, error) {
+	if len(p) == 0 {
+		return defaultWorkspaceTemplate, nil
+	}
+	blob, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the WORKSPACE template: %w", err)
+	}
+	t, err := template.New(filepath.Base(p)).Parse(string(blob))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the WORKSPACE template %q: %w", p, err)
+	}
+	// Unknown fields are only detected when the template is executed.
+	if err := t.Execute(ioutil.Discard, &workspaceData{}); err != nil {
+		return nil, fmt.Errorf("invalid WORKSPACE template %q: %w", p, err)
+	}
+	return t, nil
+}
+
+// createWorkspaceFile generates the WORKSPACE file in the given output directory using the given
+// template to import the configs tarball at the given URL described by the given manifest with the
+// given authentication, i.e., workspaceAuthNone or workspaceAuthNetrc.
+func createWorkspaceFile(m *rbeconfigsgen.Manifest, configTarballURL string, outputDir string, t *template.Template, auth string) error {
+	var authHost string
+	if auth == workspaceAuthNetrc {
+		u, err := url.Parse(configTarballURL)
+		if err != nil || len(u.Host) == 0 {
+			return fmt.Errorf("unable to determine the host to authenticate to from the configs tarball URL %q: %v", configTarballURL, err)
+		}
+		authHost = u.Hostname()
+	}
 	o, err := os.Create(path.Join(outputDir, "WORKSPACE"))
 	if err != nil {
 		return fmt.Errorf("unable to create WORKSPACE file in %q: %w", outputDir, err)
 	}
 	defer o.Close()
-	data := struct {
-		ConfigsTarballURL    string
-		ConfigsTarballDigest string
-	}{
+	data := workspaceData{
+		RepoName:             manifestRepoName(m),
 		ConfigsTarballURL:    configTarballURL,
 		ConfigsTarballDigest: m.ConfigsTarballDigest,
+		StripPrefix:          m.TarballPrefix,
+		TarballFormat:        m.TarballFormat,
+		AuthHost:             authHost,
 	}
-	if err := workspaceTemplate.Execute(o, &data); err != nil {
+	if err := t.Execute(o, &data); err != nil {
 		return fmt.Errorf("error writing Bazel WORKSPACE file in %q: %w", outputDir, err)
 	}
-	log.Printf("Generated WORKSPACE file in %q.", outputDir)
+	logging.Infof("Generated WORKSPACE file in %q.", outputDir)
 	return nil
 }
 
 // createBUILDFile creates a top level BUILD file with a file test to ensure the uploaded configs
-// included a LICENSE file.
-func createBUILDFile(outputDir string) error {
+// included a LICENSE file. repoName is the name of the external repository the configs were
+// imported as.
+func createBUILDFile(outputDir, repoName string) error {
 	o, err := os.Create(path.Join(outputDir, "BUILD"))
 	if err != nil {
 		return fmt.Errorf("unable to create BUILD file in %q: %w", outputDir, err)
@@ -190,78 +540,78 @@ load("@bazel_tools//tools/build_rules:test_rules.bzl", "file_test")
 
 file_test(
 	name = "license_exists_test",
-	file = "@rbe_default//:LICENSE",
+	file = "@%s//:LICENSE",
 	regexp = "Apache License",
 )
-`); err != nil {
+`, repoName); err != nil {
 		return fmt.Errorf("unable to write BUILD file in %q: %w", outputDir, err)
 	}
 	return nil
 }
 
-func createBazelrcFile(m *rbeconfigsgen.Manifest, configTarballURL, outputDir, rbeInst string) error {
-	o, err := os.Create(path.Join(outputDir, ".bazelrc"))
+// createBazelrcFile writes the .bazelrc configuring the test build to use the configs described by
+// the given manifest on the given backend to the given directory.
+func createBazelrcFile(m *rbeconfigsgen.Manifest, configTarballURL, outputDir string, b rbeBackend) error {
+	bazelrc, err := rbeconfigsgen.GenerateBazelrc(m, rbeconfigsgen.BazelrcOptions{
+		ConfigsURL:        configTarballURL,
+		RemoteExecutor:    b.executor,
+		RemoteInstance:    b.instance,
+		GoogleCredentials: b.googleCredentials,
+	})
 	if err != nil {
-		return fmt.Errorf("unable to open .bazelrc file for writing in %q: %w", outputDir, err)
+		return fmt.Errorf("unable to generate the .bazelrc file: %w", err)
 	}
-	defer o.Close()
-
-	fmt.Fprintf(o, `
-# .bazelrc generated for:
-#   Bazel %s
-#   Toolchain Container %s (sha256:%s)
-#   Configs Tarball URL %s (sha256:%s)
-`, m.BazelVersion, m.ToolchainContainer, m.ImageDigest, configTarballURL, m.ConfigsTarballDigest)
-	fmt.Fprintf(o, "\nbuild:remote --remote_instance_name=%s\n", rbeInst)
-	fmt.Fprint(o, `
-build:remote --jobs=6
-build:remote --define=EXECUTOR=remote
-build:remote --remote_executor=grpcs://remotebuildexecution.googleapis.com
-
-# Enforce stricter environment rules, which eliminates some non-hermetic
-# behavior and therefore improves both the remote cache hit rate and the
-# correctness and repeatability of the build.
-build:remote --incompatible_strict_action_env=true
-
-build:remote --remote_timeout=3600
-
-# Enable authentication. This will pick up application default credentials by
-# default. You can use --google_credentials=some_file.json to use a service
-# account credential instead.
-build:remote --google_default_credentials=true
-
-# C++ toolchain & default platform configuration.
-build:remote --crosstool_top=@rbe_default//cc:toolchain
-build:remote --action_env=BAZEL_DO_NOT_DETECT_CPP_TOOLCHAIN=1
-build:remote --extra_toolchains=@rbe_default//config:cc-toolchain
-build:remote --extra_execution_platforms=@rbe_default//config:platform
-build:remote --host_platform=@rbe_default//config:platform
-build:remote --platforms=@rbe_default//config:platform
-`)
-	// The Java toolchain rules used by Bazel are expected to change in a certain Bazel version
-	// that affects the bazelrc file.
-	u, err := rbeconfigsgen.UsesLocalJavaRuntime(m.BazelVersion)
-	if err != nil {
-		return fmt.Errorf("unable to determine type of Java toolchain rules used by Bazel %q: %w", m.BazelVersion, err)
-	}
-	if u {
-		fmt.Fprint(o, `
-build:remote --java_runtime_version=rbe_jdk
-build:remote --tool_java_runtime_version=rbe_jdk
-build:remote --extra_toolchains=@rbe_default//java:all
-`)
-	} else {
-		fmt.Fprint(o, `
-build:remote --host_javabase=@rbe_default//java:jdk
-build:remote --javabase=@rbe_default//java:jdk
-build:remote --host_java_toolchain=@bazel_tools//tools/jdk:toolchain_hostjdk8
-build:remote --java_toolchain=@bazel_tools//tools/jdk:toolchain_hostjdk8
-`)
-	}
-	log.Printf("Generated .bazelrc file in %q.", outputDir)
+	if err := ioutil.WriteFile(path.Join(outputDir, ".bazelrc"), []byte(bazelrc), os.ModePerm); err != nil {
+		return fmt.Errorf("unable to write .bazelrc file in %q: %w", outputDir, err)
+	}
+	logging.Infof("Generated .bazelrc file in %q.", outputDir)
 	return nil
 }
 
+// loadFilesToCopy returns the paths relative to the given source directory of the files to be
+// copied into the test repository as listed in the given copy manifest file. The default set of
+// files is returned if the copy manifest path is blank. Every listed file must exist in the source
+// directory.
+func loadFilesToCopy(manifestPath, srcDir string) ([]string, error) {
+	files := defaultFilesToCopy
+	if len(manifestPath) != 0 {
+		blob, err := ioutil.ReadFile(manifestPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read copy manifest %q: %w", manifestPath, err)
+		}
+		files = nil
+		if strings.HasSuffix(manifestPath, ".json") {
+			if err := json.Unmarshal(blob, &files); err != nil {
+				return nil, fmt.Errorf("unable to parse copy manifest %q as a JSON list of paths: %w", manifestPath, err)
+			}
+		} else {
+			for _, l := range strings.Split(string(blob), "\n") {
+				l = strings.TrimSpace(l)
+				if len(l) == 0 || strings.HasPrefix(l, "#") {
+					continue
+				}
+				files = append(files, l)
+			}
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("copy manifest %q didn't list any files", manifestPath)
+		}
+	}
+	for _, f := range files {
+		if path.IsAbs(f) || strings.HasPrefix(path.Clean(f), "..") {
+			return nil, fmt.Errorf("path %q must be relative to the source directory %q", f, srcDir)
+		}
+		s, err := os.Stat(path.Join(srcDir, f))
+		if err != nil {
+			return nil, fmt.Errorf("unable to find %q in the source directory %q: %w", f, srcDir, err)
+		}
+		if s.IsDir() {
+			return nil, fmt.Errorf("%q in the source directory %q is a directory, want a file", f, srcDir)
+		}
+	}
+	return files, nil
+}
+
 // createTestRepo creates a Bazel repository that contains C++ & Java Hello World binary/test
 // targets configured to run remotely on RBE using the toolchain configs from the given manifest &
 // config tarball URL.
@@ -273,37 +623,150 @@ build:remote --java_toolchain=@bazel_tools//tools/jdk:toolchain_hostjdk8
 // srcDir is the path to the root of the locally cloned bazel-toolchains directory from where Hello
 // World C++ & Java source files will be copied from.
 //
+// files are the paths relative to srcDir of the files to copy into the test repository.
+//
 // outputDir is the path where the Bazel repository configured to build Hello World on RBE will be
 // created.
 //
-// rbeInst is the full name of the RBE instance the remote build will be run on.
-func createTestRepo(m *rbeconfigsgen.Manifest, configTarballURL, srcDir, outputDir, rbeInst string) error {
-	// For convenience only when locally running this test.
-	log.Printf("DELETING the contents of output directory %q but ignoring any errors.", outputDir)
-	os.RemoveAll(outputDir)
+// b is the remote execution backend the remote build will be run on.
+//
+// wt is the template used to generate the WORKSPACE file & auth is how the configs tarball is
+// authenticated in it.
+func createTestRepo(m *rbeconfigsgen.Manifest, configTarballURL, srcDir string, files []string, outputDir string, b rbeBackend, wt *template.Template, auth string) error {
 	if err := os.MkdirAll(outputDir, os.ModePerm); err != nil {
 		return fmt.Errorf("unable to create output directory %q: %v", outputDir, err)
 	}
 
-	log.Printf("Copying C++ & Java Hello World source files from examples to the specified output directory.")
-	for _, f := range filesToCopy {
+	logging.Infof("Copying %d source files from examples to the specified output directory.", len(files))
+	for _, f := range files {
 		if err := copyFile(path.Join(outputDir, f), path.Join(srcDir, f)); err != nil {
 			return fmt.Errorf("error copying %q from %q to %q: %v", f, srcDir, outputDir, err)
 		}
-		log.Printf("Copied %q from %q to %q.", f, srcDir, outputDir)
+		logging.Debugf("Copied %q from %q to %q.", f, srcDir, outputDir)
 	}
-	if err := createWorkspaceFile(m, configTarballURL, outputDir); err != nil {
+	if err := createWorkspaceFile(m, configTarballURL, outputDir, wt, auth); err != nil {
 		return fmt.Errorf("error creating the Bazel WORKSPACE file: %w", err)
 	}
-	if err := createBUILDFile(outputDir); err != nil {
+	if err := createBUILDFile(outputDir, manifestRepoName(m)); err != nil {
 		return fmt.Errorf("error creating the Bazel BUILD file: %w", err)
 	}
-	if err := createBazelrcFile(m, configTarballURL, outputDir, rbeInst); err != nil {
+	if err := createBazelrcFile(m, configTarballURL, outputDir, b); err != nil {
 		return fmt.Errorf("error creating the .bazelrc file: %w", err)
 	}
 	return nil
 }
 
+// outputDirContents returns the paths relative to the given output directory of all files &
+// directories in it in lexical order. Returns nothing if the directory doesn't exist.
+func outputDirContents(outputDir string) ([]string, error) {
+	var contents []string
+	err := filepath.Walk(outputDir, func(p string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == outputDir {
+			return nil
+		}
+		rel, err := filepath.Rel(outputDir, p)
+		if err != nil {
+			return err
+		}
+		contents = append(contents, rel)
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to list the contents of %q: %w", outputDir, err)
+	}
+	return contents, nil
+}
+
+// isParentOrSame returns whether the given absolute path 'dir' is 'p' or one of its parents.
+func isParentOrSame(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// checkSafeToDelete returns an error if the given output directory is obviously dangerous to
+// delete, i.e., it's the filesystem root, or it's or contains the home directory, the current
+// directory or one of the given protected directories.
+func checkSafeToDelete(outputDir string, protected ...string) error {
+	dir, err := filepath.Abs(outputDir)
+	if err != nil {
+		return fmt.Errorf("unable to determine the absolute path of %q: %w", outputDir, err)
+	}
+	if filepath.Dir(dir) == dir {
+		return fmt.Errorf("refusing to delete the filesystem root %q", dir)
+	}
+	named := map[string]string{}
+	if h, err := os.UserHomeDir(); err == nil {
+		named[h] = "home directory"
+	}
+	if wd, err := os.Getwd(); err == nil {
+		named[wd] = "current directory"
+	}
+	for _, p := range protected {
+		named[p] = "protected directory"
+	}
+	for p, name := range named {
+		a, err := filepath.Abs(p)
+		if err != nil {
+			return fmt.Errorf("unable to determine the absolute path of %q: %w", p, err)
+		}
+		if isParentOrSame(dir, a) {
+			return fmt.Errorf("refusing to delete %q because it's or contains the %s %q", dir, name, a)
+		}
+	}
+	return nil
+}
+
+// prepareOutputDir makes sure the given output directory is empty before the test repository is
+// created in it. A non-empty directory is only deleted if force is true & it's safe to delete per
+// checkSafeToDelete with srcDir protected. If dryRun is true, the contents that would be deleted
+// are only listed.
+func prepareOutputDir(outputDir, srcDir string, force, dryRun bool) error {
+	entries, err := ioutil.ReadDir(outputDir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to read output directory %q: %w", outputDir, err)
+	}
+	if len(entries) == 0 {
+		if dryRun {
+			logging.Infof("Dry run: output directory %q is empty or doesn't exist, nothing would be deleted.", outputDir)
+		}
+		return nil
+	}
+	// Check before listing the contents because dangerous directories tend to be huge.
+	if err := checkSafeToDelete(outputDir, srcDir); err != nil {
+		return err
+	}
+	contents, err := outputDirContents(outputDir)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		logging.Infof("Dry run: the following %d files & directories in output directory %q would be deleted with --force:", len(contents), outputDir)
+		for _, c := range contents {
+			logging.Infof("  %s", c)
+		}
+		return nil
+	}
+	if !force {
+		return fmt.Errorf("output directory %q isn't empty, specify --force to delete its %d files & directories or --dry_run to list them", outputDir, len(contents))
+	}
+	logging.Infof("DELETING the %d files & directories in output directory %q because --force was specified.", len(contents), outputDir)
+	if err := os.RemoveAll(outputDir); err != nil {
+		return fmt.Errorf("unable to delete the contents of output directory %q: %w", outputDir, err)
+	}
+	return nil
+}
+
+// validateRBEInstName validates the given instance name is in the format of Google Cloud's Remote
+// Build Execution instances.
 func validateRBEInstName(instName string) error {
 	wantFormat := "projects/<GCP project ID>/instances/<instance ID>"
 	splitName := strings.Split(instName, "/")
@@ -320,69 +783,178 @@ func validateRBEInstName(instName string) error {
 	return nil
 }
 
-// downloadBazelisk downloads Bazelisk for Linux to the given directory and returns the path to the
-// downloaded Bazelisk executable.
-func downloadBazelisk(outputDir string) (string, error) {
-	bazeliskURL, bazeliskFile, err := rbeconfigsgen.BazeliskDownloadInfo(rbeconfigsgen.OSLinux)
-	if err != nil {
-		return "", fmt.Errorf("unable to determine URL to download Bazelisk from for Linux: %w", err)
+// resolveRBEBackend returns the remote execution backend described by the --rbe_backend,
+// --remote_executor & --rbe_instance flags.
+func resolveRBEBackend() (rbeBackend, error) {
+	b, ok := rbeBackends[*rbeBackendName]
+	if !ok {
+		return rbeBackend{}, fmt.Errorf("unknown backend %q, want one of googleapis, buildbuddy, buildbarn or custom", *rbeBackendName)
 	}
-	resp, err := http.Get(bazeliskURL)
-	if err != nil {
-		return "", fmt.Errorf("unable to initialize the Bazelisk download from %q: %w", bazeliskURL, err)
+	if len(*remoteExecutor) != 0 {
+		b.executor = *remoteExecutor
 	}
-	defer resp.Body.Close()
-
-	bazeliskPath := path.Join(outputDir, bazeliskFile)
-	o, err := os.Create(bazeliskPath)
-	defer o.Close()
-
-	log.Printf("Downloading Bazelisk from %s to %s.", bazeliskURL, bazeliskPath)
-	if _, err := io.Copy(o, resp.Body); err != nil {
-		return "", fmt.Errorf("error while downloading Bazelisk from %q to %q: %w", bazeliskURL, bazeliskPath, err)
+	if len(b.executor) == 0 {
+		return rbeBackend{}, fmt.Errorf("--remote_executor is required because backend %q has no default endpoint", *rbeBackendName)
 	}
-
-	return bazeliskPath, nil
-
-}
-
-// runTestBuild runs the remote build using the toolchain configs using Bazelisk to pin the version
-// of Bazel.
-func runTestBuild(ctx context.Context, workingDir, bazelVersion string) error {
-	bazeliskPath, err := downloadBazelisk(workingDir)
-	if err != nil {
-		return fmt.Errorf("failed to download Bazelisk: %w", err)
+	if !strings.HasPrefix(b.executor, "grpc://") && !strings.HasPrefix(b.executor, "grpcs://") {
+		return rbeBackend{}, fmt.Errorf("remote executor endpoint %q must start with grpc:// or grpcs://", b.executor)
 	}
-	if err := os.Chmod(bazeliskPath, os.ModePerm); err != nil {
-		return fmt.Errorf("unable to update the permissions of downloaded Bazelisk binary %q to make it executable: %w", bazeliskPath, err)
+	b.instance = *rbeInstance
+	if len(b.instance) == 0 {
+		if b.requireInstance {
+			return rbeBackend{}, fmt.Errorf("--rbe_instance is required because --rbe_backend is %q", *rbeBackendName)
+		}
+		return b, nil
+	}
+	if len(strings.TrimSpace(b.instance)) == 0 {
+		return rbeBackend{}, fmt.Errorf("--rbe_instance=%q was blank", b.instance)
 	}
+	if b.validateInstance != nil {
+		if err := b.validateInstance(b.instance); err != nil {
+			return rbeBackend{}, fmt.Errorf("--rbe_instance=%q was invalid for --rbe_backend=%q: %w", b.instance, *rbeBackendName, err)
+		}
+	}
+	return b, nil
+}
 
-	args := []string{
-		// Use a custom output base to ensure Bazel runs with a clean local cache.
-		fmt.Sprintf("--output_base=%s/.bazelcache", workingDir),
-		"build",
-		// This selects all the options specified in the .bazelrc file with config:remote.
-		"--config=remote",
-		// Disable remote caching to ensure the commands constructed from the toolchain configs
-		// are actually valid.
-		"--noremote_accept_cached",
-		// License existence test.
-		"//:license_exists_test",
-		// Hello World compilation targets.
-		"//examples/..."}
+// runBazel runs Bazel with the given arguments in the given working directory using the Bazelisk
+// executable at the given path to pin the version of Bazel. The given startup flags are passed
+// before the arguments, i.e., before the Bazel command. Returns the combined output of Bazel.
+func runBazel(ctx context.Context, bazeliskPath, workingDir, bazelVersion string, startupFlags []string, args ...string) (string, error) {
+	cmd := args[0]
+	// Use a custom output base to ensure Bazel runs with a clean local cache.
+	startupFlags = append([]string{fmt.Sprintf("--output_base=%s/.bazelcache", workingDir)}, startupFlags...)
+	args = append(startupFlags, args...)
 	c := exec.CommandContext(ctx, bazeliskPath, args...)
 	c.Env = append(c.Env, fmt.Sprintf("USE_BAZEL_VERSION=%s", bazelVersion))
 	// Used by Bazelisk to determine where to download Bazel.
 	c.Env = append(c.Env, fmt.Sprintf("XDG_CACHE_HOME=%s/.bazeliskcache", workingDir))
 	c.Dir = workingDir
-	log.Printf("Running '%s %s' with env %v with working directory %q.", bazeliskPath, strings.Join(args, " "), c.Env, workingDir)
+	logging.Debugf("Running '%s %s' with env %v with working directory %q.", bazeliskPath, strings.Join(args, " "), c.Env, workingDir)
 	o, err := c.CombinedOutput()
 	if ctx.Err() == context.DeadlineExceeded {
-		return fmt.Errorf("bazel build was killed because the timeout was reached")
+		return "", fmt.Errorf("bazel %s was killed because the timeout was reached", cmd)
 	}
 	if err != nil {
 		log.Printf("Output from Bazel:\n%s", string(o))
-		return fmt.Errorf("bazel build failed: %w", err)
+		return "", fmt.Errorf("bazel %s failed: %w", cmd, err)
+	}
+	return string(o), nil
+}
+
+// testBuildOptions configure the Bazel invocations of the test build.
+type testBuildOptions struct {
+	// startupFlags are passed before the Bazel command of every invocation.
+	startupFlags []string
+	// buildFlags are added after the flags of the test build & tests so they take precedence.
+	buildFlags []string
+	// buildTargets are built in addition to the license existence test.
+	buildTargets []string
+	// testTargets are tested after the build succeeds. No tests are run if empty.
+	testTargets []string
+	// testCache repeats the build after a clean & expects every action to be served from the
+	// remote cache.
+	testCache bool
+}
+
+// testBuildArgs returns the arguments to Bazel to run the given command, i.e., "build" or "test",
+// remotely for the given targets. Remote cache hits are only accepted if acceptCached is true. The
+// given extra flags are added after the flags of the test build so they take precedence.
+func testBuildArgs(cmd string, acceptCached bool, extraFlags, targets []string) []string {
+	args := []string{
+		cmd,
+		// This selects all the options specified in the .bazelrc file with config:remote.
+		"--config=remote",
+	}
+	if !acceptCached {
+		// Disable remote caching to ensure the commands constructed from the toolchain configs
+		// are actually valid.
+		args = append(args, "--noremote_accept_cached")
+	}
+	args = append(args, extraFlags...)
+	return append(args, targets...)
+}
+
+// splitTargets returns the comma separated Bazel target patterns in the given string.
+func splitTargets(s string) []string {
+	var targets []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); len(t) != 0 {
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
+
+// verifyCacheHits verifies the process summary printed by Bazel in the given output reports that
+// every action was either served from the cache or run internally by Bazel.
+func verifyCacheHits(bazelOutput string) error {
+	s := processSummaryRegexp.FindAllStringSubmatch(bazelOutput, -1)
+	if len(s) == 0 {
+		return fmt.Errorf("output from Bazel didn't include a process summary line like 'INFO: <n> processes: ...'")
+	}
+	// Only the last summary refers to the complete build.
+	summary := s[len(s)-1][1]
+	for _, p := range strings.Split(summary, ",") {
+		p = strings.TrimSpace(p)
+		kind := strings.TrimSpace(strings.TrimLeft(p, "0123456789"))
+		if strings.HasSuffix(kind, "cache hit") || kind == "internal" {
+			continue
+		}
+		return fmt.Errorf("expected every action to be served from the cache but Bazel reported %q in process summary %q", p, summary)
+	}
+	return nil
+}
+
+// runTestBuild runs the remote build & tests using the toolchain configs according to the given
+// options using Bazelisk to pin the version of Bazel. The given release of Bazelisk is downloaded
+// using the given HTTP client unless the path to an existing Bazelisk executable is given. A
+// downloaded executable must have the given sha256 digest, which defaults to the digest of the
+// release known to rbe_configs_gen. An existing executable is only verified if a digest is given.
+func runTestBuild(ctx context.Context, c *http.Client, workingDir, bazelVersion, bazeliskPath, bazeliskVersion, bazeliskSHA256 string, bo testBuildOptions) error {
+	if len(bazeliskPath) == 0 {
+		logging.Infof("Downloading Bazelisk for %s/%s to %s.", runtime.GOOS, runtime.GOARCH, workingDir)
+		var err error
+		if bazeliskPath, err = rbeconfigsgen.DownloadBazelisk(c, runtime.GOOS, runtime.GOARCH, bazeliskVersion, workingDir, bazeliskSHA256); err != nil {
+			return fmt.Errorf("failed to download Bazelisk: %w", err)
+		}
+	} else {
+		logging.Infof("Using Bazelisk at %s instead of downloading it.", bazeliskPath)
+		if len(bazeliskSHA256) != 0 {
+			if err := rbeconfigsgen.VerifyBazelisk(bazeliskPath, bazeliskSHA256); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Chmod(bazeliskPath, os.ModePerm); err != nil {
+		return fmt.Errorf("unable to update the permissions of Bazelisk binary %q to make it executable: %w", bazeliskPath, err)
+	}
+
+	// The license existence test is always built to verify the configs include the license.
+	buildTargets := append([]string{"//:license_exists_test"}, bo.buildTargets...)
+	if _, err := runBazel(ctx, bazeliskPath, workingDir, bazelVersion, bo.startupFlags, testBuildArgs("build", false, bo.buildFlags, buildTargets)...); err != nil {
+		return err
+	}
+	if len(bo.testTargets) != 0 {
+		logging.Infof("Running tests %s remotely.", strings.Join(bo.testTargets, " "))
+		if _, err := runBazel(ctx, bazeliskPath, workingDir, bazelVersion, bo.startupFlags, testBuildArgs("test", false, bo.buildFlags, bo.testTargets)...); err != nil {
+			return err
+		}
+	}
+	if !bo.testCache {
+		return nil
+	}
+	logging.Infof("Repeating the test build after a clean to verify actions are served from the remote cache.")
+	if _, err := runBazel(ctx, bazeliskPath, workingDir, bazelVersion, bo.startupFlags, "clean"); err != nil {
+		return err
+	}
+	o, err := runBazel(ctx, bazeliskPath, workingDir, bazelVersion, bo.startupFlags, testBuildArgs("build", true, bo.buildFlags, buildTargets)...)
+	if err != nil {
+		return fmt.Errorf("cached build failed: %w", err)
+	}
+	if err := verifyCacheHits(o); err != nil {
+		log.Printf("Output from Bazel:\n%s", o)
+		return fmt.Errorf("cached build executed actions: %w", err)
 	}
 	return nil
 }
@@ -390,42 +962,127 @@ func runTestBuild(ctx context.Context, workingDir, bazelVersion string) error {
 // printFlag prints flag values with the intent of allowing easy copy paste of flags to rerun this
 // binary.
 func printFlags() {
-	log.Println("configs_e2e.go \\")
-	log.Printf("--manifest_url=%q \\", *manifestURL)
-	log.Printf("--configs_url=%q \\", *configsURL)
-	log.Printf("--src_root=%q \\", *srcRoot)
-	log.Printf("--dest_root=%q \\", *destRoot)
-	log.Printf("--rbe_instance=%q \\", *rbeInstance)
-	log.Printf("--timeout_seconds=%d \\", *timeoutSeconds)
-	log.Printf("--enable_monitoring=%v \\", *enableMonitoring)
-	log.Printf("--monitoring_project_id=%q \\", *monitoringProjectID)
-	log.Printf("--monitoring_docker_image=%q", *monitoringDockerImage)
+	logging.Infof("configs_e2e.go \\")
+	logging.Infof("--manifest_url=%q \\", *manifestURL)
+	logging.Infof("--configs_url=%q \\", *configsURL)
+	logging.Infof("--src_root=%q \\", *srcRoot)
+	logging.Infof("--dest_root=%q \\", *destRoot)
+	if *force {
+		logging.Infof("--force=%v \\", *force)
+	}
+	if *dryRun {
+		logging.Infof("--dry_run=%v \\", *dryRun)
+	}
+	logging.Infof("--rbe_instance=%q \\", *rbeInstance)
+	logging.Infof("--rbe_backend=%q \\", *rbeBackendName)
+	logging.Infof("--remote_executor=%q \\", *remoteExecutor)
+	if len(*workspaceTemplateFile) != 0 {
+		logging.Infof("--workspace_template=%q \\", *workspaceTemplateFile)
+	}
+	if *workspaceAuth != workspaceAuthNone {
+		logging.Infof("--workspace_auth=%q \\", *workspaceAuth)
+	}
+	if len(*copyManifest) != 0 {
+		logging.Infof("--copy_manifest=%q \\", *copyManifest)
+	}
+	logging.Infof("--timeout_seconds=%d \\", *timeoutSeconds)
+	if len(*registryCACert) != 0 {
+		logging.Infof("--registry_ca_cert=%q \\", *registryCACert)
+	}
+	if *insecureRegistry {
+		logging.Infof("--insecure_registry=%v \\", *insecureRegistry)
+	}
+	if len(*httpUserAgent) != 0 {
+		logging.Infof("--http_user_agent=%q \\", *httpUserAgent)
+	}
+	if *httpTimeoutSeconds != 300 {
+		logging.Infof("--http_timeout_seconds=%d \\", *httpTimeoutSeconds)
+	}
+	if *httpRetries != 3 {
+		logging.Infof("--http_retries=%d \\", *httpRetries)
+	}
+	if *strict {
+		logging.Infof("--strict=%v \\", *strict)
+	}
+	if len(*bazeliskPath) != 0 {
+		logging.Infof("--bazelisk_path=%q \\", *bazeliskPath)
+	}
+	if len(*bazeliskVersion) != 0 {
+		logging.Infof("--bazelisk_version=%q \\", *bazeliskVersion)
+	}
+	if len(*bazeliskSHA256) != 0 {
+		logging.Infof("--bazelisk_sha256=%q \\", *bazeliskSHA256)
+	}
+	for _, f := range *extraStartupFlags {
+		logging.Infof("--extra_startup_flag=%q \\", f)
+	}
+	for _, f := range *extraBuildFlags {
+		logging.Infof("--extra_build_flag=%q \\", f)
+	}
+	if *buildTargets != "//examples/..." {
+		logging.Infof("--build_targets=%q \\", *buildTargets)
+	}
+	if len(*testTargets) != 0 {
+		logging.Infof("--test_targets=%q \\", *testTargets)
+	}
+	if *compareRemote {
+		logging.Infof("--compare_remote=%v \\", *compareRemote)
+	}
+	if len(*newManifest) != 0 {
+		logging.Infof("--new_manifest=%q \\", *newManifest)
+	}
+	if len(*newTarball) != 0 {
+		logging.Infof("--new_tarball=%q \\", *newTarball)
+	}
+	if *testCacheBehavior {
+		logging.Infof("--test_cache_behavior=%v \\", *testCacheBehavior)
+	}
+	logging.Infof("--log_level=%q \\", *logLevel)
+	logging.Infof("--enable_monitoring=%v \\", *enableMonitoring)
+	logging.Infof("--monitoring_project_id=%q \\", *monitoringProjectID)
+	logging.Infof("--monitoring_docker_image=%q", *monitoringDockerImage)
 }
 
 // runTest is the core e2e test logic allowing the caller a convenient wrapper to
 // report results to monitoring before triggering a fatal exit.
-func runTest(ctx context.Context) error {
-	m, err := downloadManifest(*manifestURL)
+func runTest(ctx context.Context, b rbeBackend, files []string, wt *template.Template) error {
+	c, err := rbeconfigsgen.NewHTTPClient(*registryCACert, *insecureRegistry, *httpUserAgent)
+	if err != nil {
+		return fmt.Errorf("unable to initialize the HTTP client for downloads: %w", err)
+	}
+	c.Timeout = time.Duration(*httpTimeoutSeconds) * time.Second
+	m, err := downloadManifest(c, *manifestURL, *httpRetries, *strict)
 	if err != nil {
 		return fmt.Errorf("unable to download the manifest from %q: %w", *manifestURL, err)
 	}
-	log.Printf("Successfully downloaded the JSON manifest from %s", *manifestURL)
+	logging.Infof("Successfully downloaded the JSON manifest from %s", *manifestURL)
+	tarballURL, err := configsTarballURL(m, *configsURL)
+	if err != nil {
+		return err
+	}
 
-	if err := verifyConfigSHA(m, *configsURL); err != nil {
+	if err := verifyConfigSHA(c, m, tarballURL, *httpRetries); err != nil {
 		return fmt.Errorf("failed to cross-check configs digest specified in the manifest with the configs tarball: %w", err)
 	}
 
-	log.Printf("Creating a new Bazel test repository at %q.", *destRoot)
+	logging.Infof("Creating a new Bazel test repository at %q.", *destRoot)
 
-	if err := createTestRepo(m, *configsURL, *srcRoot, *destRoot, *rbeInstance); err != nil {
+	if err := createTestRepo(m, tarballURL, *srcRoot, files, *destRoot, b, wt, *workspaceAuth); err != nil {
 		return fmt.Errorf("error creating the test Bazel repository: %w", err)
 	}
 
 	ctxWithTimeout, cancel := context.WithTimeout(ctx, time.Duration(*timeoutSeconds)*time.Second)
 	defer cancel()
-	log.Printf("Running test build for Bazel %s using configs downloaded from %s with timeout set to %d seconds.", m.BazelVersion, *configsURL, *timeoutSeconds)
-	if err := runTestBuild(ctxWithTimeout, *destRoot, m.BazelVersion); err != nil {
-		return fmt.Errorf("test build for Bazel %s using configs downloaded from %s failed on RBE Instance %s: %w", m.BazelVersion, *configsURL, *rbeInstance, err)
+	logging.Infof("Running test build for Bazel %s using configs downloaded from %s with timeout set to %d seconds.", m.BazelVersion, tarballURL, *timeoutSeconds)
+	bo := testBuildOptions{
+		startupFlags: *extraStartupFlags,
+		buildFlags:   *extraBuildFlags,
+		buildTargets: splitTargets(*buildTargets),
+		testTargets:  splitTargets(*testTargets),
+		testCache:    *testCacheBehavior,
+	}
+	if err := runTestBuild(ctxWithTimeout, c, *destRoot, m.BazelVersion, *bazeliskPath, *bazeliskVersion, *bazeliskSHA256, bo); err != nil {
+		return fmt.Errorf("test build for Bazel %s using configs downloaded from %s failed on remote executor %s: %w", m.BazelVersion, tarballURL, b.executor, err)
 	}
 	return nil
 }
@@ -449,13 +1106,25 @@ func initMonitoringClient(ctx context.Context) (*monitoring.Client, error) {
 
 func main() {
 	flag.Parse()
+	if err := logging.Configure(*logLevel, *quiet); err != nil {
+		log.Fatalf("Invalid --log_level: %v", err)
+	}
 	printFlags()
 
 	if len(*manifestURL) == 0 {
 		log.Fatalf("--manifest_url was not specified.")
 	}
-	if len(*configsURL) == 0 {
-		log.Fatalf("--configs_url was not specified.")
+	if *httpTimeoutSeconds < 0 {
+		log.Fatalf("--http_timeout_seconds must not be negative, got %d.", *httpTimeoutSeconds)
+	}
+	if *httpRetries < 0 {
+		log.Fatalf("--http_retries must not be negative, got %d.", *httpRetries)
+	}
+	if *compareRemote {
+		os.Exit(runCompareRemote())
+	}
+	if len(*newManifest) != 0 || len(*newTarball) != 0 {
+		log.Fatalf("--new_manifest & --new_tarball can only be specified with --compare_remote.")
 	}
 	if len(*srcRoot) == 0 {
 		log.Fatalf("--src_root was not specified.")
@@ -463,15 +1132,57 @@ func main() {
 	if len(*destRoot) == 0 {
 		log.Fatalf("--dest_root was not specified.")
 	}
-	if len(*rbeInstance) == 0 {
-		log.Fatalf("--rbe_instance was not specified.")
-	}
-	if err := validateRBEInstName(*rbeInstance); err != nil {
-		log.Fatalf("--rbe_instance=%q was invalid: %v", *rbeInstance, err)
+	b, err := resolveRBEBackend()
+	if err != nil {
+		log.Fatalf("Invalid remote execution backend: %v", err)
 	}
 	if *timeoutSeconds <= 0 {
 		log.Fatalf("--timeout_seconds was either not specified or negative.")
 	}
+	if len(splitTargets(*buildTargets)) == 0 {
+		log.Fatalf("--build_targets must specify at least one target pattern.")
+	}
+	for _, f := range append(append([]string{}, *extraStartupFlags...), *extraBuildFlags...) {
+		if !strings.HasPrefix(f, "-") {
+			log.Fatalf("Invalid --extra_startup_flag or --extra_build_flag %q, want a Bazel flag starting with '--'.", f)
+		}
+	}
+	*bazeliskSHA256 = strings.ToLower(strings.TrimPrefix(*bazeliskSHA256, "sha256:"))
+	if len(*bazeliskSHA256) != 0 && !sha256Regexp.MatchString(*bazeliskSHA256) {
+		log.Fatalf("Invalid --bazelisk_sha256 %q, want 64 hex characters.", *bazeliskSHA256)
+	}
+	if len(*bazeliskPath) != 0 && len(*bazeliskVersion) != 0 {
+		log.Fatalf("--bazelisk_version can't be specified with --bazelisk_path because Bazelisk isn't downloaded.")
+	}
+	if len(*bazeliskPath) != 0 {
+		p, err := filepath.Abs(*bazeliskPath)
+		if err != nil {
+			log.Fatalf("Unable to determine the absolute path of --bazelisk_path=%q: %v", *bazeliskPath, err)
+		}
+		if _, err := os.Stat(p); err != nil {
+			log.Fatalf("Invalid --bazelisk_path: %v", err)
+		}
+		// Bazel runs in --dest_root so relative paths wouldn't resolve.
+		*bazeliskPath = p
+	}
+	files, err := loadFilesToCopy(*copyManifest, *srcRoot)
+	if err != nil {
+		log.Fatalf("Invalid set of files to copy from --src_root: %v", err)
+	}
+	wt, err := loadWorkspaceTemplate(*workspaceTemplateFile)
+	if err != nil {
+		log.Fatalf("Invalid --workspace_template: %v", err)
+	}
+	if *workspaceAuth != workspaceAuthNone && *workspaceAuth != workspaceAuthNetrc {
+		log.Fatalf("Invalid --workspace_auth %q, want one of %s or %s.", *workspaceAuth, workspaceAuthNone, workspaceAuthNetrc)
+	}
+
+	if err := prepareOutputDir(*destRoot, *srcRoot, *force, *dryRun); err != nil {
+		log.Fatalf("Unable to prepare --dest_root: %v", err)
+	}
+	if *dryRun {
+		return
+	}
 
 	ctx := context.Background()
 	mc, err := initMonitoringClient(ctx)
@@ -480,11 +1191,11 @@ func main() {
 	}
 
 	result := true
-	if err := runTest(ctx); err != nil {
+	if err := runTest(ctx, b, files, wt); err != nil {
 		log.Printf("Config E2E test failed: %v", err)
 		result = false
 	} else {
-		log.Printf("Config E2E test passed.")
+		logging.Infof("Config E2E test passed.")
 	}
 
 	// Monitoring is optional and used for internal alerting by the owners of this repo only.
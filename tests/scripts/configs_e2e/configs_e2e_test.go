@@ -0,0 +1,251 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIsParentOrSame(t *testing.T) {
+	sep := string(filepath.Separator)
+	root := filepath.Join(sep, "work")
+	tests := []struct {
+		name string
+		dir  string
+		p    string
+		want bool
+	}{
+		{name: "Same", dir: root, p: root, want: true},
+		{name: "Parent", dir: root, p: filepath.Join(root, "src"), want: true},
+		{name: "Grandparent", dir: root, p: filepath.Join(root, "src", "lib"), want: true},
+		{name: "Filesystem root", dir: sep, p: root, want: true},
+		{name: "Child", dir: filepath.Join(root, "src"), p: root, want: false},
+		{name: "Sibling", dir: filepath.Join(root, "out"), p: filepath.Join(root, "src"), want: false},
+		{name: "Sibling with common prefix", dir: filepath.Join(root, "src"), p: filepath.Join(root, "src2"), want: false},
+		{name: "Child named like a parent reference", dir: root, p: filepath.Join(root, "..src"), want: true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if got := isParentOrSame(tc.dir, tc.p); got != tc.want {
+				t.Errorf("isParentOrSame(%q, %q)=%v, want %v", tc.dir, tc.p, got, tc.want)
+			}
+		})
+	}
+}
+
+// setHome points the home directory returned by os.UserHomeDir at the given directory until the
+// test finishes.
+func setHome(t *testing.T, dir string) {
+	for _, env := range []string{"HOME", "USERPROFILE"} {
+		old, ok := os.LookupEnv(env)
+		os.Setenv(env, dir)
+		env := env
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(env, old)
+			} else {
+				os.Unsetenv(env)
+			}
+		})
+	}
+}
+
+func TestCheckSafeToDelete(t *testing.T) {
+	// The home directory & the source root are in separate directories so that deleting the
+	// parent of one is only refused because of it.
+	tmp := t.TempDir()
+	home := filepath.Join(tmp, "home")
+	srcRoot := filepath.Join(t.TempDir(), "src", "bazel-toolchains")
+	setHome(t, home)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Unable to determine the current directory: %v", err)
+	}
+	tests := []struct {
+		name    string
+		dir     string
+		wantErr string
+	}{
+		{
+			name: "Unrelated directory",
+			dir:  filepath.Join(tmp, "out"),
+		},
+		{
+			name: "Child of the home directory",
+			dir:  filepath.Join(home, "out"),
+		},
+		{
+			name: "Child of the current directory",
+			dir:  filepath.Join(wd, "out"),
+		},
+		{
+			name:    "Filesystem root",
+			dir:     string(filepath.Separator),
+			wantErr: "filesystem root",
+		},
+		{
+			name:    "Home directory",
+			dir:     home,
+			wantErr: "home directory",
+		},
+		{
+			name:    "Parent of the home directory",
+			dir:     tmp,
+			wantErr: "home directory",
+		},
+		{
+			name:    "Current directory",
+			dir:     wd,
+			wantErr: "current directory",
+		},
+		{
+			name:    "Current directory relative",
+			dir:     ".",
+			wantErr: "current directory",
+		},
+		{
+			name:    "Parent of the current directory",
+			dir:     filepath.Dir(wd),
+			wantErr: "current directory",
+		},
+		{
+			name:    "Source root",
+			dir:     srcRoot,
+			wantErr: "protected directory",
+		},
+		{
+			name:    "Parent of the source root",
+			dir:     filepath.Dir(srcRoot),
+			wantErr: "protected directory",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkSafeToDelete(tc.dir, srcRoot)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkSafeToDelete(%q) failed: %v", tc.dir, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("checkSafeToDelete(%q)=%v, want error containing %q", tc.dir, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestPrepareOutputDir(t *testing.T) {
+	tmp := t.TempDir()
+	setHome(t, filepath.Join(tmp, "home"))
+	srcRoot := filepath.Join(tmp, "src")
+	tests := []struct {
+		name string
+		// files are created in the output directory before it's prepared. The output directory
+		// isn't created if nil.
+		files  []string
+		dir    string
+		force  bool
+		dryRun bool
+		// wantErr is a substring of the expected error, if any.
+		wantErr string
+		// wantKept is whether the files in the output directory are expected to be left alone.
+		wantKept bool
+	}{
+		{
+			name: "Missing directory",
+			dir:  filepath.Join(tmp, "missing"),
+		},
+		{
+			name:  "Empty directory",
+			files: []string{},
+			dir:   filepath.Join(tmp, "empty"),
+		},
+		{
+			name:     "Non-empty directory without force",
+			files:    []string{"WORKSPACE", "BUILD"},
+			dir:      filepath.Join(tmp, "noforce"),
+			wantErr:  "specify --force",
+			wantKept: true,
+		},
+		{
+			name:     "Dry run",
+			files:    []string{"WORKSPACE"},
+			dir:      filepath.Join(tmp, "dryrun"),
+			force:    true,
+			dryRun:   true,
+			wantKept: true,
+		},
+		{
+			name:  "Non-empty directory with force",
+			files: []string{"WORKSPACE", "BUILD"},
+			dir:   filepath.Join(tmp, "force"),
+			force: true,
+		},
+		{
+			name:     "Source root with force",
+			files:    []string{"WORKSPACE"},
+			dir:      srcRoot,
+			force:    true,
+			wantErr:  "protected directory",
+			wantKept: true,
+		},
+		{
+			name:     "Home directory with force",
+			files:    []string{".bashrc"},
+			dir:      filepath.Join(tmp, "home"),
+			force:    true,
+			wantErr:  "home directory",
+			wantKept: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.files != nil {
+				if err := os.MkdirAll(tc.dir, 0755); err != nil {
+					t.Fatalf("Unable to create the output directory: %v", err)
+				}
+				for _, f := range tc.files {
+					if err := ioutil.WriteFile(filepath.Join(tc.dir, f), nil, 0644); err != nil {
+						t.Fatalf("Unable to create file %q in the output directory: %v", f, err)
+					}
+				}
+			}
+			err := prepareOutputDir(tc.dir, srcRoot, tc.force, tc.dryRun)
+			if tc.wantErr == "" && err != nil {
+				t.Errorf("prepareOutputDir(%q, force=%v, dryRun=%v) failed: %v", tc.dir, tc.force, tc.dryRun, err)
+			}
+			if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Errorf("prepareOutputDir(%q, force=%v, dryRun=%v)=%v, want error containing %q", tc.dir, tc.force, tc.dryRun, err, tc.wantErr)
+			}
+			contents, err := outputDirContents(tc.dir)
+			if err != nil {
+				t.Fatalf("Unable to list the output directory after preparing it: %v", err)
+			}
+			if tc.wantKept && len(contents) != len(tc.files) {
+				t.Errorf("prepareOutputDir(%q) left the files %v in the output directory, want %v", tc.dir, contents, tc.files)
+			}
+			if !tc.wantKept && len(contents) != 0 {
+				t.Errorf("prepareOutputDir(%q) left the files %v in the output directory, want it empty", tc.dir, contents)
+			}
+		})
+	}
+}